@@ -4,61 +4,155 @@
 package auth
 
 import (
+	"context"
+	crand "crypto/rand"
+	"encoding/base64"
 	"errors"
-	"fmt"
 	"net/http"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/cwbriscoe/goutil/logging"
+	"github.com/cwbriscoe/goutil/net"
+	"github.com/cwbriscoe/goweb/clock"
+	"github.com/cwbriscoe/goweb/cookies"
+	"github.com/cwbriscoe/goweb/correlate"
 	"github.com/cwbriscoe/goweb/limiter"
+	"github.com/cwbriscoe/goweb/privacy"
+	"github.com/cwbriscoe/goweb/query"
 	"github.com/cwbriscoe/goweb/tracker"
 	"github.com/goccy/go-json"
 	"github.com/golang-jwt/jwt/v4"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
-	"github.com/julienschmidt/httprouter"
 	"golang.org/x/exp/slices"
 )
 
+// Router is the part of the http router used to add the auth endpoints.  Both the
+// server.Router implementations and *httprouter.Router satisfy it.
+type Router interface {
+	HandlerFunc(method, path string, handler http.HandlerFunc)
+}
+
 // Config stores the settings used for all auth requests
 type Config struct {
-	Issuer             string             // what authority will be issuing the jwt tokens
-	SecretPath         string             // path to the file with the secrets
-	Router             *httprouter.Router // router used to add auth http endpoints
-	AccessExpire       time.Duration      // how long before the access tokens will expire
-	RefreshExpire      time.Duration      // how long before the refresh tokens will expire
-	UserRate           time.Duration      // max rate that a user can make any auth request
-	GlobalRate         time.Duration      // max rate that all users can make any auth request
-	LimiterLogger      *logging.Logger    // the rate limiter logger
-	DB                 *pgxpool.Pool      // database connection to retrieve stored auth data
-	Log                *logging.Logger    // logger for logging auth state changes
-	EnableRegistration bool               // feature flag to enable or disable new registration
+	Issuer             string                   // what authority will be issuing the jwt tokens
+	SecretPath         string                   // path to the file with the secrets
+	Router             Router                   // router used to add auth http endpoints
+	AccessExpire       time.Duration            // how long before the access tokens will expire
+	RefreshExpire      time.Duration            // how long before the refresh tokens will expire
+	SlidingExpire      bool                     // extend the refresh token expiry by RefreshExpire on activity
+	MaxLifetime        time.Duration            // absolute max lifetime of a session regardless of activity, 0 = unlimited
+	UserRate           time.Duration            // max rate that a user can make any auth request
+	GlobalRate         time.Duration            // max rate that all users can make any auth request
+	Tarpit             limiter.Tarpit           // how the auth limiter handles flagged bad bots
+	LimitPage          limiter.Page             // optional, the "slow down" page of the browsers rejected by the auth limiter
+	DisableLimiter     bool                     // serve the auth endpoints without the rate limiter, ie: in load tests
+	LimiterLogger      *logging.Logger          // the rate limiter logger
+	Limiters           *limiter.Registry        // shared with the limiters of the server, the default registry when nil
+	Tracker            *tracker.Tracker         // writes the tracking cookie, the default tracker set up with the cookie attributes when nil
+	Anonymizer         *privacy.Anonymizer      // optional, anonymizes ip addresses in the logs
+	DB                 *pgxpool.Pool            // database connection to retrieve stored auth data
+	Log                *logging.Logger          // logger for logging auth state changes
+	EnableRegistration bool                     // feature flag to enable or disable new registration
+	Schema             string                   // database schema with the auth tables, defaults to "usr"
+	SameSite           map[string]http.SameSite // SameSite mode per cookie name (access, refresh, session), defaults to lax
+	HostPrefix         bool                     // prefix the auth cookie names with __Host-, requires the default domain and path
+	CookiePrefix       string                   // added to the cookie names so several apps can share a domain, ie: "shop_"
+	CookieDomain       string                   // Domain attribute of the cookies, defaults to the host that set them
+	CookiePath         string                   // Path attribute of the cookies, defaults to "/"
+	InsecureCookies    bool                     // omit the Secure attribute so the cookies work over plain http in local development
+	Partitioned        bool                     // add the CHIPS Partitioned attribute to the auth cookies
+	ChunkCookies       bool                     // split auth cookies over the browser size limit into chunks, they are only logged otherwise
+	RoleBits           []string                 // roles sent as a bitmap in the httpOnly tokens to keep them small, only ever append to it
+	OpaqueTokens       bool                     // cookies carry random tokens and the claims are kept in the token table, so clients can't read them
+	TokenCache         time.Duration            // how long opaque tokens read from the db are cached, defaults to 30s
+	CORS               *CORS                    // lets a single page app on another origin call the auth endpoints
+	PreserveTrackerID  bool                     // keep the anonymous tracking id on signin instead of rotating it
+	MaxSessions        int                      // max active sessions per user, 0 = unlimited
+	SessionLimit       SessionLimitPolicy       // what to do when a signin would exceed MaxSessions
+	AdminRoutes        bool                     // add the /auth/admin/ user and role endpoints, they require the admin scope
+	Mailer             Mailer                   // sends password reset emails, the /auth/reset/ endpoints are only added when set
+	ResetURL           string                   // page the reset link points to, the token is added as ?token=
+	ResetExpire        time.Duration            // how long a reset link is valid, defaults to an hour
+	Hasher             Hasher                   // hashes new passwords, defaults to argon2id, outdated hashes are replaced on signin
+	SlowDown           *SlowDown                // delay added to password checks, defaults to 200-250ms, &SlowDown{} disables it
+	Sleeper            Sleeper                  // waits for the SlowDown delays, time.Sleep when nil
+	Clock              clock.Clock              // tells the time of the token expiries, clock.Real when nil
+	Rand               clock.Rand               // draws the SlowDown jitter, clock.RealRand when nil
+	ReadOnly           func() bool              // optional, true while the db must not be written: refresh tokens are not rotated
+	TrackerData        TrackerData              // optional, the analytics kept by tracking id, exported and deleted with the account
 }
 
+// SessionLimitPolicy decides what happens when a user signs in while already
+// having Config.MaxSessions active sessions.
+type SessionLimitPolicy int
+
+const (
+	// RevokeOldest deletes the oldest sessions so the new signin fits within the limit.
+	RevokeOldest SessionLimitPolicy = iota
+	// RefuseSignin rejects the new signin until an existing session ends.
+	RefuseSignin
+)
+
 // Auth contains the config
 type Auth struct {
-	config  *Config          // copy of the config settings
-	secret  []byte           // secret used for signing the jwt
-	key     []byte           // secret used to encrypt hashed passwords
-	pepper  string           // secret used for adding pepper to passwords before hashing
-	log     *logging.Logger  // logger for logging auth state changes
-	limiter *limiter.Limiter // the request limiter to help mitigate ddos
+	config   *Config                       // copy of the config settings
+	secret   []byte                        // secret used for signing the jwt with HS256
+	keys     atomic.Pointer[[]*signingKey] // key pairs used for signing the jwt, newest first
+	key      []byte                        // secret used to encrypt hashed passwords
+	pepper   string                        // secret used for adding pepper to passwords before hashing
+	hasher   Hasher                        // hashes new passwords
+	dummy    dummyHash                     // compared with the passwords of unknown users
+	log      *logging.Logger               // logger for logging auth state changes
+	limiter  *limiter.Limiter              // the request limiter to help mitigate ddos
+	tracker  *tracker.Tracker              // writes the tracking cookie
+	schema   query.Schema                  // database schema with the auth tables
+	slowdown SlowDown                      // artificial delay of password checks
+	sleeper  Sleeper                       // waits for the artificial delays
+	clock    clock.Clock                   // tells the time of the token expiries
+	rand     clock.Rand                    // draws the jitter of the artificial delays
+	stale    sync.Map                      // user id -> time the users roles or sessions last changed, read from the db
+	merge    mergeHooks                    // move the rows of the app when users are merged
+	tokens   tokenCache                    // claims of the opaque tokens recently read
+	nonces   nonceStore                    // refresh token nonces of the sessions
+	cors     *corsPolicy                   // origins allowed to call the auth endpoints, nil when none are
+	ctx      context.Context               // canceled by Close to stop the background goroutines
+	cancel   context.CancelFunc
 }
 
 type claims struct {
 	jwt.RegisteredClaims
 	Permissions []string `json:"scope"`
+	RoleBits    uint64   `json:"rb,omitempty"`    // roles of Config.RoleBits, expanded into Permissions when read
+	Nonce       string   `json:"nonce,omitempty"` // only set in refresh tokens, rotated on every use
+}
+
+// validTimes returns true if the claims are not expired and were not issued in the
+// future according to the clock of the auth.
+func (a *Auth) validTimes(c *claims) bool {
+	now := a.clock.Now()
+	return c.VerifyExpiresAt(now, false) && c.VerifyIssuedAt(now, false) && c.VerifyNotBefore(now, false)
 }
 
+// rotationGrace is how long the refresh token replaced by a rotation is still accepted,
+// so concurrent requests of the same browser that all carried it are not seen as reuse.
+const rotationGrace = 30 * time.Second
+
+// errTokenReuse is returned when a refresh token that was already rotated is used again.
+var errTokenReuse = errors.New("refresh token reused")
+
 type signin struct {
-	User        string    `json:"user"` // read from client
-	Pass        string    `json:"pass"` // read from client
+	User        string    `json:"user" validate:"required"` // read from client
+	Pass        string    `json:"pass" validate:"required"` // read from client
 	id          int       // the users internal id
 	permissions []string  // the access of the user
-	session     int       // the users internal session id
+	session     int64     // the users internal session id
+	nonce       string    // nonce of the current refresh token of the session
 	expires     time.Time // the time the refresh token expires
 }
 
@@ -67,17 +161,69 @@ func NewAuth(config *Config) *Auth {
 	a := &Auth{
 		config: config,
 		log:    config.Log,
+		schema: DefaultSchema,
+	}
+	a.ctx, a.cancel = context.WithCancel(context.Background())
+	a.nonces = dbNonces{a}
+
+	if config.Schema != "" {
+		a.schema = query.Schema(config.Schema)
+	}
+
+	a.hasher = config.Hasher
+	if a.hasher == nil {
+		a.hasher = &Argon2id{}
+	}
+
+	a.slowdown = defaultSlowDown
+	if config.SlowDown != nil {
+		a.slowdown = *config.SlowDown
+	}
+	a.sleeper = config.Sleeper
+	if a.sleeper == nil {
+		a.sleeper = SleeperFunc(time.Sleep)
+	}
+	a.clock = config.Clock
+	if a.clock == nil {
+		a.clock = clock.Real
+	}
+	a.rand = config.Rand
+
+	if err := a.checkCookieConfig(); err != nil {
+		panic(err)
+	}
+	cors, err := newCORSPolicy(config.CORS)
+	if err != nil {
+		panic(err)
+	}
+	a.cors = cors
+
+	// the tracking cookie is written by the tracker package, give it the same attributes.
+	a.tracker = config.Tracker
+	if a.tracker == nil {
+		a.tracker = tracker.New(tracker.CookieOptions{
+			Name:        a.cookieName("id"),
+			ConsentName: a.cookieName("consent"),
+			Domain:      a.config.CookieDomain,
+			Path:        a.cookiePath(),
+			Insecure:    a.config.InsecureCookies,
+			Clock:       a.config.Clock,
+		})
 	}
 
 	// load the secrets
 	a.loadSecrets(a.config.SecretPath)
 
 	// init api limiter
-	var err error
 	a.limiter, err = limiter.NewLimiter(
 		&limiter.LimitSettings{
-			Name: "auth",
-			Log:  a.config.LimiterLogger,
+			Name:       "auth",
+			Log:        a.config.LimiterLogger,
+			Anonymizer: a.config.Anonymizer,
+			Registry:   a.config.Limiters,
+			Tracker:    a.tracker,
+			Page:       a.config.LimitPage,
+			Clock:      a.config.Clock,
 			UserRate: limiter.Rate{
 				Interval:   a.config.UserRate,
 				Burst:      4,
@@ -86,7 +232,10 @@ func NewAuth(config *Config) *Auth {
 			GlobalRate: limiter.Rate{
 				Interval: a.config.GlobalRate,
 				Burst:    4,
+				MaxWait:  5 * time.Second,
+				MaxShare: 2,
 			},
+			Tarpit: a.config.Tarpit,
 		})
 	if err != nil {
 		panic(err)
@@ -94,47 +243,126 @@ func NewAuth(config *Config) *Auth {
 
 	a.addRoutes()
 
+	// kick off go routine to read the access tokens expired by the other servers
+	go func() {
+		ticker := time.NewTicker(staleInterval)
+		defer ticker.Stop()
+		for {
+			if err := a.loadStale(a.ctx); err != nil && a.ctx.Err() == nil {
+				a.log.Err(err).Msg("goroutine: error reading the expired access tokens")
+			}
+			select {
+			case <-a.ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
 	// kick off go routine to purge expires sessions
 	go func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
 		for {
-			time.Sleep(time.Hour)
-			if err := a.purgeExpiredSessions(); err != nil {
-				a.log.Err(err).Msg("goroutine: error purging expired sessions")
+			select {
+			case <-a.ctx.Done():
+				return
+			case <-ticker.C:
 			}
+			a.purge(a.ctx)
 		}
 	}()
 
 	return a
 }
 
-func (a *Auth) loadSecrets(path string) {
-	type secrets struct {
-		JWTKey string `json:"jwtkey"`
-		EncKey string `json:"enckey"`
-		Pepper string `json:"pepper"`
+// purge deletes the expired sessions, reset links and opaque tokens.  The errors of a
+// purge canceled by Close are not logged.
+func (a *Auth) purge(ctx context.Context) {
+	if err := a.purgeExpiredSessions(ctx); err != nil && ctx.Err() == nil {
+		a.log.Err(err).Msg("goroutine: error purging expired sessions")
 	}
+	if err := a.purgeResets(ctx); err != nil && ctx.Err() == nil {
+		a.log.Err(err).Msg("goroutine: error purging expired reset tokens")
+	}
+	a.purgeStale()
+	if a.config.OpaqueTokens {
+		if err := a.purgeTokens(ctx); err != nil && ctx.Err() == nil {
+			a.log.Err(err).Msg("goroutine: error purging expired opaque tokens")
+		}
+	}
+}
 
+// Close stops the background goroutines of the auth and cancels their queries.  Call it
+// before closing the db pool, they would keep querying it otherwise.
+func (a *Auth) Close() {
+	if a.cancel != nil {
+		a.cancel()
+	}
+}
+
+// secrets is the layout of the secrets file.  Tokens are signed with jwtkey (HS256)
+// unless key pairs are listed in jwtKeys.  Keep jwtkey while migrating to key pairs, so
+// the tokens signed before the switch stay valid until they expire.
+type secrets struct {
+	JWTKey  string      `json:"jwtkey"`
+	JWTKeys []KeyConfig `json:"jwtKeys"`
+	EncKey  string      `json:"enckey"`
+	Pepper  string      `json:"pepper"`
+}
+
+func readSecrets(path string) (*secrets, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	secret := &secrets{}
-	err = json.Unmarshal(data, secret)
+	if err = json.Unmarshal(data, secret); err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+func (a *Auth) loadSecrets(path string) {
+	secret, err := readSecrets(path)
+	if err != nil {
+		panic(err)
+	}
+
+	keys, err := parseKeys(secret.JWTKeys)
 	if err != nil {
 		panic(err)
 	}
+	if len(keys) == 0 && secret.JWTKey == "" {
+		panic(errors.New("auth: the secrets need a jwtkey or jwtKeys"))
+	}
 
 	a.secret = []byte(secret.JWTKey)
+	a.keys.Store(&keys)
 	a.key = []byte(secret.EncKey)
 	a.pepper = secret.Pepper
 }
 
+// clientGone returns true if err was caused by the client closing the request, which
+// is logged as such instead of as a db error.
+func (a *Auth) clientGone(r *http.Request, err error, op string) bool {
+	if !errors.Is(err, context.Canceled) || r.Context().Err() == nil {
+		return false
+	}
+	correlate.Log(r.Context(), a.log).Info().Msgf("%s: client closed request", op)
+	return true
+}
+
 // AuthHandler wraps functions that need authentication before executing.  If
 // authentication fails, we return status 401 NotAuthorized.
 func (a *Auth) AuthHandler(access string, f http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		claims, success := a.getClaims(r, "access")
+		if success && a.isStale(claims) {
+			// the roles changed after the access token was issued
+			success = false
+		}
 		if !success {
 			// no access token found, we need to revalidate permissions using the refresh token if it exists
 			claims, success = a.revalidate(w, r)
@@ -148,32 +376,80 @@ func (a *Auth) AuthHandler(access string, f http.HandlerFunc) http.HandlerFunc {
 			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
+		if id, name, err := subjectID(claims); err == nil {
+			r = r.WithContext(context.WithValue(r.Context(), userKey{}, &User{ID: id, Name: name, Permissions: claims.Permissions}))
+		}
 		f(w, r)
 	}
 }
 
+// HasScope returns true if the access token of the request grants the scope.  Unlike
+// AuthHandler it never refreshes the token or redirects, so public routes can use it to
+// unlock extra behavior for signed in users.
+func (a *Auth) HasScope(r *http.Request, scope string) bool {
+	claims, success := a.getClaims(r, "access")
+	if !success || a.isStale(claims) {
+		return false
+	}
+	return slices.Contains(claims.Permissions, scope)
+}
+
+// SignedIn returns true if the request carries a valid access or refresh token.  Like
+// HasScope it never refreshes the tokens, so it is cheap enough to tell the signed in
+// users apart while the server sheds load.
+func (a *Auth) SignedIn(r *http.Request) bool {
+	if claims, ok := a.getClaims(r, "access"); ok && !a.isStale(claims) {
+		return true
+	}
+	_, ok := a.getClaims(r, "refresh")
+	return ok
+}
+
+// User is the signed in user of a request that passed AuthHandler.
+type User struct {
+	ID          int
+	Name        string
+	Permissions []string
+}
+
+type userKey struct{}
+
+// UserFromContext returns the user stored by AuthHandler or nil.
+func UserFromContext(ctx context.Context) *User {
+	user, _ := ctx.Value(userKey{}).(*User)
+	return user
+}
+
 func (a *Auth) revalidate(w http.ResponseWriter, r *http.Request) (*claims, bool) {
+	log := correlate.Log(r.Context(), a.log)
+
 	claims, success := a.getClaims(r, "refresh")
 	if !success {
 		return nil, false
 	}
 
+	// enforce the absolute session lifetime even if the refresh token has been extended.
+	if a.config.MaxLifetime > 0 && claims.IssuedAt != nil && a.clock.Now().Sub(claims.IssuedAt.Time) > a.config.MaxLifetime {
+		log.Info().Msgf("revalidate: %s session exceeded max lifetime", claims.Subject)
+		return nil, false
+	}
+
 	// setup signin struct using data from the refesh token
 	creds := strings.Split(claims.Subject, "|")
 	if len(creds) != 2 {
-		a.log.Warn().Msgf("revalidate: claims.Subject had a length != 2")
+		log.Warn().Msgf("revalidate: claims.Subject had a length != 2")
 		return nil, false
 	}
 
 	id, err := strconv.Atoi(creds[0])
 	if err != nil {
-		a.log.Warn().Msgf("revalidate: atoi failed to convert string id to int")
+		log.Warn().Msgf("revalidate: atoi failed to convert string id to int")
 		return nil, false
 	}
 
-	sess, err := strconv.Atoi(claims.ID)
+	sess, err := sessionID(claims)
 	if err != nil {
-		a.log.Warn().Msgf("revalidate: atoi failed to convert string sess to int")
+		log.Warn().Msgf("revalidate: failed to parse the session id")
 		return nil, false
 	}
 
@@ -182,31 +458,49 @@ func (a *Auth) revalidate(w http.ResponseWriter, r *http.Request) (*claims, bool
 		id:      id,
 		session: sess,
 	}
+	if claims.ExpiresAt != nil {
+		info.expires = claims.ExpiresAt.Time
+	}
 
-	// revalidate permissions with the db
-	if err = a.revalidateSecurityInfo(info); err != nil {
-		if err == pgx.ErrNoRows {
-			a.log.Warn().Msgf("revalidate: %s no longer exists in db", claims.Subject+"|"+claims.ID)
-			return nil, false
-		}
-		a.log.Err(err).Msg("revalidate: error revalidating with the db")
+	// slide the refresh expiration forward, but never past the max lifetime.
+	if a.config.SlidingExpire {
+		info.expires = a.refreshExpiration(claims.IssuedAt)
+		claims.ExpiresAt = jwt.NewNumericDate(info.expires)
+	}
+
+	// opaque tokens can't be stored in read-only mode, the user stays signed out until
+	// the site is writable again.
+	if a.config.OpaqueTokens && a.readOnly() {
+		log.Info().Msgf("revalidate: %s not refreshed in read-only mode", claims.Subject)
 		return nil, false
 	}
 
-	// kick off goroutine to update timestamp of last session revalidation
-	go func() {
-		if err := a.updateSessionTimestamp(info); err != nil {
-			a.log.Err(err).Msg("revalidate: error updating session timestamp")
+	// revalidate permissions with the db and rotate the refresh token
+	refresh, err := a.rotateRefresh(r.Context(), info, claims)
+	if err != nil {
+		if errors.Is(err, errTokenReuse) {
+			a.revokeReused(w, r, info)
+			return nil, false
 		}
-	}()
-
-	// recreate the refesh token using all the original information except for possibly updated permissions.
-	claims.Permissions = info.permissions
-	if err := a.setAuthCookie(w, "refresh", claims, true); err != nil {
-		a.log.Err(err).Msgf("revalidate: failed to create refresh token")
+		if errors.Is(err, pgx.ErrNoRows) {
+			log.Warn().Msgf("revalidate: %s no longer exists in db", claims.Subject+"|"+claims.ID)
+			return nil, false
+		}
+		if a.clientGone(r, err, "revalidate") {
+			return nil, false
+		}
+		log.Err(err).Msg("revalidate: error rotating the refresh token")
 		return nil, false
 	}
 
+	a.setCookie(w, &http.Cookie{
+		Name:     "refresh",
+		Value:    refresh,
+		Expires:  claims.ExpiresAt.Time,
+		HttpOnly: true,
+	})
+	claims.Nonce = ""
+
 	// change vars that we want to hide or show differently for the user cookie.
 	// change back to old values before writing the access cookie.
 	accessSubject := claims.Subject
@@ -215,41 +509,158 @@ func (a *Auth) revalidate(w http.ResponseWriter, r *http.Request) (*claims, bool
 	claims.ID = ""
 
 	// recreate the user token
-	if err := a.setAuthCookie(w, "session", claims, false); err != nil {
-		a.log.Err(err).Msgf("revalidate: failed to create user token")
+	if err := a.setAuthCookie(r.Context(), w, "session", claims, false); err != nil {
+		log.Err(err).Msgf("revalidate: failed to create user token")
 		return nil, false
 	}
 
 	// recreate the access token
-	expirationTime := time.Now().Add(a.config.AccessExpire)
+	expirationTime := a.clock.Now().Add(a.config.AccessExpire)
 	claims.ExpiresAt = jwt.NewNumericDate(expirationTime)
 	claims.Subject = accessSubject
 	claims.ID = accessID
-	if err := a.setAuthCookie(w, "access", claims, true); err != nil {
-		a.log.Err(err).Msgf("revalidate: failed to create access token")
+	if err := a.setAuthCookie(r.Context(), w, "access", claims, true); err != nil {
+		log.Err(err).Msgf("revalidate: failed to create access token")
 		return nil, false
 	}
 
 	// set tracking cookie
-	if _, err := r.Cookie("id"); err != nil {
-		if err := tracker.CreateAuthTracker(w, info.User, info.permissions); err != nil {
-			a.log.Err(err).Msg("revalidate: failed to create tracking token")
+	if _, err := a.cookie(r, "id"); err != nil {
+		if err := a.tracker.CreateAuthTracker(w, info.User, a.trackerScope(info.permissions)); err != nil {
+			log.Err(err).Msg("revalidate: failed to create tracking token")
 			return nil, false
 		}
 	}
 
-	a.log.Info().Msgf("%s access token refreshed", claims.Subject)
+	log.Info().Msgf("%s access token refreshed", claims.Subject)
 
 	return claims, true
 }
 
+// rotateRefresh revalidates the session, gives it a new refresh token nonce and returns
+// the new refresh token of claims.  The token is created before the rotation is written
+// so the old token stays valid when it can't be.  A refresh token with an older nonce
+// was copied from the browser and is being replayed, unless it was replaced moments ago
+// by a concurrent request.  The session also gets a new id when the user was granted a
+// role that is not in the token.
+func (a *Auth) rotateRefresh(ctx context.Context, info *signin, claims *claims) (string, error) {
+	nonce, roles := claims.Nonce, claims.Permissions
+	state, err := a.nonces.load(ctx, info)
+	if err != nil {
+		return "", err
+	}
+	// the token may carry the id the session had before its last rotation.
+	info.session = state.id
+
+	if nonce == state.current && a.readOnly() {
+		// the session can't be written, the refresh token keeps its nonce.
+		info.nonce = nonce
+		return a.refreshToken(ctx, info, claims)
+	}
+	if nonce == state.current {
+		info.nonce, err = newNonce()
+		if err != nil {
+			return "", err
+		}
+		if elevated(roles, info.permissions) {
+			if info.session, err = newSessionID(); err != nil {
+				return "", err
+			}
+		}
+		token, err := a.refreshToken(ctx, info, claims)
+		if err != nil {
+			return "", err
+		}
+		rotated, err := a.nonces.rotate(ctx, info, state.id, nonce)
+		if err != nil {
+			return "", err
+		}
+		if rotated {
+			return token, nil
+		}
+		// a concurrent request rotated the nonce first
+		if state, err = a.nonces.load(ctx, info); err != nil {
+			return "", err
+		}
+		info.session = state.id
+	}
+
+	if nonce != "" && nonce == state.previous && a.clock.Now().Sub(state.rotated) < rotationGrace {
+		info.nonce = state.current
+		return a.refreshToken(ctx, info, claims)
+	}
+
+	return "", errTokenReuse
+}
+
+// refreshToken returns the refresh token of claims with the session, nonce and
+// possibly updated permissions of info.
+func (a *Auth) refreshToken(ctx context.Context, info *signin, claims *claims) (string, error) {
+	claims.Permissions = info.permissions
+	claims.ID = strconv.FormatInt(info.session, 10)
+	claims.Nonce = info.nonce
+	return a.token(ctx, claims, true)
+}
+
+// readOnly reports whether the db must not be written.
+func (a *Auth) readOnly() bool {
+	return a.config.ReadOnly != nil && a.config.ReadOnly()
+}
+
+// revokeReused ends a session whose refresh token was reused.  Both the thief and the
+// owner are signed out since there is no way to tell them apart.
+func (a *Auth) revokeReused(w http.ResponseWriter, r *http.Request, info *signin) {
+	ip := a.config.Anonymizer.IP(net.GetIP(r))
+	correlate.Log(r.Context(), a.log).Warn().Msgf("security: %d|%s refresh token reused from %s, session %d revoked", info.id, info.User, ip, info.session)
+
+	log := correlate.Log(correlate.Detach(r.Context()), a.log)
+	go func() {
+		if err := a.deleteSession(info.id, info.session); err != nil {
+			log.Err(err).Msg("revalidate: error deleting reused session")
+		}
+		if _, err := a.schema.Exec(context.Background(), a.config.DB, qInsertAudit, info.id, "refresh token reuse", ip); err != nil {
+			log.Err(err).Msg("revalidate: error writing audit record")
+		}
+	}()
+
+	a.revokeCookieTokens(r)
+	a.deleteCookie(w, "session")
+	a.deleteCookie(w, "access")
+	a.deleteCookie(w, "refresh")
+}
+
+// newNonce returns a random refresh token nonce.
+func newNonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := crand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
 func (a *Auth) getClaims(r *http.Request, cookie string) (*claims, bool) {
+	log := correlate.Log(r.Context(), a.log)
+
 	// We can obtain the session token from the requests cookies, which come with every request
-	c, err := r.Cookie(cookie)
+	c, err := a.cookie(r, cookie)
 	if err != nil {
 		return nil, false
 	}
 
+	if a.config.OpaqueTokens {
+		claims, err := a.lookupToken(r.Context(), c.Value)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, false
+		}
+		if err != nil {
+			if !a.clientGone(r, err, "opaque token") {
+				log.Err(err).Msg("error reading opaque token")
+			}
+			return nil, false
+		}
+		return claims, true
+	}
+
 	// Get the JWT string from the cookie
 	tokenStr := c.Value
 
@@ -258,84 +669,167 @@ func (a *Auth) getClaims(r *http.Request, cookie string) (*claims, bool) {
 
 	// Parse the JWT string and store the result in `claims`.
 	// Note that we are passing the key in this method as well. This method will return an error
-	// if the token is invalid (if it has expired according to the expiry time we set on sign in),
-	// or if the signature does not match
-	token, err := jwt.ParseWithClaims(tokenStr, claims, func(token *jwt.Token) (any, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			// verify that the algorith is what we expect.
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return a.secret, nil
-	})
+	// if the signature does not match.  The expiry is checked with the clock of the auth.
+	token, err := jwt.ParseWithClaims(tokenStr, claims, a.verifyKey, jwt.WithValidMethods(a.validMethods()), jwt.WithoutClaimsValidation())
 	if err != nil {
-		if err == jwt.ErrTokenExpired {
-			// token probably expired in flight, need to revalidate
-			return nil, false
-		}
 		if err == jwt.ErrSignatureInvalid {
-			a.log.Err(err).Msg("invalid signature")
+			log.Err(err).Msg("invalid signature")
 			return nil, false
 		}
-		a.log.Err(err).Msg("bad request")
+		log.Err(err).Msg("bad request")
 		return nil, false
 	}
 	if !token.Valid {
-		a.log.Err(errors.New("jwt.ParseWithClaims returned an invalid token")).Msg("invalid token")
+		log.Err(errors.New("jwt.ParseWithClaims returned an invalid token")).Msg("invalid token")
 		return nil, false
 	}
+	if !a.validTimes(claims) {
+		// token probably expired in flight, need to revalidate
+		return nil, false
+	}
+	if claims.RoleBits != 0 {
+		claims.Permissions = expandRoles(a.config.RoleBits, claims.RoleBits, claims.Permissions)
+		claims.RoleBits = 0
+	}
 
 	return claims, true
 }
 
-func (a *Auth) createTokens(w http.ResponseWriter, info *signin) error {
+func (a *Auth) createTokens(w http.ResponseWriter, r *http.Request, info *signin) error {
+	log := correlate.Log(r.Context(), a.log)
+
 	// declare the expiration time of the token.
-	expirationTime := time.Now().Add(a.config.AccessExpire)
+	now := a.clock.Now()
+	expirationTime := now.Add(a.config.AccessExpire)
 	// create the JWT claims, which includes the username and expiry time
 	claims := &claims{
 		Permissions: info.permissions,
 		RegisteredClaims: jwt.RegisteredClaims{
 			Issuer:    a.config.Issuer,
 			Subject:   strconv.Itoa(info.id) + "|" + info.User,
-			ID:        strconv.Itoa(info.session),
+			ID:        strconv.FormatInt(info.session, 10),
 			ExpiresAt: jwt.NewNumericDate(expirationTime),
+			IssuedAt:  jwt.NewNumericDate(now),
 		},
 	}
 
 	// set the access cookie
-	if err := a.setAuthCookie(w, "access", claims, true); err != nil {
-		a.log.Err(err).Msg("createTokens: error setting access cookie")
+	if err := a.setAuthCookie(r.Context(), w, "access", claims, true); err != nil {
+		log.Err(err).Msg("createTokens: error setting access cookie")
 		return err
 	}
 
 	// set the refresh cookie
 	claims.ExpiresAt = jwt.NewNumericDate(info.expires)
-	if err := a.setAuthCookie(w, "refresh", claims, true); err != nil {
-		a.log.Err(err).Msg("createTokens: error setting refresh cookie")
+	claims.Nonce = info.nonce
+	if err := a.setAuthCookie(r.Context(), w, "refresh", claims, true); err != nil {
+		log.Err(err).Msg("createTokens: error setting refresh cookie")
 		return err
 	}
+	claims.Nonce = ""
 
 	// set session cookie
 	claims.Subject = info.User
 	claims.ID = ""
-	if err := a.setAuthCookie(w, "session", claims, false); err != nil {
-		a.log.Err(err).Msg("createTokens: error setting session cookie")
+	if err := a.setAuthCookie(r.Context(), w, "session", claims, false); err != nil {
+		log.Err(err).Msg("createTokens: error setting session cookie")
 		return err
 	}
 
 	// set tracking cookie
-	if err := tracker.CreateAuthTracker(w, info.User, info.permissions); err != nil {
-		a.log.Err(err).Msg("createTokens: error setting tracking cookie")
+	if err := a.createAuthTracker(w, r, info); err != nil {
+		log.Err(err).Msg("createTokens: error setting tracking cookie")
 		return err
 	}
 
 	return nil
 }
 
-func (a *Auth) setAuthCookie(w http.ResponseWriter, name string, claims *claims, httpOnly bool) error {
-	// declare the token with the algorithm used for signing, and the claims.
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	// create the JWT string
-	tokenString, err := token.SignedString(a.secret)
+// createAuthTracker writes the authenticated tracking cookie.  The anonymous tracking id
+// is either kept or rotated depending on the config, and the link between the anonymous
+// id, the new id and the account is recorded so analytics can follow the visitor.  An
+// id that is already linked to another user, kept or new, is regenerated.
+func (a *Auth) createAuthTracker(w http.ResponseWriter, r *http.Request, info *signin) error {
+	var anonID string
+	if anon := a.tracker.ReadTrackingInfo(r); anon != nil && !anon.Auth {
+		anonID = anon.ID
+	}
+
+	if a.config.PreserveTrackerID && anonID != "" {
+		used, err := a.trackerIDUsed(r.Context(), anonID, info.id)
+		if err != nil {
+			return err
+		}
+		if !used {
+			if err = a.tracker.CreateAuthTrackerWithID(w, anonID, info.User, a.trackerScope(info.permissions)); err != nil {
+				return err
+			}
+			go a.linkTracker(correlate.Detach(r.Context()), anonID, anonID, info.id)
+			return nil
+		}
+		correlate.Log(r.Context(), a.log).Warn().Msgf("tracker: kept id %s is linked to another user, regenerating", anonID)
+	}
+
+	id, err := a.newTrackerID(r.Context(), info.id)
+	if err != nil {
+		return err
+	}
+	if err = a.tracker.CreateAuthTrackerWithID(w, id, info.User, a.trackerScope(info.permissions)); err != nil {
+		return err
+	}
+	go a.linkTracker(correlate.Detach(r.Context()), id, anonID, info.id)
+	return nil
+}
+
+// maxTrackerAttempts is how many random tracking ids are tried before giving up, a
+// collision is already unlikely with 128 random bits.
+const maxTrackerAttempts = 3
+
+// errTrackerCollision is returned when every random tracking id was already linked to
+// another user.
+var errTrackerCollision = errors.New("tracking id collision")
+
+// newTrackerID returns a random tracking id that is not linked to another user, so the
+// analytics of two accounts are never merged.
+func (a *Auth) newTrackerID(ctx context.Context, authID int) (string, error) {
+	for i := 0; i < maxTrackerAttempts; i++ {
+		id, err := tracker.NewID()
+		if err != nil {
+			return "", err
+		}
+		used, err := a.trackerIDUsed(ctx, id, authID)
+		if err != nil {
+			return "", err
+		}
+		if !used {
+			return id, nil
+		}
+		correlate.Log(ctx, a.log).Warn().Msgf("tracker: id %s is linked to another user, regenerating", id)
+	}
+	return "", errTrackerCollision
+}
+
+func (a *Auth) linkTracker(ctx context.Context, trackerID, anonID string, authID int) {
+	if err := a.insertTrackerLink(trackerID, anonID, authID); err != nil {
+		correlate.Log(ctx, a.log).Err(err).Msg("linkTracker: error recording tracker link")
+	}
+}
+
+// refreshExpiration returns when a refresh token should expire, capped by the
+// max session lifetime measured from when the session was issued.
+func (a *Auth) refreshExpiration(issued *jwt.NumericDate) time.Time {
+	expires := a.clock.Now().Add(a.config.RefreshExpire)
+	if a.config.MaxLifetime > 0 && issued != nil {
+		limit := issued.Add(a.config.MaxLifetime)
+		if expires.After(limit) {
+			expires = limit
+		}
+	}
+	return expires
+}
+
+func (a *Auth) setAuthCookie(ctx context.Context, w http.ResponseWriter, name string, claims *claims, httpOnly bool) error {
+	tokenString, err := a.token(ctx, claims, httpOnly)
 	if err != nil {
 		// if there is an error in creating the JWT return an internal server error
 		w.WriteHeader(http.StatusInternalServerError)
@@ -344,28 +838,50 @@ func (a *Auth) setAuthCookie(w http.ResponseWriter, name string, claims *claims,
 
 	// finally, we set the client cookie for "token" as the JWT we just generated
 	// we also set an expiry time which is the same as the token itself
-	http.SetCookie(w, &http.Cookie{
+	a.setCookie(w, &http.Cookie{
 		Name:     name,
 		Value:    tokenString,
-		Path:     "/",
 		Expires:  claims.ExpiresAt.Time,
-		Secure:   true,
 		HttpOnly: httpOnly,
-		SameSite: http.SameSiteLaxMode,
 	})
 
 	return nil
 }
 
-func (*Auth) deleteCookie(w http.ResponseWriter, name string) {
-	http.SetCookie(w, &http.Cookie{
+// token returns the value of an auth cookie, an opaque token or the signed claims.
+func (a *Auth) token(ctx context.Context, claims *claims, httpOnly bool) (string, error) {
+	if a.config.OpaqueTokens {
+		return a.storeToken(ctx, claims)
+	}
+
+	// the session cookie is read by scripts, so it keeps the role names.
+	signed := claims
+	if httpOnly && len(a.config.RoleBits) > 0 {
+		compact := *claims
+		compact.RoleBits, compact.Permissions = compactRoles(a.config.RoleBits, claims.Permissions)
+		signed = &compact
+	}
+
+	// create the JWT string
+	return a.sign(signed)
+}
+
+func (a *Auth) deleteCookie(w http.ResponseWriter, name string) {
+	c := &http.Cookie{
 		Name:     name,
 		Value:    "",
-		Path:     "/",
 		Expires:  time.Unix(0, 0),
 		MaxAge:   -1,
-		Secure:   true,
 		HttpOnly: true,
-		SameSite: http.SameSiteLaxMode,
-	})
+	}
+	if !a.config.ChunkCookies {
+		a.setCookie(w, c)
+		return
+	}
+
+	// the cookie may have been split, its chunks have to go too.
+	a.applyCookieConfig(c)
+	for _, del := range cookies.Expire(c) {
+		a.writeCookie(w, del)
+	}
 }
@@ -5,10 +5,18 @@ package auth
 import (
 	"context"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/cwbriscoe/goutil/logging"
+	"github.com/cwbriscoe/goweb/clock"
+	"github.com/golang-jwt/jwt/v4"
 	"github.com/jackc/pgx/v5"
+	"github.com/rs/zerolog"
 )
 
 /*
@@ -25,16 +33,19 @@ import (
 var conn *pgx.Conn
 
 // TestMain will completely delete and recreate the auth schema
-// in the database pointed to by the GOWEBDB environment variable
+// in the database pointed to by the GOWEBDB environment variable, the tests
+// that do not need it still run when it is unreachable
 func TestMain(m *testing.M) {
 	var err error
 	ctx := context.Background()
 
 	conn, err = pgx.Connect(ctx, os.Getenv("GOWEBDB"))
 	if err != nil {
-		fmt.Println("error connecting to database:")
+		// the tests that need the database skip themselves when conn is nil.
+		fmt.Println("skipping the database tests, error connecting to database:")
 		fmt.Println(err.Error())
-		os.Exit(1)
+		conn = nil
+		os.Exit(m.Run())
 	}
 
 	err = CreateSchema(ctx, conn)
@@ -46,3 +57,69 @@ func TestMain(m *testing.M) {
 
 	os.Exit(m.Run())
 }
+
+// newTestAuth returns an auth signing its tokens with an HMAC secret.
+func newTestAuth() *Auth {
+	log := zerolog.Nop()
+	a := &Auth{config: &Config{AccessExpire: time.Minute}, secret: []byte("secret"), clock: clock.Real, log: &logging.Logger{Logger: &log}}
+	a.keys.Store(&[]*signingKey{})
+	return a
+}
+
+func TestSignedIn(t *testing.T) {
+	a := newTestAuth()
+	token := func(expires time.Duration) string {
+		s, err := a.sign(&claims{RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   "1|chris",
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(expires)),
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	tests := []struct {
+		name    string
+		cookies map[string]string
+		want    bool
+	}{
+		{"anonymous", nil, false},
+		{"access", map[string]string{"access": token(time.Minute)}, true},
+		{"refresh", map[string]string{"access": token(-time.Minute), "refresh": token(time.Hour)}, true},
+		{"forged", map[string]string{"refresh": "anything"}, false},
+		{"expired", map[string]string{"refresh": token(-time.Minute)}, false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		for name, value := range tt.cookies {
+			r.AddCookie(&http.Cookie{Name: name, Value: value})
+		}
+		if got := a.SignedIn(r); got != tt.want {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestReloadKeysEmpty(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secrets.json")
+	if err := os.WriteFile(path, []byte(`{"jwtKeys":[]}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	a := newTestAuth()
+	a.config.SecretPath = path
+	if err := a.ReloadKeys(); err != nil {
+		t.Errorf("expected the jwtkey to sign the tokens, got %v", err)
+	}
+
+	a.secret = nil
+	keys := []*signingKey{{kid: "current"}}
+	a.keys.Store(&keys)
+	if err := a.ReloadKeys(); err == nil {
+		t.Error("expected an error for a secrets file without keys")
+	}
+	if len(*a.keys.Load()) != 1 {
+		t.Error("expected the current keys to stay in use")
+	}
+}
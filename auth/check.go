@@ -0,0 +1,63 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/cwbriscoe/goweb/query"
+	"github.com/jackc/pgx/v5"
+)
+
+var qSampleHash = query.Query{
+	Name: "sampleHash",
+	SQL:  "select hash from {schema}.auth where {live} limit 1;",
+}
+
+// CheckSecrets verifies the secrets file at config.SecretPath can be used without
+// starting the auth handlers: the signing keys parse, the encryption key is a valid
+// aes key and, when config.DB is set, it decrypts a password hash stored in the db.
+func CheckSecrets(ctx context.Context, config *Config) error {
+	secret, err := readSecrets(config.SecretPath)
+	if err != nil {
+		return err
+	}
+
+	keys, err := parseKeys(secret.JWTKeys)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 && secret.JWTKey == "" {
+		return errors.New("auth: the secrets need a jwtkey or jwtKeys")
+	}
+
+	key := []byte(secret.EncKey)
+	if _, err = encrypt([]byte("check"), key); err != nil {
+		return fmt.Errorf("auth: enckey: %w", err)
+	}
+
+	if config.DB == nil {
+		return nil
+	}
+
+	schema := query.Schema(DefaultSchema)
+	if config.Schema != "" {
+		schema = query.Schema(config.Schema)
+	}
+
+	var hash string
+	err = schema.QueryRow(ctx, config.DB, qSampleHash).Scan(&hash)
+	if errors.Is(err, pgx.ErrNoRows) {
+		// no users yet, nothing was encrypted with the key.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if _, err = decrypt(hash, key); err != nil {
+		return fmt.Errorf("auth: enckey does not decrypt the stored password hashes: %w", err)
+	}
+	return nil
+}
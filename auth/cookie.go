@@ -0,0 +1,154 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package auth
+
+import (
+	"errors"
+	"math/bits"
+	"net/http"
+	"slices"
+
+	"github.com/cwbriscoe/goweb/cookies"
+)
+
+// hostPrefix is the cookie prefix that browsers only accept on secure cookies with
+// a path of / and no domain, which locks the cookie to the exact host that set it.
+const hostPrefix = "__Host-"
+
+// maxRoleBits is the most roles a token carries as a bitmap.
+const maxRoleBits = 64
+
+// checkCookieConfig returns an error for cookie settings browsers would reject.
+func (a *Auth) checkCookieConfig() error {
+	if a.config.HostPrefix && (a.config.CookieDomain != "" || a.cookiePath() != "/" || a.config.InsecureCookies) {
+		return errors.New("auth: HostPrefix cookies must be secure with no domain and a path of /")
+	}
+	if a.config.Partitioned && a.config.InsecureCookies {
+		return errors.New("auth: Partitioned cookies must be secure")
+	}
+	if len(a.config.RoleBits) > maxRoleBits {
+		return errors.New("auth: RoleBits can't have more than 64 roles")
+	}
+	return nil
+}
+
+// CookieName returns the name the named auth cookie ("access", "refresh", "session"
+// or "id") is stored under in the browser.
+func (a *Auth) CookieName(name string) string {
+	return a.cookieName(name)
+}
+
+// cookieName returns the name the named auth cookie is stored under in the browser.
+func (a *Auth) cookieName(name string) string {
+	name = a.config.CookiePrefix + name
+	if a.config.HostPrefix && name != a.config.CookiePrefix+"id" {
+		return hostPrefix + name
+	}
+	return name
+}
+
+// cookiePath returns the Path attribute of the cookies.
+func (a *Auth) cookiePath() string {
+	if a.config.CookiePath != "" {
+		return a.config.CookiePath
+	}
+	return "/"
+}
+
+// sameSite returns the SameSite mode for the named cookie.
+func (a *Auth) sameSite(name string) http.SameSite {
+	if mode, ok := a.config.SameSite[name]; ok && mode != http.SameSiteDefaultMode {
+		return mode
+	}
+	return http.SameSiteLaxMode
+}
+
+// cookie reads the named auth cookie from the request, reassembled from its chunks if
+// it was split.
+func (a *Auth) cookie(r *http.Request, name string) (*http.Cookie, error) {
+	name = a.cookieName(name)
+	value, err := cookies.Join(r, name)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Cookie{Name: name, Value: value}, nil
+}
+
+// setCookie applies the configured name, domain, path, SameSite mode, Secure flag and
+// partitioning to the cookie before writing it.  A cookie browsers would drop is split
+// into chunks with ChunkCookies, otherwise it is written anyway and logged.
+func (a *Auth) setCookie(w http.ResponseWriter, c *http.Cookie) {
+	a.applyCookieConfig(c)
+	if cookies.Fits(c) {
+		a.writeCookie(w, c)
+		return
+	}
+
+	if !a.config.ChunkCookies {
+		a.log.Warn().Msgf("auth: cookie %s is %d bytes, over the %d browsers keep", c.Name, cookies.Size(c), cookies.MaxSize)
+		a.writeCookie(w, c)
+		return
+	}
+
+	parts, err := cookies.Split(c)
+	if err != nil {
+		a.log.Err(err).Msgf("auth: cookie %s is %d bytes", c.Name, cookies.Size(c))
+		a.writeCookie(w, c)
+		return
+	}
+	for _, part := range parts {
+		a.writeCookie(w, part)
+	}
+}
+
+// applyCookieConfig applies the configured name, domain, path, SameSite mode and
+// Secure flag to the cookie.
+func (a *Auth) applyCookieConfig(c *http.Cookie) {
+	name := c.Name
+	c.Name = a.cookieName(name)
+	c.Domain = a.config.CookieDomain
+	c.Path = a.cookiePath()
+	c.SameSite = a.sameSite(name)
+	c.Secure = !a.config.InsecureCookies
+}
+
+// writeCookie writes a cookie the config was applied to, partitioned if configured.
+func (a *Auth) writeCookie(w http.ResponseWriter, c *http.Cookie) {
+	if !a.config.Partitioned {
+		http.SetCookie(w, c)
+		return
+	}
+
+	// CHIPS (Cookies Having Independent Partitioned State) requires the
+	// Partitioned attribute which must be combined with Secure.
+	c.Secure = true
+	if v := c.String(); v != "" {
+		w.Header().Add("Set-Cookie", v+"; Partitioned")
+	}
+}
+
+// compactRoles moves the roles of perms found in known to a bitmap, the bit of a role
+// is its index in known.  It returns the bitmap and the roles left.
+func compactRoles(known, perms []string) (uint64, []string) {
+	var set uint64
+	rest := make([]string, 0, len(perms))
+	for _, perm := range perms {
+		if i := slices.Index(known, perm); i >= 0 && i < maxRoleBits {
+			set |= 1 << i
+			continue
+		}
+		rest = append(rest, perm)
+	}
+	return set, rest
+}
+
+// expandRoles returns perms with the roles of the bitmap added back.
+func expandRoles(known []string, set uint64, perms []string) []string {
+	out := make([]string, 0, len(perms)+bits.OnesCount64(set))
+	for i, role := range known {
+		if i < maxRoleBits && set&(1<<i) != 0 {
+			out = append(out, role)
+		}
+	}
+	return append(out, perms...)
+}
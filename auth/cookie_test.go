@@ -0,0 +1,29 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package auth
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestCompactRoles(t *testing.T) {
+	known := []string{"user", "admin", "editor"}
+
+	set, rest := compactRoles(known, []string{"admin", "beta", "user"})
+	if set != 0b011 {
+		t.Errorf("expected bits 011, got %b", set)
+	}
+	if !slices.Equal(rest, []string{"beta"}) {
+		t.Errorf("expected [beta] left, got %v", rest)
+	}
+
+	perms := expandRoles(known, set, rest)
+	if !slices.Equal(perms, []string{"user", "admin", "beta"}) {
+		t.Errorf("unexpected roles %v", perms)
+	}
+
+	if set, rest = compactRoles(nil, []string{"admin"}); set != 0 || !slices.Equal(rest, []string{"admin"}) {
+		t.Errorf("expected no compaction without known roles, got %b %v", set, rest)
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultCORSMaxAge is how long browsers cache a preflight of the auth endpoints when
+// the config does not set it.
+const defaultCORSMaxAge = 10 * time.Minute
+
+// CORS lets a single page app on another origin sign in with the auth endpoints.  The
+// auth cookies are sent with credentials, so the origins must be listed, * is not
+// allowed.  An app on another site also needs SameSite none for the auth cookies.
+type CORS struct {
+	Origins []string      // origins allowed to call the auth endpoints, ie: https://app.example.com
+	Headers []string      // request headers allowed, defaults to Content-Type
+	MaxAge  time.Duration // how long browsers cache a preflight, defaults to 10 minutes
+}
+
+// corsPolicy is the compiled CORS config.
+type corsPolicy struct {
+	origins map[string]struct{}
+	headers string
+	maxAge  string
+}
+
+// newCORSPolicy compiles the config, it returns nil when CORS is not configured.
+func newCORSPolicy(cfg *CORS) (*corsPolicy, error) {
+	if cfg == nil || len(cfg.Origins) == 0 {
+		return nil, nil
+	}
+
+	p := &corsPolicy{
+		origins: make(map[string]struct{}, len(cfg.Origins)),
+		headers: strings.Join(cfg.Headers, ", "),
+		maxAge:  strconv.Itoa(int(cfg.MaxAge.Seconds())),
+	}
+	if p.headers == "" {
+		p.headers = "Content-Type"
+	}
+	if cfg.MaxAge <= 0 {
+		p.maxAge = strconv.Itoa(int(defaultCORSMaxAge.Seconds()))
+	}
+	for _, origin := range cfg.Origins {
+		origin = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(origin), "/"))
+		if origin == "*" {
+			return nil, errors.New("auth: CORS origins must be listed, * can't send the auth cookies")
+		}
+		p.origins[origin] = struct{}{}
+	}
+	return p, nil
+}
+
+// allowed returns true if the origin may call the auth endpoints.
+func (p *corsPolicy) allowed(origin string) bool {
+	if p == nil || origin == "" {
+		return false
+	}
+	_, ok := p.origins[strings.ToLower(origin)]
+	return ok
+}
+
+// allowOrigin adds the headers letting the script of an allowed origin read the response
+// with the cookies, it returns false for other origins.
+func (p *corsPolicy) allowOrigin(w http.ResponseWriter, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || p == nil {
+		return false
+	}
+	w.Header().Add("Vary", "Origin")
+	if !p.allowed(origin) {
+		return false
+	}
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	w.Header().Set("Access-Control-Allow-Credentials", "true")
+	return true
+}
+
+// corsHandler adds the CORS headers to the responses of an auth endpoint.
+func (a *Auth) corsHandler(f http.HandlerFunc) http.HandlerFunc {
+	if a.cors == nil {
+		return f
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		a.cors.allowOrigin(w, r)
+		f(w, r)
+	}
+}
+
+// optionsHandler answers the OPTIONS requests of an auth endpoint with the methods it
+// was registered with, and the preflights of the allowed origins when the endpoint is
+// served cross origin.
+func (a *Auth) optionsHandler(methods []string, crossOrigin bool) http.HandlerFunc {
+	allow := strings.Join(append(slices.Clone(methods), http.MethodOptions), ", ")
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Allow", allow)
+
+		method := r.Header.Get("Access-Control-Request-Method")
+		if crossOrigin && method != "" && slices.Contains(methods, method) && a.cors.allowOrigin(w, r) {
+			w.Header().Add("Vary", "Access-Control-Request-Method")
+			w.Header().Add("Vary", "Access-Control-Request-Headers")
+			w.Header().Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+			w.Header().Set("Access-Control-Allow-Headers", a.cors.headers)
+			w.Header().Set("Access-Control-Max-Age", a.cors.maxAge)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
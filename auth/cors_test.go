@@ -0,0 +1,94 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// routes records the routes added by addRoutes.
+type routes map[string]http.HandlerFunc
+
+func (rt routes) HandlerFunc(method, path string, handler http.HandlerFunc) {
+	rt[method+" "+path] = handler
+}
+
+func TestAuthRoutesOptions(t *testing.T) {
+	rt := make(routes)
+	cors, err := newCORSPolicy(&CORS{Origins: []string{"https://app.example.com/"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &Auth{config: &Config{Router: rt, AdminRoutes: true}, cors: cors}
+	a.addRoutes()
+
+	if rt["HEAD "+JWKSPath] == nil {
+		t.Error("expected a HEAD route for the jwks")
+	}
+	if rt["GET /auth/signout/"] != nil || rt["HEAD /auth/signout/"] != nil {
+		t.Error("signout must only answer POST, it has side effects")
+	}
+	if rt["HEAD /auth/account/export/"] != nil {
+		t.Error("the export must not answer HEAD, it would run the whole export")
+	}
+
+	// a plain OPTIONS request gets the methods of the path.
+	w := httptest.NewRecorder()
+	rt["OPTIONS "+JWKSPath](w, httptest.NewRequest(http.MethodOptions, JWKSPath, nil))
+	if got := w.Header().Get("Allow"); got != "GET, HEAD, OPTIONS" {
+		t.Errorf("expected GET, HEAD, OPTIONS, got %q", got)
+	}
+	if w.Code != http.StatusNoContent {
+		t.Errorf("expected 204, got %d", w.Code)
+	}
+
+	// a preflight of the allowed origin.
+	preflight := func(origin, method string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodOptions, "/auth/signin/", nil)
+		r.Header.Set("Origin", origin)
+		r.Header.Set("Access-Control-Request-Method", method)
+		w := httptest.NewRecorder()
+		rt["OPTIONS /auth/signin/"](w, r)
+		return w
+	}
+	w = preflight("https://app.example.com", "POST")
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "https://app.example.com" {
+		t.Errorf("expected the origin to be allowed, got %q", got)
+	}
+	if w.Header().Get("Access-Control-Allow-Credentials") != "true" {
+		t.Error("expected credentials to be allowed")
+	}
+	if got := w.Header().Get("Access-Control-Allow-Methods"); got != "POST" {
+		t.Errorf("expected POST, got %q", got)
+	}
+
+	// other origins and methods not registered get no CORS headers.
+	for _, w := range []*httptest.ResponseRecorder{preflight("https://evil.com", "POST"), preflight("https://app.example.com", "DELETE")} {
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != "" {
+			t.Errorf("expected no allowed origin, got %q", got)
+		}
+	}
+
+	// the account and admin endpoints are same origin only.
+	for _, path := range []string{"/auth/account/delete/", "/auth/admin/roles/grant/"} {
+		r := httptest.NewRequest(http.MethodOptions, path, nil)
+		r.Header.Set("Origin", "https://app.example.com")
+		r.Header.Set("Access-Control-Request-Method", "POST")
+		w := httptest.NewRecorder()
+		rt["OPTIONS "+path](w, r)
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != "" {
+			t.Errorf("%s: expected no allowed origin, got %q", path, got)
+		}
+	}
+}
+
+func TestCORSWildcardRejected(t *testing.T) {
+	if _, err := newCORSPolicy(&CORS{Origins: []string{"*"}}); err == nil {
+		t.Error("expected * to be rejected")
+	}
+	if p, err := newCORSPolicy(&CORS{}); p != nil || err != nil {
+		t.Errorf("expected no policy without origins, got %v %v", p, err)
+	}
+}
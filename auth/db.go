@@ -6,8 +6,121 @@ import (
 	"context"
 	"net/mail"
 	"strings"
+	"time"
 
 	"github.com/cwbriscoe/goutil/db"
+	"github.com/cwbriscoe/goweb/correlate"
+	"github.com/cwbriscoe/goweb/query"
+)
+
+// DefaultSchema is the database schema containing the auth tables when none is configured.
+const DefaultSchema = "usr"
+
+// schemaOf returns the schema named name, DefaultSchema when it is empty.
+func schemaOf(name string) query.Schema {
+	if name == "" {
+		return DefaultSchema
+	}
+	return query.Schema(name)
+}
+
+var (
+	qGetSecurityInfo = query.Query{
+		Name: "getSecurityInfo",
+		SQL:  "select id, hash, roles from {schema}.auth where name = $1 and {live};",
+	}
+	qRehash = query.Query{
+		Name: "rehash",
+		SQL:  "update {schema}.auth set hash = $3, version = version + 1 where id = $1 and hash = $2 and {live};",
+	}
+	qRevalidateSecurityInfo = query.Query{
+		Name: "revalidateSecurityInfo",
+		SQL: `
+	select roles, sess.id, sess.nonce, sess.prev_nonce, sess.rotate_ts
+	  from {schema}.auth 
+		join {schema}.sess on sess.auth_id = auth.id
+	 where auth.id = $1
+	   and auth.name = $2
+		 and (sess.id = $3 or sess.prev_id = $3)
+		 and sess.expire_ts > now()
+		 and {live:auth}
+		 and {live:sess};
+	`,
+	}
+	qRotateSession = query.Query{
+		Name: "rotateSession",
+		SQL: `
+update {schema}.sess
+   set prev_nonce = nonce, nonce = $3, prev_id = id, id = $6, rotate_ts = now(), last_used_ts = now(), expire_ts = $4
+ where id = $1
+   and auth_id = $2
+   and nonce = $5
+   and {live};`,
+	}
+	qCreateSession = query.Query{
+		Name: "createSession",
+		SQL:  "insert into {schema}.sess (id, auth_id, create_ts, expire_ts, last_used_ts, nonce, prev_nonce, rotate_ts) values ($1, $2, now(), $3, now(), $4, '', now());",
+	}
+	qTrimSessions = query.Query{
+		Name: "trimSessions",
+		SQL: `
+delete from {schema}.sess
+ where auth_id = $1
+   and id not in (
+       select id
+         from {schema}.sess
+        where auth_id = $1
+          and expire_ts > now()
+          and {live}
+        order by create_ts desc
+        limit $2);`,
+	}
+	qLockUser = query.Query{
+		Name: "lockUser",
+		SQL:  "select id from {schema}.auth where id = $1 for update;",
+	}
+	qCountSessions = query.Query{
+		Name: "countSessions",
+		SQL:  "select count(*) from {schema}.sess where auth_id = $1 and expire_ts > now() and {live};",
+	}
+	qUpdateLastLogin = query.Query{
+		Name: "updateLastLogin",
+		SQL:  "update {schema}.auth set last_login_ts = now() where id = $1;",
+	}
+	qRegisterUser = query.Query{
+		Name: "registerUser",
+		SQL: `
+insert into {schema}.auth
+(name, lname, email, hash, roles, last_login_ts, create_ts)
+values ($1, $2, $3, $4, array['user'], now(), now());
+`,
+	}
+	qCheckAlreadyExists = query.Query{
+		Name: "checkAlreadyExists",
+		SQL: `
+select coalesce((select true from {schema}.auth where lname = $1), false) as user
+,coalesce((select true from {schema}.auth where email = $2), false) as email;
+`,
+	}
+	qInsertTrackerLink = query.Query{
+		Name: "insertTrackerLink",
+		SQL:  "insert into {schema}.tracker (tracker_id, auth_id, anon_id, create_ts) values ($1, $2, nullif($3, ''), now()) on conflict do nothing;",
+	}
+	qTrackerIDUsed = query.Query{
+		Name: "trackerIDUsed",
+		SQL:  "select exists (select 1 from {schema}.tracker where tracker_id = $1 and auth_id <> $2);",
+	}
+	qRoutePermissions = query.Query{
+		Name: "routePermissions",
+		SQL:  "select route, scope from {schema}.route_perm;",
+	}
+	qPurgeExpiredSessions = query.Query{
+		Name: "purgeExpiredSessions",
+		SQL: `
+delete from {schema}.sess
+ where expire_ts < now()
+    or ($1::float8 > 0 and create_ts < now() - make_interval(secs => $1::float8));`,
+	}
 )
 
 func (*Auth) formatEmail(email string) (string, error) {
@@ -18,13 +131,12 @@ func (*Auth) formatEmail(email string) (string, error) {
 	return e.Address, nil
 }
 
-func (a *Auth) getSecurityInfo(user *signin) (string, error) {
+func (a *Auth) getSecurityInfo(ctx context.Context, user *signin) (string, error) {
 	var id int
 	var hash string
 	var roles []string
 
-	sql := "select id, hash, roles from usr.auth where name = $1;"
-	err := a.config.DB.QueryRow(context.TODO(), sql, user.User).Scan(&id, &hash, &roles)
+	err := a.schema.QueryRow(ctx, a.config.DB, qGetSecurityInfo, user.User).Scan(&id, &hash, &roles)
 	if err != nil {
 		return "", err
 	}
@@ -34,55 +146,102 @@ func (a *Auth) getSecurityInfo(user *signin) (string, error) {
 	return hash, nil
 }
 
-func (a *Auth) revalidateSecurityInfo(user *signin) error {
+// rehash replaces the outdated hash of the user with one made by the configured hasher.
+// It is skipped when the hash changed since it was read, ie: by a password reset.
+func (a *Auth) rehash(ctx context.Context, user *signin, old string) error {
+	hash, err := a.generate(user.Pass)
+	if err != nil {
+		return err
+	}
+	tag, err := a.schema.Exec(ctx, a.config.DB, qRehash, user.id, old, hash)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 1 {
+		correlate.Log(ctx, a.log).Info().Msgf("%d|%s password hash upgraded", user.id, user.User)
+	}
+	return nil
+}
+
+// sessionNonce is the refresh token nonce state of a session.
+type sessionNonce struct {
+	id       int64     // current id of the session, the token may carry the one it replaced
+	current  string    // nonce of the only refresh token that may be used
+	previous string    // nonce replaced by the last rotation
+	rotated  time.Time // when the nonce was last rotated
+}
+
+// nonceStore reads and rotates the refresh token nonces of the sessions.
+type nonceStore interface {
+	load(ctx context.Context, user *signin) (*sessionNonce, error)
+	rotate(ctx context.Context, user *signin, id int64, old string) (bool, error)
+}
+
+// dbNonces keeps the nonces in the sess table.
+type dbNonces struct {
+	a *Auth
+}
+
+func (n dbNonces) load(ctx context.Context, user *signin) (*sessionNonce, error) {
+	return n.a.revalidateSecurityInfo(ctx, user)
+}
+
+func (n dbNonces) rotate(ctx context.Context, user *signin, id int64, old string) (bool, error) {
+	return n.a.rotateSession(ctx, user, id, old)
+}
+
+func (a *Auth) revalidateSecurityInfo(ctx context.Context, user *signin) (*sessionNonce, error) {
 	var roles []string
+	nonce := &sessionNonce{}
 
-	sql := `
-	select roles 
-	  from usr.auth 
-		join usr.sess on sess.auth_id = auth.id
-	 where auth.id = $1
-	   and auth.name = $2
-		 and sess.id = $3;
-	`
-	err := a.config.DB.QueryRow(context.TODO(), sql, user.id, user.User, user.session).Scan(&roles)
+	err := a.schema.QueryRow(ctx, a.config.DB, qRevalidateSecurityInfo, user.id, user.User, user.session).Scan(&roles, &nonce.id, &nonce.current, &nonce.previous, &nonce.rotated)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	user.permissions = roles
-	return nil
+	return nonce, nil
 }
 
-func (a *Auth) updateSessionTimestamp(user *signin) error {
-	sql := `update usr.sess set last_used_ts = now() where sess.id = $1;`
-	_, err := a.config.DB.Exec(context.TODO(), sql, user.session)
-	return err
+// rotateSession replaces the nonce of the session with user.nonce and its id with
+// user.session if the nonce is still old, it returns false when another request rotated
+// it first.
+func (a *Auth) rotateSession(ctx context.Context, user *signin, id int64, old string) (bool, error) {
+	tag, err := a.schema.Exec(ctx, a.config.DB, qRotateSession, id, user.id, user.nonce, user.expires, old, user.session)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
 }
 
 func (a *Auth) createSession(user *signin) error {
-	sqli := "insert into usr.sess values ($1, $2, now(), $3, now());"
-	sqlu := "update usr.auth set last_login_ts = now() where id = $1;"
-
 	batch := db.NewBatch(context.TODO(), a.config.DB)
-	batch.Queue(sqli, user.session, user.id, user.expires)
-	batch.Queue(sqlu, user.id)
+	if !a.refusesSignin() {
+		// reserveSession already created it otherwise.
+		batch.Queue(a.schema.SQL(qCreateSession), user.session, user.id, user.expires, user.nonce)
+	}
+	batch.Queue(a.schema.SQL(qUpdateLastLogin), user.id)
+	if a.config.MaxSessions > 0 && a.config.SessionLimit == RevokeOldest {
+		// the new session is the newest so it always survives the trim.
+		batch.Queue(a.schema.SQL(qTrimSessions), user.id, a.config.MaxSessions)
+	}
 
 	_, err := batch.Exec()
 	if err != nil {
-		return err
+		return query.Wrap(qCreateSession, err)
 	}
 
 	return nil
 }
 
-func (a *Auth) deleteSession(id, sess int) error {
-	sql := "delete from usr.sess where id = $1 and auth_id = $2;"
-	_, err := a.config.DB.Exec(context.TODO(), sql, sess, id)
+// deleteSession soft deletes the session, it is kept for the audit trail until it is
+// purged.
+func (a *Auth) deleteSession(id int, sess int64) error {
+	_, err := a.schema.SoftDelete(context.TODO(), a.config.DB, "sess", "id = $1 and auth_id = $2", sess, id)
 	return err
 }
 
-func (a *Auth) registerUser(reg *register) error {
+func (a *Auth) registerUser(ctx context.Context, reg *register) error {
 	hash, err := a.generate(reg.Pass)
 	if err != nil {
 		return err
@@ -94,32 +253,91 @@ func (a *Auth) registerUser(reg *register) error {
 		return err
 	}
 
-	sql := `
-insert into usr.auth
-(name, lname, email, hash, roles, last_login_ts, create_ts)
-values ($1, $2, $3, $4, array['user'], now(), now());
-`
-	_, err = a.config.DB.Exec(context.TODO(), sql, &reg.User, &lname, &lemail, &hash)
+	_, err = a.schema.Exec(ctx, a.config.DB, qRegisterUser, &reg.User, &lname, &lemail, &hash)
 	return err
 }
 
-func (a *Auth) checkAlreadyExists(reg *register) (userExists bool, emailExists bool, err error) {
+func (a *Auth) checkAlreadyExists(ctx context.Context, reg *register) (userExists bool, emailExists bool, err error) {
 	lname := strings.ToLower(reg.User)
 	lemail, err := a.formatEmail(reg.Email)
 	if err != nil {
 		return false, false, err
 	}
 
-	sql := `
-select coalesce((select true from usr.auth where lname = $1), false) as user
-,coalesce((select true from usr.auth where email = $2), false) as email;
-`
-	err = a.config.DB.QueryRow(context.TODO(), sql, lname, lemail).Scan(&userExists, &emailExists)
+	err = a.schema.QueryRow(ctx, a.config.DB, qCheckAlreadyExists, lname, lemail).Scan(&userExists, &emailExists)
 	return userExists, emailExists, err
 }
 
-func (a *Auth) purgeExpiredSessions() error {
-	sql := `delete from usr.sess where expire_ts < now();`
-	_, err := a.config.DB.Exec(context.TODO(), sql)
+func (a *Auth) purgeExpiredSessions(ctx context.Context) error {
+	_, err := a.schema.Exec(ctx, a.config.DB, qPurgeExpiredSessions, a.config.MaxLifetime.Seconds())
+	return err
+}
+
+func (a *Auth) insertTrackerLink(trackerID, anonID string, authID int) error {
+	_, err := a.schema.Exec(context.TODO(), a.config.DB, qInsertTrackerLink, trackerID, authID, anonID)
 	return err
 }
+
+// trackerIDUsed returns true if the tracking id is linked to another user than authID.
+func (a *Auth) trackerIDUsed(ctx context.Context, id string, authID int) (bool, error) {
+	var used bool
+	err := a.schema.QueryRow(ctx, a.config.DB, qTrackerIDUsed, id, authID).Scan(&used)
+	return used, err
+}
+
+// refusesSignin returns true if a signin over the max sessions is refused.  The session
+// is then created with the check of the limit instead of after the signin.
+func (a *Auth) refusesSignin() bool {
+	return a.config.MaxSessions > 0 && a.config.SessionLimit == RefuseSignin
+}
+
+// reserveSession creates the session of the user if the max sessions is not reached
+// and returns false otherwise.  The row of the user is locked so concurrent signins
+// cannot both take the last session.
+func (a *Auth) reserveSession(ctx context.Context, user *signin) (bool, error) {
+	tx, err := a.config.DB.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	var id int
+	if err = a.schema.QueryRow(ctx, tx, qLockUser, user.id).Scan(&id); err != nil {
+		return false, err
+	}
+
+	var cnt int
+	if err = a.schema.QueryRow(ctx, tx, qCountSessions, user.id).Scan(&cnt); err != nil {
+		return false, err
+	}
+	if cnt >= a.config.MaxSessions {
+		return false, nil
+	}
+
+	if _, err = a.schema.Exec(ctx, tx, qCreateSession, user.session, user.id, user.expires, user.nonce); err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit(ctx)
+}
+
+// RoutePermissions returns the route ("METHOD /path") to required scope mapping
+// stored in the route_perm table.
+func (a *Auth) RoutePermissions(ctx context.Context) (map[string]string, error) {
+	rows, err := a.schema.Query(ctx, a.config.DB, qRoutePermissions)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	perms := make(map[string]string)
+	for rows.Next() {
+		var route, scope string
+		if err = rows.Scan(&route, &scope); err != nil {
+			return nil, query.Wrap(qRoutePermissions, err)
+		}
+		perms[route] = scope
+	}
+
+	return perms, query.Wrap(qRoutePermissions, rows.Err())
+}
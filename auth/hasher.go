@@ -0,0 +1,201 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Hasher hashes passwords.  Hashes are encoded with the algorithm and its parameters,
+// so a hash can still be verified after the parameters change.
+type Hasher interface {
+	// Hash returns the encoded hash of the password with a new random salt.
+	Hash(pass []byte) (string, error)
+	// Compare returns nil if the password matches the hash, ErrMismatchedPassword if it
+	// does not or ErrUnknownHash if the hash was not made by this kind of hasher.
+	Compare(hash string, pass []byte) error
+	// Outdated returns true if the hash was not made with the current algorithm and
+	// parameters of the hasher, so it should be replaced on the next signin.
+	Outdated(hash string) bool
+}
+
+var (
+	// ErrMismatchedPassword is returned when a password does not match the hash.
+	ErrMismatchedPassword = errors.New("password does not match the hash")
+	// ErrUnknownHash is returned for a hash in a format the hasher does not know.
+	ErrUnknownHash = errors.New("unknown password hash format")
+)
+
+// builtinHashers verify hashes made with other algorithms than the configured hasher.
+var builtinHashers = []Hasher{&Bcrypt{}, &Argon2id{}}
+
+// compareHash compares the password with the hash using the hasher, or the built in
+// hasher that knows its format.
+func compareHash(hasher Hasher, hash string, pass []byte) error {
+	err := hasher.Compare(hash, pass)
+	if !errors.Is(err, ErrUnknownHash) {
+		return err
+	}
+	for _, h := range builtinHashers {
+		if err = h.Compare(hash, pass); !errors.Is(err, ErrUnknownHash) {
+			return err
+		}
+	}
+	return ErrUnknownHash
+}
+
+// HasherConfig picks a hasher by name, so it can be read from a config file or job parm.
+type HasherConfig struct {
+	Algorithm string `json:"algorithm"` // "argon2id" (default) or "bcrypt"
+	Cost      int    `json:"cost"`      // bcrypt cost
+	Time      uint32 `json:"time"`      // argon2id passes
+	MemoryKB  uint32 `json:"memoryKB"`  // argon2id memory in KiB
+	Threads   uint8  `json:"threads"`   // argon2id parallelism
+}
+
+// Hasher returns the configured hasher.
+func (c *HasherConfig) Hasher() (Hasher, error) {
+	switch c.Algorithm {
+	case "", "argon2id":
+		return &Argon2id{Time: c.Time, Memory: c.MemoryKB, Threads: c.Threads}, nil
+	case "bcrypt":
+		return &Bcrypt{Cost: c.Cost}, nil
+	}
+	return nil, fmt.Errorf("unknown password hashing algorithm %q", c.Algorithm)
+}
+
+// Bcrypt hashes passwords with bcrypt.
+type Bcrypt struct {
+	Cost int // defaults to bcrypt.DefaultCost
+}
+
+func (b *Bcrypt) cost() int {
+	if b.Cost == 0 {
+		return bcrypt.DefaultCost
+	}
+	return b.Cost
+}
+
+// Hash implements Hasher.
+func (b *Bcrypt) Hash(pass []byte) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword(pass, b.cost())
+	return string(hash), err
+}
+
+// Compare implements Hasher.
+func (*Bcrypt) Compare(hash string, pass []byte) error {
+	if !strings.HasPrefix(hash, "$2") {
+		return ErrUnknownHash
+	}
+	err := bcrypt.CompareHashAndPassword([]byte(hash), pass)
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return ErrMismatchedPassword
+	}
+	return err
+}
+
+// Outdated implements Hasher.
+func (b *Bcrypt) Outdated(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || cost != b.cost()
+}
+
+// Argon2id hashes passwords with argon2id.  The zero value uses the parameters
+// recommended by OWASP.
+type Argon2id struct {
+	Time    uint32 // number of passes over the memory, defaults to 2
+	Memory  uint32 // memory in KiB, defaults to 19 MiB
+	Threads uint8  // degree of parallelism, defaults to 1
+	KeyLen  uint32 // length of the hash in bytes, defaults to 32
+}
+
+const argon2SaltLen = 16
+
+func (a *Argon2id) params() Argon2id {
+	p := *a
+	if p.Time == 0 {
+		p.Time = 2
+	}
+	if p.Memory == 0 {
+		p.Memory = 19 * 1024
+	}
+	if p.Threads == 0 {
+		p.Threads = 1
+	}
+	if p.KeyLen == 0 {
+		p.KeyLen = 32
+	}
+	return p
+}
+
+// Hash implements Hasher.
+func (a *Argon2id) Hash(pass []byte) (string, error) {
+	p := a.params()
+	salt := make([]byte, argon2SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey(pass, salt, p.Time, p.Memory, p.Threads, p.KeyLen)
+	return p.encode(salt, key), nil
+}
+
+func (a *Argon2id) encode(salt, key []byte) string {
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, a.Memory, a.Time, a.Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+// decodeArgon2id returns the parameters, salt and key of an encoded argon2id hash.
+func decodeArgon2id(hash string) (*Argon2id, []byte, []byte, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[0] != "" || parts[1] != "argon2id" {
+		return nil, nil, nil, ErrUnknownHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, nil, nil, fmt.Errorf("%w: argon2 version %s", ErrUnknownHash, parts[2])
+	}
+
+	p := &Argon2id{}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Time, &p.Threads); err != nil {
+		return nil, nil, nil, fmt.Errorf("argon2id parameters: %w", err)
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	p.KeyLen = uint32(len(key))
+	return p, salt, key, nil
+}
+
+// Compare implements Hasher.
+func (*Argon2id) Compare(hash string, pass []byte) error {
+	p, salt, key, err := decodeArgon2id(hash)
+	if err != nil {
+		return err
+	}
+	other := argon2.IDKey(pass, salt, p.Time, p.Memory, p.Threads, p.KeyLen)
+	if subtle.ConstantTimeCompare(key, other) != 1 {
+		return ErrMismatchedPassword
+	}
+	return nil
+}
+
+// Outdated implements Hasher.
+func (a *Argon2id) Outdated(hash string) bool {
+	p, _, _, err := decodeArgon2id(hash)
+	return err != nil || *p != a.params()
+}
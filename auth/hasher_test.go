@@ -0,0 +1,104 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package auth
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestHashers(t *testing.T) {
+	pass := []byte("correct horse.pepper")
+	hashers := []Hasher{&Bcrypt{Cost: 4}, &Argon2id{Time: 1, Memory: 1024}}
+	for _, h := range hashers {
+		hash, err := h.Hash(pass)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = h.Compare(hash, pass); err != nil {
+			t.Errorf("%s: expected a match, got %v", hash, err)
+		}
+		if err = h.Compare(hash, []byte("wrong")); !errors.Is(err, ErrMismatchedPassword) {
+			t.Errorf("%s: expected a mismatch, got %v", hash, err)
+		}
+		if h.Outdated(hash) {
+			t.Errorf("%s: new hash is outdated", hash)
+		}
+	}
+
+	// hashes of another algorithm or cost are still verified, but outdated.
+	old, _ := (&Bcrypt{Cost: 4}).Hash(pass)
+	current := &Argon2id{Time: 1, Memory: 1024}
+	if err := compareHash(current, old, pass); err != nil {
+		t.Errorf("expected the bcrypt hash to match, got %v", err)
+	}
+	if !current.Outdated(old) || !(&Bcrypt{Cost: 5}).Outdated(old) {
+		t.Error("expected the bcrypt cost 4 hash to be outdated")
+	}
+	if err := compareHash(current, "$md5$abc", pass); !errors.Is(err, ErrUnknownHash) {
+		t.Errorf("expected an unknown hash, got %v", err)
+	}
+}
+
+func TestHashKind(t *testing.T) {
+	pass := []byte("correct horse.pepper")
+	bc, _ := (&Bcrypt{Cost: 4}).Hash(pass)
+	ar, _ := (&Argon2id{Time: 1, Memory: 1024}).Hash(pass)
+
+	tests := []struct {
+		hash string
+		kind string
+		ok   bool
+	}{
+		{bc, "bcrypt cost=4", true},
+		{ar, "argon2id m=1024,t=1,p=1", true},
+		{"$md5$abc", "", false},
+		{"$2a$xx", "", false},
+	}
+	for _, test := range tests {
+		kind, ok := hashKind(test.hash)
+		if kind != test.kind || ok != test.ok {
+			t.Errorf("%s: expected %q %t, got %q %t", test.hash, test.kind, test.ok, kind, ok)
+		}
+	}
+
+	if _, err := (&HasherConfig{Algorithm: "md5"}).Hasher(); err == nil {
+		t.Error("expected an error for an unknown algorithm")
+	}
+}
+
+func TestWrapBcrypt(t *testing.T) {
+	pass := []byte("correct horse.pepper")
+	inner, err := bcrypt.GenerateFromPassword(pass, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, err := bcryptDigest(pass, 4, string(inner[7:bcryptSettingSize]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(digest) != string(inner[bcryptSettingSize:]) {
+		t.Fatalf("expected digest %s, got %s", inner[bcryptSettingSize:], digest)
+	}
+
+	hasher := &Argon2id{Time: 1, Memory: 1024}
+	wrapped, err := wrapBcrypt(hasher, string(inner))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(wrapped, string(inner[bcryptSettingSize:])) {
+		t.Error("the bcrypt digest is stored in the clear")
+	}
+	if err = compareWrapped(hasher, wrapped, pass); err != nil {
+		t.Errorf("expected a match, got %v", err)
+	}
+	if err = compareWrapped(hasher, wrapped, []byte("wrong")); !errors.Is(err, ErrMismatchedPassword) {
+		t.Errorf("expected a mismatch, got %v", err)
+	}
+	if kind, _ := hashKind(wrapped); kind != "wrapped argon2id m=1024,t=1,p=1" {
+		t.Errorf("unexpected kind %q", kind)
+	}
+}
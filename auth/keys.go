@@ -0,0 +1,223 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+
+	"github.com/goccy/go-json"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// JWKSPath is where the public keys verifying the tokens are served.
+const JWKSPath = "/auth/.well-known/jwks.json"
+
+// KeyConfig is a key pair in the secrets file used to sign tokens with RS256 or EdDSA.
+// The private key is a PEM encoded PKCS #8 (RSA or Ed25519) or PKCS #1 (RSA) key,
+// either inline or read from a file.
+//
+// Keys are rotated by adding the new key at the top of the list, the first key signs
+// new tokens and the rest still verify the tokens they signed.  An old key can be
+// removed once the refresh tokens it signed have expired.
+type KeyConfig struct {
+	KID  string `json:"kid"`  // key id written in the token header
+	PEM  string `json:"pem"`  // the private key
+	File string `json:"file"` // file with the private key, used when pem is empty
+}
+
+// signingKey is a parsed KeyConfig.
+type signingKey struct {
+	kid     string
+	method  jwt.SigningMethod
+	private crypto.Signer
+}
+
+// parseKeys parses the configured keys, the first one signs new tokens.
+func parseKeys(configs []KeyConfig) ([]*signingKey, error) {
+	keys := make([]*signingKey, 0, len(configs))
+	seen := make(map[string]bool, len(configs))
+	for _, cfg := range configs {
+		if cfg.KID == "" {
+			return nil, errors.New("auth: signing key without a kid")
+		}
+		if seen[cfg.KID] {
+			return nil, fmt.Errorf("auth: signing key %s listed twice", cfg.KID)
+		}
+		seen[cfg.KID] = true
+
+		data := []byte(cfg.PEM)
+		if cfg.PEM == "" {
+			var err error
+			if data, err = os.ReadFile(cfg.File); err != nil {
+				return nil, fmt.Errorf("auth: signing key %s: %w", cfg.KID, err)
+			}
+		}
+
+		key, err := parseKey(cfg.KID, data)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func parseKey(kid string, data []byte) (*signingKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("auth: signing key %s is not PEM encoded", kid)
+	}
+
+	var parsed any
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		if parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+			return nil, fmt.Errorf("auth: signing key %s: %w", kid, err)
+		}
+	}
+
+	switch key := parsed.(type) {
+	case *rsa.PrivateKey:
+		if key.N.BitLen() < 2048 {
+			return nil, fmt.Errorf("auth: signing key %s must have at least 2048 bits", kid)
+		}
+		return &signingKey{kid: kid, method: jwt.SigningMethodRS256, private: key}, nil
+	case ed25519.PrivateKey:
+		return &signingKey{kid: kid, method: jwt.SigningMethodEdDSA, private: key}, nil
+	}
+	return nil, fmt.Errorf("auth: signing key %s must be an RSA or Ed25519 key", kid)
+}
+
+// sign returns the signed token of the claims.  Tokens are signed by the newest key
+// pair, or with the HMAC secret when no key pairs are configured.
+func (a *Auth) sign(claims *claims) (string, error) {
+	keys := *a.keys.Load()
+	if len(keys) == 0 {
+		return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(a.secret)
+	}
+
+	token := jwt.NewWithClaims(keys[0].method, claims)
+	token.Header["kid"] = keys[0].kid
+	return token.SignedString(keys[0].private)
+}
+
+// verifyKey returns the key that verifies the token.  The algorithm of the token has
+// to match the key, so a token can't pick a weaker algorithm than the key was made for.
+func (a *Auth) verifyKey(token *jwt.Token) (any, error) {
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); ok {
+		// only accepted while the shared secret is configured, ie: while migrating
+		// from HS256 to key pairs.
+		if len(a.secret) == 0 {
+			return nil, errors.New("HS256 tokens are not accepted")
+		}
+		return a.secret, nil
+	}
+
+	kid, _ := token.Header["kid"].(string)
+	for _, key := range *a.keys.Load() {
+		if key.kid != kid {
+			continue
+		}
+		if token.Method.Alg() != key.method.Alg() {
+			return nil, fmt.Errorf("unexpected signing method %s for key %s", token.Method.Alg(), kid)
+		}
+		return key.private.Public(), nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// validMethods returns the algorithms tokens may be signed with.
+func (a *Auth) validMethods() []string {
+	var methods []string
+	if len(a.secret) > 0 {
+		methods = append(methods, jwt.SigningMethodHS256.Alg())
+	}
+	for _, key := range *a.keys.Load() {
+		methods = append(methods, key.method.Alg())
+	}
+	return methods
+}
+
+// ReloadKeys rereads the signing keys from the secrets file, so keys can be rotated
+// without a restart.  The old keys stay in use when the new ones are not valid, or when
+// the file has none and no jwtkey was loaded at startup to sign the tokens with.
+func (a *Auth) ReloadKeys() error {
+	secret, err := readSecrets(a.config.SecretPath)
+	if err != nil {
+		return err
+	}
+	keys, err := parseKeys(secret.JWTKeys)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 && len(a.secret) == 0 {
+		return errors.New("auth: the secrets have no jwtKeys and no jwtkey was loaded, keeping the current keys")
+	}
+	a.keys.Store(&keys)
+	a.log.Info().Msgf("auth: loaded %d signing keys", len(keys))
+	return nil
+}
+
+// JWK is a public key in the JSON Web Key format.
+type JWK struct {
+	KTY string `json:"kty"`
+	KID string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`   // RSA modulus
+	E   string `json:"e,omitempty"`   // RSA exponent
+	Crv string `json:"crv,omitempty"` // Ed25519 curve
+	X   string `json:"x,omitempty"`   // Ed25519 public key
+}
+
+// JWKS returns the public keys that verify the tokens, for services that check the
+// tokens without knowing the secrets.
+func (a *Auth) JWKS() []JWK {
+	keys := *a.keys.Load()
+	jwks := make([]JWK, 0, len(keys))
+	for _, key := range keys {
+		jwk := JWK{KID: key.kid, Use: "sig", Alg: key.method.Alg()}
+		switch pub := key.private.Public().(type) {
+		case *rsa.PublicKey:
+			jwk.KTY = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.KTY = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(pub)
+		}
+		jwks = append(jwks, jwk)
+	}
+	return jwks
+}
+
+// create the jwks handler
+func (a *Auth) jwksHandler() http.HandlerFunc {
+	return a.handlePanic(a.jwks())
+}
+
+func (a *Auth) jwks() http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		data, err := json.Marshal(map[string][]JWK{"keys": a.JWKS()})
+		if err != nil {
+			a.log.Err(err).Msg("jwks: error marshalling keys")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		// verifiers refetch after a rotation when they see an unknown kid
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(data)
+	}
+}
@@ -0,0 +1,252 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cwbriscoe/goweb/correlate"
+	"github.com/cwbriscoe/goweb/internal/decode"
+	"github.com/cwbriscoe/goweb/internal/respond"
+	"github.com/cwbriscoe/goweb/query"
+	"github.com/jackc/pgx/v5"
+)
+
+// ErrMergeSelf is returned when a user is merged into itself.
+var ErrMergeSelf = errors.New("cannot merge a user into itself")
+
+// MergeHook moves the rows an app keeps for a user to another user when two accounts
+// are merged, ie: orders or an OAuth identity linked to the user id.  It runs in the
+// transaction of the merge, so returning an error cancels the whole merge.
+type MergeHook interface {
+	MergeUser(ctx context.Context, tx pgx.Tx, from, into int) error
+}
+
+// MergeHookFunc adapts a function to a MergeHook.
+type MergeHookFunc func(ctx context.Context, tx pgx.Tx, from, into int) error
+
+// MergeUser calls f(ctx, tx, from, into).
+func (f MergeHookFunc) MergeUser(ctx context.Context, tx pgx.Tx, from, into int) error {
+	return f(ctx, tx, from, into)
+}
+
+// mergeHooks are the hooks registered with AddMergeHook.
+type mergeHooks struct {
+	sync.RWMutex
+	hooks []MergeHook
+}
+
+// MergeResult counts the rows moved by MergeUsers.
+type MergeResult struct {
+	From     int      `json:"from"`
+	Into     int      `json:"into"`
+	Sessions int64    `json:"sessions"`
+	Trackers int64    `json:"trackers"`
+	Roles    []string `json:"roles"` // roles of into after the merge
+}
+
+type mergeRequest struct {
+	From int `json:"from" validate:"required"` // user merged away, it is deleted
+	Into int `json:"into" validate:"required"` // user kept
+}
+
+var (
+	qLockMergeUsers = query.Query{
+		Name: "lockMergeUsers",
+		SQL:  "select id, roles from {schema}.auth where id in ($1, $2) and {live} for update;",
+	}
+	qMergeRoles = query.Query{
+		Name: "mergeRoles",
+		SQL:  "update {schema}.auth set roles = $2, version = version + 1 where id = $1;",
+	}
+	qMergeSessions = query.Query{
+		Name: "mergeSessions",
+		SQL: `
+update {schema}.sess
+   set auth_id = $2, deleted_at = coalesce(deleted_at, now())
+ where auth_id = $1
+   and id not in (select id from {schema}.sess where auth_id = $2);`,
+	}
+	qMergeTrackers = query.Query{
+		Name: "mergeTrackers",
+		SQL: `
+update {schema}.tracker
+   set auth_id = $2
+ where auth_id = $1
+   and tracker_id not in (select tracker_id from {schema}.tracker where auth_id = $2);`,
+	}
+)
+
+// AddMergeHook registers a hook run by MergeUsers for the tables of the app referencing
+// users.  Hooks run in the order they were added.
+func (a *Auth) AddMergeHook(hook MergeHook) {
+	a.merge.Lock()
+	defer a.merge.Unlock()
+	a.merge.hooks = append(a.merge.hooks, hook)
+}
+
+// MergeUsers merges the user from into the user into, ie: an account created by an
+// OAuth signin and a password account of the same person.  The sessions and tracking
+// ids of from are moved to into, then the merge hooks move the rows of the app before
+// from is soft deleted.  The sessions moved are deleted, they were issued for from and
+// are kept for the audit trail, so from is signed out everywhere.  into keeps its own
+// name and password and gains the roles of from, its signed in sessions pick them up on
+// their next request.  Everything runs in one transaction and an audit record is
+// written for both users.
+func (a *Auth) MergeUsers(ctx context.Context, from, into int, actor string) (*MergeResult, error) {
+	if from == into {
+		return nil, ErrMergeSelf
+	}
+
+	tx, err := a.config.DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	// lock both users so neither is changed or deleted while the rows move.
+	rows, err := a.schema.Query(ctx, tx, qLockMergeUsers, from, into)
+	if err != nil {
+		return nil, err
+	}
+	roles := make(map[int][]string, 2)
+	for rows.Next() {
+		var id int
+		var userRoles []string
+		if err = rows.Scan(&id, &userRoles); err != nil {
+			rows.Close()
+			return nil, query.Wrap(qLockMergeUsers, err)
+		}
+		roles[id] = userRoles
+	}
+	if err = rows.Err(); err != nil {
+		return nil, query.Wrap(qLockMergeUsers, err)
+	}
+	if len(roles) != 2 {
+		return nil, pgx.ErrNoRows
+	}
+
+	result := &MergeResult{From: from, Into: into, Roles: mergeRoles(roles[into], roles[from])}
+	var intoChanged time.Time
+	if len(result.Roles) > len(roles[into]) {
+		if _, err = a.schema.Exec(ctx, tx, qMergeRoles, into, result.Roles); err != nil {
+			return nil, err
+		}
+		if intoChanged, err = a.expireTokens(ctx, tx, into); err != nil {
+			return nil, err
+		}
+	}
+
+	tag, err := a.schema.Exec(ctx, tx, qMergeSessions, from, into)
+	if err != nil {
+		return nil, err
+	}
+	result.Sessions = tag.RowsAffected()
+	// sessions whose id is already used by into are only deleted.
+	if _, err = a.schema.SoftDelete(ctx, tx, "sess", "auth_id = $1", from); err != nil {
+		return nil, err
+	}
+
+	if tag, err = a.schema.Exec(ctx, tx, qMergeTrackers, from, into); err != nil {
+		return nil, err
+	}
+	result.Trackers = tag.RowsAffected()
+	if _, err = a.schema.Exec(ctx, tx, qDeleteUserTrackers, from); err != nil {
+		return nil, err
+	}
+
+	// a pending reset link of from must not reset a deleted account.
+	if _, err = a.schema.Exec(ctx, tx, qDeleteUserResets, from); err != nil {
+		return nil, err
+	}
+
+	a.merge.RLock()
+	hooks := a.merge.hooks
+	a.merge.RUnlock()
+	for i, hook := range hooks {
+		if err = hook.MergeUser(ctx, tx, from, into); err != nil {
+			return nil, fmt.Errorf("merge hook %d: %w", i, err)
+		}
+	}
+
+	if _, err = a.schema.SoftDelete(ctx, tx, "auth", "id = $1", from); err != nil {
+		return nil, err
+	}
+
+	changed, err := a.expireTokens(ctx, tx, from)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = a.schema.Exec(ctx, tx, qInsertAudit, from, "merged into "+strconv.Itoa(into), actor); err != nil {
+		return nil, err
+	}
+	if _, err = a.schema.Exec(ctx, tx, qInsertAudit, into, "merged from "+strconv.Itoa(from), actor); err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+
+	a.markStale(from, changed)
+	if !intoChanged.IsZero() {
+		a.markStale(into, intoChanged)
+	}
+	a.log.Info().Msgf("roles: %s merged %d into %d, %d sessions and %d trackers moved",
+		actor, from, into, result.Sessions, result.Trackers)
+	return result, nil
+}
+
+// mergeRoles returns the roles of into followed by the roles of from it does not have.
+func mergeRoles(into, from []string) []string {
+	roles := slices.Clone(into)
+	for _, role := range from {
+		if !slices.Contains(roles, role) {
+			roles = append(roles, role)
+		}
+	}
+	return roles
+}
+
+// create the merge admin handler
+func (a *Auth) mergeUsersHandler() http.HandlerFunc {
+	return a.handlePanic(a.authLimiter(a.AuthHandler("admin", a.mergeUsers())))
+}
+
+func (a *Auth) mergeUsers() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := correlate.Log(r.Context(), a.log)
+
+		req, err := decode.JSON[mergeRequest](r)
+		if err != nil {
+			log.Err(err).Msg("merge: error decoding request body")
+			decode.WriteError(w, r, err)
+			return
+		}
+
+		result, err := a.MergeUsers(r.Context(), req.From, req.Into, actorName(r))
+		if errors.Is(err, ErrMergeSelf) {
+			respond.WriteError(w, r, http.StatusBadRequest, "merge_self", "cannot merge a user into itself")
+			return
+		}
+		if errors.Is(err, pgx.ErrNoRows) {
+			respond.WriteError(w, r, http.StatusNotFound, "user_not_found", "user not found")
+			return
+		}
+		if err != nil {
+			log.Err(err).Msgf("merge: error merging %d into %d", req.From, req.Into)
+			respond.WriteError(w, r, http.StatusInternalServerError, "", "error merging the users")
+			return
+		}
+
+		writeJSON(w, a.log, result)
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/cwbriscoe/goweb/internal/respond"
+	"github.com/goccy/go-json"
+	"github.com/jackc/pgx/v5"
+)
+
+func TestMergeRoles(t *testing.T) {
+	tests := []struct {
+		into, from, want []string
+	}{
+		{[]string{"user"}, []string{"user"}, []string{"user"}},
+		{[]string{"user"}, []string{"user", "admin"}, []string{"user", "admin"}},
+		{[]string{"user", "editor"}, []string{"admin", "editor"}, []string{"user", "editor", "admin"}},
+		{nil, []string{"user"}, []string{"user"}},
+	}
+	for i, test := range tests {
+		into := slices.Clone(test.into)
+		if got := mergeRoles(into, test.from); !slices.Equal(got, test.want) {
+			t.Errorf("%d: expected %v, got %v", i, test.want, got)
+		}
+		if !slices.Equal(into, test.into) {
+			t.Errorf("%d: the roles of into were changed in place", i)
+		}
+	}
+}
+
+func TestMergeSelf(t *testing.T) {
+	a := newTestAuth()
+	if _, err := a.MergeUsers(context.Background(), 1, 1, "admin"); !errors.Is(err, ErrMergeSelf) {
+		t.Errorf("expected ErrMergeSelf, got %v", err)
+	}
+
+	tests := []struct {
+		name, body string
+		status     int
+		code       string
+	}{
+		{"missing user", `{"from":1}`, http.StatusBadRequest, "invalid_field"},
+		{"malformed", `{"from":`, http.StatusBadRequest, "invalid_json"},
+		{"self", `{"from":2,"into":2}`, http.StatusBadRequest, "merge_self"},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/auth/admin/merge/", strings.NewReader(tt.body))
+		r.Header.Set("Content-Type", "application/json")
+		a.mergeUsers()(w, r)
+		var body struct{ Error respond.Error }
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if w.Code != tt.status || body.Error.Code != tt.code {
+			t.Errorf("%s: expected %d %s, got %d %s", tt.name, tt.status, tt.code, w.Code, body.Error.Code)
+		}
+	}
+}
+
+func TestMergeHooks(t *testing.T) {
+	a := newTestAuth()
+	var calls []int
+	for i := 0; i < 2; i++ {
+		i := i
+		a.AddMergeHook(MergeHookFunc(func(_ context.Context, _ pgx.Tx, from, into int) error {
+			calls = append(calls, i, from, into)
+			return nil
+		}))
+	}
+	for _, hook := range a.merge.hooks {
+		if err := hook.MergeUser(context.Background(), nil, 3, 4); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !slices.Equal(calls, []int{0, 3, 4, 1, 3, 4}) {
+		t.Errorf("expected the hooks in the order they were added, got %v", calls)
+	}
+}
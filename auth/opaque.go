@@ -0,0 +1,207 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package auth
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cwbriscoe/goweb/correlate"
+	"github.com/cwbriscoe/goweb/query"
+	"github.com/goccy/go-json"
+	"github.com/jackc/pgx/v5"
+)
+
+// defaultTokenCache is how long a resolved opaque token is cached when the config does
+// not set it.
+const defaultTokenCache = 30 * time.Second
+
+// maxCachedTokens is the most opaque tokens kept in the cache, it is emptied when full.
+const maxCachedTokens = 10000
+
+var (
+	qInsertToken = query.Query{
+		Name: "insertToken",
+		SQL:  "insert into {schema}.token (token_hash, auth_id, sess_id, claims, expire_ts, create_ts) values ($1, $2, $3, $4, $5, now());",
+	}
+	qSelectToken = query.Query{
+		Name: "selectToken",
+		SQL:  "select claims from {schema}.token where token_hash = $1 and expire_ts > now();",
+	}
+	qDeleteTokens = query.Query{
+		Name: "deleteTokens",
+		SQL:  "delete from {schema}.token where token_hash = any($1);",
+	}
+	qPurgeTokens = query.Query{
+		Name: "purgeTokens",
+		SQL:  "delete from {schema}.token where expire_ts < now();",
+	}
+)
+
+// tokenCache keeps the claims of the opaque tokens recently resolved, so AuthHandler
+// does not read the token table on every request.
+type tokenCache struct {
+	sync.Mutex
+	entries map[string]cachedToken // token hash -> claims
+}
+
+type cachedToken struct {
+	claims *claims
+	until  time.Time
+}
+
+func (c *tokenCache) get(hash string, now time.Time) (*claims, bool) {
+	c.Lock()
+	defer c.Unlock()
+	e, ok := c.entries[hash]
+	if !ok || now.After(e.until) {
+		return nil, false
+	}
+	return copyClaims(e.claims), true
+}
+
+func (c *tokenCache) put(hash string, cl *claims, now time.Time, ttl time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	if c.entries == nil || len(c.entries) >= maxCachedTokens {
+		c.entries = make(map[string]cachedToken)
+	}
+	until := now.Add(ttl)
+	if cl.ExpiresAt != nil && cl.ExpiresAt.Before(until) {
+		until = cl.ExpiresAt.Time
+	}
+	c.entries[hash] = cachedToken{claims: copyClaims(cl), until: until}
+}
+
+func (c *tokenCache) remove(hashes []string) {
+	c.Lock()
+	defer c.Unlock()
+	for _, hash := range hashes {
+		delete(c.entries, hash)
+	}
+}
+
+// purge forgets the expired entries.
+func (c *tokenCache) purge(now time.Time) {
+	c.Lock()
+	defer c.Unlock()
+	for hash, e := range c.entries {
+		if now.After(e.until) {
+			delete(c.entries, hash)
+		}
+	}
+}
+
+// copyClaims returns a copy of the claims the caller can change, revalidate reuses the
+// claims it reads to write the new tokens.
+func copyClaims(c *claims) *claims {
+	cp := *c
+	cp.Permissions = append([]string(nil), c.Permissions...)
+	return &cp
+}
+
+// tokenCacheTTL returns how long resolved opaque tokens are cached.
+func (a *Auth) tokenCacheTTL() time.Duration {
+	if a.config.TokenCache != 0 {
+		return a.config.TokenCache
+	}
+	return defaultTokenCache
+}
+
+// storeToken keeps the claims server side and returns the opaque token the cookie
+// carries instead of them.
+func (a *Auth) storeToken(ctx context.Context, c *claims) (string, error) {
+	token, err := newToken()
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+
+	// the session cookie has neither the user id nor the session id.
+	var authID *int
+	if id, _, err := subjectID(c); err == nil {
+		authID = &id
+	}
+	sess, _ := sessionID(c)
+	if _, err = a.schema.Exec(ctx, a.config.DB, qInsertToken, hashToken(token), authID, sess, data, c.ExpiresAt.Time); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// lookupToken returns the claims of an opaque token, from the cache when it was resolved
+// moments ago.  It returns pgx.ErrNoRows when the token is unknown or expired.
+func (a *Auth) lookupToken(ctx context.Context, token string) (*claims, error) {
+	hash := hashToken(token)
+	if c, ok := a.tokens.get(hash, a.clock.Now()); ok {
+		return c, nil
+	}
+
+	var data []byte
+	if err := a.schema.QueryRow(ctx, a.config.DB, qSelectToken, hash).Scan(&data); err != nil {
+		return nil, err
+	}
+	c := &claims{}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, query.Wrap(qSelectToken, err)
+	}
+	if c.ExpiresAt == nil || !c.ExpiresAt.After(a.clock.Now()) {
+		return nil, pgx.ErrNoRows
+	}
+
+	a.tokens.put(hash, c, a.clock.Now(), a.tokenCacheTTL())
+	return c, nil
+}
+
+// deleteTokens deletes the opaque tokens by hash, other servers sharing the token table
+// keep accepting them until they drop out of their cache.
+func (a *Auth) deleteTokens(ctx context.Context, hashes []string) error {
+	_, err := a.schema.Exec(ctx, a.config.DB, qDeleteTokens, hashes)
+	return err
+}
+
+func (a *Auth) purgeTokens(ctx context.Context) error {
+	a.tokens.purge(a.clock.Now())
+	_, err := a.schema.Exec(ctx, a.config.DB, qPurgeTokens)
+	return err
+}
+
+// revokeCookieTokens deletes the opaque tokens of the auth cookies of the request.
+func (a *Auth) revokeCookieTokens(r *http.Request) {
+	if !a.config.OpaqueTokens {
+		return
+	}
+	var hashes []string
+	for _, name := range []string{"access", "refresh", "session"} {
+		if c, err := a.cookie(r, name); err == nil {
+			hashes = append(hashes, hashToken(c.Value))
+		}
+	}
+	if len(hashes) == 0 {
+		return
+	}
+
+	// the cached tokens are dropped before returning so a request right after the
+	// signout can't be served from the cache, only the db delete runs in the background.
+	a.tokens.remove(hashes)
+	log := correlate.Log(correlate.Detach(r.Context()), a.log)
+	go func() {
+		if err := a.deleteTokens(context.Background(), hashes); err != nil {
+			log.Err(err).Msg("signout: error revoking opaque tokens")
+		}
+	}()
+}
+
+// trackerScope returns the scope written in the tracking cookie, none with opaque
+// tokens since the point is to keep it from clients.
+func (a *Auth) trackerScope(perms []string) []string {
+	if a.config.OpaqueTokens {
+		return nil
+	}
+	return perms
+}
@@ -0,0 +1,56 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+func TestTokenCache(t *testing.T) {
+	var cache tokenCache
+	now := time.Now()
+	c := &claims{
+		Permissions: []string{"user"},
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   "1|bob",
+			ExpiresAt: jwt.NewNumericDate(now.Add(time.Hour)),
+		},
+	}
+
+	if _, ok := cache.get("a", now); ok {
+		t.Fatal("expected an empty cache")
+	}
+	cache.put("a", c, now, time.Minute)
+
+	got, ok := cache.get("a", now)
+	if !ok || got.Subject != "1|bob" {
+		t.Fatalf("expected the cached claims, got %v", got)
+	}
+	// revalidate changes the claims it reads, the cache must keep its own copy.
+	got.Permissions[0] = "admin"
+	if again, _ := cache.get("a", now); again.Permissions[0] != "user" {
+		t.Error("the cached claims were changed by the caller")
+	}
+	if _, ok = cache.get("a", now.Add(2*time.Minute)); ok {
+		t.Error("expected the entry to expire with the ttl")
+	}
+
+	cache.remove([]string{"a"})
+	if _, ok = cache.get("a", now); ok {
+		t.Error("expected the token to be removed")
+	}
+
+	// an entry is never cached past the expiry of its token.
+	c.ExpiresAt = jwt.NewNumericDate(now.Add(-time.Second))
+	cache.put("b", c, now, time.Minute)
+	if _, ok = cache.get("b", now); ok {
+		t.Error("expected the expired token to be missed")
+	}
+	cache.purge(now)
+	if len(cache.entries) != 0 {
+		t.Errorf("expected purge to remove the expired token, %d left", len(cache.entries))
+	}
+}
@@ -7,82 +7,110 @@ import (
 	"crypto/cipher"
 	"crypto/rand"
 	"encoding/base64"
+	"errors"
 	"io"
 	mrand "math/rand"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/cwbriscoe/goutil/str"
-	"golang.org/x/crypto/bcrypt"
 )
 
-// bcrypt format
-// $2a$04$g2tinxYv91PKj./q9ZyVdew2mKToygQrYb6gMReolejVgMaGcD2Ny
-// 2a = algorithm
-// 04 = cost
-// rest = salt + hash
+// legacyPrefix starts the hashes made before the hasher was configurable, bcrypt with
+// cost 4 disguised by alter.  They are replaced on the next signin like other outdated
+// hashes.  The format was:
+//
+//	$1$2a$12$<rot13 of the bcrypt salt + hash>
+const legacyPrefix = "$1$"
+
+// SlowDown is the artificial delay added to every password check, so the response time
+// does not tell whether the user exists or how far the check went.
+type SlowDown struct {
+	Min    time.Duration // delay of every check
+	Jitter time.Duration // max random delay added to Min
+}
 
-const (
-	hashVersion string = "1"
-	hashCost    int    = 4
-)
+// defaultSlowDown is used when Config.SlowDown is nil.
+var defaultSlowDown = SlowDown{Min: 200 * time.Millisecond, Jitter: 50 * time.Millisecond}
+
+// Sleeper waits for the artificial delays.  Tests can substitute one that does not wait.
+type Sleeper interface {
+	Sleep(d time.Duration)
+}
 
+// SleeperFunc adapts a function to a Sleeper, ie: SleeperFunc(time.Sleep).
+type SleeperFunc func(d time.Duration)
+
+// Sleep calls f(d).
+func (f SleeperFunc) Sleep(d time.Duration) {
+	f(d)
+}
+
+// generate returns the encrypted hash of the peppered password.
 func (a *Auth) generate(pass string) (string, error) {
+	defer a.slowDown()
+
 	pass += "." + a.pepper
 	start := time.Now()
-	hashedPass, err := bcrypt.GenerateFromPassword(str.UnsafeStringToByte(pass), hashCost)
+	hashedPass, err := a.hasher.Hash(str.UnsafeStringToByte(pass))
 	if err != nil {
 		return "", err
 	}
 
-	a.log.Debug().Msgf("original pass %s", string(hashedPass))
-
 	elapsed := time.Since(start)
-	a.log.Debug().Msgf("GenerateFromPassword %s", elapsed.String())
+	a.log.Debug().Msgf("hash %s", elapsed.String())
 	start = time.Now()
 
-	hashedPass = alter(string(hashedPass))
-	a.log.Debug().Msgf("altered pass %s", string(hashedPass))
-
-	encodedPass, err := encrypt(hashedPass, a.key)
+	encodedPass, err := encrypt([]byte(hashedPass), a.key)
 	if err != nil {
 		return "", err
 	}
 
-	slowDown()
-
 	elapsed = time.Since(start)
 	a.log.Debug().Msgf("encrypt %s", elapsed.String())
 
 	return encodedPass, nil
 }
 
-func (a *Auth) compare(hash, pass string) (bool, error) {
+// compare returns true if the password matches the encrypted hash.  outdated is true
+// when the hash should be replaced by one made with the configured hasher.
+func (a *Auth) compare(hash, pass string) (valid, outdated bool, err error) {
+	defer a.slowDown()
+
 	pass += "." + a.pepper
 	start := time.Now()
 	decodedPass, err := decrypt(hash, a.key)
-	a.log.Debug().Msgf("pass %s", string(decodedPass))
 	if err != nil {
-		return false, err
+		return false, false, err
 	}
 
 	elapsed := time.Since(start)
 	a.log.Debug().Msgf("decrypt %s", elapsed.String())
 	start = time.Now()
 
-	decodedPass = unalter(string(decodedPass))
-	a.log.Debug().Msgf("unaltered pass %s", string(decodedPass))
-
-	if err := bcrypt.CompareHashAndPassword(decodedPass, str.UnsafeStringToByte(pass)); err != nil {
-		return false, err
+	decoded := string(decodedPass)
+	if strings.HasPrefix(decoded, legacyPrefix) {
+		outdated = true
+		err = (&Bcrypt{}).Compare(string(unalter(decoded)), str.UnsafeStringToByte(pass))
+	} else if strings.HasPrefix(decoded, wrappedPrefix) {
+		outdated = true
+		err = compareWrapped(a.hasher, decoded, str.UnsafeStringToByte(pass))
+	} else {
+		outdated = a.hasher.Outdated(decoded)
+		err = compareHash(a.hasher, decoded, str.UnsafeStringToByte(pass))
 	}
 
-	slowDown()
-
 	elapsed = time.Since(start)
-	a.log.Debug().Msgf("CompareHashAndPassword %s", elapsed.String())
+	a.log.Debug().Msgf("compare %s", elapsed.String())
 
-	return true, nil
+	if errors.Is(err, ErrMismatchedPassword) {
+		return false, false, nil
+	}
+	if err != nil {
+		return false, false, err
+	}
+	return true, outdated, nil
 }
 
 func encrypt(secret, key []byte) (string, error) {
@@ -149,15 +177,6 @@ func decrypt(secret string, key []byte) ([]byte, error) {
 	return plaintext, nil
 }
 
-func alter(hash string) []byte {
-	pieces := strings.Split(hash, "$")
-	pieces = pieces[1:]
-	pieces[1] = "12"
-	pieces[2] = strings.Map(rot13, pieces[2])
-	result := "$" + hashVersion + "$" + strings.Join(pieces, "$")
-	return []byte(result)
-}
-
 func unalter(hash string) []byte {
 	pieces := strings.Split(hash, "$")
 	pieces = pieces[2:]
@@ -199,7 +218,43 @@ func rot13(r rune) rune {
 	return r
 }
 
-func slowDown() {
-	num := 200 + mrand.Intn(50)
-	time.Sleep(time.Duration(num) * time.Millisecond)
+// dummyHash is an encrypted hash of the configured hasher, made on first use.
+type dummyHash struct {
+	once sync.Once
+	hash string
+	err  error
+}
+
+// compareUnknown checks the password of a user that does not exist against a dummy
+// hash, so the refusal takes as long as the one of a wrong password, slowDown included.
+func (a *Auth) compareUnknown(pass string) {
+	a.dummy.once.Do(func() {
+		hash, err := a.hasher.Hash([]byte("unknown user"))
+		if err == nil {
+			hash, err = encrypt([]byte(hash), a.key)
+		}
+		a.dummy.hash, a.dummy.err = hash, err
+	})
+	if a.dummy.err != nil {
+		a.log.Err(a.dummy.err).Msg("auth: making the dummy password hash")
+		a.slowDown()
+		return
+	}
+	_, _, _ = a.compare(a.dummy.hash, pass)
+}
+
+// slowDown waits for the configured artificial delay.  It is deferred by generate and
+// compare so every path, successful or not, takes about the same time.
+func (a *Auth) slowDown() {
+	delay := a.slowdown.Min
+	if a.slowdown.Jitter > 0 {
+		jitter := mrand.Int63n
+		if a.rand != nil {
+			jitter = a.rand.Int63n
+		}
+		delay += time.Duration(jitter(int64(a.slowdown.Jitter)))
+	}
+	if delay > 0 {
+		a.sleeper.Sleep(delay)
+	}
 }
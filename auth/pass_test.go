@@ -0,0 +1,88 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package auth
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/cwbriscoe/goutil/logging"
+	"github.com/cwbriscoe/goweb/clock"
+	"github.com/rs/zerolog"
+)
+
+func TestSlowDown(t *testing.T) {
+	var delays []time.Duration
+	sleeper := SleeperFunc(func(d time.Duration) { delays = append(delays, d) })
+
+	a := &Auth{slowdown: SlowDown{Min: 100 * time.Millisecond, Jitter: 20 * time.Millisecond}, sleeper: sleeper}
+	for i := 0; i < 20; i++ {
+		a.slowDown()
+	}
+	if len(delays) != 20 {
+		t.Fatalf("expected 20 delays, got %d", len(delays))
+	}
+	for _, d := range delays {
+		if d < 100*time.Millisecond || d >= 120*time.Millisecond {
+			t.Errorf("delay %s out of range", d)
+		}
+	}
+
+	delays = nil
+	a = &Auth{slowdown: SlowDown{}, sleeper: sleeper}
+	a.slowDown()
+	if len(delays) != 0 {
+		t.Errorf("a zero slowdown should not sleep, got %v", delays)
+	}
+
+	// a failed check is delayed like a successful one.
+	a = &Auth{slowdown: SlowDown{Min: time.Second}, sleeper: sleeper, key: []byte("short")}
+	if _, _, err := a.compare("not a valid hash", "pass"); err == nil {
+		t.Error("expected an error decrypting an invalid hash")
+	}
+	if len(delays) != 1 || delays[0] != time.Second {
+		t.Errorf("expected one 1s delay for the failed compare, got %v", delays)
+	}
+}
+
+func TestCompareUnknown(t *testing.T) {
+	var delays []time.Duration
+	sleeper := SleeperFunc(func(d time.Duration) { delays = append(delays, d) })
+
+	log := zerolog.Nop()
+	a := &Auth{
+		log:      &logging.Logger{Logger: &log},
+		slowdown: SlowDown{Min: time.Second},
+		sleeper:  sleeper,
+		hasher:   &Bcrypt{Cost: 4},
+		key:      []byte("0123456789abcdef0123456789abcdef"),
+	}
+	a.compareUnknown("wrong")
+	a.compareUnknown("wrong")
+	if a.dummy.err != nil || a.dummy.hash == "" {
+		t.Fatalf("expected a dummy hash, got %q %v", a.dummy.hash, a.dummy.err)
+	}
+	if valid, _, err := a.compare(a.dummy.hash, "wrong"); err != nil || valid {
+		t.Errorf("expected the dummy hash to be compared like a stored one, got %t %v", valid, err)
+	}
+	if len(delays) != 3 {
+		t.Errorf("expected a delay for every check, got %v", delays)
+	}
+}
+
+func TestSlowDownRand(t *testing.T) {
+	jitters := func() []time.Duration {
+		var delays []time.Duration
+		sleeper := SleeperFunc(func(d time.Duration) { delays = append(delays, d) })
+		a := &Auth{slowdown: SlowDown{Jitter: time.Second}, sleeper: sleeper, rand: clock.NewRand(7)}
+		for i := 0; i < 5; i++ {
+			a.slowDown()
+		}
+		return delays
+	}
+
+	if first, second := jitters(), jitters(); !slices.Equal(first, second) {
+		t.Errorf("expected the same jitters with the same seed, got %v and %v", first, second)
+	}
+}
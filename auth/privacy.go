@@ -0,0 +1,390 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cwbriscoe/goweb/correlate"
+	"github.com/cwbriscoe/goweb/internal/decode"
+	"github.com/cwbriscoe/goweb/internal/respond"
+	"github.com/cwbriscoe/goweb/query"
+	"github.com/goccy/go-json"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// UserExport contains all of the data stored for a single user.
+type UserExport struct {
+	Account   ExportAccount   `json:"account"`
+	Sessions  []ExportSession `json:"sessions"`
+	Audit     []ExportAudit   `json:"audit"`
+	Trackers  []ExportTracker `json:"trackers"`
+	Analytics any             `json:"analytics,omitempty"`
+	Created   time.Time       `json:"exported"`
+}
+
+// TrackerData exports and deletes the analytics an app keeps by tracking id, ie: the
+// short link clicks, so the privacy requests of a user cover them too.
+type TrackerData interface {
+	ExportTrackers(ctx context.Context, ids []string) (any, error)
+	DeleteTrackers(ctx context.Context, ids []string) (int64, error)
+}
+
+// ExportAccount is the account portion of a UserExport.
+type ExportAccount struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	Email     string    `json:"email"`
+	Roles     []string  `json:"roles"`
+	LastLogin time.Time `json:"lastLogin"`
+	Created   time.Time `json:"created"`
+}
+
+// ExportSession is a single session in a UserExport.
+type ExportSession struct {
+	Created  time.Time `json:"created"`
+	Expires  time.Time `json:"expires"`
+	LastUsed time.Time `json:"lastUsed"`
+}
+
+// ExportAudit is a single audit record in a UserExport.
+type ExportAudit struct {
+	Action  string    `json:"action"`
+	Actor   string    `json:"actor"`
+	Created time.Time `json:"created"`
+}
+
+var (
+	qExportAccount = query.Query{
+		Name: "exportAccount",
+		SQL:  "select id, name, email, roles, last_login_ts, create_ts from {schema}.auth where id = $1;",
+	}
+	qExportSessions = query.Query{
+		Name: "exportSessions",
+		SQL:  "select create_ts, expire_ts, last_used_ts from {schema}.sess where auth_id = $1 order by create_ts;",
+	}
+	qExportAudit = query.Query{
+		Name: "exportAudit",
+		SQL:  "select action, actor, create_ts from {schema}.audit where auth_id = $1 order by create_ts;",
+	}
+	qExportTrackers = query.Query{
+		Name: "exportTrackers",
+		SQL:  "select tracker_id, anon_id, create_ts from {schema}.tracker where auth_id = $1 order by create_ts;",
+	}
+	qUserTrackerIDs = query.Query{
+		Name: "userTrackerIDs",
+		SQL:  "select tracker_id from {schema}.tracker where auth_id = $1;",
+	}
+	qDeleteUserTrackers = query.Query{
+		Name: "deleteUserTrackers",
+		SQL:  "delete from {schema}.tracker where auth_id = $1;",
+	}
+	qDeleteUserSessions = query.Query{
+		Name: "deleteUserSessions",
+		SQL:  "delete from {schema}.sess where auth_id = $1;",
+	}
+	qAnonymizeUser = query.Query{
+		Name: "anonymizeUser",
+		SQL: `
+update {schema}.auth
+   set name = $2, lname = $2, email = $2 || '@invalid', hash = '', roles = array[]::text[]
+ where id = $1;`,
+	}
+	qDeleteUser = query.Query{
+		Name: "deleteUser",
+		SQL:  "delete from {schema}.auth where id = $1;",
+	}
+	qInsertAudit = query.Query{
+		Name: "insertAudit",
+		SQL:  "insert into {schema}.audit (auth_id, action, actor, create_ts) values ($1, $2, $3, now());",
+	}
+)
+
+// ExportTracker is a tracking id linked to the user in a UserExport.
+type ExportTracker struct {
+	TrackerID string    `json:"trackerId"`
+	AnonID    *string   `json:"anonId,omitempty"`
+	Created   time.Time `json:"created"`
+}
+
+// ExportUser gathers all data tied to the user with the given id from the auth tables
+// in schema, DefaultSchema when empty, and from data when it is not nil.  It takes a
+// pool instead of an *Auth so it can also be called from jobs.
+func ExportUser(ctx context.Context, db *pgxpool.Pool, schema string, data TrackerData, id int) (*UserExport, error) {
+	return exportUser(ctx, db, schemaOf(schema), data, id)
+}
+
+func exportUser(ctx context.Context, db *pgxpool.Pool, schema query.Schema, data TrackerData, id int) (*UserExport, error) {
+	export := &UserExport{Created: time.Now()}
+	acct := &export.Account
+
+	err := schema.QueryRow(ctx, db, qExportAccount, id).Scan(&acct.ID, &acct.Name, &acct.Email, &acct.Roles, &acct.LastLogin, &acct.Created)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := schema.Query(ctx, db, qExportSessions, id)
+	if err != nil {
+		return nil, err
+	}
+	export.Sessions, err = pgx.CollectRows(rows, func(row pgx.CollectableRow) (ExportSession, error) {
+		var sess ExportSession
+		err := row.Scan(&sess.Created, &sess.Expires, &sess.LastUsed)
+		return sess, err
+	})
+	if err != nil {
+		return nil, query.Wrap(qExportSessions, err)
+	}
+
+	rows, err = schema.Query(ctx, db, qExportAudit, id)
+	if err != nil {
+		return nil, err
+	}
+	export.Audit, err = pgx.CollectRows(rows, func(row pgx.CollectableRow) (ExportAudit, error) {
+		var audit ExportAudit
+		err := row.Scan(&audit.Action, &audit.Actor, &audit.Created)
+		return audit, err
+	})
+	if err != nil {
+		return nil, query.Wrap(qExportAudit, err)
+	}
+
+	rows, err = schema.Query(ctx, db, qExportTrackers, id)
+	if err != nil {
+		return nil, err
+	}
+	export.Trackers, err = pgx.CollectRows(rows, func(row pgx.CollectableRow) (ExportTracker, error) {
+		var t ExportTracker
+		err := row.Scan(&t.TrackerID, &t.AnonID, &t.Created)
+		return t, err
+	})
+	if err != nil {
+		return nil, query.Wrap(qExportTrackers, err)
+	}
+
+	if data != nil && len(export.Trackers) > 0 {
+		ids := make([]string, len(export.Trackers))
+		for i := range export.Trackers {
+			ids[i] = export.Trackers[i].TrackerID
+		}
+		if export.Analytics, err = data.ExportTrackers(ctx, ids); err != nil {
+			return nil, err
+		}
+	}
+
+	return export, nil
+}
+
+// DeleteUser removes the user with the given id.  If anonymize is true, the account row
+// is kept (so foreign keys in app tables stay valid) but all identifying data is scrubbed.
+// Sessions are always deleted.  An audit record of the action is written in both cases.
+// The auth tables are in schema, DefaultSchema when empty, and the analytics of the
+// tracking ids of the user are deleted from data when it is not nil.
+func DeleteUser(ctx context.Context, db *pgxpool.Pool, schema string, data TrackerData, id int, actor string, anonymize bool) error {
+	return deleteUser(ctx, db, schemaOf(schema), data, id, actor, anonymize)
+}
+
+func deleteUser(ctx context.Context, db *pgxpool.Pool, schema query.Schema, data TrackerData, id int, actor string, anonymize bool) error {
+	// the analytics go first, the links to the tracking ids are deleted with the user.
+	if data != nil {
+		rows, err := schema.Query(ctx, db, qUserTrackerIDs, id)
+		if err != nil {
+			return err
+		}
+		ids, err := pgx.CollectRows(rows, pgx.RowTo[string])
+		if err != nil {
+			return query.Wrap(qUserTrackerIDs, err)
+		}
+		if len(ids) > 0 {
+			if _, err = data.DeleteTrackers(ctx, ids); err != nil {
+				return err
+			}
+		}
+	}
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	action := "delete"
+	if anonymize {
+		action = "anonymize"
+	}
+
+	if _, err = schema.Exec(ctx, tx, qDeleteUserSessions, id); err != nil {
+		return err
+	}
+
+	if _, err = schema.Exec(ctx, tx, qDeleteUserTrackers, id); err != nil {
+		return err
+	}
+
+	var tag pgconn.CommandTag
+	if anonymize {
+		tag, err = schema.Exec(ctx, tx, qAnonymizeUser, id, "deleted"+strconv.Itoa(id))
+	} else {
+		tag, err = schema.Exec(ctx, tx, qDeleteUser, id)
+	}
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+
+	// the audit record intentionally outlives the account so the request can be proven later.
+	if _, err = schema.Exec(ctx, tx, qInsertAudit, id, action, actor); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// subjectID returns the user id and name from the subject of an access or refresh token.
+func subjectID(c *claims) (int, string, error) {
+	creds := strings.Split(c.Subject, "|")
+	if len(creds) != 2 {
+		return 0, "", errors.New("claims.Subject had a length != 2")
+	}
+
+	id, err := strconv.Atoi(creds[0])
+	if err != nil {
+		return 0, "", err
+	}
+
+	return id, creds[1], nil
+}
+
+// create the export handler
+func (a *Auth) exportHandler() http.HandlerFunc {
+	return a.handlePanic(a.authLimiter(a.AuthHandler("user", a.export())))
+}
+
+func (a *Auth) export() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := correlate.Log(r.Context(), a.log)
+
+		claims, success := a.getClaims(r, "access")
+		if !success {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		id, name, err := subjectID(claims)
+		if err != nil {
+			log.Warn().Msgf("export: %s", err.Error())
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		export, err := exportUser(r.Context(), a.config.DB, a.schema, a.config.TrackerData, id)
+		if err != nil {
+			log.Err(err).Msg("export: error exporting user data")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		data, err := json.MarshalIndent(export, "", "  ")
+		if err != nil {
+			log.Err(err).Msg("export: error marshalling user data")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.Header().Add("Content-Disposition", "attachment; filename=\""+name+".json\"")
+		if _, err = w.Write(data); err != nil {
+			log.Err(err).Msg("export: error writing response to body")
+			return
+		}
+
+		log.Info().Msgf("%s exported account data", claims.Subject)
+	}
+}
+
+// create the account delete handler
+func (a *Auth) deleteAccountHandler() http.HandlerFunc {
+	return a.handlePanic(a.authLimiter(a.AuthHandler("user", a.deleteAccount())))
+}
+
+func (a *Auth) deleteAccount() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := correlate.Log(r.Context(), a.log)
+
+		claims, success := a.getClaims(r, "access")
+		if !success {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		id, name, err := subjectID(claims)
+		if err != nil {
+			log.Warn().Msgf("delete: %s", err.Error())
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		// a stolen access token must not be enough to delete the account.
+		req, err := decode.JSON[confirmDelete](r)
+		if err != nil {
+			decode.WriteError(w, r, err)
+			return
+		}
+		valid, err := a.reauthenticate(r.Context(), id, name, req.Pass)
+		if err != nil {
+			log.Err(err).Msg("delete: error checking password")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if !valid {
+			log.Warn().Msgf("%s tried to delete account with an invalid password", claims.Subject)
+			respond.WriteError(w, r, http.StatusUnauthorized, "invalid_password", "the password is incorrect")
+			return
+		}
+
+		anonymize := r.URL.Query().Get("anonymize") == "1"
+		if err = deleteUser(r.Context(), a.config.DB, a.schema, a.config.TrackerData, id, claims.Subject, anonymize); err != nil {
+			log.Err(err).Msg("delete: error deleting user")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		a.signOutInternal(w, r)
+		log.Info().Msgf("%s deleted account (anonymize=%t)", claims.Subject, anonymize)
+	}
+}
+
+// confirmDelete is the body of an account delete request.
+type confirmDelete struct {
+	Pass string `json:"pass" validate:"required"` // the current password of the user
+}
+
+// reauthenticate returns true when pass is the password of the signed in user.
+func (a *Auth) reauthenticate(ctx context.Context, id int, name, pass string) (bool, error) {
+	if checkPassword(pass) != nil {
+		return false, nil
+	}
+	user := &signin{User: name, Pass: pass}
+	hash, err := a.getSecurityInfo(ctx, user)
+	if errors.Is(err, pgx.ErrNoRows) {
+		a.compareUnknown(pass)
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if user.id != id {
+		return false, nil
+	}
+	valid, _, err := a.compare(hash, pass)
+	return valid, err
+}
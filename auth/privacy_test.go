@@ -0,0 +1,51 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+func TestDeleteAccountReauth(t *testing.T) {
+	a := newTestAuth()
+	token, err := a.sign(&claims{RegisteredClaims: jwt.RegisteredClaims{
+		Subject:   "1|chris",
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name, body string
+		code       int
+	}{
+		{"no password", `{}`, http.StatusBadRequest},
+		{"malformed password", `{"pass":"x"}`, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/auth/account/delete/", strings.NewReader(tt.body))
+		r.Header.Set("Content-Type", "application/json")
+		r.AddCookie(&http.Cookie{Name: "access", Value: token})
+		a.deleteAccount()(w, r)
+		if w.Code != tt.code {
+			t.Errorf("%s: expected %d, got %d", tt.name, tt.code, w.Code)
+		}
+	}
+}
+
+func TestSchemaOf(t *testing.T) {
+	if s := schemaOf(""); s != DefaultSchema {
+		t.Errorf("expected %s, got %s", DefaultSchema, s)
+	}
+	if s := schemaOf("site_usr"); s != "site_usr" {
+		t.Errorf("expected site_usr, got %s", s)
+	}
+}
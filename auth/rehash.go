@@ -0,0 +1,183 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package auth
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/cwbriscoe/goweb/query"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var qSelectHashes = query.Query{
+	Name: "selectHashes",
+	SQL:  "select id, hash from {schema}.auth where id > $1 and {live} order by id limit $2;",
+}
+
+// RehashOptions are the options of ScanHashes.
+type RehashOptions struct {
+	Hasher    Hasher                // the hasher configured for the site, defaults to argon2id
+	DryRun    bool                  // only report, legacy hashes are not rewrapped
+	BatchSize int                   // users read per query, defaults to 500
+	Schema    string                // schema of the auth tables, defaults to DefaultSchema
+	Progress  func(r *RehashReport) // called after each batch with the counts so far
+}
+
+// RehashReport counts the password hashes found by ScanHashes.
+type RehashReport struct {
+	Scanned   int            `json:"scanned"`
+	Current   int            `json:"current"`   // made with the parameters of the hasher
+	Outdated  int            `json:"outdated"`  // replaced on the next signin of the user
+	Legacy    int            `json:"legacy"`    // in the format used before the hasher was configurable
+	Rewrapped int            `json:"rewrapped"` // legacy hashes wrapped with the hasher
+	Invalid   int            `json:"invalid"`   // could not be decrypted or parsed
+	Kinds     map[string]int `json:"kinds"`     // number of hashes by algorithm and parameters
+}
+
+// ScanHashes walks the password hashes of the live users and reports the algorithms and
+// parameters they were made with.  Hashes made with other parameters than the hasher
+// are outdated and are replaced on the next signin of the user, so changing the
+// parameters needs no downtime and this only reports how far the migration went.
+// Hashes in the legacy format are wrapped with the hasher unless opts.DryRun is set, so
+// the weak bcrypt cost 4 hashes they disguise are not stored anymore.  The password is
+// needed to make a plain hash, so they stay outdated until the next signin.  It takes a pool
+// instead of an *Auth so it can be called from jobs.
+func ScanHashes(ctx context.Context, db *pgxpool.Pool, secretPath string, opts *RehashOptions) (*RehashReport, error) {
+	if opts == nil {
+		opts = &RehashOptions{}
+	}
+	hasher := opts.Hasher
+	if hasher == nil {
+		hasher = &Argon2id{}
+	}
+	batch := opts.BatchSize
+	if batch <= 0 {
+		batch = 500
+	}
+	schema := query.Schema(DefaultSchema)
+	if opts.Schema != "" {
+		schema = query.Schema(opts.Schema)
+	}
+
+	secret, err := readSecrets(secretPath)
+	if err != nil {
+		return nil, err
+	}
+	key := []byte(secret.EncKey)
+
+	report := &RehashReport{Kinds: make(map[string]int)}
+	last := 0
+	for {
+		users, err := readHashes(ctx, db, schema, last, batch)
+		if err != nil {
+			return report, err
+		}
+		for _, u := range users {
+			if err = scanHash(ctx, db, schema, key, hasher, u, opts.DryRun, report); err != nil {
+				return report, err
+			}
+			last = u.id
+		}
+		if opts.Progress != nil {
+			opts.Progress(report)
+		}
+		if len(users) < batch {
+			return report, nil
+		}
+	}
+}
+
+type storedHash struct {
+	id   int
+	hash string
+}
+
+func readHashes(ctx context.Context, db *pgxpool.Pool, schema query.Schema, after, limit int) ([]storedHash, error) {
+	rows, err := schema.Query(ctx, db, qSelectHashes, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []storedHash
+	for rows.Next() {
+		var u storedHash
+		if err = rows.Scan(&u.id, &u.hash); err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+// scanHash counts the hash of the user in the report and rewraps it if it is legacy.
+func scanHash(ctx context.Context, db *pgxpool.Pool, schema query.Schema, key []byte, hasher Hasher, u storedHash, dryRun bool, report *RehashReport) error {
+	report.Scanned++
+
+	decoded, err := decrypt(u.hash, key)
+	if err != nil {
+		report.Invalid++
+		return nil
+	}
+
+	hash := string(decoded)
+	if strings.HasPrefix(hash, legacyPrefix) {
+		report.Legacy++
+		report.Outdated++
+		report.Kinds["legacy"]++
+		if dryRun {
+			return nil
+		}
+		wrapped, err := wrapBcrypt(hasher, string(unalter(hash)))
+		if err != nil {
+			report.Invalid++
+			return nil
+		}
+		wrapped, err = encrypt([]byte(wrapped), key)
+		if err != nil {
+			return err
+		}
+		tag, err := schema.Exec(ctx, db, qRehash, u.id, u.hash, wrapped)
+		if err != nil {
+			return err
+		}
+		report.Rewrapped += int(tag.RowsAffected())
+		return nil
+	}
+
+	kind, ok := hashKind(hash)
+	if !ok {
+		report.Invalid++
+		return nil
+	}
+	report.Kinds[kind]++
+	if strings.HasPrefix(hash, wrappedPrefix) || hasher.Outdated(hash) {
+		report.Outdated++
+	} else {
+		report.Current++
+	}
+	return nil
+}
+
+// hashKind returns the algorithm and parameters of a decrypted hash, ie: "bcrypt cost=10".
+func hashKind(hash string) (string, bool) {
+	if _, outer, ok := splitWrapped(hash); ok {
+		kind, ok := hashKind(outer)
+		return "wrapped " + kind, ok
+	}
+	if strings.HasPrefix(hash, "$2") {
+		cost, err := bcrypt.Cost([]byte(hash))
+		if err != nil {
+			return "", false
+		}
+		return fmt.Sprintf("bcrypt cost=%d", cost), true
+	}
+	p, _, _, err := decodeArgon2id(hash)
+	if err != nil {
+		return "", false
+	}
+	return fmt.Sprintf("argon2id m=%d,t=%d,p=%d", p.Memory, p.Time, p.Threads), true
+}
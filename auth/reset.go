@@ -0,0 +1,313 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package auth
+
+import (
+	"context"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/cwbriscoe/goweb/correlate"
+	"github.com/cwbriscoe/goweb/internal/decode"
+	"github.com/cwbriscoe/goweb/internal/respond"
+	"github.com/cwbriscoe/goweb/query"
+	"github.com/jackc/pgx/v5"
+)
+
+// Mailer sends the password reset emails.
+type Mailer interface {
+	Mail(ctx context.Context, to, subject, body string) error
+}
+
+// ErrInvalidResetToken is returned for a reset token that is unknown, used or expired.
+var ErrInvalidResetToken = errors.New("invalid or expired reset token")
+
+// maxResetsPerHour is how many reset emails a user can be sent per hour.
+const maxResetsPerHour = 3
+
+var (
+	qGetUserByEmail = query.Query{
+		Name: "getUserByEmail",
+		SQL:  "select id, name from {schema}.auth where email = $1 and {live};",
+	}
+	qCountResets = query.Query{
+		Name: "countResets",
+		SQL:  "select count(*) from {schema}.reset where auth_id = $1 and create_ts > now() - interval '1 hour';",
+	}
+	qInsertReset = query.Query{
+		Name: "insertReset",
+		SQL:  "insert into {schema}.reset (token_hash, auth_id, expire_ts, create_ts) values ($1, $2, $3, now());",
+	}
+	qUseReset = query.Query{
+		Name: "useReset",
+		SQL: `
+update {schema}.reset
+   set used_ts = now()
+ where token_hash = $1
+   and used_ts is null
+   and expire_ts > now()
+   and auth_id in (select id from {schema}.auth where {live})
+returning auth_id;`,
+	}
+	qCheckReset = query.Query{
+		Name: "checkReset",
+		SQL: `
+select exists (
+select 1
+  from {schema}.reset
+ where token_hash = $1
+   and used_ts is null
+   and expire_ts > now());`,
+	}
+	qDeleteUserResets = query.Query{
+		Name: "deleteUserResets",
+		SQL:  "delete from {schema}.reset where auth_id = $1 and used_ts is null;",
+	}
+	qUpdateHash = query.Query{
+		Name: "updateHash",
+		SQL:  "update {schema}.auth set hash = $2, version = version + 1 where id = $1;",
+	}
+	qPurgeResets = query.Query{
+		Name: "purgeResets",
+		SQL:  "delete from {schema}.reset where expire_ts < now() - interval '1 day';",
+	}
+)
+
+// RequestReset emails a one time reset link to the user with the email address.  It
+// returns nil without sending anything when no user has the address, so callers can't
+// tell which addresses are registered.
+func (a *Auth) RequestReset(ctx context.Context, email string) error {
+	if a.config.Mailer == nil {
+		return errors.New("no mailer configured")
+	}
+
+	addr, err := a.formatEmail(email)
+	if err != nil {
+		return nil
+	}
+
+	var id int
+	var name string
+	err = a.schema.QueryRow(ctx, a.config.DB, qGetUserByEmail, addr).Scan(&id, &name)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var cnt int
+	if err = a.schema.QueryRow(ctx, a.config.DB, qCountResets, id).Scan(&cnt); err != nil {
+		return err
+	}
+	if cnt >= maxResetsPerHour {
+		a.log.Warn().Msgf("reset: %d|%s exceeded %d reset requests per hour", id, name, maxResetsPerHour)
+		return nil
+	}
+
+	token, err := newToken()
+	if err != nil {
+		return err
+	}
+
+	expires := a.clock.Now().Add(a.resetExpire())
+	if _, err = a.schema.Exec(ctx, a.config.DB, qInsertReset, hashToken(token), id, expires); err != nil {
+		return err
+	}
+
+	link := a.config.ResetURL + "?token=" + url.QueryEscape(token)
+	body := "Hi " + name + ",\n\n" +
+		"Someone asked to reset the password of your account.  Follow the link below within " +
+		a.resetExpire().String() + " to choose a new one:\n\n" + link + "\n\n" +
+		"If it wasn't you, ignore this email and your password stays the same.\n"
+	if err = a.config.Mailer.Mail(ctx, addr, "Reset your password", body); err != nil {
+		return err
+	}
+
+	a.log.Info().Msgf("reset: sent a reset link to %d|%s", id, name)
+	return nil
+}
+
+// ConfirmReset sets the password of the user the token was sent to and signs them out
+// everywhere.  The token can only be used once.
+func (a *Auth) ConfirmReset(ctx context.Context, token, pass string) error {
+	// check the token before hashing, so made up tokens do not cost a hash each.
+	if !validResetToken(token) {
+		return ErrInvalidResetToken
+	}
+	var valid bool
+	if err := a.schema.QueryRow(ctx, a.config.DB, qCheckReset, hashToken(token)).Scan(&valid); err != nil {
+		return err
+	}
+	if !valid {
+		return ErrInvalidResetToken
+	}
+
+	// hash before the transaction, it is slow on purpose.  The token is used in it, so
+	// it is still only accepted once.
+	hash, err := a.generate(pass)
+	if err != nil {
+		return err
+	}
+
+	tx, err := a.config.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	var id int
+	err = a.schema.QueryRow(ctx, tx, qUseReset, hashToken(token)).Scan(&id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrInvalidResetToken
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err = a.schema.Exec(ctx, tx, qUpdateHash, id, hash); err != nil {
+		return err
+	}
+
+	// other links sent to the user and existing sessions are no longer valid.
+	if _, err = a.schema.Exec(ctx, tx, qDeleteUserResets, id); err != nil {
+		return err
+	}
+	if _, err = a.schema.SoftDelete(ctx, tx, "sess", "auth_id = $1", id); err != nil {
+		return err
+	}
+
+	changed, err := a.expireTokens(ctx, tx, id)
+	if err != nil {
+		return err
+	}
+
+	if _, err = a.schema.Exec(ctx, tx, qInsertAudit, id, "password reset", "reset link"); err != nil {
+		return err
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return err
+	}
+
+	a.markStale(id, changed)
+	a.log.Info().Msgf("reset: password of %d was reset", id)
+	return nil
+}
+
+func (a *Auth) purgeResets(ctx context.Context) error {
+	_, err := a.schema.Exec(ctx, a.config.DB, qPurgeResets)
+	return err
+}
+
+// resetExpire returns how long a reset link is valid.
+func (a *Auth) resetExpire() time.Duration {
+	if a.config.ResetExpire > 0 {
+		return a.config.ResetExpire
+	}
+	return time.Hour
+}
+
+// newToken returns a random reset or opaque token, only its hash is stored.
+func newToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := crand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// validResetToken reports whether token has the format of the tokens made by newToken.
+func validResetToken(token string) bool {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	return err == nil && len(b) == 32
+}
+
+// hashToken returns the hash a token is stored under.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+type resetRequest struct {
+	Email string `json:"email" validate:"required"`
+}
+
+type resetConfirm struct {
+	Token string `json:"token" validate:"required"`
+	Pass  string `json:"pass" validate:"required"`
+}
+
+// create the password reset handlers
+func (a *Auth) resetRequestHandler() http.HandlerFunc {
+	return a.handlePanic(a.authLimiter(a.resetRequest()))
+}
+
+func (a *Auth) resetConfirmHandler() http.HandlerFunc {
+	return a.handlePanic(a.authLimiter(a.resetConfirm()))
+}
+
+func (a *Auth) resetRequest() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req, err := decode.JSON[resetRequest](r)
+		if err != nil {
+			decode.WriteError(w, r, err)
+			return
+		}
+		if !emailValid(req.Email) {
+			respond.WriteError(w, r, http.StatusBadRequest, "invalid_email", "invalid email address")
+			return
+		}
+
+		// the email is sent in the background so the response time doesn't tell if the
+		// address is registered.
+		ctx := correlate.Detach(r.Context())
+		go func() {
+			if err := a.RequestReset(ctx, req.Email); err != nil {
+				correlate.Log(ctx, a.log).Err(err).Msg("reset: error sending reset link")
+			}
+		}()
+
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+func (a *Auth) resetConfirm() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := correlate.Log(r.Context(), a.log)
+
+		req, err := decode.JSON[resetConfirm](r)
+		if err != nil {
+			log.Err(err).Msg("reset: error decoding request body")
+			decode.WriteError(w, r, err)
+			return
+		}
+
+		if reason := checkPassword(req.Pass); reason != nil {
+			reason.write(w, r)
+			return
+		}
+
+		err = a.ConfirmReset(r.Context(), req.Token, req.Pass)
+		if errors.Is(err, ErrInvalidResetToken) {
+			log.Warn().Msg("reset: invalid or expired reset token")
+			respond.WriteError(w, r, http.StatusBadRequest, "invalid_reset_token", "invalid or expired reset link")
+			return
+		}
+		if err != nil {
+			log.Err(err).Msg("reset: error resetting password")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		// the browser may still hold cookies of a session that was just deleted.
+		a.signOutInternal(w, r)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
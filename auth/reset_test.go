@@ -0,0 +1,64 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/cwbriscoe/goweb/internal/respond"
+	"github.com/goccy/go-json"
+)
+
+func TestConfirmResetMalformed(t *testing.T) {
+	// the test auth has no hasher, a malformed token must be refused before hashing.
+	a := newTestAuth()
+	for _, token := range []string{"", "short", "not base64 at all, not base64 at all, not b"} {
+		if err := a.ConfirmReset(context.Background(), token, "new password"); !errors.Is(err, ErrInvalidResetToken) {
+			t.Errorf("%q: expected ErrInvalidResetToken, got %v", token, err)
+		}
+	}
+
+	token, err := newToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !validResetToken(token) {
+		t.Errorf("expected %q to be valid", token)
+	}
+}
+
+func TestResetDecode(t *testing.T) {
+	a := newTestAuth()
+	tests := []struct {
+		name        string
+		handler     http.HandlerFunc
+		contentType string
+		body        string
+		status      int
+		code        string
+	}{
+		{"request not json", a.resetRequest(), "text/plain", `{"email":"a@b.com"}`, http.StatusUnsupportedMediaType, "unsupported_media_type"},
+		{"request malformed", a.resetRequest(), "application/json", `{"email":`, http.StatusBadRequest, "invalid_json"},
+		{"request bad email", a.resetRequest(), "application/json", `{"email":"nope"}`, http.StatusBadRequest, "invalid_email"},
+		{"confirm unknown field", a.resetConfirm(), "application/json", `{"token":"t","pass":"p","x":1}`, http.StatusBadRequest, "unknown_field"},
+		{"confirm missing token", a.resetConfirm(), "application/json", `{"pass":"new password"}`, http.StatusBadRequest, "invalid_field"},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/auth/reset/", strings.NewReader(tt.body))
+		r.Header.Set("Content-Type", tt.contentType)
+		tt.handler(w, r)
+		var body struct{ Error respond.Error }
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if w.Code != tt.status || body.Error.Code != tt.code {
+			t.Errorf("%s: expected %d %s, got %d %s", tt.name, tt.status, tt.code, w.Code, body.Error.Code)
+		}
+	}
+}
@@ -0,0 +1,479 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cwbriscoe/goutil/logging"
+	"github.com/cwbriscoe/goweb/correlate"
+	"github.com/cwbriscoe/goweb/internal/respond"
+	"github.com/cwbriscoe/goweb/query"
+	"github.com/goccy/go-json"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ErrInvalidRole is returned for a role name that is not a lower case identifier.
+var ErrInvalidRole = errors.New("invalid role")
+
+// ErrNameTaken is returned when a deleted user can't be restored since a user signed up
+// with their name or email in the meantime.
+var ErrNameTaken = errors.New("name or email is used by another user")
+
+var roleRegex = regexp.MustCompile(`^[a-z][a-z0-9_-]{0,31}$`)
+
+// UserSummary is a user as listed by ListUsers.
+type UserSummary struct {
+	ID        int        `json:"id"`
+	Name      string     `json:"name"`
+	Email     string     `json:"email"`
+	Roles     []string   `json:"roles"`
+	LastLogin time.Time  `json:"lastLogin"`
+	Created   time.Time  `json:"created"`
+	Deleted   *time.Time `json:"deleted,omitempty"`
+	Version   int        `json:"version"` // send back with role changes to detect concurrent edits
+}
+
+// UserRoles are the roles of a user after a role change.
+type UserRoles struct {
+	Roles   []string `json:"roles"`
+	Version int      `json:"version"`
+}
+
+var (
+	qListUsers = query.Query{
+		Name: "listUsers",
+		SQL: `
+select id, name, email, roles, last_login_ts, create_ts, deleted_at, version
+  from {schema}.auth
+ where ($1 = '' or lname like $1 || '%')
+   and {live}
+ order by lname
+ limit $2 offset $3;`,
+	}
+	qGrantRole = query.Query{
+		Name: "grantRole",
+		SQL: `
+update {schema}.auth
+   set roles = case when $2 = any(roles) then roles else array_append(roles, $2) end, version = version + 1
+ where id = $1
+   and version = $3
+   and {live}
+returning roles, version;`,
+	}
+	qExpireTokens = query.Query{
+		Name: "expireTokens",
+		SQL:  "update {schema}.auth set stale_ts = $2 where id = $1;",
+	}
+	qStaleUsers = query.Query{
+		Name: "staleUsers",
+		SQL:  "select id, stale_ts from {schema}.auth where stale_ts > $1;",
+	}
+	qRevokeRole = query.Query{
+		Name: "revokeRole",
+		SQL: `
+update {schema}.auth
+   set roles = array_remove(roles, $2), version = version + 1
+ where id = $1
+   and version = $3
+   and {live}
+returning roles, version;`,
+	}
+)
+
+// ListUsers returns the users whose lower case name starts with prefix, ordered by name.
+// Deleted users that can still be restored are only included when deleted is true.
+func (a *Auth) ListUsers(ctx context.Context, prefix string, deleted bool, limit, offset int) ([]UserSummary, error) {
+	q := qListUsers
+	if deleted {
+		q = query.IncludeDeleted(q)
+	}
+	rows, err := a.schema.Query(ctx, a.config.DB, q, strings.ToLower(prefix), limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	users, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (UserSummary, error) {
+		var u UserSummary
+		err := row.Scan(&u.ID, &u.Name, &u.Email, &u.Roles, &u.LastLogin, &u.Created, &u.Deleted, &u.Version)
+		return u, err
+	})
+	return users, query.Wrap(qListUsers, err)
+}
+
+// GrantRole adds the role to the user and returns the users roles.  The users signed in
+// sessions pick up the new roles on their next request.  It returns query.ErrConflict if
+// the user changed since that version was read.
+func (a *Auth) GrantRole(ctx context.Context, id, version int, role, actor string) (*UserRoles, error) {
+	return a.changeRole(ctx, qGrantRole, "grant ", id, version, role, actor)
+}
+
+// RevokeRole removes the role from the user and returns the users roles.  The users
+// signed in sessions lose the role on their next request.  It returns query.ErrConflict
+// if the user changed since that version was read.
+func (a *Auth) RevokeRole(ctx context.Context, id, version int, role, actor string) (*UserRoles, error) {
+	return a.changeRole(ctx, qRevokeRole, "revoke ", id, version, role, actor)
+}
+
+func (a *Auth) changeRole(ctx context.Context, q query.Query, action string, id, version int, role, actor string) (*UserRoles, error) {
+	if !roleRegex.MatchString(role) {
+		return nil, ErrInvalidRole
+	}
+	if version < 1 {
+		return nil, query.ErrNoVersion
+	}
+
+	tx, err := a.config.DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	roles := &UserRoles{}
+	err = a.schema.QueryRow(ctx, tx, q, id, role, version).Scan(&roles.Roles, &roles.Version)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, a.schema.VersionMismatch(ctx, tx, "auth", "id = $1 and {live}", id)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	changed, err := a.expireTokens(ctx, tx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = a.schema.Exec(ctx, tx, qInsertAudit, id, action+role, actor); err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+
+	a.markStale(id, changed)
+	a.log.Info().Msgf("roles: %s %s %s for %d", actor, action, role, id)
+	return roles, nil
+}
+
+// ExpireSessions signs the user out everywhere by deleting all of their sessions.
+func (a *Auth) ExpireSessions(ctx context.Context, id int, actor string) error {
+	tx, err := a.config.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	if _, err = a.schema.SoftDelete(ctx, tx, "sess", "auth_id = $1", id); err != nil {
+		return err
+	}
+
+	changed, err := a.expireTokens(ctx, tx, id)
+	if err != nil {
+		return err
+	}
+
+	if _, err = a.schema.Exec(ctx, tx, qInsertAudit, id, "expire sessions", actor); err != nil {
+		return err
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return err
+	}
+
+	a.markStale(id, changed)
+	a.log.Info().Msgf("roles: %s expired the sessions of %d", actor, id)
+	return nil
+}
+
+// DeleteUser soft deletes the user and their sessions, signing them out everywhere.  The
+// user can be restored until the purge job removes them.
+func (a *Auth) DeleteUser(ctx context.Context, id int, actor string) error {
+	tx, err := a.config.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	cnt, err := a.schema.SoftDelete(ctx, tx, "auth", "id = $1", id)
+	if err != nil {
+		return err
+	}
+	if cnt == 0 {
+		return pgx.ErrNoRows
+	}
+
+	if _, err = a.schema.SoftDelete(ctx, tx, "sess", "auth_id = $1", id); err != nil {
+		return err
+	}
+
+	changed, err := a.expireTokens(ctx, tx, id)
+	if err != nil {
+		return err
+	}
+
+	if _, err = a.schema.Exec(ctx, tx, qInsertAudit, id, "delete user", actor); err != nil {
+		return err
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return err
+	}
+
+	a.markStale(id, changed)
+	a.log.Info().Msgf("roles: %s deleted %d", actor, id)
+	return nil
+}
+
+// RestoreUser undoes DeleteUser.  The sessions of the user stay deleted, so they have
+// to sign in again.
+func (a *Auth) RestoreUser(ctx context.Context, id int, actor string) error {
+	tx, err := a.config.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	cnt, err := a.schema.Restore(ctx, tx, "auth", "id = $1", id)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+		return ErrNameTaken
+	}
+	if err != nil {
+		return err
+	}
+	if cnt == 0 {
+		return pgx.ErrNoRows
+	}
+
+	if _, err = a.schema.Exec(ctx, tx, qInsertAudit, id, "restore user", actor); err != nil {
+		return err
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return err
+	}
+
+	a.log.Info().Msgf("roles: %s restored %d", actor, id)
+	return nil
+}
+
+// PurgeDeleted removes the users and sessions soft deleted before the time.  It takes a
+// pool instead of an *Auth so it can be called from jobs.
+func PurgeDeleted(ctx context.Context, db *pgxpool.Pool, before time.Time) (users, sessions int64, err error) {
+	schema := query.Schema(DefaultSchema)
+	if sessions, err = schema.PurgeDeleted(ctx, db, "sess", before); err != nil {
+		return 0, 0, err
+	}
+	users, err = schema.PurgeDeleted(ctx, db, "auth", before)
+	return users, sessions, err
+}
+
+// staleInterval is how often the access tokens expired by the other servers are read
+// from the db.
+const staleInterval = 30 * time.Second
+
+// expireTokens records in the db that the access tokens of the user issued before now
+// are invalid, so every server makes the next request of the user revalidate against
+// the db with the refresh token.  It runs in the transaction of the change and returns
+// the time to pass to markStale once it is committed.
+func (a *Auth) expireTokens(ctx context.Context, db query.DB, id int) (time.Time, error) {
+	now := a.clock.Now()
+	_, err := a.schema.Exec(ctx, db, qExpireTokens, id, now)
+	return now, err
+}
+
+// markStale applies the expiry recorded by expireTokens on this server right away,
+// the other servers read it from the db with loadStale.
+func (a *Auth) markStale(id int, changed time.Time) {
+	if prev, ok := a.stale.Load(id); ok && prev.(time.Time).After(changed) {
+		return
+	}
+	a.stale.Store(id, changed)
+}
+
+// loadStale reads the access token expiries recorded in the db during the access
+// token lifetime, older ones no longer matter.
+func (a *Auth) loadStale(ctx context.Context) error {
+	rows, err := a.schema.Query(ctx, a.config.DB, qStaleUsers, a.clock.Now().Add(-a.config.AccessExpire))
+	if err != nil {
+		return err
+	}
+	var id int
+	var changed time.Time
+	_, err = pgx.ForEachRow(rows, []any{&id, &changed}, func() error {
+		a.markStale(id, changed)
+		return nil
+	})
+	return query.Wrap(qStaleUsers, err)
+}
+
+// isStale returns true if the roles of the user changed after the access token was issued.
+func (a *Auth) isStale(c *claims) bool {
+	id, _, err := subjectID(c)
+	if err != nil || c.ExpiresAt == nil {
+		return false
+	}
+	changed, ok := a.stale.Load(id)
+	if !ok {
+		return false
+	}
+	issued := c.ExpiresAt.Add(-a.config.AccessExpire)
+	return changed.(time.Time).After(issued)
+}
+
+// purgeStale forgets role changes older than the access token lifetime, every access
+// token issued before them has expired.
+func (a *Auth) purgeStale() {
+	limit := a.clock.Now().Add(-a.config.AccessExpire)
+	a.stale.Range(func(key, value any) bool {
+		if value.(time.Time).Before(limit) {
+			a.stale.Delete(key)
+		}
+		return true
+	})
+}
+
+type roleChange struct {
+	UserID  int    `json:"userId"`
+	Role    string `json:"role"`
+	Version int    `json:"version"` // version of the user the change is based on, 0 skips the check
+}
+
+// create the role admin handlers
+func (a *Auth) listUsersHandler() http.HandlerFunc {
+	return a.handlePanic(a.authLimiter(a.AuthHandler("admin", a.listUsers())))
+}
+
+func (a *Auth) grantRoleHandler() http.HandlerFunc {
+	return a.handlePanic(a.authLimiter(a.AuthHandler("admin", a.changeRoleHandler(a.GrantRole))))
+}
+
+func (a *Auth) revokeRoleHandler() http.HandlerFunc {
+	return a.handlePanic(a.authLimiter(a.AuthHandler("admin", a.changeRoleHandler(a.RevokeRole))))
+}
+
+func (a *Auth) expireSessionsHandler() http.HandlerFunc {
+	return a.handlePanic(a.authLimiter(a.AuthHandler("admin", a.userAction(a.ExpireSessions))))
+}
+
+func (a *Auth) deleteUserHandler() http.HandlerFunc {
+	return a.handlePanic(a.authLimiter(a.AuthHandler("admin", a.userAction(a.DeleteUser))))
+}
+
+func (a *Auth) restoreUserHandler() http.HandlerFunc {
+	return a.handlePanic(a.authLimiter(a.AuthHandler("admin", a.userAction(a.RestoreUser))))
+}
+
+func (a *Auth) listUsers() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params := r.URL.Query()
+		limit, err := strconv.Atoi(params.Get("limit"))
+		if err != nil || limit <= 0 || limit > 500 {
+			limit = 100
+		}
+		offset, err := strconv.Atoi(params.Get("offset"))
+		if err != nil || offset < 0 {
+			offset = 0
+		}
+
+		users, err := a.ListUsers(r.Context(), params.Get("q"), params.Get("deleted") == "1", limit, offset)
+		if err != nil {
+			correlate.Log(r.Context(), a.log).Err(err).Msg("roles: error listing users")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, a.log, users)
+	}
+}
+
+func (a *Auth) changeRoleHandler(change func(context.Context, int, int, string, string) (*UserRoles, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req roleChange
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		roles, err := change(r.Context(), req.UserID, req.Version, req.Role, actorName(r))
+		if errors.Is(err, ErrInvalidRole) {
+			respond.WriteError(w, r, http.StatusBadRequest, "invalid_role", "invalid role")
+			return
+		}
+		if errors.Is(err, query.ErrNoVersion) {
+			respond.WriteError(w, r, http.StatusBadRequest, "no_version", "the version of the user is required")
+			return
+		}
+		if errors.Is(err, pgx.ErrNoRows) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, query.ErrConflict) {
+			respond.WriteError(w, r, http.StatusConflict, "conflict", "user was changed by someone else, reload and try again")
+			return
+		}
+		if err != nil {
+			correlate.Log(r.Context(), a.log).Err(err).Msg("roles: error changing role")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, a.log, roles)
+	}
+}
+
+// userAction runs an admin action on the user in the request body.
+func (a *Auth) userAction(action func(context.Context, int, string) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req roleChange
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.UserID == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		err := action(r.Context(), req.UserID, actorName(r))
+		if errors.Is(err, pgx.ErrNoRows) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, ErrNameTaken) {
+			respond.WriteError(w, r, http.StatusConflict, "name_taken", err.Error())
+			return
+		}
+		if err != nil {
+			correlate.Log(r.Context(), a.log).Err(err).Msgf("roles: error running user action on %d", req.UserID)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// writeJSON writes v as the json response.
+func writeJSON(w http.ResponseWriter, log *logging.Logger, v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Err(err).Msg("roles: error marshalling response")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(data)
+}
+
+// actorName returns the name of the signed in user making the request.
+func actorName(r *http.Request) string {
+	if user := UserFromContext(r.Context()); user != nil {
+		return user.Name
+	}
+	return "UNKNOWN"
+}
@@ -0,0 +1,54 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package auth
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/cwbriscoe/goweb/clock"
+	"github.com/cwbriscoe/goweb/query"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+func TestStale(t *testing.T) {
+	now := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	fake := clock.NewFake(now)
+	a := newTestAuth()
+	a.clock = fake
+	token := func(issued time.Time) *claims {
+		return &claims{RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   "1|chris",
+			ExpiresAt: jwt.NewNumericDate(issued.Add(a.config.AccessExpire)),
+		}}
+	}
+
+	if a.isStale(token(now)) {
+		t.Fatal("expected a token without changes to be fresh")
+	}
+
+	// a change read from the db by loadStale never moves the expiry back.
+	a.markStale(1, now.Add(10*time.Second))
+	a.markStale(1, now)
+	if !a.isStale(token(now.Add(5 * time.Second))) {
+		t.Error("expected a token issued before the change to be stale")
+	}
+	if a.isStale(token(now.Add(20 * time.Second))) {
+		t.Error("expected a token issued after the change to be fresh")
+	}
+
+	fake.Advance(2 * a.config.AccessExpire)
+	a.purgeStale()
+	if _, ok := a.stale.Load(1); ok {
+		t.Error("expected the change to be purged once the tokens issued before it expired")
+	}
+}
+
+func TestChangeRoleVersion(t *testing.T) {
+	a := newTestAuth()
+	if _, err := a.GrantRole(context.Background(), 1, 0, "editor", "admin"); !errors.Is(err, query.ErrNoVersion) {
+		t.Errorf("expected query.ErrNoVersion, got %v", err)
+	}
+}
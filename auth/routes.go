@@ -4,27 +4,77 @@ package auth
 
 import (
 	"encoding/base64"
+	"errors"
 	"fmt"
-	"math/rand"
 	"net/http"
 	"strconv"
 	"strings"
-	"time"
 
 	"github.com/cwbriscoe/goutil/str"
+	"github.com/cwbriscoe/goweb/correlate"
+	"github.com/cwbriscoe/goweb/internal/decode"
+	"github.com/cwbriscoe/goweb/internal/respond"
 	"github.com/cwbriscoe/goweb/limiter"
 	"github.com/goccy/go-json"
+	"github.com/golang-jwt/jwt/v4"
 	"github.com/jackc/pgx/v5"
 )
 
-// addRoutes adds auth routhes
+// addRoutes adds auth routhes.  Every path also answers OPTIONS with the methods it was
+// registered with, and HEAD when GET is cheap and has no side effects.  Only the sign in,
+// sign out, registration and reset endpoints answer the allowed CORS origins, the
+// account and admin endpoints are same origin only.
 func (a *Auth) addRoutes() {
+	var paths []string
+	methods := make(map[string][]string)
+	crossOrigin := make(map[string]bool)
+	handle := func(method, path string, handler http.HandlerFunc) {
+		if _, ok := methods[path]; !ok {
+			paths = append(paths, path)
+		}
+		methods[path] = append(methods[path], method)
+		if crossOrigin[path] {
+			handler = a.corsHandler(handler)
+		}
+		a.config.Router.HandlerFunc(method, path, handler)
+	}
+	cors := func(method, path string, handler http.HandlerFunc) {
+		crossOrigin[path] = true
+		handle(method, path, handler)
+	}
+	// the server drops the body of HEAD responses.
+	get := func(path string, handler http.HandlerFunc) {
+		handle("GET", path, handler)
+		handle("HEAD", path, handler)
+	}
+
 	if a.config.EnableRegistration {
-		a.config.Router.HandlerFunc("POST", "/auth/register/", a.registerHandler())
+		cors("POST", "/auth/register/", a.registerHandler())
+	}
+	cors("POST", "/auth/signin/", a.signInHandler())
+	cors("POST", "/auth/signout/", a.signOutHandler())
+	get("/auth/test/", a.testHandler())
+	// no HEAD, it would run the whole export.
+	handle("GET", "/auth/account/export/", a.exportHandler())
+	handle("POST", "/auth/account/delete/", a.deleteAccountHandler())
+	get(JWKSPath, a.jwksHandler())
+	if a.config.Mailer != nil {
+		cors("POST", "/auth/reset/request/", a.resetRequestHandler())
+		cors("POST", "/auth/reset/confirm/", a.resetConfirmHandler())
+	}
+	if a.config.AdminRoutes {
+		get("/auth/admin/roles/", a.listUsersHandler())
+		handle("POST", "/auth/admin/roles/grant/", a.grantRoleHandler())
+		handle("POST", "/auth/admin/roles/revoke/", a.revokeRoleHandler())
+		handle("POST", "/auth/admin/sessions/expire/", a.expireSessionsHandler())
+		handle("POST", "/auth/admin/users/delete/", a.deleteUserHandler())
+		handle("POST", "/auth/admin/users/restore/", a.restoreUserHandler())
+		handle("POST", "/auth/admin/users/merge/", a.mergeUsersHandler())
+	}
+
+	for _, path := range paths {
+		a.config.Router.HandlerFunc("OPTIONS", path, a.optionsHandler(methods[path], crossOrigin[path]))
 	}
-	a.config.Router.HandlerFunc("POST", "/auth/signin/", a.signInHandler())
-	a.config.Router.HandlerFunc("GET", "/auth/signout/", a.signOutHandler())
-	a.config.Router.HandlerFunc("GET", "/auth/test/", a.testHandler())
 }
 
 // handlePanic will recover and log a panic.
@@ -32,7 +82,7 @@ func (a *Auth) handlePanic(f http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		defer func() {
 			if i := recover(); i != nil {
-				a.log.Error().Msgf("panic(recovered) at %s: %v", r.URL.Path, i)
+				correlate.Log(r.Context(), a.log).Error().Msgf("panic(recovered) at %s: %v", r.URL.Path, i)
 				w.WriteHeader(http.StatusInternalServerError)
 			}
 		}()
@@ -42,9 +92,12 @@ func (a *Auth) handlePanic(f http.HandlerFunc) http.HandlerFunc {
 
 // authLimiter limits the rate that single user or the sum of users can access auth requests
 func (a *Auth) authLimiter(f http.HandlerFunc) http.HandlerFunc {
+	if a.config.DisableLimiter {
+		return f
+	}
 	return func(w http.ResponseWriter, r *http.Request) {
 		if err := a.limiter.LimitRequest(w, r); err != nil {
-			limiter.WriteErrorResponse(w, err)
+			limiter.WriteRejection(w, r, err)
 			return
 		}
 		f(w, r)
@@ -57,39 +110,38 @@ func (a *Auth) registerHandler() http.HandlerFunc {
 }
 
 type register struct {
-	Email string `json:"email"`
-	User  string `json:"user"`
-	Pass  string `json:"pass"`
+	Email string `json:"email" validate:"required"`
+	User  string `json:"user" validate:"required"`
+	Pass  string `json:"pass" validate:"required"`
 }
 
 func (a *Auth) register() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		var reg register
-		err := json.NewDecoder(r.Body).Decode(&reg)
+		log := correlate.Log(r.Context(), a.log)
+
+		reg, err := decode.JSON[register](r)
 		if err != nil {
-			a.log.Err(err).Msg("register: error decoding request body")
-			w.WriteHeader(http.StatusBadRequest)
+			log.Err(err).Msg("register: error decoding request body")
+			decode.WriteError(w, r, err)
 			return
 		}
 
-		resp := a.validateRegistration(&reg)
-		if resp != nil {
-			if _, err = w.Write(resp); err != nil {
-				a.log.Err(err).Msg("register: error writing response to body")
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
+		if reason := a.validateRegistration(r.Context(), reg); reason != nil {
+			reason.write(w, r)
 			return
 		}
 
-		err = a.registerUser(&reg)
+		err = a.registerUser(r.Context(), reg)
+		if a.clientGone(r, err, "register") {
+			return
+		}
 		if err != nil {
-			a.log.Err(err).Msg("register: error inserting user into db")
+			log.Err(err).Msg("register: error inserting user into db")
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
-		a.log.Info().Msgf("%s successfully registered", reg.User)
+		log.Info().Msgf("%s successfully registered", reg.User)
 	}
 }
 
@@ -102,19 +154,20 @@ func (a *Auth) signInHandler() http.HandlerFunc {
 
 func (a *Auth) signIn() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		log := correlate.Log(r.Context(), a.log)
+
 		// make sure we are signed out first
 		name := a.signOutInternal(w, r)
 		if name != "UNKNOWN" {
-			a.log.Info().Msgf("%s successful signout", name)
+			log.Info().Msgf("%s successful signout", name)
 		}
 
-		user := &signin{}
 		// get the JSON body and decode into credentials
-		err := json.NewDecoder(r.Body).Decode(&user)
+		user, err := decode.JSON[signin](r)
 		if err != nil {
 			// if the structure of the body is wrong, return an HTTP error.
-			a.log.Err(err).Msg("signin: error decoding request body")
-			w.WriteHeader(http.StatusBadRequest)
+			log.Err(err).Msg("signin: error decoding request body")
+			decode.WriteError(w, r, err)
 			return
 		}
 
@@ -124,52 +177,92 @@ func (a *Auth) signIn() http.HandlerFunc {
 				user.User = user.User[:maxUsernameLen]
 			}
 			userName := str.ToASCII(user.User)
-			a.log.Warn().Msgf("%s tried to signin with a malformed username or password", userName)
+			log.Warn().Msgf("%s tried to signin with a malformed username or password", userName)
 			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
 
 		// get password hash from db
 		var hash string
-		hash, err = a.getSecurityInfo(user)
-		if err == pgx.ErrNoRows {
-			a.log.Warn().Msgf("%s tried to signin with an invalid username", user.User)
+		hash, err = a.getSecurityInfo(r.Context(), user)
+		if errors.Is(err, pgx.ErrNoRows) {
+			// check the password anyway so the response does not tell the user exists.
+			a.compareUnknown(user.Pass)
+			log.Warn().Msgf("%s tried to signin with an invalid username", user.User)
 			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
+		if a.clientGone(r, err, "signin") {
+			return
+		}
 		if err != nil {
-			a.log.Err(err).Msg("signin: error getting hash from db")
+			log.Err(err).Msg("signin: error getting hash from db")
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
 		// now compare the hash with the password
-		var valid bool
-		valid, err = a.compare(hash, user.Pass)
+		var valid, outdated bool
+		valid, outdated, err = a.compare(hash, user.Pass)
 		if err != nil {
-			a.log.Err(err).Msg("signin: comparing password")
+			log.Err(err).Msg("signin: comparing password")
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 		if !valid {
-			a.log.Warn().Msgf("%s tried to signin with an invalid password", user.User)
+			log.Warn().Msgf("%s tried to signin with an invalid password", user.User)
 			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
 
 		// authentication passed, create the auth tokens
-		user.expires = time.Now().Add(a.config.RefreshExpire)
-		user.session = int(rand.Int31())
-		if err = a.createTokens(w, user); err != nil {
+		user.expires = a.refreshExpiration(jwt.NewNumericDate(a.clock.Now()))
+		if user.session, err = newSessionID(); err != nil {
+			log.Err(err).Msg("signin: error creating session id")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if user.nonce, err = newNonce(); err != nil {
+			log.Err(err).Msg("signin: error creating refresh nonce")
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
-		a.log.Info().Msgf("%s successful signin", strconv.Itoa(user.id)+"|"+user.User)
+		// make sure the user is allowed another session
+		if a.refusesSignin() {
+			var reserved bool
+			reserved, err = a.reserveSession(r.Context(), user)
+			if a.clientGone(r, err, "signin") {
+				return
+			}
+			if err != nil {
+				log.Err(err).Msg("signin: error checking session limit")
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			if !reserved {
+				log.Warn().Msgf("%s tried to signin with too many active sessions", user.User)
+				respond.WriteError(w, r, http.StatusConflict, "too_many_sessions", "too many active sessions")
+				return
+			}
+		}
 
+		if err = a.createTokens(w, r, user); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		log.Info().Msgf("%s successful signin", strconv.Itoa(user.id)+"|"+user.User)
+
+		ctx := correlate.Detach(r.Context())
 		go func() {
 			if err := a.createSession(user); err != nil {
-				a.log.Err(err).Msg("signin: error creating new session")
+				correlate.Log(ctx, a.log).Err(err).Msg("signin: error creating new session")
+			}
+			if outdated {
+				if err := a.rehash(ctx, user, hash); err != nil {
+					correlate.Log(ctx, a.log).Err(err).Msg("signin: error replacing outdated password hash")
+				}
 			}
 		}()
 	}
@@ -183,7 +276,7 @@ func (a *Auth) signOutHandler() http.HandlerFunc {
 func (a *Auth) signOut() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		user := a.signOutInternal(w, r)
-		a.log.Info().Msgf("%s successful signout", user)
+		correlate.Log(r.Context(), a.log).Info().Msgf("%s successful signout", user)
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 	}
 }
@@ -193,31 +286,33 @@ func (a *Auth) signOutInternal(w http.ResponseWriter, r *http.Request) string {
 	claims, success := a.getClaims(r, "refresh")
 	if success {
 		user = claims.Subject
+		log := correlate.Log(correlate.Detach(r.Context()), a.log)
 		go func() {
 			creds := strings.Split(claims.Subject, "|")
 			if len(creds) != 2 {
-				a.log.Warn().Msgf("signout: claims.Subject had a length != 2")
+				log.Warn().Msgf("signout: claims.Subject had a length != 2")
 				return
 			}
 
 			id, err := strconv.Atoi(creds[0])
 			if err != nil {
-				a.log.Warn().Msgf("signout: atoi failed to convert string id to int")
+				log.Warn().Msgf("signout: atoi failed to convert string id to int")
 				return
 			}
 
-			sess, err := strconv.Atoi(claims.ID)
+			sess, err := sessionID(claims)
 			if err != nil {
-				a.log.Warn().Msgf("signout: atoi failed to convert string sess to int")
+				log.Warn().Msgf("signout: failed to parse the session id")
 				return
 			}
 
 			if err := a.deleteSession(id, sess); err != nil {
-				a.log.Err(err).Msg("signout: error deleting session")
+				log.Err(err).Msg("signout: error deleting session")
 			}
 		}()
 	}
 
+	a.revokeCookieTokens(r)
 	a.deleteCookie(w, "id")
 	a.deleteCookie(w, "session")
 	a.deleteCookie(w, "access")
@@ -232,13 +327,15 @@ func (a *Auth) testHandler() http.HandlerFunc {
 
 func (a *Auth) test() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		log := correlate.Log(r.Context(), a.log)
+
 		claims, success := a.getClaims(r, "access")
 		dataAccess := []byte("refresh to see")
 		var err error
 		if success {
 			dataAccess, err = json.Marshal(claims)
 			if err != nil {
-				a.log.Err(err).Msg("test: error marshalling claims")
+				log.Err(err).Msg("test: error marshalling claims")
 				w.WriteHeader(http.StatusInternalServerError)
 				return
 			}
@@ -246,36 +343,36 @@ func (a *Auth) test() http.HandlerFunc {
 
 		claims, success = a.getClaims(r, "session")
 		if !success {
-			a.log.Debug().Msg("test called without a valid user token")
+			log.Debug().Msg("test called without a valid user token")
 			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
 		dataUser, err := json.Marshal(claims)
 		if err != nil {
-			a.log.Err(err).Msg("test: error marshalling claims")
+			log.Err(err).Msg("test: error marshalling claims")
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
 		claims, success = a.getClaims(r, "refresh")
 		if !success {
-			a.log.Debug().Msg("test called without a valid refresh token")
+			log.Debug().Msg("test called without a valid refresh token")
 			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
 		dataRefresh, err := json.Marshal(claims)
 		if err != nil {
-			a.log.Err(err).Msg("test: error marshalling claims")
+			log.Err(err).Msg("test: error marshalling claims")
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
 		var dataID []byte
-		c, err := r.Cookie("id")
+		c, err := a.cookie(r, "id")
 		if err == nil {
 			dataID, err = base64.URLEncoding.DecodeString(c.Value)
 			if err != nil {
-				a.log.Err(err).Msg("test: error decoding id")
+				log.Err(err).Msg("test: error decoding id")
 				w.WriteHeader(http.StatusInternalServerError)
 				return
 			}
@@ -295,7 +392,7 @@ func (a *Auth) test() http.HandlerFunc {
 		_, _ = w.Write([]byte("\nid:      "))
 		_, _ = w.Write(dataID)
 
-		a.log.Debug().Msgf("%s test successfully authenticated", claims.Subject)
+		log.Debug().Msgf("%s test successfully authenticated", claims.Subject)
 	}
 }
 
@@ -5,9 +5,129 @@ package auth
 import (
 	"context"
 
+	"github.com/cwbriscoe/goweb/migrate"
 	"github.com/jackc/pgx/v5"
 )
 
+// Migrations lists the changes to the auth schema, add new migrations to the end.  The
+// baseline only creates the original tables when they are missing, so applying the set
+// to a database created before the migrations were recorded brings it up to date.
+var Migrations = migrate.Set{
+	Name:   "auth",
+	Schema: "auth",
+	Migrations: []migrate.Migration{
+		{Version: 1, Name: "baseline", SQL: `
+create table if not exists {schema}.user (
+	id int4 not null generated always as identity( increment by 1 minvalue 1 maxvalue 2147483647 start 1 cache 1 no cycle),
+	"name" varchar not null,
+	lname varchar not null,
+	email varchar not null,
+	hash varchar not null,
+	roles _text not null,
+	last_login_ts timestamptz not null,
+	create_ts timestamptz not null,
+	constraint auth_pk primary key (id)
+);
+create unique index if not exists auth_email_idx on {schema}.user using btree (email);
+create unique index if not exists auth_lname_idx on {schema}.user using btree (lname);
+create unique index if not exists auth_name_idx on {schema}.user using btree (name);
+grant select, insert, update on table {schema}.user to api;
+create table if not exists {schema}.sess (
+	id int4 not null,
+	auth_id int4 not null,
+	create_ts timestamptz not null,
+	expire_ts timestamptz not null,
+	last_used_ts timestamptz not null,
+	constraint sess_pk primary key (id, auth_id),
+	constraint sess_fk foreign key (auth_id) references {schema}.user(id) on delete cascade
+);
+grant select, insert, update, delete on table {schema}.sess to api;`},
+		{Version: 2, Name: "random session ids", SQL: `
+alter table {schema}.sess alter column id type int8;
+alter table {schema}.sess add column if not exists prev_id int8 not null default 0;`},
+		{Version: 3, Name: "opaque tokens", SQL: `
+create table if not exists {schema}.token (
+	token_hash varchar not null,
+	auth_id int4 null,
+	sess_id int8 not null,
+	claims jsonb not null,
+	expire_ts timestamptz not null,
+	create_ts timestamptz not null,
+	constraint token_pk primary key (token_hash),
+	constraint token_fk foreign key (auth_id) references {schema}.user(id) on delete cascade
+);
+create index if not exists token_expire_ts_idx on {schema}.token using btree (expire_ts);
+grant select, insert, delete on table {schema}.token to api;`},
+		{Version: 4, Name: "account audit", SQL: `
+create table if not exists {schema}.audit (
+	id int8 not null generated always as identity,
+	auth_id int4 not null,
+	"action" varchar not null,
+	actor varchar not null,
+	create_ts timestamptz not null,
+	constraint audit_pk primary key (id)
+);
+create index if not exists audit_auth_id_idx on {schema}.audit using btree (auth_id);
+grant select, insert on table {schema}.audit to api;`},
+		{Version: 5, Name: "tracker links", SQL: `
+create table if not exists {schema}.tracker (
+	tracker_id int8 not null,
+	auth_id int4 not null,
+	anon_id int8 null,
+	create_ts timestamptz not null,
+	constraint tracker_pk primary key (tracker_id, auth_id),
+	constraint tracker_fk foreign key (auth_id) references {schema}.user(id) on delete cascade
+);
+create index if not exists tracker_anon_id_idx on {schema}.tracker using btree (anon_id);
+grant select, insert, update, delete on table {schema}.tracker to api;`},
+		{Version: 6, Name: "route permissions", SQL: `
+create table if not exists {schema}.route_perm (
+	route varchar not null,
+	"scope" varchar not null,
+	constraint route_perm_pk primary key (route)
+);
+grant select on table {schema}.route_perm to api;`},
+		{Version: 7, Name: "refresh rotation", SQL: `
+alter table {schema}.sess add column if not exists nonce varchar not null default '';
+alter table {schema}.sess add column if not exists prev_nonce varchar not null default '';
+alter table {schema}.sess add column if not exists rotate_ts timestamptz not null default now();`},
+		{Version: 8, Name: "password reset", SQL: `
+create table if not exists {schema}.reset (
+	token_hash varchar not null,
+	auth_id int4 not null,
+	expire_ts timestamptz not null,
+	used_ts timestamptz null,
+	create_ts timestamptz not null,
+	constraint reset_pk primary key (token_hash),
+	constraint reset_fk foreign key (auth_id) references {schema}.user(id) on delete cascade
+);
+create index if not exists reset_auth_id_idx on {schema}.reset using btree (auth_id);
+grant select, insert, update, delete on table {schema}.reset to api;`},
+		{Version: 9, Name: "soft delete", SQL: `
+alter table {schema}.user add column if not exists deleted_at timestamptz null;
+alter table {schema}.sess add column if not exists deleted_at timestamptz null;
+grant select, delete on table {schema}.user, {schema}.sess to job;`},
+		{Version: 10, Name: "row versions", SQL: `
+alter table {schema}.user add column if not exists version int4 not null default 1;`},
+		{Version: 11, Name: "rehash grant", SQL: `
+grant update (hash) on table {schema}.user to job;`},
+		{Version: 12, Name: "stale access tokens", SQL: `
+alter table {schema}.user add column if not exists stale_ts timestamptz null;
+create index if not exists user_stale_ts_idx on {schema}.user using btree (stale_ts) where stale_ts is not null;`},
+		{Version: 13, Name: "unique live users", SQL: `
+drop index if exists {schema}.auth_email_idx;
+drop index if exists {schema}.auth_lname_idx;
+drop index if exists {schema}.auth_name_idx;
+create unique index if not exists auth_email_idx on {schema}.user using btree (email) where deleted_at is null;
+create unique index if not exists auth_lname_idx on {schema}.user using btree (lname) where deleted_at is null;
+create unique index if not exists auth_name_idx on {schema}.user using btree (name) where deleted_at is null;
+grant update (version) on table {schema}.user to job;`},
+		{Version: 14, Name: "wide tracker ids", SQL: `
+alter table {schema}.tracker alter column tracker_id type varchar using tracker_id::varchar;
+alter table {schema}.tracker alter column anon_id type varchar using anon_id::varchar;`},
+	},
+}
+
 // CreateSchema will create the auth schema and associated tables needed
 // for this package to run
 func CreateSchema(ctx context.Context, conn *pgx.Conn) error {
@@ -26,53 +146,12 @@ func CreateSchema(ctx context.Context, conn *pgx.Conn) error {
 		return err
 	}
 
-	sql = `
-CREATE TABLE auth.user (
-	id int4 NOT NULL GENERATED ALWAYS AS IDENTITY( INCREMENT BY 1 MINVALUE 1 MAXVALUE 2147483647 START 1 CACHE 1 NO CYCLE),
-	"name" varchar NOT NULL,
-	lname varchar NOT NULL,
-	email varchar NOT NULL,
-	hash varchar NOT NULL,
-	roles _text NOT NULL,
-	last_login_ts timestamptz NOT NULL,
-	create_ts timestamptz NOT NULL,
-	CONSTRAINT auth_pk PRIMARY KEY (id)
-);
-CREATE UNIQUE INDEX auth_email_idx ON auth.user USING btree (email);
-CREATE UNIQUE INDEX auth_lname_idx ON auth.user USING btree (lname);
-CREATE UNIQUE INDEX auth_name_idx ON auth.user USING btree (name);`
-	_, err = conn.Exec(ctx, sql)
-	if err != nil {
-		return err
-	}
-
-	sql = "grant select, insert, update on table auth.user to api;"
-	_, err = conn.Exec(ctx, sql)
-	if err != nil {
-		return err
-	}
-
-	sql = `
-	CREATE TABLE auth.sess (
-		id int4 NOT NULL,
-		auth_id int4 NOT NULL,
-		create_ts timestamptz NOT NULL,
-		expire_ts timestamptz NOT NULL,
-		last_used_ts timestamptz NOT NULL,
-		CONSTRAINT sess_pk PRIMARY KEY (id, auth_id)
-	);`
-	_, err = conn.Exec(ctx, sql)
-	if err != nil {
-		return err
-	}
-
-	sql = "grant select, insert, update, delete on table auth.sess to api;"
-	_, err = conn.Exec(ctx, sql)
+	_, err = migrate.Apply(ctx, conn, &Migrations)
 	if err != nil {
 		return err
 	}
 
-	sql = "ALTER TABLE auth.sess ADD CONSTRAINT sess_fk FOREIGN KEY (auth_id) REFERENCES auth.user(id) ON DELETE CASCADE;"
+	sql = "grant select on table auth.schema_version to api;"
 	_, err = conn.Exec(ctx, sql)
 	if err != nil {
 		return err
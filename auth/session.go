@@ -0,0 +1,32 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package auth
+
+import (
+	"slices"
+	"strconv"
+
+	"github.com/cwbriscoe/goweb/internal/randid"
+)
+
+// newSessionID returns a random positive session id.  Session ids are in the refresh
+// tokens, so they come from crypto/rand and can't be guessed from other sessions.
+func newSessionID() (int64, error) {
+	return randid.Int63()
+}
+
+// sessionID returns the session id of a refresh or access token.
+func sessionID(c *claims) (int64, error) {
+	return strconv.ParseInt(c.ID, 10, 64)
+}
+
+// elevated returns true if roles has a role that was not in old, the session id is then
+// regenerated so an id leaked before the change can't be used with the new roles.
+func elevated(old, roles []string) bool {
+	for _, role := range roles {
+		if !slices.Contains(old, role) {
+			return true
+		}
+	}
+	return false
+}
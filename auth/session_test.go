@@ -0,0 +1,133 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package auth
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+func TestNewSessionID(t *testing.T) {
+	seen := make(map[int64]bool)
+	for i := 0; i < 100; i++ {
+		id, err := newSessionID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id <= 0 {
+			t.Fatalf("expected a positive id, got %d", id)
+		}
+		if seen[id] {
+			t.Fatalf("id %d returned twice", id)
+		}
+		seen[id] = true
+
+		got, err := sessionID(&claims{RegisteredClaims: jwt.RegisteredClaims{ID: strconv.FormatInt(id, 10)}})
+		if err != nil || got != id {
+			t.Errorf("expected %d to round trip, got %d %v", id, got, err)
+		}
+	}
+}
+
+func TestElevated(t *testing.T) {
+	tests := []struct {
+		old, roles []string
+		want       bool
+	}{
+		{[]string{"user"}, []string{"user"}, false},
+		{[]string{"user", "admin"}, []string{"user"}, false},
+		{[]string{"user"}, []string{"user", "admin"}, true},
+		{nil, []string{"user"}, true},
+	}
+	for i, test := range tests {
+		if got := elevated(test.old, test.roles); got != test.want {
+			t.Errorf("%d: expected %t, got %t", i, test.want, got)
+		}
+	}
+}
+
+// memNonces keeps the nonce of a single session in memory.
+type memNonces struct {
+	state     sessionNonce
+	rotations int
+}
+
+func (n *memNonces) load(_ context.Context, user *signin) (*sessionNonce, error) {
+	user.permissions = []string{"user"}
+	state := n.state
+	return &state, nil
+}
+
+func (n *memNonces) rotate(_ context.Context, user *signin, id int64, old string) (bool, error) {
+	if n.state.id != id || n.state.current != old {
+		return false, nil
+	}
+	n.state = sessionNonce{id: user.session, current: user.nonce, previous: old, rotated: time.Now()}
+	n.rotations++
+	return true, nil
+}
+
+func TestRotateRefresh(t *testing.T) {
+	ctx := context.Background()
+	nonces := &memNonces{state: sessionNonce{id: 7, current: "n1"}}
+	refresh := func(a *Auth, nonce string) (*claims, string, error) {
+		c := &claims{Permissions: []string{"user"}, Nonce: nonce}
+		token, err := a.rotateRefresh(ctx, &signin{User: "chris", id: 1, session: 7}, c)
+		return c, token, err
+	}
+
+	// a token that can't be signed must not use up the nonce of the browser.
+	broken := newTestAuth()
+	broken.keys.Store(&[]*signingKey{{kid: "rs", method: jwt.SigningMethodRS256}})
+	broken.nonces = nonces
+	if _, _, err := refresh(broken, "n1"); err == nil {
+		t.Fatal("expected the signing to fail")
+	}
+	if nonces.rotations != 0 || nonces.state.current != "n1" {
+		t.Fatalf("the nonce was rotated without a new token: %+v", nonces.state)
+	}
+
+	a := newTestAuth()
+	a.nonces = nonces
+	c, token, err := refresh(a, "n1")
+	if err != nil || token == "" {
+		t.Fatalf("expected a new refresh token, got %v", err)
+	}
+	if nonces.rotations != 1 || c.Nonce != nonces.state.current || c.Nonce == "n1" || c.ID != "7" {
+		t.Errorf("expected the token to carry the rotated nonce, got %+v and %+v", c, nonces.state)
+	}
+
+	// the old token is replayed by a concurrent request during the grace period.
+	if c, _, err = refresh(a, "n1"); err != nil || c.Nonce != nonces.state.current || nonces.rotations != 1 {
+		t.Errorf("expected the current nonce within the grace period, got %v", err)
+	}
+
+	nonces.state.rotated = time.Now().Add(-2 * rotationGrace)
+	if _, _, err = refresh(a, "n1"); !errors.Is(err, errTokenReuse) {
+		t.Errorf("expected the reuse to be detected, got %v", err)
+	}
+}
+
+func TestRefusesSignin(t *testing.T) {
+	tests := []struct {
+		max    int
+		policy SessionLimitPolicy
+		want   bool
+	}{
+		{0, RefuseSignin, false},
+		{2, RevokeOldest, false},
+		{2, RefuseSignin, true},
+	}
+	for i, test := range tests {
+		a := newTestAuth()
+		a.config.MaxSessions, a.config.SessionLimit = test.max, test.policy
+		if got := a.refusesSignin(); got != test.want {
+			t.Errorf("%d: expected %t, got %t", i, test.want, got)
+		}
+	}
+}
@@ -3,9 +3,12 @@
 package auth
 
 import (
+	"context"
+	"net/http"
 	"net/mail"
 
 	"github.com/cwbriscoe/goutil/str"
+	"github.com/cwbriscoe/goweb/internal/respond"
 )
 
 const (
@@ -16,9 +19,25 @@ const (
 	maxEmailLen    = 320
 )
 
-func (a *Auth) validateRegistration(reg *register) []byte {
+// rejection is why a request was rejected, written as the error envelope.
+type rejection struct {
+	status  int
+	code    string
+	message string
+}
+
+// write writes the rejection as the error envelope.
+func (rej *rejection) write(w http.ResponseWriter, r *http.Request) {
+	respond.WriteError(w, r, rej.status, rej.code, rej.message)
+}
+
+func badRequest(code, message string) *rejection {
+	return &rejection{status: http.StatusBadRequest, code: code, message: message}
+}
+
+func (a *Auth) validateRegistration(ctx context.Context, reg *register) *rejection {
 	if !emailValid(reg.Email) {
-		return []byte("{\"error\":\"invalid email address\"}")
+		return badRequest("invalid_email", "invalid email address")
 	}
 
 	if reason := checkUsername(reg.User); reason != nil {
@@ -29,16 +48,16 @@ func (a *Auth) validateRegistration(reg *register) []byte {
 		return reason
 	}
 
-	userExists, emailExists, err := a.checkAlreadyExists(reg)
+	userExists, emailExists, err := a.checkAlreadyExists(ctx, reg)
 	if userExists {
-		return []byte("{\"error\":\"user name already exists\"}")
+		return &rejection{status: http.StatusConflict, code: "user_exists", message: "user name already exists"}
 	}
 	if emailExists {
-		return []byte("{\"error\":\"email address already exists\"}")
+		return &rejection{status: http.StatusConflict, code: "email_exists", message: "email address already exists"}
 	}
 	if err != nil {
 		a.log.Err(err).Msg("validateRegistration: error validating data with the db")
-		return []byte("{\"error\":\"internal server error\"}")
+		return &rejection{status: http.StatusInternalServerError, code: "internal_server_error", message: "internal server error"}
 	}
 
 	return nil
@@ -52,9 +71,9 @@ func emailValid(email string) bool {
 	return err == nil
 }
 
-func checkUsername(user string) []byte {
-	invalidLength := []byte("{\"error\":\"Invalid user name.  Must have a length >= 4 and <= 20.\"}")
-	invalidUsername := []byte("{\"error\":\"Invalid user name.  Must only contain characters: [a-z][A-Z][0-9].\"}")
+func checkUsername(user string) *rejection {
+	invalidLength := badRequest("invalid_username", "Invalid user name.  Must have a length >= 4 and <= 20.")
+	invalidUsername := badRequest("invalid_username", "Invalid user name.  Must only contain characters: [a-z][A-Z][0-9].")
 
 	if len(user) < minUsernameLen || len(user) > maxUsernameLen {
 		return invalidLength
@@ -67,7 +86,7 @@ func checkUsername(user string) []byte {
 	firstChar := true
 	for _, char := range user {
 		if firstChar && !str.IsLower(char) && !str.IsUpper(char) {
-			return []byte("{\"error\":\"Invalid user name.  First character has to be alphabetic: [a-z][A-Z].\"}")
+			return badRequest("invalid_username", "Invalid user name.  First character has to be alphabetic: [a-z][A-Z].")
 		}
 
 		if !str.IsLower(char) && !str.IsUpper(char) && !str.IsDigit(char) {
@@ -80,9 +99,9 @@ func checkUsername(user string) []byte {
 	return nil
 }
 
-func checkPassword(pass string) []byte {
-	invalidLength := []byte("{\"error\":\"Invalid password.  Must have a length >= 10 and <= 32.\"}")
-	invalidPassword := []byte("{\"error\":\"Invalid password.  Must only contain characters: [a-z][A-Z][0-9][ !#$%&()*+,-./:;<=>?@^_{|}~]\"}")
+func checkPassword(pass string) *rejection {
+	invalidLength := badRequest("invalid_password", "Invalid password.  Must have a length >= 10 and <= 32.")
+	invalidPassword := badRequest("invalid_password", "Invalid password.  Must only contain characters: [a-z][A-Z][0-9][ !#$%&()*+,-./:;<=>?@^_{|}~]")
 
 	if len(pass) < minPasswordLen || len(pass) > maxPasswordLen {
 		return invalidLength
@@ -111,7 +130,7 @@ func checkPassword(pass string) []byte {
 	}
 
 	if !lwr || !upr || !num || !spl {
-		return []byte("{\"error\":\"Invalid password.  Must contain at least one character from each category: [a-z][A-Z][0-9][!#$%&()*+,-./:;<=>?@^_{|}~]\"}")
+		return badRequest("invalid_password", "Invalid password.  Must contain at least one character from each category: [a-z][A-Z][0-9][!#$%&()*+,-./:;<=>?@^_{|}~]")
 	}
 
 	return nil
@@ -0,0 +1,103 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package auth
+
+import (
+	"encoding/base64"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/blowfish"
+)
+
+// wrappedPrefix starts the legacy hashes rewrapped by ScanHashes.  The digest of the
+// bcrypt cost 4 hash disguised by the legacy format is hashed again with the configured
+// hasher, so a stolen hash costs as much to crack as a new one.  The bcrypt setting is
+// kept in the clear to compute the digest of a password.  The format is:
+//
+//	$w$$2a$04$<bcrypt salt><hash of the bcrypt digest>
+//
+// They are replaced with a plain hash on the next signin like other outdated hashes.
+const wrappedPrefix = "$w$"
+
+// bcryptSettingSize is the length of the version, cost and salt of a bcrypt hash.
+const bcryptSettingSize = 29
+
+var bcryptEncoding = base64.NewEncoding("./ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789").WithPadding(base64.NoPadding)
+
+// bcryptMagic is the IV of the 64 blowfish encryptions of bcrypt, "OrpheanBeholderScryDoubt".
+var bcryptMagic = []byte{
+	0x4f, 0x72, 0x70, 0x68, 0x65, 0x61, 0x6e, 0x42,
+	0x65, 0x68, 0x6f, 0x6c, 0x64, 0x65, 0x72, 0x53,
+	0x63, 0x72, 0x79, 0x44, 0x6f, 0x75, 0x62, 0x74,
+}
+
+// wrapBcrypt hashes the digest of the bcrypt hash again with the hasher.
+func wrapBcrypt(hasher Hasher, inner string) (string, error) {
+	if len(inner) <= bcryptSettingSize || !strings.HasPrefix(inner, "$2") {
+		return "", ErrUnknownHash
+	}
+	outer, err := hasher.Hash([]byte(inner[bcryptSettingSize:]))
+	if err != nil {
+		return "", err
+	}
+	return wrappedPrefix + inner[:bcryptSettingSize] + outer, nil
+}
+
+// compareWrapped computes the bcrypt digest of the password with the setting of the
+// wrapped hash and compares it with the outer hash.
+func compareWrapped(hasher Hasher, hash string, pass []byte) error {
+	setting, outer, ok := splitWrapped(hash)
+	if !ok {
+		return ErrUnknownHash
+	}
+	cost, err := strconv.Atoi(setting[4:6])
+	if err != nil || cost < 4 || cost > 31 {
+		return ErrUnknownHash
+	}
+	digest, err := bcryptDigest(pass, cost, setting[7:])
+	if err != nil {
+		return ErrUnknownHash
+	}
+	return compareHash(hasher, outer, digest)
+}
+
+// splitWrapped returns the bcrypt setting and the outer hash of a wrapped hash.
+func splitWrapped(hash string) (string, string, bool) {
+	rest, ok := strings.CutPrefix(hash, wrappedPrefix)
+	if !ok || len(rest) <= bcryptSettingSize || !strings.HasPrefix(rest, "$2") {
+		return "", "", false
+	}
+	return rest[:bcryptSettingSize], rest[bcryptSettingSize:], true
+}
+
+// bcryptDigest returns the encoded digest bcrypt stores after the salt, the bcrypt
+// package only exposes it with a random salt.
+func bcryptDigest(pass []byte, cost int, salt string) ([]byte, error) {
+	csalt, err := bcryptEncoding.DecodeString(salt)
+	if err != nil {
+		return nil, err
+	}
+
+	// the C implementations expand the key with its trailing NUL.
+	key := append(pass[:len(pass):len(pass)], 0)
+	c, err := blowfish.NewSaltedCipher(key, csalt)
+	if err != nil {
+		return nil, err
+	}
+	for i := uint64(0); i < 1<<uint(cost); i++ {
+		blowfish.ExpandKey(key, c)
+		blowfish.ExpandKey(csalt, c)
+	}
+
+	data := make([]byte, len(bcryptMagic))
+	copy(data, bcryptMagic)
+	for i := 0; i < len(data); i += 8 {
+		for j := 0; j < 64; j++ {
+			c.Encrypt(data[i:i+8], data[i:i+8])
+		}
+	}
+
+	// only 23 of the 24 bytes are encoded, like the C implementations.
+	return []byte(bcryptEncoding.EncodeToString(data[:23])), nil
+}
@@ -0,0 +1,207 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+// Package chaos injects faults into a share of the requests matching operator defined
+// rules: added latency, error responses or dropped connections.  It is meant for staging,
+// to check that clients retry and back off and that circuit breakers open and recover.
+package chaos
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rule selects requests and the faults injected into them.  Empty conditions always
+// match.  Latency is added first, then the request either gets the error status, is
+// dropped or is served normally.
+type Rule struct {
+	Name    string  `json:"name" doc:"name of the rule in the logs"`
+	Path    string  `json:"path" doc:"regex matched against the url path"`
+	Method  string  `json:"method" doc:"comma separated list of methods"`
+	Percent float64 `json:"percent" doc:"share of the matching requests to inject faults into, 0-100"`
+	Latency int     `json:"latency" doc:"milliseconds added before the request is handled"`
+	Jitter  int     `json:"jitter" doc:"up to this many random milliseconds added to the latency"`
+	Status  int     `json:"status" doc:"error status returned instead of serving the request"`
+	Drop    bool    `json:"drop" doc:"close the connection without a response"`
+
+	path    *regexp.Regexp
+	methods []string
+}
+
+// Fault is the fault picked for a single request.
+type Fault struct {
+	Rule    string        `json:"rule"`
+	Latency time.Duration `json:"latency,omitempty"`
+	Status  int           `json:"status,omitempty"`
+	Drop    bool          `json:"drop,omitempty"`
+}
+
+// Settings contains the rules for an Engine.
+type Settings struct {
+	Enabled bool
+	Rules   []Rule
+}
+
+// ErrInvalidRule is returned for a rule that can not be applied.
+var ErrInvalidRule = errors.New("invalid chaos rule")
+
+// Engine picks the faults for requests.  Rules are evaluated in order, the first
+// matching rule decides.  It is safe to change the rules and toggle the engine while
+// requests are served.
+type Engine struct {
+	mu      sync.RWMutex
+	enabled bool
+	rules   []Rule
+	rand    *rand.Rand
+	randMu  sync.Mutex
+}
+
+// NewEngine compiles the rules and returns a new Engine.
+func NewEngine(settings *Settings) (*Engine, error) {
+	e := &Engine{rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+	if err := e.SetRules(settings.Rules); err != nil {
+		return nil, err
+	}
+	e.enabled = settings.Enabled
+	return e, nil
+}
+
+// SetRules compiles and replaces the rules.  The old rules are kept on error.
+func (e *Engine) SetRules(rules []Rule) error {
+	compiled := make([]Rule, len(rules))
+	for i, rule := range rules {
+		if err := rule.compile(); err != nil {
+			return err
+		}
+		compiled[i] = rule
+	}
+
+	e.mu.Lock()
+	e.rules = compiled
+	e.mu.Unlock()
+	return nil
+}
+
+func (rule *Rule) compile() error {
+	var err error
+	rule.path, rule.methods = nil, nil
+	if rule.Path != "" {
+		if rule.path, err = regexp.Compile(rule.Path); err != nil {
+			return fmt.Errorf("chaos rule %q: %w", rule.Name, err)
+		}
+	}
+	for _, method := range strings.Split(rule.Method, ",") {
+		if method = strings.TrimSpace(method); method != "" {
+			rule.methods = append(rule.methods, strings.ToUpper(method))
+		}
+	}
+	switch {
+	case rule.Percent <= 0 || rule.Percent > 100:
+		return fmt.Errorf("chaos rule %q: %w: percent must be above 0 and at most 100", rule.Name, ErrInvalidRule)
+	case rule.Latency < 0 || rule.Jitter < 0:
+		return fmt.Errorf("chaos rule %q: %w: latency and jitter can not be negative", rule.Name, ErrInvalidRule)
+	case rule.Status != 0 && (rule.Status < 400 || rule.Status > 599):
+		return fmt.Errorf("chaos rule %q: %w: status must be an error status", rule.Name, ErrInvalidRule)
+	case rule.Status != 0 && rule.Drop:
+		return fmt.Errorf("chaos rule %q: %w: status and drop can not be combined", rule.Name, ErrInvalidRule)
+	case rule.Status == 0 && !rule.Drop && rule.Latency == 0 && rule.Jitter == 0:
+		return fmt.Errorf("chaos rule %q: %w: no fault to inject", rule.Name, ErrInvalidRule)
+	}
+	return nil
+}
+
+// Rules returns the configured rules.
+func (e *Engine) Rules() []Rule {
+	if e == nil {
+		return nil
+	}
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.rules
+}
+
+// Enabled returns true if faults are being injected.
+func (e *Engine) Enabled() bool {
+	if e == nil {
+		return false
+	}
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.enabled
+}
+
+// SetEnabled starts or stops injecting faults.
+func (e *Engine) SetEnabled(enabled bool) {
+	e.mu.Lock()
+	e.enabled = enabled
+	e.mu.Unlock()
+}
+
+// Pick returns the fault to inject into the request or nil if it should be served
+// normally.
+func (e *Engine) Pick(r *http.Request) *Fault {
+	if e == nil {
+		return nil
+	}
+
+	e.mu.RLock()
+	enabled, rules := e.enabled, e.rules
+	e.mu.RUnlock()
+	if !enabled {
+		return nil
+	}
+
+	for i := range rules {
+		rule := &rules[i]
+		if !rule.match(r) {
+			continue
+		}
+		if e.float()*100 >= rule.Percent {
+			return nil
+		}
+		fault := &Fault{
+			Rule:    rule.Name,
+			Latency: time.Duration(rule.Latency) * time.Millisecond,
+			Status:  rule.Status,
+			Drop:    rule.Drop,
+		}
+		if rule.Jitter > 0 {
+			fault.Latency += time.Duration(e.intn(rule.Jitter+1)) * time.Millisecond
+		}
+		return fault
+	}
+	return nil
+}
+
+func (rule *Rule) match(r *http.Request) bool {
+	if rule.path != nil && !rule.path.MatchString(r.URL.Path) {
+		return false
+	}
+	if len(rule.methods) > 0 {
+		for _, method := range rule.methods {
+			if method == r.Method {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// rand.Rand is not safe for concurrent use.
+func (e *Engine) float() float64 {
+	e.randMu.Lock()
+	defer e.randMu.Unlock()
+	return e.rand.Float64()
+}
+
+func (e *Engine) intn(n int) int {
+	e.randMu.Lock()
+	defer e.randMu.Unlock()
+	return e.rand.Intn(n)
+}
@@ -0,0 +1,77 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package chaos
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPick(t *testing.T) {
+	e, err := NewEngine(&Settings{
+		Enabled: true,
+		Rules: []Rule{
+			{Name: "slow", Path: "^/api/", Method: "get", Percent: 100, Latency: 200, Jitter: 50},
+			{Name: "errors", Path: "^/api/", Percent: 100, Status: 503},
+			{Name: "never", Path: "^/drop/", Percent: 0.0001, Drop: true},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := e.Pick(httptest.NewRequest("GET", "/api/items", nil))
+	if f == nil || f.Rule != "slow" || f.Latency < 200*time.Millisecond || f.Latency > 250*time.Millisecond {
+		t.Errorf("expected slow with 200-250ms, got %+v", f)
+	}
+
+	f = e.Pick(httptest.NewRequest("POST", "/api/items", nil))
+	if f == nil || f.Rule != "errors" || f.Status != 503 {
+		t.Errorf("expected errors with 503, got %+v", f)
+	}
+
+	if f = e.Pick(httptest.NewRequest("GET", "/", nil)); f != nil {
+		t.Errorf("expected no fault, got %+v", f)
+	}
+
+	e.SetEnabled(false)
+	if f = e.Pick(httptest.NewRequest("GET", "/api/items", nil)); f != nil {
+		t.Errorf("expected no fault while disabled, got %+v", f)
+	}
+}
+
+func TestPercent(t *testing.T) {
+	e, err := NewEngine(&Settings{
+		Enabled: true,
+		Rules:   []Rule{{Name: "half", Percent: 50, Status: 500}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	faults := 0
+	for i := 0; i < 10000; i++ {
+		if e.Pick(httptest.NewRequest("GET", "/", nil)) != nil {
+			faults++
+		}
+	}
+	if faults < 4500 || faults > 5500 {
+		t.Errorf("expected about 5000 faults, got %d", faults)
+	}
+}
+
+func TestInvalidRule(t *testing.T) {
+	bad := []Rule{
+		{Name: "percent", Status: 500},
+		{Name: "status", Percent: 10, Status: 200},
+		{Name: "both", Percent: 10, Status: 500, Drop: true},
+		{Name: "nothing", Percent: 10},
+		{Name: "regex", Path: "(", Percent: 10, Drop: true},
+	}
+	for _, rule := range bad {
+		if _, err := NewEngine(&Settings{Rules: []Rule{rule}}); err == nil {
+			t.Errorf("%s: expected an error", rule.Name)
+		}
+	}
+}
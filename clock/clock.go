@@ -0,0 +1,107 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+// Package clock provides the time and randomness used by the framework behind
+// interfaces, so tests and simulations can control them.  Secrets and tokens are always
+// read from crypto/rand and never from a Rand.
+package clock
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Clock tells the current time.
+type Clock interface {
+	Now() time.Time
+}
+
+// Func adapts a function to a Clock, ie: clock.Func(time.Now).
+type Func func() time.Time
+
+// Now calls f.
+func (f Func) Now() time.Time {
+	return f()
+}
+
+// Real is the Clock of the system time.
+var Real Clock = Func(time.Now)
+
+// Fake is a Clock that only moves when it is set or advanced.  It is safe for
+// concurrent use.
+type Fake struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// NewFake returns a Fake clock set to now.
+func NewFake(now time.Time) *Fake {
+	return &Fake{now: now}
+}
+
+// Now returns the time the clock is set to.
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+// Set sets the clock to t.
+func (f *Fake) Set(t time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = t
+}
+
+// Advance moves the clock forward by d.
+func (f *Fake) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = f.now.Add(d)
+}
+
+// Rand is a source of non cryptographic randomness, ie: for jitter and sampling.
+type Rand interface {
+	Int63n(n int64) int64
+	Intn(n int) int
+	Float64() float64
+}
+
+// RealRand is the Rand of the global source of math/rand.
+var RealRand Rand = globalRand{}
+
+type globalRand struct{}
+
+func (globalRand) Int63n(n int64) int64 { return rand.Int63n(n) }
+func (globalRand) Intn(n int) int       { return rand.Intn(n) }
+func (globalRand) Float64() float64     { return rand.Float64() }
+
+// NewRand returns a Rand seeded with seed, so the same values are drawn on every run.
+// It is safe for concurrent use.
+func NewRand(seed int64) Rand {
+	return &lockedRand{r: rand.New(rand.NewSource(seed))}
+}
+
+// lockedRand is a seeded source of math/rand, which is not safe for concurrent use.
+type lockedRand struct {
+	mu sync.Mutex
+	r  *rand.Rand
+}
+
+func (l *lockedRand) Int63n(n int64) int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.r.Int63n(n)
+}
+
+func (l *lockedRand) Intn(n int) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.r.Intn(n)
+}
+
+func (l *lockedRand) Float64() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.r.Float64()
+}
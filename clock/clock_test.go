@@ -0,0 +1,38 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFake(t *testing.T) {
+	start := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	c := NewFake(start)
+	if !c.Now().Equal(start) {
+		t.Errorf("expected %s, got %s", start, c.Now())
+	}
+
+	c.Advance(90 * time.Minute)
+	if want := start.Add(90 * time.Minute); !c.Now().Equal(want) {
+		t.Errorf("expected %s, got %s", want, c.Now())
+	}
+
+	c.Set(start)
+	if !c.Now().Equal(start) {
+		t.Errorf("expected %s after Set, got %s", start, c.Now())
+	}
+}
+
+func TestNewRand(t *testing.T) {
+	a, b := NewRand(42), NewRand(42)
+	for i := 0; i < 10; i++ {
+		if x, y := a.Int63n(1000), b.Int63n(1000); x != y {
+			t.Fatalf("draw %d: expected the same value with the same seed, got %d and %d", i, x, y)
+		}
+	}
+	if f := a.Float64(); f < 0 || f >= 1 {
+		t.Errorf("Float64 out of range: %f", f)
+	}
+}
@@ -0,0 +1,228 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+// Package main checks that a goweb instance can start with its config before traffic is
+// sent to it: the config is valid, the db is reachable and has the schemas with all
+// their migrations applied, the secrets are usable, the static and log directories exist and the tls certificate chain is
+// valid.  It prints a report and exits non-zero if any check failed, for use in deploy
+// pipelines.
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cwbriscoe/goweb/auth"
+	"github.com/cwbriscoe/goweb/config"
+	"github.com/cwbriscoe/goweb/job"
+	"github.com/cwbriscoe/goweb/migrate"
+	"github.com/cwbriscoe/goweb/schema"
+	"github.com/cwbriscoe/goweb/server"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+type checker struct {
+	cfg      *config.Config
+	secrets  string
+	minValid time.Duration
+	failed   int
+}
+
+func main() {
+	if err := run(); err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	// parse flags
+	file := flag.String("config", "./config/prod.json", "config file to check")
+	secrets := flag.String("secrets", server.DefaultSecretFile, "secrets file to check")
+	timeout := flag.Duration("timeout", 10*time.Second, "timeout for the db checks")
+	minValid := flag.Duration("cert-valid", 14*24*time.Hour, "min time the tls certificate must stay valid")
+	flag.Parse()
+
+	c := &checker{cfg: &config.Config{}, secrets: *secrets, minValid: *minValid}
+	if err := c.cfg.Load(*file); err != nil {
+		return fmt.Errorf("error loading config %s: %w", *file, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	c.report("config", c.cfg.Validate())
+	c.checkDB(ctx)
+	c.checkDir("log dir", c.cfg.LogDir, true)
+	c.checkDir("app root", c.root(c.cfg.HTTPS.AppRoot), false)
+	c.checkDir("static root", c.root(c.cfg.HTTPS.StaticRoot), false)
+	c.checkTLS()
+
+	if c.failed > 0 {
+		return fmt.Errorf("%d checks failed", c.failed)
+	}
+	fmt.Println("all checks passed")
+	return nil
+}
+
+// report prints the result of a check.
+func (c *checker) report(name string, err error) {
+	if err != nil {
+		c.failed++
+		fmt.Printf("FAIL  %-14s %v\n", name, err)
+		return
+	}
+	fmt.Printf("ok    %s\n", name)
+}
+
+// skip prints a check that does not apply to the config.
+func (c *checker) skip(name, reason string) {
+	fmt.Printf("skip  %-14s %s\n", name, reason)
+}
+
+func (c *checker) root(dir string) string {
+	if dir == "" {
+		return ""
+	}
+	return c.cfg.RootDir + dir
+}
+
+// checkDB connects like the server does, then checks the schemas, their migrations and
+// the secrets.
+func (c *checker) checkDB(ctx context.Context) {
+	connstr := "postgresql://" +
+		c.cfg.DB.Host + ":" +
+		c.cfg.DB.Port + "/" +
+		c.cfg.DB.Name + "?user=" +
+		c.cfg.DB.User + "&password=" +
+		c.cfg.DB.Pass
+	pool, err := pgxpool.New(ctx, connstr)
+	if err == nil {
+		defer pool.Close()
+		err = pool.Ping(ctx)
+	}
+	c.report("db", err)
+	if err != nil {
+		// the secrets file can still be checked without the db.
+		c.checkSecrets(ctx, nil)
+		return
+	}
+
+	conn, err := pool.Acquire(ctx)
+	if err == nil {
+		var missing []string
+		missing, err = schema.Missing(ctx, conn.Conn())
+		conn.Release()
+		if err == nil && len(missing) > 0 {
+			err = fmt.Errorf("missing or not usable: %s", strings.Join(missing, ", "))
+		}
+	}
+	c.report("schemas", err)
+	c.report("migrations", checkMigrations(ctx, pool))
+
+	c.checkSecrets(ctx, pool)
+}
+
+// checkMigrations fails when the auth or job schema has pending migrations, the server
+// would run with tables older than its queries.
+func checkMigrations(ctx context.Context, pool *pgxpool.Pool) error {
+	var errs []error
+	for _, set := range []*migrate.Set{&auth.Migrations, &job.Migrations} {
+		status, err := migrate.Check(ctx, pool, set)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", set.Name, err))
+			continue
+		}
+		if !status.Current() {
+			errs = append(errs, fmt.Errorf("%s: version %d of %d, pending: %s", set.Name, status.Version, status.Latest, strings.Join(status.Pending, ", ")))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (c *checker) checkSecrets(ctx context.Context, pool *pgxpool.Pool) {
+	c.report("secrets", auth.CheckSecrets(ctx, &auth.Config{
+		SecretPath: c.secrets,
+		DB:         pool,
+	}))
+}
+
+// checkDir checks that dir is a directory, and that files can be created in it when
+// writable is set.
+func (c *checker) checkDir(name, dir string, writable bool) {
+	if dir == "" {
+		c.skip(name, "not configured")
+		return
+	}
+
+	info, err := os.Stat(dir)
+	if err == nil && !info.IsDir() {
+		err = fmt.Errorf("%s is not a directory", dir)
+	}
+	if err == nil && writable {
+		var f *os.File
+		if f, err = os.CreateTemp(dir, ".check-*"); err == nil {
+			_ = f.Close()
+			err = os.Remove(f.Name())
+		}
+	}
+	c.report(name, err)
+}
+
+func (c *checker) checkTLS() {
+	cfg := c.cfg.TLS
+	switch {
+	case cfg.AutoCert:
+		cacheDir := cfg.CacheDir
+		if cacheDir == "" {
+			cacheDir = "./config/certs"
+		}
+		c.checkDir("autocert cache", cacheDir, true)
+	case cfg.CertFile != "" && cfg.KeyFile != "":
+		c.report("tls", c.verifyCert(cfg.CertFile, cfg.KeyFile))
+	default:
+		c.skip("tls", "no certificate configured")
+	}
+}
+
+// verifyCert checks the key matches the certificate and that the chain in the file
+// verifies against the system roots for the configured domain.
+func (c *checker) verifyCert(certFile, keyFile string) error {
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+
+	certs := make([]*x509.Certificate, 0, len(pair.Certificate))
+	for _, der := range pair.Certificate {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return err
+		}
+		certs = append(certs, cert)
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	leaf := certs[0]
+	if _, err = leaf.Verify(x509.VerifyOptions{
+		DNSName:       c.cfg.HTTPS.Domain,
+		Intermediates: intermediates,
+	}); err != nil {
+		return err
+	}
+
+	if left := time.Until(leaf.NotAfter); left < c.minValid {
+		return errors.New("certificate expires " + leaf.NotAfter.Format(time.RFC3339))
+	}
+	return nil
+}
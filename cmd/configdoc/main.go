@@ -0,0 +1,138 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+// Package main generates the documentation of the config file from the tags of
+// config.Config: an example config with every setting commented and set to its
+// default, or a markdown or html reference of the settings.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"html/template"
+	"os"
+	"strings"
+
+	"github.com/cwbriscoe/goweb/config"
+)
+
+func main() {
+	if err := run(); err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	// parse flags
+	format := flag.String("format", "example", "example, markdown or html")
+	out := flag.String("out", "", "file to write, defaults to stdout")
+	flag.Parse()
+
+	var data []byte
+	switch *format {
+	case "example":
+		data = config.Example()
+	case "markdown":
+		data = markdown(flatten(config.Settings()))
+	case "html":
+		var err error
+		if data, err = html(flatten(config.Settings())); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown format %q", *format)
+	}
+
+	if *out == "" {
+		_, err := os.Stdout.Write(data)
+		return err
+	}
+	return os.WriteFile(*out, data, 0o644)
+}
+
+// flatten returns the settings and the settings inside them in order.
+func flatten(settings []config.Setting) []config.Setting {
+	var list []config.Setting
+	for _, s := range settings {
+		list = append(list, s)
+		list = append(list, flatten(s.Settings)...)
+	}
+	return list
+}
+
+// description returns the doc of the setting with its allowed values.
+func description(s *config.Setting) string {
+	desc := s.Doc
+	if len(s.Enum) > 0 {
+		desc += ", one of: " + strings.Join(s.Enum, ", ")
+	}
+	if s.Required {
+		desc += ", required"
+	}
+	return desc
+}
+
+const intro = "Settings are read from the GOWEB_ environment variables first, then from the config " +
+	"file, where ${NAME} is replaced with the environment variable NAME.  Unset settings use " +
+	"their default.  <name> stands for the keys of a map and [] for the items of a list."
+
+func markdown(settings []config.Setting) []byte {
+	var b bytes.Buffer
+	b.WriteString("# Config reference\n\n")
+	b.WriteString(strings.ReplaceAll(intro, "<name>", "`<name>`") + "\n\n")
+	b.WriteString("| Setting | Type | Default | Environment | Description |\n")
+	b.WriteString("| --- | --- | --- | --- | --- |\n")
+	for i := range settings {
+		s := &settings[i]
+		fmt.Fprintf(&b, "| `%s` | %s | %s | %s | %s |\n", s.Path, s.Type, code(s.Default), code(s.Env()),
+			escape.Replace(description(s)))
+	}
+	return b.Bytes()
+}
+
+// escape keeps the descriptions from breaking the markdown tables or being taken as html.
+var escape = strings.NewReplacer("|", `\|`, "<", "&lt;")
+
+func code(s string) string {
+	if s == "" {
+		return ""
+	}
+	return "`" + s + "`"
+}
+
+var page = template.Must(template.New("config").Funcs(template.FuncMap{
+	"description": description,
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Config reference</title>
+</head>
+<body>
+<h1>Config reference</h1>
+<p>{{.Intro}}</p>
+<table>
+<thead><tr><th>Setting</th><th>Type</th><th>Default</th><th>Environment</th><th>Description</th></tr></thead>
+<tbody>
+{{- range $i, $s := .Settings}}
+<tr id="{{$s.Path}}"><td><code>{{$s.Path}}</code></td><td>{{$s.Type}}</td><td>{{with $s.Default}}<code>{{.}}</code>{{end}}</td><td>{{with $s.Env}}<code>{{.}}</code>{{end}}</td><td>{{description $s}}</td></tr>
+{{- end}}
+</tbody>
+</table>
+</body>
+</html>
+`))
+
+func html(settings []config.Setting) ([]byte, error) {
+	refs := make([]*config.Setting, len(settings))
+	for i := range settings {
+		refs[i] = &settings[i]
+	}
+	var b bytes.Buffer
+	err := page.Execute(&b, struct {
+		Intro    string
+		Settings []*config.Setting
+	}{intro, refs})
+	return b.Bytes(), err
+}
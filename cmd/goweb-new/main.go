@@ -0,0 +1,220 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+// Package main creates a starter project using goweb: a server with its config and
+// secrets, a cached page read from the db, an api for signed in users, a job and the
+// migrations of the app schema.  The generated README lists the steps to run it.
+//
+//	go run github.com/cwbriscoe/goweb/cmd/goweb-new -module example.com/notes
+package main
+
+import (
+	"bytes"
+	crand "crypto/rand"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"go/format"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/cwbriscoe/goweb/config"
+	"github.com/goccy/go-json"
+)
+
+//go:embed templates
+var templates embed.FS
+
+// project is the data the templates are rendered with.
+type project struct {
+	Module string // module path of the project, ie: example.com/notes
+	Name   string // last element of the module path
+	Schema string // database schema of the app tables
+}
+
+func main() {
+	if err := run(); err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	// parse flags
+	module := flag.String("module", "", "module path of the new project, ie: example.com/notes")
+	dir := flag.String("dir", "", "directory of the new project, defaults to the last element of the module path")
+	force := flag.Bool("force", false, "overwrite the files of an existing directory")
+	flag.Parse()
+
+	if *module == "" {
+		flag.Usage()
+		return errors.New("goweb-new: -module is required")
+	}
+
+	p := newProject(*module)
+	if *dir == "" {
+		*dir = p.Name
+	}
+	if err := generate(*dir, p, *force); err != nil {
+		return err
+	}
+
+	fmt.Printf("created %s in %s, see %s for the next steps\n", p.Module, *dir, filepath.Join(*dir, "README.md"))
+	return nil
+}
+
+func newProject(module string) *project {
+	module = strings.Trim(strings.TrimSpace(module), "/")
+	name := path.Base(module)
+	return &project{Module: module, Name: name, Schema: schemaName(name)}
+}
+
+// schemaName turns the name of the project into a postgres identifier.
+func schemaName(name string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(name) {
+		switch {
+		case r >= 'a' && r <= 'z', r == '_':
+			b.WriteRune(r)
+		case r >= '0' && r <= '9':
+			if b.Len() == 0 {
+				b.WriteString("app_")
+			}
+			b.WriteRune(r)
+		default:
+			b.WriteRune('_')
+		}
+	}
+	schema := strings.Trim(b.String(), "_")
+	if schema == "" || schema == "auth" || schema == "job" || schema == "public" {
+		schema = "app"
+	}
+	return schema
+}
+
+// generate writes the project into dir.  Existing files are only replaced with force.
+func generate(dir string, p *project, force bool) error {
+	if !force {
+		if entries, err := os.ReadDir(dir); err == nil && len(entries) > 0 {
+			return fmt.Errorf("goweb-new: %s is not empty, use -force to overwrite it", dir)
+		}
+	}
+
+	err := fs.WalkDir(templates, "templates", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := render(name, p)
+		if err != nil {
+			return err
+		}
+		return writeFile(filepath.Join(dir, outputName(name)), data, 0o644)
+	})
+	if err != nil {
+		return err
+	}
+
+	if err = writeConfig(filepath.Join(dir, "config", "dev.json"), p); err != nil {
+		return err
+	}
+	return writeSecrets(filepath.Join(dir, "config", "secrets.json"))
+}
+
+// outputName returns the path in the project of a template.  Dot files are stored
+// without the dot so embed includes them.
+func outputName(name string) string {
+	name = strings.TrimSuffix(strings.TrimPrefix(name, "templates/"), ".tmpl")
+	if base := path.Base(name); base == "gitignore" {
+		name = path.Join(path.Dir(name), "."+base)
+	}
+	return filepath.FromSlash(name)
+}
+
+// render executes a template, go files are formatted.
+func render(name string, p *project) ([]byte, error) {
+	src, err := templates.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := template.New(path.Base(name)).Parse(string(src))
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err = tmpl.Execute(&buf, p); err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(outputName(name), ".go") {
+		return buf.Bytes(), nil
+	}
+
+	data, err := format.Source(buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("goweb-new: formatting %s: %w", name, err)
+	}
+	return data, nil
+}
+
+func writeFile(file string, data []byte, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(file, data, perm)
+}
+
+// writeConfig writes a config for local development, over http with the db created by
+// cmd/initschema.
+func writeConfig(file string, p *project) error {
+	cfg := &config.Config{
+		Environment: "dev",
+		RootDir:     ".",
+		LogDir:      "./log",
+		Listen:      ":8080",
+	}
+	cfg.Features.EnableRegistration = true
+	cfg.Cache.Capacity = 64 << 20
+	cfg.Cache.Buckets = 16
+	cfg.DB.Host = "localhost"
+	cfg.DB.Port = "5432"
+	cfg.DB.Name = "goweb"
+	cfg.DB.User = "api"
+	cfg.DB.Pass = "api"
+	cfg.HTTPS.Scheme = "http"
+	cfg.HTTPS.Domain = "localhost"
+	cfg.HTTPS.Port = "8080"
+	cfg.HTTPS.AppRoot = "/public"
+	cfg.HTTPS.StaticRoot = "/public"
+	cfg.Cookies.Prefix = p.Schema + "_"
+	cfg.Cookies.Insecure = true
+
+	if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+		return err
+	}
+	return cfg.Save(file)
+}
+
+// writeSecrets writes random auth secrets.  The file is listed in the .gitignore of the
+// project.
+func writeSecrets(file string) error {
+	secrets := make(map[string]string, 3)
+	for _, key := range []string{"jwtkey", "enckey", "pepper"} {
+		// hex encoded, so the 32 characters of enckey are an aes-256 key.
+		b := make([]byte, 16)
+		if _, err := crand.Read(b); err != nil {
+			return err
+		}
+		secrets[key] = hex.EncodeToString(b)
+	}
+
+	data, err := json.MarshalIndent(secrets, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(file, data, 0o600)
+}
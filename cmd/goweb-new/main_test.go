@@ -0,0 +1,54 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSchemaName(t *testing.T) {
+	tests := map[string]string{
+		"notes":    "notes",
+		"My-Notes": "my_notes",
+		"2fa":      "app_2fa",
+		"auth":     "app",
+		"--":       "app",
+	}
+	for name, want := range tests {
+		if got := schemaName(name); got != want {
+			t.Errorf("schemaName(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	dir := t.TempDir()
+	p := newProject("example.com/my-notes/")
+	if err := generate(dir, p, false); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"go.mod", "main.go", "routes.go", "notes.go", "jobs.go", "migrations.go", ".gitignore", "public/app/site.css", "config/dev.json", "config/secrets.json"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("missing %s: %v", name, err)
+		}
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "migrations.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `Schema: "my_notes"`) {
+		t.Errorf("migrations.go does not use the my_notes schema:\n%s", data)
+	}
+
+	if err = generate(dir, p, false); err == nil {
+		t.Error("generate overwrote a project without force")
+	}
+	if err = generate(dir, p, true); err != nil {
+		t.Errorf("generate with force: %v", err)
+	}
+}
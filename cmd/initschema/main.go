@@ -2,17 +2,55 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"os"
 
+	"github.com/cwbriscoe/goutil/db"
 	"github.com/cwbriscoe/goweb/schema"
 )
 
 func main() {
-	_, err := schema.CreateDatabase("goweb")
+	info, err := parseFlags(os.Args[1:])
+	if err == nil {
+		_, err = schema.CreateDatabaseWithConfig(context.Background(), info, "goweb", nil)
+	}
 	if err != nil {
 		fmt.Println(err.Error())
 		os.Exit(1)
 	}
 	os.Exit(0)
 }
+
+// parseFlags returns the connection info of the maintenance database the goweb database
+// is created from.
+func parseFlags(args []string) (*db.PgConnInfo, error) {
+	fs := flag.NewFlagSet("initschema", flag.ContinueOnError)
+	host := fs.String("host", "localhost", "database host")
+	port := fs.String("port", "5432", "database port")
+	name := fs.String("name", "postgres", "database name")
+	user := fs.String("user", "postgres", "database user")
+	pass := fs.String("pass", "postgres", "database password")
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if *name == "" {
+		return nil, errors.New("a database name must be provided (-name)")
+	}
+
+	if *pass == "" {
+		return nil, errors.New("a database password must be provided (-pass)")
+	}
+
+	return &db.PgConnInfo{
+		Host: *host,
+		Port: *port,
+		Name: *name,
+		User: *user,
+		Pass: *pass,
+	}, nil
+}
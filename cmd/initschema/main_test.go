@@ -0,0 +1,22 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package main
+
+import "testing"
+
+func TestParseFlags(t *testing.T) {
+	info, err := parseFlags([]string{"-host", "db", "-pass", "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Host != "db" || info.Port != "5432" || info.Name != "postgres" || info.Pass != "secret" {
+		t.Errorf("unexpected connection info %+v", info)
+	}
+
+	if _, err = parseFlags([]string{"-name", ""}); err == nil {
+		t.Error("expected an error without a database name")
+	}
+	if _, err = parseFlags([]string{"-pass", ""}); err == nil {
+		t.Error("expected an error without a password")
+	}
+}
@@ -0,0 +1,192 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+// Package main replays recorded or synthetic traffic against a goweb instance and
+// reports latency percentiles and limiter rejection rates
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cwbriscoe/goweb/server"
+)
+
+type request struct {
+	method string
+	path   string
+}
+
+type result struct {
+	status  int
+	elapsed time.Duration
+	err     bool
+}
+
+func main() {
+	if err := run(); err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	// parse flags
+	target := flag.String("target", "http://localhost:8080", "base url of the goweb instance")
+	logFile := flag.String("log", "", "access.log or combined.log to replay")
+	routes := flag.String("routes", "/", "comma separated routes for a synthetic mix (ignored with -log)")
+	concurrency := flag.Int("concurrency", 10, "number of concurrent clients")
+	total := flag.Int("requests", 1000, "total number of requests to send")
+	ips := flag.Int("ips", 100, "number of distinct visitor ip addresses to simulate")
+	ua := flag.String("ua", "goweb-loadgen/1.0", "user agent to send")
+	timeout := flag.Duration("timeout", 30*time.Second, "per request timeout")
+	flag.Parse()
+
+	var reqs []request
+	var err error
+	if *logFile != "" {
+		reqs, err = readAccessLog(*logFile)
+		if err != nil {
+			return err
+		}
+	} else {
+		for _, route := range strings.Split(*routes, ",") {
+			reqs = append(reqs, request{http.MethodGet, strings.TrimSpace(route)})
+		}
+	}
+	if len(reqs) == 0 {
+		return errors.New("no requests to send")
+	}
+	if *concurrency <= 0 || *ips <= 0 {
+		return errors.New("-concurrency and -ips must be greater than zero")
+	}
+
+	visitors := make([]string, *ips)
+	for i := range visitors {
+		visitors[i] = fmt.Sprintf("10.%d.%d.%d", rand.Intn(256), rand.Intn(256), 1+rand.Intn(254))
+	}
+
+	client := &http.Client{
+		Timeout: *timeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	results := make([]result, *total)
+	var next atomic.Int64
+	var wg sync.WaitGroup
+
+	fmt.Printf("sending %d requests to %s with %d clients and %d visitors\n", *total, *target, *concurrency, *ips)
+	start := time.Now()
+
+	for c := 0; c < *concurrency; c++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				i := int(next.Add(1)) - 1
+				if i >= *total {
+					return
+				}
+				req := reqs[i%len(reqs)]
+				ip := visitors[rand.Intn(len(visitors))]
+				results[i] = send(client, *target, req, ip, *ua)
+			}
+		}()
+	}
+
+	wg.Wait()
+	report(results, time.Since(start))
+
+	return nil
+}
+
+// readAccessLog extracts the GET requests of an access log in any of the formats of
+// server.Logger.
+func readAccessLog(file string) ([]request, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var reqs []request
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		method, uri, ok := server.ParseAccessLine(scanner.Bytes())
+		if ok && method == http.MethodGet {
+			reqs = append(reqs, request{method, uri})
+		}
+	}
+
+	return reqs, scanner.Err()
+}
+
+func send(client *http.Client, target string, req request, ip, ua string) result {
+	r, err := http.NewRequest(req.method, target+req.path, http.NoBody)
+	if err != nil {
+		return result{err: true}
+	}
+	r.Header.Set("X-Real-IP", ip)
+	r.Header.Set("User-Agent", ua)
+	r.Header.Set("Accept-Encoding", "br, gzip")
+
+	start := time.Now()
+	resp, err := client.Do(r)
+	if err != nil {
+		return result{elapsed: time.Since(start), err: true}
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	return result{status: resp.StatusCode, elapsed: time.Since(start)}
+}
+
+func report(results []result, elapsed time.Duration) {
+	latencies := make([]time.Duration, 0, len(results))
+	statuses := make(map[int]int)
+	var errs int
+
+	for _, res := range results {
+		if res.err {
+			errs++
+			continue
+		}
+		statuses[res.status]++
+		latencies = append(latencies, res.elapsed)
+	}
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	fmt.Printf("\ncompleted %d requests in %s (%.1f req/s)\n", len(results), elapsed.String(), float64(len(results))/elapsed.Seconds())
+	fmt.Printf("errors: %d\n", errs)
+
+	codes := make([]int, 0, len(statuses))
+	for code := range statuses {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		fmt.Printf("status %d: %d (%.2f%%)\n", code, statuses[code], 100*float64(statuses[code])/float64(len(results)))
+	}
+	fmt.Printf("limited (429): %.2f%%\n", 100*float64(statuses[http.StatusTooManyRequests])/float64(len(results)))
+
+	if len(latencies) == 0 {
+		return
+	}
+	for _, p := range []float64{50, 90, 95, 99, 100} {
+		idx := int(float64(len(latencies)-1) * p / 100)
+		fmt.Printf("p%-3.0f %s\n", p, latencies[idx].String())
+	}
+}
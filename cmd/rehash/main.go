@@ -0,0 +1,96 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+// Package main reports the algorithms and parameters of the stored password hashes and
+// how many of them will be replaced on the next signin of their user, after the
+// passwords section of the config changed.  Hashes in the legacy format are wrapped
+// with the configured hasher unless -dry-run is set.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/cwbriscoe/goweb/auth"
+	"github.com/cwbriscoe/goweb/config"
+	"github.com/cwbriscoe/goweb/server"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+func main() {
+	if err := run(); err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	// parse flags
+	file := flag.String("config", "./config/prod.json", "config file of the site")
+	secrets := flag.String("secrets", server.DefaultSecretFile, "secrets file of the site")
+	dryRun := flag.Bool("dry-run", false, "only report, do not rewrap the legacy hashes")
+	batch := flag.Int("batch", 500, "users read per query")
+	flag.Parse()
+
+	cfg := &config.Config{}
+	if err := cfg.Load(*file); err != nil {
+		return fmt.Errorf("error loading config %s: %w", *file, err)
+	}
+
+	hasher, err := server.PasswordHasher(cfg)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	connstr := "postgresql://" +
+		cfg.DB.Host + ":" +
+		cfg.DB.Port + "/" +
+		cfg.DB.Name + "?user=" +
+		cfg.DB.User + "&password=" +
+		cfg.DB.Pass
+	pool, err := pgxpool.New(ctx, connstr)
+	if err != nil {
+		return err
+	}
+	defer pool.Close()
+
+	report, err := auth.ScanHashes(ctx, pool, *secrets, &auth.RehashOptions{
+		Hasher:    hasher,
+		DryRun:    *dryRun,
+		BatchSize: *batch,
+		Progress: func(r *auth.RehashReport) {
+			fmt.Printf("%d hashes scanned\n", r.Scanned)
+		},
+	})
+	if report != nil {
+		printReport(report, *dryRun)
+	}
+	return err
+}
+
+func printReport(r *auth.RehashReport, dryRun bool) {
+	kinds := make([]string, 0, len(r.Kinds))
+	for kind := range r.Kinds {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+
+	fmt.Println()
+	for _, kind := range kinds {
+		fmt.Printf("%8d  %s\n", r.Kinds[kind], kind)
+	}
+	fmt.Println()
+	fmt.Printf("%8d  scanned\n", r.Scanned)
+	fmt.Printf("%8d  current\n", r.Current)
+	fmt.Printf("%8d  outdated, replaced on the next signin\n", r.Outdated)
+	fmt.Printf("%8d  legacy\n", r.Legacy)
+	if dryRun {
+		fmt.Printf("%8d  rewrapped (dry run)\n", r.Rewrapped)
+	} else {
+		fmt.Printf("%8d  rewrapped\n", r.Rewrapped)
+	}
+	fmt.Printf("%8d  invalid\n", r.Invalid)
+}
@@ -0,0 +1,283 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+// Package comments stores threaded comments on content, like articles or products,
+// and queues suspicious comments for moderation
+package comments
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/cwbriscoe/goweb/query"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// DefaultSchema is the schema with the comments tables.
+const DefaultSchema query.Schema = "comments"
+
+// Status is the moderation state of a comment.
+type Status string
+
+// Comment states, only approved comments are shown.
+const (
+	Pending  Status = "pending"
+	Approved Status = "approved"
+	Rejected Status = "rejected"
+)
+
+var (
+	// ErrNotFound is returned when a comment does not exist.
+	ErrNotFound = errors.New("comment not found")
+	// ErrInvalidParent is returned when replying to a comment that is not shown on the
+	// same content or is nested too deep.
+	ErrInvalidParent = errors.New("invalid parent comment")
+	// ErrInvalidBody is returned for an empty or too long comment.
+	ErrInvalidBody = errors.New("invalid comment body")
+	// ErrTooMany is returned when the author posted the max comments of the last hour.
+	ErrTooMany = errors.New("too many comments")
+)
+
+// Comment is a comment on the content identified by Key.
+type Comment struct {
+	ID       int64      `json:"id"`
+	Key      string     `json:"key"`
+	ParentID int64      `json:"parentId,omitempty"`
+	Depth    int        `json:"depth"`
+	AuthorID int        `json:"authorId"`
+	Author   string     `json:"author"`
+	Body     string     `json:"body"`
+	Status   Status     `json:"status"`
+	Score    int        `json:"score"` // spam score when it was posted
+	Created  time.Time  `json:"created"`
+	Replies  []*Comment `json:"replies,omitempty"`
+}
+
+var (
+	qParent = query.Query{
+		Name: "parent",
+		SQL:  "select key, depth, status from {schema}.comment where id = $1;",
+	}
+	qDuplicate = query.Query{
+		Name: "duplicate",
+		SQL: `
+select exists (
+	select 1
+	  from {schema}.comment
+	 where author_id = $1
+	   and body = $2
+	   and create_ts > now() - interval '1 day');`,
+	}
+	// the rate of the author is checked in the same statement, so it can't change
+	// between the check and the insert.
+	qInsertComment = query.Query{
+		Name: "insertComment",
+		SQL: `
+insert into {schema}.comment (key, parent_id, depth, author_id, author, body, status, score, create_ts)
+select $1::varchar, nullif($2::int8, 0), $3::int4, $4::int4, $5::varchar, $6::varchar, $7::varchar, $8::int4, now()
+ where (select count(*)
+          from {schema}.comment
+         where author_id = $4
+           and create_ts > now() - interval '1 hour') < $9
+returning id, create_ts;`,
+	}
+	qThread = query.Query{
+		Name: "thread",
+		SQL: `
+select id, key, coalesce(parent_id, 0), depth, author_id, author, body, status, score, create_ts
+  from {schema}.comment
+ where key = $1
+   and status = 'approved'
+ order by create_ts, id;`,
+	}
+	qQueue = query.Query{
+		Name: "queue",
+		SQL: `
+select id, key, coalesce(parent_id, 0), depth, author_id, author, body, status, score, create_ts
+  from {schema}.comment
+ where status = 'pending'
+ order by create_ts
+ limit $1;`,
+	}
+	qModerate = query.Query{
+		Name: "moderate",
+		SQL:  "update {schema}.comment set status = $2, moderate_ts = now() where id = $1 returning key;",
+	}
+	qCountRecent = query.Query{
+		Name: "countRecent",
+		SQL:  "select count(*) from {schema}.comment where author_id = $1 and create_ts > $2;",
+	}
+)
+
+// Settings contains the settings for a Store.
+type Settings struct {
+	DB          *pgxpool.Pool
+	Schema      string   // defaults to "comments"
+	MaxLen      int      // max characters in a comment, defaults to 2000
+	MaxDepth    int      // max reply nesting, defaults to 5
+	Premoderate bool     // queue every comment for moderation
+	Blocklist   []string // words that mark a comment as spam
+	MaxPerHour  int      // max comments of an author per hour, defaults to 10
+}
+
+// Store reads and writes comments.
+type Store struct {
+	db          *pgxpool.Pool
+	schema      query.Schema
+	maxLen      int
+	maxDepth    int
+	premoderate bool
+	maxPerHour  int
+	spam        *SpamFilter
+}
+
+// NewStore returns a Store using the settings.
+func NewStore(settings *Settings) *Store {
+	store := &Store{
+		db:          settings.DB,
+		schema:      DefaultSchema,
+		maxLen:      settings.MaxLen,
+		maxDepth:    settings.MaxDepth,
+		premoderate: settings.Premoderate,
+		maxPerHour:  settings.MaxPerHour,
+		spam:        NewSpamFilter(settings.Blocklist),
+	}
+	if settings.Schema != "" {
+		store.schema = query.Schema(settings.Schema)
+	}
+	if store.maxLen <= 0 {
+		store.maxLen = 2000
+	}
+	if store.maxDepth <= 0 {
+		store.maxDepth = 5
+	}
+	if store.maxPerHour <= 0 {
+		store.maxPerHour = 10
+	}
+	return store
+}
+
+// Create validates and stores a new comment, filling in its id, depth, status, score
+// and creation time.  The status is decided by the spam score of the comment.
+// ErrTooMany is returned when the author already posted the max comments per hour.
+func (s *Store) Create(ctx context.Context, c *Comment) error {
+	c.Body = strings.TrimSpace(c.Body)
+	if c.Body == "" || utf8.RuneCountInString(c.Body) > s.maxLen {
+		return ErrInvalidBody
+	}
+
+	c.Depth = 0
+	if c.ParentID != 0 {
+		var key string
+		var depth int
+		var status Status
+		err := s.schema.QueryRow(ctx, s.db, qParent, c.ParentID).Scan(&key, &depth, &status)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrInvalidParent
+		}
+		if err != nil {
+			return err
+		}
+		if key != c.Key || status != Approved || depth+1 > s.maxDepth {
+			return ErrInvalidParent
+		}
+		c.Depth = depth + 1
+	}
+
+	var dup bool
+	if err := s.schema.QueryRow(ctx, s.db, qDuplicate, c.AuthorID, c.Body).Scan(&dup); err != nil {
+		return err
+	}
+
+	c.Score = s.spam.Score(c.Body)
+	if dup {
+		c.Score += duplicateScore
+	}
+	c.Status = s.status(c.Score)
+
+	err := s.schema.QueryRow(ctx, s.db, qInsertComment,
+		c.Key, c.ParentID, c.Depth, c.AuthorID, c.Author, c.Body, c.Status, c.Score, s.maxPerHour,
+	).Scan(&c.ID, &c.Created)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrTooMany
+	}
+	return err
+}
+
+// status returns the initial status of a comment with the spam score.
+func (s *Store) status(score int) Status {
+	switch {
+	case score >= RejectScore:
+		return Rejected
+	case score >= ModerateScore || s.premoderate:
+		return Pending
+	}
+	return Approved
+}
+
+// Thread returns the approved comments on the content as a tree.
+func (s *Store) Thread(ctx context.Context, key string) ([]*Comment, error) {
+	list, err := s.list(ctx, qThread, key)
+	if err != nil {
+		return nil, err
+	}
+	return BuildTree(list), nil
+}
+
+// Queue returns the oldest comments waiting for moderation.
+func (s *Store) Queue(ctx context.Context, limit int) ([]*Comment, error) {
+	return s.list(ctx, qQueue, limit)
+}
+
+func (s *Store) list(ctx context.Context, q query.Query, args ...any) ([]*Comment, error) {
+	rows, err := s.schema.Query(ctx, s.db, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	list, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (*Comment, error) {
+		c := &Comment{}
+		err := row.Scan(&c.ID, &c.Key, &c.ParentID, &c.Depth, &c.AuthorID, &c.Author, &c.Body, &c.Status, &c.Score, &c.Created)
+		return c, err
+	})
+	return list, query.Wrap(q, err)
+}
+
+// Moderate sets the status of a comment and returns the key of its content.
+func (s *Store) Moderate(ctx context.Context, id int64, status Status) (string, error) {
+	var key string
+	err := s.schema.QueryRow(ctx, s.db, qModerate, id, status).Scan(&key)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", ErrNotFound
+	}
+	return key, err
+}
+
+// CountRecent returns the number of comments the author posted since the time.
+func (s *Store) CountRecent(ctx context.Context, authorID int, since time.Time) (int, error) {
+	var cnt int
+	err := s.schema.QueryRow(ctx, s.db, qCountRecent, authorID, since).Scan(&cnt)
+	return cnt, err
+}
+
+// BuildTree nests the comments under their parents.  The comments must be ordered so
+// parents come before their replies.  Replies to comments not in the list are dropped.
+func BuildTree(list []*Comment) []*Comment {
+	byID := make(map[int64]*Comment, len(list))
+	var roots []*Comment
+	for _, c := range list {
+		c.Replies = nil
+		if c.ParentID == 0 {
+			roots = append(roots, c)
+			byID[c.ID] = c
+			continue
+		}
+		if parent, ok := byID[c.ParentID]; ok {
+			parent.Replies = append(parent.Replies, c)
+			byID[c.ID] = c
+		}
+	}
+	return roots
+}
@@ -0,0 +1,89 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package comments
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSpamScore(t *testing.T) {
+	f := NewSpamFilter([]string{"Casino"})
+
+	tests := []struct {
+		body  string
+		score int
+	}{
+		{"Nice article, thanks!", 0},
+		{"see https://example.com for more", 0},
+		{"http://a.example http://b.example www.c.example", 2},
+		{"wow!!!!!!!!!!", 1},
+		{"THIS IS THE BEST ARTICLE I HAVE EVER READ", 1},
+		{"visit my CASINO", 3},
+	}
+
+	for _, test := range tests {
+		if score := f.Score(test.body); score != test.score {
+			t.Errorf("expected score %d for %q, got %d", test.score, test.body, score)
+		}
+	}
+}
+
+func TestStatus(t *testing.T) {
+	s := NewStore(&Settings{})
+	if status := s.status(0); status != Approved {
+		t.Errorf("expected approved, got %s", status)
+	}
+	if status := s.status(ModerateScore); status != Pending {
+		t.Errorf("expected pending, got %s", status)
+	}
+	if status := s.status(RejectScore); status != Rejected {
+		t.Errorf("expected rejected, got %s", status)
+	}
+
+	s = NewStore(&Settings{Premoderate: true})
+	if status := s.status(0); status != Pending {
+		t.Errorf("expected pending when premoderated, got %s", status)
+	}
+}
+
+func TestBuildTree(t *testing.T) {
+	list := []*Comment{
+		{ID: 1},
+		{ID: 2, ParentID: 1},
+		{ID: 3},
+		{ID: 4, ParentID: 2},
+		{ID: 5, ParentID: 99}, // parent not approved
+		{ID: 6, ParentID: 1},
+	}
+
+	roots := BuildTree(list)
+	if len(roots) != 2 || roots[0].ID != 1 || roots[1].ID != 3 {
+		t.Fatalf("unexpected roots %+v", roots)
+	}
+	if len(roots[0].Replies) != 2 || roots[0].Replies[0].ID != 2 || roots[0].Replies[1].ID != 6 {
+		t.Errorf("unexpected replies %+v", roots[0].Replies)
+	}
+	if len(roots[0].Replies[0].Replies) != 1 || roots[0].Replies[0].Replies[0].ID != 4 {
+		t.Errorf("expected comment 4 under comment 2")
+	}
+}
+
+func TestRender(t *testing.T) {
+	thread := BuildTree([]*Comment{
+		{ID: 1, Author: "chris", Body: "<b>hi</b>\nthere", Created: time.Unix(0, 0)},
+		{ID: 2, ParentID: 1, Author: "bob", Body: "reply"},
+	})
+
+	out := string(Render(thread))
+	if !strings.Contains(out, "&lt;b&gt;hi&lt;/b&gt;<br>there") {
+		t.Errorf("expected escaped body with line break, got %s", out)
+	}
+	if !strings.Contains(out, `<ul class="replies"><li class="comment" id="comment-2"`) {
+		t.Errorf("expected nested reply, got %s", out)
+	}
+	if empty := string(Render(nil)); empty != `<ul class="comments"></ul>` {
+		t.Errorf("unexpected empty render %s", empty)
+	}
+}
@@ -0,0 +1,38 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package comments
+
+import (
+	"bytes"
+	"html"
+	"strconv"
+	"strings"
+)
+
+// Render returns the comment tree as an html fragment of nested lists.  Comment text
+// is escaped and line breaks are kept.
+func Render(thread []*Comment) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(`<ul class="comments">`)
+	renderList(&buf, thread)
+	buf.WriteString(`</ul>`)
+	return buf.Bytes()
+}
+
+func renderList(buf *bytes.Buffer, list []*Comment) {
+	for _, c := range list {
+		id := strconv.FormatInt(c.ID, 10)
+		buf.WriteString(`<li class="comment" id="comment-` + id + `" data-id="` + id + `">`)
+		buf.WriteString(`<span class="comment-author">` + html.EscapeString(c.Author) + `</span>`)
+		buf.WriteString(`<time datetime="` + c.Created.UTC().Format("2006-01-02T15:04:05Z") + `"></time>`)
+		buf.WriteString(`<p class="comment-body">`)
+		buf.WriteString(strings.ReplaceAll(html.EscapeString(c.Body), "\n", "<br>"))
+		buf.WriteString(`</p>`)
+		if len(c.Replies) > 0 {
+			buf.WriteString(`<ul class="replies">`)
+			renderList(buf, c.Replies)
+			buf.WriteString(`</ul>`)
+		}
+		buf.WriteString(`</li>`)
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package comments
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// CreateSchema will create the comments schema and associated tables needed
+// for this package to run
+func CreateSchema(ctx context.Context, conn *pgx.Conn) error {
+	var sql string
+	var err error
+
+	sql = "drop schema if exists comments cascade;"
+	_, err = conn.Exec(ctx, sql)
+	if err != nil {
+		return err
+	}
+
+	sql = "create schema comments authorization current_role;"
+	_, err = conn.Exec(ctx, sql)
+	if err != nil {
+		return err
+	}
+
+	sql = `
+	CREATE TABLE comments.comment (
+		id int8 NOT NULL GENERATED ALWAYS AS IDENTITY,
+		key varchar NOT NULL,
+		parent_id int8 NULL REFERENCES comments.comment (id) ON DELETE CASCADE,
+		depth int4 NOT NULL,
+		author_id int4 NOT NULL,
+		author varchar NOT NULL,
+		body varchar NOT NULL,
+		status varchar NOT NULL,
+		score int4 NOT NULL,
+		create_ts timestamptz NOT NULL,
+		moderate_ts timestamptz NULL,
+		CONSTRAINT comment_pk PRIMARY KEY (id)
+	);`
+	_, err = conn.Exec(ctx, sql)
+	if err != nil {
+		return err
+	}
+
+	sql = "CREATE INDEX comment_key_idx ON comments.comment (key, status);"
+	_, err = conn.Exec(ctx, sql)
+	if err != nil {
+		return err
+	}
+
+	sql = "CREATE INDEX comment_author_idx ON comments.comment (author_id, create_ts);"
+	_, err = conn.Exec(ctx, sql)
+	if err != nil {
+		return err
+	}
+
+	sql = "CREATE INDEX comment_pending_idx ON comments.comment (create_ts) WHERE status = 'pending';"
+	_, err = conn.Exec(ctx, sql)
+	if err != nil {
+		return err
+	}
+
+	sql = "grant select, insert, update on table comments.comment to api;"
+	_, err = conn.Exec(ctx, sql)
+	if err != nil {
+		return err
+	}
+
+	sql = "grant select, delete on table comments.comment to job;"
+	_, err = conn.Exec(ctx, sql)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,96 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package comments
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// Spam scores at or above these values queue or reject a comment.
+const (
+	ModerateScore = 2
+	RejectScore   = 5
+)
+
+// duplicateScore is added when the author posted the same comment within a day.
+const duplicateScore = 3
+
+var linkRegex = regexp.MustCompile(`(?i)(https?://|www\.)`)
+
+// SpamFilter scores comments with simple heuristics.  None of them is proof of spam
+// on its own, so a comment needs a few signals before it is held back.
+type SpamFilter struct {
+	blocklist []string
+}
+
+// NewSpamFilter returns a SpamFilter that also scores the blocked words.
+func NewSpamFilter(blocklist []string) *SpamFilter {
+	f := &SpamFilter{}
+	for _, word := range blocklist {
+		if word = strings.ToLower(strings.TrimSpace(word)); word != "" {
+			f.blocklist = append(f.blocklist, word)
+		}
+	}
+	return f
+}
+
+// Score returns the spam score of the comment body.
+func (f *SpamFilter) Score(body string) int {
+	score := 0
+
+	// one link is normal, every extra one is suspicious
+	if links := len(linkRegex.FindAllStringIndex(body, -1)); links > 1 {
+		score += links - 1
+	}
+
+	// the same character over and over, ie: !!!!!!!!!!
+	if repeats(body, 10) {
+		score++
+	}
+
+	if shouting(body) {
+		score++
+	}
+
+	lower := strings.ToLower(body)
+	for _, word := range f.blocklist {
+		if strings.Contains(lower, word) {
+			score += 3
+		}
+	}
+
+	return score
+}
+
+// repeats returns true when a character is repeated n times in a row.
+func repeats(body string, n int) bool {
+	var prev rune
+	cnt := 0
+	for _, r := range body {
+		if r == prev {
+			cnt++
+		} else {
+			prev, cnt = r, 1
+		}
+		if cnt >= n {
+			return true
+		}
+	}
+	return false
+}
+
+// shouting returns true when most letters of a longer comment are upper case.
+func shouting(body string) bool {
+	var letters, upper int
+	for _, r := range body {
+		if unicode.IsLetter(r) {
+			letters++
+			if unicode.IsUpper(r) {
+				upper++
+			}
+		}
+	}
+	return letters >= 20 && upper*10 > letters*7
+}
@@ -1,81 +1,279 @@
 // Copyright 2023 Christopher Briscoe.  All rights reserved.
 
-// Package config loads a config file with settings to start a web server/app
+// Package config loads a config file with settings to start a web server/app.
+//
+// Settings are taken in this order, the first one found wins:
+//
+//  1. an environment variable named after the json path of the setting with the
+//     GOWEB_ prefix, ie: GOWEB_DB_PASS for db.pass or GOWEB_LISTEN for listen
+//  2. the config file, where ${NAME} is replaced with the value of the environment
+//     variable NAME, ie: "pass": "${DB_PASSWORD}"
+//  3. the zero value of the setting, which the server replaces with its default
+//
+// Secrets can so be injected by the deployment environment instead of being written
+// in the config file.  The values of the references are masked when the config is
+// printed or compared.
 package config
 
 import (
+	"bytes"
 	"fmt"
 	"os"
 
 	"github.com/cwbriscoe/goutil/db"
+	"github.com/cwbriscoe/goweb/chaos"
+	"github.com/cwbriscoe/goweb/forms"
+	"github.com/cwbriscoe/goweb/logsink"
+	"github.com/cwbriscoe/goweb/waf"
 	"github.com/goccy/go-json"
 )
 
 type features struct {
-	EnableRegistration bool `json:"enableRegistration"`
-	EnableLimiters     bool `json:"enableLimiters"`
+	EnableRegistration bool `json:"enableRegistration" doc:"serve the signup route"`
+	DisableLimiters    bool `json:"disableLimiters" doc:"serve the server and auth routes without rate limits, ie: in load tests"`
+	EnableRoleAdmin    bool `json:"enableRoleAdmin" doc:"serve the /auth/admin/ user and role endpoints"`
+	ReadOnly           bool `json:"readOnly" doc:"start in read-only mode, requests that write get a 503"`
 }
 
 type cache struct {
-	Capacity int64 `json:"capacity"`
-	Buckets  int   `json:"buckets"`
+	Capacity       int64    `json:"capacity" doc:"max bytes held by the cache" required:"true"`
+	Buckets        int      `json:"buckets" doc:"number of buckets the cache is split into to reduce lock contention, 1-256" default:"16"`
+	AsyncGroups    []string `json:"asyncGroups" doc:"groups whose misses are filled in the background, answered with 202"`
+	Snapshot       string   `json:"snapshot" doc:"file the cache is saved to on shutdown and loaded from on startup"`
+	SnapshotGroups []string `json:"snapshotGroups" doc:"groups saved in the snapshot, all groups when empty"`
+	Cluster        bool     `json:"cluster" doc:"broadcast invalidations to the other servers sharing the database"`
+	BypassScope    string   `json:"bypassScope" doc:"scope of the users who can force a refresh" default:"admin"`
+}
+
+// CompressLevels stores the gzip, brotli and zstd compression levels.  Zero means use the
+// default.  The zstd level is only used by the streamed responses of the default levels.
+type CompressLevels struct {
+	Gzip   int `json:"gzip" doc:"gzip level, 1-9"`
+	Brotli int `json:"brotli" doc:"brotli level, 0-11"`
+	Zstd   int `json:"zstd" doc:"zstd level of streamed responses, 1-22"`
+}
+
+type compression struct {
+	Default   CompressLevels            `json:"default" doc:"levels for dynamic responses"`
+	Static    CompressLevels            `json:"static" doc:"levels for static assets"`
+	Types     map[string]CompressLevels `json:"types" doc:"overrides per content type"`
+	LargeSize int                       `json:"largeSize" doc:"dynamic responses above this size in bytes are compressed faster under load" default:"262144"`
+}
+
+type watchdog struct {
+	Enabled       bool    `json:"enabled" doc:"shed load when a limit is exceeded"`
+	Interval      int     `json:"interval" doc:"seconds between samples" default:"5"`
+	MaxHeapMB     int     `json:"maxHeapMB" doc:"max heap in megabytes"`
+	MaxGoroutines int     `json:"maxGoroutines" doc:"max number of goroutines"`
+	MaxPoolUsage  float64 `json:"maxPoolUsage" doc:"max fraction of db connections in use"`
+}
+
+type privacy struct {
+	AnonymizeIPs string `json:"anonymizeIPs" doc:"anonymize the visitor ips before they are stored, kept as is when empty" enum:"hash,truncate"`
+}
+
+type accessLog struct {
+	Format string `json:"format" doc:"json for structured fields or combined to also write the apache combined log to combined.log" default:"text" enum:"text,json,combined"`
+}
+
+type tarpit struct {
+	Mode         string `json:"mode" doc:"how bad bots are answered, they get the 1 request per hour limiter when empty" enum:"deny,drip"`
+	Interval     int    `json:"interval" doc:"milliseconds between drips" default:"1000"`
+	Drips        int    `json:"drips" doc:"number of drips before the response ends" default:"30"`
+	MaxOpen      int64  `json:"maxOpen" doc:"max concurrent drip responses before falling back to deny"`
+	FlagFakeBots bool   `json:"flagFakeBots" doc:"flag the bot user agents failing the reverse dns check as bad bots"`
+}
+
+type firewall struct {
+	CountryHeader string     `json:"countryHeader" doc:"header with the visitors country code"`
+	Rules         []waf.Rule `json:"rules" doc:"rules checked in order, the first one that matches decides"`
+}
+
+type chaosSettings struct {
+	Allow   bool         `json:"allow" doc:"serve the /chaos/ toggle, never set it in production"`
+	Enabled bool         `json:"enabled" doc:"inject faults from startup"`
+	Rules   []chaos.Rule `json:"rules" doc:"faults to inject"`
+}
+
+type corsSettings struct {
+	Origins     []string `json:"origins" doc:"allowed origins, ie: https://app.example.com, https://*.example.com or *"`
+	Methods     []string `json:"methods" doc:"allowed methods, defaults to the methods registered for the route"`
+	Headers     []string `json:"headers" doc:"allowed request headers" default:"Content-Type"`
+	Expose      []string `json:"expose" doc:"response headers readable by scripts"`
+	Credentials bool     `json:"credentials" doc:"send cookies, never with the * origin"`
+	MaxAge      int      `json:"maxAge" doc:"seconds browsers cache a preflight" default:"600"`
+}
+
+type sitemap struct {
+	IndexNowKey string `json:"indexNowKey" doc:"hosted at /indexnow/<key>.txt for the sitemap ping job"`
+}
+
+type security struct {
+	CSP           string `json:"csp" doc:"Content-Security-Policy, reports go to /csp-report/"`
+	CSPReportOnly bool   `json:"cspReportOnly" doc:"only report violations instead of enforcing the policy"`
+}
+
+type cookies struct {
+	Prefix   string `json:"prefix" doc:"added to the cookie names when several apps share a domain"`
+	Domain   string `json:"domain" doc:"Domain attribute, defaults to the host that set the cookie"`
+	Path     string `json:"path" doc:"Path attribute" default:"/"`
+	Insecure bool   `json:"insecure" doc:"omit the Secure attribute for local http development"`
+	Opaque   bool   `json:"opaque" doc:"auth cookies carry random tokens, the claims stay in the db"`
+}
+
+type passwords struct {
+	Algorithm string `json:"algorithm" doc:"hash of new passwords" default:"argon2id" enum:"argon2id,bcrypt"`
+	Cost      int    `json:"cost" doc:"bcrypt cost" default:"10"`
+	Time      uint32 `json:"time" doc:"argon2id passes" default:"2"`
+	MemoryKB  uint32 `json:"memoryKB" doc:"argon2id memory in KiB" default:"19456"`
+	Threads   uint8  `json:"threads" doc:"argon2id parallelism" default:"1"`
+}
+
+type formSettings struct {
+	Secret string       `json:"secret" doc:"signs the form tokens, a random secret is used when empty"`
+	Forms  []forms.Form `json:"forms" doc:"forms accepted by /form/<name>"`
+}
+
+type commentSettings struct {
+	Enabled     bool     `json:"enabled" doc:"serve the comment routes"`
+	Premoderate bool     `json:"premoderate" doc:"queue every comment for moderation"`
+	MaxPerHour  int      `json:"maxPerHour" doc:"max comments per user per hour" default:"10"`
+	MaxLen      int      `json:"maxLen" doc:"max characters per comment" default:"2000"`
+	MaxDepth    int      `json:"maxDepth" doc:"max reply nesting" default:"5"`
+	Blocklist   []string `json:"blocklist" doc:"words that mark a comment as spam"`
 }
 
 type https struct {
-	Scheme     string `json:"scheme"`
-	Domain     string `json:"domain"`
-	Port       string `json:"port"`
-	AppRoot    string `json:"approot"`
-	StaticRoot string `json:"staticroot"`
+	Scheme     string   `json:"scheme" doc:"scheme of the public urls" enum:"http,https" required:"true"`
+	Domain     string   `json:"domain" doc:"domain of the public urls, ie: example.com" required:"true"`
+	Port       string   `json:"port" doc:"port of the public urls, left out of them when 80 or 443" required:"true"`
+	AppRoot    string   `json:"approot" doc:"directory under rootdir served at /app"`
+	StaticRoot string   `json:"staticroot" doc:"directory under rootdir served at /static"`
+	AppDirs    []string `json:"appdirs" doc:"subdirectories of approot that are served, all of them when empty"`
+	StaticDirs []string `json:"staticdirs" doc:"subdirectories of staticroot that are served, all of them when empty"`
+	SPA        bool     `json:"spa" doc:"serve app/index.html for the extension-less paths under /app that are not files"`
 }
 
-// Config store environment information for the currently running app.
+type limits struct {
+	MaxBody           int64 `json:"maxBody" doc:"largest request body in bytes, -1 for no limit" default:"10485760"`
+	MaxJSONBody       int64 `json:"maxJsonBody" doc:"largest json body in bytes read by server.Decode" default:"1048576"`
+	MaxHeaderBytes    int   `json:"maxHeaderBytes" doc:"largest request headers in bytes" default:"1048576"`
+	ReadHeaderTimeout int   `json:"readHeaderTimeout" doc:"seconds to read the request headers" default:"10"`
+	ReadTimeout       int   `json:"readTimeout" doc:"seconds to read the whole request, no limit when 0"`
+	WriteTimeout      int   `json:"writeTimeout" doc:"seconds to write the response, no limit when 0, streams are not limited"`
+	IdleTimeout       int   `json:"idleTimeout" doc:"seconds a keep-alive connection waits for the next request" default:"120"`
+}
+
+type staticType struct {
+	ContentType string `json:"contentType" doc:"defaults to the type of the extension known by the mime package"`
+	Compress    bool   `json:"compress" doc:"compress and transform the files, for text formats"`
+	MaxAge      int    `json:"maxAge" doc:"seconds browsers cache the files, defaults to the lifetime of the cache entry"`
+}
+
+type tlsSettings struct {
+	CertFile   string   `json:"certFile" doc:"certificate chain in pem format"`
+	KeyFile    string   `json:"keyFile" doc:"private key in pem format"`
+	AutoCert   bool     `json:"autoCert" doc:"get certificates from let's encrypt instead of the files"`
+	Hosts      []string `json:"hosts" doc:"hosts autocert may get certificates for, defaults to https.domain"`
+	CacheDir   string   `json:"cacheDir" doc:"where autocert stores certificates"`
+	Email      string   `json:"email" doc:"contact for the let's encrypt account"`
+	Listen     string   `json:"listen" doc:"https address" default:":443"`
+	HTTPListen string   `json:"httpListen" doc:"address redirected to https, - disables it" default:":80"`
+}
+
+// Config store environment information for the currently running app.  The doc,
+// default and enum tags describe the settings for the generated documentation, see
+// Settings.
 type Config struct {
-	LogConsole  bool          `json:"-"`
-	URLPrefix   string        `json:"-"`
-	Environment string        `json:"environment"`
-	RootDir     string        `json:"rootdir"`
-	LogDir      string        `json:"logdir"`
-	Listen      string        `json:"listen"`
-	Features    features      `json:"features"`
-	Cache       cache         `json:"cache"`
-	DB          db.PgConnInfo `json:"db"`
-	HTTPS       https         `json:"https"`
-}
-
-// Load loads a config file.
+	LogConsole  bool                         `json:"-"`
+	URLPrefix   string                       `json:"-"`
+	envValues   []string                     // values of the ${NAME} references, masked when printed
+	Environment string                       `json:"environment" doc:"name of the environment, picks ./config/<environment>.json, ie: dev or prod"`
+	RootDir     string                       `json:"rootdir" doc:"directory the app and static roots are under" required:"true"`
+	LogDir      string                       `json:"logdir" doc:"directory of the log files" required:"true"`
+	Listen      string                       `json:"listen" doc:"address of the http server, ie: :8080, required without tls"`
+	Features    features                     `json:"features" doc:"optional features"`
+	Cache       cache                        `json:"cache" doc:"response cache"`
+	Compression compression                  `json:"compression" doc:"compression levels, zero uses the default level"`
+	DB          db.PgConnInfo                `json:"db" doc:"postgres database"`
+	HTTPS       https                        `json:"https" doc:"public url and served directories"`
+	Limits      limits                       `json:"limits" doc:"request size and timeout limits"`
+	StaticTypes map[string]staticType        `json:"staticTypes" doc:"extensions served by the static handlers besides the defaults"`
+	TLS         tlsSettings                  `json:"tls" doc:"serve https directly, without a proxy in front"`
+	Privacy     privacy                      `json:"privacy" doc:"privacy of the visitors"`
+	Watchdog    watchdog                     `json:"watchdog" doc:"resource limits the server sheds load at"`
+	Permissions map[string]string            `json:"permissions" doc:"scope required by a route, by method and path"`
+	WAF         firewall                     `json:"waf" doc:"web application firewall"`
+	Chaos       chaosSettings                `json:"chaos" doc:"fault injection for resilience testing in staging"`
+	CORS        corsSettings                 `json:"cors" doc:"cross origin api calls, disabled without origins"`
+	Tarpits     map[string]tarpit            `json:"tarpits" doc:"bad bot handling per limiter: api, search, shortlink, forms, auth"`
+	Sitemap     sitemap                      `json:"sitemap" doc:"sitemap generation"`
+	Security    security                     `json:"security" doc:"security headers"`
+	Cookies     cookies                      `json:"cookies" doc:"attributes of the cookies set by the server"`
+	Passwords   passwords                    `json:"passwords" doc:"password hashing, hashes of other algorithms or costs are replaced on signin"`
+	Forms       formSettings                 `json:"forms" doc:"public forms"`
+	Comments    commentSettings              `json:"comments" doc:"comments on pages"`
+	Logging     map[string]*logsink.Settings `json:"logging" doc:"per logger overrides: server, access, limiter, combined"`
+	AccessLog   accessLog                    `json:"accessLog" doc:"format of the request lines written by Server.Logger"`
+}
+
+// Load loads a config file and prints it.
 func (c *Config) Load(file string) error {
+	if err := c.Read(file); err != nil {
+		return err
+	}
+
+	// print the config out with the secrets masked, like Diff does
+	data, err := json.MarshalIndent(c.maskSecrets(), "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(maskEnv(string(data), c.envValues))
+
+	return nil
+}
+
+// Read loads a config file without printing it, ie: to compare it with the running
+// config.  The ${NAME} references in the file are expanded and the GOWEB_ environment
+// variables override the settings of the file.
+func (c *Config) Read(file string) error {
 	data, err := os.ReadFile(file)
 	if err != nil {
 		return err
 	}
 
+	if data, c.envValues, err = expandEnv(stripComments(data)); err != nil {
+		return err
+	}
+
 	err = json.Unmarshal(data, c)
 	if err != nil {
 		return err
 	}
 
+	if err = applyEnv(c); err != nil {
+		return err
+	}
+
 	// calculate the base host URL
 	c.URLPrefix = c.HTTPS.Scheme + "://" + c.HTTPS.Domain
 	if c.HTTPS.Port != "80" && c.HTTPS.Port != "443" {
 		c.URLPrefix += ":" + c.HTTPS.Port
 	}
 
-	// mask password so we can print config
-	pass := c.DB.Pass
-	c.DB.Pass = "********"
+	return nil
+}
 
-	// print the config out
-	data, err = json.MarshalIndent(c, "", "  ")
-	if err != nil {
-		return err
+// stripComments blanks the lines starting with //, ie: the comments of Example.  json
+// strings can not span lines, so the comments can not be confused with values.
+func stripComments(data []byte) []byte {
+	lines := bytes.Split(data, []byte("\n"))
+	for i, line := range lines {
+		if bytes.HasPrefix(bytes.TrimSpace(line), []byte("//")) {
+			lines[i] = nil
+		}
 	}
-	fmt.Println(string(data))
-
-	// set the passwords back to original values
-	c.DB.Pass = pass
-
-	return nil
+	return bytes.Join(lines, []byte("\n"))
 }
 
 // Save saves a config file.
@@ -0,0 +1,179 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package config
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+
+	"github.com/cwbriscoe/goweb/logsink"
+	"github.com/goccy/go-json"
+)
+
+// masked replaces the values of the secret settings when a config is printed or
+// compared.
+const masked = "********"
+
+// Change is a setting that differs between two configs.
+type Change struct {
+	Path string `json:"path"` // json path of the setting, ie: features.readOnly or logging.server.level
+	Old  string `json:"old"`  // json value in the first config
+	New  string `json:"new"`  // json value in the second config
+}
+
+// Diff returns the settings that differ between a and b sorted by path.  Objects are
+// compared field by field and arrays as a whole.  Unset settings compare equal to their
+// zero value.  The values of the secret settings and the values expanded from ${NAME}
+// references are masked, see maskSecrets and maskEnv.
+func Diff(a, b *Config) ([]Change, error) {
+	before, err := flatten(a)
+	if err != nil {
+		return nil, err
+	}
+	after, err := flatten(b)
+	if err != nil {
+		return nil, err
+	}
+
+	// the changes are found on the real values so a changed secret is still reported,
+	// but the values shown are taken from the masked configs.
+	shownBefore, err := flatten(a.maskSecrets())
+	if err != nil {
+		return nil, err
+	}
+	shownAfter, err := flatten(b.maskSecrets())
+	if err != nil {
+		return nil, err
+	}
+
+	for path, v := range shownBefore {
+		shownBefore[path] = maskEnv(v, a.envValues)
+	}
+	for path, v := range shownAfter {
+		shownAfter[path] = maskEnv(v, b.envValues)
+	}
+
+	var changes []Change
+	for path, old := range before {
+		if v, ok := after[path]; !ok {
+			changes = append(changes, Change{Path: path, Old: shownBefore[path], New: zeroValue(old)})
+		} else if v != old {
+			changes = append(changes, Change{Path: path, Old: shownBefore[path], New: shownAfter[path]})
+		}
+	}
+	for path, v := range after {
+		if _, ok := before[path]; !ok {
+			changes = append(changes, Change{Path: path, Old: zeroValue(v), New: shownAfter[path]})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes, nil
+}
+
+// maskSecrets returns a copy of c with the values of the secret settings masked:
+// db.pass, forms.secret and the s3 secretKey and the headers of the log sinks.  Unset
+// secrets stay unset.  The maps, slices and pointers leading to a secret are copied, so
+// c itself is left untouched.
+func (c *Config) maskSecrets() *Config {
+	cp := *c
+	mask(&cp.DB.Pass)
+	mask(&cp.Forms.Secret)
+
+	if c.Logging != nil {
+		cp.Logging = make(map[string]*logsink.Settings, len(c.Logging))
+		for name, settings := range c.Logging {
+			if settings == nil {
+				cp.Logging[name] = nil
+				continue
+			}
+			s := *settings
+			s.Sinks = append([]logsink.Config(nil), settings.Sinks...)
+			for i := range s.Sinks {
+				sink := &s.Sinks[i]
+				if sink.Headers != nil {
+					headers := make(map[string]string, len(sink.Headers))
+					for k, v := range sink.Headers {
+						mask(&v)
+						headers[k] = v
+					}
+					sink.Headers = headers
+				}
+				if sink.S3 != nil {
+					s3 := *sink.S3
+					mask(&s3.SecretKey)
+					sink.S3 = &s3
+				}
+			}
+			cp.Logging[name] = &s
+		}
+	}
+	return &cp
+}
+
+// mask replaces a secret with masked unless it is unset.
+func mask(secret *string) {
+	if *secret != "" {
+		*secret = masked
+	}
+}
+
+// flatten returns the json values of the settings of c by path, leaving out the
+// settings with a zero value.
+func flatten(c *Config) (map[string]string, error) {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var root map[string]any
+	if err = dec.Decode(&root); err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]string)
+	if err = flattenObject("", root, values); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+func flattenObject(prefix string, obj map[string]any, values map[string]string) error {
+	for key, v := range obj {
+		path := prefix + key
+		if child, ok := v.(map[string]any); ok {
+			if err := flattenObject(path+".", child, values); err != nil {
+				return err
+			}
+			continue
+		}
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		if s := string(data); s != zeroValue(s) && s != "null" {
+			values[path] = s
+		}
+	}
+	return nil
+}
+
+// zeroValue returns the json zero value of the type of the json value v.
+func zeroValue(v string) string {
+	switch {
+	case v == "true" || v == "false":
+		return "false"
+	case strings.HasPrefix(v, `"`):
+		return `""`
+	case strings.HasPrefix(v, "["):
+		return "[]"
+	case strings.HasPrefix(v, "{"):
+		return "{}"
+	case v == "null":
+		return "null"
+	default:
+		return "0"
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/cwbriscoe/goweb/logsink"
+	"github.com/cwbriscoe/goweb/storage"
+)
+
+func TestDiff(t *testing.T) {
+	a := &Config{Listen: ":8080"}
+	a.DB.Pass = "old"
+	a.Features.ReadOnly = true
+
+	b := &Config{Listen: ":8080"}
+	b.DB.Pass = "new"
+	b.HTTPS.StaticDirs = []string{"img"}
+	b.Logging = map[string]*logsink.Settings{"server": {Level: "warn"}}
+
+	changes, err := Diff(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Change{
+		{Path: "db.pass", Old: `"********"`, New: `"********"`},
+		{Path: "features.readOnly", Old: "true", New: "false"},
+		{Path: "https.staticdirs", Old: "[]", New: `["img"]`},
+		{Path: "logging.server.level", Old: `""`, New: `"warn"`},
+	}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("expected %v, got %v", want, changes)
+	}
+
+	if changes, _ = Diff(b, b); len(changes) != 0 {
+		t.Errorf("expected no changes, got %v", changes)
+	}
+}
+
+func TestDiffSecrets(t *testing.T) {
+	sink := func(key, token string) *logsink.Settings {
+		return &logsink.Settings{Sinks: []logsink.Config{{
+			Type:    "s3",
+			Headers: map[string]string{"authorization": token},
+			S3:      &storage.S3{Bucket: "logs", SecretKey: key},
+		}}}
+	}
+	a := &Config{Logging: map[string]*logsink.Settings{"server": sink("old-key", "old-token")}}
+	b := &Config{Logging: map[string]*logsink.Settings{"server": sink("new-key", "old-token")}}
+	b.Forms.Secret = "new-secret"
+
+	changes, err := Diff(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 2 || changes[0].Path != "forms.secret" || changes[1].Path != "logging.server.sinks" {
+		t.Fatalf("expected forms.secret and logging.server.sinks, got %v", changes)
+	}
+	for _, c := range changes {
+		for _, secret := range []string{"old-key", "new-key", "old-token", "new-secret"} {
+			if strings.Contains(c.Old+c.New, secret) {
+				t.Errorf("%s shows the secret %q: %v", c.Path, secret, c)
+			}
+		}
+	}
+	if !strings.Contains(changes[1].New, `"bucket":"logs"`) {
+		t.Errorf("expected the other settings of the sink to be shown, got %s", changes[1].New)
+	}
+
+	// masking works on a copy.
+	if s := b.Logging["server"].Sinks[0]; s.S3.SecretKey != "new-key" || s.Headers["authorization"] != "old-token" || b.Forms.Secret != "new-secret" {
+		t.Errorf("secrets of the config were masked: %+v %+v", s, s.S3)
+	}
+}
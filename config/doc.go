@@ -0,0 +1,228 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package config
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+
+	"github.com/goccy/go-json"
+)
+
+// Setting describes a setting of the config file.  It is read from the tags of the
+// fields of Config and of the module configs it embeds:
+//
+//	doc      what the setting does
+//	default  value used when the setting is unset, written like a GOWEB_ variable
+//	enum     comma separated values allowed besides the empty one
+//	required the setting must be set, see Validate
+type Setting struct {
+	Name     string    `json:"name"`
+	Path     string    `json:"path"` // ie: features.readOnly, <name> stands for the keys of a map and [] for the items of a list
+	Type     string    `json:"type"` // string, integer, number, boolean, object, []<type> or map[string]<type>
+	Doc      string    `json:"doc"`
+	Default  string    `json:"default,omitempty"`
+	Enum     []string  `json:"enum,omitempty"`
+	Required bool      `json:"required,omitempty"`
+	Settings []Setting `json:"settings,omitempty"` // fields of an object or of the objects of a list or map
+
+	typ reflect.Type
+}
+
+// externalTags are the tags of the settings of types declared outside of goweb.
+var externalTags = map[string]reflect.StructTag{
+	"db.host": `doc:"host of the postgres server" required:"true"`,
+	"db.port": `doc:"port of the postgres server, ie: 5432" required:"true"`,
+	"db.name": `doc:"name of the database" required:"true"`,
+	"db.user": `doc:"user the server connects as" required:"true"`,
+	"db.pass": `doc:"password of the user, ie: ${DB_PASSWORD}"`,
+}
+
+// tagOf returns the tags of the field at path.
+func tagOf(field reflect.StructField, path string) reflect.StructTag {
+	if tag, ok := externalTags[path]; ok {
+		return tag
+	}
+	return field.Tag
+}
+
+// Settings returns the settings of the config file in the order of the fields of Config.
+func Settings() []Setting {
+	return settingsOf(reflect.TypeOf(Config{}), "")
+}
+
+func settingsOf(t reflect.Type, prefix string) []Setting {
+	var settings []Setting
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if !field.IsExported() || name == "" || name == "-" {
+			continue
+		}
+
+		tag := tagOf(field, prefix+name)
+		s := Setting{
+			Name:     name,
+			Path:     prefix + name,
+			Type:     typeName(field.Type),
+			Doc:      tag.Get("doc"),
+			Default:  tag.Get("default"),
+			Required: tag.Get("required") == "true",
+			typ:      field.Type,
+		}
+		if enum := tag.Get("enum"); enum != "" {
+			s.Enum = strings.Split(enum, ",")
+		}
+
+		switch elem := indirect(field.Type); {
+		case elem.Kind() == reflect.Struct:
+			s.Settings = settingsOf(elem, s.Path+".")
+		case elem.Kind() == reflect.Slice && indirect(elem.Elem()).Kind() == reflect.Struct:
+			s.Settings = settingsOf(indirect(elem.Elem()), s.Path+"[].")
+		case elem.Kind() == reflect.Map && indirect(elem.Elem()).Kind() == reflect.Struct:
+			s.Settings = settingsOf(indirect(elem.Elem()), s.Path+".<name>.")
+		}
+		settings = append(settings, s)
+	}
+	return settings
+}
+
+func indirect(t reflect.Type) reflect.Type {
+	if t.Kind() == reflect.Pointer {
+		return t.Elem()
+	}
+	return t
+}
+
+func typeName(t reflect.Type) string {
+	t = indirect(t)
+	switch t.Kind() {
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "integer"
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Slice:
+		return "[]" + typeName(t.Elem())
+	case reflect.Map:
+		return "map[string]" + typeName(t.Elem())
+	}
+	return "object"
+}
+
+// Env returns the name of the environment variable that overrides the setting, empty
+// if it can not be overridden, ie: for objects or the settings inside lists and maps.
+func (s *Setting) Env() string {
+	if strings.ContainsAny(s.Path, "[<") {
+		return ""
+	}
+	switch t := indirect(s.typ); t.Kind() {
+	case reflect.Struct, reflect.Map:
+		return ""
+	case reflect.Slice:
+		if t.Elem().Kind() != reflect.String {
+			return ""
+		}
+	}
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(s.Path, ".", "_"))
+}
+
+// value returns the json value of the setting in the example config: its default or
+// the zero value of its type.
+func (s *Setting) value() string {
+	t := indirect(s.typ)
+	switch t.Kind() {
+	case reflect.Struct:
+		return ""
+	case reflect.Slice:
+		if s.Default == "" {
+			return "[]"
+		}
+	case reflect.Map:
+		return "{}"
+	}
+
+	v := reflect.New(t).Elem()
+	if s.Default != "" {
+		if err := setEnvValue(v, s.Default); err != nil {
+			panic("config: invalid default of " + s.Path + ": " + err.Error())
+		}
+	}
+	data, err := json.Marshal(v.Interface())
+	if err != nil {
+		panic(err)
+	}
+	return string(data)
+}
+
+// comment returns the doc of the setting with its allowed values.
+func (s *Setting) comment() string {
+	comment := s.Doc
+	if len(s.Enum) > 0 {
+		comment += " (" + strings.Join(s.Enum, ", ") + ")"
+	}
+	if s.Required {
+		comment += ", required"
+	}
+	return comment
+}
+
+// Example returns a config file with every setting set to its default and commented
+// with its doc.  Read skips the comments, so it can be used as a starting point.  The
+// objects of lists and maps are left empty and their fields are described in the
+// comments.
+func Example() []byte {
+	var b bytes.Buffer
+	b.WriteString("{\n")
+	writeExample(&b, Settings(), "  ")
+	b.WriteString("}\n")
+	return b.Bytes()
+}
+
+func writeExample(b *bytes.Buffer, settings []Setting, indent string) {
+	for i, s := range settings {
+		writeComment(b, indent, s.comment())
+		kind := indirect(s.typ).Kind()
+		if kind != reflect.Struct && len(s.Settings) > 0 {
+			writeFields(b, s.Settings, indent, 1)
+		}
+
+		b.WriteString(indent + `"` + s.Name + `": `)
+		if kind == reflect.Struct {
+			b.WriteString("{\n")
+			writeExample(b, s.Settings, indent+"  ")
+			b.WriteString(indent + "}")
+		} else {
+			b.WriteString(s.value())
+		}
+		if i < len(settings)-1 {
+			b.WriteByte(',')
+		}
+		b.WriteByte('\n')
+	}
+}
+
+// writeFields describes the fields of the objects of a list or map in comments.
+func writeFields(b *bytes.Buffer, settings []Setting, indent string, depth int) {
+	for _, s := range settings {
+		line := strings.Repeat("  ", depth) + s.Name + ": " + s.comment()
+		if s.Default != "" {
+			line += ", defaults to " + s.Default
+		}
+		writeComment(b, indent, line)
+		if len(s.Settings) > 0 {
+			writeFields(b, s.Settings, indent, depth+1)
+		}
+	}
+}
+
+func writeComment(b *bytes.Buffer, indent, comment string) {
+	if comment != "" {
+		b.WriteString(indent + "// " + comment + "\n")
+	}
+}
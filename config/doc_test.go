@@ -0,0 +1,67 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSettingsDocumented(t *testing.T) {
+	var check func(settings []Setting)
+	check = func(settings []Setting) {
+		for _, s := range settings {
+			if s.Doc == "" {
+				t.Errorf("%s has no doc tag", s.Path)
+			}
+			check(s.Settings)
+		}
+	}
+	check(Settings())
+}
+
+func TestExample(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "example.json")
+	if err := os.WriteFile(file, Example(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &Config{}
+	if err := c.Read(file); err != nil {
+		t.Fatal(err)
+	}
+	if c.Limits.MaxBody != 10485760 || c.TLS.Listen != ":443" || c.Passwords.Algorithm != "argon2id" {
+		t.Errorf("defaults not set: maxBody %d, tls.listen %q, algorithm %q", c.Limits.MaxBody, c.TLS.Listen, c.Passwords.Algorithm)
+	}
+	if want := []string{"Content-Type"}; !reflect.DeepEqual(c.CORS.Headers, want) {
+		t.Errorf("expected cors.headers %v, got %v", want, c.CORS.Headers)
+	}
+}
+
+func TestSettingEnv(t *testing.T) {
+	tests := map[string]string{
+		"db.pass":              "GOWEB_DB_PASS",
+		"https.staticdirs":     "GOWEB_HTTPS_STATICDIRS",
+		"features":             "",
+		"waf.rules":            "",
+		"logging.<name>.level": "",
+	}
+	var walk func(settings []Setting)
+	walk = func(settings []Setting) {
+		for _, s := range settings {
+			if want, ok := tests[s.Path]; ok {
+				if got := s.Env(); got != want {
+					t.Errorf("%s: expected %q, got %q", s.Path, want, got)
+				}
+				delete(tests, s.Path)
+			}
+			walk(s.Settings)
+		}
+	}
+	walk(Settings())
+	for path := range tests {
+		t.Errorf("setting %s not found", path)
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/goccy/go-json"
+)
+
+// EnvPrefix starts the names of the environment variables that override settings of
+// the config file, ie: GOWEB_DB_PASS for db.pass or GOWEB_FEATURES_READONLY for
+// features.readOnly.
+const EnvPrefix = "GOWEB_"
+
+// envRef matches a ${NAME} reference to an environment variable in a config file.
+var envRef = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnv replaces the ${NAME} references in the json data with the values of the
+// environment variables, escaped so they can be used inside json strings.  It is an
+// error to reference a variable that is not set, so a missing secret is not silently
+// replaced with an empty one.  The escaped values are returned too, so they can be
+// masked when the config is printed.
+func expandEnv(data []byte) ([]byte, []string, error) {
+	var missing, values []string
+	data = envRef.ReplaceAllFunc(data, func(ref []byte) []byte {
+		name := string(envRef.FindSubmatch(ref)[1])
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			missing = append(missing, name)
+			return ref
+		}
+		quoted, _ := json.Marshal(v)
+		values = append(values, string(quoted[1:len(quoted)-1]))
+		return quoted[1 : len(quoted)-1]
+	})
+	if len(missing) > 0 {
+		return nil, nil, fmt.Errorf("config references unset environment variables: %s", strings.Join(missing, ", "))
+	}
+	return data, values, nil
+}
+
+// maskEnv masks the values expanded from ${NAME} references in the json data, they
+// may be secrets in settings maskSecrets does not know about.  Values that are json
+// literals, ie: a number, are kept since they can not be told apart from the other
+// values and are not secrets.
+func maskEnv(data string, values []string) string {
+	for _, v := range values {
+		if v == "" || json.Valid([]byte(v)) {
+			continue
+		}
+		data = strings.ReplaceAll(data, v, masked)
+	}
+	return data
+}
+
+// applyEnv overrides the settings of c with the environment variables named after
+// their json path.  Strings, numbers, booleans and lists of strings, separated by
+// commas, can be overridden.  Maps and lists of objects can not.
+func applyEnv(c *Config) error {
+	return applyEnvStruct(reflect.ValueOf(c).Elem(), EnvPrefix)
+}
+
+func applyEnvStruct(v reflect.Value, prefix string) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if !field.IsExported() || name == "" || name == "-" {
+			continue
+		}
+		name = prefix + strings.ToUpper(name)
+
+		f := v.Field(i)
+		if f.Kind() == reflect.Struct {
+			if err := applyEnvStruct(f, name+"_"); err != nil {
+				return err
+			}
+			continue
+		}
+		s, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		if err := setEnvValue(f, s); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func setEnvValue(f reflect.Value, s string) error {
+	switch f.Kind() {
+	case reflect.String:
+		f.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		f.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, f.Type().Bits())
+		if err != nil {
+			return err
+		}
+		f.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, f.Type().Bits())
+		if err != nil {
+			return err
+		}
+		f.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(s, f.Type().Bits())
+		if err != nil {
+			return err
+		}
+		f.SetFloat(n)
+	case reflect.Slice:
+		if f.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("%s can not be set from the environment", f.Type())
+		}
+		var list []string
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		f.Set(reflect.ValueOf(list).Convert(f.Type()))
+	default:
+		return fmt.Errorf("%s can not be set from the environment", f.Type())
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReadEnv(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "test.json")
+	cfg := `{"listen":":8080","db":{"user":"web","pass":"${TEST_DB_PASS}"},"limits":{"maxBody":${TEST_MAX_BODY}}}`
+	if err := os.WriteFile(file, []byte(cfg), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &Config{}
+	if err := c.Read(file); err == nil {
+		t.Fatal("expected an error for the unset variables")
+	}
+
+	t.Setenv("TEST_DB_PASS", `pa"ss`)
+	t.Setenv("TEST_MAX_BODY", "1024")
+	t.Setenv("GOWEB_LISTEN", ":9090")
+	t.Setenv("GOWEB_FEATURES_READONLY", "true")
+	t.Setenv("GOWEB_HTTPS_STATICDIRS", "img, css")
+	t.Setenv("GOWEB_PASSWORDS_THREADS", "4")
+
+	c = &Config{}
+	if err := c.Read(file); err != nil {
+		t.Fatal(err)
+	}
+	if c.DB.Pass != `pa"ss` || c.DB.User != "web" || c.Limits.MaxBody != 1024 {
+		t.Errorf("references not expanded: pass %q, user %q, maxBody %d", c.DB.Pass, c.DB.User, c.Limits.MaxBody)
+	}
+	if c.Listen != ":9090" || !c.Features.ReadOnly || c.Passwords.Threads != 4 {
+		t.Errorf("overrides not applied: listen %q, readOnly %v, threads %d", c.Listen, c.Features.ReadOnly, c.Passwords.Threads)
+	}
+	if want := []string{"img", "css"}; !reflect.DeepEqual(c.HTTPS.StaticDirs, want) {
+		t.Errorf("expected staticdirs %v, got %v", want, c.HTTPS.StaticDirs)
+	}
+
+	t.Setenv("GOWEB_FEATURES_READONLY", "maybe")
+	if err := (&Config{}).Read(file); err == nil {
+		t.Error("expected an error for an invalid boolean")
+	}
+}
+
+func TestMaskEnv(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "test.json")
+	cfg := `{"db":{"user":"${TEST_DB_USER}"},"limits":{"maxBody":${TEST_MAX_BODY}}}`
+	if err := os.WriteFile(file, []byte(cfg), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TEST_DB_USER", "secret-user")
+	t.Setenv("TEST_MAX_BODY", "1024")
+
+	c := &Config{}
+	if err := c.Read(file); err != nil {
+		t.Fatal(err)
+	}
+	changes, err := Diff(&Config{}, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 2 {
+		t.Fatalf("expected db.user and limits.maxBody, got %v", changes)
+	}
+	for _, change := range changes {
+		switch change.Path {
+		case "db.user":
+			if change.New != `"********"` {
+				t.Errorf("expected db.user to be masked, got %s", change.New)
+			}
+		case "limits.maxBody":
+			if change.New != "1024" {
+				t.Errorf("expected limits.maxBody to be kept, got %s", change.New)
+			}
+		}
+	}
+	if c.DB.User != "secret-user" {
+		t.Errorf("expected the config to keep the value, got %q", c.DB.User)
+	}
+}
@@ -0,0 +1,205 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Validate checks the settings before the server is started with them: the required
+// settings are set, the settings with allowed values have one of them, the addresses
+// and ports are valid, the root directory exists, the log directory is writable, the
+// cache bounds and compression levels are sane and cors does not send credentials to
+// every origin.  All the problems found are joined in the error, one per
+// line, each starting with the path of the setting.
+func (c *Config) Validate() error {
+	var errs []error
+	fail := func(path, format string, args ...any) {
+		errs = append(errs, fmt.Errorf("%s: %s", path, fmt.Sprintf(format, args...)))
+	}
+
+	checkTags(reflect.ValueOf(c).Elem(), "", fail)
+
+	tls := c.TLS.AutoCert || c.TLS.CertFile != ""
+	if c.Listen == "" && !tls {
+		fail("listen", "is required without tls")
+	}
+	checkAddr("listen", c.Listen, fail)
+	checkAddr("tls.listen", c.TLS.Listen, fail)
+	if c.TLS.HTTPListen != "-" {
+		checkAddr("tls.httpListen", c.TLS.HTTPListen, fail)
+	}
+	checkPort("https.port", c.HTTPS.Port, fail)
+	checkPort("db.port", c.DB.Port, fail)
+	if !c.TLS.AutoCert && (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		fail("tls", "certFile and keyFile must be set together")
+	}
+
+	if c.RootDir != "" {
+		if info, err := os.Stat(c.RootDir); err != nil {
+			fail("rootdir", "%v", err)
+		} else if !info.IsDir() {
+			fail("rootdir", "%s is not a directory", c.RootDir)
+		}
+	}
+	if c.LogDir != "" {
+		if err := checkWritable(c.LogDir); err != nil {
+			fail("logdir", "%v", err)
+		}
+	}
+
+	if c.Cache.Capacity < 0 {
+		fail("cache.capacity", "must be positive, got %d", c.Cache.Capacity)
+	}
+	buckets := int64(c.Cache.Buckets)
+	if buckets == 0 {
+		buckets = 16
+	}
+	if buckets < 1 || buckets > 256 {
+		fail("cache.buckets", "must be between 1 and 256, got %d", buckets)
+	} else if c.Cache.Capacity > 0 && c.Cache.Capacity < buckets<<10 {
+		fail("cache.capacity", "must be at least 1KB per bucket, got %d bytes for %d buckets", c.Cache.Capacity, buckets)
+	}
+
+	checkLevels("compression.default", c.Compression.Default, fail)
+	checkLevels("compression.static", c.Compression.Static, fail)
+	types := make([]string, 0, len(c.Compression.Types))
+	for typ := range c.Compression.Types {
+		types = append(types, typ)
+	}
+	slices.Sort(types)
+	for _, typ := range types {
+		checkLevels("compression.types."+typ, c.Compression.Types[typ], fail)
+	}
+	if c.Compression.LargeSize < 0 {
+		fail("compression.largeSize", "must not be negative, got %d", c.Compression.LargeSize)
+	}
+
+	// browsers refuse credentials with the * origin, the CORS handler would have to
+	// echo every origin back instead.
+	if c.CORS.Credentials && slices.Contains(c.CORS.Origins, "*") {
+		fail("cors.credentials", "cannot be used with the * origin")
+	}
+
+	return errors.Join(errs...)
+}
+
+// failFunc records a problem with the setting at path.
+type failFunc func(path, format string, args ...any)
+
+// checkTags checks the required and enum tags of the fields of the struct v and of the
+// objects inside it.
+func checkTags(v reflect.Value, prefix string, fail failFunc) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if !field.IsExported() || name == "" || name == "-" {
+			continue
+		}
+		path := prefix + name
+		tag := tagOf(field, path)
+		f := v.Field(i)
+
+		if tag.Get("required") == "true" && f.IsZero() {
+			fail(path, "is required")
+		}
+		if enum := tag.Get("enum"); enum != "" && f.Kind() == reflect.String {
+			if s := f.String(); s != "" && !slices.Contains(strings.Split(enum, ","), s) {
+				fail(path, "%q is not one of %s", s, strings.ReplaceAll(enum, ",", ", "))
+			}
+		}
+
+		if f.Kind() == reflect.Pointer {
+			if f.IsNil() {
+				continue
+			}
+			f = f.Elem()
+		}
+		switch f.Kind() {
+		case reflect.Struct:
+			checkTags(f, path+".", fail)
+		case reflect.Slice:
+			for j := 0; j < f.Len(); j++ {
+				if item := reflect.Indirect(f.Index(j)); item.Kind() == reflect.Struct {
+					checkTags(item, fmt.Sprintf("%s[%d].", path, j), fail)
+				}
+			}
+		case reflect.Map:
+			iter := f.MapRange()
+			for iter.Next() {
+				if item := reflect.Indirect(iter.Value()); item.Kind() == reflect.Struct {
+					checkTags(item, path+"."+iter.Key().String()+".", fail)
+				}
+			}
+		}
+	}
+}
+
+// checkLevels checks the gzip, brotli and zstd levels, zero uses the default level.
+func checkLevels(path string, levels CompressLevels, fail failFunc) {
+	if levels.Gzip < 0 || levels.Gzip > 9 {
+		fail(path+".gzip", "must be between 1 and 9, got %d", levels.Gzip)
+	}
+	if levels.Brotli < 0 || levels.Brotli > 11 {
+		fail(path+".brotli", "must be between 0 and 11, got %d", levels.Brotli)
+	}
+	if levels.Zstd < 0 || levels.Zstd > 22 {
+		fail(path+".zstd", "must be between 1 and 22, got %d", levels.Zstd)
+	}
+}
+
+// checkAddr checks a listen address like :8080 or 127.0.0.1:8080 when it is set.
+func checkAddr(path, addr string, fail failFunc) {
+	if addr == "" {
+		return
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err == nil {
+		// named ports like :http are accepted by net.Listen too.
+		_, err = net.LookupPort("tcp", port)
+	}
+	if err != nil {
+		fail(path, "%q is not a valid host:port address", addr)
+	}
+}
+
+// checkPort checks a port number when it is set.
+func checkPort(path, port string, fail failFunc) {
+	if port == "" {
+		return
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		fail(path, "%q is not a port between 1 and 65535", port)
+	}
+}
+
+// checkWritable checks that files can be created in dir.  A dir that does not exist
+// is created by the log writers, so its nearest existing parent must be writable.
+func checkWritable(dir string) error {
+	info, err := os.Stat(dir)
+	for os.IsNotExist(err) && filepath.Dir(dir) != dir {
+		dir = filepath.Dir(dir)
+		info, err = os.Stat(dir)
+	}
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	f, err := os.CreateTemp(dir, ".validate-*")
+	if err != nil {
+		return fmt.Errorf("%s is not writable: %w", dir, err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
@@ -0,0 +1,94 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cwbriscoe/goweb/logsink"
+	"github.com/cwbriscoe/goweb/waf"
+)
+
+// validConfig returns a config that passes Validate.
+func validConfig(t *testing.T) *Config {
+	dir := t.TempDir()
+	c := &Config{RootDir: dir, LogDir: dir, Listen: ":8080"}
+	c.Cache.Capacity = 1 << 20
+	c.HTTPS.Scheme = "https"
+	c.HTTPS.Domain = "example.com"
+	c.HTTPS.Port = "443"
+	c.DB.Host = "localhost"
+	c.DB.Port = "5432"
+	c.DB.Name = "web"
+	c.DB.User = "web"
+	return c
+}
+
+func TestValidate(t *testing.T) {
+	c := validConfig(t)
+	c.LogDir = filepath.Join(c.LogDir, "log") // created by the log writers
+	if err := c.Validate(); err != nil {
+		t.Fatalf("expected a valid config, got %v", err)
+	}
+
+	c = validConfig(t)
+	c.Listen = ":99999"
+	c.LogDir = filepath.Join(c.LogDir, "file", "log")
+	if err := os.WriteFile(filepath.Join(c.RootDir, "file"), nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	c.DB.Host = ""
+	c.HTTPS.Scheme = "ftp"
+	c.Cache.Buckets = 300
+	c.TLS.CertFile = "cert.pem"
+	c.WAF.Rules = []waf.Rule{{Name: "block", Action: "drop"}}
+	c.Logging = map[string]*logsink.Settings{"server": {Level: "loud"}}
+	c.Compression.Default.Gzip = 10
+	c.Compression.Static.Zstd = 23
+	c.Compression.LargeSize = -1
+	c.Compression.Types = map[string]CompressLevels{"text/html": {Brotli: 12}}
+	c.CORS.Origins = []string{"*"}
+	c.CORS.Credentials = true
+
+	err := c.Validate()
+	if err == nil {
+		t.Fatal("expected an invalid config")
+	}
+	want := []string{
+		"db.host: is required",
+		`https.scheme: "ftp" is not one of http, https`,
+		`waf.rules[0].action: "drop" is not one of allow, deny, challenge, tarpit, reroute`,
+		`logging.server.level: "loud" is not one of`,
+		`listen: ":99999" is not a valid host:port address`,
+		"tls: certFile and keyFile must be set together",
+		"logdir: stat " + c.LogDir + ": not a directory",
+		"cache.buckets: must be between 1 and 256, got 300",
+		"compression.default.gzip: must be between 1 and 9, got 10",
+		"compression.static.zstd: must be between 1 and 22, got 23",
+		"compression.types.text/html.brotli: must be between 0 and 11, got 12",
+		"compression.largeSize: must not be negative, got -1",
+		"cors.credentials: cannot be used with the * origin",
+	}
+	lines := strings.Split(err.Error(), "\n")
+	if len(lines) != len(want) {
+		t.Errorf("expected %d problems, got %d:\n%v", len(want), len(lines), err)
+	}
+	for _, w := range want {
+		found := false
+		for _, line := range lines {
+			found = found || strings.HasPrefix(line, w)
+		}
+		if !found {
+			t.Errorf("expected a problem starting with %q in:\n%v", w, err)
+		}
+	}
+
+	c = validConfig(t)
+	c.Cache.Capacity = 1000
+	if err = c.Validate(); err == nil || !strings.HasPrefix(err.Error(), "cache.capacity: must be at least 1KB per bucket") {
+		t.Errorf("expected the capacity to be too small, got %v", err)
+	}
+}
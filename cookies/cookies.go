@@ -0,0 +1,138 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+// Package cookies measures cookies against the size browsers are guaranteed to keep and
+// splits values that don't fit into numbered chunks that are reassembled when read.
+package cookies
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+const (
+	// MaxSize is the size of a cookie, name, value and attributes, that every browser
+	// keeps.  Larger cookies are dropped or truncated by some of them.
+	MaxSize = 4096
+	// MaxChunks is the most chunks a value is split into.
+	MaxChunks = 8
+)
+
+// chunkMarker starts the value of the cookie holding the chunk count and checksum of a
+// split value.  Values written with Split must not start with it.
+const chunkMarker = "~"
+
+var (
+	// ErrTooLarge is returned when a value does not fit in MaxChunks chunks.
+	ErrTooLarge = errors.New("cookies: value too large")
+	// ErrIntegrity is returned when the chunks of a value are missing or were not
+	// written together.
+	ErrIntegrity = errors.New("cookies: chunks do not match their checksum")
+)
+
+// Size returns the size of the Set-Cookie header value of the cookie.
+func Size(c *http.Cookie) int {
+	return len(c.String())
+}
+
+// Fits returns true if browsers keep the cookie.
+func Fits(c *http.Cookie) bool {
+	return Size(c) <= MaxSize
+}
+
+// ChunkName returns the name of the ith chunk, starting at 1, of the cookie.
+func ChunkName(name string, i int) string {
+	return name + "_" + strconv.Itoa(i)
+}
+
+// Split returns the cookies to write for c: c itself if it fits, otherwise a cookie
+// named like c holding the number of chunks and the checksum of the value, followed by
+// the chunks.  Every cookie has the attributes of c.
+func Split(c *http.Cookie) ([]*http.Cookie, error) {
+	if Fits(c) {
+		return []*http.Cookie{c}, nil
+	}
+
+	// the room left for the value next to the name and attributes of the last chunk.
+	empty := *c
+	empty.Name = ChunkName(c.Name, MaxChunks)
+	empty.Value = ""
+	room := MaxSize - Size(&empty)
+	if room <= 0 {
+		return nil, ErrTooLarge
+	}
+	count := (len(c.Value) + room - 1) / room
+	if count > MaxChunks {
+		return nil, ErrTooLarge
+	}
+
+	head := *c
+	head.Value = chunkMarker + strconv.Itoa(count) + "." + checksum(c.Value)
+	out := []*http.Cookie{&head}
+	for i := 0; i < count; i++ {
+		part := *c
+		part.Name = ChunkName(c.Name, i+1)
+		part.Value = c.Value[i*room : min((i+1)*room, len(c.Value))]
+		out = append(out, &part)
+	}
+	return out, nil
+}
+
+// Join returns the value of the named cookie of the request, reassembled from its
+// chunks if it was split.  It returns http.ErrNoCookie if the cookie is missing and
+// ErrIntegrity if its chunks are.
+func Join(r *http.Request, name string) (string, error) {
+	c, err := r.Cookie(name)
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasPrefix(c.Value, chunkMarker) {
+		return c.Value, nil
+	}
+
+	countStr, sum, ok := strings.Cut(c.Value[len(chunkMarker):], ".")
+	count, err := strconv.Atoi(countStr)
+	if !ok || err != nil || count < 1 || count > MaxChunks {
+		return "", ErrIntegrity
+	}
+
+	var b strings.Builder
+	for i := 1; i <= count; i++ {
+		part, err := r.Cookie(ChunkName(name, i))
+		if err != nil {
+			return "", ErrIntegrity
+		}
+		b.WriteString(part.Value)
+	}
+
+	value := b.String()
+	if checksum(value) != sum {
+		return "", ErrIntegrity
+	}
+	return value, nil
+}
+
+// Expire returns the cookies that delete c and every chunk it could have been split
+// into.  Every cookie has the attributes of c.
+func Expire(c *http.Cookie) []*http.Cookie {
+	out := make([]*http.Cookie, 0, MaxChunks+1)
+	for i := 0; i <= MaxChunks; i++ {
+		del := *c
+		if i > 0 {
+			del.Name = ChunkName(c.Name, i)
+		}
+		del.Value = ""
+		del.Expires = time.Unix(0, 0)
+		del.MaxAge = -1
+		out = append(out, &del)
+	}
+	return out
+}
+
+func checksum(value string) string {
+	return strconv.FormatUint(xxhash.Sum64String(value), 16)
+}
@@ -0,0 +1,118 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package cookies
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// request returns a request sending back the cookies as a browser would.
+func request(cs []*http.Cookie) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	for _, c := range cs {
+		r.AddCookie(&http.Cookie{Name: c.Name, Value: c.Value})
+	}
+	return r
+}
+
+func TestSplitJoin(t *testing.T) {
+	value := strings.Repeat("abcdefghij", 1000)
+	c := &http.Cookie{Name: "access", Value: value, Path: "/", Secure: true, HttpOnly: true}
+
+	parts, err := Split(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parts) != 4 {
+		t.Fatalf("expected a head and 3 chunks, got %d cookies", len(parts))
+	}
+	for _, part := range parts {
+		if !Fits(part) {
+			t.Errorf("cookie %s is %d bytes", part.Name, Size(part))
+		}
+		if !part.HttpOnly || !part.Secure || part.Path != "/" {
+			t.Errorf("cookie %s lost the attributes", part.Name)
+		}
+	}
+
+	got, err := Join(request(parts), "access")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != value {
+		t.Error("joined value does not match")
+	}
+}
+
+func TestSplitFits(t *testing.T) {
+	c := &http.Cookie{Name: "access", Value: "small"}
+	parts, err := Split(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parts) != 1 || parts[0] != c {
+		t.Fatal("expected the cookie to be returned as is")
+	}
+
+	got, err := Join(request(parts), "access")
+	if err != nil || got != "small" {
+		t.Errorf("expected small, got %q, %v", got, err)
+	}
+}
+
+func TestSplitTooLarge(t *testing.T) {
+	c := &http.Cookie{Name: "access", Value: strings.Repeat("a", MaxSize*MaxChunks)}
+	if _, err := Split(c); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("expected ErrTooLarge, got %v", err)
+	}
+}
+
+func TestJoinIntegrity(t *testing.T) {
+	c := &http.Cookie{Name: "access", Value: strings.Repeat("0123456789", 1000)}
+	parts, err := Split(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a chunk is missing.
+	if _, err = Join(request(parts[:len(parts)-1]), "access"); !errors.Is(err, ErrIntegrity) {
+		t.Errorf("missing chunk: expected ErrIntegrity, got %v", err)
+	}
+
+	// a chunk from another value.
+	changed := append([]*http.Cookie{}, parts...)
+	other := *parts[1]
+	other.Value = strings.Repeat("x", len(other.Value))
+	changed[1] = &other
+	if _, err = Join(request(changed), "access"); !errors.Is(err, ErrIntegrity) {
+		t.Errorf("changed chunk: expected ErrIntegrity, got %v", err)
+	}
+
+	// a head that can't be parsed.
+	if _, err = Join(request([]*http.Cookie{{Name: "access", Value: "~x"}}), "access"); !errors.Is(err, ErrIntegrity) {
+		t.Errorf("bad head: expected ErrIntegrity, got %v", err)
+	}
+
+	if _, err = Join(request(nil), "access"); !errors.Is(err, http.ErrNoCookie) {
+		t.Errorf("expected ErrNoCookie, got %v", err)
+	}
+}
+
+func TestExpire(t *testing.T) {
+	dels := Expire(&http.Cookie{Name: "access", Value: "v", Path: "/app"})
+	if len(dels) != MaxChunks+1 {
+		t.Fatalf("expected %d cookies, got %d", MaxChunks+1, len(dels))
+	}
+	if dels[0].Name != "access" || dels[MaxChunks].Name != ChunkName("access", MaxChunks) {
+		t.Errorf("unexpected names %s and %s", dels[0].Name, dels[MaxChunks].Name)
+	}
+	for _, del := range dels {
+		if del.MaxAge != -1 || del.Value != "" || del.Path != "/app" {
+			t.Errorf("cookie %s is not expired with the attributes", del.Name)
+		}
+	}
+}
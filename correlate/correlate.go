@@ -0,0 +1,167 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+// Package correlate propagates request and job run ids across http calls and
+// background work so the logs from both sides can be matched up
+package correlate
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/cwbriscoe/goutil/logging"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// RequestIDHeader carries the request id between services.
+	RequestIDHeader = "X-Request-Id"
+	// RunIDHeader carries the id of the job run that made the request, signed with the
+	// run key shared by the job manager and the server, see SignRunID.
+	RunIDHeader = "X-Job-Run-Id"
+)
+
+// maxIDLen is the longest request id accepted from a header.
+const maxIDLen = 64
+
+type ctxKey int
+
+const (
+	requestIDKey ctxKey = iota
+	runIDKey
+)
+
+// NewID returns a random request id.
+func NewID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// WithRequestID returns a copy of ctx carrying the request id.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey, id)
+}
+
+// RequestID returns the request id stored in ctx or "" if there is none.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// WithRunID returns a copy of ctx carrying the job run id.
+func WithRunID(ctx context.Context, id int) context.Context {
+	return context.WithValue(ctx, runIDKey, id)
+}
+
+// RunID returns the job run id stored in ctx or 0 if there is none.
+func RunID(ctx context.Context) int {
+	id, _ := ctx.Value(runIDKey).(int)
+	return id
+}
+
+// Detach returns a background context with the ids of ctx.  Use it for work that
+// outlives the request so it is not cancelled when the response is written.
+func Detach(ctx context.Context) context.Context {
+	out := context.Background()
+	if id := RequestID(ctx); id != "" {
+		out = WithRequestID(out, id)
+	}
+	if id := RunID(ctx); id != 0 {
+		out = WithRunID(out, id)
+	}
+	return out
+}
+
+// SetHeaders adds the ids stored in ctx to an outgoing request.  The run id is only
+// sent when runKey is set, signed with it.
+func SetHeaders(ctx context.Context, req *http.Request, runKey []byte) {
+	if id := RequestID(ctx); id != "" {
+		req.Header.Set(RequestIDHeader, id)
+	}
+	if id := RunID(ctx); id != 0 && len(runKey) > 0 {
+		req.Header.Set(RunIDHeader, SignRunID(runKey, id))
+	}
+}
+
+// SignRunID returns the RunIDHeader value of the run, the id and its hmac with runKey.
+func SignRunID(runKey []byte, id int) string {
+	value := strconv.Itoa(id)
+	return value + "." + hex.EncodeToString(runMAC(runKey, value))
+}
+
+// verifyRunID returns the run id of a RunIDHeader value signed with runKey, 0 when the
+// signature does not match.
+func verifyRunID(runKey []byte, header string) int {
+	value, sig, ok := strings.Cut(header, ".")
+	if !ok || len(runKey) == 0 {
+		return 0
+	}
+	mac, err := hex.DecodeString(sig)
+	if err != nil || !hmac.Equal(mac, runMAC(runKey, value)) {
+		return 0
+	}
+	if run, err := strconv.Atoi(value); err == nil && run > 0 {
+		return run
+	}
+	return 0
+}
+
+func runMAC(runKey []byte, value string) []byte {
+	mac := hmac.New(sha256.New, runKey)
+	mac.Write([]byte(value))
+	return mac.Sum(nil)
+}
+
+// FromRequest returns the context of an incoming request with the ids from its headers.
+// A new request id is created when the caller did not send a valid one.  The run id is
+// only trusted when it is signed with runKey, so clients can't pass their requests off
+// as the ones of a job run.
+func FromRequest(r *http.Request, runKey []byte) context.Context {
+	ctx := r.Context()
+
+	id := r.Header.Get(RequestIDHeader)
+	if !validID(id) {
+		id = NewID()
+	}
+	ctx = WithRequestID(ctx, id)
+
+	if run := verifyRunID(runKey, r.Header.Get(RunIDHeader)); run > 0 {
+		ctx = WithRunID(ctx, run)
+	}
+
+	return ctx
+}
+
+// validID only accepts short ids made of characters that are safe to log.
+func validID(id string) bool {
+	if id == "" || len(id) > maxIDLen {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_', c == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Log returns the logger with the ids stored in ctx added as fields.
+func Log(ctx context.Context, l *logging.Logger) *zerolog.Logger {
+	lc := l.With()
+	if id := RequestID(ctx); id != "" {
+		lc = lc.Str("req", id)
+	}
+	if id := RunID(ctx); id != 0 {
+		lc = lc.Int("run", id)
+	}
+	logger := lc.Logger()
+	return &logger
+}
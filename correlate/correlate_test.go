@@ -0,0 +1,83 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package correlate
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+)
+
+var testRunKey = []byte("run key")
+
+func TestFromRequest(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set(RequestIDHeader, "abc-123")
+	r.Header.Set(RunIDHeader, SignRunID(testRunKey, 42))
+
+	ctx := FromRequest(r, testRunKey)
+	if id := RequestID(ctx); id != "abc-123" {
+		t.Errorf("expected request id abc-123, got %q", id)
+	}
+	if id := RunID(ctx); id != 42 {
+		t.Errorf("expected run id 42, got %d", id)
+	}
+}
+
+func TestFromRequestInvalid(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set(RequestIDHeader, "bad id\nwith newline")
+	r.Header.Set(RunIDHeader, SignRunID(testRunKey, -1))
+
+	ctx := FromRequest(r, testRunKey)
+	if id := RequestID(ctx); id == "" || id == "bad id\nwith newline" {
+		t.Errorf("expected a new request id, got %q", id)
+	}
+	if id := RunID(ctx); id != 0 {
+		t.Errorf("expected no run id, got %d", id)
+	}
+}
+
+func TestDetachAndSetHeaders(t *testing.T) {
+	ctx, cancel := context.WithCancel(WithRunID(WithRequestID(context.Background(), "req1"), 7))
+	cancel()
+
+	detached := Detach(ctx)
+	if detached.Err() != nil {
+		t.Error("expected detached context not to be cancelled")
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	SetHeaders(detached, r, testRunKey)
+	if h := r.Header.Get(RequestIDHeader); h != "req1" {
+		t.Errorf("expected request id header req1, got %q", h)
+	}
+	if id := RunID(FromRequest(r, testRunKey)); id != 7 {
+		t.Errorf("expected the signed run id 7, got %d", id)
+	}
+}
+
+func TestFromRequestUnsigned(t *testing.T) {
+	tests := []struct {
+		name, header string
+		key          []byte
+	}{
+		{"unsigned", "42", testRunKey},
+		{"forged", "42.00ff", testRunKey},
+		{"other key", SignRunID([]byte("other"), 42), testRunKey},
+		{"no key", SignRunID(testRunKey, 42), nil},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set(RunIDHeader, tt.header)
+		if id := RunID(FromRequest(r, tt.key)); id != 0 {
+			t.Errorf("%s: expected the run id to be ignored, got %d", tt.name, id)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	SetHeaders(WithRunID(context.Background(), 7), r, nil)
+	if h := r.Header.Get(RunIDHeader); h != "" {
+		t.Errorf("expected no run id without a key, got %q", h)
+	}
+}
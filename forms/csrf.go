@@ -0,0 +1,128 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package forms
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrInvalidToken is returned for a missing, forged or expired csrf token.
+	ErrInvalidToken = errors.New("invalid form token")
+	// ErrTooFast is returned when a form is submitted faster than a person could fill it.
+	ErrTooFast = errors.New("form submitted too fast")
+)
+
+// Tokens issues and checks the csrf tokens of forms.  A token is bound to the form
+// name and records when it was issued so forms submitted by bots right after loading
+// the page can be rejected.  The caller also sends the token as a cookie and compares
+// it to the submitted one, so a token cannot be used from another site.  A token is
+// used up by Use, the used tokens are remembered in memory until they expire.
+type Tokens struct {
+	secret  []byte
+	MaxAge  time.Duration // how long a token is valid, defaults to 2 hours
+	MinFill time.Duration // min time between issuing and using a token, defaults to 2 seconds
+	mu      sync.Mutex
+	used    map[string]time.Time // issue time of the used tokens by nonce
+}
+
+// NewTokens returns Tokens signed with the secret.  A random secret is used when it is
+// empty, so tokens do not survive a restart.
+func NewTokens(secret string) (*Tokens, error) {
+	key := []byte(secret)
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+	}
+	return &Tokens{secret: key, MaxAge: 2 * time.Hour, MinFill: 2 * time.Second, used: make(map[string]time.Time)}, nil
+}
+
+func (t *Tokens) sign(form string, data []byte) []byte {
+	mac := hmac.New(sha256.New, t.secret)
+	mac.Write([]byte(form))
+	mac.Write([]byte{0})
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// Issue returns a new token for the form.
+func (t *Tokens) Issue(form string, now time.Time) (string, error) {
+	// the issue time followed by a random nonce
+	data := make([]byte, 24)
+	binary.BigEndian.PutUint64(data, uint64(now.Unix()))
+	if _, err := rand.Read(data[8:]); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data) + "." +
+		base64.RawURLEncoding.EncodeToString(t.sign(form, data)), nil
+}
+
+// Check verifies a token for the form.  A used token is not valid.
+func (t *Tokens) Check(token, form string, now time.Time) error {
+	_, err := t.check(token, form, now)
+	return err
+}
+
+// Use checks the token like Check and uses it up, so it can not be replayed.
+func (t *Tokens) Use(token, form string, now time.Time) error {
+	issued, err := t.check(token, form, now)
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	nonce, _, _ := strings.Cut(token, ".")
+	if _, ok := t.used[nonce]; ok {
+		return ErrInvalidToken
+	}
+	for n, ts := range t.used {
+		if now.Sub(ts) > t.MaxAge {
+			delete(t.used, n)
+		}
+	}
+	t.used[nonce] = issued
+	return nil
+}
+
+// check verifies a token for the form and returns when it was issued.
+func (t *Tokens) check(token, form string, now time.Time) (time.Time, error) {
+	enc, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return time.Time{}, ErrInvalidToken
+	}
+	data, err := base64.RawURLEncoding.DecodeString(enc)
+	if err != nil || len(data) != 24 {
+		return time.Time{}, ErrInvalidToken
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(mac, t.sign(form, data)) {
+		return time.Time{}, ErrInvalidToken
+	}
+
+	issued := time.Unix(int64(binary.BigEndian.Uint64(data)), 0)
+	age := now.Sub(issued)
+	if age > t.MaxAge {
+		return time.Time{}, ErrInvalidToken
+	}
+	t.mu.Lock()
+	_, used := t.used[enc]
+	t.mu.Unlock()
+	if used {
+		return time.Time{}, ErrInvalidToken
+	}
+	if age < t.MinFill {
+		return time.Time{}, ErrTooFast
+	}
+	return issued, nil
+}
@@ -0,0 +1,284 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+// Package forms validates and stores the submissions of forms defined in config or code
+package forms
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/mail"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/cwbriscoe/goweb/query"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// DefaultSchema is the schema with the forms tables.
+const DefaultSchema query.Schema = "forms"
+
+// defaultMaxLen is the max length of a field without a MaxLen.
+const defaultMaxLen = 1000
+
+// FieldType is the kind of value a field accepts.
+type FieldType string
+
+// Field types.
+const (
+	Text     FieldType = "text"
+	TextArea FieldType = "textarea"
+	Email    FieldType = "email"
+	Number   FieldType = "number"
+	Checkbox FieldType = "checkbox"
+	Select   FieldType = "select"
+)
+
+// Field is a single input of a form.
+type Field struct {
+	Name     string    `json:"name" doc:"name of the input"`
+	Label    string    `json:"label" doc:"label in the validation errors"`
+	Type     FieldType `json:"type" doc:"kind of input" default:"text" enum:"text,textarea,email,number,checkbox,select"`
+	Required bool      `json:"required" doc:"the value must not be empty"`
+	MinLen   int       `json:"minLen,omitempty" doc:"min characters of the value"`
+	MaxLen   int       `json:"maxLen,omitempty" doc:"max characters of the value" default:"1000"`
+	Pattern  string    `json:"pattern,omitempty" doc:"regular expression the value must match"`
+	Options  []string  `json:"options,omitempty" doc:"allowed values of a select"`
+	pattern  *regexp.Regexp
+}
+
+// Form is the definition of a form.
+type Form struct {
+	Name     string  `json:"name" doc:"name of the form in /form/<name>"`
+	Fields   []Field `json:"fields" doc:"inputs of the form"`
+	Honeypot string  `json:"honeypot,omitempty" doc:"hidden field that must be left empty" default:"website"`
+	Subject  string  `json:"subject,omitempty" doc:"subject of the notification, defaults to form <name> submitted"`
+	Webhook  string  `json:"webhook,omitempty" doc:"url the submission is posted to as json"`
+	Notify   bool    `json:"notify,omitempty" doc:"send the submission to the Notifier"`
+}
+
+// Submission is a validated and stored form submission.
+type Submission struct {
+	ID        int64             `json:"id"`
+	Form      string            `json:"form"`
+	Data      map[string]string `json:"data"`
+	TrackerID string            `json:"trackerId"`
+	IP        string            `json:"ip"` // anonymized by the caller if configured
+	Created   time.Time         `json:"created"`
+}
+
+// ValidationError lists the invalid fields of a submission.
+type ValidationError struct {
+	Fields map[string]string `json:"fields"` // field name -> reason
+}
+
+func (e *ValidationError) Error() string {
+	names := make([]string, 0, len(e.Fields))
+	for name := range e.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return "invalid form fields: " + strings.Join(names, ", ")
+}
+
+// ErrSpam is returned when the honeypot field is filled in.
+var ErrSpam = errors.New("form submission rejected as spam")
+
+var (
+	qInsertSubmission = query.Query{
+		Name: "insertSubmission",
+		SQL: `
+insert into {schema}.submission (form, data, tracker_id, ip, create_ts)
+values ($1, $2, $3, $4, now())
+returning id, create_ts;`,
+	}
+	qSubmissions = query.Query{
+		Name: "submissions",
+		SQL: `
+select id, form, data, tracker_id, ip, create_ts
+  from {schema}.submission
+ where ($1 = '' or form = $1)
+ order by create_ts desc
+ limit $2;`,
+	}
+)
+
+// Settings contains the settings for a Registry.
+type Settings struct {
+	DB     *pgxpool.Pool
+	Schema string // defaults to "forms"
+}
+
+// Registry holds the form definitions and stores their submissions.
+type Registry struct {
+	sync.RWMutex
+	db     *pgxpool.Pool
+	schema query.Schema
+	forms  map[string]*Form
+}
+
+// NewRegistry returns an empty Registry.
+func NewRegistry(settings *Settings) *Registry {
+	reg := &Registry{
+		db:     settings.DB,
+		schema: DefaultSchema,
+		forms:  make(map[string]*Form),
+	}
+	if settings.Schema != "" {
+		reg.schema = query.Schema(settings.Schema)
+	}
+	return reg
+}
+
+// Register adds or replaces a form definition.
+func (reg *Registry) Register(form Form) error {
+	if form.Name == "" {
+		return errors.New("forms: form name is required")
+	}
+	if form.Honeypot == "" {
+		form.Honeypot = "website"
+	}
+	if form.Subject == "" {
+		form.Subject = "form " + form.Name + " submitted"
+	}
+
+	fields := make([]Field, len(form.Fields))
+	for i, f := range form.Fields {
+		if f.Name == "" || f.Name == form.Honeypot {
+			return fmt.Errorf("forms: %s: invalid field name %q", form.Name, f.Name)
+		}
+		if f.Type == "" {
+			f.Type = Text
+		}
+		if f.MaxLen <= 0 {
+			f.MaxLen = defaultMaxLen
+		}
+		if f.Pattern != "" {
+			re, err := regexp.Compile("^(?:" + f.Pattern + ")$")
+			if err != nil {
+				return fmt.Errorf("forms: %s.%s: %w", form.Name, f.Name, err)
+			}
+			f.pattern = re
+		}
+		fields[i] = f
+	}
+	form.Fields = fields
+
+	reg.Lock()
+	defer reg.Unlock()
+	reg.forms[form.Name] = &form
+	return nil
+}
+
+// Form returns the definition of the named form or nil.
+func (reg *Registry) Form(name string) *Form {
+	reg.RLock()
+	defer reg.RUnlock()
+	return reg.forms[name]
+}
+
+// Validate checks the values against the form and returns the cleaned values of the
+// defined fields.  Values of undefined fields are dropped.
+func (form *Form) Validate(values map[string]string) (map[string]string, error) {
+	if strings.TrimSpace(values[form.Honeypot]) != "" {
+		return nil, ErrSpam
+	}
+
+	data := make(map[string]string, len(form.Fields))
+	invalid := make(map[string]string)
+	for _, f := range form.Fields {
+		val := strings.TrimSpace(values[f.Name])
+		if reason := f.check(val); reason != "" {
+			invalid[f.Name] = reason
+			continue
+		}
+		if val != "" {
+			data[f.Name] = val
+		}
+	}
+
+	if len(invalid) > 0 {
+		return nil, &ValidationError{Fields: invalid}
+	}
+	return data, nil
+}
+
+// check returns why the value is invalid or an empty string.
+func (f *Field) check(val string) string {
+	if val == "" {
+		if f.Required {
+			return "required"
+		}
+		return ""
+	}
+
+	n := utf8.RuneCountInString(val)
+	if n > f.MaxLen {
+		return "too long"
+	}
+	if n < f.MinLen {
+		return "too short"
+	}
+
+	switch f.Type {
+	case Email:
+		addr, err := mail.ParseAddress(val)
+		if err != nil || addr.Address != val {
+			return "invalid email"
+		}
+	case Number:
+		if _, err := strconv.ParseFloat(val, 64); err != nil {
+			return "invalid number"
+		}
+	case Checkbox:
+		if val != "on" && val != "true" && val != "1" {
+			return "invalid checkbox"
+		}
+	case Select:
+		found := false
+		for _, opt := range f.Options {
+			if opt == val {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return "invalid option"
+		}
+	case Text:
+		if strings.ContainsAny(val, "\r\n") {
+			return "invalid text"
+		}
+	}
+
+	if f.pattern != nil && !f.pattern.MatchString(val) {
+		return "invalid format"
+	}
+	return ""
+}
+
+// Save stores a validated submission and fills in its id and creation time.
+func (reg *Registry) Save(ctx context.Context, sub *Submission) error {
+	return reg.schema.QueryRow(ctx, reg.db, qInsertSubmission, sub.Form, sub.Data, sub.TrackerID, sub.IP).Scan(&sub.ID, &sub.Created)
+}
+
+// Submissions returns the newest submissions of the named form, or of all forms when
+// name is empty.
+func (reg *Registry) Submissions(ctx context.Context, name string, limit int) ([]*Submission, error) {
+	rows, err := reg.schema.Query(ctx, reg.db, qSubmissions, name, limit)
+	if err != nil {
+		return nil, err
+	}
+	subs, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (*Submission, error) {
+		sub := &Submission{}
+		err := row.Scan(&sub.ID, &sub.Form, &sub.Data, &sub.TrackerID, &sub.IP, &sub.Created)
+		return sub, err
+	})
+	return subs, query.Wrap(qSubmissions, err)
+}
@@ -0,0 +1,151 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package forms
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func contactForm(t *testing.T) *Form {
+	reg := NewRegistry(&Settings{})
+	err := reg.Register(Form{
+		Name: "contact",
+		Fields: []Field{
+			{Name: "name", Required: true, MaxLen: 10},
+			{Name: "email", Type: Email, Required: true},
+			{Name: "topic", Type: Select, Options: []string{"sales", "support"}},
+			{Name: "zip", Pattern: `[0-9]{5}`},
+			{Name: "message", Type: TextArea, MinLen: 5},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reg.Form("contact")
+}
+
+func TestValidate(t *testing.T) {
+	form := contactForm(t)
+
+	data, err := form.Validate(map[string]string{
+		"name":    " Chris ",
+		"email":   "chris@example.com",
+		"topic":   "sales",
+		"message": "hello\nthere",
+		"extra":   "dropped",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data["name"] != "Chris" {
+		t.Errorf("expected trimmed name, got %q", data["name"])
+	}
+	if _, ok := data["extra"]; ok {
+		t.Error("expected undefined field to be dropped")
+	}
+	if _, ok := data["zip"]; ok {
+		t.Error("expected empty optional field to be left out")
+	}
+}
+
+func TestValidateInvalid(t *testing.T) {
+	form := contactForm(t)
+
+	_, err := form.Validate(map[string]string{
+		"name":    "a name that is too long",
+		"email":   "Chris <chris@example.com>",
+		"topic":   "other",
+		"zip":     "1234",
+		"message": "hi",
+	})
+	var invalid *ValidationError
+	if !errors.As(err, &invalid) {
+		t.Fatalf("expected a validation error, got %v", err)
+	}
+
+	expected := map[string]string{
+		"name":    "too long",
+		"email":   "invalid email",
+		"topic":   "invalid option",
+		"zip":     "invalid format",
+		"message": "too short",
+	}
+	for name, reason := range expected {
+		if invalid.Fields[name] != reason {
+			t.Errorf("expected %s to be %q, got %q", name, reason, invalid.Fields[name])
+		}
+	}
+
+	_, err = form.Validate(map[string]string{"email": "chris@example.com"})
+	if !errors.As(err, &invalid) || invalid.Fields["name"] != "required" {
+		t.Errorf("expected name to be required, got %v", err)
+	}
+}
+
+func TestValidateHoneypot(t *testing.T) {
+	form := contactForm(t)
+
+	_, err := form.Validate(map[string]string{
+		"name":    "Chris",
+		"email":   "chris@example.com",
+		"website": "http://spam.example.com",
+	})
+	if !errors.Is(err, ErrSpam) {
+		t.Errorf("expected spam, got %v", err)
+	}
+}
+
+func TestRegisterInvalid(t *testing.T) {
+	reg := NewRegistry(&Settings{})
+	if err := reg.Register(Form{Name: "bad", Fields: []Field{{Name: "website"}}}); err == nil {
+		t.Error("expected a field named like the honeypot to fail")
+	}
+	if err := reg.Register(Form{Name: "bad", Fields: []Field{{Name: "a", Pattern: "("}}}); err == nil {
+		t.Error("expected an invalid pattern to fail")
+	}
+}
+
+func TestTokens(t *testing.T) {
+	tokens, err := NewTokens("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	token, err := tokens.Issue("contact", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = tokens.Check(token, "contact", now.Add(10*time.Second)); err != nil {
+		t.Errorf("expected valid token, got %v", err)
+	}
+	if err = tokens.Check(token, "contact", now); !errors.Is(err, ErrTooFast) {
+		t.Errorf("expected too fast, got %v", err)
+	}
+	if err = tokens.Check(token, "contact", now.Add(3*time.Hour)); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("expected expired token, got %v", err)
+	}
+	if err = tokens.Check(token, "other", now.Add(10*time.Second)); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("expected token for another form to fail, got %v", err)
+	}
+
+	other, _ := NewTokens("another secret")
+	if err = other.Check(token, "contact", now.Add(10*time.Second)); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("expected token signed with another secret to fail, got %v", err)
+	}
+	if err = tokens.Check("garbage", "contact", now); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("expected garbage token to fail, got %v", err)
+	}
+	if err = tokens.Use(token, "contact", now.Add(10*time.Second)); err != nil {
+		t.Errorf("expected the token to be used, got %v", err)
+	}
+	if err = tokens.Use(token, "contact", now.Add(20*time.Second)); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("expected a used token to fail, got %v", err)
+	}
+	if err = tokens.Check(token, "contact", now.Add(20*time.Second)); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("expected a used token to fail the check, got %v", err)
+	}
+}
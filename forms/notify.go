@@ -0,0 +1,67 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package forms
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/goccy/go-json"
+)
+
+// PostWebhook posts the submission as json to the url.
+func PostWebhook(ctx context.Context, client *http.Client, url string, sub *Submission) error {
+	data, err := json.Marshal(sub)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("forms: webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// Body returns the submission as plain text for notifications, one field per line
+// in the order the fields are defined in the form.
+func (form *Form) Body(sub *Submission) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "form: %s\nid: %d\n\n", sub.Form, sub.ID)
+
+	seen := make(map[string]bool, len(form.Fields))
+	for _, f := range form.Fields {
+		seen[f.Name] = true
+		if val, ok := sub.Data[f.Name]; ok {
+			fmt.Fprintf(&sb, "%s: %s\n", f.Name, val)
+		}
+	}
+
+	// the form can change after a submission was stored
+	var extra []string
+	for name := range sub.Data {
+		if !seen[name] {
+			extra = append(extra, name)
+		}
+	}
+	sort.Strings(extra)
+	for _, name := range extra {
+		fmt.Fprintf(&sb, "%s: %s\n", name, sub.Data[name])
+	}
+	return sb.String()
+}
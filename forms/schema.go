@@ -0,0 +1,63 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package forms
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// CreateSchema will create the forms schema and associated tables needed
+// for this package to run
+func CreateSchema(ctx context.Context, conn *pgx.Conn) error {
+	var sql string
+	var err error
+
+	sql = "drop schema if exists forms cascade;"
+	_, err = conn.Exec(ctx, sql)
+	if err != nil {
+		return err
+	}
+
+	sql = "create schema forms authorization current_role;"
+	_, err = conn.Exec(ctx, sql)
+	if err != nil {
+		return err
+	}
+
+	sql = `
+	CREATE TABLE forms.submission (
+		id int8 NOT NULL GENERATED ALWAYS AS IDENTITY,
+		form varchar NOT NULL,
+		data jsonb NOT NULL,
+		tracker_id varchar NOT NULL,
+		ip varchar NOT NULL,
+		create_ts timestamptz NOT NULL,
+		CONSTRAINT submission_pk PRIMARY KEY (id)
+	);`
+	_, err = conn.Exec(ctx, sql)
+	if err != nil {
+		return err
+	}
+
+	sql = "CREATE INDEX submission_form_idx ON forms.submission (form, create_ts);"
+	_, err = conn.Exec(ctx, sql)
+	if err != nil {
+		return err
+	}
+
+	sql = "grant select, insert on table forms.submission to api;"
+	_, err = conn.Exec(ctx, sql)
+	if err != nil {
+		return err
+	}
+
+	sql = "grant select, delete on table forms.submission to job;"
+	_, err = conn.Exec(ctx, sql)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -3,6 +3,7 @@ module github.com/cwbriscoe/goweb
 go 1.21.1
 
 require (
+	github.com/andybalholm/brotli v1.0.5
 	github.com/cespare/xxhash/v2 v2.2.0
 	github.com/cwbriscoe/goutil v0.0.0-20231004041107-2e0b845e13e2
 	github.com/cwbriscoe/webcache v0.2.0
@@ -10,21 +11,21 @@ require (
 	github.com/golang-jwt/jwt/v4 v4.5.0
 	github.com/jackc/pgx/v5 v5.4.3
 	github.com/julienschmidt/httprouter v1.3.0
+	github.com/klauspost/compress v1.17.0
+	github.com/natefinch/lumberjack/v3 v3.0.0-alpha
+	github.com/rs/zerolog v1.31.0
 	golang.org/x/crypto v0.13.0
 	golang.org/x/exp v0.0.0-20230905200255-921286631fa9
 	golang.org/x/time v0.3.0
 )
 
 require (
-	github.com/andybalholm/brotli v1.0.5 // indirect
 	github.com/jackc/pgpassfile v1.0.0 // indirect
 	github.com/jackc/pgservicefile v0.0.0-20221227161230-091c0ba34f0a // indirect
 	github.com/jackc/puddle/v2 v2.2.1 // indirect
-	github.com/klauspost/compress v1.17.0 // indirect
 	github.com/mattn/go-colorable v0.1.13 // indirect
 	github.com/mattn/go-isatty v0.0.19 // indirect
-	github.com/natefinch/lumberjack/v3 v3.0.0-alpha // indirect
-	github.com/rs/zerolog v1.31.0 // indirect
+	golang.org/x/net v0.10.0 // indirect
 	golang.org/x/sync v0.3.0 // indirect
 	golang.org/x/sys v0.12.0 // indirect
 	golang.org/x/text v0.13.0 // indirect
@@ -0,0 +1,185 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+// Package decode reads and validates the json bodies of requests for the server and
+// auth endpoints
+package decode
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/cwbriscoe/goweb/internal/respond"
+	"github.com/goccy/go-json"
+)
+
+// DefaultMaxBytes is the largest body JSON reads when the context has no limit.
+const DefaultMaxBytes = 1 << 20
+
+// Error is why a body was rejected, written as the error envelope by WriteError.
+type Error struct {
+	Status  int    // 400, or 413 and 415 for the size and content type
+	Code    string // machine readable code, ie: invalid_field
+	Message string // can be shown to users
+	Field   string // json name of the invalid field, dotted for nested fields
+	Err     error  // the cause, if any
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+type maxBytesKey struct{}
+
+// WithMaxBytes returns a copy of ctx with the largest body JSON reads.
+func WithMaxBytes(ctx context.Context, n int64) context.Context {
+	return context.WithValue(ctx, maxBytesKey{}, n)
+}
+
+// MaxBytes returns the largest body JSON reads with ctx.
+func MaxBytes(ctx context.Context) int64 {
+	if n, ok := ctx.Value(maxBytesKey{}).(int64); ok && n > 0 {
+		return n
+	}
+	return DefaultMaxBytes
+}
+
+// JSON decodes the body of r into a new T and validates it with Validate.  The body
+// must be a single json value of Content-Type application/json, of at most MaxBytes of
+// the request context, and must not have fields unknown to T.  The error is an *Error.
+func JSON[T any](r *http.Request) (*T, error) {
+	if !isJSON(r.Header.Get("Content-Type")) {
+		return nil, &Error{Status: http.StatusUnsupportedMediaType, Code: "unsupported_media_type", Message: "the body must be application/json"}
+	}
+
+	// read the body first, the decoder reports read errors as invalid json.
+	limit := MaxBytes(r.Context())
+	data, err := io.ReadAll(http.MaxBytesReader(nil, r.Body, limit))
+	if err != nil {
+		return nil, decodeError(err, nil, limit)
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+
+	v := new(T)
+	if err = dec.Decode(v); err != nil {
+		return nil, decodeError(err, reflect.TypeOf(v), limit)
+	}
+	if err = dec.Decode(&struct{}{}); !errors.Is(err, io.EOF) {
+		if err == nil {
+			err = errors.New("more than one json value")
+		}
+		return nil, decodeError(err, reflect.TypeOf(v), limit)
+	}
+
+	if err := Validate(v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// WriteError writes the error envelope of err, a 400 with the code invalid_json unless
+// it is an *Error.
+func WriteError(w http.ResponseWriter, r *http.Request, err error) {
+	var e *Error
+	if !errors.As(err, &e) {
+		e = &Error{Status: http.StatusBadRequest, Code: "invalid_json", Message: "invalid request body"}
+	}
+	respond.WriteErrorBody(w, r, e.Status, &respond.Error{Code: e.Code, Message: e.Message, Field: e.Field})
+}
+
+// isJSON returns true for application/json and the +json types.
+func isJSON(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || (strings.HasPrefix(mediaType, "application/") && strings.HasSuffix(mediaType, "+json"))
+}
+
+// decodeError returns the *Error of a decoding error.
+func decodeError(err error, typ reflect.Type, limit int64) *Error {
+	var maxErr *http.MaxBytesError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &maxErr):
+		return &Error{Status: http.StatusRequestEntityTooLarge, Code: "body_too_large", Message: "the body is larger than " + strconv.FormatInt(limit, 10) + " bytes", Err: err}
+	case errors.Is(err, io.EOF):
+		return &Error{Status: http.StatusBadRequest, Code: "invalid_json", Message: "the body is empty", Err: err}
+	case errors.As(err, &typeErr):
+		field := jsonPath(typ, typeErr)
+		return &Error{Status: http.StatusBadRequest, Code: "invalid_field", Message: field + " must be " + typeName(typeErr), Field: field, Err: err}
+	}
+
+	if field, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		if name, uerr := strconv.Unquote(field); uerr == nil {
+			field = name
+		}
+		return &Error{Status: http.StatusBadRequest, Code: "unknown_field", Message: "unknown field " + field, Field: field, Err: err}
+	}
+	return &Error{Status: http.StatusBadRequest, Code: "invalid_json", Message: fmt.Sprintf("invalid json: %s", strings.TrimPrefix(err.Error(), "json: ")), Err: err}
+}
+
+// typeName describes the json type of a go type.
+func typeName(e *json.UnmarshalTypeError) string {
+	if e.Type == nil {
+		return "valid"
+	}
+	switch e.Type.Kind() {
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	case reflect.Struct, reflect.Map:
+		return "an object"
+	default:
+		return "a number"
+	}
+}
+
+// jsonPath returns the dotted json path in typ of the field of a type error, which
+// only names the field and its struct.
+func jsonPath(typ reflect.Type, e *json.UnmarshalTypeError) string {
+	if path, ok := findField(typ, e.Struct, e.Field, 0); ok {
+		return path
+	}
+	return e.Field
+}
+
+func findField(typ reflect.Type, structName, field string, depth int) (string, bool) {
+	for typ != nil && (typ.Kind() == reflect.Pointer || typ.Kind() == reflect.Slice || typ.Kind() == reflect.Array || typ.Kind() == reflect.Map) {
+		typ = typ.Elem()
+	}
+	if typ == nil || typ.Kind() != reflect.Struct || depth > 8 {
+		return "", false
+	}
+	if typ.Name() == structName {
+		if sf, ok := typ.FieldByName(field); ok {
+			return fieldName(sf), true
+		}
+	}
+	for i := 0; i < typ.NumField(); i++ {
+		sf := typ.Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+		if path, ok := findField(sf.Type, structName, field, depth+1); ok {
+			return fieldName(sf) + "." + path, true
+		}
+	}
+	return "", false
+}
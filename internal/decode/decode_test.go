@@ -0,0 +1,96 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package decode
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type address struct {
+	City string `json:"city" validate:"required"`
+}
+
+type person struct {
+	Name    string   `json:"name" validate:"required,min=2,max=5"`
+	Email   string   `json:"email" validate:"email"`
+	Age     int      `json:"age" validate:"max=150"`
+	Role    string   `json:"role" validate:"oneof=user admin"`
+	Tags    []string `json:"tags" validate:"max=2"`
+	Address *address `json:"address"`
+}
+
+func TestJSON(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		status      int
+		code        string
+		field       string
+	}{
+		{"ok", "application/json; charset=utf-8", `{"name":"chris","email":"c@example.com","role":"admin"}`, 0, "", ""},
+		{"plus json", "application/merge-patch+json", `{"name":"chris"}`, 0, "", ""},
+		{"no content type", "", `{"name":"chris"}`, 415, "unsupported_media_type", ""},
+		{"form", "application/x-www-form-urlencoded", `name=chris`, 415, "unsupported_media_type", ""},
+		{"empty", "application/json", ``, 400, "invalid_json", ""},
+		{"syntax", "application/json", `{"name":`, 400, "invalid_json", ""},
+		{"trailing", "application/json", `{"name":"chris"} {}`, 400, "invalid_json", ""},
+		{"unknown", "application/json", `{"name":"chris","admin":true}`, 400, "unknown_field", "admin"},
+		{"type", "application/json", `{"name":5}`, 400, "invalid_field", "name"},
+		{"too large", "application/json", `{"name":"` + strings.Repeat("a", DefaultMaxBytes) + `"}`, 413, "body_too_large", ""},
+		{"required", "application/json", `{"email":"c@example.com"}`, 400, "invalid_field", "name"},
+		{"min", "application/json", `{"name":"c"}`, 400, "invalid_field", "name"},
+		{"max runes", "application/json", `{"name":"éééééé"}`, 400, "invalid_field", "name"},
+		{"email", "application/json", `{"name":"chris","email":"Chris <c@example.com>"}`, 400, "invalid_field", "email"},
+		{"number", "application/json", `{"name":"chris","age":200}`, 400, "invalid_field", "age"},
+		{"oneof", "application/json", `{"name":"chris","role":"root"}`, 400, "invalid_field", "role"},
+		{"elements", "application/json", `{"name":"chris","tags":["a","b","c"]}`, 400, "invalid_field", "tags"},
+		{"nested", "application/json", `{"name":"chris","address":{}}`, 400, "invalid_field", "address.city"},
+		{"nested type", "application/json", `{"name":"chris","address":{"city":5}}`, 400, "invalid_field", "address.city"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("POST", "/", strings.NewReader(test.body))
+		if test.contentType != "" {
+			r.Header.Set("Content-Type", test.contentType)
+		}
+		p, err := JSON[person](r)
+		if test.status == 0 {
+			if err != nil || p == nil || p.Name != "chris" {
+				t.Errorf("%s: expected chris, got %v %v", test.name, p, err)
+			}
+			continue
+		}
+
+		var e *Error
+		if !errors.As(err, &e) {
+			t.Errorf("%s: expected an *Error, got %v", test.name, err)
+			continue
+		}
+		if e.Status != test.status || e.Code != test.code || e.Field != test.field {
+			t.Errorf("%s: expected %d %s %q, got %d %s %q: %s", test.name, test.status, test.code, test.field, e.Status, e.Code, e.Field, e.Message)
+		}
+	}
+}
+
+func TestMaxBytes(t *testing.T) {
+	r := httptest.NewRequest("POST", "/", strings.NewReader(`{"name":"chris"}`))
+	r.Header.Set("Content-Type", "application/json")
+	r = r.WithContext(WithMaxBytes(r.Context(), 8))
+
+	var e *Error
+	if _, err := JSON[person](r); !errors.As(err, &e) || e.Code != "body_too_large" {
+		t.Errorf("expected body_too_large, got %v", err)
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	w := httptest.NewRecorder()
+	WriteError(w, httptest.NewRequest("POST", "/", nil), &Error{Status: 400, Code: "invalid_field", Message: "name is required", Field: "name"})
+	want := `{"error":{"code":"invalid_field","message":"name is required","field":"name"}}`
+	if w.Code != 400 || w.Body.String() != want {
+		t.Errorf("expected 400 %s, got %d %s", want, w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package decode
+
+import (
+	"net/http"
+	"net/mail"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Validate checks the fields of the struct v points to against their validate tags,
+// ie: `validate:"required,max=20"`.  Nested structs are checked too.  The rules are:
+//
+//	required  the field is not the zero value
+//	min=N     strings have at least N characters, slices and maps N elements, numbers are >= N
+//	max=N     like min, at most
+//	email     strings are an email address
+//	oneof=a b strings are one of the space separated values
+//
+// Rules other than required are skipped for zero values.  The error is an *Error
+// naming the first invalid field.  Validate panics on an unknown rule.
+func Validate(v any) error {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Pointer {
+		if rv.IsNil() {
+			return nil
+		}
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return nil
+	}
+	return validateStruct(rv, "")
+}
+
+func validateStruct(rv reflect.Value, prefix string) error {
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		sf := rt.Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+		name := prefix + fieldName(sf)
+		fv := rv.Field(i)
+
+		if tag := sf.Tag.Get("validate"); tag != "" && tag != "-" {
+			if err := validateField(fv, name, tag); err != nil {
+				return err
+			}
+		}
+
+		for fv.Kind() == reflect.Pointer && !fv.IsNil() {
+			fv = fv.Elem()
+		}
+		if fv.Kind() == reflect.Struct {
+			if err := validateStruct(fv, name+"."); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// fieldName returns the json name of a field.
+func fieldName(sf reflect.StructField) string {
+	if name, _, _ := strings.Cut(sf.Tag.Get("json"), ","); name != "" && name != "-" {
+		return name
+	}
+	return sf.Name
+}
+
+func invalid(field, message string) *Error {
+	return &Error{Status: http.StatusBadRequest, Code: "invalid_field", Message: field + " " + message, Field: field}
+}
+
+func validateField(fv reflect.Value, field, tag string) error {
+	for _, rule := range strings.Split(tag, ",") {
+		name, arg, _ := strings.Cut(strings.TrimSpace(rule), "=")
+		if name == "required" {
+			if fv.IsZero() {
+				return invalid(field, "is required")
+			}
+			continue
+		}
+		if fv.IsZero() {
+			continue
+		}
+
+		switch name {
+		case "min", "max":
+			n, err := strconv.ParseFloat(arg, 64)
+			if err != nil {
+				panic("decode: invalid " + name + " rule of " + field + ": " + arg)
+			}
+			size, ok := measure(fv)
+			if !ok {
+				panic("decode: " + name + " rule on " + field + " of kind " + fv.Kind().String())
+			}
+			if name == "min" && size < n {
+				return invalid(field, bound(fv, "at least", arg))
+			}
+			if name == "max" && size > n {
+				return invalid(field, bound(fv, "at most", arg))
+			}
+		case "email":
+			if fv.Kind() != reflect.String || !emailValid(fv.String()) {
+				return invalid(field, "must be an email address")
+			}
+		case "oneof":
+			values := strings.Fields(arg)
+			if fv.Kind() != reflect.String || !slices.Contains(values, fv.String()) {
+				return invalid(field, "must be one of "+strings.Join(values, ", "))
+			}
+		default:
+			panic("decode: unknown validate rule " + name + " of " + field)
+		}
+	}
+	return nil
+}
+
+// measure returns the size min and max compare: the characters of a string, the
+// elements of a slice or map or the value of a number.
+func measure(fv reflect.Value) (float64, bool) {
+	switch fv.Kind() {
+	case reflect.String:
+		return float64(utf8.RuneCountInString(fv.String())), true
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return float64(fv.Len()), true
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(fv.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(fv.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return fv.Float(), true
+	}
+	return 0, false
+}
+
+// bound describes a min or max rule, ie: "must have at least 4 characters".
+func bound(fv reflect.Value, limit, arg string) string {
+	switch fv.Kind() {
+	case reflect.String:
+		return "must have " + limit + " " + arg + " characters"
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return "must have " + limit + " " + arg + " elements"
+	}
+	return "must be " + limit + " " + arg
+}
+
+// emailValid returns true if email is a bare address, ie: not "Name <a@b.c>".
+func emailValid(email string) bool {
+	addr, err := mail.ParseAddress(email)
+	return err == nil && addr.Address == email
+}
@@ -0,0 +1,34 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+// Package randid generates the random ids of the sessions and tracking cookies from
+// crypto/rand, so an id can't be guessed from the ids handed out to other visitors
+package randid
+
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+)
+
+// Int63 returns a random id between 1 and 2^63-1 for the int8 columns.  Zero is never
+// returned, it means no id.
+func Int63() (int64, error) {
+	b := make([]byte, 8)
+	for {
+		if _, err := crand.Read(b); err != nil {
+			return 0, err
+		}
+		if id := int64(binary.BigEndian.Uint64(b) >> 1); id != 0 {
+			return id, nil
+		}
+	}
+}
+
+// Hex returns n random bytes as 2n lower case hex characters.
+func Hex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := crand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
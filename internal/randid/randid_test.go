@@ -0,0 +1,33 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package randid
+
+import "testing"
+
+func TestInt63(t *testing.T) {
+	seen := make(map[int64]bool)
+	for i := 0; i < 1000; i++ {
+		id, err := Int63()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id <= 0 || seen[id] {
+			t.Fatalf("expected a new positive id, got %d", id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestHex(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		id, err := Hex(16)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(id) != 32 || seen[id] {
+			t.Fatalf("expected a new 32 character id, got %q", id)
+		}
+		seen[id] = true
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+// Package respond writes the json responses and the error envelope shared by the server
+// and auth endpoints
+package respond
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/cwbriscoe/goweb/correlate"
+	"github.com/goccy/go-json"
+)
+
+// MinCompressSize is the smallest body compressed, smaller ones are not worth the cpu.
+const MinCompressSize = 1024
+
+// Compressor compresses response bodies with the encoding "br" or "gz", the
+// server.Compressor implements it.
+type Compressor interface {
+	Compress(encoding, contentType string, src []byte, static bool) ([]byte, error)
+}
+
+// Error is the body of every error response: {"error": {"code": ..., "message": ...}}.
+// Code is machine readable, ie: invalid_password, the message can be shown to users.
+type Error struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	Field     string `json:"field,omitempty"`     // json name of the invalid field of a request body
+	RequestID string `json:"requestId,omitempty"` // id of the request in the logs
+}
+
+type envelope struct {
+	Error *Error `json:"error"`
+}
+
+// StatusCode returns the code of a status, ie: too_many_requests for 429.
+func StatusCode(status int) string {
+	text := http.StatusText(status)
+	if text == "" {
+		return "status_" + strconv.Itoa(status)
+	}
+	return strings.ReplaceAll(strings.ToLower(strings.ReplaceAll(text, "-", " ")), " ", "_")
+}
+
+// WriteJSON writes v as the json body of the response with the status.  Bodies of at
+// least MinCompressSize are compressed with the preferred encoding of the client when
+// comp is not nil.  r may be nil, the body is then never compressed.  The error is
+// returned when v can't be marshaled, a 500 without a body is written then.
+func WriteJSON(w http.ResponseWriter, r *http.Request, status int, v any, comp Compressor) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return err
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", "application/json")
+	if comp != nil && r != nil && len(data) >= MinCompressSize && h.Get("Content-Encoding") == "" {
+		h.Add("Vary", "Accept-Encoding")
+		if encoding := preferredEncoding(r); encoding != "" {
+			if compressed, err := comp.Compress(encoding, "application/json", data, false); err == nil {
+				data = compressed
+				if encoding == "gz" {
+					encoding = "gzip"
+				}
+				h.Set("Content-Encoding", encoding)
+			}
+		}
+	}
+
+	w.WriteHeader(status)
+	_, _ = w.Write(data)
+	return nil
+}
+
+// WriteError writes the error envelope with the status.  The request id is the one the
+// server echoes in the response headers, else the one in the context of r, which may be
+// nil.  An empty code defaults to the code of the status.
+func WriteError(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	WriteErrorBody(w, r, status, &Error{Code: code, Message: message})
+}
+
+// WriteErrorBody writes e as the error envelope with the status, see WriteError.  The
+// request id of e is set when it is empty.
+func WriteErrorBody(w http.ResponseWriter, r *http.Request, status int, e *Error) {
+	body := *e
+	if body.Code == "" {
+		body.Code = StatusCode(status)
+	}
+	if body.RequestID == "" {
+		body.RequestID = w.Header().Get(correlate.RequestIDHeader)
+	}
+	if body.RequestID == "" && r != nil {
+		body.RequestID = correlate.RequestID(r.Context())
+	}
+	_ = WriteJSON(w, nil, status, &envelope{Error: &body}, nil)
+}
+
+// preferredEncoding returns the encoding of the Compressor accepted by the client, "br"
+// or "gz", or "" when it accepts neither.
+func preferredEncoding(r *http.Request) string {
+	var br, gzip bool
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if q, err := strconv.ParseFloat(v, 64); err == nil && q <= 0 {
+				continue
+			}
+		}
+		switch strings.ToLower(name) {
+		case "br":
+			br = true
+		case "gzip":
+			gzip = true
+		}
+	}
+
+	switch {
+	case br:
+		return "br"
+	case gzip:
+		return "gz"
+	}
+	return ""
+}
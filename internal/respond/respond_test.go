@@ -0,0 +1,97 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package respond
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/cwbriscoe/goweb/correlate"
+	"github.com/goccy/go-json"
+)
+
+type upper struct{}
+
+func (upper) Compress(encoding, _ string, src []byte, _ bool) ([]byte, error) {
+	return append([]byte(encoding+":"), bytes.ToUpper(src)...), nil
+}
+
+func TestStatusCode(t *testing.T) {
+	tests := map[int]string{
+		http.StatusTooManyRequests:      "too_many_requests",
+		http.StatusBadRequest:           "bad_request",
+		http.StatusNonAuthoritativeInfo: "non_authoritative_information",
+		499:                             "status_499",
+	}
+	for status, want := range tests {
+		if got := StatusCode(status); got != want {
+			t.Errorf("%d: expected %s, got %s", status, want, got)
+		}
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	r := httptest.NewRequest("POST", "/auth/register/", nil)
+	r = r.WithContext(correlate.WithRequestID(context.Background(), "req-1"))
+	w := httptest.NewRecorder()
+	WriteError(w, r, http.StatusConflict, "user_exists", "user name already exists")
+
+	if w.Code != http.StatusConflict || w.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("got status %d and type %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	var body envelope
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	want := Error{Code: "user_exists", Message: "user name already exists", RequestID: "req-1"}
+	if body.Error == nil || *body.Error != want {
+		t.Errorf("expected %+v, got %s", want, w.Body.String())
+	}
+
+	// the id echoed by the server wins and the code defaults to the one of the status.
+	w = httptest.NewRecorder()
+	w.Header().Set(correlate.RequestIDHeader, "req-2")
+	WriteError(w, nil, http.StatusTooManyRequests, "", "slow down")
+	if got := w.Body.String(); got != `{"error":{"code":"too_many_requests","message":"slow down","requestId":"req-2"}}` {
+		t.Errorf("got %s", got)
+	}
+}
+
+func TestWriteJSONCompression(t *testing.T) {
+	large := map[string]string{"text": strings.Repeat("a", MinCompressSize)}
+	tests := []struct {
+		accept   string
+		v        any
+		encoding string
+	}{
+		{"gzip, deflate, br", large, "br"},
+		{"gzip", large, "gzip"},
+		{"br;q=0, gzip", large, "gzip"},
+		{"identity", large, ""},
+		{"br", map[string]string{"text": "small"}, ""},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept-Encoding", test.accept)
+		w := httptest.NewRecorder()
+		if err := WriteJSON(w, r, http.StatusOK, test.v, upper{}); err != nil {
+			t.Fatal(err)
+		}
+		if got := w.Header().Get("Content-Encoding"); got != test.encoding {
+			t.Errorf("%s: expected encoding %q, got %q", test.accept, test.encoding, got)
+		}
+		compressed := strings.HasPrefix(w.Body.String(), "br:") || strings.HasPrefix(w.Body.String(), "gz:")
+		if compressed != (test.encoding != "") {
+			t.Errorf("%s: body compressed %v", test.accept, compressed)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	if err := WriteJSON(w, nil, http.StatusOK, make(chan int), nil); err == nil || w.Code != http.StatusInternalServerError {
+		t.Errorf("expected a marshal error and a 500, got %v and %d", err, w.Code)
+	}
+}
@@ -0,0 +1,298 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package job
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/cwbriscoe/goweb/storage"
+)
+
+// BackupOptions contains the settings for Backup.
+type BackupOptions struct {
+	Dir         string      `json:"dir"`         // directory the backups are written to
+	Keep        int         `json:"keep"`        // number of backups to keep, defaults to 7
+	Upload      Uploader    `json:"-"`           // optional, remote storage the backups are copied to
+	S3          *storage.S3 `json:"s3"`          // used as the Uploader when Upload is nil
+	S3SecretRef string      `json:"s3SecretRef"` // reference of the s3 secret key in the Secrets of the manager, used by the backup job
+	Prefix      string      `json:"prefix"`      // backup file name prefix, defaults to app_env
+}
+
+// RestoreOptions contains the settings of the restore job.
+type RestoreOptions struct {
+	File   string `json:"file"`   // backup to restore, defaults to the newest backup in Dir
+	Dir    string `json:"dir"`    // directory of the backups, defaults to the backup dir of the backup job
+	Prefix string `json:"prefix"` // backup file name prefix, defaults to app_env
+}
+
+// Uploader copies a file to remote storage.
+type Uploader interface {
+	Upload(ctx context.Context, name string, file *os.File, size int64, sha256 string) error
+}
+
+// ErrNoBackup is returned by the restore job when there is no backup to restore.
+var ErrNoBackup = errors.New("no backup to restore")
+
+// ErrPlainSecret is returned by the backup job when the backup parm contains the s3
+// secret key, the parms are stored in the clear.
+var ErrPlainSecret = errors.New("the s3 secret key must be a reference to the secrets, set s3SecretRef")
+
+// ErrChecksumMismatch is returned when a backup file does not match its checksum.
+var ErrChecksumMismatch = errors.New("backup checksum mismatch")
+
+const backupExt = ".dump"
+
+// pgArgs returns the connection arguments for pg_dump/pg_restore.  The password is
+// passed through the environment so it is never logged.
+func (e *Entry) pgArgs() ([]string, []string) {
+	cfg := e.DB.Config().ConnConfig
+	args := []string{"--host=" + cfg.Host, "--port=" + strconv.Itoa(int(cfg.Port)), "--username=" + cfg.User, "--dbname=" + cfg.Database}
+	return args, []string{"PGPASSWORD=" + cfg.Password}
+}
+
+// Backup dumps the database with pg_dump in the custom format, writes a sha256 checksum
+// next to it, verifies the archive with pg_restore --list, uploads it if configured and
+// deletes the oldest backups past opts.Keep.  It returns the path of the backup.
+func (e *Entry) Backup(opts *BackupOptions) (string, error) {
+	prefix := opts.Prefix
+	if prefix == "" {
+		prefix = e.App + "_" + e.Env
+	}
+	if err := os.MkdirAll(opts.Dir, 0o700); err != nil {
+		return "", err
+	}
+
+	file := filepath.Join(opts.Dir, prefix+"_"+e.Now().Format("20060102150405")+backupExt)
+	conn, env := e.pgArgs()
+
+	// the arguments are passed as is, the paths can contain spaces.
+	if err := e.runArgs(e.Ctx, append([]string{"pg_dump", "--format=custom", "--file=" + file}, conn...), env); err != nil {
+		return "", err
+	}
+
+	sum, err := fileChecksum(file)
+	if err != nil {
+		return "", err
+	}
+	if err = os.WriteFile(file+".sha256", []byte(sum+"  "+filepath.Base(file)+"\n"), 0o600); err != nil {
+		return "", err
+	}
+
+	// make sure the archive can be read back before trusting it.
+	if err = e.runArgs(e.Ctx, []string{"pg_restore", "--list", file}, nil); err != nil {
+		return "", err
+	}
+
+	uploader := opts.Upload
+	if uploader == nil && opts.S3 != nil {
+		uploader = opts.S3
+	}
+	if uploader != nil {
+		if err = uploadFile(e.Ctx, uploader, file, sum); err != nil {
+			return "", err
+		}
+		e.Log.Info().Msgf("backup %s uploaded", filepath.Base(file))
+	}
+
+	if err = e.rotateBackups(opts.Dir, prefix, opts.Keep); err != nil {
+		return "", err
+	}
+
+	return file, nil
+}
+
+// Restore verifies the checksum of the backup and restores it with pg_restore,
+// dropping the existing objects first.
+func (e *Entry) Restore(file string) error {
+	if err := VerifyBackup(file); err != nil {
+		return err
+	}
+	conn, env := e.pgArgs()
+	args := append([]string{"pg_restore", "--clean", "--if-exists", "--no-owner"}, conn...)
+	return e.runArgs(e.Ctx, append(args, file), env)
+}
+
+// VerifyBackup checks the backup against the checksum file written next to it.
+func VerifyBackup(file string) error {
+	data, err := os.ReadFile(file + ".sha256")
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return ErrChecksumMismatch
+	}
+
+	sum, err := fileChecksum(file)
+	if err != nil {
+		return err
+	}
+	if sum != fields[0] {
+		return fmt.Errorf("%w: %s", ErrChecksumMismatch, file)
+	}
+	return nil
+}
+
+func fileChecksum(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func uploadFile(ctx context.Context, uploader Uploader, file, sum string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	return uploader.Upload(ctx, filepath.Base(file), f, info.Size(), sum)
+}
+
+// rotateBackups deletes the oldest backups with the prefix so only keep remain.
+func (e *Entry) rotateBackups(dir, prefix string, keep int) error {
+	if keep <= 0 {
+		keep = 7
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, prefix+"_*"+backupExt))
+	if err != nil {
+		return err
+	}
+	if len(files) <= keep {
+		return nil
+	}
+
+	// the timestamp in the name sorts oldest first.
+	sort.Strings(files)
+	for _, file := range files[:len(files)-keep] {
+		e.Log.Info().Msgf("deleting old backup %s", filepath.Base(file))
+		if err = os.Remove(file); err != nil {
+			return err
+		}
+		if err = os.Remove(file + ".sha256"); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// backup is the built in backup job.  The options are read from the "backup" job parm.
+// The notifier is alerted when the backup fails.
+func (m *Manager) backup(e *Entry) error {
+	opts := &BackupOptions{}
+	if err := e.GetParm("backup", 0, opts); err != nil {
+		return err
+	}
+	if opts.Dir == "" {
+		opts.Dir = filepath.Join(e.RootDir, "backup")
+	}
+	if opts.S3 != nil {
+		if err := m.resolveS3Secret(e, opts); err != nil {
+			return err
+		}
+	}
+
+	file, err := e.Backup(opts)
+	if err != nil {
+		if m.notifier != nil {
+			subject := fmt.Sprintf("[%s] database backup failed", e.App)
+			if err2 := m.notifier.Notify(e.Ctx, subject, err.Error()); err2 != nil {
+				e.Log.Err(err2).Msg("backup: error sending notification")
+			}
+		}
+		return err
+	}
+
+	e.Log.Info().Msgf("backup %s completed", file)
+	return nil
+}
+
+// resolveS3Secret sets the secret key of the s3 settings from the Secrets of the manager.
+func (m *Manager) resolveS3Secret(e *Entry, opts *BackupOptions) error {
+	if opts.S3.SecretKey != "" {
+		return ErrPlainSecret
+	}
+	if opts.S3SecretRef == "" {
+		return nil
+	}
+	if m.secrets == nil {
+		return errors.New("backup: s3SecretRef is set but the manager has no Secrets")
+	}
+	secret, err := m.secrets.Secret(e.Ctx, opts.S3SecretRef)
+	if err != nil {
+		return fmt.Errorf("backup: s3 secret key: %w", err)
+	}
+	opts.S3.SecretKey = secret
+	return nil
+}
+
+// restore is the built in restore job.  The options are read from the "restore" job
+// parm, the newest backup is restored when it names no file.  It should be an exclusive
+// job so nothing else runs while the database is replaced.
+func (*Manager) restore(e *Entry) error {
+	opts := &RestoreOptions{}
+	if err := e.GetParm("restore", 0, opts); err != nil {
+		return err
+	}
+	file := opts.File
+	if file == "" {
+		var err error
+		if file, err = e.newestBackup(opts); err != nil {
+			return err
+		}
+	}
+
+	e.Log.Info().Msgf("restoring backup %s", file)
+	if err := e.Restore(file); err != nil {
+		return err
+	}
+	e.Log.Info().Msgf("backup %s restored", file)
+	return nil
+}
+
+// newestBackup returns the newest backup in the directory of the options.
+func (e *Entry) newestBackup(opts *RestoreOptions) (string, error) {
+	dir, prefix := opts.Dir, opts.Prefix
+	if dir == "" {
+		dir = filepath.Join(e.RootDir, "backup")
+	}
+	if prefix == "" {
+		prefix = e.App + "_" + e.Env
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, prefix+"_*"+backupExt))
+	if err != nil {
+		return "", err
+	}
+	if len(files) == 0 {
+		return "", fmt.Errorf("%w in %s", ErrNoBackup, dir)
+	}
+	// the timestamp in the name sorts oldest first.
+	sort.Strings(files)
+	return files[len(files)-1], nil
+}
@@ -0,0 +1,76 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package job
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/cwbriscoe/goweb/storage"
+)
+
+func TestSplitCmd(t *testing.T) {
+	tests := []struct {
+		cmd  string
+		args []string
+	}{
+		{"pg_restore --list file.dump", []string{"pg_restore", "--list", "file.dump"}},
+		{`cp "my file.txt" 'other dir/'`, []string{"cp", "my file.txt", "other dir/"}},
+		{`echo a\ b "c \"d\"" 'e\f' ""`, []string{"echo", "a b", `c "d"`, `e\f`, ""}},
+		{"  tabs\tand  spaces ", []string{"tabs", "and", "spaces"}},
+	}
+	for _, tt := range tests {
+		args, err := splitCmd(tt.cmd)
+		if err != nil || !slices.Equal(args, tt.args) {
+			t.Errorf("%s: expected %q, got %q %v", tt.cmd, tt.args, args, err)
+		}
+	}
+
+	for _, cmd := range []string{"", "  ", `echo "open`, "echo 'open", `echo a\`} {
+		if _, err := splitCmd(cmd); !errors.Is(err, ErrBadCommand) {
+			t.Errorf("%q: expected ErrBadCommand, got %v", cmd, err)
+		}
+	}
+}
+
+func TestResolveS3Secret(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "secrets.json")
+	if err := os.WriteFile(file, []byte(`{"s3":"s3cret"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	m := &Manager{secrets: SecretsFile(file)}
+	e := &Entry{Ctx: context.Background()}
+
+	opts := &BackupOptions{S3: &storage.S3{SecretKey: "plain"}}
+	if err := m.resolveS3Secret(e, opts); !errors.Is(err, ErrPlainSecret) {
+		t.Errorf("expected ErrPlainSecret, got %v", err)
+	}
+
+	opts = &BackupOptions{S3: &storage.S3{}, S3SecretRef: "s3"}
+	if err := m.resolveS3Secret(e, opts); err != nil || opts.S3.SecretKey != "s3cret" {
+		t.Errorf("expected the secret key from the secrets, got %q %v", opts.S3.SecretKey, err)
+	}
+}
+
+func TestNewestBackup(t *testing.T) {
+	dir := t.TempDir()
+	e := &Entry{App: "app", Env: "prod"}
+	opts := &RestoreOptions{Dir: dir}
+	if _, err := e.newestBackup(opts); !errors.Is(err, ErrNoBackup) {
+		t.Errorf("expected ErrNoBackup, got %v", err)
+	}
+
+	for _, name := range []string{"app_prod_20230101000000.dump", "app_prod_20230301000000.dump", "app_test_20230401000000.dump"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	file, err := e.newestBackup(opts)
+	if err != nil || filepath.Base(file) != "app_prod_20230301000000.dump" {
+		t.Errorf("expected the newest backup of the env, got %s %v", file, err)
+	}
+}
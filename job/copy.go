@@ -0,0 +1,94 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package job
+
+import (
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// defaultBatchSize is the number of rows buffered by a BatchInserter when no size is given.
+const defaultBatchSize = 5000
+
+// CopyFrom bulk loads the rows into the table with the postgres COPY protocol and logs
+// the rows copied and runtime.  table may be schema qualified, ie: "data.items".
+func (e *Entry) CopyFrom(table string, columns []string, rows [][]any) (int64, error) {
+	start := time.Now()
+
+	cnt, err := e.DB.CopyFrom(e.Ctx, pgx.Identifier(strings.Split(table, ".")), columns, pgx.CopyFromRows(rows))
+	if err != nil {
+		e.Log.Err(err).Msgf("failed to copy rows into %s", table)
+		return cnt, err
+	}
+	e.Counter(CounterRows).Add(cnt)
+
+	e.Log.Info().Msgf("copy into %s executed successfully: time: %s, rows: %d", table, time.Since(start).String(), cnt)
+
+	return cnt, nil
+}
+
+// BatchInserter buffers rows and copies them into a table each time the buffer fills.
+// It is not safe for concurrent use.
+type BatchInserter struct {
+	entry   *Entry
+	table   string
+	columns []string
+	size    int
+	rows    [][]any
+	total   int64
+	start   time.Time
+}
+
+// NewBatchInserter returns a BatchInserter that flushes every size rows.  Close must
+// be called to flush the remaining rows.
+func (e *Entry) NewBatchInserter(table string, columns []string, size int) *BatchInserter {
+	if size <= 0 {
+		size = defaultBatchSize
+	}
+	return &BatchInserter{
+		entry:   e,
+		table:   table,
+		columns: columns,
+		size:    size,
+		rows:    make([][]any, 0, size),
+		start:   time.Now(),
+	}
+}
+
+// Add buffers a row, flushing the buffer if it is full.  The values must be in the
+// same order as the columns.
+func (b *BatchInserter) Add(values ...any) error {
+	b.rows = append(b.rows, values)
+	if len(b.rows) >= b.size {
+		return b.Flush()
+	}
+	return nil
+}
+
+// Flush copies the buffered rows into the table.
+func (b *BatchInserter) Flush() error {
+	if len(b.rows) == 0 {
+		return nil
+	}
+
+	cnt, err := b.entry.DB.CopyFrom(b.entry.Ctx, pgx.Identifier(strings.Split(b.table, ".")), b.columns, pgx.CopyFromRows(b.rows))
+	if err != nil {
+		b.entry.Log.Err(err).Msgf("failed to flush %d rows into %s", len(b.rows), b.table)
+		return err
+	}
+
+	b.total += cnt
+	b.entry.Counter(CounterRows).Add(cnt)
+	b.rows = b.rows[:0]
+	b.entry.Log.Info().Msgf("%s: flushed %d rows, total: %d, elapsed: %s", b.table, cnt, b.total, time.Since(b.start).String())
+
+	return nil
+}
+
+// Close flushes the remaining rows and returns the total number of rows inserted.
+func (b *BatchInserter) Close() (int64, error) {
+	err := b.Flush()
+	return b.total, err
+}
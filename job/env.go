@@ -0,0 +1,162 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package job
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/cwbriscoe/goweb/query"
+	"github.com/goccy/go-json"
+	"github.com/jackc/pgx/v5"
+)
+
+// Secrets resolves the secret references of the job environments, ie: from a vault or
+// a secrets file.
+type Secrets interface {
+	Secret(ctx context.Context, ref string) (string, error)
+}
+
+// SecretsFile returns the Secrets of the string values of a json object file, ie: the
+// secrets file of the server.  The file is read for every run so secrets can be
+// rotated without restarting the manager.
+func SecretsFile(path string) Secrets {
+	return secretsFile(path)
+}
+
+type secretsFile string
+
+func (f secretsFile) Secret(_ context.Context, ref string) (string, error) {
+	data, err := os.ReadFile(string(f))
+	if err != nil {
+		return "", err
+	}
+	var values map[string]any
+	if err = json.Unmarshal(data, &values); err != nil {
+		return "", fmt.Errorf("secrets file %s: %w", string(f), err)
+	}
+	value, ok := values[ref].(string)
+	if !ok {
+		return "", fmt.Errorf("secret %s not found in %s", ref, string(f))
+	}
+	return value, nil
+}
+
+// EnvVar is an environment variable of a job.  The value of a secret is a reference
+// resolved by the Secrets of the manager when a run starts.
+type EnvVar struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Secret bool   `json:"secret"`
+}
+
+var envName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+var (
+	qGetEnv = query.Query{
+		Name: "getEnv",
+		SQL:  "select name, value, secret from {schema}.env where job_id = $1 order by name;",
+	}
+	qSetEnv = query.Query{
+		Name: "setEnv",
+		SQL: `
+insert into {schema}.env (job_id, name, value, secret)
+values ($1, $2, $3, $4)
+on conflict (job_id, name) do update set value = $3, secret = $4;`,
+	}
+	qUnsetEnv = query.Query{
+		Name: "unsetEnv",
+		SQL:  "delete from {schema}.env where job_id = $1 and name = $2;",
+	}
+)
+
+// Env returns the environment variables of the job, secrets are listed by reference.
+func (m *Manager) Env(ctx context.Context, jobID int) ([]EnvVar, error) {
+	rows, err := m.schema.Query(ctx, m.db, qGetEnv, jobID)
+	if err != nil {
+		return nil, err
+	}
+
+	vars, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (EnvVar, error) {
+		var v EnvVar
+		err := row.Scan(&v.Name, &v.Value, &v.Secret)
+		return v, err
+	})
+	if err != nil {
+		return nil, query.Wrap(qGetEnv, err)
+	}
+
+	return vars, nil
+}
+
+// SetEnv sets an environment variable of the job.  If secret is true, value is the
+// reference of the secret instead of the secret itself.
+func (m *Manager) SetEnv(ctx context.Context, jobID int, name, value string, secret bool) error {
+	if !envName.MatchString(name) {
+		return fmt.Errorf("invalid environment variable name %q", name)
+	}
+	_, err := m.schema.Exec(ctx, m.db, qSetEnv, jobID, name, value, secret)
+	return err
+}
+
+// UnsetEnv removes an environment variable of the job.
+func (m *Manager) UnsetEnv(ctx context.Context, jobID int, name string) error {
+	_, err := m.schema.Exec(ctx, m.db, qUnsetEnv, jobID, name)
+	return err
+}
+
+// loadEnv resolves the environment of the entry before it runs.
+func (m *Manager) loadEnv(entry *Entry) error {
+	vars, err := m.Env(entry.Ctx, entry.JobID)
+	if err != nil {
+		return err
+	}
+	entry.env, err = resolveEnv(entry.Ctx, vars, m.secrets)
+	return err
+}
+
+// resolveEnv returns the environment of vars as name=value pairs.
+func resolveEnv(ctx context.Context, vars []EnvVar, secrets Secrets) ([]string, error) {
+	env := make([]string, 0, len(vars))
+	for _, v := range vars {
+		value := v.Value
+		if v.Secret {
+			if secrets == nil {
+				return nil, fmt.Errorf("environment variable %s is a secret but the manager has no Secrets", v.Name)
+			}
+			var err error
+			if value, err = secrets.Secret(ctx, v.Value); err != nil {
+				return nil, fmt.Errorf("environment variable %s: %w", v.Name, err)
+			}
+		}
+		env = append(env, v.Name+"="+value)
+	}
+	return env, nil
+}
+
+// Getenv returns the value of the environment variable of the job, empty if it is not
+// set.  The environment of the process is not searched.
+func (e *Entry) Getenv(name string) string {
+	value, _ := e.LookupEnv(name)
+	return value
+}
+
+// LookupEnv returns the value of the environment variable of the job and whether it is
+// set.  The environment of the process is not searched.
+func (e *Entry) LookupEnv(name string) (string, bool) {
+	for _, kv := range e.env {
+		if k, v, _ := strings.Cut(kv, "="); k == name {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// Environ returns the environment of the job as name=value pairs, it is added to the
+// environment of the commands run with RunCmd.
+func (e *Entry) Environ() []string {
+	return append([]string(nil), e.env...)
+}
@@ -0,0 +1,49 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package job
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestResolveEnv(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "secrets.json")
+	if err := os.WriteFile(file, []byte(`{"ftpPass":"s3cret","port":21}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	secrets := SecretsFile(file)
+	ctx := context.Background()
+
+	vars := []EnvVar{
+		{Name: "FTP_USER", Value: "loader"},
+		{Name: "FTP_PASS", Value: "ftpPass", Secret: true},
+	}
+	env, err := resolveEnv(ctx, vars, secrets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(env, []string{"FTP_USER=loader", "FTP_PASS=s3cret"}) {
+		t.Errorf("unexpected env: %v", env)
+	}
+
+	e := &Entry{env: env}
+	if v := e.Getenv("FTP_PASS"); v != "s3cret" {
+		t.Errorf("Getenv(FTP_PASS) = %q", v)
+	}
+	if _, ok := e.LookupEnv("HOME"); ok {
+		t.Error("the process environment is not part of the job environment")
+	}
+
+	for _, ref := range []string{"missing", "port"} {
+		if _, err = resolveEnv(ctx, []EnvVar{{Name: "X", Value: ref, Secret: true}}, secrets); err == nil {
+			t.Errorf("expected an error for secret %s", ref)
+		}
+	}
+	if _, err = resolveEnv(ctx, vars, nil); err == nil {
+		t.Error("expected an error for a secret without Secrets")
+	}
+}
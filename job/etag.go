@@ -3,25 +3,74 @@
 package job
 
 import (
+	"context"
+	"errors"
+	"net/http"
 	"net/url"
 	"strings"
+	"time"
 
 	"github.com/cespare/xxhash/v2"
+	"github.com/cwbriscoe/goutil/net"
 	"github.com/cwbriscoe/goutil/str"
+	"github.com/cwbriscoe/goweb/query"
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
 )
 
-// GetEtag retrieve the last known etag for the provided url.
-func (e *Entry) GetEtag(nurl *url.URL) (string, error) {
-	path := nurl.RequestURI()
-	id := int64(xxhash.Sum64String(path))
+// EtagStats are the conditional fetch statistics of a url.
+type EtagStats struct {
+	URL        string    `json:"url"`
+	Hits       int64     `json:"hits"`       // 304 responses
+	Misses     int64     `json:"misses"`     // full responses
+	SavedBytes int64     `json:"savedBytes"` // estimated bytes not downloaded thanks to 304s
+	LastCheck  time.Time `json:"lastCheck"`
+}
 
-	sql := "select etag from job.etag where id = $1;"
+var (
+	qGetEtag = query.Query{
+		Name: "getEtag",
+		SQL:  "select etag from {schema}.etag where id = $1;",
+	}
+	qSetEtag = query.Query{
+		Name: "setEtag",
+		SQL: `
+insert into {schema}.etag (id, etag, last_update_ts, url, hits, misses, size, saved_bytes, last_check_ts)
+values ($1, $2, now(), $3, 0, 0, 0, 0, now())
+on conflict (id) do update set etag = $2, last_update_ts = now(), url = $3, last_check_ts = now();`,
+	}
+	qEtagHit = query.Query{
+		Name: "etagHit",
+		SQL:  "update {schema}.etag set hits = hits + 1, saved_bytes = saved_bytes + size, last_check_ts = now() where id = $1;",
+	}
+	qEtagMiss = query.Query{
+		Name: "etagMiss",
+		SQL:  "update {schema}.etag set misses = misses + 1, size = $2, last_check_ts = now() where id = $1;",
+	}
+	qPurgeEtags = query.Query{
+		Name: "purgeEtags",
+		SQL:  "delete from {schema}.etag where last_check_ts < $1;",
+	}
+	qTopEtags = query.Query{
+		Name: "topEtags",
+		SQL: `
+select url, hits, misses, saved_bytes, last_check_ts
+  from {schema}.etag
+ order by saved_bytes desc, hits desc
+ limit $1;`,
+	}
+)
 
+func etagID(nurl *url.URL) int64 {
+	return int64(xxhash.Sum64String(nurl.RequestURI()))
+}
+
+// GetEtag retrieve the last known etag for the provided url.
+func (e *Entry) GetEtag(nurl *url.URL) (string, error) {
 	var etag string
-	err := e.DB.QueryRow(e.Ctx, sql, id).Scan(&etag)
+	err := e.dbSchema().QueryRow(e.Ctx, e.DB, qGetEtag, etagID(nurl)).Scan(&etag)
 
-	if err != nil && err != pgx.ErrNoRows {
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
 		return "", err
 	}
 
@@ -34,13 +83,96 @@ func (e *Entry) SetEtag(nurl *url.URL, etag string) error {
 		return nil
 	}
 
-	path := nurl.RequestURI()
-	id := int64(xxhash.Sum64String(path))
-
 	etag = str.TrimQuotes(strings.TrimPrefix(etag, "W/"))
 
-	sql := "insert into job.etag values ($1, $2, now()) on conflict (id) do update set etag = $2, last_update_ts = now();"
-	_, err := e.DB.Exec(e.Ctx, sql, id, etag)
+	_, err := e.dbSchema().Exec(e.Ctx, e.DB, qSetEtag, etagID(nurl), etag, nurl.String())
+
+	return err
+}
+
+// RecordFetch updates the hit/miss statistics of a conditional fetch of the provided
+// url.  A 304 is a hit, any other successful response is a miss of the given size,
+// added to the bytes counter of the run.
+func (e *Entry) RecordFetch(nurl *url.URL, status, size int) error {
+	var err error
+	switch {
+	case status == http.StatusNotModified:
+		_, err = e.dbSchema().Exec(e.Ctx, e.DB, qEtagHit, etagID(nurl))
+	case status >= 200 && status < 300:
+		e.Counter(CounterBytes).Add(int64(size))
+		_, err = e.dbSchema().Exec(e.Ctx, e.DB, qEtagMiss, etagID(nurl), size)
+	}
+	return err
+}
+
+// Fetch gets the url with the last known etag in If-None-Match.  The fetch is recorded
+// with RecordFetch and the etag of a full response is saved for the next one.  The body
+// is empty when the response is a 304.
+func (e *Entry) Fetch(nurl *url.URL) (*http.Response, []byte, error) {
+	etag, err := e.GetEtag(nurl)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	client := &net.Client{}
+	client.SetTimeout(30 * time.Second)
+	if etag != "" {
+		client.SetHeader("If-None-Match", `"`+etag+`"`)
+	}
 
+	resp, body, err := client.Fetch(nurl.String())
+	if err != nil {
+		return resp, nil, err
+	}
+	// the etag is saved first so the miss of the first fetch is counted.
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		if err = e.SetEtag(nurl, resp.Header.Get("ETag")); err != nil {
+			return resp, nil, err
+		}
+	}
+	if err = e.RecordFetch(nurl, resp.StatusCode, len(body)); err != nil {
+		return resp, nil, err
+	}
+	return resp, body, nil
+}
+
+// PurgeEtags deletes the etags of urls that have not been checked for longer than
+// olderThan and returns the number deleted.
+func (e *Entry) PurgeEtags(olderThan time.Duration) (int64, error) {
+	tag, err := e.dbSchema().Exec(e.Ctx, e.DB, qPurgeEtags, e.Now().Add(-olderThan))
+	if err != nil {
+		return 0, err
+	}
+	e.Log.Info().Msgf("purged %d etags older than %s", tag.RowsAffected(), olderThan)
+	return tag.RowsAffected(), nil
+}
+
+// purgeEtags is the built in etag retention job.  The retention in days is read from
+// the "days" job parm and defaults to 90.
+func (*Manager) purgeEtags(e *Entry) error {
+	days := 90
+	if err := e.GetParm("days", 0, &days); err != nil {
+		return err
+	}
+	if days <= 0 {
+		days = 90
+	}
+	_, err := e.PurgeEtags(time.Duration(days) * 24 * time.Hour)
 	return err
 }
+
+// TopEtags returns the urls that saved the most bytes thanks to 304 responses from the
+// job tables in schema, DefaultSchema when empty.
+func TopEtags(ctx context.Context, db *pgxpool.Pool, schema string, limit int) ([]EtagStats, error) {
+	rows, err := schemaOf(schema).Query(ctx, db, qTopEtags, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	stats, err := pgx.CollectRows(rows, pgx.RowToStructByPos[EtagStats])
+	if err != nil {
+		return nil, query.Wrap(qTopEtags, err)
+	}
+
+	return stats, nil
+}
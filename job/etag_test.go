@@ -0,0 +1,58 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package job
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+func TestFetch(t *testing.T) {
+	if conn == nil {
+		t.Skip("no database")
+	}
+	ctx := context.Background()
+	db, err := pgxpool.New(ctx, os.Getenv("GOWEBDB"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		_, _ = w.Write([]byte("sitemap"))
+	}))
+	defer srv.Close()
+
+	nurl, _ := url.Parse(srv.URL + "/sitemap.xml")
+	e := &Entry{Ctx: ctx, DB: db}
+	for _, status := range []int{http.StatusOK, http.StatusNotModified} {
+		resp, _, err := e.Fetch(nurl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != status {
+			t.Errorf("expected %d, got %d", status, resp.StatusCode)
+		}
+	}
+
+	stats, err := TopEtags(ctx, db, "", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range stats {
+		if s.URL == nurl.String() && (s.Hits != 1 || s.Misses != 1 || s.SavedBytes != 7) {
+			t.Errorf("expected a hit and a miss saving 7 bytes, got %+v", s)
+		}
+	}
+}
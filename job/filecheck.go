@@ -0,0 +1,177 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package job
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/cwbriscoe/goweb/query"
+	"github.com/jackc/pgx/v5"
+)
+
+// fileStates are the states of the files checked by a run.
+type fileStates struct {
+	sync.Mutex
+	m map[string]*FileState
+}
+
+// FileState is the recorded state of an input file of a job.
+type FileState struct {
+	Path     string    `json:"path"`
+	Checksum string    `json:"checksum"` // sha256 of a local file, the validators of a remote one
+	Size     int64     `json:"size"`
+	Checked  time.Time `json:"checked"` // last time the state was recorded
+	Changed  time.Time `json:"changed"` // last time the recorded checksum changed
+}
+
+var (
+	qGetFile = query.Query{
+		Name: "getFile",
+		SQL:  "select path, checksum, size, check_ts, change_ts from {schema}.file where job_id = $1 and id = $2;",
+	}
+	qSetFile = query.Query{
+		Name: "setFile",
+		SQL: `
+insert into {schema}.file (job_id, id, path, checksum, size, check_ts, change_ts)
+values ($1, $2, $3, $4, $5, now(), now())
+on conflict (job_id, id) do update
+   set path = $3
+      ,checksum = $4
+      ,size = $5
+      ,check_ts = now()
+      ,change_ts = case when file.checksum = $4 then file.change_ts else now() end;`,
+	}
+)
+
+func fileID(path string) int64 {
+	return int64(xxhash.Sum64String(path))
+}
+
+// HasFileChanged returns true if the checksum of the file differs from the one recorded
+// with RecordFile by the job, or if none was recorded.  Every job has its own record, so
+// jobs reading the same file do not skip it for each other.  path is a local file or an http(s) url,
+// remote files are checked with a HEAD request and compared by their ETag, or their
+// Last-Modified and Content-Length.  The state is not recorded, call RecordFile once the
+// file was processed so a failed run checks it again:
+//
+//	changed, err := e.HasFileChanged(file)
+//	if err != nil || !changed {
+//		return err
+//	}
+//	// ingest the file
+//	return e.RecordFile(file)
+func (e *Entry) HasFileChanged(path string) (bool, error) {
+	current, err := e.currentFileState(path)
+	if err != nil {
+		return false, err
+	}
+
+	recorded, err := e.FileState(path)
+	if err != nil {
+		return false, err
+	}
+	changed := recorded == nil || recorded.Checksum != current.Checksum
+	if !changed {
+		e.Log.Info().Msgf("%s is unchanged since %s", path, recorded.Changed.Format(time.RFC3339))
+	}
+	return changed, nil
+}
+
+// RecordFile records the state of the file seen by the last HasFileChanged of the run,
+// or its current state if it was not checked.
+func (e *Entry) RecordFile(path string) error {
+	e.files.Lock()
+	state, ok := e.files.m[path]
+	e.files.Unlock()
+
+	if !ok {
+		var err error
+		if state, err = e.currentFileState(path); err != nil {
+			return err
+		}
+	}
+
+	_, err := e.dbSchema().Exec(e.Ctx, e.DB, qSetFile, e.JobID, fileID(path), path, state.Checksum, state.Size)
+	return err
+}
+
+// FileState returns the state of the file recorded by the job, nil if none was recorded.
+func (e *Entry) FileState(path string) (*FileState, error) {
+	state := &FileState{}
+	err := e.dbSchema().QueryRow(e.Ctx, e.DB, qGetFile, e.JobID, fileID(path)).Scan(&state.Path, &state.Checksum, &state.Size, &state.Checked, &state.Changed)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// currentFileState computes the state of the file and keeps it for RecordFile.
+func (e *Entry) currentFileState(path string) (*FileState, error) {
+	var state *FileState
+	var err error
+	if strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://") {
+		state, err = e.remoteFileState(path)
+	} else {
+		state, err = localFileState(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	e.files.Lock()
+	defer e.files.Unlock()
+	if e.files.m == nil {
+		e.files.m = make(map[string]*FileState)
+	}
+	e.files.m[path] = state
+	return state, nil
+}
+
+func localFileState(path string) (*FileState, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	sum, err := fileChecksum(path)
+	if err != nil {
+		return nil, err
+	}
+	return &FileState{Path: path, Checksum: sum, Size: info.Size()}, nil
+}
+
+func (e *Entry) remoteFileState(path string) (*FileState, error) {
+	req, err := http.NewRequestWithContext(e.Ctx, http.MethodHead, path, http.NoBody)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("HEAD %s: %s", path, resp.Status)
+	}
+
+	checksum := resp.Header.Get("ETag")
+	if checksum == "" {
+		modified := resp.Header.Get("Last-Modified")
+		if modified == "" {
+			return nil, fmt.Errorf("HEAD %s: no ETag or Last-Modified to detect changes", path)
+		}
+		checksum = modified + "|" + strconv.FormatInt(resp.ContentLength, 10)
+	}
+	return &FileState{Path: path, Checksum: checksum, Size: max(resp.ContentLength, 0)}, nil
+}
@@ -0,0 +1,71 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package job
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCurrentFileState(t *testing.T) {
+	e := &Entry{Ctx: context.Background()}
+	file := filepath.Join(t.TempDir(), "input.csv")
+	if err := os.WriteFile(file, []byte("a,b\n1,2\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := e.currentFileState(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Size != 8 || len(first.Checksum) != 64 {
+		t.Errorf("unexpected state: %+v", first)
+	}
+
+	if err = os.WriteFile(file, []byte("a,b\n1,3\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	second, err := e.currentFileState(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.Checksum == first.Checksum {
+		t.Error("checksum did not change with the content")
+	}
+	if e.files.m[file] != second {
+		t.Error("the last state is not kept for RecordFile")
+	}
+}
+
+func TestRemoteFileState(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodHead {
+			t.Errorf("unexpected method %s", r.Method)
+		}
+		switch r.URL.Path {
+		case "/etag":
+			w.Header().Set("ETag", `"v1"`)
+		case "/modified":
+			w.Header().Set("Last-Modified", "Mon, 02 Jan 2023 15:04:05 GMT")
+			w.Header().Set("Content-Length", "42")
+		}
+	}))
+	defer srv.Close()
+
+	e := &Entry{Ctx: context.Background()}
+	state, err := e.currentFileState(srv.URL + "/etag")
+	if err != nil || state.Checksum != `"v1"` {
+		t.Errorf("unexpected state %+v, error %v", state, err)
+	}
+	state, err = e.currentFileState(srv.URL + "/modified")
+	if err != nil || state.Checksum != "Mon, 02 Jan 2023 15:04:05 GMT|42" || state.Size != 42 {
+		t.Errorf("unexpected state %+v, error %v", state, err)
+	}
+	if _, err = e.currentFileState(srv.URL + "/none"); err == nil {
+		t.Error("expected an error without validators")
+	}
+}
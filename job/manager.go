@@ -6,14 +6,25 @@ package job
 import (
 	"bufio"
 	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
 	"os/exec"
 	"path"
 	"strings"
 	"sync"
 	"time"
+	"unicode"
 
 	"github.com/cwbriscoe/goutil/db"
 	"github.com/cwbriscoe/goutil/logging"
+	"github.com/cwbriscoe/goweb/auth"
+	"github.com/cwbriscoe/goweb/clock"
+	"github.com/cwbriscoe/goweb/correlate"
+	"github.com/cwbriscoe/goweb/logsink"
+	"github.com/cwbriscoe/goweb/query"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
@@ -23,6 +34,10 @@ import (
 // RunCallback will be called to run the submitted process.
 type RunCallback func(*Entry) error
 
+// PauseCallback is called before each scan for jobs.  If it returns true, no new
+// jobs are submitted during that scan.
+type PauseCallback func() bool
+
 // Manager is an instance of a job manager.
 type Manager struct {
 	app            string
@@ -35,6 +50,19 @@ type Manager struct {
 	interval       time.Duration
 	maxConcurrency int
 	callback       RunCallback
+	pause          PauseCallback
+	notifier       Notifier
+	logging        map[string]*logsink.Settings
+	schema         query.Schema
+	linkSchema     string
+	notifySchema   string
+	runKey         []byte
+	preemptGrace   time.Duration
+	secrets        Secrets
+	hasher         auth.Hasher
+	clock          clock.Clock
+	runs           map[int]*run // runs started by this manager
+	runsmu         sync.Mutex
 }
 
 // ManagerOptions contain the settings to use when creating a new job
@@ -49,6 +77,18 @@ type ManagerOptions struct {
 	ScanInterval   time.Duration
 	MaxConcurrency int
 	RunCallback    RunCallback
+	Functions      []string                     // optional, the job functions run by the RunCallback, checked against the built in names
+	PauseCallback  PauseCallback                // optional, e.g. watchdog.Watchdog.Overloaded
+	Schema         string                       // database schema with the job tables, defaults to "job"
+	LinkSchema     string                       // database schema with the shortlink tables purged by the built in jobs, defaults to "shortlink"
+	NotifySchema   string                       // database schema with the notification tables, defaults to "notification"
+	RunKey         []byte                       // optional, signs the run ids sent to the server, the runKey of its secrets file
+	Notifier       Notifier                     // optional, used by built in jobs to send alerts
+	Logging        map[string]*logsink.Settings // optional, overrides for the "jobmanager" and "job" logs
+	PreemptGrace   time.Duration                // how long a preempting exclusive job waits, defaults to DefaultPreemptGrace
+	Secrets        Secrets                      // optional, resolves the secrets of the job environments
+	Hasher         auth.Hasher                  // optional, the password hasher of the site used by the rehash job
+	Clock          clock.Clock                  // tells the time of the schedule and of the jobs, clock.Real when nil
 }
 
 // Entry stores resources and information about running
@@ -65,7 +105,107 @@ type Entry struct {
 	Fun     string
 	DB      *pgxpool.Pool
 	Log     *logging.Logger
-	Ctx     context.Context
+	Ctx     context.Context // canceled with the cause ErrPreempted when an exclusive job preempts the run
+	schema  query.Schema
+	clock   clock.Clock
+
+	notifySchema string // schema of the notification tables, the default when empty
+	runKey       []byte // signs the run id in the headers of the requests made by the run
+
+	priority  int
+	exclusive bool
+	preempt   bool
+	counters  counters
+	files     fileStates
+	env       []string // name=value pairs of the job environment
+}
+
+// DefaultSchema is the database schema containing the job tables when none is configured.
+const DefaultSchema = "job"
+
+// schemaOf returns the schema named name, DefaultSchema when it is empty.
+func schemaOf(name string) query.Schema {
+	if name == "" {
+		return DefaultSchema
+	}
+	return query.Schema(name)
+}
+
+var (
+	qExclusiveRunning = query.Query{
+		Name: "exclusiveRunning",
+		SQL: `
+select active.job_id
+      ,active.run_id
+  from {schema}.active
+	join {schema}.entry on active.job_id = entry.job_id
+ where entry.exclusive = true;`,
+	}
+	qNextJob = query.Query{
+		Name: "nextJob",
+		SQL: `
+select job_id
+      ,name 
+      ,function
+      ,priority
+      ,exclusive
+      ,preempt
+  from {schema}.entry
+ where entry.enabled = true
+   and $1 > entry.last_run_ts + entry.every
+   and not exists(
+       select 1
+         from {schema}.active
+        where active.job_id = entry.job_id
+          and entry.multiple = false)
+ order by priority, last_run_ts
+ limit 1;`,
+	}
+	qActiveCount = query.Query{
+		Name: "activeCount",
+		SQL:  "select count(*) from {schema}.active;",
+	}
+	qUpdateLastRun = query.Query{
+		Name: "updateLastRun",
+		SQL:  "update {schema}.entry set last_run_ts = $2 where job_id = $1;",
+	}
+	qInsertActive = query.Query{
+		Name: "insertActive",
+		SQL:  "insert into {schema}.active (job_id, start_ts) values ($1, $2) returning run_id",
+	}
+	qInsertCompleted = query.Query{
+		Name: "insertCompleted",
+		SQL: `
+insert into {schema}.completed (run_id, job_id, start_ts, finish_ts, status)
+select run_id, job_id, start_ts, $3, $2 from {schema}.active where run_id = $1;`,
+	}
+	qDeleteActive = query.Query{
+		Name: "deleteActive",
+		SQL:  "delete from {schema}.active where run_id = $1;",
+	}
+	qSelectActive = query.Query{
+		Name: "selectActive",
+		SQL:  "select run_id, job_id from {schema}.active;",
+	}
+)
+
+// ErrBuiltinClash is returned by NewManager when a job function of the app has the name
+// of a built in job.
+var ErrBuiltinClash = errors.New("job function has the name of a built in job")
+
+// builtins are job functions provided by this package.  They are run instead of the
+// RunCallback when the function of a job entry matches, so NewManager rejects app
+// functions with the same name.
+var builtins = map[string]func(*Manager, *Entry) error{
+	"backup":             (*Manager).backup,
+	"checkRoutes":        (*Manager).checkRoutes,
+	"purgeDeleted":       (*Manager).purgeDeleted,
+	"purgeEtags":         (*Manager).purgeEtags,
+	"purgeLinks":         (*Manager).purgeLinks,
+	"purgeNotifications": (*Manager).purgeNotifications,
+	"pingSitemap":        (*Manager).pingSitemap,
+	"rehash":             (*Manager).rehash,
+	"restore":            (*Manager).restore,
 }
 
 // LogDivider can be used to divide logical sections in the log output.
@@ -73,6 +213,12 @@ var LogDivider = strings.Repeat("=", 80)
 
 // NewManager initializes a new job manager and returns a pointer.
 func NewManager(options *ManagerOptions) (*Manager, error) {
+	for _, fun := range options.Functions {
+		if _, ok := builtins[fun]; ok {
+			return nil, fmt.Errorf("%w: %s", ErrBuiltinClash, fun)
+		}
+	}
+
 	var err error
 	manager := &Manager{
 		app:            options.App,
@@ -82,11 +228,29 @@ func NewManager(options *ManagerOptions) (*Manager, error) {
 		interval:       options.ScanInterval,
 		maxConcurrency: options.MaxConcurrency,
 		callback:       options.RunCallback,
+		pause:          options.PauseCallback,
+		notifier:       options.Notifier,
+		logging:        options.Logging,
 		rootDir:        options.RootDir,
 		logDir:         options.LogDir,
+		schema:         schemaOf(options.Schema),
+		linkSchema:     options.LinkSchema,
+		notifySchema:   options.NotifySchema,
+		runKey:         options.RunKey,
+		preemptGrace:   options.PreemptGrace,
+		secrets:        options.Secrets,
+		hasher:         options.Hasher,
+		clock:          options.Clock,
+		runs:           make(map[int]*run),
+	}
+	if manager.preemptGrace <= 0 {
+		manager.preemptGrace = DefaultPreemptGrace
+	}
+	if manager.clock == nil {
+		manager.clock = clock.Real
 	}
 
-	manager.log, err = logging.NewLogger(logging.Config{
+	manager.log, err = logsink.NewLogger(logging.Config{
 		BaseDir:    manager.logDir,
 		FileName:   "jobmanager.log",
 		MaxAge:     time.Hour * 24 * 28,
@@ -94,7 +258,7 @@ func NewManager(options *ManagerOptions) (*Manager, error) {
 		MaxBackups: 28,
 		Console:    false,
 		Compress:   true,
-	})
+	}, options.Logging["jobmanager"])
 	if err != nil {
 		return nil, err
 	}
@@ -111,7 +275,21 @@ func (m *Manager) Run() {
 		m.log.Err(err).Msg("failed in call to markAbandoned()")
 	}
 
+	paused := false
 	for {
+		if m.pause != nil && m.pause() {
+			// only log transitions so an extended pause doesn't flood the log.
+			if !paused {
+				m.log.Info().Msg("job submission paused")
+				paused = true
+			}
+			time.Sleep(m.interval)
+			continue
+		}
+		if paused {
+			m.log.Info().Msg("job submission resumed")
+			paused = false
+		}
 		// m.log.Info().Msg("starting scan for jobs to submit")
 		m.submit()
 		// m.log.Info().Msgf("ending scan, sleeping for %s", m.interval.String())
@@ -136,7 +314,7 @@ func (m *Manager) submit() {
 		entry.NameKey = strings.ReplaceAll(strings.ToLower(entry.Name), " ", "_")
 		logFile := entry.NameKey + ".log"
 
-		entry.Log, err = logging.NewLogger(logging.Config{
+		entry.Log, err = logsink.NewLogger(logging.Config{
 			BaseDir:    path.Join(m.logDir, "job"),
 			FileName:   logFile,
 			MaxAge:     time.Hour * 24 * 30,
@@ -144,7 +322,7 @@ func (m *Manager) submit() {
 			MaxBackups: 100,
 			Console:    false,
 			Compress:   true,
-		})
+		}, m.logging["job"])
 		if err != nil {
 			m.log.Err(err).Msgf("error running new logger for file: %s", path.Join(path.Join(m.logDir, "job"), logFile))
 			return
@@ -157,14 +335,22 @@ func (m *Manager) submit() {
 		}
 
 		entry.DB = m.db
-		entry.Ctx = context.Background()
+		entry.Ctx = correlate.WithRunID(context.Background(), entry.RunID)
+		run := m.trackRun(entry)
+
+		// tag every line of the job log with the run id so it can be matched with the
+		// server logs of the requests the job makes.
+		runLog := entry.Log.With().Int("run", entry.RunID).Logger().Hook(warningHook{entry.Counter(CounterWarnings)})
+		entry.Log.Logger = &runLog
 
 		go func() {
+			defer m.untrackRun(run)
 			defer func() {
 				if i := recover(); i != nil {
 					m.log.Warn().Msgf("recovered from panic in submitted job %d", entry.RunID)
 					m.log.Warn().Msgf("panic info: %v", i)
 
+					m.saveStats(entry)
 					err = m.markEnded(entry.RunID, entry.JobID, "panic")
 					if err != nil {
 						m.log.Err(err).Msg("error calling markended(panic)")
@@ -172,6 +358,13 @@ func (m *Manager) submit() {
 				}
 			}()
 
+			// a preempting exclusive job stops the lower priority runs instead of waiting
+			// for them to end.  The grace period only holds up this run, the exclusive job
+			// is already active so nothing else is submitted meanwhile.
+			if entry.exclusive && entry.preempt {
+				m.preempt(entry)
+			}
+
 			start := time.Now()
 			m.log.Info().Msgf("job %d started - id: %d, name:'%s', function: '%s'", entry.RunID, entry.JobID, entry.Name, entry.Fun)
 			entry.Log.Info().Msg("")
@@ -179,12 +372,21 @@ func (m *Manager) submit() {
 			entry.Log.Info().Msgf("========== job %d %s() starting - %s", entry.RunID, entry.Fun, time.Now().Format("2006-01-02 15:04:05"))
 			entry.Log.Info().Msg(LogDivider)
 
-			err = m.callback(entry)
+			// a job missing its environment fails instead of running without credentials.
+			if err = m.loadEnv(entry); err != nil {
+				entry.Log.Err(err).Msg("failed to load the job environment")
+			} else if builtin, ok := builtins[entry.Fun]; ok {
+				err = builtin(m, entry)
+			} else {
+				err = m.callback(entry)
+			}
+			status := runStatus(entry, err)
+			m.saveStats(entry)
 			if err != nil {
-				m.log.Err(err).Msgf("job %d error", entry.RunID)
-				err2 := m.markEnded(entry.RunID, entry.JobID, "error")
+				m.log.Err(err).Msgf("job %d %s", entry.RunID, status)
+				err2 := m.markEnded(entry.RunID, entry.JobID, status)
 				if err2 != nil {
-					m.log.Err(err).Msg("error calling markended(error)")
+					m.log.Err(err).Msgf("error calling markended(%s)", status)
 					return
 				}
 			}
@@ -196,6 +398,8 @@ func (m *Manager) submit() {
 			entry.Log.Info().Msg(LogDivider)
 			m.log.Info().Msgf("job %d ended - runtime: %s", entry.RunID, duration)
 
+			m.notifyCompletion(entry, status, end.Sub(start))
+
 			if err == nil {
 				err2 := m.markEnded(entry.RunID, entry.JobID, "ok")
 				if err2 != nil {
@@ -214,15 +418,8 @@ func (m *Manager) getJob() (*Entry, error) {
 	ctx := context.Background()
 
 	var jobid, runid int
-	sql := `
-select active.job_id
-      ,active.run_id
-  from job.active
-	join job.entry on active.job_id = entry.job_id
- where entry.exclusive = true;`
-
-	err := m.db.QueryRow(ctx, sql).Scan(&jobid, &runid)
-	if err != nil && err != pgx.ErrNoRows {
+	err := m.schema.QueryRow(ctx, m.db, qExclusiveRunning).Scan(&jobid, &runid)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
 		return nil, err
 	}
 	// if we get a row, we cannot process a new job since and exclusive job is running now
@@ -231,42 +428,31 @@ select active.job_id
 		return nil, nil
 	}
 
-	sql = `
-select job_id
-      ,name 
-      ,function
-  from job.entry
- where entry.enabled = true
-   and now() > entry.last_run_ts + entry.every
-   and not exists(
-       select 1
-         from job.active
-        where active.job_id = entry.job_id
-          and entry.multiple = false)
- order by priority, last_run_ts
- limit 1;`
-
 	jobEntry := &Entry{
 		App:     m.app,
 		Env:     m.env,
 		URL:     m.url,
 		RootDir: m.rootDir,
+		schema:  m.schema,
+		clock:   m.clock,
+
+		notifySchema: m.notifySchema,
+		runKey:       m.runKey,
 	}
-	err = m.db.QueryRow(ctx, sql).Scan(&jobEntry.JobID, &jobEntry.Name, &jobEntry.Fun)
+	err = m.schema.QueryRow(ctx, m.db, qNextJob, m.clock.Now()).Scan(&jobEntry.JobID, &jobEntry.Name, &jobEntry.Fun, &jobEntry.priority, &jobEntry.exclusive, &jobEntry.preempt)
 	if err != nil {
-		if err == pgx.ErrNoRows {
+		if errors.Is(err, pgx.ErrNoRows) {
 			return nil, nil
 		}
 		return nil, err
 	}
 
 	var cnt int
-	sql = "select count(*) from job.active;"
-	err = m.db.QueryRow(ctx, sql).Scan(&cnt)
-	if err != nil && err != pgx.ErrNoRows {
+	err = m.schema.QueryRow(ctx, m.db, qActiveCount).Scan(&cnt)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
 		return nil, err
 	}
-	if cnt >= m.maxConcurrency {
+	if !m.canSubmit(jobEntry, cnt) {
 		m.log.Info().Msgf("cannot submit job %d because max concurrency of %d has been reached", jobEntry.JobID, cnt)
 		return nil, nil
 	}
@@ -274,18 +460,26 @@ select job_id
 	return jobEntry, nil
 }
 
+// canSubmit reports whether the job entry can start while active runs are going.  The
+// runs a preempting exclusive job will cancel do not count against the max concurrency.
+func (m *Manager) canSubmit(entry *Entry, active int) bool {
+	if entry.exclusive && entry.preempt {
+		active -= len(m.preemptible(entry.priority))
+	}
+	return active < m.maxConcurrency
+}
+
 func (m *Manager) markStarted(jobEntry *Entry) (int, error) {
 	ctx := context.Background()
 	var runid int
 
-	sqlu := "update job.entry set last_run_ts = now() where job_id = $1;"
-	_, err := m.db.Exec(ctx, sqlu, jobEntry.JobID)
+	now := m.clock.Now()
+	_, err := m.schema.Exec(ctx, m.db, qUpdateLastRun, jobEntry.JobID, now)
 	if err != nil {
 		return -1, err
 	}
 
-	sqld := "insert into job.active (job_id, start_ts) values ($1, now()) returning run_id"
-	err = m.db.QueryRow(ctx, sqld, jobEntry.JobID).Scan(&runid)
+	err = m.schema.QueryRow(ctx, m.db, qInsertActive, jobEntry.JobID, now).Scan(&runid)
 	if err != nil {
 		return -1, err
 	}
@@ -295,33 +489,24 @@ func (m *Manager) markStarted(jobEntry *Entry) (int, error) {
 
 func (m *Manager) markEnded(runid, jobid int, reason string) error {
 	batch := db.NewBatch(context.TODO(), m.db)
+	now := m.clock.Now()
 
-	sqli := `
-insert into job.completed (run_id, job_id, start_ts, finish_ts, status)
-select run_id, job_id, start_ts, now(), $2 from job.active where run_id = $1;`
-
-	sqld := "delete from job.active where run_id = $1;"
-
-	sqlu := "update job.entry set last_run_ts = now() where job_id = $1;"
-
-	batch.Queue(sqli, runid, reason)
-	batch.Queue(sqld, runid)
+	batch.Queue(m.schema.SQL(qInsertCompleted), runid, reason, now)
+	batch.Queue(m.schema.SQL(qDeleteActive), runid)
 	if reason != "abandoned" {
-		batch.Queue(sqlu, jobid)
+		batch.Queue(m.schema.SQL(qUpdateLastRun), jobid, now)
 	}
 
 	_, err := batch.Exec()
 	if err != nil {
-		return err
+		return query.Wrap(qInsertCompleted, err)
 	}
 
 	return nil
 }
 
 func (m *Manager) markAbandoned() error {
-	sql := "select run_id, job_id from job.active;"
-
-	rows, err := m.db.Query(context.TODO(), sql)
+	rows, err := m.schema.Query(context.TODO(), m.db, qSelectActive)
 	if err != nil {
 		return err
 	}
@@ -347,6 +532,24 @@ Job utility functions that can be called from running jobs (goroutines)
 *******************************************************************************
 */
 
+// Now returns the current time of the manager clock, jobs use it instead of time.Now so
+// they can run in simulated time.
+func (j *Entry) Now() time.Time {
+	if j.clock == nil {
+		return time.Now()
+	}
+	return j.clock.Now()
+}
+
+// dbSchema returns the schema of the job tables, DefaultSchema for an Entry that was
+// not made by a manager.
+func (j *Entry) dbSchema() query.Schema {
+	if j.schema == "" {
+		return DefaultSchema
+	}
+	return j.schema
+}
+
 // LogMultiLineString prints out a multiline string and
 // prints a line number for each line
 func (j *Entry) LogMultiLineString(s string) {
@@ -381,12 +584,93 @@ func (j *Entry) Exec(ctx context.Context, sql string, args ...any) error {
 	return nil
 }
 
+// NewRequest creates a request to the server at Entry.URL with the job run id in the
+// headers so the server logs of the request can be matched with the job log.
+func (j *Entry) NewRequest(method, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(j.Ctx, method, j.URL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	correlate.SetHeaders(j.Ctx, req, j.runKey)
+	return req, nil
+}
+
 // RunCmd will execute the given command and log its output
 func (j *Entry) RunCmd(ctx context.Context, cmdstr string) error {
-	j.Log.Info().Msgf("cmd: %s", cmdstr)
+	return j.RunCmdEnv(ctx, cmdstr, nil)
+}
+
+// RunCmdEnv will execute the given command with extra environment variables and log its
+// output.  The environment is not logged so it can be used to pass secrets.  The job
+// environment is added before env, so env overrides it.
+// The command is split into arguments like a shell would, see splitCmd.
+func (j *Entry) RunCmdEnv(ctx context.Context, cmdstr string, env []string) error {
+	args, err := splitCmd(cmdstr)
+	if err != nil {
+		return err
+	}
+	return j.runArgs(ctx, args, env)
+}
+
+// ErrBadCommand is returned by RunCmd for an empty command or one with an unterminated
+// quote or escape.
+var ErrBadCommand = errors.New("malformed command")
+
+// splitCmd splits a command line into its arguments.  Arguments are separated by white
+// space, single quotes keep their content as is and double quotes keep it as is except
+// for backslash escapes.  Outside of single quotes a backslash escapes the next rune.
+func splitCmd(cmdstr string) ([]string, error) {
+	var args []string
+	var arg strings.Builder
+	inArg, escaped := false, false
+	var quote rune
+
+	for _, r := range cmdstr {
+		switch {
+		case escaped:
+			arg.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped, inArg = true, true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				arg.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote, inArg = r, true
+		case unicode.IsSpace(r):
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(r)
+			inArg = true
+		}
+	}
+	if escaped || quote != 0 {
+		return nil, fmt.Errorf("%w: unterminated quote or escape in %q", ErrBadCommand, cmdstr)
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	if len(args) == 0 {
+		return nil, fmt.Errorf("%w: empty command", ErrBadCommand)
+	}
+	return args, nil
+}
+
+// runArgs executes the command with the arguments as is, see RunCmdEnv.
+func (j *Entry) runArgs(ctx context.Context, args, env []string) error {
+	j.Log.Info().Msgf("cmd: %s", strings.Join(args, " "))
 
-	args := strings.Fields(cmdstr)
 	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	if len(j.env) > 0 || len(env) > 0 {
+		cmd.Env = append(append(os.Environ(), j.env...), env...)
+	}
 
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
@@ -0,0 +1,166 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package job
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// CacheChannel is the postgres notification channel used to tell the web servers to
+// invalidate a cache group.  The payload is the name of the group, or the group and a
+// key separated by a | to only invalidate the key.
+const CacheChannel = "goweb_cache"
+
+// MatView is a materialized view to refresh.
+type MatView struct {
+	Name      string   // schema qualified name of the view
+	DependsOn []string // views that must be refreshed first
+	Groups    []string // cache groups serving pages backed by the view
+}
+
+// RefreshOptions contains the settings for RefreshViews.
+type RefreshOptions struct {
+	Concurrently bool          // use refresh concurrently, the view needs a unique index
+	LockTimeout  time.Duration // max time to wait for the view lock, defaults to 30 seconds
+	Retries      int           // times to retry a refresh that timed out waiting for a lock
+}
+
+// ErrRefreshFailed is returned when one or more views could not be refreshed.
+var ErrRefreshFailed = errors.New("one or more materialized views failed to refresh")
+
+// lockNotAvailable is the postgres error code for lock_timeout.
+const lockNotAvailable = "55P03"
+
+// RefreshViews refreshes the views in dependency order.  Views depending on a view that
+// failed to refresh are skipped.  After a view is refreshed, its cache groups are
+// invalidated with a notification on CacheChannel.
+func (e *Entry) RefreshViews(views []MatView, opts *RefreshOptions) error {
+	ordered, err := orderViews(views)
+	if err != nil {
+		return err
+	}
+
+	timeout := opts.LockTimeout
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+
+	failed := make(map[string]bool)
+	for _, view := range ordered {
+		if dep := failedDependency(view, failed); dep != "" {
+			e.Log.Warn().Msgf("refresh %s: skipped because %s failed", view.Name, dep)
+			failed[view.Name] = true
+			continue
+		}
+
+		if err = e.refreshView(view, opts.Concurrently, timeout, opts.Retries); err != nil {
+			e.Log.Err(err).Msgf("refresh %s: failed", view.Name)
+			failed[view.Name] = true
+			continue
+		}
+
+		for _, group := range view.Groups {
+			if _, err = e.DB.Exec(e.Ctx, "select pg_notify($1, $2);", CacheChannel, group); err != nil {
+				e.Log.Err(err).Msgf("refresh %s: error invalidating cache group %s", view.Name, group)
+			}
+		}
+	}
+
+	if len(failed) > 0 {
+		return ErrRefreshFailed
+	}
+	return nil
+}
+
+func failedDependency(view *MatView, failed map[string]bool) string {
+	for _, dep := range view.DependsOn {
+		if failed[dep] {
+			return dep
+		}
+	}
+	return ""
+}
+
+func (e *Entry) refreshView(view *MatView, concurrently bool, timeout time.Duration, retries int) error {
+	sql := "refresh materialized view "
+	if concurrently {
+		sql += "concurrently "
+	}
+	sql += pgx.Identifier(strings.Split(view.Name, ".")).Sanitize() + ";"
+
+	for attempt := 0; ; attempt++ {
+		start := time.Now()
+		err := pgx.BeginFunc(e.Ctx, e.DB, func(tx pgx.Tx) error {
+			if _, err := tx.Exec(e.Ctx, "set local lock_timeout = "+strconv.FormatInt(timeout.Milliseconds(), 10)+";"); err != nil {
+				return err
+			}
+			_, err := tx.Exec(e.Ctx, sql)
+			return err
+		})
+		if err == nil {
+			e.Log.Info().Msgf("refresh %s: time: %s", view.Name, time.Since(start).String())
+			return nil
+		}
+
+		var pgErr *pgconn.PgError
+		if !errors.As(err, &pgErr) || pgErr.Code != lockNotAvailable || attempt >= retries {
+			return err
+		}
+
+		e.Log.Warn().Msgf("refresh %s: lock timeout, retry %d of %d", view.Name, attempt+1, retries)
+		time.Sleep(time.Duration(attempt+1) * 5 * time.Second)
+	}
+}
+
+// orderViews sorts the views so each one comes after the views it depends on.
+// Dependencies that are not in the list are assumed to be up to date.
+func orderViews(views []MatView) ([]*MatView, error) {
+	byName := make(map[string]*MatView, len(views))
+	for i := range views {
+		byName[views[i].Name] = &views[i]
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[string]int, len(views))
+	ordered := make([]*MatView, 0, len(views))
+
+	var visit func(view *MatView) error
+	visit = func(view *MatView) error {
+		switch state[view.Name] {
+		case visiting:
+			return fmt.Errorf("materialized view dependency cycle at %s", view.Name)
+		case visited:
+			return nil
+		}
+		state[view.Name] = visiting
+		for _, dep := range view.DependsOn {
+			if v, ok := byName[dep]; ok {
+				if err := visit(v); err != nil {
+					return err
+				}
+			}
+		}
+		state[view.Name] = visited
+		ordered = append(ordered, view)
+		return nil
+	}
+
+	for i := range views {
+		if err := visit(&views[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	return ordered, nil
+}
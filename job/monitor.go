@@ -0,0 +1,196 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package job
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cwbriscoe/goweb/correlate"
+)
+
+// Notifier sends alerts to the operators of the site.
+type Notifier interface {
+	Notify(ctx context.Context, subject, body string) error
+}
+
+// Check is a route requested by the synthetic monitor.
+type Check struct {
+	Name       string `json:"name"`
+	Path       string `json:"path"`       // path requested relative to the base url
+	Status     int    `json:"status"`     // expected status, defaults to 200
+	MaxLatency int    `json:"maxLatency"` // max milliseconds for the response, 0 = unchecked
+	Hash       string `json:"hash"`       // expected sha256 of the body in hex, empty = unchecked
+	Contains   string `json:"contains"`   // text the body must contain, empty = unchecked
+}
+
+// CheckOptions contains the settings for CheckRoutes.
+type CheckOptions struct {
+	BaseURL  string   // defaults to http://localhost
+	Checks   []Check  // routes to check
+	Notifier Notifier // optional, alerted when a check starts failing or recovers
+	Timeout  time.Duration
+}
+
+// CheckResult is the outcome of a single check.
+type CheckResult struct {
+	Name    string    `json:"name"`
+	OK      bool      `json:"ok"`
+	Status  int       `json:"status"`
+	Latency int64     `json:"latency"` // milliseconds
+	Hash    string    `json:"hash"`
+	Error   string    `json:"error,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// ErrCheckFailed is returned when at least one route check failed.
+var ErrCheckFailed = errors.New("one or more route checks failed")
+
+// ErrCheckName is returned when a check has no name or shares it with another check.
+var ErrCheckName = errors.New("route checks need a unique name")
+
+// checkParmKey is the job parm key the last results of the checks are stored under,
+// keyed by the name of the check.
+const checkParmKey = "check"
+
+// checkRoutes is the built in synthetic monitoring job.  The checks are read from the
+// "checks" job parm and the base url from the "baseURL" job parm.
+func (m *Manager) checkRoutes(e *Entry) error {
+	opts := &CheckOptions{Notifier: m.notifier}
+	if err := e.GetParm("checks", 0, &opts.Checks); err != nil {
+		return err
+	}
+	if err := e.GetParm("baseURL", 0, &opts.BaseURL); err != nil {
+		return err
+	}
+	return e.CheckRoutes(opts)
+}
+
+// CheckRoutes requests each route and verifies its status, latency and content.  The
+// last result of each check is stored in the job parms by name so the notifier is only
+// alerted when a check changes state, even when the checks are reordered.
+func (e *Entry) CheckRoutes(opts *CheckOptions) error {
+	names := make(map[string]bool, len(opts.Checks))
+	for _, check := range opts.Checks {
+		if check.Name == "" || names[check.Name] {
+			return fmt.Errorf("%w: %q", ErrCheckName, check.Name)
+		}
+		names[check.Name] = true
+	}
+
+	last := make(map[string]*CheckResult)
+	if err := e.GetParm(checkParmKey, 0, &last); err != nil {
+		return err
+	}
+
+	base := strings.TrimSuffix(opts.BaseURL, "/")
+	if base == "" {
+		base = "http://localhost"
+	}
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	client := &http.Client{Timeout: timeout}
+
+	failed := false
+	results := make(map[string]*CheckResult, len(opts.Checks))
+	for _, check := range opts.Checks {
+		result := runCheck(e.Ctx, client, base, &check, e.runKey)
+		if !result.OK {
+			failed = true
+			e.Log.Warn().Msgf("check %s failed: %s", check.Name, result.Error)
+		} else {
+			e.Log.Info().Msgf("check %s ok: status %d in %dms", check.Name, result.Status, result.Latency)
+		}
+
+		results[check.Name] = result
+
+		// a check with no previous result starts out as ok.
+		prev, ok := last[check.Name]
+		if (!ok || prev.OK) != result.OK && opts.Notifier != nil {
+			e.notifyCheck(opts.Notifier, base, &check, result)
+		}
+	}
+
+	// the results of removed checks are dropped.
+	if err := e.SetParm(checkParmKey, 0, results); err != nil {
+		return err
+	}
+
+	if failed {
+		return ErrCheckFailed
+	}
+	return nil
+}
+
+func (e *Entry) notifyCheck(notifier Notifier, base string, check *Check, result *CheckResult) {
+	subject := fmt.Sprintf("[%s] check %s recovered", e.App, check.Name)
+	if !result.OK {
+		subject = fmt.Sprintf("[%s] check %s failed", e.App, check.Name)
+	}
+	body := fmt.Sprintf("url: %s%s\nstatus: %d\nlatency: %dms\nerror: %s\ntime: %s",
+		base, check.Path, result.Status, result.Latency, result.Error, result.Time.Format(time.RFC3339))
+
+	if err := notifier.Notify(e.Ctx, subject, body); err != nil {
+		e.Log.Err(err).Msgf("check %s: error sending notification", check.Name)
+	}
+}
+
+func runCheck(ctx context.Context, client *http.Client, base string, check *Check, runKey []byte) *CheckResult {
+	result := &CheckResult{Name: check.Name, Time: time.Now()}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, base+check.Path, nil)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	req.Header.Set("User-Agent", "goweb-monitor")
+	correlate.SetHeaders(ctx, req, runKey)
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	result.Latency = time.Since(start).Milliseconds()
+	result.Status = resp.StatusCode
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	sum := sha256.Sum256(body)
+	result.Hash = hex.EncodeToString(sum[:])
+
+	expected := check.Status
+	if expected == 0 {
+		expected = http.StatusOK
+	}
+
+	switch {
+	case result.Status != expected:
+		result.Error = fmt.Sprintf("status %d, expected %d", result.Status, expected)
+	case check.MaxLatency > 0 && result.Latency > int64(check.MaxLatency):
+		result.Error = fmt.Sprintf("latency %dms, max %dms", result.Latency, check.MaxLatency)
+	case check.Hash != "" && !strings.EqualFold(check.Hash, result.Hash):
+		result.Error = "content hash mismatch: " + result.Hash
+	case check.Contains != "" && !strings.Contains(string(body), check.Contains):
+		result.Error = "content missing: " + check.Contains
+	default:
+		result.OK = true
+	}
+
+	return result
+}
@@ -0,0 +1,79 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package job
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/cwbriscoe/goutil/logging"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/rs/zerolog"
+)
+
+type testNotifier struct {
+	subjects []string
+}
+
+func (n *testNotifier) Notify(_ context.Context, subject, _ string) error {
+	n.subjects = append(n.subjects, subject)
+	return nil
+}
+
+func TestCheckNames(t *testing.T) {
+	e := &Entry{Ctx: context.Background()}
+	for _, checks := range [][]Check{
+		{{Name: "home", Path: "/"}, {Name: "home", Path: "/about"}},
+		{{Name: "", Path: "/"}},
+	} {
+		if err := e.CheckRoutes(&CheckOptions{Checks: checks}); !errors.Is(err, ErrCheckName) {
+			t.Errorf("expected ErrCheckName for %v, got %v", checks, err)
+		}
+	}
+}
+
+func TestBuiltinClash(t *testing.T) {
+	_, err := NewManager(&ManagerOptions{Functions: []string{"nightly", "backup"}})
+	if !errors.Is(err, ErrBuiltinClash) {
+		t.Errorf("expected ErrBuiltinClash, got %v", err)
+	}
+}
+
+func TestCheckState(t *testing.T) {
+	if conn == nil {
+		t.Skip("no database")
+	}
+	ctx := context.Background()
+	db, err := pgxpool.New(ctx, os.Getenv("GOWEBDB"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/down" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+
+	log := zerolog.Nop()
+	e := &Entry{Ctx: ctx, DB: db, NameKey: "checkstate", Log: &logging.Logger{Logger: &log}}
+	notifier := &testNotifier{}
+	up, down := Check{Name: "up", Path: "/"}, Check{Name: "down", Path: "/down"}
+
+	// reordering the checks keeps the state of each one, only the first failure alerts.
+	for _, checks := range [][]Check{{up, down}, {down, up}} {
+		err = e.CheckRoutes(&CheckOptions{BaseURL: srv.URL, Checks: checks, Notifier: notifier})
+		if !errors.Is(err, ErrCheckFailed) {
+			t.Fatalf("expected ErrCheckFailed, got %v", err)
+		}
+	}
+	if len(notifier.subjects) != 1 {
+		t.Errorf("expected a single alert, got %v", notifier.subjects)
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package job
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/cwbriscoe/goweb/notification"
+)
+
+// NotifyUser sends a notification from the running job to the user.
+func (e *Entry) NotifyUser(userID int, title, body, link string) error {
+	return e.notifyUser(e.Ctx, userID, title, body, link)
+}
+
+func (e *Entry) notifyUser(ctx context.Context, userID int, title, body, link string) error {
+	store := notification.NewStore(&notification.Settings{DB: e.DB, Schema: e.notifySchema})
+	return store.Send(ctx, &notification.Notification{
+		UserID: userID,
+		Kind:   "job",
+		Title:  title,
+		Body:   body,
+		Link:   link,
+	})
+}
+
+// notifyCompletion tells the users in the "notifyUsers" job parm that the job ended.
+// The context of the run is canceled when it was preempted, so the users are told with
+// a context of their own.
+func (m *Manager) notifyCompletion(e *Entry, status string, runtime time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	var users []int
+	if err := e.getParm(ctx, "notifyUsers", 0, &users); err != nil {
+		m.log.Err(err).Msgf("job %d error reading notifyUsers parm", e.RunID)
+		return
+	}
+
+	body := "run " + strconv.Itoa(e.RunID) + " ended with status " + status + " after " + runtime.Round(time.Second).String()
+	for _, id := range users {
+		if err := e.notifyUser(ctx, id, "job "+e.Name+" finished", body, ""); err != nil {
+			m.log.Err(err).Msgf("job %d error notifying user %d", e.RunID, id)
+		}
+	}
+}
+
+// purgeNotifications is the built in job deleting notifications past their retention.
+func (*Manager) purgeNotifications(e *Entry) error {
+	store := notification.NewStore(&notification.Settings{DB: e.DB, Schema: e.notifySchema})
+	cnt, err := store.Purge(e.Ctx)
+	if err != nil {
+		return err
+	}
+	e.Log.Info().Msgf("purged %d notifications", cnt)
+	return nil
+}
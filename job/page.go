@@ -0,0 +1,147 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package job
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/cwbriscoe/goweb/query"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// DefaultPageType is the content type of the pages set without one.
+const DefaultPageType = "text/html; charset=utf-8"
+
+// Page is a pre-rendered page stored in the page table by a job and served by the web
+// servers with server.PageHandler.
+type Page struct {
+	Group       string        `json:"group"`       // cache group of the handler serving the page
+	Path        string        `json:"path"`        // request path, ie: /articles/golang
+	Body        []byte        `json:"-"`           // rendered page
+	ContentType string        `json:"contentType"` // defaults to DefaultPageType
+	Etag        string        `json:"etag"`        // version of the body, defaults to a hash of it
+	TTL         time.Duration `json:"ttl"`         // how long the servers cache the page, the max age of the group when 0
+	Rendered    time.Time     `json:"rendered"`    // last time the page was set
+}
+
+var (
+	qGetPage = query.Query{
+		Name: "getPage",
+		SQL: `
+select body, content_type, etag, ttl, render_ts
+  from {schema}.page
+ where group_name = $1 and path = $2;`,
+	}
+	qGetPageEtag = query.Query{
+		Name: "getPageEtag",
+		SQL:  "select etag from {schema}.page where group_name = $1 and path = $2;",
+	}
+	qSetPage = query.Query{
+		Name: "setPage",
+		SQL: `
+insert into {schema}.page (group_name, path, body, content_type, etag, ttl, render_ts)
+values ($1, $2, $3, $4, $5, $6, now())
+on conflict (group_name, path) do update set body = $3, content_type = $4, etag = $5, ttl = $6, render_ts = now();`,
+	}
+	qTouchPage = query.Query{
+		Name: "touchPage",
+		SQL:  "update {schema}.page set content_type = $3, ttl = $4, render_ts = now() where group_name = $1 and path = $2;",
+	}
+	qDeletePage = query.Query{
+		Name: "deletePage",
+		SQL:  "delete from {schema}.page where group_name = $1 and path = $2;",
+	}
+	qPurgePages = query.Query{
+		Name: "purgePages",
+		SQL:  "delete from {schema}.page where group_name = $1 and render_ts < $2;",
+	}
+)
+
+// SetPage stores the page and returns true if its body changed.  The servers drop the
+// cached copy of a changed page with a notification on CacheChannel.  Setting a page
+// with an unchanged etag only records that it was rendered, see PurgePages.
+func (e *Entry) SetPage(p *Page) (bool, error) {
+	contentType := p.ContentType
+	if contentType == "" {
+		contentType = DefaultPageType
+	}
+	etag := p.Etag
+	if etag == "" {
+		etag = strconv.FormatUint(xxhash.Sum64(p.Body), 16)
+	}
+	ttl := int(p.TTL / time.Second)
+
+	var old string
+	err := e.dbSchema().QueryRow(e.Ctx, e.DB, qGetPageEtag, p.Group, p.Path).Scan(&old)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return false, err
+	}
+	if err == nil && old == etag {
+		_, err = e.dbSchema().Exec(e.Ctx, e.DB, qTouchPage, p.Group, p.Path, contentType, ttl)
+		return false, err
+	}
+
+	if _, err = e.dbSchema().Exec(e.Ctx, e.DB, qSetPage, p.Group, p.Path, p.Body, contentType, etag, ttl); err != nil {
+		return false, err
+	}
+	e.invalidatePage(p.Group, p.Path)
+	return true, nil
+}
+
+// DeletePage deletes the page, the servers answer 404 for it once they dropped their
+// cached copy.
+func (e *Entry) DeletePage(group, path string) error {
+	tag, err := e.dbSchema().Exec(e.Ctx, e.DB, qDeletePage, group, path)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() > 0 {
+		e.invalidatePage(group, path)
+	}
+	return nil
+}
+
+// PurgePages deletes the pages of the group that were not set since before, ie: the
+// pages a batch did not render again because their source is gone.  It returns the
+// number of pages deleted.
+func (e *Entry) PurgePages(group string, before time.Time) (int64, error) {
+	tag, err := e.dbSchema().Exec(e.Ctx, e.DB, qPurgePages, group, before)
+	if err != nil {
+		return 0, err
+	}
+	if n := tag.RowsAffected(); n > 0 {
+		if _, err = e.DB.Exec(e.Ctx, "select pg_notify($1, $2);", CacheChannel, group); err != nil {
+			e.Log.Err(err).Msgf("pages: error invalidating cache group %s", group)
+		}
+		return n, nil
+	}
+	return 0, nil
+}
+
+// invalidatePage tells the servers to drop their cached copy of the page.
+func (e *Entry) invalidatePage(group, path string) {
+	if _, err := e.DB.Exec(e.Ctx, "select pg_notify($1, $2);", CacheChannel, group+"|"+path); err != nil {
+		e.Log.Err(err).Msgf("pages: error invalidating %s %s", group, path)
+	}
+}
+
+// GetPage returns the page of the group stored at path in schema, DefaultSchema when
+// empty, nil if there is none.
+func GetPage(ctx context.Context, db *pgxpool.Pool, schema, group, path string) (*Page, error) {
+	p := &Page{Group: group, Path: path}
+	var ttl int
+	err := schemaOf(schema).QueryRow(ctx, db, qGetPage, group, path).Scan(&p.Body, &p.ContentType, &p.Etag, &ttl, &p.Rendered)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	p.TTL = time.Duration(ttl) * time.Second
+	return p, nil
+}
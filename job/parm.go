@@ -3,18 +3,41 @@
 package job
 
 import (
+	"context"
+	"errors"
+
+	"github.com/cwbriscoe/goweb/query"
 	"github.com/goccy/go-json"
 	"github.com/jackc/pgx/v5"
 )
 
-// GetParm retrieves the current jobs parm with the given key and sequence
+var (
+	qGetParm = query.Query{
+		Name: "getParm",
+		SQL:  "select data from {schema}.parm where job = $1 and key = $2 and seq = $3;",
+	}
+	qUpdateParm = query.Query{
+		Name: "updateParm",
+		SQL:  "update {schema}.parm set data = $4 where job = $1 and key = $2 and seq = $3;",
+	}
+	qInsertParm = query.Query{
+		Name: "insertParm",
+		SQL:  "insert into {schema}.parm values ($1, $2, $3, $4);",
+	}
+)
+
+// GetParm retrieves the current jobs parm with the given key and sequence.  If a
+// schema is registered for the parm, decode errors name the parm and field.
 func (e *Entry) GetParm(key string, seq int, val any) error {
-	sql := "select data from job.parm where job = $1 and key = $2 and seq = $3;"
+	return e.getParm(e.Ctx, key, seq, val)
+}
 
+// getParm is GetParm with a context other than the one of the run.
+func (e *Entry) getParm(ctx context.Context, key string, seq int, val any) error {
 	var p any
-	err := e.DB.QueryRow(e.Ctx, sql, e.NameKey, key, seq).Scan(&p)
+	err := e.dbSchema().QueryRow(ctx, e.DB, qGetParm, e.NameKey, key, seq).Scan(&p)
 
-	if err != nil && err != pgx.ErrNoRows {
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
 		return err
 	}
 
@@ -23,13 +46,28 @@ func (e *Entry) GetParm(key string, seq int, val any) error {
 		return err
 	}
 
+	if p != nil {
+		if err = validateParm(e.NameKey, key, seq, jsonStr); err != nil {
+			return err
+		}
+	}
+
 	return json.Unmarshal(jsonStr, val)
 }
 
-// SetParm sets the current jobs parm with the given key and sequence
+// SetParm sets the current jobs parm with the given key and sequence.  If a schema is
+// registered for the parm, values that do not match it are rejected with ErrInvalidParm.
 func (e *Entry) SetParm(key string, seq int, p any) error {
-	sql := "update job.parm set data = $4 where job = $1 and key = $2 and seq = $3;"
-	tag, err := e.DB.Exec(e.Ctx, sql, e.NameKey, key, seq, p)
+	jsonStr, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+
+	if err = validateParm(e.NameKey, key, seq, jsonStr); err != nil {
+		return err
+	}
+
+	tag, err := e.dbSchema().Exec(e.Ctx, e.DB, qUpdateParm, e.NameKey, key, seq, p)
 	if err != nil {
 		return err
 	}
@@ -38,8 +76,7 @@ func (e *Entry) SetParm(key string, seq int, p any) error {
 		return nil
 	}
 
-	sql = "insert into job.parm values ($1, $2, $3, $4);"
-	_, err = e.DB.Exec(e.Ctx, sql, e.NameKey, key, seq, p)
+	_, err = e.dbSchema().Exec(e.Ctx, e.DB, qInsertParm, e.NameKey, key, seq, p)
 	if err != nil {
 		return err
 	}
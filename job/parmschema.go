@@ -0,0 +1,101 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package job
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/goccy/go-json"
+)
+
+// ErrInvalidParm is returned when a parm does not match its registered schema.
+var ErrInvalidParm = errors.New("invalid job parm")
+
+type parmSchemaKey struct {
+	job string
+	key string
+}
+
+var parmSchemas = struct {
+	sync.RWMutex
+	types map[parmSchemaKey]reflect.Type
+}{types: make(map[parmSchemaKey]reflect.Type)}
+
+// RegisterParm registers the Go type of a job parm.  Once registered, SetParm rejects
+// values that do not decode into the type and GetParm reports precise decode errors.
+// Unknown fields are rejected and struct fields tagged `parm:"required"` must not be
+// the zero value.  job is the job name key (lowercase with underscores).
+func RegisterParm(job, key string, proto any) {
+	t := reflect.TypeOf(proto)
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	parmSchemas.Lock()
+	defer parmSchemas.Unlock()
+	parmSchemas.types[parmSchemaKey{job, key}] = t
+}
+
+func parmSchema(job, key string) reflect.Type {
+	parmSchemas.RLock()
+	defer parmSchemas.RUnlock()
+	return parmSchemas.types[parmSchemaKey{job, key}]
+}
+
+// validateParm decodes the json into a new value of the registered type and checks
+// the required fields.
+func validateParm(job, key string, seq int, data []byte) error {
+	t := parmSchema(job, key)
+	if t == nil {
+		return nil
+	}
+
+	v := reflect.New(t)
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v.Interface()); err != nil {
+		return fmt.Errorf("%w %s/%s[%d]: %s", ErrInvalidParm, job, key, seq, err.Error())
+	}
+
+	if missing := missingFields(v.Elem(), ""); len(missing) > 0 {
+		return fmt.Errorf("%w %s/%s[%d]: missing required fields: %s", ErrInvalidParm, job, key, seq, strings.Join(missing, ", "))
+	}
+
+	return nil
+}
+
+// missingFields returns the json names of the required fields with zero values.
+func missingFields(v reflect.Value, prefix string) []string {
+	if v.Kind() != reflect.Struct {
+		return nil
+	}
+
+	var missing []string
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "" {
+			name = field.Name
+		}
+		name = prefix + name
+
+		fv := v.Field(i)
+		if field.Tag.Get("parm") == "required" && fv.IsZero() {
+			missing = append(missing, name)
+			continue
+		}
+		missing = append(missing, missingFields(fv, name+".")...)
+	}
+
+	return missing
+}
@@ -0,0 +1,46 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package job
+
+import (
+	"errors"
+	"testing"
+)
+
+type testParm struct {
+	URL   string `json:"url" parm:"required"`
+	Limit int    `json:"limit"`
+	Inner struct {
+		Name string `json:"name" parm:"required"`
+	} `json:"inner"`
+}
+
+func TestValidateParm(t *testing.T) {
+	RegisterParm("test_job", "settings", &testParm{})
+
+	tests := []struct {
+		data  string
+		valid bool
+	}{
+		{`{"url":"https://example.com","limit":5,"inner":{"name":"x"}}`, true},
+		{`{"url":"https://example.com","inner":{}}`, false},
+		{`{"limit":5,"inner":{"name":"x"}}`, false},
+		{`{"url":"https://example.com","extra":1,"inner":{"name":"x"}}`, false},
+		{`{"url":"https://example.com","limit":"five","inner":{"name":"x"}}`, false},
+	}
+
+	for _, test := range tests {
+		err := validateParm("test_job", "settings", 0, []byte(test.data))
+		if test.valid && err != nil {
+			t.Errorf("%s: unexpected error: %v", test.data, err)
+		}
+		if !test.valid && !errors.Is(err, ErrInvalidParm) {
+			t.Errorf("%s: expected ErrInvalidParm, got %v", test.data, err)
+		}
+	}
+
+	// parms without a registered schema are not validated
+	if err := validateParm("other_job", "settings", 0, []byte(`{"anything":true}`)); err != nil {
+		t.Errorf("unexpected error for unregistered parm: %v", err)
+	}
+}
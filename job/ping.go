@@ -0,0 +1,219 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package job
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/cwbriscoe/goutil/net"
+	"github.com/cwbriscoe/goutil/str"
+	"github.com/cwbriscoe/goweb/query"
+	"github.com/goccy/go-json"
+	"github.com/jackc/pgx/v5"
+)
+
+// Engine is a search engine to notify when the sitemap changes.
+type Engine struct {
+	Name     string `json:"name"`     // unique name used to track submissions
+	Endpoint string `json:"endpoint"` // ping url the sitemap url is appended to, or the IndexNow api url
+	IndexNow bool   `json:"indexNow"` // submit the urls with the IndexNow protocol instead of a sitemap ping
+}
+
+// DefaultEngines are the engines notified when PingOptions.Engines is empty.  Google and
+// Bing retired their sitemap ping endpoints, Bing and the other IndexNow engines share
+// the submissions made to api.indexnow.org.  Google reads the sitemap listed in
+// robots.txt or in the search console.
+var DefaultEngines = []Engine{
+	{Name: "indexnow", Endpoint: "https://api.indexnow.org/indexnow", IndexNow: true},
+}
+
+// PingOptions contains the settings for PingSitemap.
+type PingOptions struct {
+	Sitemap     string   `json:"sitemap"`     // absolute url of the sitemap or sitemap index
+	URLs        []string `json:"urls"`        // changed urls submitted to IndexNow engines, defaults to the sitemap url
+	IndexNowKey string   `json:"indexNowKey"` // IndexNow key, IndexNow engines are skipped when empty
+	KeyLocation string   `json:"keyLocation"` // absolute url of the hosted key file, defaults to /indexnow/<key>.txt
+	Engines     []Engine `json:"engines"`     // defaults to DefaultEngines
+}
+
+// ErrPingFailed is returned when at least one engine did not accept the submission.
+var ErrPingFailed = errors.New("one or more sitemap pings failed")
+
+var (
+	qGetPing = query.Query{
+		Name: "getPing",
+		SQL:  "select etag from {schema}.ping where engine = $1 and id = $2;",
+	}
+	qSetPing = query.Query{
+		Name: "setPing",
+		SQL: `
+insert into {schema}.ping (engine, id, url, etag, status, response, submit_ts)
+values ($1, $2, $3, $4, $5, $6, now())
+on conflict (engine, id) do update set etag = $4, status = $5, response = $6, submit_ts = now();`,
+	}
+)
+
+// pingSitemap is the built in sitemap submission job.  The options are read from the
+// "ping" job parm.
+func (*Manager) pingSitemap(e *Entry) error {
+	opts := &PingOptions{}
+	if err := e.GetParm("ping", 0, opts); err != nil {
+		return err
+	}
+	if opts.Sitemap == "" {
+		return errors.New("ping: the ping job parm has no sitemap")
+	}
+	return e.PingSitemap(opts)
+}
+
+// PingSitemap notifies search engines that the sitemap changed.  Each engine is only
+// notified when the sitemap etag differs from the last successful submission to it.
+// Responses are recorded in the ping table.
+func (e *Entry) PingSitemap(opts *PingOptions) error {
+	sitemap, err := url.Parse(opts.Sitemap)
+	if err != nil {
+		return err
+	}
+
+	etag, err := e.sitemapEtag(sitemap)
+	if err != nil {
+		return err
+	}
+
+	engines := opts.Engines
+	if len(engines) == 0 {
+		engines = DefaultEngines
+	}
+
+	id := int64(xxhash.Sum64String(sitemap.String()))
+	failed := false
+
+	for _, engine := range engines {
+		if engine.IndexNow && opts.IndexNowKey == "" {
+			continue
+		}
+
+		var last string
+		err = e.dbSchema().QueryRow(e.Ctx, e.DB, qGetPing, engine.Name, id).Scan(&last)
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			return err
+		}
+		if last == etag {
+			e.Log.Info().Msgf("ping %s: sitemap unchanged since last submission", engine.Name)
+			continue
+		}
+
+		var status int
+		var response string
+		if engine.IndexNow {
+			status, response, err = e.submitIndexNow(engine, sitemap, opts)
+		} else {
+			status, response, err = e.pingEngine(engine.Endpoint + url.QueryEscape(sitemap.String()))
+		}
+		if err != nil {
+			e.Log.Err(err).Msgf("ping %s: request failed", engine.Name)
+			status, response = 0, err.Error()
+		}
+
+		// only remember the etag when the engine accepted it so failures are retried.
+		saved := etag
+		if status < 200 || status > 299 {
+			failed = true
+			saved = ""
+		}
+		e.Log.Info().Msgf("ping %s: status %d", engine.Name, status)
+
+		_, err = e.dbSchema().Exec(e.Ctx, e.DB, qSetPing, engine.Name, id, sitemap.String(), saved, status, response)
+		if err != nil {
+			return err
+		}
+	}
+
+	if failed {
+		return ErrPingFailed
+	}
+	return nil
+}
+
+// sitemapEtag returns the etag of the sitemap or a hash of its content if it has none.
+// The sitemap is fetched with the etag of the last fetch, a 304 returns that etag.
+func (e *Entry) sitemapEtag(sitemap *url.URL) (string, error) {
+	resp, body, err := e.Fetch(sitemap)
+	if err != nil {
+		return "", err
+	}
+
+	if resp.StatusCode == http.StatusNotModified {
+		return e.GetEtag(sitemap)
+	}
+	if etag := resp.Header.Get("ETag"); etag != "" {
+		return str.TrimQuotes(strings.TrimPrefix(etag, "W/")), nil
+	}
+	return strconv.FormatUint(xxhash.Sum64(body), 16), nil
+}
+
+func (e *Entry) pingEngine(endpoint string) (int, string, error) {
+	client := &net.Client{}
+	client.SetTimeout(30 * time.Second)
+
+	resp, body, err := client.Fetch(endpoint)
+	if resp == nil {
+		return 0, "", err
+	}
+	// a 404 is a valid response to record, not a request failure.
+	if err != nil && !errors.Is(err, net.ErrNotFound) {
+		return 0, "", err
+	}
+	return resp.StatusCode, truncate(string(body), 1000), nil
+}
+
+func (e *Entry) submitIndexNow(engine Engine, sitemap *url.URL, opts *PingOptions) (int, string, error) {
+	keyLocation := opts.KeyLocation
+	if keyLocation == "" {
+		keyLocation = sitemap.Scheme + "://" + sitemap.Host + "/indexnow/" + opts.IndexNowKey + ".txt"
+	}
+
+	urls := opts.URLs
+	if len(urls) == 0 {
+		urls = []string{sitemap.String()}
+	}
+
+	payload, err := json.Marshal(map[string]any{
+		"host":        sitemap.Host,
+		"key":         opts.IndexNowKey,
+		"keyLocation": keyLocation,
+		"urlList":     urls,
+	})
+	if err != nil {
+		return 0, "", err
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Post(engine.Endpoint, "application/json; charset=utf-8", bytes.NewReader(payload))
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1000))
+	if err != nil {
+		return resp.StatusCode, "", err
+	}
+
+	return resp.StatusCode, string(body), nil
+}
+
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
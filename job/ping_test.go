@@ -0,0 +1,31 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package job
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/goccy/go-json"
+)
+
+func TestPingBuiltin(t *testing.T) {
+	if _, ok := builtins["pingSitemap"]; !ok {
+		t.Error("expected pingSitemap to be a built in job")
+	}
+	for _, engine := range DefaultEngines {
+		if !engine.IndexNow {
+			t.Errorf("expected only IndexNow engines by default, got %s", engine.Endpoint)
+		}
+	}
+
+	// the options are read from the ping job parm.
+	opts := &PingOptions{}
+	err := json.Unmarshal([]byte(`{"sitemap":"https://example.com/sitemap.xml","indexNowKey":"key","engines":[{"name":"local","endpoint":"http://localhost/ping?sitemap="}]}`), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.Sitemap == "" || opts.IndexNowKey != "key" || len(opts.Engines) != 1 || !strings.HasPrefix(opts.Engines[0].Endpoint, "http://localhost") {
+		t.Errorf("unexpected options %+v", opts)
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package job
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cwbriscoe/goweb/query"
+)
+
+// ErrPreempted is the cause of the context of a run canceled by a preempting exclusive
+// job.  Runs ending with an error after it are recorded with the status "preempted".
+var ErrPreempted = errors.New("job preempted by an exclusive job")
+
+// DefaultPreemptGrace is how long a preempting job waits for the runs it canceled when
+// ManagerOptions.PreemptGrace is not set.
+const DefaultPreemptGrace = 30 * time.Second
+
+// run is a job started by this manager.
+type run struct {
+	entry  *Entry
+	cancel context.CancelCauseFunc
+	done   chan struct{} // closed when the run ends
+}
+
+var qInsertEvent = query.Query{
+	Name: "insertEvent",
+	SQL:  "insert into {schema}.event (job_id, run_id, event, detail, event_ts) values ($1, $2, $3, $4, now());",
+}
+
+// trackRun gives the entry a context canceled by preempt and remembers the run until
+// untrackRun is called.
+func (m *Manager) trackRun(entry *Entry) *run {
+	ctx, cancel := context.WithCancelCause(entry.Ctx)
+	entry.Ctx = ctx
+	r := &run{entry: entry, cancel: cancel, done: make(chan struct{})}
+
+	m.runsmu.Lock()
+	defer m.runsmu.Unlock()
+	m.runs[entry.RunID] = r
+	return r
+}
+
+func (m *Manager) untrackRun(r *run) {
+	m.runsmu.Lock()
+	delete(m.runs, r.entry.RunID)
+	m.runsmu.Unlock()
+
+	r.cancel(nil)
+	close(r.done)
+}
+
+// preemptible returns the runs of this manager with a lower priority than priority.
+// Runs of other processes can not be canceled.
+func (m *Manager) preemptible(priority int) []*run {
+	m.runsmu.Lock()
+	defer m.runsmu.Unlock()
+	var runs []*run
+	for _, r := range m.runs {
+		if r.entry.priority > priority {
+			runs = append(runs, r)
+		}
+	}
+	return runs
+}
+
+// preempt cancels the runs with a lower priority than the exclusive job entry and
+// waits up to the grace period for them to end.  Runs ignoring their context keep
+// running, the entry starts anyway when the grace period is over.  Every step is
+// recorded in the event table.
+func (m *Manager) preempt(entry *Entry) {
+	runs := m.preemptible(entry.priority)
+	if len(runs) == 0 {
+		return
+	}
+
+	by := "by job " + strconv.Itoa(entry.JobID) + " " + entry.Name
+	ids := make([]string, 0, len(runs))
+	for _, r := range runs {
+		ids = append(ids, strconv.Itoa(r.entry.RunID))
+		m.recordEvent(r.entry.JobID, r.entry.RunID, "preempt_requested", by)
+		r.cancel(ErrPreempted)
+	}
+	m.log.Info().Msgf("job %d %s is preempting runs %s", entry.JobID, entry.Name, strings.Join(ids, ", "))
+	m.recordEvent(entry.JobID, 0, "preempting", "runs "+strings.Join(ids, ", "))
+
+	stopped := awaitRuns(runs, m.preemptGrace, func(r *run) {
+		m.recordEvent(r.entry.JobID, r.entry.RunID, "preempted", by)
+	})
+	if stopped < len(runs) {
+		left := strings.Join(ids[stopped:], ", ")
+		m.log.Warn().Msgf("job %d %s starting after a grace period of %s, runs %s did not stop", entry.JobID, entry.Name, m.preemptGrace, left)
+		m.recordEvent(entry.JobID, 0, "preempt_timeout", "runs "+left+" still running after "+m.preemptGrace.String())
+		return
+	}
+	m.recordEvent(entry.JobID, 0, "preempt_done", "runs "+strings.Join(ids, ", ")+" stopped")
+}
+
+// awaitRuns waits up to grace for the runs to end in order and calls ended for each
+// one that did.  It returns the number of runs that ended before the grace was over.
+func awaitRuns(runs []*run, grace time.Duration, ended func(*run)) int {
+	timer := time.NewTimer(grace)
+	defer timer.Stop()
+	for i, r := range runs {
+		select {
+		case <-r.done:
+			ended(r)
+		case <-timer.C:
+			return i
+		}
+	}
+	return len(runs)
+}
+
+// recordEvent records a transition of a job, runID is zero for a job not started yet.
+func (m *Manager) recordEvent(jobID, runID int, event, detail string) {
+	var id *int
+	if runID != 0 {
+		id = &runID
+	}
+	if _, err := m.schema.Exec(context.Background(), m.db, qInsertEvent, jobID, id, event, detail); err != nil {
+		m.log.Err(err).Msgf("error recording event %s of job %d", event, jobID)
+	}
+}
+
+// runStatus returns the status a run ending with err is recorded with.
+func runStatus(entry *Entry, err error) string {
+	switch {
+	case err == nil:
+		return "ok"
+	case errors.Is(context.Cause(entry.Ctx), ErrPreempted):
+		return "preempted"
+	default:
+		return "error"
+	}
+}
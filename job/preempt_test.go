@@ -0,0 +1,89 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package job
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPreemptible(t *testing.T) {
+	m := &Manager{runs: make(map[int]*run)}
+	runs := make(map[int]*run)
+	for id, priority := range map[int]int{1: 1, 2: 5, 3: 9} {
+		runs[id] = m.trackRun(&Entry{RunID: id, Ctx: context.Background(), priority: priority})
+	}
+
+	victims := m.preemptible(5)
+	if len(victims) != 1 || victims[0].entry.RunID != 3 {
+		t.Fatalf("expected run 3 to be preemptible, got %d runs", len(victims))
+	}
+
+	victims[0].cancel(ErrPreempted)
+	err := errors.New("canceled")
+	if status := runStatus(runs[3].entry, err); status != "preempted" {
+		t.Errorf("expected preempted, got %s", status)
+	}
+	if status := runStatus(runs[2].entry, err); status != "error" {
+		t.Errorf("expected error, got %s", status)
+	}
+	if status := runStatus(runs[1].entry, nil); status != "ok" {
+		t.Errorf("expected ok, got %s", status)
+	}
+
+	m.untrackRun(runs[3])
+	select {
+	case <-runs[3].done:
+	default:
+		t.Error("expected the run to be done")
+	}
+	if len(m.preemptible(0)) != 2 {
+		t.Error("expected the ended run to be forgotten")
+	}
+}
+
+func TestCanSubmit(t *testing.T) {
+	m := &Manager{maxConcurrency: 2, runs: make(map[int]*run)}
+	for id, priority := range map[int]int{1: 1, 2: 9} {
+		m.trackRun(&Entry{RunID: id, Ctx: context.Background(), priority: priority})
+	}
+
+	tests := []struct {
+		name   string
+		entry  *Entry
+		active int
+		want   bool
+	}{
+		{"free slot", &Entry{priority: 5}, 1, true},
+		{"full", &Entry{priority: 5}, 2, false},
+		{"exclusive without preempt", &Entry{priority: 5, exclusive: true}, 2, false},
+		{"preempt frees a slot", &Entry{priority: 5, exclusive: true, preempt: true}, 2, true},
+		{"preempt frees too few", &Entry{priority: 5, exclusive: true, preempt: true}, 3, false},
+		{"nothing to preempt", &Entry{priority: 9, exclusive: true, preempt: true}, 2, false},
+	}
+	for _, test := range tests {
+		if got := m.canSubmit(test.entry, test.active); got != test.want {
+			t.Errorf("%s: expected %t, got %t", test.name, test.want, got)
+		}
+	}
+}
+
+func TestAwaitRuns(t *testing.T) {
+	runs := []*run{{done: make(chan struct{})}, {done: make(chan struct{})}}
+	close(runs[0].done)
+
+	var ended []*run
+	if n := awaitRuns(runs, 10*time.Millisecond, func(r *run) { ended = append(ended, r) }); n != 1 {
+		t.Errorf("expected 1 run to end before the grace period, got %d", n)
+	}
+	if len(ended) != 1 || ended[0] != runs[0] {
+		t.Errorf("expected the first run to be reported, got %d runs", len(ended))
+	}
+
+	close(runs[1].done)
+	if n := awaitRuns(runs, time.Minute, func(*run) {}); n != 2 {
+		t.Errorf("expected both runs to end, got %d", n)
+	}
+}
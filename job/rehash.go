@@ -0,0 +1,49 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package job
+
+import (
+	"errors"
+
+	"github.com/cwbriscoe/goweb/auth"
+)
+
+// rehash is the built in job reporting the password hashes that will be replaced on
+// the next signin and wrapping the legacy ones with ManagerOptions.Hasher.  The path of
+// the secrets file is read from the "secrets" job parm, the "dryRun" and "batch" parms
+// are optional.
+func (m *Manager) rehash(e *Entry) error {
+	var secrets string
+	if err := e.GetParm("secrets", 0, &secrets); err != nil {
+		return err
+	}
+	if secrets == "" {
+		return errors.New("rehash: the secrets job parm is required")
+	}
+
+	if m.hasher == nil {
+		return errors.New("rehash: the manager has no password hasher")
+	}
+
+	opts := &auth.RehashOptions{Hasher: m.hasher}
+	if err := e.GetParm("dryRun", 0, &opts.DryRun); err != nil {
+		return err
+	}
+	if err := e.GetParm("batch", 0, &opts.BatchSize); err != nil {
+		return err
+	}
+	opts.Progress = func(r *auth.RehashReport) {
+		e.Log.Debug().Msgf("rehash: %d hashes scanned", r.Scanned)
+	}
+
+	report, err := auth.ScanHashes(e.Ctx, e.DB, secrets, opts)
+	if err != nil {
+		return err
+	}
+	e.Log.Info().Msgf("rehash: %d scanned, %d current, %d outdated, %d legacy, %d rewrapped, %d invalid",
+		report.Scanned, report.Current, report.Outdated, report.Legacy, report.Rewrapped, report.Invalid)
+	for kind, count := range report.Kinds {
+		e.Log.Info().Msgf("rehash: %d %s", count, kind)
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package job
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/cwbriscoe/goweb/query"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// UpcomingRun is a run of a job the manager is expected to submit.
+type UpcomingRun struct {
+	JobID     int       `json:"jobId"`
+	Name      string    `json:"name"`
+	Function  string    `json:"function"`
+	At        time.Time `json:"at"` // the earliest time the run is submitted
+	Priority  int       `json:"priority"`
+	Exclusive bool      `json:"exclusive"` // no other job is submitted while it runs
+	Overdue   bool      `json:"overdue"`   // the job is due now, it waits for a scan, a free slot or an exclusive job
+	Running   bool      `json:"running"`   // the job is running, the run waits for it to end unless multiple runs are allowed
+}
+
+// scheduledJob is an enabled job entry and its last run.
+type scheduledJob struct {
+	id        int
+	name      string
+	function  string
+	every     time.Duration
+	priority  int
+	exclusive bool
+	multiple  bool
+	lastRun   time.Time
+	running   bool
+}
+
+var qScheduledJobs = query.Query{
+	Name: "scheduledJobs",
+	SQL: `
+select entry.job_id
+      ,entry.name
+      ,entry.function
+      ,extract(epoch from entry.every)::float8
+      ,entry.priority
+      ,entry.exclusive
+      ,entry.multiple
+      ,entry.last_run_ts
+      ,exists(select 1 from {schema}.active where active.job_id = entry.job_id)
+  from {schema}.entry
+ where entry.enabled = true;`,
+}
+
+// UpcomingRuns returns the next runs of the enabled jobs within window, at most limit
+// of them, in the order they are expected to be submitted.  Jobs are due every interval
+// after their last run and are not submitted more often than the scan interval.  The
+// schedule assumes runs end as soon as they start, so runs of long jobs come later than
+// listed.  Jobs already due are listed as overdue at the current time.
+func (m *Manager) UpcomingRuns(ctx context.Context, window time.Duration, limit int) ([]UpcomingRun, error) {
+	jobs, err := scheduledJobs(ctx, m.db, m.schema)
+	if err != nil {
+		return nil, err
+	}
+	return projectRuns(jobs, m.clock.Now(), window, m.interval, limit), nil
+}
+
+// UpcomingRuns returns the next runs of the enabled jobs of schema, DefaultSchema when
+// empty, within window, at most limit of them, for processes without a Manager.  See
+// Manager.UpcomingRuns.
+func UpcomingRuns(ctx context.Context, db *pgxpool.Pool, schema string, window time.Duration, limit int) ([]UpcomingRun, error) {
+	jobs, err := scheduledJobs(ctx, db, schemaOf(schema))
+	if err != nil {
+		return nil, err
+	}
+	return projectRuns(jobs, time.Now(), window, 0, limit), nil
+}
+
+func scheduledJobs(ctx context.Context, db *pgxpool.Pool, schema query.Schema) ([]*scheduledJob, error) {
+	rows, err := schema.Query(ctx, db, qScheduledJobs)
+	if err != nil {
+		return nil, err
+	}
+
+	jobs, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (*scheduledJob, error) {
+		j := &scheduledJob{}
+		var every float64
+		err := row.Scan(&j.id, &j.name, &j.function, &every, &j.priority, &j.exclusive, &j.multiple, &j.lastRun, &j.running)
+		j.every = time.Duration(every * float64(time.Second))
+		return j, err
+	})
+	if err != nil {
+		return nil, query.Wrap(qScheduledJobs, err)
+	}
+
+	return jobs, nil
+}
+
+// projectRuns lists the runs of the jobs from now to now + window, sorted by time and
+// then priority like the manager picks them.  Jobs are never submitted more often than
+// the scan interval of the manager.
+func projectRuns(jobs []*scheduledJob, now time.Time, window, scan time.Duration, limit int) []UpcomingRun {
+	end := now.Add(window)
+	var runs []UpcomingRun
+	for _, j := range jobs {
+		step := max(j.every, scan, time.Second)
+		at := j.lastRun.Add(j.every)
+		overdue := !at.After(now)
+		if overdue {
+			at = now
+		}
+		running := j.running && !j.multiple
+
+		for n := 0; !at.After(end) && (limit <= 0 || n < limit); n++ {
+			runs = append(runs, UpcomingRun{
+				JobID:     j.id,
+				Name:      j.name,
+				Function:  j.function,
+				At:        at,
+				Priority:  j.priority,
+				Exclusive: j.exclusive,
+				Overdue:   overdue,
+				Running:   running,
+			})
+			overdue, running = false, false
+			at = at.Add(step)
+		}
+	}
+
+	sort.SliceStable(runs, func(a, b int) bool {
+		if !runs[a].At.Equal(runs[b].At) {
+			return runs[a].At.Before(runs[b].At)
+		}
+		return runs[a].Priority < runs[b].Priority
+	})
+	if limit > 0 && len(runs) > limit {
+		runs = runs[:limit]
+	}
+	return runs
+}
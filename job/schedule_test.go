@@ -0,0 +1,48 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package job
+
+import (
+	"testing"
+	"time"
+)
+
+func TestProjectRuns(t *testing.T) {
+	now := time.Date(2023, 6, 1, 18, 0, 0, 0, time.UTC)
+	jobs := []*scheduledJob{
+		{id: 1, name: "hourly", every: time.Hour, priority: 5, lastRun: now.Add(-30 * time.Minute)},
+		{id: 2, name: "nightly", every: 24 * time.Hour, priority: 1, lastRun: now.Add(-20 * time.Hour), exclusive: true},
+		{id: 3, name: "late", every: time.Hour, priority: 9, lastRun: now.Add(-2 * time.Hour), running: true},
+		{id: 4, name: "often", every: 0, priority: 1, lastRun: now.Add(time.Hour)},
+	}
+
+	runs := projectRuns(jobs, now, 6*time.Hour, 10*time.Minute, 0)
+
+	// late is overdue and running, hourly comes at 18:30 then every hour, nightly at 22:00.
+	if first := runs[0]; first.JobID != 3 || !first.At.Equal(now) || !first.Overdue || !first.Running {
+		t.Errorf("expected the overdue late job first, got %+v", first)
+	}
+	counts := make(map[int]int)
+	for i, run := range runs {
+		counts[run.JobID]++
+		if i > 0 && run.At.Before(runs[i-1].At) {
+			t.Errorf("runs are not sorted: %v before %v", runs[i-1].At, run.At)
+		}
+		if run.JobID == 3 && !run.At.Equal(now) && (run.Overdue || run.Running) {
+			t.Errorf("only the first run is overdue or waits: %+v", run)
+		}
+	}
+	// hourly: 18:30 .. 23:30, late: 18:00 .. 24:00, nightly: 22:00, often: every 10 minutes from 19:00.
+	want := map[int]int{1: 6, 2: 1, 3: 7, 4: 31}
+	for id, n := range want {
+		if counts[id] != n {
+			t.Errorf("job %d: expected %d runs, got %d", id, n, counts[id])
+		}
+	}
+
+	// at 19:00 often comes before late, it has a higher priority.
+	limited := projectRuns(jobs, now, 6*time.Hour, 10*time.Minute, 3)
+	if len(limited) != 3 || limited[0].JobID != 3 || limited[1].JobID != 1 || limited[2].JobID != 4 {
+		t.Errorf("expected late, hourly, often, got %+v", limited)
+	}
+}
@@ -5,9 +5,155 @@ package job
 import (
 	"context"
 
+	"github.com/cwbriscoe/goweb/migrate"
 	"github.com/jackc/pgx/v5"
 )
 
+// Migrations lists the changes to the job schema, add new migrations to the end.  The
+// baseline only creates the original tables when they are missing, so applying the set
+// to a database created before the migrations were recorded brings it up to date.
+var Migrations = migrate.Set{
+	Name:   "job",
+	Schema: "job",
+	Migrations: []migrate.Migration{
+		{Version: 1, Name: "baseline", SQL: `
+create table if not exists {schema}.entry (
+	job_id int4 not null,
+	"name" varchar not null,
+	"function" varchar not null,
+	"every" interval not null,
+	priority int4 not null,
+	enabled bool not null,
+	"exclusive" bool not null,
+	multiple bool not null,
+	last_run_ts timestamptz not null,
+	constraint entry_pk primary key (job_id)
+);
+grant select, update on table {schema}.entry to job;
+create table if not exists {schema}.active (
+	run_id int4 not null generated always as identity( increment by 1 minvalue 1 maxvalue 2147483647 start 1 cache 1 no cycle),
+	job_id int4 not null,
+	start_ts timestamptz not null,
+	constraint active_pk primary key (run_id),
+	constraint active_fk foreign key (job_id) references {schema}.entry(job_id) on delete cascade
+);
+grant select, insert, update, delete on table {schema}.active to job;
+create table if not exists {schema}.completed (
+	run_id int4 not null,
+	job_id int4 not null,
+	start_ts timestamptz not null,
+	finish_ts timestamptz not null,
+	status varchar not null,
+	constraint completed_pk primary key (run_id),
+	constraint completed_fk foreign key (job_id) references {schema}.entry(job_id) on delete cascade
+);
+grant select, insert, update, delete on table {schema}.completed to job;
+create table if not exists {schema}.parm (
+	job varchar not null,
+	"key" varchar not null,
+	seq int4 not null,
+	"data" jsonb not null,
+	constraint parm_pk primary key (job, key, seq)
+);
+grant select, insert, update, delete on table {schema}.parm to job;
+create table if not exists {schema}.etag (
+	id int8 not null,
+	etag varchar not null,
+	last_update_ts timestamptz not null,
+	constraint etag_pk primary key (id)
+);
+grant select, insert, update, delete on table {schema}.etag to job;`},
+		{Version: 2, Name: "api schedule access", SQL: `
+grant select on table {schema}.entry, {schema}.active to api;`},
+		{Version: 3, Name: "preemption", SQL: `
+alter table {schema}.entry add column preempt bool not null default false;
+create table {schema}.event (
+	event_id int8 not null generated always as identity,
+	job_id int4 not null,
+	run_id int4 null,
+	event varchar not null,
+	detail varchar not null,
+	event_ts timestamptz not null,
+	constraint event_pk primary key (event_id)
+);
+create index event_job_idx on {schema}.event using btree (job_id, event_ts);
+alter table {schema}.event add constraint event_fk foreign key (job_id) references {schema}.entry(job_id) on delete cascade;
+grant select, insert, delete on table {schema}.event to job;`},
+		{Version: 4, Name: "run stats", SQL: `
+create table {schema}.run_stats (
+	run_id int4 not null,
+	job_id int4 not null,
+	"name" varchar not null,
+	value int8 not null,
+	constraint run_stats_pk primary key (run_id, name)
+);
+create index run_stats_job_idx on {schema}.run_stats using btree (job_id, name);
+alter table {schema}.run_stats add constraint run_stats_fk foreign key (job_id) references {schema}.entry(job_id) on delete cascade;
+grant select, insert, delete on table {schema}.run_stats to job;
+grant select on table {schema}.run_stats, {schema}.completed to api;`},
+		{Version: 5, Name: "file checksums", SQL: `
+create table {schema}.file (
+	id int8 not null,
+	path varchar not null,
+	checksum varchar not null,
+	size int8 not null,
+	check_ts timestamptz not null,
+	change_ts timestamptz not null,
+	constraint file_pk primary key (id)
+);
+grant select, insert, update, delete on table {schema}.file to job;`},
+		{Version: 6, Name: "job environment", SQL: `
+create table {schema}.env (
+	job_id int4 not null,
+	"name" varchar not null,
+	value varchar not null,
+	secret bool not null default false,
+	constraint env_pk primary key (job_id, name)
+);
+alter table {schema}.env add constraint env_fk foreign key (job_id) references {schema}.entry(job_id) on delete cascade;
+grant select, insert, update, delete on table {schema}.env to job;`},
+		{Version: 7, Name: "pages", SQL: `
+create table {schema}.page (
+	group_name varchar not null,
+	path varchar not null,
+	body bytea not null,
+	content_type varchar not null,
+	etag varchar not null,
+	ttl int4 not null,
+	render_ts timestamptz not null,
+	constraint page_pk primary key (group_name, path)
+);
+grant select, insert, update, delete on table {schema}.page to job;
+grant select on table {schema}.page to api;`},
+		{Version: 8, Name: "etag statistics", SQL: `
+alter table {schema}.etag add column if not exists url varchar not null default '';
+alter table {schema}.etag add column if not exists hits int8 not null default 0;
+alter table {schema}.etag add column if not exists misses int8 not null default 0;
+alter table {schema}.etag add column if not exists size int8 not null default 0;
+alter table {schema}.etag add column if not exists saved_bytes int8 not null default 0;
+alter table {schema}.etag add column if not exists last_check_ts timestamptz not null default now();
+grant select on table {schema}.etag to api;`},
+		{Version: 9, Name: "sitemap pings", SQL: `
+create table if not exists {schema}.ping (
+	engine varchar not null,
+	id int8 not null,
+	url varchar not null,
+	etag varchar not null,
+	status int4 not null,
+	response varchar not null,
+	submit_ts timestamptz not null,
+	constraint ping_pk primary key (engine, id)
+);
+grant select, insert, update, delete on table {schema}.ping to job;`},
+		{Version: 10, Name: "file state per job", SQL: `
+delete from {schema}.file;
+alter table {schema}.file add column job_id int4 not null;
+alter table {schema}.file drop constraint file_pk;
+alter table {schema}.file add constraint file_pk primary key (job_id, id);
+alter table {schema}.file add constraint file_fk foreign key (job_id) references {schema}.entry(job_id) on delete cascade;`},
+	},
+}
+
 // CreateSchema will create the job schema and associated tables needed
 // for this package to run
 func CreateSchema(ctx context.Context, conn *pgx.Conn) error {
@@ -26,112 +172,12 @@ func CreateSchema(ctx context.Context, conn *pgx.Conn) error {
 		return err
 	}
 
-	sql = `
-	CREATE TABLE job.entry (
-		job_id int4 NOT NULL,
-		"name" varchar NOT NULL,
-		"function" varchar NOT NULL,
-		"every" interval NOT NULL,
-		priority int4 NOT NULL,
-		enabled bool NOT NULL,
-		"exclusive" bool NOT NULL,
-		multiple bool NOT NULL,
-		last_run_ts timestamptz NOT NULL,
-		CONSTRAINT entry_pk PRIMARY KEY (job_id)
-	); `
-	_, err = conn.Exec(ctx, sql)
-	if err != nil {
-		return err
-	}
-
-	sql = "grant select, update on table job.entry to job;"
-	_, err = conn.Exec(ctx, sql)
-	if err != nil {
-		return err
-	}
-
-	sql = `
-	CREATE TABLE job.active (
-		run_id int4 NOT NULL GENERATED ALWAYS AS IDENTITY( INCREMENT BY 1 MINVALUE 1 MAXVALUE 2147483647 START 1 CACHE 1 NO CYCLE),
-		job_id int4 NOT NULL,
-		start_ts timestamptz NOT NULL,
-		CONSTRAINT active_pk PRIMARY KEY (run_id)
-	);`
-	_, err = conn.Exec(ctx, sql)
-	if err != nil {
-		return err
-	}
-
-	sql = "grant select, insert, update, delete on table job.active to job;"
-	_, err = conn.Exec(ctx, sql)
-	if err != nil {
-		return err
-	}
-
-	sql = "alter table job.active add constraint active_fk foreign key (job_id) references job.entry(job_id) on delete cascade;"
-	_, err = conn.Exec(ctx, sql)
-	if err != nil {
-		return err
-	}
-
-	sql = `
-	CREATE TABLE job.completed (
-		run_id int4 NOT NULL,
-		job_id int4 NOT NULL,
-		start_ts timestamptz NOT NULL,
-		finish_ts timestamptz NOT NULL,
-		status varchar NOT NULL,
-		CONSTRAINT completed_pk PRIMARY KEY (run_id)
-	); `
-	_, err = conn.Exec(ctx, sql)
-	if err != nil {
-		return err
-	}
-
-	sql = "grant select, insert, update, delete on table job.completed to job;"
-	_, err = conn.Exec(ctx, sql)
-	if err != nil {
-		return err
-	}
-
-	sql = "alter table job.completed add constraint completed_fk foreign key (job_id) references job.entry(job_id) on delete cascade;"
-	_, err = conn.Exec(ctx, sql)
-	if err != nil {
-		return err
-	}
-
-	sql = `
-	CREATE TABLE job.parm (
-		job varchar NOT NULL,
-		"key" varchar NOT NULL,
-		seq int4 NOT NULL,
-		"data" jsonb NOT NULL,
-		CONSTRAINT parm_pk PRIMARY KEY (job, key, seq)
-	);`
-	_, err = conn.Exec(ctx, sql)
-	if err != nil {
-		return err
-	}
-
-	sql = "grant select, insert, update, delete on table job.parm to job;"
-	_, err = conn.Exec(ctx, sql)
-	if err != nil {
-		return err
-	}
-
-	sql = `
-	CREATE TABLE job.etag (
-		id int8 NOT NULL,
-		etag varchar NOT NULL,
-		last_update_ts timestamptz NOT NULL,
-		CONSTRAINT etag_pk PRIMARY KEY (id)
-	);`
-	_, err = conn.Exec(ctx, sql)
+	_, err = migrate.Apply(ctx, conn, &Migrations)
 	if err != nil {
 		return err
 	}
 
-	sql = "grant select, insert, update, delete on table job.etag to job;"
+	sql = "grant select on table job.schema_version to job, api;"
 	_, err = conn.Exec(ctx, sql)
 	if err != nil {
 		return err
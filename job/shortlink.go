@@ -0,0 +1,34 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package job
+
+import (
+	"time"
+
+	"github.com/cwbriscoe/goweb/shortlink"
+)
+
+// purgeLinks is the built in job deleting short links that expired more than the
+// "days" job parm ago, 30 by default.
+func (m *Manager) purgeLinks(e *Entry) error {
+	days := 30
+	if err := e.GetParm("days", 0, &days); err != nil {
+		return err
+	}
+	if days <= 0 {
+		days = 30
+	}
+
+	store := m.linkStore(e)
+	cnt, err := store.Purge(e.Ctx, time.Duration(days)*24*time.Hour)
+	if err != nil {
+		return err
+	}
+	e.Log.Info().Msgf("purged %d short links expired more than %d days ago", cnt, days)
+	return nil
+}
+
+// linkStore returns a store of the short links in the configured schema.
+func (m *Manager) linkStore(e *Entry) *shortlink.Store {
+	return shortlink.NewStore(&shortlink.Settings{DB: e.DB, Schema: m.linkSchema})
+}
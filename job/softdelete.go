@@ -0,0 +1,36 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package job
+
+import (
+	"time"
+
+	"github.com/cwbriscoe/goweb/auth"
+)
+
+// purgeDeleted is the built in job removing the users, sessions and short links that
+// were soft deleted more than the "days" job parm ago, 30 by default.
+func (m *Manager) purgeDeleted(e *Entry) error {
+	days := 30
+	if err := e.GetParm("days", 0, &days); err != nil {
+		return err
+	}
+	if days <= 0 {
+		days = 30
+	}
+	retention := time.Duration(days) * 24 * time.Hour
+
+	users, sessions, err := auth.PurgeDeleted(e.Ctx, e.DB, e.Now().Add(-retention))
+	if err != nil {
+		return err
+	}
+	e.Log.Info().Msgf("purged %d users and %d sessions deleted more than %d days ago", users, sessions, days)
+
+	store := m.linkStore(e)
+	links, err := store.PurgeDeleted(e.Ctx, retention)
+	if err != nil {
+		return err
+	}
+	e.Log.Info().Msgf("purged %d short links deleted more than %d days ago", links, days)
+	return nil
+}
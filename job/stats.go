@@ -0,0 +1,170 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package job
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cwbriscoe/goweb/query"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/rs/zerolog"
+)
+
+// Names of the counters maintained by the package.  The rows copied by CopyFrom and
+// BatchInserter, the bytes of the responses recorded by RecordFetch and the warnings
+// written to the job log.
+const (
+	CounterRows     = "rows"
+	CounterBytes    = "bytes"
+	CounterWarnings = "warnings"
+)
+
+// Counter is a statistic of a run, saved in the run_stats table when the run ends.
+type Counter struct {
+	v atomic.Int64
+}
+
+// Add adds n to the counter.  It is safe for concurrent use.
+func (c *Counter) Add(n int64) {
+	c.v.Add(n)
+}
+
+// Value returns the current value of the counter.
+func (c *Counter) Value() int64 {
+	return c.v.Load()
+}
+
+// counters are the counters of a run.
+type counters struct {
+	sync.Mutex
+	m map[string]*Counter
+}
+
+// Counter returns the counter of the run with the name, creating it at zero.  The
+// counters are listed with the run by History, ie:
+//
+//	e.Counter("pages").Add(1)
+func (e *Entry) Counter(name string) *Counter {
+	e.counters.Lock()
+	defer e.counters.Unlock()
+	if e.counters.m == nil {
+		e.counters.m = make(map[string]*Counter)
+	}
+	c, ok := e.counters.m[name]
+	if !ok {
+		c = &Counter{}
+		e.counters.m[name] = c
+	}
+	return c
+}
+
+// Stats returns the values of the counters of the run.
+func (e *Entry) Stats() map[string]int64 {
+	e.counters.Lock()
+	defer e.counters.Unlock()
+	stats := make(map[string]int64, len(e.counters.m))
+	for name, c := range e.counters.m {
+		stats[name] = c.Value()
+	}
+	return stats
+}
+
+// warningHook counts the warnings and errors written to the job log.
+type warningHook struct {
+	c *Counter
+}
+
+func (h warningHook) Run(_ *zerolog.Event, level zerolog.Level, _ string) {
+	if level >= zerolog.WarnLevel && level <= zerolog.FatalLevel {
+		h.c.Add(1)
+	}
+}
+
+// Run is a completed run of a job and its counters.
+type Run struct {
+	RunID  int              `json:"runId"`
+	JobID  int              `json:"jobId"`
+	Name   string           `json:"name"`
+	Start  time.Time        `json:"start"`
+	Finish time.Time        `json:"finish"`
+	Status string           `json:"status"` // ok, error, preempted, panic or abandoned
+	Stats  map[string]int64 `json:"stats"`
+}
+
+var (
+	qInsertRunStats = query.Query{
+		Name: "insertRunStats",
+		SQL: `
+insert into {schema}.run_stats (run_id, job_id, name, value)
+select $1, $2, unnest($3::varchar[]), unnest($4::int8[]);`,
+	}
+	qHistory = query.Query{
+		Name: "history",
+		SQL: `
+select completed.run_id
+      ,completed.job_id
+      ,entry.name
+      ,completed.start_ts
+      ,completed.finish_ts
+      ,completed.status
+      ,coalesce((select jsonb_object_agg(run_stats.name, run_stats.value)
+                   from {schema}.run_stats
+                  where run_stats.run_id = completed.run_id), '{}'::jsonb)
+  from {schema}.completed
+  join {schema}.entry on entry.job_id = completed.job_id
+ where $1 = 0 or completed.job_id = $1
+ order by completed.finish_ts desc
+ limit $2;`,
+	}
+)
+
+// saveStats writes the counters of a run to the run_stats table.
+func (m *Manager) saveStats(entry *Entry) {
+	stats := entry.Stats()
+	if len(stats) == 0 {
+		return
+	}
+	names := make([]string, 0, len(stats))
+	values := make([]int64, 0, len(stats))
+	for name, value := range stats {
+		names = append(names, name)
+		values = append(values, value)
+	}
+	if _, err := m.schema.Exec(context.Background(), m.db, qInsertRunStats, entry.RunID, entry.JobID, names, values); err != nil {
+		m.log.Err(err).Msgf("error saving the stats of job %d", entry.RunID)
+	}
+}
+
+// History returns the last runs of the job with their counters, most recent first, at
+// most limit of them.  A jobID of zero returns the runs of all jobs.
+func (m *Manager) History(ctx context.Context, jobID, limit int) ([]Run, error) {
+	return history(ctx, m.db, m.schema, jobID, limit)
+}
+
+// History returns the last runs of the jobs of schema, DefaultSchema when empty, for
+// processes without a Manager.  See Manager.History.
+func History(ctx context.Context, db *pgxpool.Pool, schema string, jobID, limit int) ([]Run, error) {
+	return history(ctx, db, schemaOf(schema), jobID, limit)
+}
+
+func history(ctx context.Context, db *pgxpool.Pool, schema query.Schema, jobID, limit int) ([]Run, error) {
+	rows, err := schema.Query(ctx, db, qHistory, jobID, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	runs, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (Run, error) {
+		var r Run
+		err := row.Scan(&r.RunID, &r.JobID, &r.Name, &r.Start, &r.Finish, &r.Status, &r.Stats)
+		return r, err
+	})
+	if err != nil {
+		return nil, query.Wrap(qHistory, err)
+	}
+
+	return runs, nil
+}
@@ -0,0 +1,35 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package job
+
+import (
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+func TestCounters(t *testing.T) {
+	e := &Entry{}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			e.Counter("pages").Add(2)
+		}()
+	}
+	wg.Wait()
+
+	log := zerolog.New(io.Discard).Hook(warningHook{e.Counter(CounterWarnings)})
+	log.Info().Msg("info")
+	log.Warn().Msg("warn")
+	log.Error().Msg("error")
+
+	stats := e.Stats()
+	if len(stats) != 2 || stats["pages"] != 20 || stats[CounterWarnings] != 2 {
+		t.Errorf("unexpected stats: %v", stats)
+	}
+}
@@ -51,7 +51,7 @@ func (r *Limiter) checkUserAgent(ip, ua string) (string, bool) {
 	ual := strings.ToLower(ua)
 	for _, s := range uaStrings {
 		if strings.Contains(ual, s.text) {
-			r.vars.Log.Info().Msgf("%s(?) ua string bot match: %s", ip, s.text)
+			r.vars.Log.Info().Msgf("%s(?) ua string bot match: %s", r.logIP(ip), s.text)
 			return s.name, true
 		}
 	}
@@ -61,7 +61,12 @@ func (r *Limiter) checkUserAgent(ip, ua string) (string, bool) {
 func (r *Limiter) getHostName(ip string) (string, error) {
 	host, err := net.LookupAddr(ip)
 	if err != nil {
-		r.vars.Log.Err(err).Msg("")
+		// the lookup error contains the raw ip so only log it when not anonymizing.
+		if r.vars.Anonymizer.Enabled() {
+			r.vars.Log.Warn().Msgf("%s(?) reverse lookup failed", r.logIP(ip))
+		} else {
+			r.vars.Log.Err(err).Msg("")
+		}
 		return "", err
 	}
 	return host[0], nil
@@ -79,7 +84,7 @@ func (r *Limiter) getHostNameLoop(ip string) (string, error) {
 		}
 		retries++
 		if retries > 3 {
-			r.vars.Log.Info().Msgf("%s(?) too many errors, aborting validation", ip)
+			r.vars.Log.Info().Msgf("%s(?) too many errors, aborting validation", r.logIP(ip))
 			return "", err
 		}
 		time.Sleep(2 * time.Second)
@@ -90,7 +95,7 @@ func (r *Limiter) getHostNameLoop(ip string) (string, error) {
 func (r *Limiter) checkHostName(ip, host string) bool {
 	for _, s := range validDomains {
 		if strings.Contains(host, s) {
-			r.vars.Log.Info().Msgf("%s(?) hostname bot match: %s", ip, host)
+			r.vars.Log.Info().Msgf("%s(?) hostname bot match: %s", r.logIP(ip), host)
 			return true
 		}
 	}
@@ -100,12 +105,12 @@ func (r *Limiter) checkHostName(ip, host string) bool {
 func (r *Limiter) validateIPMatch(ip, host string) (bool, string, error) {
 	ipCheck, err := net.LookupIP(host)
 	if err != nil {
-		r.vars.Log.Info().Msgf("%s(?) returned error when trying to LookupIP(host): %s", ip, err.Error())
+		r.vars.Log.Info().Msgf("%s(?) returned error when trying to LookupIP(host): %s", r.logIP(ip), err.Error())
 		return false, "", err
 	}
 	ip2 := ipCheck[0].String()
 	if ip2 == ip {
-		r.vars.Log.Info().Msgf("%s(?) ip forward lookup matches: %s", ip, ip)
+		r.vars.Log.Info().Msgf("%s(?) ip forward lookup matches: %s", r.logIP(ip), r.logIP(ip))
 		return true, ip2, nil
 	}
 	return false, ip2, nil
@@ -120,7 +125,7 @@ func (r *Limiter) validateIPMatchLoop(ip, host string) (bool, string, error) {
 		}
 
 		if retries > 3 {
-			r.vars.Log.Info().Msgf("%s(?) too many errors, aborting validation", ip)
+			r.vars.Log.Info().Msgf("%s(?) too many errors, aborting validation", r.logIP(ip))
 			return false, "", err
 		}
 		time.Sleep(2 * time.Second)
@@ -128,12 +133,21 @@ func (r *Limiter) validateIPMatchLoop(ip, host string) (bool, string, error) {
 }
 
 func (r *Limiter) upgradeLimit(ip, host, name string) {
-	shared.gbotsmu.Lock()
-	defer shared.gbotsmu.Unlock()
-
-	shared.gbots[ip] = &botEntry{name, host}
+	r.registry.addGoodBot(ip, host, name)
 	visitor := r.createVisitor(ip, name, goodBot)
-	r.vars.Log.Info().Msgf("%s(%d) verfied %s Bot", ip, visitor.vtype, name)
+	r.vars.Log.Info().Msgf("%s(%d) verfied %s Bot", r.logIP(ip), visitor.vtype, name)
+}
+
+// downgradeLimit flags a visitor claiming to be a bot it could not be verified as, when
+// enabled.  The reverse dns of some legitimate crawlers is misconfigured, so it is off
+// by default and the mismatch is only logged.
+func (r *Limiter) downgradeLimit(ip, name string) {
+	if !r.vars.Tarpit.FlagFakeBots {
+		return
+	}
+	r.registry.FlagBadBot(ip, "fake "+name)
+	visitor := r.createVisitor(ip, "fake "+name, badBot)
+	r.vars.Log.Info().Msgf("%s(%d) flagged fake %s Bot", r.logIP(ip), visitor.vtype, name)
 }
 
 func (r *Limiter) routine(ip, ua string) {
@@ -148,7 +162,8 @@ func (r *Limiter) routine(ip, ua string) {
 	}
 
 	if !r.checkHostName(ip, host) {
-		r.vars.Log.Warn().Msgf("%s(?) ua bot match with unmatched host(%s), possible bad bot", ip, host)
+		r.vars.Log.Warn().Msgf("%s(?) ua bot match with unmatched host(%s), possible bad bot", r.logIP(ip), host)
+		r.downgradeLimit(ip, name)
 		return
 	}
 
@@ -158,42 +173,10 @@ func (r *Limiter) routine(ip, ua string) {
 	}
 
 	if !valid {
-		r.vars.Log.Warn().Msgf("%s(?) -> %s -> %s mismatches, possible bad bot", ip, host, ip2)
+		r.vars.Log.Warn().Msgf("%s(?) -> %s -> %s mismatches, possible bad bot", r.logIP(ip), host, r.logIP(ip2))
+		r.downgradeLimit(ip, name)
 		return
 	}
 
 	r.upgradeLimit(ip, host, name)
 }
-
-func isGoodBot(ip string) (bool, string) {
-	shared.gbotsmu.RLock()
-	defer shared.gbotsmu.RUnlock()
-	entry, exists := shared.gbots[ip]
-	if exists {
-		return true, entry.name
-	}
-	return false, ""
-}
-
-func isBadBot(ip string) (bool, string) {
-	shared.bbotsmu.RLock()
-	defer shared.bbotsmu.RUnlock()
-	entry, exists := shared.bbots[ip]
-	if exists {
-		return true, entry.name
-	}
-	return false, ""
-}
-
-// GetBotName will look for a good or bad bot and return its name if found
-func GetBotName(ip string) string {
-	valid, name := isGoodBot(ip)
-	if valid {
-		return name
-	}
-	valid, name = isBadBot(ip)
-	if valid {
-		return name
-	}
-	return ""
-}
@@ -4,34 +4,41 @@ package limiter
 
 import "time"
 
-func (s *sharedResources) daemon() {
+func (g *Registry) daemon() {
+	ticker := time.NewTicker(10 * time.Minute)
+	defer ticker.Stop()
 	for {
-		time.Sleep(10 * time.Minute)
-		s.trimVisitors()
+		select {
+		case <-g.stop:
+			return
+		case <-ticker.C:
+			g.trimVisitors()
+		}
+	}
+}
+
+func (g *Registry) trimVisitors() {
+	g.limitersmu.Lock()
+	defer g.limitersmu.Unlock()
+	for _, limiter := range g.limiters {
+		limiter.trim()
 	}
 }
 
-func (*sharedResources) trim(limiter *Limiter) {
+// trim removes the visitors not seen for an hour.
+func (r *Limiter) trim() {
 	var cnt, total int
-	now := time.Now()
-	limiter.Lock()
-	defer limiter.Unlock()
-	for k, v := range limiter.visitors {
+	now := r.clock.Now()
+	r.Lock()
+	defer r.Unlock()
+	for k, v := range r.visitors {
 		total++
 		if now.Sub(v.lastSeen) > time.Hour {
-			delete(limiter.visitors, k)
+			delete(r.visitors, k)
 			cnt++
 		}
 	}
 	if cnt > 0 {
-		limiter.vars.Log.Info().Msgf("daemon: %s: %d/%d visitors trimmed", limiter.vars.Name, cnt, total)
-	}
-}
-
-func (s *sharedResources) trimVisitors() {
-	s.limitersmu.Lock()
-	defer s.limitersmu.Unlock()
-	for _, limiter := range s.limiters {
-		s.trim(limiter)
+		r.vars.Log.Info().Msgf("daemon: %s: %d/%d visitors trimmed", r.vars.Name, cnt, total)
 	}
 }
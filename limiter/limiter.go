@@ -4,6 +4,7 @@
 package limiter
 
 import (
+	"context"
 	"errors"
 	"net/http"
 	"sync"
@@ -12,6 +13,8 @@ import (
 
 	"github.com/cwbriscoe/goutil/logging"
 	"github.com/cwbriscoe/goutil/net"
+	"github.com/cwbriscoe/goweb/clock"
+	"github.com/cwbriscoe/goweb/privacy"
 	"github.com/cwbriscoe/goweb/tracker"
 	"golang.org/x/time/rate"
 )
@@ -34,6 +37,7 @@ type visitor struct {
 	lastSeen   time.Time     // time of last request
 	delayCount uint64        // total number of times this visitor has been delayed
 	currDelays int64         // current number of delayed transactions
+	globalHeld int64         // current number of transactions waiting on the global limiter
 }
 
 // botEntry stores info for a search/crawler/spider bot
@@ -47,40 +51,40 @@ type Rate struct {
 	Interval   time.Duration // max interval between requests
 	Burst      int           // max number of transactions that can ignore the interval before the limiting begins
 	MaxDelayed uint64        // ignored for global rate limiter
+	MaxWait    time.Duration // global rate limiter only: max combined wait of a transaction, zero for no max
+	MaxShare   int           // global rate limiter only: max transactions of one visitor waiting on it, zero for no max
 }
 
 // LimitSettings contains the global, bot and user rate limit setttings.
 type LimitSettings struct {
 	Name        string
 	Log         *logging.Logger
+	Anonymizer  *privacy.Anonymizer // optional, anonymizes ip addresses written to the log
 	GlobalRate  Rate
 	GoodBotRate Rate
 	UserRate    Rate
+	Tarpit      Tarpit           // how flagged bad bots are handled
+	Registry    *Registry        // shares the known bots with other limiters, DefaultRegistry when nil
+	Tracker     *tracker.Tracker // reads the tracking cookie, tracker.Default when nil
+	Page        Page             // optional, the "slow down" page of the browsers rejected by WriteRejection
+	Clock       clock.Clock      // tells the time of the reservations and visits, clock.Real when nil
 }
 
 // Limiter contains variables and resources for a Limiter instance.
 type Limiter struct {
 	sync.RWMutex
 	vars     *LimitSettings
+	registry *Registry
+	tracker  *tracker.Tracker
 	global   *rate.Limiter // the global limiter if active
 	visitors map[string]*visitor
-}
-
-type sharedResources struct {
-	limiters   []*Limiter           // list of all limiters created
-	limitersmu sync.Mutex           // limiters slice mutex
-	gbotsmu    sync.RWMutex         // good bots map mutex
-	gbots      map[string]*botEntry // good bots map [ip]*botEntry
-	bbotsmu    sync.RWMutex         // bad bots mutex
-	bbots      map[string]*botEntry // bad bots map [ip]*botEntry
+	clock    clock.Clock
 }
 
 // ErrTooManyRequests is returned instead of delaying when the current
 // visitor has too many delayed transactions
 var ErrTooManyRequests = errors.New("Limiter: Too many current delays")
 
-var shared *sharedResources
-
 // NewLimiter creates a new rate limiter for one or more resources.
 func NewLimiter(settings *LimitSettings) (*Limiter, error) {
 	if settings.UserRate.Burst <= 0 {
@@ -103,43 +107,35 @@ func NewLimiter(settings *LimitSettings) (*Limiter, error) {
 
 	limiter := &Limiter{
 		vars:     settings,
+		registry: settings.Registry,
+		tracker:  settings.Tracker,
 		visitors: make(map[string]*visitor),
+		clock:    settings.Clock,
+	}
+	if limiter.clock == nil {
+		limiter.clock = clock.Real
+	}
+	if limiter.registry == nil {
+		limiter.registry = DefaultRegistry()
+	}
+	if limiter.tracker == nil {
+		limiter.tracker = tracker.Default()
 	}
 
 	if limiter.vars.GlobalRate.Burst > 0 {
 		limiter.global = rate.NewLimiter(rate.Every(limiter.vars.GlobalRate.Interval), limiter.vars.GlobalRate.Burst)
 	}
 
-	limiter.setupSharedResources()
+	limiter.registry.register(limiter)
 
 	limiter.vars.Log.Info().Msgf("%s limiter started", limiter.vars.Name)
 
 	return limiter, nil
 }
 
-// WriteErrorResponse is a utility function to write the correct http response
-// depending on the error return from the Limiter handler.
-func WriteErrorResponse(w http.ResponseWriter, err error) {
-	if err == ErrTooManyRequests {
-		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
-		return
-	}
-	http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-}
-
-// setupSharedResources sets up global vars and resources to be used by all instances of Limiter.
-func (r *Limiter) setupSharedResources() {
-	var once sync.Once
-	once.Do(func() {
-		shared = &sharedResources{
-			gbots: make(map[string]*botEntry),
-			bbots: make(map[string]*botEntry),
-		}
-		go shared.daemon()
-	})
-	shared.limitersmu.Lock()
-	defer shared.limitersmu.Unlock()
-	shared.limiters = append(shared.limiters, r)
+// logIP returns the ip address as it should appear in the logs.
+func (r *Limiter) logIP(ip string) string {
+	return r.vars.Anonymizer.IP(ip)
 }
 
 func (r *Limiter) getVisitorEntry(ip string) *visitor {
@@ -149,7 +145,7 @@ func (r *Limiter) getVisitorEntry(ip string) *visitor {
 	if !exists {
 		return nil
 	}
-	visitor.lastSeen = time.Now()
+	visitor.lastSeen = r.clock.Now()
 	return visitor
 }
 
@@ -170,12 +166,12 @@ func (r *Limiter) createVisitor(ip, name string, typ visitorType) *visitor {
 	}
 
 	limiter := rate.NewLimiter(rate.Every(interval), burst)
-	now := time.Now()
+	now := r.clock.Now()
 
 	r.Lock()
 	defer r.Unlock()
 
-	r.visitors[ip] = &visitor{name, limiter, typ, now, now, 0, 0}
+	r.visitors[ip] = &visitor{name: name, limiter: limiter, vtype: typ, firstSeen: now, lastSeen: now}
 	return r.visitors[ip]
 }
 
@@ -194,11 +190,11 @@ func (r *Limiter) logNewVisitor(ip, name string, typ visitorType, info *tracker.
 	} else {
 		uname = "anon"
 	}
-	r.vars.Log.Info().Msgf("%s(%d):%s %s: new visitor", ip, typ, uname, name)
+	r.vars.Log.Info().Msgf("%s(%d):%s %s: new visitor", r.logIP(ip), typ, uname, name)
 }
 
 func (r *Limiter) upgradeIfGoodBot(ip string, info *tracker.Info) (*rate.Limiter, string) {
-	isGoodBot, name := isGoodBot(ip)
+	isGoodBot, name := r.registry.isGoodBot(ip)
 	if isGoodBot {
 		visitor := r.createVisitor(ip, name, goodBot)
 		r.logNewVisitor(ip, r.vars.Name, goodBot, info)
@@ -208,7 +204,7 @@ func (r *Limiter) upgradeIfGoodBot(ip string, info *tracker.Info) (*rate.Limiter
 }
 
 func (r *Limiter) downgradeIfBadBot(ip string, info *tracker.Info) (*rate.Limiter, string) {
-	isBadBot, name := isBadBot(ip)
+	isBadBot, name := r.registry.isBadBot(ip)
 	if isBadBot {
 		visitor := r.createVisitor(ip, name, badBot)
 		r.logNewVisitor(ip, r.vars.Name, badBot, info)
@@ -248,68 +244,79 @@ func (r *Limiter) getLimiter(ip, ua string, info *tracker.Info, req *http.Reques
 			if info.Auth {
 				req.Header.Set("Visitor-Name", info.Name)
 			} else {
-				req.Header.Set("Visitor-Name", ip+"|"+info.Name)
+				req.Header.Set("Visitor-Name", r.logIP(ip)+"|"+info.Name)
 			}
 		} else {
-			req.Header.Set("Visitor-Name", ip)
+			req.Header.Set("Visitor-Name", r.logIP(ip))
 		}
 	}
 	return limiter
 }
 
-func (r *Limiter) globalDelay(ip string, delay time.Duration) {
-	r.vars.Log.Info().Msgf("%s %s: globally limited for %s", ip, r.vars.Name, delay.String())
-	time.Sleep(delay)
+// maxDelayed returns the max number of delayed transactions of the visitor.
+func (r *Limiter) maxDelayed(v *visitor) uint64 {
+	switch v.vtype {
+	case user:
+		return r.vars.UserRate.MaxDelayed
+	case goodBot:
+		return r.vars.GoodBotRate.MaxDelayed
+	default:
+		return 1
+	}
 }
 
-func (r *Limiter) visitorDelay(ip string, delay time.Duration) error {
+// wait delays the transaction of the visitor until both of its reservations are ready.
+// The delay of the visitor and the global delay overlap, so the transaction waits for
+// the longer one only.  It is rejected if the visitor has too many delayed transactions,
+// holds too many of the global limiter or would wait longer than the global max.
+func (r *Limiter) wait(ctx context.Context, ip string, visitorDelay, globalDelay time.Duration) error {
 	visitor := r.getVisitorEntry(ip)
 	if visitor == nil {
-		r.vars.Log.Error().Msgf("getVisitorEntry() returned nil for ip %s", ip)
+		r.vars.Log.Error().Msgf("getVisitorEntry() returned nil for ip %s", r.logIP(ip))
 		return nil
 	}
+	delay := max(visitorDelay, globalDelay)
 
-	atomic.AddUint64(&visitor.delayCount, 1)
-	atomic.AddInt64(&visitor.currDelays, 1)
-	cnt := atomic.LoadUint64(&visitor.delayCount)
-	curr := atomic.LoadInt64(&visitor.currDelays)
-
-	var maxDelayed uint64
-	switch visitor.vtype {
-	case user:
-		maxDelayed = r.vars.UserRate.MaxDelayed
-	case goodBot:
-		maxDelayed = r.vars.GoodBotRate.MaxDelayed
-	default:
-		maxDelayed = 1
-	}
+	if visitorDelay > 0 {
+		cnt := atomic.AddUint64(&visitor.delayCount, 1)
+		curr := atomic.AddInt64(&visitor.currDelays, 1)
+		defer atomic.AddInt64(&visitor.currDelays, -1)
 
-	var err error
-	doSleep := true
-	if maxDelayed > 0 && curr > int64(maxDelayed) {
-		doSleep = false
-		err = ErrTooManyRequests
+		if maxDelayed := r.maxDelayed(visitor); maxDelayed > 0 && curr > int64(maxDelayed) {
+			r.vars.Log.Warn().Msgf("%s(%d) %s: exceeded max limit of %d; tot limits = %d", r.logIP(ip), visitor.vtype, r.vars.Name, maxDelayed, cnt)
+			return r.tooManyRequests(visitor.limiter, delay)
+		}
+		r.vars.Log.Info().Msgf("%s(%d) %s: limited for %s; tot limits = %d; curr limits = %d", r.logIP(ip), visitor.vtype, r.vars.Name, visitorDelay.String(), cnt, curr)
 	}
 
-	if err != nil {
-		r.vars.Log.Warn().Msgf("%s(%d) %s: exceeded max limit of %d; tot limits = %d", ip, visitor.vtype, r.vars.Name, maxDelayed, cnt)
-	} else {
-		r.vars.Log.Info().Msgf("%s(%d) %s: limited for %s; tot limits = %d; curr limits = %d", ip, visitor.vtype, r.vars.Name, delay.String(), cnt, curr)
-	}
+	if globalDelay > 0 {
+		held := atomic.AddInt64(&visitor.globalHeld, 1)
+		defer atomic.AddInt64(&visitor.globalHeld, -1)
 
-	if doSleep {
-		time.Sleep(delay)
+		global := r.vars.GlobalRate
+		if global.MaxShare > 0 && held > int64(global.MaxShare) {
+			r.vars.Log.Warn().Msgf("%s(%d) %s: exceeded global share of %d", r.logIP(ip), visitor.vtype, r.vars.Name, global.MaxShare)
+			return r.tooManyRequests(visitor.limiter, delay)
+		}
+		if global.MaxWait > 0 && delay > global.MaxWait {
+			r.vars.Log.Warn().Msgf("%s(%d) %s: wait of %s exceeds global max of %s", r.logIP(ip), visitor.vtype, r.vars.Name, delay.String(), global.MaxWait.String())
+			return r.tooManyRequests(visitor.limiter, delay)
+		}
+		r.vars.Log.Info().Msgf("%s %s: globally limited for %s", r.logIP(ip), r.vars.Name, globalDelay.String())
 	}
 
-	if curr > 0 {
-		atomic.AddInt64(&visitor.currDelays, -1)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-
-	return err
 }
 
 // limit will limit the ip address based on the configured settings for the resources it limits.
-func (r *Limiter) limit(ip string, info *tracker.Info, req *http.Request) error {
+func (r *Limiter) limit(ctx context.Context, ip string, info *tracker.Info, req *http.Request) error {
 	// if no ip is passed, just return
 	if ip == "" {
 		return errors.New("limiter ip address was empty")
@@ -320,36 +327,58 @@ func (r *Limiter) limit(ip string, info *tracker.Info, req *http.Request) error
 	// get a limiter for the ip address
 	limiter := r.getLimiter(ip, ua, info, req)
 
+	// reserve the global limiter before the one of the visitor so both waits run at
+	// the same time instead of one after the other.
+	now := r.clock.Now()
+	var global *rate.Reservation
+	var globalDelay time.Duration
+	if r.global != nil {
+		global = r.global.ReserveN(now, 1)
+		globalDelay = global.DelayFrom(now)
+	}
+
 	// get a reservation to perform the request
-	reservation := limiter.Reserve()
+	reservation := limiter.ReserveN(now, 1)
 
 	// see how long we need to delay if at all
-	delay := reservation.Delay()
-	if delay > 0 {
-		if err := r.visitorDelay(ip, delay); err != nil {
-			reservation.Cancel()
-			return err
-		}
+	delay := reservation.DelayFrom(now)
+	if delay <= 0 && globalDelay <= 0 {
+		return nil
 	}
 
-	// now do the same delay if there is a global limiter
-	if r.global != nil {
-		reservation = r.global.Reserve()
-		delay = reservation.Delay()
-		if delay > 0 {
-			r.globalDelay(ip, delay)
+	if err := r.wait(ctx, ip, delay, globalDelay); err != nil {
+		// give back the tokens of a rejected or canceled transaction.
+		now = r.clock.Now()
+		reservation.CancelAt(now)
+		if global != nil {
+			global.CancelAt(now)
 		}
+		return err
 	}
 
 	return nil
 }
 
 // LimitRequest will get the true ip address from the request and will limit the ip address based
-// on the configured settings for the resources it limits.
+// on the configured settings for the resources it limits.  The wait ends early with the error of
+// the context when the request is canceled.
 func (r *Limiter) LimitRequest(w http.ResponseWriter, req *http.Request) error {
 	ip := net.GetIP(req)
 
-	info := tracker.GetTrackingInfo(w, req)
+	if err := r.tarpit(w, req, ip); err != nil {
+		return err
+	}
 
-	return r.limit(ip, info, req)
+	info := r.tracker.GetTrackingInfo(w, req)
+
+	return r.limit(req.Context(), ip, info, req)
+}
+
+// GoodBotBudget returns the number of requests per day the limiter allows a verified bot.
+func (r *Limiter) GoodBotBudget() float64 {
+	rate := r.vars.GoodBotRate
+	if rate.Interval <= 0 {
+		return 0
+	}
+	return float64(rate.Burst) + float64(24*time.Hour)/float64(rate.Interval)
 }
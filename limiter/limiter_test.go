@@ -0,0 +1,136 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package limiter
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cwbriscoe/goutil/logging"
+	"github.com/cwbriscoe/goweb/clock"
+	"github.com/rs/zerolog"
+)
+
+func newTestLimiter(t *testing.T, user, global Rate) *Limiter {
+	t.Helper()
+	log := zerolog.Nop()
+	registry := NewRegistry()
+	t.Cleanup(registry.Close)
+	l, err := NewLimiter(&LimitSettings{
+		Name:       "test",
+		Log:        &logging.Logger{Logger: &log},
+		Registry:   registry,
+		UserRate:   user,
+		GlobalRate: global,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func limitIP(ctx context.Context, l *Limiter, ip string) error {
+	r := httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+	r.RemoteAddr = ip + ":1234"
+	return l.LimitRequest(httptest.NewRecorder(), r)
+}
+
+func TestGlobalDelayOverlapsVisitorDelay(t *testing.T) {
+	l := newTestLimiter(t, Rate{Interval: 100 * time.Millisecond, Burst: 1}, Rate{Interval: 100 * time.Millisecond, Burst: 1})
+
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		if err := limitIP(context.Background(), l, "192.0.2.1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond || elapsed > 180*time.Millisecond {
+		t.Errorf("expected one delay of 100ms, got %s", elapsed)
+	}
+}
+
+func TestGlobalMaxWait(t *testing.T) {
+	l := newTestLimiter(t, Rate{Interval: time.Nanosecond, Burst: 10}, Rate{Interval: time.Second, Burst: 1, MaxWait: 100 * time.Millisecond})
+
+	if err := limitIP(context.Background(), l, "192.0.2.1"); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	err := limitIP(context.Background(), l, "192.0.2.2")
+	var rej *Rejection
+	if !errors.As(err, &rej) || !errors.Is(err, ErrTooManyRequests) {
+		t.Fatalf("expected a rejection, got %v", err)
+	}
+	if rej.RetryAfter <= 100*time.Millisecond || time.Since(start) > 50*time.Millisecond {
+		t.Errorf("expected an immediate rejection with a retry over the max wait, got %s after %s", rej.RetryAfter, time.Since(start))
+	}
+}
+
+func TestGlobalShareAndCancel(t *testing.T) {
+	l := newTestLimiter(t, Rate{Interval: time.Nanosecond, Burst: 10}, Rate{Interval: time.Second, Burst: 1, MaxShare: 1})
+
+	if err := limitIP(context.Background(), l, "192.0.2.1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the second request of the visitor waits on the global limiter.
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- limitIP(ctx, l, "192.0.2.1") }()
+	time.Sleep(50 * time.Millisecond)
+
+	// the third goes over the share of the visitor.
+	if err := limitIP(context.Background(), l, "192.0.2.1"); !errors.Is(err, ErrTooManyRequests) {
+		t.Errorf("expected the visitor share to be exceeded, got %v", err)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("expected the wait to be canceled, got %v", err)
+		}
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("the wait was not canceled")
+	}
+}
+
+func TestLimiterClock(t *testing.T) {
+	l := newTestLimiter(t, Rate{Interval: time.Hour, Burst: 1, MaxDelayed: 1}, Rate{})
+	fake := clock.NewFake(time.Now())
+	l.clock = fake
+
+	// a second request within the hour would wait, the fake hour passes at once.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	for i := 0; i < 2; i++ {
+		if err := limitIP(ctx, l, "10.0.0.1"); err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+		fake.Advance(time.Hour)
+	}
+
+	fake.Advance(time.Hour)
+	l.trim()
+	if len(l.visitors) != 0 {
+		t.Errorf("expected the visitor to be trimmed, %d left", len(l.visitors))
+	}
+}
+
+func TestDowngradeLimit(t *testing.T) {
+	rate := Rate{Interval: time.Second, Burst: 1}
+	l := newTestLimiter(t, rate, rate)
+	l.downgradeLimit("10.0.0.1", "Google")
+	if bad, _ := l.registry.isBadBot("10.0.0.1"); bad {
+		t.Error("expected a reverse dns mismatch not to flag the visitor by default")
+	}
+
+	l.vars.Tarpit.FlagFakeBots = true
+	l.downgradeLimit("10.0.0.1", "Google")
+	if bad, name := l.registry.isBadBot("10.0.0.1"); !bad || name != "fake Google" {
+		t.Errorf("expected the visitor to be flagged as a fake bot, got %t %q", bad, name)
+	}
+}
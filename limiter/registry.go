@@ -0,0 +1,149 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package limiter
+
+import "sync"
+
+// Registry holds the state shared by a set of limiters: the verified good bots, the
+// flagged bad bots, the open tarpits and the daemon that trims idle visitors.  A server
+// owns one registry for all of its limiters so a bot verified or flagged by one limiter
+// is known to the others.  Registries are independent of each other, so several servers
+// or tests can run in the same process.
+type Registry struct {
+	limiters    []*Limiter           // limiters using the registry
+	limitersmu  sync.Mutex           // limiters slice mutex
+	gbots       map[string]*botEntry // good bots map [ip]*botEntry
+	gbotsmu     sync.RWMutex         // good bots map mutex
+	bbots       map[string]*botEntry // bad bots map [ip]*botEntry
+	bbotsmu     sync.RWMutex         // bad bots mutex
+	openTarpits int64                // drip responses currently open
+	stop        chan struct{}        // closed to stop the daemon
+	closeOnce   sync.Once
+}
+
+// NewRegistry returns a new Registry and starts its daemon.  Close stops it.
+func NewRegistry() *Registry {
+	g := &Registry{
+		gbots: make(map[string]*botEntry),
+		bbots: make(map[string]*botEntry),
+		stop:  make(chan struct{}),
+	}
+	go g.daemon()
+	return g
+}
+
+var (
+	defaultRegistry     *Registry
+	defaultRegistryOnce sync.Once
+)
+
+// DefaultRegistry returns the registry of the limiters created without one.
+func DefaultRegistry() *Registry {
+	defaultRegistryOnce.Do(func() {
+		defaultRegistry = NewRegistry()
+	})
+	return defaultRegistry
+}
+
+// Close stops the daemon and releases the limiters.  The limiters keep working, but
+// their idle visitors are no longer trimmed.
+func (g *Registry) Close() {
+	g.closeOnce.Do(func() {
+		close(g.stop)
+		g.limitersmu.Lock()
+		g.limiters = nil
+		g.limitersmu.Unlock()
+	})
+}
+
+// register adds the limiter to the ones trimmed by the daemon.
+func (g *Registry) register(limiter *Limiter) {
+	g.limitersmu.Lock()
+	defer g.limitersmu.Unlock()
+	g.limiters = append(g.limiters, limiter)
+}
+
+func (g *Registry) addGoodBot(ip, host, name string) {
+	g.gbotsmu.Lock()
+	defer g.gbotsmu.Unlock()
+	g.gbots[ip] = &botEntry{name, host}
+}
+
+// FlagBadBot marks an ip address as a bad bot for all limiters of the registry.
+func (g *Registry) FlagBadBot(ip, name string) {
+	g.bbotsmu.Lock()
+	defer g.bbotsmu.Unlock()
+	g.bbots[ip] = &botEntry{name: name}
+}
+
+func (g *Registry) isGoodBot(ip string) (bool, string) {
+	if g == nil {
+		return false, ""
+	}
+	g.gbotsmu.RLock()
+	defer g.gbotsmu.RUnlock()
+	entry, exists := g.gbots[ip]
+	if exists {
+		return true, entry.name
+	}
+	return false, ""
+}
+
+func (g *Registry) isBadBot(ip string) (bool, string) {
+	if g == nil {
+		return false, ""
+	}
+	g.bbotsmu.RLock()
+	defer g.bbotsmu.RUnlock()
+	entry, exists := g.bbots[ip]
+	if exists {
+		return true, entry.name
+	}
+	return false, ""
+}
+
+// BotName returns the name of the good or bad bot at the ip address or an empty string.
+// A nil registry knows no bots.
+func (g *Registry) BotName(ip string) string {
+	if valid, name := g.isGoodBot(ip); valid {
+		return name
+	}
+	if valid, name := g.isBadBot(ip); valid {
+		return name
+	}
+	return ""
+}
+
+// VisitorKind returns "goodbot" or "badbot" for verified bots and "user" for everyone else.
+func (g *Registry) VisitorKind(ip string) string {
+	if valid, _ := g.isGoodBot(ip); valid {
+		return "goodbot"
+	}
+	if valid, _ := g.isBadBot(ip); valid {
+		return "badbot"
+	}
+	return "user"
+}
+
+// FlagBadBot marks an ip address as a bad bot for all limiters of the default registry.
+func FlagBadBot(ip, name string) {
+	DefaultRegistry().FlagBadBot(ip, name)
+}
+
+// GetBotName will look for a good or bad bot in the default registry and return its
+// name if found.
+func GetBotName(ip string) string {
+	return DefaultRegistry().BotName(ip)
+}
+
+// VisitorKind returns the kind of the visitor at the ip address in the default registry.
+func VisitorKind(ip string) string {
+	return DefaultRegistry().VisitorKind(ip)
+}
+
+// StopDaemon stops the daemon of the default registry.
+//
+// Deprecated: give the limiters a Registry and Close it instead.
+func StopDaemon() {
+	DefaultRegistry().Close()
+}
@@ -0,0 +1,44 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package limiter
+
+import "testing"
+
+func TestRegistriesAreIndependent(t *testing.T) {
+	a, b := NewRegistry(), NewRegistry()
+	defer a.Close()
+	defer b.Close()
+
+	a.FlagBadBot("10.0.0.1", "scraper")
+	a.addGoodBot("10.0.0.2", "crawl.googlebot.com.", "Google")
+
+	if kind := a.VisitorKind("10.0.0.1"); kind != "badbot" {
+		t.Errorf("expected badbot, got %s", kind)
+	}
+	if name := a.BotName("10.0.0.2"); name != "Google" {
+		t.Errorf("expected Google, got %q", name)
+	}
+	if kind := b.VisitorKind("10.0.0.1"); kind != "user" {
+		t.Errorf("expected the other registry to see a user, got %s", kind)
+	}
+
+	var none *Registry
+	if kind := none.VisitorKind("10.0.0.1"); kind != "user" {
+		t.Errorf("expected a nil registry to see a user, got %s", kind)
+	}
+}
+
+func TestRegistryClose(t *testing.T) {
+	g := NewRegistry()
+	r := &Limiter{visitors: make(map[string]*visitor)}
+	g.register(r)
+	if len(g.limiters) != 1 || g.limiters[0] != r {
+		t.Fatal("expected the limiter to be registered")
+	}
+
+	g.Close()
+	g.Close()
+	if len(g.limiters) != 0 {
+		t.Error("expected the limiters to be released")
+	}
+}
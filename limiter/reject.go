@@ -0,0 +1,168 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package limiter
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cwbriscoe/goweb/internal/respond"
+	"golang.org/x/time/rate"
+)
+
+// Page writes a branded "slow down" page to a browser whose request was rejected.  It
+// is only called for requests accepting text/html, the status and the Retry-After and
+// RateLimit headers are set before it is called.
+type Page func(w http.ResponseWriter, r *http.Request, rej *Rejection)
+
+// Rejection is the error LimitRequest returns when it rejects a request.  errors.Is
+// matches it with ErrTooManyRequests or ErrForbidden.
+type Rejection struct {
+	Err        error         // ErrTooManyRequests or ErrForbidden
+	Status     int           // 429 or 403
+	Code       string        // machine readable code, rate_limited or forbidden
+	RetryAfter time.Duration // when the client may retry, zero when it should not
+	Limit      int           // requests allowed in a burst, zero when unknown
+	Window     time.Duration // time for a request of the burst to be allowed again
+	page       Page
+}
+
+func (e *Rejection) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Rejection) Unwrap() error {
+	return e.Err
+}
+
+// tooManyRequests returns the rejection of a visitor delayed too many times, the client
+// may retry after the delay it would have waited.
+func (r *Limiter) tooManyRequests(l *rate.Limiter, delay time.Duration) *Rejection {
+	rej := &Rejection{
+		Err:        ErrTooManyRequests,
+		Status:     http.StatusTooManyRequests,
+		Code:       "rate_limited",
+		RetryAfter: delay,
+		Limit:      l.Burst(),
+		page:       r.vars.Page,
+	}
+	if limit := l.Limit(); limit > 0 && limit != rate.Inf {
+		rej.Window = time.Duration(float64(time.Second) / float64(limit))
+	}
+	return rej
+}
+
+// forbidden returns the rejection of a denied bad bot.
+func (r *Limiter) forbidden() *Rejection {
+	return &Rejection{Err: ErrForbidden, Status: http.StatusForbidden, Code: "forbidden", page: r.vars.Page}
+}
+
+// WriteRejection writes the response to a request LimitRequest rejected with err.  The
+// Retry-After and RateLimit headers tell clients when to retry.  Browsers get the Page
+// of the limiter when it has one, the other clients accepting json the error envelope,
+// ie: {"error": {"code": "rate_limited", ...}}, and the rest plain text.  r may be nil,
+// the body is then plain text.
+func WriteRejection(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, ErrTarpitted) || errors.Is(err, context.Canceled) {
+		// the response has already been written or the client is gone.
+		return
+	}
+
+	var rej *Rejection
+	if !errors.As(err, &rej) {
+		switch {
+		case errors.Is(err, ErrTooManyRequests):
+			rej = &Rejection{Err: err, Status: http.StatusTooManyRequests, Code: "rate_limited"}
+		case errors.Is(err, ErrForbidden):
+			rej = &Rejection{Err: err, Status: http.StatusForbidden, Code: "forbidden"}
+		case errors.Is(err, context.DeadlineExceeded):
+			rej = &Rejection{Err: err, Status: http.StatusServiceUnavailable, Code: "limiter_timeout"}
+		default:
+			rej = &Rejection{Err: err, Status: http.StatusInternalServerError, Code: "limiter_error"}
+		}
+	}
+	rej.setHeaders(w)
+
+	html := r != nil && accepts(r, "text/html")
+	switch {
+	case html && rej.page != nil:
+		w.Header().Set("Cache-Control", "no-store")
+		rej.page(w, r, rej)
+	case !html && r != nil && accepts(r, "application/json"):
+		respond.WriteError(w, r, rej.Status, rej.Code, rej.message())
+	default:
+		http.Error(w, http.StatusText(rej.Status), rej.Status)
+	}
+}
+
+// WriteErrorResponse is a utility function to write the correct http response
+// depending on the error return from the Limiter handler.  It writes plain text, use
+// WriteRejection to answer with json or the Page of the limiter.
+func WriteErrorResponse(w http.ResponseWriter, err error) {
+	WriteRejection(w, nil, err)
+}
+
+// setHeaders sets Retry-After and the RateLimit headers of the ietf draft.
+func (e *Rejection) setHeaders(w http.ResponseWriter) {
+	if e.RetryAfter <= 0 {
+		return
+	}
+	retry := strconv.Itoa(seconds(e.RetryAfter))
+	h := w.Header()
+	h.Set("Retry-After", retry)
+	if e.Limit > 0 {
+		h.Set("RateLimit-Limit", strconv.Itoa(e.Limit))
+		h.Set("RateLimit-Remaining", "0")
+		h.Set("RateLimit-Reset", retry)
+		if e.Window > 0 {
+			h.Set("RateLimit-Policy", strconv.Itoa(e.Limit)+";w="+strconv.Itoa(seconds(e.Window)))
+		}
+	}
+}
+
+func (e *Rejection) message() string {
+	switch e.Status {
+	case http.StatusTooManyRequests:
+		if e.RetryAfter > 0 {
+			return "too many requests, retry in " + strconv.Itoa(seconds(e.RetryAfter)) + " seconds"
+		}
+		return "too many requests, slow down"
+	case http.StatusForbidden:
+		return "access denied"
+	}
+	return http.StatusText(e.Status)
+}
+
+// seconds rounds d up to whole seconds, at least one.
+func seconds(d time.Duration) int {
+	return max(1, int(math.Ceil(d.Seconds())))
+}
+
+// accepts returns true if the Accept header of the request lists the media type with a
+// quality above zero.  A missing header or */* accepts json but not html, so browsers
+// are only told apart by asking for text/html.
+func accepts(r *http.Request, mediaType string) bool {
+	header := r.Header.Get("Accept")
+	if header == "" {
+		return mediaType == "application/json"
+	}
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name != mediaType && (name != "*/*" || mediaType == "text/html") {
+			continue
+		}
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if q, err := strconv.ParseFloat(v, 64); err == nil && q <= 0 {
+				continue
+			}
+		}
+		return true
+	}
+	return false
+}
@@ -0,0 +1,99 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package limiter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+func TestWriteRejection(t *testing.T) {
+	page := func(w http.ResponseWriter, _ *http.Request, rej *Rejection) {
+		w.WriteHeader(rej.Status)
+		_, _ = w.Write([]byte("<h1>slow down</h1>"))
+	}
+	l := &Limiter{vars: &LimitSettings{Page: page}}
+	limited := l.tooManyRequests(rate.NewLimiter(rate.Every(2*time.Second), 3), 1500*time.Millisecond)
+
+	tests := []struct {
+		name   string
+		accept string
+		err    error
+		status int
+		body   string
+	}{
+		{"json", "application/json", limited, 429, `"code":"rate_limited"`},
+		{"any", "*/*", limited, 429, `"code":"rate_limited"`},
+		{"no accept", "", fmt.Errorf("wrapped: %w", l.forbidden()), 403, `"code":"forbidden"`},
+		{"browser", "text/html,application/xhtml+xml,*/*;q=0.8", limited, 429, "<h1>slow down</h1>"},
+		{"text", "text/plain", limited, 429, "Too Many Requests"},
+		{"bare error", "application/json", ErrTooManyRequests, 429, `"code":"rate_limited"`},
+		{"deadline", "application/json", context.DeadlineExceeded, 503, `"code":"limiter_timeout"`},
+		{"other error", "application/json", errors.New("boom"), 500, `"code":"limiter_error"`},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		if test.accept != "" {
+			r.Header.Set("Accept", test.accept)
+		}
+		w := httptest.NewRecorder()
+		WriteRejection(w, r, test.err)
+		if w.Code != test.status || !strings.Contains(w.Body.String(), test.body) {
+			t.Errorf("%s: expected %d %s, got %d %s", test.name, test.status, test.body, w.Code, w.Body.String())
+		}
+	}
+
+	w := httptest.NewRecorder()
+	WriteRejection(w, httptest.NewRequest("GET", "/", nil), limited)
+	want := map[string]string{
+		"Retry-After":         "2",
+		"RateLimit-Limit":     "3",
+		"RateLimit-Remaining": "0",
+		"RateLimit-Reset":     "2",
+		"RateLimit-Policy":    "3;w=2",
+	}
+	for name, value := range want {
+		if got := w.Header().Get(name); got != value {
+			t.Errorf("%s: expected %q, got %q", name, value, got)
+		}
+	}
+
+	// the tarpit already wrote the response.
+	w = httptest.NewRecorder()
+	w.WriteHeader(http.StatusTeapot)
+	WriteRejection(w, httptest.NewRequest("GET", "/", nil), ErrTarpitted)
+	if w.Body.Len() != 0 || w.Header().Get("Content-Type") != "" {
+		t.Errorf("tarpitted: wrote %q", w.Body.String())
+	}
+}
+
+func TestAccepts(t *testing.T) {
+	tests := []struct {
+		accept    string
+		mediaType string
+		want      bool
+	}{
+		{"", "application/json", true},
+		{"", "text/html", false},
+		{"*/*", "text/html", false},
+		{"text/html;q=0.9, */*", "text/html", true},
+		{"Application/JSON", "application/json", true},
+		{"application/json;q=0", "application/json", false},
+		{"text/plain", "application/json", false},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept", test.accept)
+		if got := accepts(r, test.mediaType); got != test.want {
+			t.Errorf("%q %s: expected %v, got %v", test.accept, test.mediaType, test.want, got)
+		}
+	}
+}
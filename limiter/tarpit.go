@@ -0,0 +1,105 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package limiter
+
+import (
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// TarpitMode selects how a limiter responds to flagged bad bots.
+type TarpitMode string
+
+// The available tarpit modes.
+const (
+	TarpitOff  TarpitMode = ""     // bad bots get the 1 request per hour limiter
+	TarpitDeny TarpitMode = "deny" // bad bots get an immediate 403
+	TarpitDrip TarpitMode = "drip" // bad bots get a very slow response
+)
+
+const (
+	defaultDrips = 30  // number of drips before the response ends
+	maxTarpits   = 100 // max concurrent drip responses before falling back to deny
+	dripChunk    = "<!-- -->\n"
+)
+
+// Tarpit contains the tarpit settings for a limiter.
+type Tarpit struct {
+	Mode         TarpitMode
+	Interval     time.Duration // time between drips, defaults to 1 second
+	Drips        int           // number of drips before the response ends
+	MaxOpen      int64         // max concurrent drip responses before falling back to deny
+	FlagFakeBots bool          // flag the bot user agents failing the reverse dns check as bad bots
+}
+
+// ErrTarpitted is returned when the limiter already wrote the response to a bad bot.
+var ErrTarpitted = errors.New("Limiter: bad bot tarpitted")
+
+// ErrForbidden is returned when a bad bot should be denied.
+var ErrForbidden = errors.New("Limiter: bad bot denied")
+
+// tarpit handles a request from a bad bot according to the tarpit mode.  It returns
+// nil if the request should go through the normal limiter.
+func (r *Limiter) tarpit(w http.ResponseWriter, req *http.Request, ip string) error {
+	if isBad, _ := r.registry.isBadBot(ip); !isBad {
+		return nil
+	}
+
+	switch r.vars.Tarpit.Mode {
+	case TarpitDeny:
+		r.vars.Log.Info().Msgf("%s(%d) %s: bad bot denied", r.logIP(ip), badBot, r.vars.Name)
+		return r.forbidden()
+	case TarpitDrip:
+		max := r.vars.Tarpit.MaxOpen
+		if max <= 0 {
+			max = maxTarpits
+		}
+		if atomic.AddInt64(&r.registry.openTarpits, 1) > max {
+			atomic.AddInt64(&r.registry.openTarpits, -1)
+			r.vars.Log.Info().Msgf("%s(%d) %s: tarpit full, bad bot denied", r.logIP(ip), badBot, r.vars.Name)
+			return r.forbidden()
+		}
+		defer atomic.AddInt64(&r.registry.openTarpits, -1)
+		r.vars.Log.Info().Msgf("%s(%d) %s: bad bot tarpitted", r.logIP(ip), badBot, r.vars.Name)
+		r.drip(w, req)
+		return ErrTarpitted
+	}
+
+	return nil
+}
+
+// drip writes a tiny chunk of the response each interval until the drips run out or
+// the client gives up.  A ticker is used so the client hanging up ends it right away.
+func (r *Limiter) drip(w http.ResponseWriter, req *http.Request) {
+	interval := r.vars.Tarpit.Interval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	drips := r.vars.Tarpit.Drips
+	if drips <= 0 {
+		drips = defaultDrips
+	}
+
+	flusher, _ := w.(http.Flusher)
+	w.Header().Set("Content-Type", "text/html")
+	w.WriteHeader(http.StatusOK)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for i := 0; i < drips; i++ {
+		select {
+		case <-req.Context().Done():
+			return
+		case <-ticker.C:
+			if _, err := w.Write([]byte(dripChunk)); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+}
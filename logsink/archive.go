@@ -0,0 +1,104 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package logsink
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cwbriscoe/goweb/storage"
+)
+
+// archiveInterval is how often the log directory is scanned for rotated files.
+const archiveInterval = 10 * time.Minute
+
+// startArchiver kicks off a goroutine that uploads the rotated backups of the log file
+// to s3.  The names of the uploaded files are kept in a state file in the log directory
+// so they are not uploaded again after a restart.
+func startArchiver(dir, filename string, s3 *storage.S3) {
+	ext := path.Ext(filename)
+	pattern := filepath.Join(dir, strings.TrimSuffix(filename, ext)+"-*")
+	state := filepath.Join(dir, "."+filename+".archived")
+
+	go func() {
+		uploaded := readArchived(state)
+		for {
+			if err := archive(pattern, ext, state, s3, uploaded); err != nil {
+				fmt.Fprintf(os.Stderr, "logsink archive %s: %v\n", filename, err)
+			}
+			time.Sleep(archiveInterval)
+		}
+	}()
+}
+
+func readArchived(state string) map[string]bool {
+	uploaded := make(map[string]bool)
+	f, err := os.Open(state)
+	if err != nil {
+		return uploaded
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		uploaded[scanner.Text()] = true
+	}
+	return uploaded
+}
+
+func archive(pattern, ext, state string, s3 *storage.S3, uploaded map[string]bool) error {
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		name := filepath.Base(file)
+		// rotated files are either name-<time>.ext or compressed name-<time>.ext.gz
+		if uploaded[name] || !(strings.HasSuffix(name, ext) || strings.HasSuffix(name, ext+".gz")) {
+			continue
+		}
+
+		if err = uploadLog(file, s3); err != nil {
+			return err
+		}
+
+		uploaded[name] = true
+		if err = appendArchived(state, name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func uploadLog(file string, s3 *storage.S3) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	return s3.Upload(context.Background(), filepath.Base(file), f, info.Size(), "")
+}
+
+func appendArchived(state, name string) error {
+	f, err := os.OpenFile(state, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.WriteString(name + "\n")
+	return err
+}
@@ -0,0 +1,64 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package logsink
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/rs/zerolog"
+)
+
+// levels are the levels of the loggers by file, shared by every logger writing the
+// file so SetLevel changes them all.
+var levels = make(map[string]*atomic.Int32)
+
+// levelHook discards the events below the level of the file of the logger.
+type levelHook struct {
+	level *atomic.Int32
+}
+
+func (h levelHook) Run(e *zerolog.Event, level zerolog.Level, _ string) {
+	if level < zerolog.Level(h.level.Load()) {
+		e.Discard()
+	}
+}
+
+// parseLevel returns the level of the settings, trace when empty.
+func parseLevel(level string) (zerolog.Level, error) {
+	if level == "" {
+		return zerolog.TraceLevel, nil
+	}
+	return zerolog.ParseLevel(level)
+}
+
+// fileLevel returns the level shared by the loggers of file set to level.
+func fileLevel(file string, level zerolog.Level) *atomic.Int32 {
+	writersmu.Lock()
+	defer writersmu.Unlock()
+	l, ok := levels[file]
+	if !ok {
+		l = &atomic.Int32{}
+		levels[file] = l
+	}
+	l.Store(int32(level))
+	return l
+}
+
+// SetLevel changes the level of the loggers writing file, the path of the log file
+// under its base dir, while they run.  An empty level logs every level.
+func SetLevel(file, level string) error {
+	lvl, err := parseLevel(level)
+	if err != nil {
+		return err
+	}
+
+	writersmu.Lock()
+	defer writersmu.Unlock()
+	l, ok := levels[file]
+	if !ok {
+		return fmt.Errorf("no logger writes %s", file)
+	}
+	l.Store(int32(lvl))
+	return nil
+}
@@ -0,0 +1,373 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+// Package logsink ships log lines to remote sinks (syslog, http, otlp) and archives
+// rotated log files to S3 compatible storage in addition to the local rotating files.
+package logsink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cwbriscoe/goutil/logging"
+	"github.com/cwbriscoe/goweb/storage"
+	"github.com/natefinch/lumberjack/v3"
+	"github.com/rs/zerolog"
+)
+
+// Config is the settings of a single sink.
+type Config struct {
+	Type          string            `json:"type" doc:"kind of sink" enum:"syslog,http,otlp,s3"`
+	Network       string            `json:"network" doc:"syslog network, the local syslog when empty" enum:"udp,tcp"`
+	Addr          string            `json:"addr" doc:"syslog address"`
+	URL           string            `json:"url" doc:"http and otlp endpoint"`
+	Headers       map[string]string `json:"headers" doc:"extra http headers, ie: authorization"`
+	Tag           string            `json:"tag" doc:"syslog tag and otlp service name, defaults to the log file name"`
+	Buffer        int               `json:"buffer" doc:"lines buffered before applying backpressure" default:"10000"`
+	Block         bool              `json:"block" doc:"block the logger when the buffer is full instead of dropping lines"`
+	BatchSize     int               `json:"batchSize" doc:"max lines sent per request" default:"500"`
+	FlushInterval int               `json:"flushInterval" doc:"max milliseconds lines wait in the buffer" default:"1000"`
+	S3            *storage.S3       `json:"s3" doc:"bucket rotated files are archived to"`
+}
+
+// batchWriter sends a batch of log lines to a sink.
+type batchWriter interface {
+	writeBatch(lines [][]byte) error
+}
+
+// asyncWriter buffers log lines and sends them to the sink in batches from its own
+// goroutine so a slow sink never stalls the request path unless Block is set.
+type asyncWriter struct {
+	name     string
+	ch       chan []byte
+	out      batchWriter
+	block    bool
+	size     int
+	interval time.Duration
+	flushc   chan chan struct{}
+	dropped  atomic.Int64
+	failed   atomic.Int64
+}
+
+// writers are shared by loggers writing the same file to the same sink, so loggers
+// recreated for every job run do not start another goroutine each time.
+var (
+	writersmu sync.Mutex
+	writers   = make(map[string]*asyncWriter)
+	archivers = make(map[string]bool)
+)
+
+// Stats is the number of lines a sink dropped because its buffer was full and the
+// number of lines it failed to send.
+type Stats struct {
+	Sink    string `json:"sink"`
+	Dropped int64  `json:"dropped"`
+	Failed  int64  `json:"failed"`
+	Pending int    `json:"pending"`
+}
+
+// GetStats returns the stats of every sink created.
+func GetStats() []Stats {
+	writersmu.Lock()
+	defer writersmu.Unlock()
+	stats := make([]Stats, 0, len(writers))
+	for _, w := range writers {
+		stats = append(stats, Stats{w.name, w.dropped.Load(), w.failed.Load(), len(w.ch)})
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Sink < stats[j].Sink })
+	return stats
+}
+
+// getAsyncWriter returns the existing writer for the sink or creates a new one.
+func getAsyncWriter(name string, cfg *Config, create func() (batchWriter, error)) (*asyncWriter, error) {
+	writersmu.Lock()
+	defer writersmu.Unlock()
+
+	if w, ok := writers[name]; ok {
+		return w, nil
+	}
+
+	out, err := create()
+	if err != nil {
+		return nil, err
+	}
+
+	w := newAsyncWriter(name, cfg, out)
+	writers[name] = w
+	return w, nil
+}
+
+func newAsyncWriter(name string, cfg *Config, out batchWriter) *asyncWriter {
+	w := &asyncWriter{
+		name:     name,
+		out:      out,
+		block:    cfg.Block,
+		size:     cfg.BatchSize,
+		interval: time.Duration(cfg.FlushInterval) * time.Millisecond,
+	}
+	buffer := cfg.Buffer
+	if buffer <= 0 {
+		buffer = 10000
+	}
+	if w.size <= 0 {
+		w.size = 500
+	}
+	if w.interval <= 0 {
+		w.interval = time.Second
+	}
+	w.ch = make(chan []byte, buffer)
+	w.flushc = make(chan chan struct{})
+
+	go w.run()
+	return w
+}
+
+// Write queues a copy of the line, zerolog reuses its buffer after Write returns.
+func (w *asyncWriter) Write(p []byte) (int, error) {
+	line := make([]byte, len(p))
+	copy(line, p)
+
+	if w.block {
+		w.ch <- line
+		return len(p), nil
+	}
+
+	select {
+	case w.ch <- line:
+	default:
+		w.dropped.Add(1)
+	}
+	return len(p), nil
+}
+
+func (w *asyncWriter) run() {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	batch := make([][]byte, 0, w.size)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := w.out.writeBatch(batch); err != nil {
+			w.failed.Add(int64(len(batch)))
+			fmt.Fprintf(os.Stderr, "logsink %s: %v\n", w.name, err)
+		}
+		batch = make([][]byte, 0, w.size)
+	}
+
+	for {
+		select {
+		case line := <-w.ch:
+			batch = append(batch, line)
+			if len(batch) >= w.size {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case done := <-w.flushc:
+			// send everything queued so far.
+			for len(w.ch) > 0 {
+				batch = append(batch, <-w.ch)
+				if len(batch) >= w.size {
+					flush()
+				}
+			}
+			flush()
+			close(done)
+		}
+	}
+}
+
+// Flush sends the lines queued for all sinks and waits until they are written or ctx
+// is done.  It should be called before the process exits.
+func Flush(ctx context.Context) error {
+	writersmu.Lock()
+	all := make([]*asyncWriter, 0, len(writers))
+	for _, w := range writers {
+		all = append(all, w)
+	}
+	writersmu.Unlock()
+
+	for _, w := range all {
+		done := make(chan struct{})
+		select {
+		case w.flushc <- done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// ErrUnknownSink is returned for a sink with an unknown type.
+var ErrUnknownSink = errors.New("unknown log sink type")
+
+// ErrNoRoller is returned by Rotate for the loggers with sinks, logging.Logger only
+// knows the roller of the loggers made by logging.NewLogger.
+var ErrNoRoller = errors.New("logger has no roller to rotate")
+
+// Settings are the configurable overrides of a logger.  Zero values keep the defaults
+// chosen by the module creating the logger.
+type Settings struct {
+	Level      string   `json:"level" doc:"min level of the logged events" default:"trace" enum:"trace,debug,info,warn,error,fatal,panic,disabled"`
+	MaxAgeDays int      `json:"maxAgeDays" doc:"days rotated files are kept"`
+	MaxSizeMB  int      `json:"maxSizeMB" doc:"size in megabytes a file is rotated at"`
+	MaxBackups int      `json:"maxBackups" doc:"number of rotated files kept"`
+	Console    *bool    `json:"console" doc:"also log to the console"`
+	Compress   *bool    `json:"compress" doc:"compress rotated files"`
+	Sinks      []Config `json:"sinks" doc:"remote sinks in addition to the local log file"`
+}
+
+// Apply returns the logging config with the overrides applied.
+func (s *Settings) Apply(config logging.Config) logging.Config {
+	if s == nil {
+		return config
+	}
+	if s.MaxAgeDays > 0 {
+		config.MaxAge = time.Duration(s.MaxAgeDays) * 24 * time.Hour
+	}
+	if s.MaxSizeMB > 0 {
+		config.MaxSize = int64(s.MaxSizeMB) * 1024 * 1024
+	}
+	if s.MaxBackups > 0 {
+		config.MaxBackups = s.MaxBackups
+	}
+	if s.Console != nil {
+		config.Console = *s.Console
+	}
+	if s.Compress != nil {
+		config.Compress = *s.Compress
+	}
+	return config
+}
+
+// NewLogger returns a rolling logger like logging.NewLogger with the settings applied
+// that also writes to the configured sinks.  settings may be nil.  Loggers with sinks
+// are rotated by size and age only, see Rotate.  The level can be changed later with
+// SetLevel.
+func NewLogger(config logging.Config, settings *Settings) (*logging.Logger, error) {
+	config = settings.Apply(config)
+
+	var sinks []Config
+	var levelName string
+	if settings != nil {
+		sinks = settings.Sinks
+		levelName = settings.Level
+	}
+	level, err := parseLevel(levelName)
+	if err != nil {
+		return nil, err
+	}
+	filename := path.Join(config.BaseDir, config.FileName)
+	hook := levelHook{fileLevel(filename, level)}
+
+	if len(sinks) == 0 {
+		l, err := logging.NewLogger(config)
+		if err != nil {
+			return nil, err
+		}
+		logger := l.Logger.Hook(hook)
+		l.Logger = &logger
+		return l, nil
+	}
+
+	var out []io.Writer
+
+	if config.Console {
+		out = append(out, zerolog.ConsoleWriter{Out: os.Stderr})
+	}
+
+	roller, err := lumberjack.NewRoller(filename, config.MaxSize, &lumberjack.Options{
+		MaxAge:     config.MaxAge,
+		MaxBackups: config.MaxBackups,
+		Compress:   config.Compress,
+	})
+	if err != nil {
+		return nil, err
+	}
+	out = append(out, roller)
+
+	for i := range sinks {
+		cfg := &sinks[i]
+		if cfg.Tag == "" {
+			cfg.Tag = config.FileName
+		}
+		name := cfg.Type + ":" + cfg.Addr + cfg.URL + ":" + filename
+
+		var create func() (batchWriter, error)
+		switch cfg.Type {
+		case "syslog":
+			create = func() (batchWriter, error) { return newSyslogWriter(cfg) }
+		case "http":
+			create = func() (batchWriter, error) { return newHTTPWriter(cfg, false), nil }
+		case "otlp":
+			create = func() (batchWriter, error) { return newHTTPWriter(cfg, true), nil }
+		case "s3":
+			if cfg.S3 == nil {
+				return nil, fmt.Errorf("log sink %s: missing s3 settings", name)
+			}
+			writersmu.Lock()
+			if !archivers[filename] {
+				archivers[filename] = true
+				startArchiver(config.BaseDir, config.FileName, cfg.S3)
+			}
+			writersmu.Unlock()
+			continue
+		default:
+			return nil, fmt.Errorf("%w: %s", ErrUnknownSink, cfg.Type)
+		}
+
+		w, err := getAsyncWriter(name, cfg, create)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, w)
+	}
+
+	logger := zerolog.New(io.MultiWriter(out...)).Hook(hook).With().Timestamp().Logger()
+
+	return &logging.Logger{Logger: &logger}, nil
+}
+
+// Rotate immediately rotates the file of a logger made by NewLogger.  The loggers with
+// sinks have no roller, logging.Logger.Rotate panics on them and Rotate returns
+// ErrNoRoller instead.
+func Rotate(l *logging.Logger) (err error) {
+	defer func() {
+		if recover() != nil {
+			err = ErrNoRoller
+		}
+	}()
+	return l.Rotate()
+}
+
+// NewWriter returns a rolling file writer with the settings applied for logs that are
+// not written through zerolog, ie: access logs in the apache combined format.  Lines
+// are written to the file as is, the remote sinks of the settings are not used.
+func NewWriter(config logging.Config, settings *Settings) (io.WriteCloser, error) {
+	config = settings.Apply(config)
+
+	filename := path.Join(config.BaseDir, config.FileName)
+	roller, err := lumberjack.NewRoller(filename, config.MaxSize, &lumberjack.Options{
+		MaxAge:     config.MaxAge,
+		MaxBackups: config.MaxBackups,
+		Compress:   config.Compress,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return roller, nil
+}
@@ -0,0 +1,63 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package logsink
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cwbriscoe/goutil/logging"
+	"github.com/goccy/go-json"
+)
+
+func TestRotate(t *testing.T) {
+	dir := t.TempDir()
+	l, err := NewLogger(logging.Config{BaseDir: dir, FileName: "plain.log", MaxSize: 1000}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = Rotate(l); err != nil {
+		t.Errorf("expected the plain logger to rotate, got %v", err)
+	}
+
+	settings := &Settings{Sinks: []Config{{Type: "http", URL: "http://127.0.0.1:0/"}}}
+	l, err = NewLogger(logging.Config{BaseDir: dir, FileName: "sink.log", MaxSize: 1000}, settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = Rotate(l); !errors.Is(err, ErrNoRoller) {
+		t.Errorf("expected ErrNoRoller for the logger with sinks, got %v", err)
+	}
+}
+
+func TestOTLPTime(t *testing.T) {
+	h := newHTTPWriter(&Config{Tag: "test"}, true)
+	body, err := h.otlpBody([][]byte{
+		[]byte(`{"level":"info","time":"2023-10-01T12:00:00Z","message":"a"}` + "\n"),
+		[]byte(`{"level":"warn","message":"b"}` + "\n"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var req struct {
+		ResourceLogs []struct {
+			ScopeLogs []struct {
+				LogRecords []otlpRecord `json:"logRecords"`
+			} `json:"scopeLogs"`
+		} `json:"resourceLogs"`
+	}
+	if err = json.Unmarshal(body, &req); err != nil {
+		t.Fatal(err)
+	}
+	records := req.ResourceLogs[0].ScopeLogs[0].LogRecords
+	event := time.Date(2023, 10, 1, 12, 0, 0, 0, time.UTC).UnixNano()
+	if records[0].TimeUnixNano != strconv.FormatInt(event, 10) {
+		t.Errorf("expected the event time %d, got %s", event, records[0].TimeUnixNano)
+	}
+	if records[1].TimeUnixNano != records[1].ObservedTimeUnixNano {
+		t.Errorf("expected the send time for a line without a time, got %s and %s", records[1].TimeUnixNano, records[1].ObservedTimeUnixNano)
+	}
+}
@@ -0,0 +1,176 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package logsink
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/syslog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/rs/zerolog"
+)
+
+// syslogWriter sends each line to syslog with a priority matching its level.
+type syslogWriter struct {
+	w *syslog.Writer
+}
+
+func newSyslogWriter(cfg *Config) (*syslogWriter, error) {
+	w, err := syslog.Dial(cfg.Network, cfg.Addr, syslog.LOG_INFO|syslog.LOG_DAEMON, cfg.Tag)
+	if err != nil {
+		return nil, err
+	}
+	return &syslogWriter{w}, nil
+}
+
+func (s *syslogWriter) writeBatch(lines [][]byte) error {
+	for _, line := range lines {
+		msg := string(bytes.TrimRight(line, "\n"))
+		var err error
+		switch lineLevel(line) {
+		case "debug", "trace":
+			err = s.w.Debug(msg)
+		case "warn":
+			err = s.w.Warning(msg)
+		case "error":
+			err = s.w.Err(msg)
+		case "fatal", "panic":
+			err = s.w.Crit(msg)
+		default:
+			err = s.w.Info(msg)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lineLevel returns the zerolog level field of a json log line.
+func lineLevel(line []byte) string {
+	var fields struct {
+		Level string `json:"level"`
+	}
+	_ = json.Unmarshal(line, &fields)
+	return fields.Level
+}
+
+// httpWriter posts batches of lines as newline delimited json or as an otlp/http json
+// logs request.
+type httpWriter struct {
+	cfg    *Config
+	otlp   bool
+	client *http.Client
+}
+
+func newHTTPWriter(cfg *Config, otlp bool) *httpWriter {
+	return &httpWriter{cfg, otlp, &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (h *httpWriter) writeBatch(lines [][]byte) error {
+	var body []byte
+	var err error
+	contentType := "application/x-ndjson"
+
+	if h.otlp {
+		contentType = "application/json"
+		body, err = h.otlpBody(lines)
+		if err != nil {
+			return err
+		}
+	} else {
+		body = bytes.Join(lines, nil)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, h.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	for k, v := range h.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s returned status %d", h.cfg.URL, resp.StatusCode)
+	}
+	return nil
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpRecord struct {
+	TimeUnixNano         string    `json:"timeUnixNano"`
+	ObservedTimeUnixNano string    `json:"observedTimeUnixNano"`
+	SeverityNumber       int       `json:"severityNumber"`
+	SeverityText         string    `json:"severityText"`
+	Body                 otlpValue `json:"body"`
+}
+
+// otlpSeverity maps zerolog levels to otlp severity numbers.
+var otlpSeverity = map[string]int{
+	"trace": 1,
+	"debug": 5,
+	"info":  9,
+	"warn":  13,
+	"error": 17,
+	"fatal": 21,
+	"panic": 21,
+}
+
+// otlpBody returns the otlp logs request of the lines.  The records are stamped with
+// the time of the zerolog event, the time the batch is sent when a line has none.
+func (h *httpWriter) otlpBody(lines [][]byte) ([]byte, error) {
+	now := time.Now()
+	observed := strconv.FormatInt(now.UnixNano(), 10)
+	records := make([]otlpRecord, 0, len(lines))
+	for _, line := range lines {
+		var fields struct {
+			Level string `json:"level"`
+			Time  string `json:"time"`
+		}
+		_ = json.Unmarshal(line, &fields)
+		ts, err := time.Parse(zerolog.TimeFieldFormat, fields.Time)
+		if err != nil {
+			ts = now
+		}
+		records = append(records, otlpRecord{
+			TimeUnixNano:         strconv.FormatInt(ts.UnixNano(), 10),
+			ObservedTimeUnixNano: observed,
+			SeverityNumber:       otlpSeverity[fields.Level],
+			SeverityText:         fields.Level,
+			Body:                 otlpValue{string(bytes.TrimRight(line, "\n"))},
+		})
+	}
+
+	return json.Marshal(map[string]any{
+		"resourceLogs": []any{map[string]any{
+			"resource": map[string]any{
+				"attributes": []otlpAttribute{{"service.name", otlpValue{h.cfg.Tag}}},
+			},
+			"scopeLogs": []any{map[string]any{
+				"scope":      map[string]string{"name": "goweb"},
+				"logRecords": records,
+			}},
+		}},
+	})
+}
@@ -0,0 +1,194 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+// Package migrate records the migrations applied to a database schema so a deployment
+// can be checked for pending migrations before traffic is shifted to it.
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/cwbriscoe/goweb/query"
+	"github.com/jackc/pgx/v5"
+)
+
+// Migration is a numbered change to a schema.  The sql may use {schema} for the
+// schema of the set.  The first migration of a set is usually the baseline, it creates
+// the original tables only when they are missing so databases that predate the set can
+// be brought up to date with Apply.
+type Migration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+// Set is the ordered list of migrations of a schema.
+type Set struct {
+	Name       string // component the schema belongs to, ie: auth, job or app
+	Schema     string // database schema holding the tables and the version table
+	Migrations []Migration
+}
+
+// Status is the migration state of a set in the database.
+type Status struct {
+	Name    string    `json:"name"`
+	Schema  string    `json:"schema"`
+	Version int       `json:"version"`           // highest applied version, 0 when nothing is recorded
+	Latest  int       `json:"latest"`            // highest version known to the binary
+	Applied time.Time `json:"applied,omitempty"` // when the highest version was applied
+	Pending []string  `json:"pending"`           // "version name" of the migrations not applied yet
+}
+
+// Current reports whether all the migrations of the set are applied.
+func (s *Status) Current() bool {
+	return len(s.Pending) == 0
+}
+
+// Beginner is the subset of pgxpool.Pool and pgx.Conn used to apply migrations.
+type Beginner interface {
+	query.DB
+	Begin(ctx context.Context) (pgx.Tx, error)
+}
+
+var (
+	qVersionTable = query.Query{
+		Name: "versionTable",
+		SQL:  "select to_regclass('{schema}.schema_version') is not null;",
+	}
+	qCreateVersionTable = query.Query{
+		Name: "createVersionTable",
+		SQL: `
+create table if not exists {schema}.schema_version (
+	version int4 not null,
+	name varchar not null,
+	applied_ts timestamptz not null default now(),
+	constraint schema_version_pk primary key (version)
+);`,
+	}
+	qCurrentVersion = query.Query{
+		Name: "currentVersion",
+		SQL:  "select version, applied_ts from {schema}.schema_version order by version desc limit 1;",
+	}
+	qRecordVersion = query.Query{
+		Name: "recordVersion",
+		SQL:  "insert into {schema}.schema_version (version, name) values ($1, $2) on conflict do nothing;",
+	}
+)
+
+// Validate checks the versions of the set are positive and strictly increasing.
+func (s *Set) Validate() error {
+	last := 0
+	for _, m := range s.Migrations {
+		if m.Version <= last {
+			return fmt.Errorf("migrate: %s: version %d must be greater than %d", s.Name, m.Version, last)
+		}
+		last = m.Version
+	}
+	return nil
+}
+
+// Latest returns the highest version of the set.
+func (s *Set) Latest() int {
+	if len(s.Migrations) == 0 {
+		return 0
+	}
+	return s.Migrations[len(s.Migrations)-1].Version
+}
+
+// pending returns the migrations of the set above version.
+func (s *Set) pending(version int) []Migration {
+	i := sort.Search(len(s.Migrations), func(i int) bool {
+		return s.Migrations[i].Version > version
+	})
+	return s.Migrations[i:]
+}
+
+// Check returns the migration state of the set in the database.
+func Check(ctx context.Context, db query.DB, set *Set) (*Status, error) {
+	if err := set.Validate(); err != nil {
+		return nil, err
+	}
+
+	status := &Status{Name: set.Name, Schema: set.Schema, Latest: set.Latest(), Pending: []string{}}
+	schema := query.Schema(set.Schema)
+
+	var exists bool
+	if err := schema.QueryRow(ctx, db, qVersionTable).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if exists {
+		err := schema.QueryRow(ctx, db, qCurrentVersion).Scan(&status.Version, &status.Applied)
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			return nil, err
+		}
+	}
+
+	for _, m := range set.pending(status.Version) {
+		status.Pending = append(status.Pending, strconv.Itoa(m.Version)+" "+m.Name)
+	}
+	return status, nil
+}
+
+// Baseline records all the migrations of the set as applied without running them, ie:
+// for a schema created at its latest version by other means.
+func Baseline(ctx context.Context, db query.DB, set *Set) error {
+	if err := set.Validate(); err != nil {
+		return err
+	}
+
+	schema := query.Schema(set.Schema)
+	if _, err := schema.Exec(ctx, db, qCreateVersionTable); err != nil {
+		return err
+	}
+	for _, m := range set.Migrations {
+		if _, err := schema.Exec(ctx, db, qRecordVersion, m.Version, m.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Apply runs the pending migrations of the set, each one in its own transaction, and
+// returns the resulting state.
+func Apply(ctx context.Context, db Beginner, set *Set) (*Status, error) {
+	status, err := Check(ctx, db, set)
+	if err != nil {
+		return nil, err
+	}
+
+	schema := query.Schema(set.Schema)
+	if _, err = schema.Exec(ctx, db, qCreateVersionTable); err != nil {
+		return nil, err
+	}
+
+	for _, m := range set.pending(status.Version) {
+		if err = apply(ctx, db, schema, m); err != nil {
+			return nil, fmt.Errorf("migrate: %s %d %s: %w", set.Name, m.Version, m.Name, err)
+		}
+	}
+
+	return Check(ctx, db, set)
+}
+
+func apply(ctx context.Context, db Beginner, schema query.Schema, m Migration) error {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	if m.SQL != "" {
+		if _, err = tx.Exec(ctx, schema.SQL(query.Query{Name: m.Name, SQL: m.SQL})); err != nil {
+			return err
+		}
+	}
+	if _, err = schema.Exec(ctx, tx, qRecordVersion, m.Version, m.Name); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
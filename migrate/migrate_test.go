@@ -0,0 +1,39 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package migrate
+
+import "testing"
+
+func TestSet(t *testing.T) {
+	set := &Set{Name: "app", Schema: "app", Migrations: []Migration{
+		{Version: 1, Name: "baseline"},
+		{Version: 2, Name: "add_column"},
+		{Version: 5, Name: "add_index"},
+	}}
+
+	if err := set.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if set.Latest() != 5 {
+		t.Errorf("latest: got %d, want 5", set.Latest())
+	}
+
+	for version, want := range map[int]int{0: 3, 1: 2, 2: 1, 3: 1, 5: 0, 9: 0} {
+		if got := len(set.pending(version)); got != want {
+			t.Errorf("pending(%d): got %d migrations, want %d", version, got, want)
+		}
+	}
+	if m := set.pending(2); m[0].Name != "add_index" {
+		t.Errorf("pending(2): got %s, want add_index", m[0].Name)
+	}
+
+	set.Migrations = append(set.Migrations, Migration{Version: 5, Name: "duplicate"})
+	if err := set.Validate(); err == nil {
+		t.Error("expected an error for a duplicate version")
+	}
+
+	empty := &Set{Name: "empty"}
+	if empty.Latest() != 0 || len(empty.pending(0)) != 0 {
+		t.Error("an empty set should have no migrations")
+	}
+}
@@ -0,0 +1,184 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+// Package notification stores the notifications shown to signed in users, like replies
+// to their comments or finished jobs they asked to be told about
+package notification
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/cwbriscoe/goweb/query"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// DefaultSchema is the schema with the notification tables.
+const DefaultSchema query.Schema = "notification"
+
+// Channel is the postgres channel a user id is sent on when the user gets a new
+// notification, so servers can push it to connected browsers.
+const Channel = "notification"
+
+// ErrInvalid is returned for a notification without a user or title.
+var ErrInvalid = errors.New("invalid notification")
+
+// Notification is a message for a single user.
+type Notification struct {
+	ID      int64      `json:"id"`
+	UserID  int        `json:"-"`
+	Kind    string     `json:"kind"` // set by the sender, ie: "comment" or "job"
+	Title   string     `json:"title"`
+	Body    string     `json:"body,omitempty"`
+	Link    string     `json:"link,omitempty"`
+	Read    *time.Time `json:"read,omitempty"`
+	Created time.Time  `json:"created"`
+}
+
+var (
+	qInsertNotification = query.Query{
+		Name: "insertNotification",
+		SQL: `
+insert into {schema}.notification (auth_id, kind, title, body, link, create_ts)
+values ($1, $2, $3, $4, $5, now())
+returning id, create_ts;`,
+	}
+	qNotify = query.Query{
+		Name: "notify",
+		SQL:  "select pg_notify('" + Channel + "', $1);",
+	}
+	qListNotifications = query.Query{
+		Name: "listNotifications",
+		SQL: `
+select id, auth_id, kind, title, body, link, read_ts, create_ts
+  from {schema}.notification
+ where auth_id = $1
+   and ($2 = 0 or id < $2)
+   and (not $3 or read_ts is null)
+ order by id desc
+ limit $4;`,
+	}
+	qUnreadCount = query.Query{
+		Name: "unreadCount",
+		SQL:  "select count(*) from {schema}.notification where auth_id = $1 and read_ts is null;",
+	}
+	qMarkRead = query.Query{
+		Name: "markRead",
+		SQL:  "update {schema}.notification set read_ts = now() where auth_id = $1 and id = any($2) and read_ts is null;",
+	}
+	qMarkAllRead = query.Query{
+		Name: "markAllRead",
+		SQL:  "update {schema}.notification set read_ts = now() where auth_id = $1 and read_ts is null;",
+	}
+	qPurgeNotifications = query.Query{
+		Name: "purgeNotifications",
+		SQL: `
+delete from {schema}.notification
+ where create_ts < $1
+    or read_ts < $2;`,
+	}
+)
+
+// Settings contains the settings for a Store.
+type Settings struct {
+	DB            *pgxpool.Pool
+	Schema        string        // defaults to "notification"
+	Retention     time.Duration // notifications are deleted this long after they are sent, defaults to 90 days
+	ReadRetention time.Duration // read notifications are deleted this long after they are read, defaults to 30 days
+}
+
+// Store reads and writes notifications.
+type Store struct {
+	db            *pgxpool.Pool
+	schema        query.Schema
+	retention     time.Duration
+	readRetention time.Duration
+}
+
+// NewStore returns a Store using the settings.
+func NewStore(settings *Settings) *Store {
+	store := &Store{
+		db:            settings.DB,
+		schema:        DefaultSchema,
+		retention:     settings.Retention,
+		readRetention: settings.ReadRetention,
+	}
+	if settings.Schema != "" {
+		store.schema = query.Schema(settings.Schema)
+	}
+	if store.retention <= 0 {
+		store.retention = 90 * 24 * time.Hour
+	}
+	if store.readRetention <= 0 {
+		store.readRetention = 30 * 24 * time.Hour
+	}
+	return store
+}
+
+// Send stores the notification and signals the servers that the user has a new one.
+// It fills in the id and creation time.
+func (s *Store) Send(ctx context.Context, n *Notification) error {
+	if n.UserID == 0 || n.Title == "" {
+		return ErrInvalid
+	}
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	err = s.schema.QueryRow(ctx, tx, qInsertNotification, n.UserID, n.Kind, n.Title, n.Body, n.Link).Scan(&n.ID, &n.Created)
+	if err != nil {
+		return err
+	}
+
+	// the notification is only delivered once the transaction commits.
+	if _, err = s.schema.Exec(ctx, tx, qNotify, strconv.Itoa(n.UserID)); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// List returns up to limit notifications of the user older than the before id, newest
+// first.  A before of zero starts with the newest notification.
+func (s *Store) List(ctx context.Context, userID int, before int64, unreadOnly bool, limit int) ([]*Notification, error) {
+	rows, err := s.schema.Query(ctx, s.db, qListNotifications, userID, before, unreadOnly, limit)
+	if err != nil {
+		return nil, err
+	}
+	list, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (*Notification, error) {
+		n := &Notification{}
+		err := row.Scan(&n.ID, &n.UserID, &n.Kind, &n.Title, &n.Body, &n.Link, &n.Read, &n.Created)
+		return n, err
+	})
+	return list, query.Wrap(qListNotifications, err)
+}
+
+// Unread returns the number of unread notifications of the user.
+func (s *Store) Unread(ctx context.Context, userID int) (int, error) {
+	var cnt int
+	err := s.schema.QueryRow(ctx, s.db, qUnreadCount, userID).Scan(&cnt)
+	return cnt, err
+}
+
+// MarkRead marks the notifications of the user as read.  All of the users notifications
+// are marked when ids is empty.  It returns the number of notifications marked.
+func (s *Store) MarkRead(ctx context.Context, userID int, ids []int64) (int64, error) {
+	if len(ids) == 0 {
+		tag, err := s.schema.Exec(ctx, s.db, qMarkAllRead, userID)
+		return tag.RowsAffected(), err
+	}
+	tag, err := s.schema.Exec(ctx, s.db, qMarkRead, userID, ids)
+	return tag.RowsAffected(), err
+}
+
+// Purge deletes the notifications past their retention and returns the number deleted.
+func (s *Store) Purge(ctx context.Context) (int64, error) {
+	now := time.Now()
+	tag, err := s.schema.Exec(ctx, s.db, qPurgeNotifications, now.Add(-s.retention), now.Add(-s.readRetention))
+	return tag.RowsAffected(), err
+}
@@ -0,0 +1,71 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package notification
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// CreateSchema will create the notification schema and associated tables needed
+// for this package to run
+func CreateSchema(ctx context.Context, conn *pgx.Conn) error {
+	var sql string
+	var err error
+
+	sql = "drop schema if exists notification cascade;"
+	_, err = conn.Exec(ctx, sql)
+	if err != nil {
+		return err
+	}
+
+	sql = "create schema notification authorization current_role;"
+	_, err = conn.Exec(ctx, sql)
+	if err != nil {
+		return err
+	}
+
+	sql = `
+	CREATE TABLE notification.notification (
+		id int8 NOT NULL GENERATED ALWAYS AS IDENTITY,
+		auth_id int4 NOT NULL,
+		kind varchar NOT NULL,
+		title varchar NOT NULL,
+		body varchar NOT NULL,
+		link varchar NOT NULL,
+		read_ts timestamptz NULL,
+		create_ts timestamptz NOT NULL,
+		CONSTRAINT notification_pk PRIMARY KEY (id)
+	);`
+	_, err = conn.Exec(ctx, sql)
+	if err != nil {
+		return err
+	}
+
+	sql = "CREATE INDEX notification_auth_idx ON notification.notification (auth_id, id);"
+	_, err = conn.Exec(ctx, sql)
+	if err != nil {
+		return err
+	}
+
+	sql = "CREATE INDEX notification_unread_idx ON notification.notification (auth_id) WHERE read_ts IS NULL;"
+	_, err = conn.Exec(ctx, sql)
+	if err != nil {
+		return err
+	}
+
+	sql = "grant select, insert, update on table notification.notification to api;"
+	_, err = conn.Exec(ctx, sql)
+	if err != nil {
+		return err
+	}
+
+	sql = "grant select, insert, delete on table notification.notification to job;"
+	_, err = conn.Exec(ctx, sql)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,105 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+// Package privacy provides helpers to keep personally identifiable information out of logs
+package privacy
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// Mode is the method used to anonymize an ip address.
+type Mode string
+
+const (
+	// ModeNone leaves ip addresses untouched.
+	ModeNone Mode = ""
+	// ModeHash replaces ip addresses with a salted hash.  The salt is rotated daily
+	// so visitors can be correlated within a day but not across days.
+	ModeHash Mode = "hash"
+	// ModeTruncate zeroes the host portion of ip addresses (/24 for ipv4, /48 for ipv6).
+	ModeTruncate Mode = "truncate"
+)
+
+// Anonymizer hashes or truncates ip addresses before they are written to logs.
+// A nil *Anonymizer is valid and returns ip addresses unchanged.
+type Anonymizer struct {
+	sync.Mutex
+	mode Mode
+	day  string
+	salt []byte
+}
+
+// NewAnonymizer returns an Anonymizer for the given mode.
+func NewAnonymizer(mode string) (*Anonymizer, error) {
+	switch Mode(mode) {
+	case ModeNone, ModeHash, ModeTruncate:
+	default:
+		return nil, errors.New("privacy: unknown anonymize mode '" + mode + "'")
+	}
+	return &Anonymizer{mode: Mode(mode)}, nil
+}
+
+// Enabled returns true if the anonymizer will alter ip addresses.
+func (a *Anonymizer) Enabled() bool {
+	return a != nil && a.mode != ModeNone
+}
+
+// IP returns the anonymized version of ip according to the configured mode.
+func (a *Anonymizer) IP(ip string) string {
+	if !a.Enabled() || ip == "" {
+		return ip
+	}
+
+	switch a.mode {
+	case ModeHash:
+		return a.hash(ip)
+	case ModeTruncate:
+		return truncate(ip)
+	}
+
+	return ip
+}
+
+func (a *Anonymizer) hash(ip string) string {
+	h := sha256.New()
+	h.Write(a.currentSalt())
+	h.Write([]byte(ip))
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// currentSalt returns the salt for today, creating a new one when the day changes.
+func (a *Anonymizer) currentSalt() []byte {
+	a.Lock()
+	defer a.Unlock()
+
+	day := time.Now().UTC().Format("20060102")
+	if day != a.day || a.salt == nil {
+		salt := make([]byte, 32)
+		if _, err := rand.Read(salt); err != nil {
+			panic(err)
+		}
+		a.salt = salt
+		a.day = day
+	}
+
+	return a.salt
+}
+
+func truncate(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return "invalid"
+	}
+
+	if v4 := parsed.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String()
+	}
+
+	return parsed.Mask(net.CIDRMask(48, 128)).String()
+}
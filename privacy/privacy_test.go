@@ -0,0 +1,70 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package privacy
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestNewAnonymizer(t *testing.T) {
+	for _, mode := range []string{"", "hash", "truncate"} {
+		if _, err := NewAnonymizer(mode); err != nil {
+			t.Errorf("mode %q: %v", mode, err)
+		}
+	}
+	if _, err := NewAnonymizer("mask"); err == nil {
+		t.Error("expected an error for an unknown mode")
+	}
+}
+
+func TestAnonymizeNone(t *testing.T) {
+	var nilAnon *Anonymizer
+	none, _ := NewAnonymizer("")
+	for _, a := range []*Anonymizer{nilAnon, none} {
+		if a.Enabled() {
+			t.Error("expected the anonymizer to be disabled")
+		}
+		if ip := a.IP("192.0.2.10"); ip != "192.0.2.10" {
+			t.Errorf("expected the ip unchanged, got %s", ip)
+		}
+	}
+}
+
+func TestAnonymizeTruncate(t *testing.T) {
+	a, _ := NewAnonymizer("truncate")
+	tests := []struct {
+		ip, want string
+	}{
+		{"192.0.2.10", "192.0.2.0"},
+		{"::ffff:192.0.2.10", "192.0.2.0"},
+		{"2001:db8:85a3:8d3:1319:8a2e:370:7348", "2001:db8:85a3::"},
+		{"not an ip", "invalid"},
+		{"", ""},
+	}
+	for _, test := range tests {
+		if got := a.IP(test.ip); got != test.want {
+			t.Errorf("%q: expected %q, got %q", test.ip, test.want, got)
+		}
+	}
+}
+
+func TestAnonymizeHash(t *testing.T) {
+	a, _ := NewAnonymizer("hash")
+	first := a.IP("192.0.2.10")
+	if _, err := hex.DecodeString(first); err != nil || len(first) != 16 {
+		t.Fatalf("expected 16 hex characters, got %q", first)
+	}
+	if again := a.IP("192.0.2.10"); again != first {
+		t.Errorf("expected the same hash within a day, got %s and %s", first, again)
+	}
+	if other := a.IP("192.0.2.11"); other == first {
+		t.Error("expected another ip to get another hash")
+	}
+
+	// a new day draws a new salt, so visitors can't be followed across days.
+	a.day = "19700101"
+	if next := a.IP("192.0.2.10"); next == first {
+		t.Error("expected the hash to change with the salt")
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+// Package query contains helpers to run named sql statements against a configurable schema
+package query
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Query is a named sql statement.  Tables are written as {schema}.table so the
+// schema can be chosen when the query is run.  The name is used to wrap errors.
+type Query struct {
+	Name string
+	SQL  string
+}
+
+// DB is the subset of pgxpool.Pool, pgx.Conn and pgx.Tx used to run queries.  Tests
+// can substitute a mock implementation.
+type DB interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// Schema is the name of the schema queries are run against.
+type Schema string
+
+// SQL returns the sql of the query with the schema and {live} placeholders replaced.
+func (s Schema) SQL(q Query) string {
+	return live(strings.ReplaceAll(q.SQL, "{schema}", string(s)))
+}
+
+// Exec runs a query that does not return rows.
+func (s Schema) Exec(ctx context.Context, db DB, q Query, args ...any) (pgconn.CommandTag, error) {
+	tag, err := db.Exec(ctx, s.SQL(q), args...)
+	return tag, Wrap(q, err)
+}
+
+// Query runs a query that returns rows.
+func (s Schema) Query(ctx context.Context, db DB, q Query, args ...any) (pgx.Rows, error) {
+	rows, err := db.Query(ctx, s.SQL(q), args...)
+	return rows, Wrap(q, err)
+}
+
+// QueryRow runs a query that returns at most one row.  Errors returned from Scan
+// are wrapped with the query name.
+func (s Schema) QueryRow(ctx context.Context, db DB, q Query, args ...any) pgx.Row {
+	return &row{db.QueryRow(ctx, s.SQL(q), args...), q}
+}
+
+// Wrap prefixes err with the name of the query.  The original error can still be
+// checked with errors.Is (e.g. errors.Is(err, pgx.ErrNoRows)).
+func Wrap(q Query, err error) error {
+	if err == nil {
+		return nil
+	}
+	return fmt.Errorf("%s: %w", q.Name, err)
+}
+
+type row struct {
+	pgx.Row
+	q Query
+}
+
+func (r *row) Scan(dest ...any) error {
+	return Wrap(r.q, r.Row.Scan(dest...))
+}
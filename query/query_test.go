@@ -0,0 +1,49 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package query
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+)
+
+func TestSQL(t *testing.T) {
+	q := Query{Name: "test", SQL: "select a from {schema}.t1 join {schema}.t2 on true;"}
+	got := Schema("usr").SQL(q)
+	want := "select a from usr.t1 join usr.t2 on true;"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestWrap(t *testing.T) {
+	q := Query{Name: "getThing"}
+	if Wrap(q, nil) != nil {
+		t.Error("wrapping a nil error should return nil")
+	}
+
+	err := Wrap(q, pgx.ErrNoRows)
+	if !errors.Is(err, pgx.ErrNoRows) {
+		t.Error("wrapped error should still match pgx.ErrNoRows")
+	}
+	if err.Error() != "getThing: "+pgx.ErrNoRows.Error() {
+		t.Errorf("unexpected error text: %s", err.Error())
+	}
+}
+
+func TestLive(t *testing.T) {
+	q := Query{Name: "test", SQL: "select 1 from {schema}.a join {schema}.b on b.id = a.id where {live:a} and {live:b} and {live};"}
+	got := Schema("usr").SQL(q)
+	want := "select 1 from usr.a join usr.b on b.id = a.id where a.deleted_at is null and b.deleted_at is null and deleted_at is null;"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	got = Schema("usr").SQL(IncludeDeleted(q))
+	want = "select 1 from usr.a join usr.b on b.id = a.id where true and true and true;"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
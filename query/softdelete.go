@@ -0,0 +1,79 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package query
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Soft deleted rows are kept with the time they were deleted in a nullable deleted_at
+// column, so they can be restored until a purge job removes them past their retention.
+// Tables using it add:
+//
+//	deleted_at timestamptz NULL
+//
+// Queries filter out deleted rows with the {live} placeholder, or {live:alias} when the
+// table is aliased or joined, ie: "where name = $1 and {live}".  Both are replaced with
+// "deleted_at is null" when the query is run.
+const DeletedColumn = "deleted_at"
+
+var liveRegex = regexp.MustCompile(`\{live(?::(\w+))?\}`)
+
+// live replaces the {live} placeholders of sql with the deleted_at filter.
+func live(sql string) string {
+	if !strings.Contains(sql, "{live") {
+		return sql
+	}
+	return liveRegex.ReplaceAllStringFunc(sql, func(m string) string {
+		if alias := liveRegex.FindStringSubmatch(m)[1]; alias != "" {
+			return alias + "." + DeletedColumn + " is null"
+		}
+		return DeletedColumn + " is null"
+	})
+}
+
+// IncludeDeleted returns a copy of the query that also matches soft deleted rows, for
+// admin pages that list or restore them.
+func IncludeDeleted(q Query) Query {
+	return Query{
+		Name: q.Name,
+		SQL:  liveRegex.ReplaceAllString(q.SQL, "true"),
+	}
+}
+
+// SoftDelete marks the live rows of the table matched by the where clause as deleted
+// and returns the number of rows marked.  The table and where clause are part of the
+// sql and must never come from user input, values are passed as args ($1, $2, ...).
+func (s Schema) SoftDelete(ctx context.Context, db DB, table, where string, args ...any) (int64, error) {
+	q := Query{
+		Name: "softDelete." + table,
+		SQL:  "update {schema}." + table + " set " + DeletedColumn + " = now() where " + DeletedColumn + " is null and (" + where + ");",
+	}
+	tag, err := s.Exec(ctx, db, q, args...)
+	return tag.RowsAffected(), err
+}
+
+// Restore clears the deleted mark of the rows of the table matched by the where clause
+// and returns the number of rows restored.
+func (s Schema) Restore(ctx context.Context, db DB, table, where string, args ...any) (int64, error) {
+	q := Query{
+		Name: "restore." + table,
+		SQL:  "update {schema}." + table + " set " + DeletedColumn + " = null where " + DeletedColumn + " is not null and (" + where + ");",
+	}
+	tag, err := s.Exec(ctx, db, q, args...)
+	return tag.RowsAffected(), err
+}
+
+// PurgeDeleted removes the rows of the table that were soft deleted before the time
+// and returns the number of rows removed.
+func (s Schema) PurgeDeleted(ctx context.Context, db DB, table string, before time.Time) (int64, error) {
+	q := Query{
+		Name: "purgeDeleted." + table,
+		SQL:  "delete from {schema}." + table + " where " + DeletedColumn + " < $1;",
+	}
+	tag, err := s.Exec(ctx, db, q, before)
+	return tag.RowsAffected(), err
+}
@@ -0,0 +1,54 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package query
+
+import (
+	"context"
+	"errors"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Versioned rows carry a version that every update increments, so an update made from
+// a stale copy of the row can be detected instead of silently overwriting the changes
+// made since it was read.  Tables using it add:
+//
+//	version int4 NOT NULL DEFAULT 1
+//
+// Every update sets "version = version + 1", and the updates made on behalf of a client
+// add "and version = $n" to their where clause, with $n the version the client read.
+const VersionColumn = "version"
+
+// ErrNoVersion is returned when a versioned update is made without the version of the
+// row, so it can't be checked.  Http handlers report it as 400 Bad Request.
+var ErrNoVersion = errors.New("version of the row is required")
+
+// ErrConflict is returned when a row changed after the version being updated was read.
+// Http handlers report it as 409 Conflict.
+var ErrConflict = errors.New("row was changed by someone else, reload and try again")
+
+// ReadVersion returns the version of the row of the table matched by the where clause.
+// The table and where clause are part of the sql and must never come from user input.
+func (s Schema) ReadVersion(ctx context.Context, db DB, table, where string, args ...any) (int, error) {
+	q := Query{
+		Name: "readVersion." + table,
+		SQL:  "select " + VersionColumn + " from {schema}." + table + " where " + where + ";",
+	}
+	var version int
+	err := s.QueryRow(ctx, db, q, args...).Scan(&version)
+	return version, err
+}
+
+// VersionMismatch explains a versioned update that changed no rows.  It returns
+// ErrConflict when the row matched by the where clause still exists, so its version must
+// have changed, or pgx.ErrNoRows when it does not.
+func (s Schema) VersionMismatch(ctx context.Context, db DB, table, where string, args ...any) error {
+	_, err := s.ReadVersion(ctx, db, table, where, args...)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return pgx.ErrNoRows
+	}
+	if err != nil {
+		return err
+	}
+	return ErrConflict
+}
@@ -4,62 +4,74 @@ package schema
 import (
 	"context"
 	"errors"
-	"flag"
 	"fmt"
+	"io"
+	"os"
+	"strings"
 	"time"
 
 	"github.com/cwbriscoe/goutil/db"
 	"github.com/cwbriscoe/goweb/auth"
+	"github.com/cwbriscoe/goweb/comments"
+	"github.com/cwbriscoe/goweb/forms"
 	"github.com/cwbriscoe/goweb/job"
+	"github.com/cwbriscoe/goweb/notification"
+	"github.com/cwbriscoe/goweb/search"
+	"github.com/cwbriscoe/goweb/setting"
+	"github.com/cwbriscoe/goweb/shortlink"
+	"github.com/cwbriscoe/goweb/stats"
 	"github.com/jackc/pgx/v5"
 )
 
-var connInfo *db.PgConnInfo
-
-// CreateDatabase creates a new database and renames old one if it already exists
-func CreateDatabase(name string) (*pgx.Conn, error) {
-	var err error
-	connInfo, err = parseFlags()
-	if err != nil {
-		return nil, err
-	}
-
-	conn, err := db.GetPgConn(connInfo)
+// Names lists the schemas CreateDatabaseWithConfig creates, in the order they are created.
+var Names = []string{"auth", "job", "comments", "forms", "notification", "search", "setting", "shortlink", "stats"}
+
+// Missing returns the schemas in Names that do not exist in the database conn is
+// connected to or that the connected role is not allowed to use.
+func Missing(ctx context.Context, conn *pgx.Conn) ([]string, error) {
+	sql := `
+select n.name
+  from unnest($1::text[]) as n(name)
+ where case when exists (select from pg_catalog.pg_namespace where nspname = n.name)
+            then not has_schema_privilege(n.name, 'USAGE')
+            else true
+       end
+ order by n.name;`
+
+	rows, err := conn.Query(ctx, sql, Names)
 	if err != nil {
 		return nil, err
 	}
-
-	return createSchema(context.Background(), conn, name)
+	return pgx.CollectRows(rows, pgx.RowTo[string])
 }
 
-func parseFlags() (*db.PgConnInfo, error) {
-	// parse flags
-	host := flag.String("host", "localhost", "database host")
-	port := flag.String("port", "5432", "database port")
-	name := flag.String("name", "postgres", "database name")
-	user := flag.String("user", "postgres", "database user")
-	pass := flag.String("pass", "postgres", "database password")
+// Options are the optional settings of CreateDatabaseWithConfig.
+type Options struct {
+	Output io.Writer // progress messages, defaults to os.Stdout, use io.Discard to silence them
+}
 
-	flag.Parse()
+// CreateDatabaseWithConfig connects to the database in info, creates the database name
+// and its schemas and returns a connection to it.  An existing database with the same
+// name is renamed first.  info is not modified and opts may be nil.
+func CreateDatabaseWithConfig(ctx context.Context, info *db.PgConnInfo, name string, opts *Options) (*pgx.Conn, error) {
+	if info == nil {
+		return nil, errors.New("schema: missing connection info")
+	}
 
-	if *name == "" {
-		return nil, errors.New("a database name must be provided (-name)")
+	out := io.Writer(os.Stdout)
+	if opts != nil && opts.Output != nil {
+		out = opts.Output
 	}
 
-	if *pass == "" {
-		return nil, errors.New("a database password must be provided (-pass)")
+	conn, err := db.GetPgConn(info)
+	if err != nil {
+		return nil, err
 	}
 
-	return &db.PgConnInfo{
-		Host: *host,
-		Port: *port,
-		Name: *name,
-		User: *user,
-		Pass: *pass,
-	}, nil
+	return createSchema(ctx, conn, *info, name, out)
 }
 
-func createSchema(ctx context.Context, conn *pgx.Conn, name string) (*pgx.Conn, error) {
+func createSchema(ctx context.Context, conn *pgx.Conn, info db.PgConnInfo, name string, out io.Writer) (*pgx.Conn, error) {
 	var nm string
 
 	row := conn.QueryRow(ctx, "select datname from pg_database where datname = $1;", name)
@@ -71,101 +83,146 @@ func createSchema(ctx context.Context, conn *pgx.Conn, name string) (*pgx.Conn,
 	exists := (err != pgx.ErrNoRows)
 
 	if exists {
-		err = renameDatabase(ctx, conn, name)
+		err = renameDatabase(ctx, conn, name, out)
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	err = createNewDatabase(ctx, conn, name)
+	err = createNewDatabase(ctx, conn, name, out)
 	if err != nil {
 		return nil, err
 	}
 
-	err = CreateRole(ctx, conn, "api")
+	err = createRole(ctx, conn, "api", out)
 	if err != nil {
 		return nil, err
 	}
 
-	err = CreateRole(ctx, conn, "job")
+	err = createRole(ctx, conn, "job", out)
 	if err != nil {
 		return nil, err
 	}
 
-	connInfo.Name = name
-	fmt.Println("connecting to", name)
-	conn, err = db.GetPgConn(connInfo)
+	// close the maintenance connection, the schemas are created in the new database
+	if err = conn.Close(ctx); err != nil {
+		return nil, err
+	}
+
+	info.Name = name
+	fmt.Fprintln(out, "connecting to", name)
+	conn, err = db.GetPgConn(&info)
 	if err != nil {
 		return nil, err
 	}
 
-	fmt.Println("creating auth schema")
+	fmt.Fprintln(out, "creating auth schema")
 	err = auth.CreateSchema(ctx, conn)
 	if err != nil {
 		return nil, err
 	}
 
-	fmt.Println("creating job schema")
+	fmt.Fprintln(out, "creating job schema")
 	err = job.CreateSchema(ctx, conn)
 	if err != nil {
 		return nil, err
 	}
 
-	fmt.Println("successfully created database", name, "base schema")
-	return conn, nil
-}
+	fmt.Fprintln(out, "creating comments schema")
+	err = comments.CreateSchema(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
 
-func renameDatabase(ctx context.Context, conn *pgx.Conn, name string) error {
-	now := time.Now()
-	newName := name + now.Format("20060102150405")
+	fmt.Fprintln(out, "creating forms schema")
+	err = forms.CreateSchema(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
 
-	fmt.Println("renaming database", name, "to", newName)
+	fmt.Fprintln(out, "creating notification schema")
+	err = notification.CreateSchema(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
 
-	sql := "alter database " + name + " rename to " + newName
-	_, err := conn.Exec(ctx, sql)
+	fmt.Fprintln(out, "creating search schema")
+	err = search.CreateSchema(ctx, conn)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
-}
+	fmt.Fprintln(out, "creating setting schema")
+	err = setting.CreateSchema(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
 
-func createNewDatabase(ctx context.Context, conn *pgx.Conn, name string) error {
-	fmt.Println("creating database", name)
+	fmt.Fprintln(out, "creating shortlink schema")
+	err = shortlink.CreateSchema(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
 
-	sql := "create database " + name + " template template0;"
-	_, err := conn.Exec(ctx, sql)
+	fmt.Fprintln(out, "creating stats schema")
+	err = stats.CreateSchema(ctx, conn)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	fmt.Fprintln(out, "successfully created database", name, "base schema")
+	return conn, nil
+}
+
+func renameDatabase(ctx context.Context, conn *pgx.Conn, name string, out io.Writer) error {
+	newName := name + time.Now().Format("20060102150405")
+
+	fmt.Fprintln(out, "renaming database", name, "to", newName)
+
+	_, err := conn.Exec(ctx, renameDatabaseSQL(name, newName))
+	return err
+}
+
+func renameDatabaseSQL(name, newName string) string {
+	return "alter database " + pgx.Identifier{name}.Sanitize() + " rename to " + pgx.Identifier{newName}.Sanitize() + ";"
+}
+
+func createNewDatabase(ctx context.Context, conn *pgx.Conn, name string, out io.Writer) error {
+	fmt.Fprintln(out, "creating database", name)
+
+	_, err := conn.Exec(ctx, createDatabaseSQL(name))
+	return err
+}
+
+func createDatabaseSQL(name string) string {
+	return "create database " + pgx.Identifier{name}.Sanitize() + " template template0;"
 }
 
 // CreateRole creates a role with only login permissions
 func CreateRole(ctx context.Context, conn *pgx.Conn, name string) error {
-	fmt.Println("attempting to create role", name)
-
-	sql := "select 'create role " + name + " with login password ''" + name + "'';'"
-	sql += "where not exists (select from pg_catalog.pg_roles where rolname = '" + name + "');"
+	return createRole(ctx, conn, name, os.Stdout)
+}
 
-	var str string
-	row := conn.QueryRow(ctx, sql)
-	err := row.Scan(&str)
-	if err == pgx.ErrNoRows {
-		fmt.Println("role", name, "already exists")
-		return nil
-	}
+func createRole(ctx context.Context, conn *pgx.Conn, name string, out io.Writer) error {
+	fmt.Fprintln(out, "attempting to create role", name)
 
+	var exists bool
+	err := conn.QueryRow(ctx, "select exists (select from pg_catalog.pg_roles where rolname = $1);", name).Scan(&exists)
 	if err != nil {
 		return err
 	}
-
-	fmt.Println("creating role", name)
-	_, err = conn.Exec(ctx, str)
-	if err != nil {
-		return err
+	if exists {
+		fmt.Fprintln(out, "role", name, "already exists")
+		return nil
 	}
 
-	return nil
+	fmt.Fprintln(out, "creating role", name)
+	_, err = conn.Exec(ctx, createRoleSQL(name))
+	return err
+}
+
+// createRoleSQL returns the statement creating the role with its name as password, ddl
+// statements can't take parameters.
+func createRoleSQL(name string) string {
+	return "create role " + pgx.Identifier{name}.Sanitize() + " with login password '" + strings.ReplaceAll(name, "'", "''") + "';"
 }
@@ -0,0 +1,22 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package schema
+
+import "testing"
+
+func TestQuotedNames(t *testing.T) {
+	tests := []struct {
+		got, want string
+	}{
+		{createDatabaseSQL("goweb"), `create database "goweb" template template0;`},
+		{createDatabaseSQL(`a"; drop database x; --`), `create database "a""; drop database x; --" template template0;`},
+		{renameDatabaseSQL("goweb", "goweb20230501"), `alter database "goweb" rename to "goweb20230501";`},
+		{createRoleSQL("api"), `create role "api" with login password 'api';`},
+		{createRoleSQL("o'neil"), `create role "o'neil" with login password 'o''neil';`},
+	}
+	for _, test := range tests {
+		if test.got != test.want {
+			t.Errorf("got %s, want %s", test.got, test.want)
+		}
+	}
+}
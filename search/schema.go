@@ -0,0 +1,58 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package search
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// CreateSchema will create the search schema and associated tables needed
+// for this package to run
+func CreateSchema(ctx context.Context, conn *pgx.Conn) error {
+	var sql string
+	var err error
+
+	sql = "drop schema if exists search cascade;"
+	_, err = conn.Exec(ctx, sql)
+	if err != nil {
+		return err
+	}
+
+	sql = "create schema search authorization current_role;"
+	_, err = conn.Exec(ctx, sql)
+	if err != nil {
+		return err
+	}
+
+	sql = `
+	CREATE TABLE search.doc (
+		provider varchar NOT NULL,
+		"key" varchar NOT NULL,
+		title varchar NOT NULL,
+		body text NOT NULL,
+		url varchar NOT NULL,
+		tsv tsvector NOT NULL,
+		update_ts timestamptz NOT NULL,
+		CONSTRAINT doc_pk PRIMARY KEY (provider, key)
+	);`
+	_, err = conn.Exec(ctx, sql)
+	if err != nil {
+		return err
+	}
+
+	sql = "CREATE INDEX doc_tsv_idx ON search.doc USING gin (tsv);"
+	_, err = conn.Exec(ctx, sql)
+	if err != nil {
+		return err
+	}
+
+	sql = "grant select, insert, update, delete on table search.doc to api;"
+	_, err = conn.Exec(ctx, sql)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,274 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+// Package search maintains a Postgres full text index of the documents of registered
+// content providers and runs ranked queries against it.
+package search
+
+import (
+	"context"
+	"errors"
+	"html"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cwbriscoe/goutil/db"
+	"github.com/cwbriscoe/goutil/logging"
+	"github.com/cwbriscoe/goweb/query"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// DefaultSchema is the schema with the search tables.
+const DefaultSchema query.Schema = "search"
+
+// maxPageSize is the max number of hits returned per page.
+const maxPageSize = 50
+
+// startSel and stopSel mark the terms in the snippets returned by postgres, they are
+// replaced by the <b></b> tags once the text around them is escaped.
+const (
+	startSel = "\x02"
+	stopSel  = "\x03"
+)
+
+// headlineOptions are the ts_headline options of the snippets.
+const headlineOptions = "StartSel=" + startSel + ", StopSel=" + stopSel + ", MaxFragments=2, MaxWords=30, MinWords=10"
+
+// Document is a piece of content to be indexed.
+type Document struct {
+	Key     string    // unique key of the document within its provider
+	Title   string    // weighted higher than the body when ranking
+	Body    string    // text to be indexed
+	URL     string    // link to the document
+	Updated time.Time // last time the document changed
+	Deleted bool      // remove the document from the index
+}
+
+// Provider supplies the documents of a type of content to the index.
+type Provider interface {
+	// Name returns the unique name of the provider.
+	Name() string
+	// Documents returns the documents that changed since the given time.  The zero
+	// time asks for all documents.
+	Documents(ctx context.Context, since time.Time) ([]Document, error)
+}
+
+// Hit is a single document matching a query.
+type Hit struct {
+	Provider string  `json:"provider"`
+	Key      string  `json:"key"`
+	Title    string  `json:"title"`
+	URL      string  `json:"url"`
+	Snippet  string  `json:"snippet"` // html escaped matching text with the terms wrapped in <b></b>
+	Rank     float32 `json:"rank"`
+}
+
+// Results is a page of hits for a query.
+type Results struct {
+	Query string `json:"query"`
+	Page  int    `json:"page"`
+	Size  int    `json:"size"`
+	Total int64  `json:"total"`
+	Hits  []Hit  `json:"hits"`
+}
+
+// Settings contains the settings for an Index.
+type Settings struct {
+	DB     *pgxpool.Pool
+	Log    *logging.Logger
+	Schema string // defaults to "search"
+	Config string // text search config, defaults to "english"
+}
+
+// Index keeps the search tables up to date with the registered providers.
+type Index struct {
+	sync.Mutex
+	db        *pgxpool.Pool
+	log       *logging.Logger
+	schema    query.Schema
+	config    string
+	providers map[string]Provider
+	synced    map[string]time.Time // last successful sync per provider
+}
+
+// ErrEmptyQuery is returned when searching with an empty query.
+var ErrEmptyQuery = errors.New("empty search query")
+
+var (
+	qUpsertDoc = query.Query{
+		Name: "upsertDoc",
+		SQL: `
+		insert into {schema}.doc (provider, key, title, body, url, tsv, update_ts)
+		values ($1, $2, $3, $4, $5, setweight(to_tsvector($7::regconfig, $3), 'A') || setweight(to_tsvector($7::regconfig, $4), 'B'), $6)
+		on conflict (provider, key) do update set
+			title = excluded.title,
+			body = excluded.body,
+			url = excluded.url,
+			tsv = excluded.tsv,
+			update_ts = excluded.update_ts;`,
+	}
+	qDeleteDoc = query.Query{
+		Name: "deleteDoc",
+		SQL:  "delete from {schema}.doc where provider = $1 and key = $2;",
+	}
+	qSearch = query.Query{
+		Name: "search",
+		SQL: `
+		select provider, key, title, url,
+			ts_headline($4::regconfig, body, q, $5),
+			ts_rank_cd(tsv, q) as rank
+		from {schema}.doc, websearch_to_tsquery($4::regconfig, $1) q
+		where tsv @@ q
+		order by rank desc, update_ts desc
+		limit $2 offset $3;`,
+	}
+	qSearchCount = query.Query{
+		Name: "searchCount",
+		SQL:  "select count(*) from {schema}.doc where tsv @@ websearch_to_tsquery($2::regconfig, $1);",
+	}
+)
+
+// NewIndex returns a new Index.
+func NewIndex(settings *Settings) *Index {
+	idx := &Index{
+		db:        settings.DB,
+		log:       settings.Log,
+		schema:    DefaultSchema,
+		config:    "english",
+		providers: make(map[string]Provider),
+		synced:    make(map[string]time.Time),
+	}
+	if settings.Schema != "" {
+		idx.schema = query.Schema(settings.Schema)
+	}
+	if settings.Config != "" {
+		idx.config = settings.Config
+	}
+	return idx
+}
+
+// Register adds a content provider to the index.
+func (idx *Index) Register(p Provider) {
+	idx.Lock()
+	defer idx.Unlock()
+	idx.providers[p.Name()] = p
+}
+
+// Sync indexes the documents that changed since the last sync of each provider.
+func (idx *Index) Sync(ctx context.Context) error {
+	idx.Lock()
+	providers := make([]Provider, 0, len(idx.providers))
+	for _, p := range idx.providers {
+		providers = append(providers, p)
+	}
+	idx.Unlock()
+
+	var errs []error
+	for _, p := range providers {
+		if err := idx.syncProvider(ctx, p); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (idx *Index) syncProvider(ctx context.Context, p Provider) error {
+	idx.Lock()
+	since := idx.synced[p.Name()]
+	idx.Unlock()
+
+	start := time.Now()
+	docs, err := p.Documents(ctx, since)
+	if err != nil {
+		return err
+	}
+
+	if len(docs) > 0 {
+		batch := db.NewBatch(ctx, idx.db)
+		for _, doc := range docs {
+			if doc.Deleted {
+				batch.Queue(idx.schema.SQL(qDeleteDoc), p.Name(), doc.Key)
+				continue
+			}
+			batch.Queue(idx.schema.SQL(qUpsertDoc), p.Name(), doc.Key, doc.Title, doc.Body, doc.URL, doc.Updated, idx.config)
+		}
+		if _, err = batch.Exec(); err != nil {
+			return query.Wrap(qUpsertDoc, err)
+		}
+		idx.log.Info().Msgf("search: indexed %d %s documents", len(docs), p.Name())
+	}
+
+	idx.Lock()
+	idx.synced[p.Name()] = start
+	idx.Unlock()
+
+	return nil
+}
+
+// Start kicks off a goroutine to sync the index on the given interval until ctx is done.
+func (idx *Index) Start(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if err := idx.Sync(ctx); err != nil && ctx.Err() == nil {
+				idx.log.Err(err).Msg("goroutine: error syncing search index")
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Search returns a page of ranked hits for the query.  Pages start at 1.
+func (idx *Index) Search(ctx context.Context, q string, page, size int) (*Results, error) {
+	if q == "" {
+		return nil, ErrEmptyQuery
+	}
+	if page < 1 {
+		page = 1
+	}
+	if size < 1 || size > maxPageSize {
+		size = maxPageSize
+	}
+
+	results := &Results{Query: q, Page: page, Size: size}
+
+	err := idx.schema.QueryRow(ctx, idx.db, qSearchCount, q, idx.config).Scan(&results.Total)
+	if err != nil {
+		return nil, err
+	}
+
+	if results.Total == 0 {
+		results.Hits = []Hit{}
+		return results, nil
+	}
+
+	rows, err := idx.schema.Query(ctx, idx.db, qSearch, q, size, (page-1)*size, idx.config, headlineOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	results.Hits, err = pgx.CollectRows(rows, pgx.RowToStructByPos[Hit])
+	if err != nil {
+		return nil, query.Wrap(qSearch, err)
+	}
+	for i := range results.Hits {
+		results.Hits[i].Snippet = highlight(results.Hits[i].Snippet)
+	}
+
+	return results, nil
+}
+
+// highlightTags replaces the term markers with tags.
+var highlightTags = strings.NewReplacer(startSel, "<b>", stopSel, "</b>")
+
+// highlight escapes the snippet returned by ts_headline, the documents are plain text
+// and any markup in them is shown as is, then wraps the marked terms in <b></b>.
+func highlight(snippet string) string {
+	return highlightTags.Replace(html.EscapeString(snippet))
+}
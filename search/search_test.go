@@ -0,0 +1,18 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package search
+
+import "testing"
+
+func TestHighlight(t *testing.T) {
+	tests := map[string]string{
+		"plain " + startSel + "go" + stopSel + " text":                    "plain <b>go</b> text",
+		"<script>alert(1)</script> " + startSel + "go" + stopSel:          "&lt;script&gt;alert(1)&lt;/script&gt; <b>go</b>",
+		`<b onmouseover="x">` + startSel + "go" + stopSel + "</b> & more": "&lt;b onmouseover=&#34;x&#34;&gt;<b>go</b>&lt;/b&gt; &amp; more",
+	}
+	for in, want := range tests {
+		if got := highlight(in); got != want {
+			t.Errorf("highlight(%q): expected %q, got %q", in, want, got)
+		}
+	}
+}
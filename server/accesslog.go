@@ -0,0 +1,206 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package server
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cwbriscoe/goutil/logging"
+	"github.com/goccy/go-json"
+	"github.com/rs/zerolog"
+)
+
+// access log formats
+const (
+	accessText     = "text"
+	accessJSON     = "json"
+	accessCombined = "combined"
+)
+
+// accessMessage is the message of the json access log lines.
+const accessMessage = "access"
+
+// accessEntry is a single request written to the access log.
+type accessEntry struct {
+	start   time.Time
+	elapsed time.Duration
+	status  int
+	bytes   int64
+	host    string // anonymized ip of the visitor
+	visitor string // bot or visitor name, the anonymized ip otherwise
+	method  string
+	uri     string
+	proto   string
+	path    string
+	query   string
+	ua      string
+	referer string
+	aborted bool
+}
+
+// accessLog writes the request lines of Server.Logger in the configured format.
+type accessLog struct {
+	format string
+	out    io.WriteCloser // combined.log, only opened for the combined format
+}
+
+// newAccessLog opens the access log for the format of the config.
+func (s *Server) newAccessLog() (accessLog, error) {
+	a := accessLog{format: s.Config.AccessLog.Format}
+	switch a.format {
+	case "":
+		a.format = accessText
+	case accessText, accessJSON:
+	case accessCombined:
+		// combined lines are not json, so they go to their own file where analyzers
+		// like goaccess or awstats can read them.  The access log keeps the text lines.
+		var err error
+		a.out, err = s.newWriter("combined", logging.Config{
+			BaseDir:    s.Config.LogDir,
+			FileName:   "combined.log",
+			MaxAge:     time.Hour * 24 * 30,
+			MaxSize:    1024 * 1024,
+			MaxBackups: 100,
+			Compress:   true,
+		})
+		if err != nil {
+			return a, err
+		}
+	default:
+		return a, fmt.Errorf("unknown access log format: %s", a.format)
+	}
+	return a, nil
+}
+
+// write logs the entry.  log is the server logger tagged with the request id.
+func (a *accessLog) write(log *zerolog.Logger, e *accessEntry) {
+	switch a.format {
+	case accessJSON:
+		ev := log.Info().
+			Int("status", e.status).
+			Str("method", e.method).
+			Str("path", e.path)
+		if e.query != "" {
+			ev.Str("query", e.query)
+		}
+		ev.Int64("bytes", e.bytes).
+			Dur("duration", e.elapsed).
+			Str("visitor", e.visitor).
+			Str("ua", e.ua).
+			Str("referer", e.referer)
+		if e.aborted {
+			ev.Bool("aborted", true)
+		}
+		ev.Msg(accessMessage)
+	default:
+		if a.format == accessCombined {
+			if _, err := io.WriteString(a.out, combinedLine(e)); err != nil {
+				log.Err(err).Msg("access: error writing combined log")
+			}
+		}
+		if e.aborted {
+			log.Info().Msgf("%d %s %s %s %v client closed request", e.status, e.visitor, e.method, e.uri, e.elapsed)
+			return
+		}
+		log.Info().Msgf("%d %s %s %s %v", e.status, e.visitor, e.method, e.uri, e.elapsed)
+	}
+}
+
+// ParseAccessLine returns the method and url of a line of the access log or the
+// combined log written in any of the formats, for tools replaying the traffic.
+func ParseAccessLine(line []byte) (method, uri string, ok bool) {
+	var entry struct {
+		Message string `json:"message"`
+		Method  string `json:"method"`
+		Path    string `json:"path"`
+		Query   string `json:"query"`
+	}
+	if err := json.Unmarshal(line, &entry); err != nil {
+		// combined: host ident user [time] "method url protocol" ...
+		_, request, found := strings.Cut(string(line), "\"")
+		fields := strings.Fields(request)
+		if !found || len(fields) < 3 {
+			return "", "", false
+		}
+		return fields[0], fields[1], true
+	}
+
+	if entry.Message == accessMessage && entry.Method != "" {
+		uri = entry.Path
+		if entry.Query != "" {
+			uri += "?" + entry.Query
+		}
+		return entry.Method, uri, true
+	}
+
+	// text: status visitor method url elapsed
+	fields := strings.Fields(entry.Message)
+	if len(fields) < 5 {
+		return "", "", false
+	}
+	return fields[2], fields[3], true
+}
+
+// close closes the combined log if it was opened.
+func (a *accessLog) close() error {
+	if a.out == nil {
+		return nil
+	}
+	return a.out.Close()
+}
+
+// combinedLine formats the entry in the apache combined log format:
+// host ident user [time] "request" status bytes "referer" "user-agent"
+func combinedLine(e *accessEntry) string {
+	var b strings.Builder
+	b.WriteString(e.host)
+	b.WriteString(" - - [")
+	b.WriteString(e.start.Format("02/Jan/2006:15:04:05 -0700"))
+	b.WriteString("] \"")
+	b.WriteString(combinedEscape(e.method + " " + e.uri + " " + e.proto))
+	b.WriteString("\" ")
+	b.WriteString(strconv.Itoa(e.status))
+	b.WriteByte(' ')
+	if e.bytes > 0 {
+		b.WriteString(strconv.FormatInt(e.bytes, 10))
+	} else {
+		b.WriteByte('-')
+	}
+	b.WriteString(" \"")
+	b.WriteString(combinedField(e.referer))
+	b.WriteString("\" \"")
+	b.WriteString(combinedField(e.ua))
+	b.WriteString("\"\n")
+	return b.String()
+}
+
+// combinedField escapes a header value for the combined log, empty values are "-".
+func combinedField(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return combinedEscape(s)
+}
+
+// combinedEscape escapes quotes, backslashes and control characters like apache does
+// so a crafted header can not break the line apart.
+func combinedEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c == 0x7f:
+			fmt.Fprintf(&b, "\\x%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
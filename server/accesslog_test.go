@@ -0,0 +1,90 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package server
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/cwbriscoe/goweb/config"
+	"github.com/rs/zerolog"
+)
+
+func TestCombinedLine(t *testing.T) {
+	start := time.Date(2023, time.October, 5, 13, 55, 36, 0, time.FixedZone("", -7*3600))
+	e := &accessEntry{
+		start:   start,
+		status:  200,
+		bytes:   2326,
+		host:    "127.0.0.1",
+		method:  "GET",
+		uri:     "/apache_pb.gif?x=1",
+		proto:   "HTTP/1.1",
+		referer: "http://www.example.com/start.html",
+		ua:      "Mozilla/4.08 [en] (Win98; I ;Nav)",
+	}
+
+	want := `127.0.0.1 - - [05/Oct/2023:13:55:36 -0700] "GET /apache_pb.gif?x=1 HTTP/1.1" 200 2326 "http://www.example.com/start.html" "Mozilla/4.08 [en] (Win98; I ;Nav)"` + "\n"
+	if got := combinedLine(e); got != want {
+		t.Errorf("combinedLine:\n got %q\nwant %q", got, want)
+	}
+
+	e.bytes = 0
+	e.referer = ""
+	e.ua = "evil\" \"agent\n"
+	want = `127.0.0.1 - - [05/Oct/2023:13:55:36 -0700] "GET /apache_pb.gif?x=1 HTTP/1.1" 200 - "-" "evil\" \"agent\x0a"` + "\n"
+	if got := combinedLine(e); got != want {
+		t.Errorf("combinedLine escaped:\n got %q\nwant %q", got, want)
+	}
+}
+
+func TestAccessLogFormat(t *testing.T) {
+	for format, valid := range map[string]bool{"": true, "text": true, "json": true, "apache": false} {
+		s := &Server{Config: &config.Config{}}
+		s.Config.AccessLog.Format = format
+		_, err := s.newAccessLog()
+		if valid && err != nil {
+			t.Errorf("format %q: unexpected error %v", format, err)
+		}
+		if !valid && err == nil {
+			t.Errorf("format %q: expected an error", format)
+		}
+	}
+}
+
+func TestParseAccessLine(t *testing.T) {
+	tests := []struct {
+		line        string
+		method, uri string
+		ok          bool
+	}{
+		{`{"level":"info","message":"200 10.0.0.1 GET /books?page=2 1.2ms"}`, "GET", "/books?page=2", true},
+		{`{"level":"info","status":200,"method":"GET","path":"/books","query":"page=2","message":"access"}`, "GET", "/books?page=2", true},
+		{`10.0.0.0 - - [01/May/2023:12:00:00 +0000] "POST /login HTTP/1.1" 303 - "-" "curl/8.0"`, "POST", "/login", true},
+		{`{"level":"info","message":"server started"}`, "", "", false},
+		{`garbage`, "", "", false},
+	}
+	for _, test := range tests {
+		method, uri, ok := ParseAccessLine([]byte(test.line))
+		if method != test.method || uri != test.uri || ok != test.ok {
+			t.Errorf("ParseAccessLine(%s) = %s %s %t, want %s %s %t", test.line, method, uri, ok, test.method, test.uri, test.ok)
+		}
+	}
+}
+
+func TestParseWrittenAccessLine(t *testing.T) {
+	e := &accessEntry{status: 200, visitor: "10.0.0.0", method: "GET", uri: "/books?page=2", path: "/books", query: "page=2", proto: "HTTP/1.1"}
+	for _, format := range []string{accessText, accessJSON} {
+		var buf bytes.Buffer
+		log := zerolog.New(&buf)
+		a := &accessLog{format: format}
+		a.write(&log, e)
+		if method, uri, _ := ParseAccessLine(buf.Bytes()); method != e.method || uri != e.uri {
+			t.Errorf("%s: parsed %s %s from %s", format, method, uri, buf.String())
+		}
+	}
+	if method, uri, _ := ParseAccessLine([]byte(combinedLine(e))); method != e.method || uri != e.uri {
+		t.Errorf("combined: parsed %s %s", method, uri)
+	}
+}
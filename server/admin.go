@@ -3,29 +3,34 @@
 package server
 
 import (
-	"context"
+	"errors"
 	"net/http"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/cwbriscoe/goutil/compress"
+	"github.com/cwbriscoe/goweb/correlate"
+	"github.com/cwbriscoe/goweb/job"
 	"github.com/cwbriscoe/webcache"
 	"github.com/goccy/go-json"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 func (s *Server) adminHandler() http.HandlerFunc {
-	return s.HandlePanic(s.Logger(s.auth.AuthHandler("admin", s.getAdminData())))
+	return s.HandlePanic(s.Logger(s.ProfileLabel("admin", s.getAdminData())))
 }
 
 func (s *Server) getAdminData() http.HandlerFunc {
-	var once sync.Once
-	admin := &Admin{}
 	return func(w http.ResponseWriter, r *http.Request) {
-		once.Do(func() {
-			admin.SetResources(s.DB, s.Cache)
-		})
-		bytes, err := admin.GetCache(r.Context())
+		name := s.Param(r, "func")
+		bytes, err := s.admin.Get(r, name)
+		if err == errAdminNotFound {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
 		if err != nil {
+			correlate.Log(r.Context(), s.Log).Err(err).Msgf("admin: error calling %s", name)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
@@ -39,10 +44,40 @@ func (s *Server) getAdminData() http.HandlerFunc {
 	}
 }
 
+// AdminFunc returns data that will be marshalled to json and returned by the
+// admin handler.
+type AdminFunc func(r *http.Request) (any, error)
+
+var errAdminNotFound = errors.New("admin function not found")
+
+// AddAdminFunc registers a function that will be served at GET /admin/{name}/ to users
+// with the admin permission.
+func (s *Server) AddAdminFunc(name string, f AdminFunc) {
+	s.admin.add(&s.admin.funcs, name, f)
+}
+
+// AddAdminAction registers a function that changes the state of the server, it will be
+// served at POST /admin/{name}/ to users with the admin permission.
+func (s *Server) AddAdminAction(name string, f AdminFunc) {
+	s.admin.add(&s.admin.actions, name, f)
+}
+
 // Admin struct stores resources needed by the API
 type Admin struct {
-	db    *pgxpool.Pool
-	cache *webcache.WebCache
+	sync.RWMutex
+	db      *pgxpool.Pool
+	cache   *webcache.WebCache
+	funcs   map[string]AdminFunc
+	actions map[string]AdminFunc
+}
+
+func (a *Admin) add(funcs *map[string]AdminFunc, name string, f AdminFunc) {
+	a.Lock()
+	defer a.Unlock()
+	if *funcs == nil {
+		*funcs = make(map[string]AdminFunc)
+	}
+	(*funcs)[name] = f
 }
 
 // SetResources sets the DB to be used by the Github API
@@ -51,19 +86,63 @@ func (a *Admin) SetResources(db *pgxpool.Pool, cache *webcache.WebCache) {
 	a.cache = cache
 }
 
-// GetCache retrieves stats from the cache
-func (a *Admin) GetCache(_ context.Context) ([]byte, error) {
-	stats := a.cache.BucketStats()
+// Get calls the admin function, or the admin action for a POST, with the given name and
+// returns the brotli compressed json result.
+func (a *Admin) Get(r *http.Request, name string) ([]byte, error) {
+	a.RLock()
+	f, ok := a.funcs[name]
+	if r.Method == http.MethodPost {
+		f, ok = a.actions[name]
+	}
+	a.RUnlock()
+	if !ok {
+		return nil, errAdminNotFound
+	}
 
-	src, err := json.MarshalIndent(stats, "", "  ")
+	data, err := f(r)
 	if err != nil {
-		return []byte(err.Error()), err
+		return nil, err
 	}
 
-	dest, err := compress.Brotli(src, 6)
+	src, err := json.MarshalIndent(data, "", "  ")
 	if err != nil {
 		return nil, err
 	}
 
-	return dest, nil
+	return compress.Brotli(src, 6)
+}
+
+// GetCache retrieves stats from the cache
+func (a *Admin) GetCache(_ *http.Request) (any, error) {
+	return a.cache.BucketStats(), nil
+}
+
+// maxJobRows caps the ?limit= of the job admin functions.
+const maxJobRows = 1000
+
+// jobLimit returns the ?limit= of a job admin function, 100 by default and at most
+// maxJobRows.
+func jobLimit(r *http.Request) int {
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 {
+		return 100
+	}
+	return min(limit, maxJobRows)
+}
+
+// jobSchedule is the admin function listing the job runs expected in the next ?hours=
+// hours (default 24), at most ?limit= runs (default 100).
+func (s *Server) jobSchedule(r *http.Request) (any, error) {
+	hours, err := strconv.Atoi(r.URL.Query().Get("hours"))
+	if err != nil || hours <= 0 {
+		hours = 24
+	}
+	return job.UpcomingRuns(r.Context(), s.DB, s.JobSchema, time.Duration(hours)*time.Hour, jobLimit(r))
+}
+
+// jobHistory is the admin function listing the last runs of the jobs and their stats,
+// of the job ?job= (all jobs by default), at most ?limit= runs (default 100).
+func (s *Server) jobHistory(r *http.Request) (any, error) {
+	jobID, _ := strconv.Atoi(r.URL.Query().Get("job"))
+	return job.History(r.Context(), s.DB, s.JobSchema, jobID, jobLimit(r))
 }
@@ -0,0 +1,55 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package server
+
+import (
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/cwbriscoe/goweb/config"
+)
+
+func TestJobLimit(t *testing.T) {
+	tests := map[string]int{
+		"":              100,
+		"?limit=abc":    100,
+		"?limit=-5":     100,
+		"?limit=20":     20,
+		"?limit=999999": maxJobRows,
+	}
+	for query, want := range tests {
+		r := httptest.NewRequest("GET", "/admin/jobhistory/"+query, nil)
+		if got := jobLimit(r); got != want {
+			t.Errorf("%q: expected %d, got %d", query, want, got)
+		}
+	}
+}
+
+func TestAdminActions(t *testing.T) {
+	s := newStreamServer()
+	s.Config = &config.Config{LogDir: t.TempDir()}
+	s.admin = &Admin{}
+	s.AddAdminAction("profile", s.captureProfile)
+
+	if _, err := s.admin.Get(httptest.NewRequest("GET", "/admin/profile/?type=heap", nil), "profile"); err != errAdminNotFound {
+		t.Errorf("expected an action not to be served on a GET, got %v", err)
+	}
+
+	names := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		if _, err := s.admin.Get(httptest.NewRequest("POST", "/admin/profile/?type=heap", nil), "profile"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, err := os.ReadDir(s.profileDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		names[entry.Name()] = true
+	}
+	if len(names) != 2 {
+		t.Errorf("expected 2 heap profiles with distinct names, got %v", names)
+	}
+}
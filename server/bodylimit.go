@@ -0,0 +1,87 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package server
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/cwbriscoe/goweb/internal/decode"
+	"github.com/cwbriscoe/goweb/internal/respond"
+)
+
+// defaultMaxBody is the largest request body when limits.maxBody is not set.
+const defaultMaxBody = 10 << 20
+
+type bodyKey struct{}
+
+// limitBody limits the request bodies to limits.maxBody and the bodies read by Decode
+// to limits.maxJsonBody.  The original body is kept so MaxBody can raise the limit of a
+// route, which is not known yet, so a body announcing more than the limit is only
+// refused when the handler reads it.
+func (s *Server) limitBody(next http.Handler) http.Handler {
+	limit := s.Config.Limits.MaxBody
+	if limit == 0 {
+		limit = defaultMaxBody
+	}
+	jsonLimit := s.Config.Limits.MaxJSONBody
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if jsonLimit > 0 {
+			ctx = decode.WithMaxBytes(ctx, jsonLimit)
+		}
+		if limit > 0 && r.Body != nil && r.Body != http.NoBody {
+			ctx = context.WithValue(ctx, bodyKey{}, r.Body)
+			if r.ContentLength > limit {
+				r.Body = &announcedBody{ReadCloser: r.Body, w: w, limit: limit}
+			} else {
+				r.Body = http.MaxBytesReader(w, r.Body, limit)
+			}
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// MaxBody returns middleware limiting the request bodies of a route to n bytes, more or
+// less than limits.maxBody.  Decode reads up to n bytes on the route too.  Requests
+// announcing a larger body get a 413 with the code body_too_large, reads past n of the
+// others fail with an *http.MaxBytesError.
+func (s *Server) MaxBody(n int64) Middleware {
+	return func(f http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.ContentLength > n {
+				writeBodyTooLarge(w, r, n)
+				return
+			}
+			body := r.Body
+			if orig, ok := r.Context().Value(bodyKey{}).(io.ReadCloser); ok {
+				body = orig
+			}
+			if body != nil && body != http.NoBody {
+				r.Body = http.MaxBytesReader(w, body, n)
+			}
+			f(w, r.WithContext(decode.WithMaxBytes(r.Context(), n)))
+		}
+	}
+}
+
+// announcedBody fails the reads of a body announcing more than the limit without
+// reading it, like http.MaxBytesReader does once the limit is read.
+type announcedBody struct {
+	io.ReadCloser
+	w     http.ResponseWriter
+	limit int64
+}
+
+func (b *announcedBody) Read([]byte) (int, error) {
+	b.w.Header().Set("Connection", "close")
+	return 0, &http.MaxBytesError{Limit: b.limit}
+}
+
+func writeBodyTooLarge(w http.ResponseWriter, r *http.Request, limit int64) {
+	w.Header().Set("Connection", "close")
+	respond.WriteError(w, r, http.StatusRequestEntityTooLarge, "body_too_large", "the body is larger than "+strconv.FormatInt(limit, 10)+" bytes")
+}
@@ -0,0 +1,83 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cwbriscoe/goweb/config"
+)
+
+func TestBodyLimits(t *testing.T) {
+	s := newStreamServer()
+	s.Config = &config.Config{}
+	s.Config.Limits.MaxBody = 10
+
+	read := func(w http.ResponseWriter, r *http.Request) {
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		_, _ = w.Write(data)
+	}
+
+	tests := []struct {
+		name   string
+		h      http.Handler
+		body   string
+		chunk  bool // hide the content length
+		status int
+	}{
+		{"under", s.limitBody(http.HandlerFunc(read)), "0123456789", false, 200},
+		{"announced", s.limitBody(http.HandlerFunc(read)), "0123456789a", false, 413},
+		{"read", s.limitBody(http.HandlerFunc(read)), "0123456789a", true, 413},
+		{"route raises", s.limitBody(s.MaxBody(20)(read)), "0123456789abcdef", true, 200},
+		{"route raises announced", s.limitBody(s.MaxBody(20)(read)), "0123456789abcdef", false, 200},
+		{"route raises past", s.limitBody(s.MaxBody(20)(read)), "0123456789abcdef01234", false, 413},
+		{"route lowers", s.limitBody(s.MaxBody(4)(read)), "01234", false, 413},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("POST", "/", strings.NewReader(test.body))
+		if test.chunk {
+			r.ContentLength = -1
+		}
+		w := httptest.NewRecorder()
+		test.h.ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("%s: expected %d, got %d", test.name, test.status, w.Code)
+		}
+		if w.Code == http.StatusOK && w.Body.String() != test.body {
+			t.Errorf("%s: expected %q, got %q", test.name, test.body, w.Body.String())
+		}
+	}
+
+	r := httptest.NewRequest("POST", "/", strings.NewReader(`{"text":"too long"}`))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	s.MaxBody(8)(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := Decode[struct{ Text string }](r); err != nil {
+			s.WriteDecodeError(w, r, err)
+		}
+	})(w, r)
+	if w.Code != http.StatusRequestEntityTooLarge || !strings.Contains(w.Body.String(), "body_too_large") {
+		t.Errorf("expected Decode to use the route limit, got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestNewHTTPServer(t *testing.T) {
+	s := newStreamServer()
+	s.Config = &config.Config{}
+	s.Config.Limits.ReadTimeout = 5
+	s.Config.Limits.MaxHeaderBytes = 4096
+
+	srv := s.newHTTPServer(":0", http.NotFoundHandler())
+	if srv.ReadTimeout != 5*time.Second || srv.ReadHeaderTimeout != 10*time.Second || srv.WriteTimeout != 0 || srv.IdleTimeout != 2*time.Minute || srv.MaxHeaderBytes != 4096 {
+		t.Errorf("unexpected limits: read %s, header %s, write %s, idle %s, max header %d", srv.ReadTimeout, srv.ReadHeaderTimeout, srv.WriteTimeout, srv.IdleTimeout, srv.MaxHeaderBytes)
+	}
+}
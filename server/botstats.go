@@ -0,0 +1,223 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package server
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cwbriscoe/goutil/db"
+	"github.com/cwbriscoe/goweb/query"
+	"github.com/jackc/pgx/v5"
+)
+
+// statsSchema is the schema with the traffic stats tables.
+const statsSchema query.Schema = "stats"
+
+const (
+	maxBotHitKeys = 10000 // distinct day, bot and path keys kept between flushes
+	maxBotPathLen = 200
+	otherBotPaths = "(other)" // the paths past maxBotHitKeys are counted under it
+)
+
+var (
+	qUpsertBotHit = query.Query{
+		Name: "upsertBotHit",
+		SQL: `
+		insert into {schema}.bot_hit (day, bot, path, hits, total_ms, errors, last_ts)
+		values ($1, $2, $3, $4, $5, $6, $7)
+		on conflict (day, bot, path) do update set
+			hits = bot_hit.hits + excluded.hits,
+			total_ms = bot_hit.total_ms + excluded.total_ms,
+			errors = bot_hit.errors + excluded.errors,
+			last_ts = greatest(bot_hit.last_ts, excluded.last_ts);`,
+	}
+	qBotReport = query.Query{
+		Name: "botReport",
+		SQL: `
+		select bot, sum(hits)::int8, count(distinct path)::int8, sum(total_ms) / sum(hits), sum(errors)::int8, max(last_ts),
+			coalesce(sum(hits) filter (where day = current_date), 0)::int8
+		from {schema}.bot_hit
+		where day > current_date - $1::int4
+		group by bot
+		order by 2 desc;`,
+	}
+	qBotTopPaths = query.Query{
+		Name: "botTopPaths",
+		SQL: `
+		select path, sum(hits)::int8
+		from {schema}.bot_hit
+		where bot = $1 and day > current_date - $2::int4
+		group by path
+		order by 2 desc
+		limit 10;`,
+	}
+)
+
+type botHit struct {
+	hits    int64
+	totalMS float64
+	errors  int64
+	last    time.Time
+}
+
+type botHitKey struct {
+	day  string
+	bot  string
+	path string
+}
+
+// botStats aggregates requests from verified crawlers in memory and periodically
+// flushes them to the database.
+type botStats struct {
+	sync.Mutex
+	hits map[botHitKey]*botHit
+}
+
+// BotPath is the number of times a bot requested a path.
+type BotPath struct {
+	Path string `json:"path"`
+	Hits int64  `json:"hits"`
+}
+
+// BotReport summarizes the traffic of a verified crawler.
+type BotReport struct {
+	Bot       string    `json:"bot"`
+	Requests  int64     `json:"requests"`
+	Paths     int64     `json:"paths"`
+	AvgMS     float64   `json:"avgMs"`
+	Errors    int64     `json:"errors"`
+	LastSeen  time.Time `json:"lastSeen"`
+	Budget    float64   `json:"budget"`    // requests per day the good bot limiter allows
+	BudgetPct float64   `json:"budgetPct"` // requests today as a percent of the budget
+	TopPaths  []BotPath `json:"topPaths"`
+}
+
+// record counts the request of the bot.  Crawlers can request any number of paths, so
+// long paths are truncated and the paths past maxBotHitKeys are counted together.
+func (b *botStats) record(bot, path string, status int, elapsed time.Duration) {
+	now := time.Now()
+	if len(path) > maxBotPathLen {
+		path = strings.ToValidUTF8(path[:maxBotPathLen], "")
+	}
+	key := botHitKey{now.Format("2006-01-02"), bot, path}
+
+	b.Lock()
+	defer b.Unlock()
+
+	if b.hits == nil {
+		b.hits = make(map[botHitKey]*botHit)
+	}
+	hit, ok := b.hits[key]
+	if !ok && len(b.hits) >= maxBotHitKeys {
+		key.path = otherBotPaths
+		hit, ok = b.hits[key]
+	}
+	if !ok {
+		hit = &botHit{}
+		b.hits[key] = hit
+	}
+	hit.hits++
+	hit.totalMS += float64(elapsed) / float64(time.Millisecond)
+	// a client giving up is not an error of the crawled site
+	if status >= 400 && status != StatusClientClosed {
+		hit.errors++
+	}
+	hit.last = now
+}
+
+func (b *botStats) swap() map[botHitKey]*botHit {
+	b.Lock()
+	defer b.Unlock()
+	hits := b.hits
+	b.hits = nil
+	return hits
+}
+
+// flushBotStats writes the aggregated bot hits to the database.
+func (s *Server) flushBotStats() error {
+	hits := s.bots.swap()
+	if len(hits) == 0 {
+		return nil
+	}
+
+	batch := db.NewBatch(context.TODO(), s.DB)
+	for key, hit := range hits {
+		batch.Queue(statsSchema.SQL(qUpsertBotHit), key.day, key.bot, key.path, hit.hits, hit.totalMS, hit.errors, hit.last)
+	}
+
+	_, err := batch.Exec()
+	return query.Wrap(qUpsertBotHit, err)
+}
+
+// startBotStats kicks off a goroutine to flush the bot stats every minute.
+func (s *Server) startBotStats() {
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if err := s.flushBotStats(); err != nil {
+				s.Log.Err(err).Msg("goroutine: error flushing bot stats")
+			}
+		}
+	}()
+}
+
+// flushBotReport is the admin action writing the bot hits that were not flushed yet
+// before returning the report.
+func (s *Server) flushBotReport(r *http.Request) (any, error) {
+	if err := s.flushBotStats(); err != nil {
+		return nil, err
+	}
+	return s.botReport(r)
+}
+
+// botReport returns the crawler traffic for the last ?days= days (default 7), up to the
+// last flush.
+func (s *Server) botReport(r *http.Request) (any, error) {
+	days, err := strconv.Atoi(r.URL.Query().Get("days"))
+	if err != nil || days <= 0 {
+		days = 7
+	}
+
+	rows, err := statsSchema.Query(r.Context(), s.DB, qBotReport, days)
+	if err != nil {
+		return nil, err
+	}
+
+	budget := s.Limiter.GoodBotBudget()
+	reports, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (*BotReport, error) {
+		report := &BotReport{Budget: budget}
+		var today int64
+		err := row.Scan(&report.Bot, &report.Requests, &report.Paths, &report.AvgMS, &report.Errors, &report.LastSeen, &today)
+		if budget > 0 {
+			report.BudgetPct = float64(today) / budget * 100
+		}
+		return report, err
+	})
+	if err != nil {
+		return nil, query.Wrap(qBotReport, err)
+	}
+
+	for _, report := range reports {
+		rows, err = statsSchema.Query(r.Context(), s.DB, qBotTopPaths, report.Bot, days)
+		if err != nil {
+			return nil, err
+		}
+		report.TopPaths, err = pgx.CollectRows(rows, pgx.RowToStructByPos[BotPath])
+		if err != nil {
+			return nil, query.Wrap(qBotTopPaths, err)
+		}
+	}
+
+	return reports, nil
+}
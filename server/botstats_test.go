@@ -0,0 +1,35 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package server
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBotStatsKeys(t *testing.T) {
+	var b botStats
+	for i := 0; i < maxBotHitKeys+5; i++ {
+		b.record("Google", "/p/"+strconv.Itoa(i), 200, time.Millisecond)
+	}
+	b.record("Google", "/"+strings.Repeat("a", 1000), 200, time.Millisecond)
+
+	hits := b.swap()
+	if len(hits) != maxBotHitKeys+1 {
+		t.Fatalf("expected %d keys, got %d", maxBotHitKeys+1, len(hits))
+	}
+	other := 0
+	for key, hit := range hits {
+		if key.path == otherBotPaths {
+			other += int(hit.hits)
+		}
+		if len(key.path) > maxBotPathLen {
+			t.Errorf("expected the path to be truncated, got %d bytes", len(key.path))
+		}
+	}
+	if other != 6 {
+		t.Errorf("expected 6 hits counted under %s, got %d", otherBotPaths, other)
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package server
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/cwbriscoe/goutil/net"
+)
+
+// BotVariantOptions are the per route options of BotVariant.
+type BotVariantOptions struct {
+	Bots []string // names of the verified good bots served the variant, ie: Google or Bing, all of them when empty
+}
+
+// serves returns true if the variant is served to the bot with the name.
+func (o *BotVariantOptions) serves(name string) bool {
+	if o == nil || len(o.Bots) == 0 {
+		return true
+	}
+	for _, bot := range o.Bots {
+		if strings.EqualFold(bot, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// BotGroup returns the cache group of the bot variant of a group, so both variants of
+// a page are cached separately.  The bot group is added with the getter rendering the
+// full page on the server.
+func BotGroup(group string) string {
+	return group + ".bot"
+}
+
+// IsGoodBot returns the name of the bot if the request comes from a good bot verified
+// by the limiters.
+func (s *Server) IsGoodBot(r *http.Request) (string, bool) {
+	ip := net.GetIP(r)
+	if s.Limiters.VisitorKind(ip) != "goodbot" {
+		return "", false
+	}
+	return s.Limiters.BotName(ip), true
+}
+
+// BotVariant serves the bot handler, ie: a simplified page fully rendered on the server
+// for search engines, to the verified good bots picked by opts and the user handler,
+// ie: the spa shell, to everyone else.  Bots are only known once the limiter verified
+// them, so their first requests get the user variant.  opts may be nil.
+func (s *Server) BotVariant(opts *BotVariantOptions, bot, user http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// shared caches must not serve one variant in place of the other.
+		w.Header().Add("Vary", "User-Agent")
+
+		if name, ok := s.IsGoodBot(r); ok && opts.serves(name) {
+			bot(w, r)
+			return
+		}
+		user(w, r)
+	}
+}
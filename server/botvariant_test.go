@@ -0,0 +1,47 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBotVariantOptions(t *testing.T) {
+	var none *BotVariantOptions
+	if !none.serves("Google") {
+		t.Error("nil options should serve every good bot")
+	}
+
+	opts := &BotVariantOptions{Bots: []string{"Google", "Bing"}}
+	for name, want := range map[string]bool{"Google": true, "bing": true, "Yandex": false} {
+		if got := opts.serves(name); got != want {
+			t.Errorf("%s: got %t, want %t", name, got, want)
+		}
+	}
+}
+
+func TestBotVariantUser(t *testing.T) {
+	s := &Server{}
+	served := ""
+	h := s.BotVariant(nil,
+		func(http.ResponseWriter, *http.Request) { served = "bot" },
+		func(http.ResponseWriter, *http.Request) { served = "user" })
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("User-Agent", "Mozilla/5.0 (compatible; Googlebot/2.1)")
+	w := httptest.NewRecorder()
+	h(w, r)
+
+	// claiming to be a bot is not enough, it has to be verified by the limiter.
+	if served != "user" {
+		t.Errorf("unverified bot got the %s variant", served)
+	}
+	if w.Header().Get("Vary") != "User-Agent" {
+		t.Errorf("expected Vary: User-Agent, got %q", w.Header().Get("Vary"))
+	}
+	if BotGroup("index") != "index.bot" {
+		t.Errorf("unexpected bot group %s", BotGroup("index"))
+	}
+}
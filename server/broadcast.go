@@ -0,0 +1,151 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package server
+
+import (
+	"sync"
+
+	"github.com/goccy/go-json"
+)
+
+// InvalidateChannel is the postgres channel cache invalidations are broadcast on to the
+// other servers sharing the database when cache.cluster is set in the config.
+const InvalidateChannel = "cache_invalidate"
+
+// broadcastQueue is the max number of invalidations waiting to be sent to the peers.
+const broadcastQueue = 1024
+
+// invalidation is the payload of a broadcast invalidation.  Origin and Seq let peers
+// drop their own and duplicate messages.  An empty Key invalidates the whole group.
+type invalidation struct {
+	Origin string `json:"o"`
+	Seq    uint64 `json:"s"`
+	Group  string `json:"g"`
+	Key    string `json:"k,omitempty"`
+	User   int    `json:"u,omitempty"` // invalidates the user cache of the user in the group
+}
+
+// broadcaster sends the local invalidations to the peers and filters the ones received.
+// They are queued in sequence order and sent by a single goroutine, so the sequence
+// numbers of an origin are committed, and so delivered by postgres, in order.  A peer
+// that sees a gap in the sequence, ie: an invalidation dropped from a full queue or
+// that failed to send, flushes its cache.
+type broadcaster struct {
+	id     string // random id of this server, empty when broadcasting is disabled
+	sendmu sync.Mutex
+	seq    uint64
+	queue  chan *invalidation
+	mu     sync.Mutex
+	last   map[string]uint64 // origin -> last sequence number applied
+}
+
+// enabled returns true if invalidations are broadcast.
+func (b *broadcaster) enabled() bool {
+	return b.id != ""
+}
+
+// accept returns true if the invalidation came from a peer and was not applied yet.
+// gap is true if messages of the origin were missed, ie: while reconnecting.
+func (b *broadcaster) accept(inv *invalidation) (ok, gap bool) {
+	if inv.Origin == b.id {
+		return false, false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.last == nil {
+		b.last = make(map[string]uint64)
+	}
+	last, seen := b.last[inv.Origin]
+	if seen && inv.Seq <= last {
+		return false, false
+	}
+	b.last[inv.Origin] = inv.Seq
+	return true, seen && inv.Seq > last+1
+}
+
+// startBroadcasts enables broadcasting and kicks off the goroutine sending the queued
+// invalidations to the peers until the server shuts down.
+func (s *Server) startBroadcasts() {
+	b := &s.broadcaster
+	b.id = newAsyncID()
+	b.queue = make(chan *invalidation, broadcastQueue)
+	go func() {
+		for {
+			select {
+			case inv := <-b.queue:
+				s.sendBroadcast(inv)
+			case <-s.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// broadcast queues the invalidation of the group, or of a key of the group, for the
+// peers without waiting for it to be sent.
+func (s *Server) broadcast(group, key string) {
+	s.queueBroadcast(&invalidation{Group: group, Key: key})
+}
+
+// broadcastUser queues the invalidation of the user cache of the user in the group.
+func (s *Server) broadcastUser(group string, userID int) {
+	s.queueBroadcast(&invalidation{Group: group, User: userID})
+}
+
+func (s *Server) queueBroadcast(inv *invalidation) {
+	b := &s.broadcaster
+	if !b.enabled() {
+		return
+	}
+
+	b.sendmu.Lock()
+	defer b.sendmu.Unlock()
+
+	b.seq++
+	inv.Origin, inv.Seq = b.id, b.seq
+	select {
+	case b.queue <- inv:
+	default:
+		s.Log.Warn().Msgf("cache: broadcast queue full, the invalidation of %s %s is dropped", inv.Group, inv.Key)
+	}
+}
+
+// sendBroadcast sends a queued invalidation to the peers.
+func (s *Server) sendBroadcast(inv *invalidation) {
+	payload, err := json.Marshal(inv)
+	if err == nil {
+		_, err = s.DB.Exec(s.ctx, "select pg_notify($1, $2);", InvalidateChannel, string(payload))
+	}
+	if err != nil && s.ctx.Err() == nil {
+		s.Log.Err(err).Msgf("cache: error broadcasting the invalidation of %s %s", inv.Group, inv.Key)
+	}
+}
+
+// applyBroadcast applies an invalidation received from a peer.
+func (s *Server) applyBroadcast(payload string) {
+	inv := &invalidation{}
+	if err := json.Unmarshal([]byte(payload), inv); err != nil {
+		s.Log.Warn().Msgf("cache: invalid broadcast invalidation %q", payload)
+		return
+	}
+
+	ok, gap := s.broadcaster.accept(inv)
+	if !ok {
+		return
+	}
+	if gap {
+		// the missed invalidations could be of any group.
+		s.invalidateAll("missed invalidations from " + inv.Origin)
+		return
+	}
+
+	if inv.User != 0 {
+		s.userCache.invalidate(inv.Group, inv.User)
+		return
+	}
+	if inv.Key == "" {
+		s.invalidateGroup(inv.Group)
+		return
+	}
+	s.invalidateKey(inv.Group, inv.Key)
+}
@@ -0,0 +1,83 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cwbriscoe/webcache"
+)
+
+func TestBroadcasterAccept(t *testing.T) {
+	b := &broadcaster{id: "self"}
+	tests := []struct {
+		origin  string
+		seq     uint64
+		ok, gap bool
+	}{
+		{"self", 1, false, false},
+		{"peer", 1, true, false},
+		{"peer", 1, false, false}, // duplicate
+		{"peer", 2, true, false},
+		{"other", 7, true, false}, // first message of a peer that started earlier
+		{"peer", 5, true, true},   // 3 and 4 were missed
+		{"peer", 4, false, false}, // late, already superseded
+		{"other", 8, true, false},
+	}
+	for i, test := range tests {
+		ok, gap := b.accept(&invalidation{Origin: test.origin, Seq: test.seq, Group: "g"})
+		if ok != test.ok || gap != test.gap {
+			t.Errorf("%d: %s %d: got ok=%t gap=%t, want ok=%t gap=%t", i, test.origin, test.seq, ok, gap, test.ok, test.gap)
+		}
+	}
+}
+
+func TestApplyBroadcastGap(t *testing.T) {
+	s := newStreamServer()
+	s.Cache = webcache.NewWebCache(1<<20, 1)
+	s.broadcaster.id = "self"
+	s.cacheKeys.add("pages", "/a")
+	s.cacheKeys.add("search", "q=go")
+
+	s.applyBroadcast(`{"o":"peer","s":1,"g":"pages","k":"/a"}`)
+	if groups := s.cacheKeys.groupNames(); len(groups) != 2 {
+		t.Fatalf("expected only the key to be invalidated, got groups %v", groups)
+	}
+	s.applyBroadcast(`{"o":"peer","s":3,"g":"pages","k":"/b"}`)
+	if groups := s.cacheKeys.groupNames(); len(groups) != 0 {
+		t.Errorf("expected every group to be invalidated after a gap, got %v", groups)
+	}
+}
+
+func TestBroadcastQueue(t *testing.T) {
+	s := newStreamServer()
+	s.broadcaster.id = "self"
+	s.broadcaster.queue = make(chan *invalidation, 1)
+
+	s.broadcast("pages", "/a")
+	s.broadcast("pages", "/b") // dropped, the peers see the gap
+	if len(s.broadcaster.queue) != 1 || s.broadcaster.seq != 2 {
+		t.Fatalf("expected 1 queued invalidation and seq 2, got %d and %d", len(s.broadcaster.queue), s.broadcaster.seq)
+	}
+	if inv := <-s.broadcaster.queue; inv.Seq != 1 || inv.Key != "/a" {
+		t.Errorf("expected the first invalidation to be queued, got %+v", inv)
+	}
+}
+
+func TestApplyBroadcastUser(t *testing.T) {
+	s := newStreamServer()
+	s.broadcaster.id = "self"
+	s.broadcaster.queue = make(chan *invalidation, 1)
+	s.userCache.set("dash", 7, "/a", 0, &userCacheEntry{expires: time.Now().Add(time.Minute)})
+
+	s.InvalidateUser("dash", 8)
+	if inv := <-s.broadcaster.queue; inv.Group != "dash" || inv.User != 8 || inv.Key != "" {
+		t.Errorf("expected the user invalidation to be queued, got %+v", inv)
+	}
+
+	s.applyBroadcast(`{"o":"peer","s":1,"g":"dash","u":7}`)
+	if s.userCache.get("dash", 7, "/a") != nil {
+		t.Error("expected the entries of the user to be invalidated")
+	}
+}
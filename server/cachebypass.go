@@ -0,0 +1,104 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package server
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// defaultBypassScope is the scope allowed to force a refresh when neither the route nor
+// the config set one.
+const defaultBypassScope = "admin"
+
+// uncacheableTTL is how long the mark of an uncacheable response is kept, long enough
+// for the requests that shared its getter to see it.
+const uncacheableTTL = time.Minute
+
+// CacheOptions are the per route options of CacherWithOptions.
+type CacheOptions struct {
+	BypassScope string // scope of the users who can force a refresh, defaults to cache.bypassScope of the config
+	NoBypass    bool   // never let anyone force a refresh of the route
+}
+
+// bypassScope returns the scope of the users who can force a refresh of the route.
+func (s *Server) bypassScope(opts *CacheOptions) string {
+	if opts != nil && opts.BypassScope != "" {
+		return opts.BypassScope
+	}
+	if s.Config.Cache.BypassScope != "" {
+		return s.Config.Cache.BypassScope
+	}
+	return defaultBypassScope
+}
+
+// forceRefresh returns true if the request asks for a fresh entry, with Cache-Control:
+// no-cache or ?refresh=1, and comes from a user with the bypass scope.  Everyone else
+// asking with no-cache gets the throttled refresh of applyCacheHints and ?refresh=1 is
+// ignored.
+func (s *Server) forceRefresh(r *http.Request, opts *CacheOptions) bool {
+	if opts != nil && opts.NoBypass || s.auth == nil {
+		return false
+	}
+	if requestCacheHint(r) != hintNoCache && r.URL.Query().Get("refresh") != "1" {
+		return false
+	}
+	return s.auth.HasScope(r, s.bypassScope(opts))
+}
+
+// uncacheable tracks the entries whose getter marked the response as uncacheable.
+// Requests waiting on the same getter share its value, so the mark is kept for a
+// while instead of being read only by the request that ran the getter.
+type uncacheable struct {
+	sync.Mutex
+	marks map[string]time.Time // group|key -> time the getter marked the response
+}
+
+type uncacheableKey struct{}
+
+// uncacheableMark is passed to the getter in its context.
+type uncacheableMark struct {
+	u          *uncacheable
+	group, key string
+}
+
+// context returns a context the getter of the key can mark the response uncacheable with.
+func (u *uncacheable) context(ctx context.Context, group, key string) context.Context {
+	return context.WithValue(ctx, uncacheableKey{}, &uncacheableMark{u: u, group: group, key: key})
+}
+
+func (u *uncacheable) mark(group, key string) {
+	u.Lock()
+	defer u.Unlock()
+	if u.marks == nil {
+		u.marks = make(map[string]time.Time)
+	}
+	now := time.Now()
+	for k, t := range u.marks {
+		if now.Sub(t) > uncacheableTTL {
+			delete(u.marks, k)
+		}
+	}
+	u.marks[group+"|"+key] = now
+}
+
+// marked returns true if a getter started after since marked the response of the key.
+func (u *uncacheable) marked(group, key string, since time.Time) bool {
+	u.Lock()
+	defer u.Unlock()
+	t, ok := u.marks[group+"|"+key]
+	return ok && !t.Before(since)
+}
+
+// Uncacheable marks the response being read by the cache getter called with ctx as
+// uncacheable, ie: a partial result while a backend is degraded.  Cacher serves it to
+// the requests waiting for it with Cache-Control: no-store and removes it from the
+// cache, so the next request calls the getter again.  It does nothing for getters not
+// called by Cacher.
+func Uncacheable(ctx context.Context) {
+	if m, ok := ctx.Value(uncacheableKey{}).(*uncacheableMark); ok {
+		m.u.mark(m.group, m.key)
+	}
+}
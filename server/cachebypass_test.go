@@ -0,0 +1,55 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package server
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cwbriscoe/goweb/config"
+)
+
+func TestUncacheable(t *testing.T) {
+	var u uncacheable
+	start := time.Now()
+
+	// getters not called by Cacher have no mark in their context.
+	Uncacheable(context.Background())
+
+	ctx := u.context(context.Background(), "books", "1|br")
+	if u.marked("books", "1|br", start) {
+		t.Error("expected no mark before the getter marks the response")
+	}
+	Uncacheable(ctx)
+	if !u.marked("books", "1|br", start) {
+		t.Error("expected the response to be marked")
+	}
+	if u.marked("books", "1", start) {
+		t.Error("expected the other encodings not to be marked")
+	}
+	if u.marked("books", "1|br", time.Now().Add(time.Second)) {
+		t.Error("expected a mark older than the request to be ignored")
+	}
+}
+
+func TestForceRefresh(t *testing.T) {
+	s := &Server{Config: &config.Config{}}
+	r := httptest.NewRequest("GET", "/books/1?refresh=1", nil)
+	// without auth nobody has the bypass scope.
+	if s.forceRefresh(r, nil) {
+		t.Error("expected no forced refresh without auth")
+	}
+
+	if scope := s.bypassScope(nil); scope != defaultBypassScope {
+		t.Errorf("expected the default scope, got %q", scope)
+	}
+	s.Config.Cache.BypassScope = "editor"
+	if scope := s.bypassScope(nil); scope != "editor" {
+		t.Errorf("expected the config scope, got %q", scope)
+	}
+	if scope := s.bypassScope(&CacheOptions{BypassScope: "ops"}); scope != "ops" {
+		t.Errorf("expected the route scope, got %q", scope)
+	}
+}
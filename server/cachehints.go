@@ -0,0 +1,274 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cwbriscoe/goweb/correlate"
+)
+
+// Clients choose between fresh and fast responses of cached resources with request
+// headers:
+//
+//	Cache-Control: no-cache        regenerate the entry, unless it is younger than noCacheMinAge
+//	Cache-Control: only-if-cached  serve the entry if it is cached, 504 otherwise, keys past
+//	                               maxTrackedKeys are served as if there was no hint
+//	Prefer: respond-async          on a miss, fill the entry in the background and return
+//	                               202 with a status url to poll
+//
+// Users with the bypass scope of the route, admins by default, always get a fresh entry
+// with no-cache or ?refresh=1, see CacherWithOptions.
+//
+// Misses of the groups in Config.Cache.AsyncGroups are always answered like
+// respond-async, so the first request after an expensive entry expired or was
+// invalidated doesn't time out waiting for it.
+const (
+	noCacheMinAge = 30 * time.Second // so reloads can't keep expensive getters busy
+	asyncPath     = "/async/"
+	asyncTTL      = 10 * time.Minute // how long the status of a finished fill is kept
+	asyncWorkers  = 4                // max entries filled in the background at once
+	asyncQueue    = 64               // max fills waiting for a worker
+	maxAsyncFills = 10000            // max fills tracked, running or finished within asyncTTL
+)
+
+// cacheHint is the freshness a request asks for.
+type cacheHint int
+
+const (
+	hintNone cacheHint = iota
+	hintNoCache
+	hintOnlyIfCached
+)
+
+// requestCacheHint returns the freshness asked for by the Cache-Control and Pragma
+// request headers.
+func requestCacheHint(r *http.Request) cacheHint {
+	hint := hintNone
+	for _, directive := range headerTokens(r.Header.Values("Cache-Control")) {
+		switch directive {
+		case "only-if-cached":
+			return hintOnlyIfCached
+		case "no-cache":
+			hint = hintNoCache
+		}
+	}
+	if hint == hintNone && r.Header.Get("Cache-Control") == "" && strings.EqualFold(r.Header.Get("Pragma"), "no-cache") {
+		hint = hintNoCache
+	}
+	return hint
+}
+
+// prefersAsync returns true if the request has Prefer: respond-async.
+func prefersAsync(r *http.Request) bool {
+	for _, pref := range headerTokens(r.Header.Values("Prefer")) {
+		if pref == "respond-async" {
+			return true
+		}
+	}
+	return false
+}
+
+// headerTokens splits comma separated header values into lower case tokens, without
+// their parameters.
+func headerTokens(values []string) []string {
+	var tokens []string
+	for _, value := range values {
+		for _, token := range strings.Split(value, ",") {
+			token, _, _ = strings.Cut(token, ";")
+			token, _, _ = strings.Cut(token, "=")
+			if token = strings.ToLower(strings.TrimSpace(token)); token != "" {
+				tokens = append(tokens, token)
+			}
+		}
+	}
+	return tokens
+}
+
+// applyCacheHints acts on the freshness headers of the request before the cache is
+// read.  It returns true if the response was written.
+func (s *Server) applyCacheHints(w http.ResponseWriter, r *http.Request, group, key string) bool {
+	state, tracked := s.cacheKeys.state(group, key)
+	cached := state.fresh()
+
+	switch requestCacheHint(r) {
+	case hintOnlyIfCached:
+		// an untracked entry may be cached, it can't be told apart from a miss.
+		if !cached && tracked {
+			w.Header().Del("Content-Encoding")
+			w.WriteHeader(http.StatusGatewayTimeout)
+			return true
+		}
+		return false
+	case hintNoCache:
+		if cached && time.Since(state.stored) >= noCacheMinAge {
+			// the other encodings of the entry are just as stale.
+			s.invalidateKey(group, plainKey(key))
+			cached = false
+		}
+	}
+
+	// untracked keys are never known to be cached, so polling would never end.
+	if cached || !tracked {
+		return false
+	}
+	preferred := prefersAsync(r)
+	if !preferred && !s.asyncGroup(group) {
+		return false
+	}
+
+	id, ok := s.asyncFills.start(r, group, key, s.fillCache)
+	if !ok {
+		correlate.Log(r.Context(), s.Log).Warn().Msgf("cache: too many background fills, %s %s refused", group, key)
+		w.Header().Del("Content-Encoding")
+		w.Header().Set("Retry-After", "5")
+		writeJSONError(w, http.StatusServiceUnavailable, "too many requests being filled, try again later")
+		return true
+	}
+	w.Header().Del("Content-Encoding")
+	w.Header().Set("Location", asyncPath+id)
+	if preferred {
+		w.Header().Set("Preference-Applied", "respond-async")
+	}
+	w.Header().Set("Retry-After", "1")
+	writeJSON(w, http.StatusAccepted, map[string]string{"status": "pending", "statusUrl": asyncPath + id})
+	return true
+}
+
+// asyncGroup returns true if misses of the group are always filled in the background.
+func (s *Server) asyncGroup(group string) bool {
+	for _, g := range s.Config.Cache.AsyncGroups {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
+
+// fillCache reads the entry of the key into the cache.
+func (s *Server) fillCache(ctx context.Context, group, key string) error {
+	_, info, err := s.getCached(ctx, group, key, "")
+	if err == nil && info != nil {
+		s.cacheKeys.seen(group, key, info.Expires)
+	}
+	return err
+}
+
+// asyncFill is a cache entry being filled in the background.
+type asyncFill struct {
+	url      string // the resource to get once the fill is done
+	key      string
+	done     bool
+	failed   bool
+	finished time.Time
+}
+
+// asyncFills tracks the cache entries filled in the background for requests with
+// Prefer: respond-async.
+type asyncFills struct {
+	sync.Mutex
+	fills map[string]*asyncFill // status id -> fill
+	keys  map[string]string     // group|key -> status id of the running fill
+	slots chan struct{}         // limits the fills running at once to asyncWorkers
+	busy  int                   // fills running or waiting for a slot
+}
+
+// start fills the cache entry in the background unless it is already being filled and
+// returns the id of its status.  It returns false when maxAsyncFills are tracked or
+// asyncQueue fills already wait for a worker.
+func (a *asyncFills) start(r *http.Request, group, key string, fill func(context.Context, string, string) error) (string, bool) {
+	a.Lock()
+	defer a.Unlock()
+
+	if a.fills == nil {
+		a.fills = make(map[string]*asyncFill)
+		a.keys = make(map[string]string)
+		a.slots = make(chan struct{}, asyncWorkers)
+	}
+	a.purgeLocked()
+
+	cacheKey := group + "|" + key
+	if id, ok := a.keys[cacheKey]; ok {
+		return id, true
+	}
+	if len(a.fills) >= maxAsyncFills || a.busy >= asyncWorkers+asyncQueue {
+		return "", false
+	}
+	a.busy++
+
+	id := newAsyncID()
+	f := &asyncFill{url: r.URL.RequestURI(), key: cacheKey}
+	a.fills[id] = f
+	a.keys[cacheKey] = id
+
+	ctx := correlate.Detach(r.Context())
+	go func() {
+		a.slots <- struct{}{}
+		err := fill(ctx, group, key)
+		<-a.slots
+
+		a.Lock()
+		defer a.Unlock()
+		f.done, f.failed, f.finished = true, err != nil, time.Now()
+		delete(a.keys, cacheKey)
+		a.busy--
+	}()
+	return id, true
+}
+
+// status returns a copy of the fill with the id.
+func (a *asyncFills) status(id string) (asyncFill, bool) {
+	a.Lock()
+	defer a.Unlock()
+	f, ok := a.fills[id]
+	if !ok {
+		return asyncFill{}, false
+	}
+	return *f, true
+}
+
+func (a *asyncFills) purgeLocked() {
+	for id, f := range a.fills {
+		if f.done && time.Since(f.finished) > asyncTTL {
+			delete(a.fills, id)
+		}
+	}
+}
+
+func newAsyncID() string {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func (s *Server) asyncStatusHandler() http.HandlerFunc {
+	return s.HandlePanic(s.Limit(s.Logger(s.asyncStatus())))
+}
+
+// asyncStatus reports a background fill: 202 while it runs, 303 to the resource once it
+// is cached and 500 if it failed.
+func (s *Server) asyncStatus() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		f, ok := s.asyncFills.status(s.Param(r, "id"))
+		w.Header().Set("Cache-Control", "no-store")
+		switch {
+		case !ok:
+			writeJSONError(w, http.StatusNotFound, "unknown or expired status")
+		case !f.done:
+			w.Header().Set("Retry-After", "1")
+			writeJSON(w, http.StatusAccepted, map[string]string{"status": "pending"})
+		case f.failed:
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"status": "failed"})
+		default:
+			http.Redirect(w, r, f.url, http.StatusSeeOther)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package server
+
+import (
+	"context"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRequestCacheHint(t *testing.T) {
+	tests := []struct {
+		headers map[string]string
+		want    cacheHint
+	}{
+		{map[string]string{}, hintNone},
+		{map[string]string{"Cache-Control": "max-age=0"}, hintNone},
+		{map[string]string{"Cache-Control": "No-Cache"}, hintNoCache},
+		{map[string]string{"Cache-Control": "max-age=0, no-cache"}, hintNoCache},
+		{map[string]string{"Cache-Control": "no-cache, only-if-cached"}, hintOnlyIfCached},
+		{map[string]string{"Pragma": "no-cache"}, hintNoCache},
+		{map[string]string{"Pragma": "no-cache", "Cache-Control": "max-age=60"}, hintNone},
+	}
+	for i, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		for name, value := range test.headers {
+			r.Header.Set(name, value)
+		}
+		if hint := requestCacheHint(r); hint != test.want {
+			t.Errorf("%d: expected %d, got %d", i, test.want, hint)
+		}
+	}
+}
+
+func TestPrefersAsync(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Prefer", "return=minimal, respond-async; wait=5")
+	if !prefersAsync(r) {
+		t.Error("expected respond-async")
+	}
+	r.Header.Set("Prefer", "return=minimal")
+	if prefersAsync(r) {
+		t.Error("expected no respond-async")
+	}
+}
+
+func TestAsyncFills(t *testing.T) {
+	var fills asyncFills
+	release := make(chan struct{})
+	fill := func(context.Context, string, string) error {
+		<-release
+		return nil
+	}
+
+	r := httptest.NewRequest("GET", "/report?id=1", nil)
+	id, _ := fills.start(r, "reports", "1", fill)
+	if again, _ := fills.start(r, "reports", "1", fill); again != id {
+		t.Errorf("expected the running fill %q, got %q", id, again)
+	}
+	if f, ok := fills.status(id); !ok || f.done {
+		t.Fatalf("expected a pending fill, got %+v", f)
+	}
+
+	// the fills past the queue are refused.
+	for i := 2; i <= asyncWorkers+asyncQueue; i++ {
+		if _, ok := fills.start(r, "reports", strconv.Itoa(i), fill); !ok {
+			t.Fatalf("expected fill %d to be queued", i)
+		}
+	}
+	if _, ok := fills.start(r, "reports", "queue", fill); ok {
+		t.Error("expected a fill past the queue to be refused")
+	}
+
+	// the fills past the limit are refused, the running one is still found.
+	var tracked asyncFills
+	tracked.start(r, "reports", "1", fill)
+	for i := 0; len(tracked.fills) < maxAsyncFills; i++ {
+		tracked.fills[strconv.Itoa(i)] = &asyncFill{done: true, finished: time.Now()}
+	}
+	if _, ok := tracked.start(r, "reports", "2", fill); ok {
+		t.Error("expected a fill past the limit to be refused")
+	}
+	if again, ok := fills.start(r, "reports", "1", fill); !ok || again != id {
+		t.Errorf("expected the running fill %q, got %q", id, again)
+	}
+
+	close(release)
+	for i := 0; i < 100; i++ {
+		if f, _ := fills.status(id); f.done {
+			if f.failed || f.url != "/report?id=1" {
+				t.Errorf("expected a successful fill of /report?id=1, got %+v", f)
+			}
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("fill did not finish")
+}
@@ -0,0 +1,90 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// defaultKeyValueLen is the longest value kept in a cache key when KeyOptions.MaxLen is zero.
+const defaultKeyValueLen = 100
+
+// minKeyValueLen is the smallest MaxLen, a long value keeps a prefix next to its hash.
+const minKeyValueLen = 32
+
+// KeyOptions control which parts of a request make up its cache key.
+type KeyOptions struct {
+	Params    []string // route params in key order, all params in route order when empty
+	Query     []string // query params allowed in the key, all others are ignored
+	LowerCase bool     // lower case the values so /Book/ABC and /book/abc share an entry
+	MaxLen    int      // longer values are shortened to a prefix and a hash of the whole value, defaults to 100
+}
+
+// CacheKey builds a canonical cache key for the request.  The key is the route param
+// values followed by the allowed query params sorted by name, separated by "|" so it
+// can be split with net.GetRequestParams.  Query params not in the allowed list, like
+// the tracking params crawlers append, are dropped so they can't create new entries.
+func (s *Server) CacheKey(r *http.Request, opts *KeyOptions) string {
+	if opts == nil {
+		opts = &KeyOptions{}
+	}
+	maxLen := opts.MaxLen
+	if maxLen <= 0 {
+		maxLen = defaultKeyValueLen
+	}
+	maxLen = max(maxLen, minKeyValueLen)
+
+	clean := func(val string) string {
+		val = strings.TrimSpace(val)
+		if opts.LowerCase {
+			val = strings.ToLower(val)
+		}
+		return shortenKeyValue(val, maxLen)
+	}
+
+	var parts []string
+
+	params := s.Router.Params(r)
+	if len(opts.Params) == 0 {
+		for _, p := range params {
+			parts = append(parts, url.QueryEscape(clean(p.Value)))
+		}
+	} else {
+		for _, name := range opts.Params {
+			parts = append(parts, url.QueryEscape(clean(params.ByName(name))))
+		}
+	}
+
+	if len(opts.Query) > 0 {
+		query := r.URL.Query()
+		names := append([]string(nil), opts.Query...)
+		sort.Strings(names)
+
+		// only the first value of a param is used so repeating it can't change the key.
+		var qs []string
+		for _, name := range names {
+			if val := clean(query.Get(name)); val != "" {
+				qs = append(qs, url.QueryEscape(name)+"="+url.QueryEscape(val))
+			}
+		}
+		parts = append(parts, strings.Join(qs, "&"))
+	}
+
+	return strings.Join(parts, "|")
+}
+
+// shortenKeyValue returns val when it fits in maxLen, else a prefix of it followed by
+// the hash of the whole value, so long values that share a prefix get distinct keys.
+func shortenKeyValue(val string, maxLen int) string {
+	if len(val) <= maxLen {
+		return val
+	}
+	sum := fmt.Sprintf("~%016x", xxhash.Sum64String(val))
+	return val[:maxLen-len(sum)] + sum
+}
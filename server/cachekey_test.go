@@ -0,0 +1,56 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package server
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func keyRequest(target string, params httprouter.Params) string {
+	r := httptest.NewRequest("GET", target, nil)
+	s := &Server{Router: NewHTTPRouter()}
+	return s.CacheKey(r.WithContext(context.WithValue(r.Context(), httprouter.ParamsKey, params)), &KeyOptions{
+		Query:     []string{"sort", "page"},
+		LowerCase: true,
+	})
+}
+
+func TestCacheKey(t *testing.T) {
+	params := httprouter.Params{{Key: "id", Value: "ABC"}}
+
+	want := "abc|page=2&sort=asc"
+	keys := []string{
+		keyRequest("/book/ABC?page=2&sort=asc", params),
+		keyRequest("/book/ABC?sort=ASC&page=2&utm_source=bot", params),
+		keyRequest("/book/ABC?page=2&page=3&sort=asc&fbclid=123", params),
+	}
+	for i, key := range keys {
+		if key != want {
+			t.Errorf("key %d: expected %q, got %q", i, want, key)
+		}
+	}
+}
+
+func TestCacheKeyEscapes(t *testing.T) {
+	params := httprouter.Params{{Key: "id", Value: "a|b"}}
+	if key := keyRequest("/book/x?page=1%7C2", params); key != "a%7Cb|page=1%7C2" {
+		t.Errorf("expected separators to be escaped, got %q", key)
+	}
+}
+
+func TestCacheKeyLongValues(t *testing.T) {
+	prefix := strings.Repeat("a", 200)
+	a := keyRequest("/search?page="+prefix+"1", nil)
+	b := keyRequest("/search?page="+prefix+"2", nil)
+	if a == b {
+		t.Errorf("expected long values with a common prefix to get distinct keys, got %q", a)
+	}
+	if len(a) > len("page=")+defaultKeyValueLen {
+		t.Errorf("expected the value to be shortened, got %d bytes", len(a))
+	}
+}
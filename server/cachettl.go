@@ -0,0 +1,138 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// cacheTTLs tracks the entries whose getter shortened their lifetime with CacheTTL.
+// The cache only knows the max age of the group, so the entries are deleted when they
+// are read after their deadline.
+type cacheTTLs struct {
+	sync.Mutex
+	marks     map[string]ttlMark     // group|key -> lifetime asked by the getter
+	deadlines map[string]ttlDeadline // group|key -> when the cached entry goes stale
+}
+
+type ttlMark struct {
+	at  time.Time
+	ttl time.Duration
+}
+
+type ttlDeadline struct {
+	expires  time.Time // expiry of the entry in the cache, tells if it was stored again
+	deadline time.Time
+}
+
+type cacheTTLKey struct{}
+
+// cacheTTLMark is passed to the getter in its context.
+type cacheTTLMark struct {
+	c          *cacheTTLs
+	group, key string
+}
+
+// context returns a context the getter of the key can shorten the lifetime of its
+// entry with.
+func (c *cacheTTLs) context(ctx context.Context, group, key string) context.Context {
+	return context.WithValue(ctx, cacheTTLKey{}, &cacheTTLMark{c: c, group: group, key: key})
+}
+
+func (c *cacheTTLs) mark(group, key string, ttl time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	if c.marks == nil {
+		c.marks = make(map[string]ttlMark)
+	}
+	c.marks[group+"|"+key] = ttlMark{at: time.Now(), ttl: ttl}
+}
+
+// filled records the deadline of the entry stored with expires when its getter, started
+// at since, asked for a shorter lifetime.
+func (c *cacheTTLs) filled(group, key string, since, expires time.Time) {
+	c.Lock()
+	defer c.Unlock()
+	k := group + "|" + key
+	m, ok := c.marks[k]
+	if !ok || m.at.Before(since) {
+		return
+	}
+	delete(c.marks, k)
+
+	deadline := m.at.Add(m.ttl)
+	if !deadline.Before(expires) {
+		return
+	}
+	if c.deadlines == nil {
+		c.deadlines = make(map[string]ttlDeadline)
+	}
+	c.deadlines[k] = ttlDeadline{expires: expires, deadline: deadline}
+}
+
+// prune forgets the marks of getters that ended without filling the cache and the
+// deadlines that passed without the entry being read again.
+func (c *cacheTTLs) prune(now time.Time) {
+	c.Lock()
+	defer c.Unlock()
+	for k, m := range c.marks {
+		if now.Sub(m.at) > uncacheableTTL {
+			delete(c.marks, k)
+		}
+	}
+	for k, d := range c.deadlines {
+		if now.After(d.deadline) {
+			delete(c.deadlines, k)
+		}
+	}
+}
+
+// startCacheTTLs kicks off a goroutine to prune the cache ttls every minute.
+func (s *Server) startCacheTTLs() {
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.ctx.Done():
+				return
+			case now := <-ticker.C:
+				s.cacheTTLs.prune(now)
+			}
+		}
+	}()
+}
+
+// deadline returns when the entry stored with expires goes stale, zero if its getter
+// did not shorten its lifetime.  stale is true once the deadline passed.
+func (c *cacheTTLs) deadline(group, key string, expires time.Time) (deadline time.Time, stale bool) {
+	c.Lock()
+	defer c.Unlock()
+	k := group + "|" + key
+	d, ok := c.deadlines[k]
+	if !ok {
+		return time.Time{}, false
+	}
+	if !d.expires.Equal(expires) {
+		// the entry was stored again without a shorter lifetime.
+		delete(c.deadlines, k)
+		return time.Time{}, false
+	}
+	if !time.Now().Before(d.deadline) {
+		delete(c.deadlines, k)
+		return time.Time{}, true
+	}
+	return d.deadline, false
+}
+
+// CacheTTL shortens the lifetime of the entry read by the cache getter called with ctx
+// to ttl, ie: when the source of the entry knows when it goes stale.  It can not extend
+// the lifetime past the max age of the cache group.  It does nothing for getters not
+// called by the cache handlers.
+func CacheTTL(ctx context.Context, ttl time.Duration) {
+	if m, ok := ctx.Value(cacheTTLKey{}).(*cacheTTLMark); ok {
+		m.c.mark(m.group, m.key, ttl)
+	}
+}
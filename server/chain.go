@@ -0,0 +1,133 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Middleware wraps a handler, ie: Server.HandlePanic or Server.Logger.  Middleware
+// taking other arguments can be adapted with a closure.
+type Middleware func(http.HandlerFunc) http.HandlerFunc
+
+// Chain returns a middleware applying mws in order, the first one is the outermost.
+// Chain(s.HandlePanic, limit, s.Logger)(f) is s.HandlePanic(limit(s.Logger(f))).
+func Chain(mws ...Middleware) Middleware {
+	return func(f http.HandlerFunc) http.HandlerFunc {
+		for i := len(mws) - 1; i >= 0; i-- {
+			f = mws[i](f)
+		}
+		return f
+	}
+}
+
+// Stage is where middleware runs in the chain of a route.  The stages run in the order
+// they are declared, the first one is the outermost:
+//
+//	StageRecover  HandlePanic, so a panic in any later stage becomes a 500
+//	StageLimit    the rate limiters, so rejected requests cost nothing more
+//	StageLog      Logger, so the requests that were let in are logged with their status
+//	StageShed     LoadShedder, so shed requests are logged as such
+//	StageApp      the middleware of the app, then the permission check and the handler
+//
+// The routes of the server registered by Init wrap their middleware in the same order.
+type Stage int
+
+// The stages of the middleware chain, from the outermost.
+const (
+	StageRecover Stage = iota
+	StageLimit
+	StageLog
+	StageShed
+	StageApp
+	numStages
+)
+
+// middlewares is the middleware applied to every route registered with HandlerFunc.
+type middlewares struct {
+	sync.RWMutex
+	stages [numStages][]Middleware
+}
+
+func (m *middlewares) wrap(f http.HandlerFunc) http.HandlerFunc {
+	m.RLock()
+	defer m.RUnlock()
+	var mws []Middleware
+	for _, stage := range m.stages {
+		mws = append(mws, stage...)
+	}
+	return Chain(mws...)(f)
+}
+
+// Use adds middleware to StageApp, see UseStage.
+func (s *Server) Use(mws ...Middleware) {
+	s.UseStage(StageApp, mws...)
+}
+
+// UseStage adds middleware applied to the routes registered with HandlerFunc after it
+// is called, outside of the permission check of the route.  Whatever the order of the
+// calls, the stages run in their declared order and the middleware of a stage in the
+// order it was added.  The routes of the server registered by Init wrap their own
+// middleware and are not affected.
+func (s *Server) UseStage(stage Stage, mws ...Middleware) {
+	if stage < 0 || stage >= numStages {
+		panic(fmt.Sprintf("server: unknown middleware stage %d", stage))
+	}
+	s.middlewares.Lock()
+	defer s.middlewares.Unlock()
+	s.middlewares.stages[stage] = append(s.middlewares.stages[stage], mws...)
+}
+
+// UseDefaults adds the middleware of the server to their stages: HandlePanic, Limit with
+// the api limiter, Logger and LoadShedder.
+func (s *Server) UseDefaults() {
+	s.UseStage(StageRecover, s.HandlePanic)
+	s.UseStage(StageLimit, s.Limit)
+	s.UseStage(StageLog, s.Logger)
+	s.UseStage(StageShed, s.LoadShedder)
+}
+
+// RouteGroup registers routes sharing a path prefix and middleware.
+type RouteGroup struct {
+	svr    *Server
+	prefix string
+	mws    []Middleware
+}
+
+// Group returns a route group with the prefix, ie: /api.  The middleware of the group
+// is applied inside of the middleware added to the server with Use and UseStage.
+func (s *Server) Group(prefix string, mws ...Middleware) *RouteGroup {
+	return &RouteGroup{svr: s, prefix: strings.TrimSuffix(prefix, "/"), mws: mws}
+}
+
+// Group returns a nested route group.  Its prefix is appended to the prefix of the
+// parent and its middleware applied inside of the middleware of the parent.
+func (g *RouteGroup) Group(prefix string, mws ...Middleware) *RouteGroup {
+	return &RouteGroup{
+		svr:    g.svr,
+		prefix: g.path(strings.TrimSuffix(prefix, "/")),
+		mws:    append(append([]Middleware{}, g.mws...), mws...),
+	}
+}
+
+// Use adds middleware applied to the routes registered with the group after it is called.
+func (g *RouteGroup) Use(mws ...Middleware) {
+	g.mws = append(g.mws, mws...)
+}
+
+// HandlerFunc registers a handler for the path under the prefix of the group.
+func (g *RouteGroup) HandlerFunc(method, path string, f http.HandlerFunc) {
+	g.svr.HandlerFunc(method, g.path(path), Chain(g.mws...)(f))
+}
+
+// RequireScope requires the scope for the path under the prefix of the group.
+func (g *RouteGroup) RequireScope(method, path, scope string) {
+	g.svr.RequireScope(method, g.path(path), scope)
+}
+
+func (g *RouteGroup) path(path string) string {
+	return g.prefix + path
+}
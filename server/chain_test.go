@@ -0,0 +1,78 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func tagMiddleware(tag string) Middleware {
+	return func(f http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("X-Chain", tag)
+			f(w, r)
+		}
+	}
+}
+
+func TestChain(t *testing.T) {
+	s := &Server{Router: NewHTTPRouter()}
+	ok := func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusOK) }
+
+	s.HandlerFunc("GET", "/before", ok)
+	s.Use(tagMiddleware("a"), tagMiddleware("b"))
+	s.HandlerFunc("GET", "/after", ok)
+
+	api := s.Group("/api/", tagMiddleware("c"))
+	api.HandlerFunc("GET", "/links/", ok)
+	v2 := api.Group("/v2", tagMiddleware("d"))
+	v2.Use(tagMiddleware("e"))
+	v2.HandlerFunc("GET", "/links/:code", ok)
+
+	tests := map[string]string{
+		"/before":         "",
+		"/after":          "a,b",
+		"/api/links/":     "a,b,c",
+		"/api/v2/links/x": "a,b,c,d,e",
+	}
+	for path, want := range tests {
+		w := httptest.NewRecorder()
+		s.Router.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: got status %d", path, w.Code)
+		}
+		if got := strings.Join(w.Header().Values("X-Chain"), ","); got != want {
+			t.Errorf("%s: got chain %q, want %q", path, got, want)
+		}
+	}
+}
+
+func TestUseStage(t *testing.T) {
+	s := &Server{Router: NewHTTPRouter()}
+	ok := func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusOK) }
+
+	s.Use(tagMiddleware("app"))
+	s.UseStage(StageShed, tagMiddleware("shed"))
+	s.UseStage(StageLog, tagMiddleware("log"))
+	s.UseStage(StageLimit, tagMiddleware("limit"))
+	s.UseStage(StageRecover, tagMiddleware("recover"))
+	s.Use(tagMiddleware("app2"))
+	s.HandlerFunc("GET", "/", ok)
+
+	w := httptest.NewRecorder()
+	s.Router.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	want := "recover,limit,log,shed,app,app2"
+	if got := strings.Join(w.Header().Values("X-Chain"), ","); got != want {
+		t.Errorf("got chain %q, want %q", got, want)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("UseStage accepted an unknown stage")
+		}
+	}()
+	s.UseStage(numStages, tagMiddleware("x"))
+}
@@ -0,0 +1,117 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package server
+
+import (
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/cwbriscoe/goweb/auth"
+	"github.com/cwbriscoe/goweb/chaos"
+	"github.com/cwbriscoe/goweb/correlate"
+	"github.com/goccy/go-json"
+)
+
+// chaosPath serves the fault injection state and is never subject to it, so it can
+// always be turned off again.
+const chaosPath = "/chaos/"
+
+// chaosHeader names the rule that injected an error, so test clients can tell injected
+// failures from real ones.
+const chaosHeader = "X-Chaos-Fault"
+
+const chaosMaxBody = 64 * 1024
+
+type chaosState struct {
+	Enabled bool         `json:"enabled"`
+	Rules   []chaos.Rule `json:"rules"`
+}
+
+type updateChaos struct {
+	Enabled *bool         `json:"enabled"` // unchanged when omitted
+	Rules   *[]chaos.Rule `json:"rules"`   // unchanged when omitted
+}
+
+// ChaosHandler injects the faults picked by the chaos rules before passing the request
+// to the next handler.
+func (s *Server) ChaosHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == chaosPath {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		fault := s.Chaos.Pick(r)
+		if fault == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		correlate.Log(r.Context(), s.Log).Debug().Msgf("chaos %s: latency %s, status %d, drop %t on %s %s",
+			fault.Rule, fault.Latency, fault.Status, fault.Drop, r.Method, r.URL.Path)
+
+		if fault.Latency > 0 {
+			timer := time.NewTimer(fault.Latency)
+			select {
+			case <-r.Context().Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+		}
+
+		switch {
+		case fault.Drop:
+			// aborts the response and closes the connection, or resets the stream on
+			// http/2, without the server logging a panic.
+			panic(http.ErrAbortHandler)
+		case fault.Status != 0:
+			w.Header().Set(chaosHeader, fault.Rule)
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, http.StatusText(fault.Status), fault.Status)
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+func (s *Server) chaosHandler() http.HandlerFunc {
+	return s.HandlePanic(s.Logger(s.chaosState()))
+}
+
+// chaosState returns the fault injection state or changes it for a PUT.  It requires
+// the admin scope.  Changes only apply to the server handling the request.
+func (s *Server) chaosState() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			req := &updateChaos{}
+			data, err := io.ReadAll(io.LimitReader(r.Body, chaosMaxBody))
+			if err != nil || json.Unmarshal(data, req) != nil {
+				writeJSONError(w, http.StatusBadRequest, "invalid request body")
+				return
+			}
+			if req.Rules != nil {
+				if err = s.Chaos.SetRules(*req.Rules); err != nil {
+					writeJSONError(w, http.StatusUnprocessableEntity, err.Error())
+					return
+				}
+			}
+			if req.Enabled != nil {
+				s.Chaos.SetEnabled(*req.Enabled)
+			}
+
+			actor := "UNKNOWN"
+			if user := auth.UserFromContext(r.Context()); user != nil {
+				actor = user.Name
+			}
+			correlate.Log(r.Context(), s.Log).Warn().Msgf("chaos: %s set enabled=%t with %d rules", actor, s.Chaos.Enabled(), len(s.Chaos.Rules()))
+		}
+
+		w.Header().Set("Cache-Control", "no-store")
+		writeJSON(w, http.StatusOK, &chaosState{
+			Enabled: s.Chaos.Enabled(),
+			Rules:   s.Chaos.Rules(),
+		})
+	}
+}
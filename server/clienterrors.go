@@ -0,0 +1,131 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package server
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/cwbriscoe/goweb/correlate"
+	"github.com/goccy/go-json"
+)
+
+const (
+	clientErrorMaxBody   = 32 * 1024 // max size of a client error request
+	clientErrorMaxField  = 1024      // max length of the message, source and url
+	clientErrorMaxStack  = 8192      // max length of the stack trace
+	clientErrorMaxRecent = 200       // number of recent client errors kept in memory
+)
+
+// ClientError is a javascript error reported by the frontend.
+type ClientError struct {
+	Message   string    `json:"message"`
+	Source    string    `json:"source,omitempty"`
+	Line      int       `json:"line,omitempty"`
+	Column    int       `json:"column,omitempty"`
+	Stack     string    `json:"stack,omitempty"`
+	URL       string    `json:"url,omitempty"`
+	UserAgent string    `json:"userAgent,omitempty"`
+	TrackerID string    `json:"trackerId,omitempty"`
+	User      string    `json:"user,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+// ErrorReporter receives the client errors reported by the frontend, e.g. to forward
+// them to an external error tracking service.
+type ErrorReporter interface {
+	Report(ctx context.Context, e *ClientError) error
+}
+
+// clientErrors keeps the most recent client errors in a ring buffer.
+type clientErrors struct {
+	sync.Mutex
+	recent []*ClientError
+	next   int
+}
+
+func (c *clientErrors) add(e *ClientError) {
+	c.Lock()
+	defer c.Unlock()
+	if len(c.recent) < clientErrorMaxRecent {
+		c.recent = append(c.recent, e)
+		return
+	}
+	c.recent[c.next] = e
+	c.next = (c.next + 1) % clientErrorMaxRecent
+}
+
+// list returns the recent client errors, newest first.
+func (c *clientErrors) list(*http.Request) (any, error) {
+	c.Lock()
+	defer c.Unlock()
+	result := make([]*ClientError, 0, len(c.recent))
+	for i := len(c.recent) - 1; i >= 0; i-- {
+		result = append(result, c.recent[(c.next+i)%len(c.recent)])
+	}
+	return result, nil
+}
+
+func (s *Server) clientErrorHandler() http.HandlerFunc {
+	return s.HandlePanic(s.Limit(s.Logger(s.clientError())))
+}
+
+func (s *Server) clientError() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := correlate.Log(r.Context(), s.Log)
+
+		data, err := io.ReadAll(io.LimitReader(r.Body, clientErrorMaxBody))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		e := &ClientError{}
+		if err = json.Unmarshal(data, e); err != nil || e.Message == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		e.Message = truncateUTF8(e.Message, clientErrorMaxField)
+		e.Source = truncateUTF8(e.Source, clientErrorMaxField)
+		e.URL = truncateUTF8(e.URL, clientErrorMaxField)
+		e.Stack = truncateUTF8(e.Stack, clientErrorMaxStack)
+		e.UserAgent = truncateUTF8(r.Header.Get("User-Agent"), clientErrorMaxField)
+		e.Time = time.Now()
+
+		// never trust identity sent by the client, use the tracking cookie instead.
+		e.TrackerID, e.User = "", ""
+		if info := s.Tracker.ReadTrackingInfo(r); info != nil {
+			e.TrackerID = info.ID
+			if info.Auth {
+				e.User = info.Name
+			}
+		}
+
+		s.clientErrors.add(e)
+		log.Warn().Msgf("client error: %s at %s:%d:%d (%s)", e.Message, e.Source, e.Line, e.Column, e.URL)
+
+		if s.ErrorReporter != nil {
+			if err = s.ErrorReporter.Report(r.Context(), e); err != nil {
+				log.Err(err).Msg("client error: error forwarding to the error reporter")
+			}
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// truncateUTF8 truncates s to at most n bytes without splitting a multibyte character.
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
@@ -0,0 +1,214 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cwbriscoe/goutil/net"
+	"github.com/cwbriscoe/goweb/auth"
+	"github.com/cwbriscoe/goweb/comments"
+	"github.com/cwbriscoe/goweb/correlate"
+	"github.com/goccy/go-json"
+)
+
+const (
+	commentsGroup     = "comments"
+	commentsMaxBody   = 16 * 1024
+	commentsMaxKeyLen = 200
+)
+
+type postComment struct {
+	Key      string `json:"key"`
+	ParentID int64  `json:"parentId"`
+	Body     string `json:"body"`
+}
+
+type moderateComment struct {
+	Status comments.Status `json:"status"`
+}
+
+// CommentData stores the resources used to load rendered comment threads into the cache
+type CommentData struct {
+	store *comments.Store
+	comp  *Compressor
+}
+
+// Get renders the approved comments of a content key when it is not found in the cache
+func (d *CommentData) Get(ctx context.Context, key string) ([]byte, error) {
+	keys, encoding := net.GetRequestParams(key)
+	if len(keys) != 1 {
+		return nil, nil
+	}
+
+	contentKey, err := url.QueryUnescape(keys[0])
+	if err != nil {
+		return nil, nil
+	}
+
+	thread, err := d.store.Thread(ctx, contentKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return d.comp.Compress(encoding, "text/html", comments.Render(thread), false)
+}
+
+// invalidateComments drops the cached thread of the content key in every encoding, on
+// the other servers of the cluster too.
+func (s *Server) invalidateComments(key string) {
+	s.InvalidateKey(commentsGroup, url.QueryEscape(key))
+}
+
+func (s *Server) commentsHandler(cacheDuration time.Duration) http.HandlerFunc {
+	return s.HandlePanic(s.Limit(s.Logger(s.LoadShedder(s.ProfileLabel(commentsGroup, s.getComments(cacheDuration))))))
+}
+
+// getComments returns the approved comments of the ?key= content as an html fragment.
+func (s *Server) getComments(cacheDuration time.Duration) http.HandlerFunc {
+	var once sync.Once
+	return func(w http.ResponseWriter, r *http.Request) {
+		once.Do(func() {
+			data := &CommentData{
+				store: s.Comments,
+				comp:  s.Compressor,
+			}
+			err := s.Cache.AddGroup(commentsGroup, cacheDuration, data)
+			if err != nil {
+				panic(err)
+			}
+		})
+
+		key := r.URL.Query().Get("key")
+		if key == "" || len(key) > commentsMaxKeyLen {
+			writeJSONError(w, http.StatusBadRequest, "invalid content key")
+			return
+		}
+
+		w.Header().Add("Content-Type", "text/html; charset=utf-8")
+		net.SetPreferredEncoding(w, r)
+		s.Cacher(w, r, commentsGroup, url.QueryEscape(key))
+	}
+}
+
+func (s *Server) postCommentHandler() http.HandlerFunc {
+	return s.HandlePanic(s.Limit(s.Logger(s.postComment())))
+}
+
+// postComment adds a comment by the signed in user.  Comments that look like spam wait
+// in the moderation queue, the returned status tells the client if it is shown yet.
+func (s *Server) postComment() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := correlate.Log(r.Context(), s.Log)
+
+		user := auth.UserFromContext(r.Context())
+		if user == nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		req := &postComment{}
+		data, err := io.ReadAll(io.LimitReader(r.Body, commentsMaxBody))
+		if err != nil || json.Unmarshal(data, req) != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+		if req.Key == "" || len(req.Key) > commentsMaxKeyLen {
+			writeJSONError(w, http.StatusBadRequest, "invalid content key")
+			return
+		}
+
+		c := &comments.Comment{
+			Key:      req.Key,
+			ParentID: req.ParentID,
+			AuthorID: user.ID,
+			Author:   user.Name,
+			Body:     req.Body,
+		}
+		err = s.Comments.Create(r.Context(), c)
+		switch {
+		case errors.Is(err, comments.ErrInvalidBody):
+			writeJSONError(w, http.StatusBadRequest, "invalid comment")
+			return
+		case errors.Is(err, comments.ErrInvalidParent):
+			writeJSONError(w, http.StatusBadRequest, "invalid parent comment")
+			return
+		case errors.Is(err, comments.ErrTooMany):
+			log.Warn().Msgf("comments: %d|%s exceeded the comments per hour", user.ID, user.Name)
+			writeJSONError(w, http.StatusTooManyRequests, "too many comments, try again later")
+			return
+		case err != nil:
+			log.Err(err).Msg("comments: error creating comment")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		if c.Status == comments.Approved {
+			s.invalidateComments(c.Key)
+		}
+
+		log.Info().Msgf("comments: %d|%s commented %d on %s, %s with score %d", user.ID, user.Name, c.ID, c.Key, c.Status, c.Score)
+		writeJSON(w, http.StatusCreated, c)
+	}
+}
+
+func (s *Server) moderateCommentHandler() http.HandlerFunc {
+	return s.HandlePanic(s.Limit(s.Logger(s.scoped("admin", s.moderateComment()))))
+}
+
+// moderateComment approves or rejects a comment, it requires the admin scope.
+func (s *Server) moderateComment() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := correlate.Log(r.Context(), s.Log)
+
+		id, err := strconv.ParseInt(s.Param(r, "id"), 10, 64)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		req := &moderateComment{}
+		data, err := io.ReadAll(io.LimitReader(r.Body, commentsMaxBody))
+		if err != nil || json.Unmarshal(data, req) != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+		if req.Status != comments.Approved && req.Status != comments.Rejected {
+			writeJSONError(w, http.StatusBadRequest, "invalid status")
+			return
+		}
+
+		key, err := s.Comments.Moderate(r.Context(), id, req.Status)
+		if errors.Is(err, comments.ErrNotFound) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			log.Err(err).Msg("comments: error moderating comment")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		// rejecting a comment that was already shown removes it as well.
+		s.invalidateComments(key)
+
+		actor := "UNKNOWN"
+		if user := auth.UserFromContext(r.Context()); user != nil {
+			actor = user.Name
+		}
+		log.Info().Msgf("comments: %s set %d %s", actor, id, req.Status)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// commentQueue returns the oldest comments waiting for moderation.
+func (s *Server) commentQueue(r *http.Request) (any, error) {
+	return s.Comments.Queue(r.Context(), 100)
+}
@@ -0,0 +1,202 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package server
+
+import (
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cwbriscoe/goutil/compress"
+	"github.com/cwbriscoe/goweb/config"
+)
+
+const (
+	defaultGzipLevel   = 6
+	defaultBrotliLevel = 6
+	staticGzipLevel    = 9
+	staticBrotliLevel  = 11
+	fastGzipLevel      = 1
+	fastBrotliLevel    = 2
+	defaultZstdLevel   = 3
+	defaultLargeSize   = 256 * 1024
+)
+
+// compressStats keeps track of the work done for a single encoding.
+type compressStats struct {
+	calls    atomic.Int64
+	bytesIn  atomic.Int64
+	bytesOut atomic.Int64
+	nanos    atomic.Int64
+	fast     atomic.Int64
+}
+
+// CompressStats is a snapshot of the compression metrics for a single encoding.
+type CompressStats struct {
+	Calls     int64   `json:"calls"`
+	BytesIn   int64   `json:"bytesIn"`
+	BytesOut  int64   `json:"bytesOut"`
+	Ratio     float64 `json:"ratio"`
+	AvgMillis float64 `json:"avgMillis"`
+	FastCalls int64   `json:"fastCalls"`
+}
+
+// Compressor compresses response bodies using pooled writers.  The level used depends
+// on the content type, whether the response is a static asset that will be cached for
+// a long time, and how busy the server currently is.
+type Compressor struct {
+	sync.Mutex
+	config  *config.Config
+	gz      map[int]*compress.GzipPool
+	br      map[int]*compress.BrotliPool
+	active  atomic.Int64
+	stats   map[string]*compressStats
+	streams streamPools
+}
+
+// NewCompressor creates a Compressor using the compression section of the config.
+func NewCompressor(cfg *config.Config) *Compressor {
+	return &Compressor{
+		config: cfg,
+		gz:     make(map[int]*compress.GzipPool),
+		br:     make(map[int]*compress.BrotliPool),
+		stats: map[string]*compressStats{
+			"br": {},
+			"gz": {},
+		},
+	}
+}
+
+// GzipPool returns the pool for the given gzip level.
+func (c *Compressor) GzipPool(level int) *compress.GzipPool {
+	c.Lock()
+	defer c.Unlock()
+	pool, ok := c.gz[level]
+	if !ok {
+		pool = compress.NewGzipPool(level)
+		c.gz[level] = pool
+	}
+	return pool
+}
+
+// BrotliPool returns the pool for the given brotli level.
+func (c *Compressor) BrotliPool(level int) *compress.BrotliPool {
+	c.Lock()
+	defer c.Unlock()
+	pool, ok := c.br[level]
+	if !ok {
+		pool = compress.NewBrotliPool(level)
+		c.br[level] = pool
+	}
+	return pool
+}
+
+// zstdLevel returns the zstd level of the streamed responses.
+func (c *Compressor) zstdLevel() int {
+	if level := c.config.Compression.Default.Zstd; level > 0 {
+		return level
+	}
+	return defaultZstdLevel
+}
+
+// levels returns the gzip and brotli levels to use for a response.
+func (c *Compressor) levels(contentType string, size int, static bool) (int, int, bool) {
+	cfg := &c.config.Compression
+
+	gz, br := cfg.Default.Gzip, cfg.Default.Brotli
+	if gz == 0 {
+		gz = defaultGzipLevel
+	}
+	if br == 0 {
+		br = defaultBrotliLevel
+	}
+
+	// static assets are compressed once and then cached for a long time so
+	// spend the extra cpu to get them as small as possible.
+	if static {
+		gz, br = cfg.Static.Gzip, cfg.Static.Brotli
+		if gz == 0 {
+			gz = staticGzipLevel
+		}
+		if br == 0 {
+			br = staticBrotliLevel
+		}
+	}
+
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	if levels, ok := cfg.Types[mediaType]; ok {
+		if levels.Gzip > 0 {
+			gz = levels.Gzip
+		}
+		if levels.Brotli > 0 {
+			br = levels.Brotli
+		}
+	}
+
+	// large dynamic responses drop down to a fast level when every cpu is
+	// already busy compressing something else.
+	large := cfg.LargeSize
+	if large == 0 {
+		large = defaultLargeSize
+	}
+	if !static && size > large && c.active.Load() > int64(runtime.NumCPU()) {
+		return fastGzipLevel, fastBrotliLevel, true
+	}
+
+	return gz, br, false
+}
+
+// Compress compresses src with the given encoding ("br" or "gz").
+func (c *Compressor) Compress(encoding, contentType string, src []byte, static bool) ([]byte, error) {
+	c.active.Add(1)
+	defer c.active.Add(-1)
+
+	gzLevel, brLevel, fast := c.levels(contentType, len(src), static)
+
+	start := time.Now()
+	var dest []byte
+	var err error
+	if encoding == "br" {
+		dest, err = c.BrotliPool(brLevel).Compress(src)
+	} else {
+		encoding = "gz"
+		dest, err = c.GzipPool(gzLevel).Compress(src)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	stats := c.stats[encoding]
+	stats.calls.Add(1)
+	stats.bytesIn.Add(int64(len(src)))
+	stats.bytesOut.Add(int64(len(dest)))
+	stats.nanos.Add(int64(time.Since(start)))
+	if fast {
+		stats.fast.Add(1)
+	}
+
+	return dest, nil
+}
+
+// Stats returns a snapshot of the compression metrics per encoding.
+func (c *Compressor) Stats() map[string]*CompressStats {
+	result := make(map[string]*CompressStats, len(c.stats))
+	for encoding, stats := range c.stats {
+		snap := &CompressStats{
+			Calls:     stats.calls.Load(),
+			BytesIn:   stats.bytesIn.Load(),
+			BytesOut:  stats.bytesOut.Load(),
+			FastCalls: stats.fast.Load(),
+		}
+		if snap.BytesIn > 0 {
+			snap.Ratio = float64(snap.BytesOut) / float64(snap.BytesIn)
+		}
+		if snap.Calls > 0 {
+			snap.AvgMillis = float64(stats.nanos.Load()) / float64(snap.Calls) / float64(time.Millisecond)
+		}
+		result[encoding] = snap
+	}
+	return result
+}
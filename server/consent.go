@@ -0,0 +1,62 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package server
+
+import (
+	"net/http"
+
+	"github.com/cwbriscoe/goweb/correlate"
+	"github.com/cwbriscoe/goweb/tracker"
+	"github.com/goccy/go-json"
+)
+
+// Consent stores the visitors consent state in the request context so handlers and
+// render code can use tracker.ConsentFromContext to gate optional features.
+func (s *Server) Consent(f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		consent := s.Tracker.GetConsent(r)
+		w.Header().Add("Vary", "Cookie")
+		f(w, r.WithContext(tracker.WithConsent(r.Context(), consent)))
+	}
+}
+
+// ConsentKey appends the visitors consent state to a cache key so cached html can
+// differ depending on what the visitor has agreed to.  Getters can recover the
+// state with tracker.ParseConsentKey on the last key param.
+func ConsentKey(r *http.Request, key string) string {
+	return key + "|" + tracker.ConsentFromContext(r.Context()).Key()
+}
+
+func (s *Server) consentHandler() http.HandlerFunc {
+	return s.HandlePanic(s.Limit(s.Logger(s.Consent(s.consent()))))
+}
+
+func (s *Server) consent() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := correlate.Log(r.Context(), s.Log)
+
+		consent := tracker.ConsentFromContext(r.Context())
+
+		if r.Method == http.MethodPost {
+			consent = &tracker.Consent{}
+			if err := json.NewDecoder(r.Body).Decode(consent); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			s.Tracker.SetConsent(w, consent)
+		}
+
+		data, err := json.Marshal(consent)
+		if err != nil {
+			log.Err(err).Msg("consent: error marshalling consent")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.Header().Add("Cache-Control", "no-store")
+		if _, err = w.Write(data); err != nil {
+			log.Err(err).Msg("consent: error writing response")
+		}
+	}
+}
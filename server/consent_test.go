@@ -0,0 +1,87 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cwbriscoe/goweb/config"
+	"github.com/cwbriscoe/goweb/limiter"
+	"github.com/cwbriscoe/goweb/tracker"
+)
+
+func TestConsentTwoServers(t *testing.T) {
+	public, internal := newStreamServer(), newStreamServer()
+	public.Config, internal.Config = &config.Config{}, &config.Config{}
+	public.Config.Cookies.Prefix = "site_"
+	internal.Config.Cookies.Prefix = "api_"
+	internal.Config.Cookies.Insecure = true
+	public.Tracker, internal.Tracker = public.newTracker(), internal.newTracker()
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/consent/", strings.NewReader(`{"analytics":true}`))
+	public.consentHandler()(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "site_consent" || !cookies[0].Secure {
+		t.Fatalf("expected the secure site_consent cookie, got %v", cookies)
+	}
+
+	r = httptest.NewRequest("GET", "/consent/", nil)
+	r.AddCookie(cookies[0])
+	if !public.Tracker.GetConsent(r).Analytics {
+		t.Error("expected the public server to read its consent")
+	}
+	if internal.Tracker.GetConsent(r).Analytics {
+		t.Error("expected the internal server not to read the consent of the public one")
+	}
+
+	w = httptest.NewRecorder()
+	internal.Tracker.SetConsent(w, &tracker.Consent{})
+	if c := w.Result().Cookies()[0]; c.Name != "api_consent" || c.Secure {
+		t.Errorf("expected the insecure api_consent cookie, got %v", c)
+	}
+
+	public.cpuProfiling.Store(true)
+	if internal.cpuProfiling.Load() {
+		t.Error("expected the profiling state of the servers to be separate")
+	}
+}
+
+func TestConsentLimit(t *testing.T) {
+	s := newStreamServer()
+	s.Config = &config.Config{}
+	s.Tracker = s.newTracker()
+	var err error
+	s.Limiter, err = limiter.NewLimiter(&limiter.LimitSettings{
+		Name:     "test",
+		Log:      s.Log,
+		UserRate: limiter.Rate{Interval: 200 * time.Millisecond, Burst: 1},
+		Registry: limiter.NewRegistry(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the limiter delays the second consent of the burst.
+	h := s.consentHandler()
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/consent/", strings.NewReader(`{"analytics":true}`))
+		r.RemoteAddr = "192.0.2.1:1234"
+		h(w, r)
+		if w.Code != http.StatusOK {
+			t.Errorf("expected 200, got %d", w.Code)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("expected the consents to be limited, took %s", elapsed)
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package server
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/cwbriscoe/goweb/correlate"
+)
+
+const defaultCORSMaxAge = 600
+
+// corsMethods are the methods checked against the router to answer a preflight when no
+// methods are configured.
+var corsMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"}
+
+// corsPolicy is the compiled CORS config.
+type corsPolicy struct {
+	any         bool
+	origins     map[string]struct{}
+	suffixes    []string // .example.com of a https://*.example.com origin
+	schemes     []string // https:// of the same origin
+	methods     string
+	headers     string
+	expose      string
+	credentials bool
+	maxAge      string
+}
+
+// corsPolicy compiles the CORS config.  Credentials can't be sent to any origin, every
+// site could then call the api as the signed in visitor.
+func (s *Server) corsPolicy() (*corsPolicy, error) {
+	cfg := s.Config.CORS
+	p := &corsPolicy{
+		origins:     make(map[string]struct{}),
+		methods:     strings.Join(cfg.Methods, ", "),
+		headers:     strings.Join(cfg.Headers, ", "),
+		expose:      strings.Join(append([]string{correlate.RequestIDHeader}, cfg.Expose...), ", "),
+		credentials: cfg.Credentials,
+		maxAge:      strconv.Itoa(cfg.MaxAge),
+	}
+	if p.headers == "" {
+		p.headers = "Content-Type"
+	}
+	if cfg.MaxAge <= 0 {
+		p.maxAge = strconv.Itoa(defaultCORSMaxAge)
+	}
+
+	for _, origin := range cfg.Origins {
+		origin = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(origin), "/"))
+		scheme, host, _ := strings.Cut(origin, "://")
+		switch {
+		case origin == "null":
+			return nil, errors.New("server: the null CORS origin is sent by sandboxed documents of any site, it can't be allowed")
+		case origin == "*":
+			if p.credentials {
+				return nil, errors.New("server: CORS credentials can't be allowed for the * origin, list the origins")
+			}
+			p.any = true
+		case strings.HasPrefix(host, "*."):
+			p.schemes = append(p.schemes, scheme+"://")
+			p.suffixes = append(p.suffixes, host[1:])
+		case origin != "":
+			p.origins[origin] = struct{}{}
+		}
+	}
+	return p, nil
+}
+
+// allowed returns true if the origin may call the api.  The opaque null origin of
+// sandboxed documents and local files is never allowed.
+func (p *corsPolicy) allowed(origin string) bool {
+	origin = strings.ToLower(origin)
+	if origin == "null" {
+		return false
+	}
+	if _, ok := p.origins[origin]; ok {
+		return true
+	}
+	for i, suffix := range p.suffixes {
+		if host, ok := strings.CutPrefix(origin, p.schemes[i]); ok && strings.HasSuffix(host, suffix) {
+			return true
+		}
+	}
+	return p.any
+}
+
+// CORS lets scripts on the origins in the config call the api.  It answers the preflight
+// OPTIONS requests of registered routes itself and adds the CORS headers to the other
+// responses of allowed origins.  Requests of other origins are passed on unchanged, the
+// browser then hides the response from the script.  It panics when the config allows
+// credentials for any origin.
+func (s *Server) CORS(next http.Handler) http.Handler {
+	p, err := s.corsPolicy()
+	if err != nil {
+		panic(err)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+		if !p.allowed(origin) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// a listed origin is echoed so credentials can be allowed, * never allows them.
+		if p.any {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			if p.credentials {
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+		}
+
+		method := r.Header.Get("Access-Control-Request-Method")
+		if r.Method != http.MethodOptions || method == "" {
+			w.Header().Set("Access-Control-Expose-Headers", p.expose)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// preflight
+		if s.Router.Match(method, r.URL.Path) == "" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		methods := p.methods
+		if methods == "" {
+			methods = s.routeMethods(r.URL.Path)
+		}
+		w.Header().Add("Vary", "Access-Control-Request-Method")
+		w.Header().Add("Vary", "Access-Control-Request-Headers")
+		w.Header().Set("Access-Control-Allow-Methods", methods)
+		w.Header().Set("Access-Control-Allow-Headers", p.headers)
+		w.Header().Set("Access-Control-Max-Age", p.maxAge)
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// routeMethods returns the methods registered for the path.
+func (s *Server) routeMethods(path string) string {
+	var methods []string
+	for _, method := range corsMethods {
+		if s.Router.Match(method, path) != "" {
+			methods = append(methods, method)
+		}
+	}
+	return strings.Join(methods, ", ")
+}
@@ -0,0 +1,99 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cwbriscoe/goweb/config"
+)
+
+func corsServer(cors func(*config.Config)) http.Handler {
+	s := &Server{Router: NewHTTPRouter(), Config: &config.Config{}}
+	cors(s.Config)
+	ok := func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusOK) }
+	s.Router.HandlerFunc("GET", "/links/", ok)
+	s.Router.HandlerFunc("POST", "/links/", ok)
+	return s.CORS(s.Router)
+}
+
+func TestCORSPreflight(t *testing.T) {
+	h := corsServer(func(c *config.Config) {
+		c.CORS.Origins = []string{"https://app.example.com", "https://*.example.org"}
+		c.CORS.Credentials = true
+	})
+
+	preflight := func(origin, method, path string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("OPTIONS", path, nil)
+		r.Header.Set("Origin", origin)
+		r.Header.Set("Access-Control-Request-Method", method)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	w := preflight("https://app.example.com", "POST", "/links/")
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", w.Code)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Methods"); got != "GET, POST" {
+		t.Errorf("expected the route methods, got %q", got)
+	}
+	if w.Header().Get("Access-Control-Allow-Origin") != "https://app.example.com" || w.Header().Get("Access-Control-Allow-Credentials") != "true" {
+		t.Errorf("expected the origin with credentials, got %v", w.Header())
+	}
+
+	if w = preflight("https://api.example.org", "DELETE", "/links/"); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unregistered method, got %d", w.Code)
+	}
+	if w = preflight("https://evil.com", "GET", "/links/"); w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("expected no cors headers for another origin, got %v", w.Header())
+	}
+	if w = preflight("https://example.org.evil.com", "GET", "/links/"); w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("expected no cors headers for a lookalike origin, got %v", w.Header())
+	}
+}
+
+func TestCORSAnyOrigin(t *testing.T) {
+	h := corsServer(func(c *config.Config) {
+		c.CORS.Origins = []string{"*"}
+	})
+
+	r := httptest.NewRequest("GET", "/links/", nil)
+	r.Header.Set("Origin", "https://anywhere.net")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Header().Get("Access-Control-Allow-Origin") != "*" {
+		t.Errorf("expected 200 for any origin, got %d %v", w.Code, w.Header())
+	}
+	if w.Header().Get("Access-Control-Allow-Credentials") != "" {
+		t.Error("expected no credentials for any origin")
+	}
+}
+
+func TestCORSCredentials(t *testing.T) {
+	s := &Server{Config: &config.Config{}}
+	s.Config.CORS.Origins = []string{"*"}
+	s.Config.CORS.Credentials = true
+	if _, err := s.corsPolicy(); err == nil {
+		t.Error("expected credentials to be refused for any origin")
+	}
+	s.Config.CORS.Origins = []string{"null"}
+	s.Config.CORS.Credentials = false
+	if _, err := s.corsPolicy(); err == nil {
+		t.Error("expected the null origin to be refused")
+	}
+
+	h := corsServer(func(c *config.Config) {
+		c.CORS.Origins = []string{"*"}
+	})
+	r := httptest.NewRequest("GET", "/links/", nil)
+	r.Header.Set("Origin", "null")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("expected no cors headers for the null origin, got %v", w.Header())
+	}
+}
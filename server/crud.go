@@ -0,0 +1,579 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cwbriscoe/goweb/auth"
+	"github.com/cwbriscoe/goweb/correlate"
+	"github.com/cwbriscoe/goweb/internal/respond"
+	"github.com/cwbriscoe/goweb/query"
+	"github.com/goccy/go-json"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+const (
+	crudMaxBody  = 64 * 1024
+	crudPageSize = 50
+	crudMaxLimit = 500
+)
+
+// CRUDType is the type of a CRUD column, json and query string values are converted to
+// it before they reach the db.
+type CRUDType int
+
+// The CRUD column types.
+const (
+	CRUDText  CRUDType = iota
+	CRUDInt            // int2, int4 or int8
+	CRUDFloat          // float4, float8 or numeric
+	CRUDBool
+	CRUDTime // timestamptz, sent as RFC 3339
+)
+
+// CRUDColumn maps a column of the table to a json field.
+type CRUDColumn struct {
+	Name     string   // column name
+	Field    string   // json field, defaults to the column name
+	Type     CRUDType // defaults to CRUDText
+	Key      bool     // the primary key, exactly one column has to be the key
+	ReadOnly bool     // set by the db, ie: a generated key or create_ts, ignored in requests
+	Required bool     // must be set when a row is created
+	Filter   bool     // the list can be filtered with ?field=value
+	MaxLen   int      // max length of text values, 0 is unlimited
+}
+
+// CRUDScopes are the scopes required for each operation.  An empty scope defaults to
+// "admin", "*" lets everyone through.
+type CRUDScopes struct {
+	List   string
+	Get    string
+	Create string
+	Update string
+	Delete string
+}
+
+// CRUDResource declares a table that is served as json endpoints:
+//
+//	GET    {Path}      list, paged with ?limit= and ?offset= and filtered by Filter columns
+//	GET    {Path}:key  get one row
+//	POST   {Path}      create a row, returns it with the values set by the db
+//	PUT    {Path}:key  update the fields sent, returns the row
+//	DELETE {Path}:key  delete a row
+//
+// Path must not share a prefix with a wildcard route, ie: use "/api/countries/" instead
+// of "/admin/countries/".
+type CRUDResource struct {
+	Path       string // ie: "/api/countries/"
+	Schema     string
+	Table      string
+	Columns    []CRUDColumn
+	Order      string                                      // order by of the list, defaults to the key column
+	Scopes     CRUDScopes                                  // scopes per operation
+	Validate   func(row map[string]any, create bool) error // optional, the error message is returned with a 422
+	Invalidate []string                                    // cache groups invalidated after every change
+}
+
+// crud is a compiled CRUDResource.
+type crud struct {
+	res     *CRUDResource
+	key     *CRUDColumn
+	fields  map[string]*CRUDColumn // json field -> column
+	table   string                 // sanitized schema.table
+	columns string                 // sanitized select list
+	order   string
+}
+
+// AddCRUD registers the json endpoints of the resource.  It panics when the resource is
+// not valid, so mistakes show up when the server starts.
+func (s *Server) AddCRUD(res *CRUDResource) {
+	c, err := compileCRUD(res)
+	if err != nil {
+		panic(err)
+	}
+
+	rowPath := res.Path + ":key"
+	scope := func(scope string) string {
+		switch scope {
+		case "":
+			return "admin"
+		case "*":
+			return ""
+		}
+		return scope
+	}
+	s.RequireScope("GET", res.Path, scope(res.Scopes.List))
+	s.RequireScope("GET", rowPath, scope(res.Scopes.Get))
+	s.RequireScope("POST", res.Path, scope(res.Scopes.Create))
+	s.RequireScope("PUT", rowPath, scope(res.Scopes.Update))
+	s.RequireScope("DELETE", rowPath, scope(res.Scopes.Delete))
+
+	s.HandlerFunc("GET", res.Path, s.crudHandler(scope(res.Scopes.List), s.crudList(c)))
+	s.HandlerFunc("GET", rowPath, s.crudHandler(scope(res.Scopes.Get), s.crudGet(c)))
+	s.HandlerFunc("POST", res.Path, s.crudHandler(scope(res.Scopes.Create), s.crudCreate(c)))
+	s.HandlerFunc("PUT", rowPath, s.crudHandler(scope(res.Scopes.Update), s.crudUpdate(c)))
+	s.HandlerFunc("DELETE", rowPath, s.crudHandler(scope(res.Scopes.Delete), s.crudDelete(c)))
+}
+
+func compileCRUD(res *CRUDResource) (*crud, error) {
+	if !strings.HasPrefix(res.Path, "/") || !strings.HasSuffix(res.Path, "/") {
+		return nil, fmt.Errorf("crud: path %q must start and end with /", res.Path)
+	}
+	if res.Table == "" || len(res.Columns) == 0 {
+		return nil, fmt.Errorf("crud: %s needs a table and columns", res.Path)
+	}
+
+	c := &crud{
+		res:    res,
+		fields: make(map[string]*CRUDColumn, len(res.Columns)),
+		table:  pgx.Identifier{res.Schema, res.Table}.Sanitize(),
+	}
+	if res.Schema == "" {
+		c.table = pgx.Identifier{res.Table}.Sanitize()
+	}
+
+	names := make([]string, 0, len(res.Columns))
+	for i := range res.Columns {
+		col := &res.Columns[i]
+		if col.Name == "" {
+			return nil, fmt.Errorf("crud: %s has a column without a name", res.Path)
+		}
+		if col.Field == "" {
+			col.Field = col.Name
+		}
+		if _, ok := c.fields[col.Field]; ok {
+			return nil, fmt.Errorf("crud: %s has field %s twice", res.Path, col.Field)
+		}
+		c.fields[col.Field] = col
+		if col.Key {
+			if c.key != nil {
+				return nil, fmt.Errorf("crud: %s has more than one key column", res.Path)
+			}
+			c.key = col
+		}
+		names = append(names, pgx.Identifier{col.Name}.Sanitize())
+	}
+	if c.key == nil {
+		return nil, fmt.Errorf("crud: %s has no key column", res.Path)
+	}
+	c.columns = strings.Join(names, ", ")
+
+	c.order = pgx.Identifier{c.key.Name}.Sanitize()
+	if res.Order != "" {
+		found := false
+		for _, col := range res.Columns {
+			found = found || col.Name == res.Order
+		}
+		if !found {
+			return nil, fmt.Errorf("crud: %s orders by unknown column %s", res.Path, res.Order)
+		}
+		c.order = pgx.Identifier{res.Order}.Sanitize()
+	}
+
+	return c, nil
+}
+
+// crudError is returned to the client with a 422.
+type crudError struct {
+	field string // json name of the invalid field, empty when the error is not about one
+	msg   string
+}
+
+func (e *crudError) Error() string {
+	return e.msg
+}
+
+func invalidField(field, msg string) error {
+	return &crudError{field: field, msg: field + ": " + msg}
+}
+
+// convertJSON converts a decoded json value to the type of the column.
+func convertJSON(col *CRUDColumn, v any) (any, error) {
+	if v == nil {
+		if col.Required {
+			return nil, invalidField(col.Field, "is required")
+		}
+		return nil, nil
+	}
+
+	switch col.Type {
+	case CRUDInt:
+		f, ok := v.(float64)
+		if !ok || f != math.Trunc(f) || math.Abs(f) > 1<<53 {
+			return nil, invalidField(col.Field, "must be an integer")
+		}
+		return int64(f), nil
+	case CRUDFloat:
+		f, ok := v.(float64)
+		if !ok {
+			return nil, invalidField(col.Field, "must be a number")
+		}
+		return f, nil
+	case CRUDBool:
+		b, ok := v.(bool)
+		if !ok {
+			return nil, invalidField(col.Field, "must be true or false")
+		}
+		return b, nil
+	}
+
+	str, ok := v.(string)
+	if !ok {
+		return nil, invalidField(col.Field, "must be a string")
+	}
+	return convertText(col, str)
+}
+
+// convertText converts a query string or url parameter to the type of the column.
+func convertText(col *CRUDColumn, v string) (any, error) {
+	switch col.Type {
+	case CRUDInt:
+		i, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, invalidField(col.Field, "must be an integer")
+		}
+		return i, nil
+	case CRUDFloat:
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return nil, invalidField(col.Field, "must be a number")
+		}
+		return f, nil
+	case CRUDBool:
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, invalidField(col.Field, "must be true or false")
+		}
+		return b, nil
+	case CRUDTime:
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return nil, invalidField(col.Field, "must be an RFC 3339 time")
+		}
+		return t, nil
+	}
+
+	if col.MaxLen > 0 && len([]rune(v)) > col.MaxLen {
+		return nil, invalidField(col.Field, "must be at most "+strconv.Itoa(col.MaxLen)+" characters")
+	}
+	if col.Required && strings.TrimSpace(v) == "" {
+		return nil, invalidField(col.Field, "is required")
+	}
+	return v, nil
+}
+
+// decodeRow reads the writable fields of the request body.  Read only fields are
+// ignored so a client can send back a row it read, unknown fields are an error.
+func (c *crud) decodeRow(r *http.Request, create bool) (map[string]any, error) {
+	data, err := io.ReadAll(io.LimitReader(r.Body, crudMaxBody))
+	if err != nil {
+		return nil, &crudError{msg: "invalid request body"}
+	}
+	body := make(map[string]any)
+	if err = json.Unmarshal(data, &body); err != nil {
+		return nil, &crudError{msg: "invalid request body"}
+	}
+
+	row := make(map[string]any, len(body))
+	for field, v := range body {
+		col, ok := c.fields[field]
+		if !ok {
+			return nil, invalidField(field, "is unknown")
+		}
+		// the key of an existing row comes from the url
+		if col.ReadOnly || (col.Key && !create) {
+			continue
+		}
+		if row[field], err = convertJSON(col, v); err != nil {
+			return nil, err
+		}
+	}
+
+	if create {
+		for _, col := range c.res.Columns {
+			if _, ok := row[col.Field]; !ok && col.Required && !col.ReadOnly {
+				return nil, invalidField(col.Field, "is required")
+			}
+		}
+	}
+	if len(row) == 0 {
+		return nil, &crudError{msg: "no fields to save"}
+	}
+
+	if c.res.Validate != nil {
+		if err = c.res.Validate(row, create); err != nil {
+			return nil, &crudError{msg: err.Error()}
+		}
+	}
+	return row, nil
+}
+
+// crudHandler wraps the CRUD endpoints with the api middleware and checks the scope of
+// the operation again, so overriding the route permission can't open up a table.
+func (s *Server) crudHandler(scope string, f http.HandlerFunc) http.HandlerFunc {
+	return s.HandlePanic(s.Limit(s.Logger(s.scoped(scope, f))))
+}
+
+func (c *crud) queryName(op string) query.Query {
+	return query.Query{Name: "crud." + c.res.Table + "." + op}
+}
+
+// collect scans rows into json objects keyed by field.
+// columnField returns the json name of the column, or "" when it is not one of the
+// columns of the resource, ie: the column of a postgres error is not always set.
+func (c *crud) columnField(name string) string {
+	for _, col := range c.res.Columns {
+		if col.Name == name {
+			return col.Field
+		}
+	}
+	return ""
+}
+
+func (c *crud) collect(rows pgx.Rows) ([]map[string]any, error) {
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (map[string]any, error) {
+		values, err := row.Values()
+		if err != nil {
+			return nil, err
+		}
+		obj := make(map[string]any, len(values))
+		for i, v := range values {
+			obj[c.res.Columns[i].Field] = v
+		}
+		return obj, nil
+	})
+}
+
+func (s *Server) crudList(c *crud) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params := r.URL.Query()
+		limit, err := strconv.Atoi(params.Get("limit"))
+		if err != nil || limit <= 0 || limit > crudMaxLimit {
+			limit = crudPageSize
+		}
+		offset, err := strconv.Atoi(params.Get("offset"))
+		if err != nil || offset < 0 {
+			offset = 0
+		}
+
+		var where []string
+		var args []any
+		for _, col := range c.res.Columns {
+			if !col.Filter || !params.Has(col.Field) {
+				continue
+			}
+			v, err := convertText(&col, params.Get(col.Field))
+			if err != nil {
+				s.crudFailed(w, r, c, err)
+				return
+			}
+			args = append(args, v)
+			where = append(where, pgx.Identifier{col.Name}.Sanitize()+" = $"+strconv.Itoa(len(args)))
+		}
+
+		sql := "select " + c.columns + " from " + c.table
+		if len(where) > 0 {
+			sql += " where " + strings.Join(where, " and ")
+		}
+		args = append(args, limit, offset)
+		sql += " order by " + c.order + " limit $" + strconv.Itoa(len(args)-1) + " offset $" + strconv.Itoa(len(args)) + ";"
+
+		q := c.queryName("list")
+		rows, err := s.DB.Query(r.Context(), sql, args...)
+		if err != nil {
+			s.crudFailed(w, r, c, query.Wrap(q, err))
+			return
+		}
+		items, err := c.collect(rows)
+		if err != nil {
+			s.crudFailed(w, r, c, query.Wrap(q, err))
+			return
+		}
+
+		writeJSON(w, http.StatusOK, map[string]any{"items": items, "limit": limit, "offset": offset})
+	}
+}
+
+func (s *Server) crudGet(c *crud) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key, err := convertText(c.key, s.Param(r, "key"))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		sql := "select " + c.columns + " from " + c.table + " where " + pgx.Identifier{c.key.Name}.Sanitize() + " = $1;"
+		obj, err := s.crudOne(r.Context(), c, "get", sql, key)
+		if errors.Is(err, pgx.ErrNoRows) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			s.crudFailed(w, r, c, err)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, obj)
+	}
+}
+
+func (s *Server) crudCreate(c *crud) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		row, err := c.decodeRow(r, true)
+		if err != nil {
+			s.crudFailed(w, r, c, err)
+			return
+		}
+
+		names := make([]string, 0, len(row))
+		places := make([]string, 0, len(row))
+		args := make([]any, 0, len(row))
+		for _, col := range c.res.Columns {
+			if v, ok := row[col.Field]; ok {
+				args = append(args, v)
+				names = append(names, pgx.Identifier{col.Name}.Sanitize())
+				places = append(places, "$"+strconv.Itoa(len(args)))
+			}
+		}
+
+		sql := "insert into " + c.table + " (" + strings.Join(names, ", ") + ") values (" + strings.Join(places, ", ") + ") returning " + c.columns + ";"
+		obj, err := s.crudOne(r.Context(), c, "create", sql, args...)
+		if err != nil {
+			s.crudFailed(w, r, c, err)
+			return
+		}
+
+		s.crudChanged(r, c, "created", obj[c.key.Field])
+		writeJSON(w, http.StatusCreated, obj)
+	}
+}
+
+func (s *Server) crudUpdate(c *crud) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key, err := convertText(c.key, s.Param(r, "key"))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		row, err := c.decodeRow(r, false)
+		if err != nil {
+			s.crudFailed(w, r, c, err)
+			return
+		}
+
+		sets := make([]string, 0, len(row))
+		args := make([]any, 0, len(row)+1)
+		for _, col := range c.res.Columns {
+			if v, ok := row[col.Field]; ok {
+				args = append(args, v)
+				sets = append(sets, pgx.Identifier{col.Name}.Sanitize()+" = $"+strconv.Itoa(len(args)))
+			}
+		}
+		args = append(args, key)
+
+		sql := "update " + c.table + " set " + strings.Join(sets, ", ") + " where " + pgx.Identifier{c.key.Name}.Sanitize() + " = $" + strconv.Itoa(len(args)) + " returning " + c.columns + ";"
+		obj, err := s.crudOne(r.Context(), c, "update", sql, args...)
+		if errors.Is(err, pgx.ErrNoRows) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			s.crudFailed(w, r, c, err)
+			return
+		}
+
+		s.crudChanged(r, c, "updated", key)
+		writeJSON(w, http.StatusOK, obj)
+	}
+}
+
+func (s *Server) crudDelete(c *crud) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key, err := convertText(c.key, s.Param(r, "key"))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		sql := "delete from " + c.table + " where " + pgx.Identifier{c.key.Name}.Sanitize() + " = $1;"
+		tag, err := s.DB.Exec(r.Context(), sql, key)
+		if err != nil {
+			s.crudFailed(w, r, c, query.Wrap(c.queryName("delete"), err))
+			return
+		}
+		if tag.RowsAffected() == 0 {
+			http.NotFound(w, r)
+			return
+		}
+
+		s.crudChanged(r, c, "deleted", key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// crudOne runs a query returning at most one row.
+func (s *Server) crudOne(ctx context.Context, c *crud, op, sql string, args ...any) (map[string]any, error) {
+	rows, err := s.DB.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, query.Wrap(c.queryName(op), err)
+	}
+	objs, err := c.collect(rows)
+	if err != nil {
+		return nil, query.Wrap(c.queryName(op), err)
+	}
+	if len(objs) == 0 {
+		return nil, pgx.ErrNoRows
+	}
+	return objs[0], nil
+}
+
+// crudChanged logs the change and invalidates the cache groups depending on the table.
+func (s *Server) crudChanged(r *http.Request, c *crud, action string, key any) {
+	actor := "UNKNOWN"
+	if user := auth.UserFromContext(r.Context()); user != nil {
+		actor = user.Name
+	}
+	correlate.Log(r.Context(), s.Log).Info().Msgf("crud: %s %s %s %v", actor, action, c.res.Table, key)
+
+	for _, group := range c.res.Invalidate {
+		s.InvalidateGroup(group)
+	}
+}
+
+// crudFailed maps validation and constraint errors to a 4xx response.
+func (s *Server) crudFailed(w http.ResponseWriter, r *http.Request, c *crud, err error) {
+	var cerr *crudError
+	if errors.As(err, &cerr) {
+		respond.WriteErrorBody(w, r, http.StatusUnprocessableEntity, &respond.Error{Code: "invalid_field", Message: cerr.msg, Field: cerr.field})
+		return
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch {
+		case pgErr.Code == "23505":
+			respond.WriteError(w, r, http.StatusConflict, "", "a row with the same key already exists")
+			return
+		case pgErr.Code == "23503":
+			respond.WriteError(w, r, http.StatusConflict, "", "the row is referenced by or references another row")
+			return
+		case pgErr.Code == "23502", pgErr.Code == "23514", strings.HasPrefix(pgErr.Code, "22"):
+			respond.WriteErrorBody(w, r, http.StatusUnprocessableEntity, &respond.Error{Code: "invalid_field", Message: pgErr.Message, Field: c.columnField(pgErr.ColumnName)})
+			return
+		}
+	}
+
+	s.Log.Err(err).Msg("crud: error running query")
+	w.WriteHeader(http.StatusInternalServerError)
+}
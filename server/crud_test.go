@@ -0,0 +1,142 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package server
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/cwbriscoe/goweb/internal/respond"
+	"github.com/goccy/go-json"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+func testCRUD(t *testing.T) *crud {
+	c, err := compileCRUD(&CRUDResource{
+		Path:   "/api/countries/",
+		Schema: "ref",
+		Table:  "country",
+		Columns: []CRUDColumn{
+			{Name: "id", Type: CRUDInt, Key: true, ReadOnly: true},
+			{Name: "code", Required: true, MaxLen: 2, Filter: true},
+			{Name: "name", Required: true},
+			{Name: "eu_member", Field: "euMember", Type: CRUDBool},
+			{Name: "create_ts", Field: "created", Type: CRUDTime, ReadOnly: true},
+		},
+		Validate: func(row map[string]any, _ bool) error {
+			if row["code"] == "XX" {
+				return errors.New("code: XX is reserved")
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestCompileCRUD(t *testing.T) {
+	c := testCRUD(t)
+	if c.table != `"ref"."country"` {
+		t.Errorf("unexpected table %s", c.table)
+	}
+	if c.columns != `"id", "code", "name", "eu_member", "create_ts"` {
+		t.Errorf("unexpected columns %s", c.columns)
+	}
+	if c.key.Name != "id" || c.order != `"id"` {
+		t.Errorf("unexpected key %s or order %s", c.key.Name, c.order)
+	}
+
+	bad := []*CRUDResource{
+		{Path: "/api/countries", Table: "t", Columns: []CRUDColumn{{Name: "id", Key: true}}},
+		{Path: "/api/countries/", Table: "t", Columns: []CRUDColumn{{Name: "id"}}},
+		{Path: "/api/countries/", Table: "t", Columns: []CRUDColumn{{Name: "id", Key: true}, {Name: "id2", Key: true}}},
+		{Path: "/api/countries/", Table: "t", Columns: []CRUDColumn{{Name: "id", Key: true}}, Order: "name"},
+	}
+	for i, res := range bad {
+		if _, err := compileCRUD(res); err == nil {
+			t.Errorf("%d: expected an error", i)
+		}
+	}
+}
+
+func TestDecodeCRUDRow(t *testing.T) {
+	c := testCRUD(t)
+	tests := []struct {
+		body   string
+		create bool
+		err    string
+	}{
+		{`{"code":"DE","name":"Germany","euMember":true}`, true, ""},
+		{`{"id":7,"code":"DE","name":"Germany","created":"2023-01-02T03:04:05Z"}`, true, ""},
+		{`{"name":"Germany"}`, true, "code: is required"},
+		{`{"name":"Germany"}`, false, ""},
+		{`{"code":"DEU","name":"Germany"}`, true, "code: must be at most 2 characters"},
+		{`{"code":"DE","name":"Germany","euMember":"yes"}`, true, "euMember: must be true or false"},
+		{`{"code":"DE","name":"Germany","capital":"Berlin"}`, true, "capital: is unknown"},
+		{`{"code":"XX","name":"Nowhere"}`, true, "code: XX is reserved"},
+		{`{"id":7}`, false, "no fields to save"},
+		{`not json`, true, "invalid request body"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("POST", "/api/countries/", strings.NewReader(test.body))
+		row, err := c.decodeRow(r, test.create)
+		if test.err == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", test.body, err)
+			} else if _, ok := row["id"]; ok {
+				t.Errorf("%s: read only id was not ignored", test.body)
+			}
+			continue
+		}
+		if err == nil || err.Error() != test.err {
+			t.Errorf("%s: expected %q, got %v", test.body, test.err, err)
+		}
+	}
+}
+
+func TestConvertCRUDValues(t *testing.T) {
+	col := &CRUDColumn{Field: "n", Type: CRUDInt}
+	if v, err := convertJSON(col, float64(42)); err != nil || v != int64(42) {
+		t.Errorf("expected 42, got %v %v", v, err)
+	}
+	if _, err := convertJSON(col, 4.2); err == nil {
+		t.Error("expected an error for a fraction")
+	}
+	if v, err := convertText(col, "-3"); err != nil || v != int64(-3) {
+		t.Errorf("expected -3, got %v %v", v, err)
+	}
+	if _, err := convertText(&CRUDColumn{Field: "t", Type: CRUDTime}, "yesterday"); err == nil {
+		t.Error("expected an error for an invalid time")
+	}
+}
+
+func TestCRUDFailed(t *testing.T) {
+	c := testCRUD(t)
+	s := &Server{}
+	tests := []struct {
+		err   error
+		field string
+	}{
+		{invalidField("euMember", "must be true or false"), "euMember"},
+		{&crudError{msg: "no fields to save"}, ""},
+		{&pgconn.PgError{Code: "23502", Message: "null value", ColumnName: "eu_member"}, "euMember"},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		s.crudFailed(w, httptest.NewRequest("POST", "/api/countries/", nil), c, test.err)
+		if w.Code != 422 {
+			t.Errorf("%v: expected 422, got %d", test.err, w.Code)
+		}
+		var body struct{ Error respond.Error }
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		if body.Error.Code != "invalid_field" || body.Error.Field != test.field || body.Error.Message == "" {
+			t.Errorf("%v: unexpected error %+v", test.err, body.Error)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goccy/go-json"
+)
+
+const (
+	cspReportPath    = "/csp-report/"
+	cspMaxBody       = 64 * 1024 // max size of a report request
+	cspMaxViolations = 500       // max number of distinct violations kept
+	cspMaxSamples    = 5         // max number of recent samples kept per violation
+)
+
+// CSPReport is a single browser reported content security policy violation.
+type CSPReport struct {
+	DocumentURL        string `json:"documentURL"`
+	BlockedURL         string `json:"blockedURL"`
+	EffectiveDirective string `json:"effectiveDirective"`
+	Disposition        string `json:"disposition,omitempty"`
+	SourceFile         string `json:"sourceFile,omitempty"`
+	LineNumber         int    `json:"lineNumber,omitempty"`
+	Sample             string `json:"sample,omitempty"`
+	UserAgent          string `json:"userAgent,omitempty"`
+}
+
+// CSPViolation is a deduplicated violation with its most recent samples.
+type CSPViolation struct {
+	Directive string       `json:"directive"`
+	Blocked   string       `json:"blocked"`
+	Document  string       `json:"document"`
+	Count     int64        `json:"count"`
+	FirstSeen time.Time    `json:"firstSeen"`
+	LastSeen  time.Time    `json:"lastSeen"`
+	Samples   []*CSPReport `json:"samples"`
+}
+
+// cspReports deduplicates the violation reports in memory.
+type cspReports struct {
+	sync.Mutex
+	violations map[string]*CSPViolation
+}
+
+// legacy report-uri format
+type cspLegacyReport struct {
+	Report struct {
+		DocumentURI        string `json:"document-uri"`
+		BlockedURI         string `json:"blocked-uri"`
+		EffectiveDirective string `json:"effective-directive"`
+		ViolatedDirective  string `json:"violated-directive"`
+		Disposition        string `json:"disposition"`
+		SourceFile         string `json:"source-file"`
+		LineNumber         int    `json:"line-number"`
+		ScriptSample       string `json:"script-sample"`
+	} `json:"csp-report"`
+}
+
+// reporting api (Report-To) format
+type cspReportingAPI struct {
+	Type      string     `json:"type"`
+	UserAgent string     `json:"user_agent"`
+	Body      *CSPReport `json:"body"`
+}
+
+// cspPolicy is the Content-Security-Policy header sent by SecurityHeaders.
+type cspPolicy struct {
+	header string
+	value  string
+}
+
+// setCSP replaces the policy sent by SecurityHeaders, no header is sent when policy is
+// empty.
+func (s *Server) setCSP(policy string, reportOnly bool) {
+	csp := &cspPolicy{header: "Content-Security-Policy"}
+	if reportOnly {
+		csp.header = "Content-Security-Policy-Report-Only"
+	}
+	if policy != "" {
+		csp.value = policy + "; report-uri " + cspReportPath + "; report-to csp-endpoint"
+	}
+	s.cspPolicy.Store(csp)
+}
+
+// SecurityHeaders adds the configured Content-Security-Policy to the response with the
+// report endpoints pointing at the built in collector.
+func (s *Server) SecurityHeaders(f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if csp := s.cspPolicy.Load(); csp != nil && csp.value != "" {
+			w.Header().Set("Reporting-Endpoints", `csp-endpoint="`+cspReportPath+`"`)
+			w.Header().Set("Report-To", `{"group":"csp-endpoint","max_age":86400,"endpoints":[{"url":"`+cspReportPath+`"}]}`)
+			w.Header().Set(csp.header, csp.value)
+		}
+		f(w, r)
+	}
+}
+
+func (s *Server) cspReportHandler() http.HandlerFunc {
+	return s.HandlePanic(s.Limit(s.Logger(s.cspReport())))
+}
+
+func (s *Server) cspReport() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		data, err := io.ReadAll(io.LimitReader(r.Body, cspMaxBody))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		reports, err := parseCSPReports(r.Header.Get("Content-Type"), data)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		for _, report := range reports {
+			if report.UserAgent == "" {
+				report.UserAgent = r.Header.Get("User-Agent")
+			}
+			s.csp.add(report)
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func parseCSPReports(contentType string, data []byte) ([]*CSPReport, error) {
+	if strings.HasPrefix(contentType, "application/reports+json") {
+		var list []cspReportingAPI
+		if err := json.Unmarshal(data, &list); err != nil {
+			return nil, err
+		}
+		reports := make([]*CSPReport, 0, len(list))
+		for _, item := range list {
+			if item.Type != "csp-violation" || item.Body == nil {
+				continue
+			}
+			item.Body.UserAgent = item.UserAgent
+			reports = append(reports, item.Body)
+		}
+		return reports, nil
+	}
+
+	legacy := &cspLegacyReport{}
+	if err := json.Unmarshal(data, legacy); err != nil {
+		return nil, err
+	}
+	directive := legacy.Report.EffectiveDirective
+	if directive == "" {
+		directive = legacy.Report.ViolatedDirective
+	}
+	return []*CSPReport{{
+		DocumentURL:        legacy.Report.DocumentURI,
+		BlockedURL:         legacy.Report.BlockedURI,
+		EffectiveDirective: directive,
+		Disposition:        legacy.Report.Disposition,
+		SourceFile:         legacy.Report.SourceFile,
+		LineNumber:         legacy.Report.LineNumber,
+		Sample:             legacy.Report.ScriptSample,
+	}}, nil
+}
+
+// stripQuery removes the query string and fragment so reports from the same page dedupe.
+func stripQuery(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return s
+	}
+	u.RawQuery = ""
+	u.Fragment = ""
+	return u.String()
+}
+
+func (c *cspReports) add(report *CSPReport) {
+	now := time.Now()
+	blocked := stripQuery(report.BlockedURL)
+	document := stripQuery(report.DocumentURL)
+	key := report.EffectiveDirective + "|" + blocked + "|" + document
+
+	c.Lock()
+	defer c.Unlock()
+
+	if c.violations == nil {
+		c.violations = make(map[string]*CSPViolation)
+	}
+
+	v, ok := c.violations[key]
+	if !ok {
+		if len(c.violations) >= cspMaxViolations {
+			c.evictOldest()
+		}
+		v = &CSPViolation{
+			Directive: report.EffectiveDirective,
+			Blocked:   blocked,
+			Document:  document,
+			FirstSeen: now,
+		}
+		c.violations[key] = v
+	}
+
+	v.Count++
+	v.LastSeen = now
+	v.Samples = append(v.Samples, report)
+	if len(v.Samples) > cspMaxSamples {
+		v.Samples = v.Samples[1:]
+	}
+}
+
+func (c *cspReports) evictOldest() {
+	var oldest string
+	var last time.Time
+	for key, v := range c.violations {
+		if oldest == "" || v.LastSeen.Before(last) {
+			oldest, last = key, v.LastSeen
+		}
+	}
+	delete(c.violations, oldest)
+}
+
+// list returns the violations ordered by count.
+func (c *cspReports) list(*http.Request) (any, error) {
+	return c.collect(false), nil
+}
+
+// clear resets the collector and returns the violations it held ordered by count.
+func (c *cspReports) clear(*http.Request) (any, error) {
+	return c.collect(true), nil
+}
+
+func (c *cspReports) collect(reset bool) []CSPViolation {
+	c.Lock()
+	defer c.Unlock()
+
+	result := make([]CSPViolation, 0, len(c.violations))
+	for _, v := range c.violations {
+		cp := *v
+		cp.Samples = append([]*CSPReport(nil), v.Samples...)
+		result = append(result, cp)
+	}
+
+	if reset {
+		c.violations = nil
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Count > result[j].Count
+	})
+
+	return result
+}
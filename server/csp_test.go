@@ -0,0 +1,29 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package server
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCSPReportsClear(t *testing.T) {
+	var c cspReports
+	c.add(&CSPReport{DocumentURL: "https://example.com/", BlockedURL: "inline", EffectiveDirective: "script-src"})
+
+	r := httptest.NewRequest("GET", "/admin/csp/?clear=1", nil)
+	if v, _ := c.list(r); len(v.([]CSPViolation)) != 1 {
+		t.Fatalf("expected 1 violation, got %v", v)
+	}
+	if v, _ := c.list(r); len(v.([]CSPViolation)) != 1 {
+		t.Error("expected a GET not to clear the violations")
+	}
+
+	r = httptest.NewRequest("POST", "/admin/csp/", nil)
+	if v, _ := c.clear(r); len(v.([]CSPViolation)) != 1 {
+		t.Errorf("expected the cleared violation to be returned, got %v", v)
+	}
+	if v, _ := c.list(r); len(v.([]CSPViolation)) != 0 {
+		t.Errorf("expected no violations after clearing, got %v", v)
+	}
+}
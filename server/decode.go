@@ -0,0 +1,36 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package server
+
+import (
+	"net/http"
+
+	"github.com/cwbriscoe/goweb/internal/decode"
+)
+
+// DecodeError is why Decode rejected a body: the status, the code, ie: unknown_field or
+// invalid_field, the message and the invalid field.
+type DecodeError = decode.Error
+
+// Decode decodes the json body of r into a new T and validates it with the validate
+// tags of T, ie: `validate:"required,max=20"`.  The Content-Type must be application/json,
+// the body at most limits.maxJsonBody bytes, 1MB by default, and fields unknown to T are
+// rejected.  The error is a *DecodeError, write it with WriteDecodeError:
+//
+//	req, err := server.Decode[newNote](r)
+//	if err != nil {
+//		s.WriteDecodeError(w, r, err)
+//		return
+//	}
+//
+// The rules of the validate tags are required, min=N and max=N, the characters of
+// strings, elements of slices or value of numbers, email and oneof=a b c.
+func Decode[T any](r *http.Request) (*T, error) {
+	return decode.JSON[T](r)
+}
+
+// WriteDecodeError writes the error envelope of an error returned by Decode, with the
+// invalid field, ie: {"error": {"code": "invalid_field", "field": "text", ...}}.
+func (*Server) WriteDecodeError(w http.ResponseWriter, r *http.Request, err error) {
+	decode.WriteError(w, r, err)
+}
@@ -0,0 +1,110 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package server
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/cwbriscoe/goutil/net"
+	"github.com/cwbriscoe/goweb/correlate"
+	"github.com/cwbriscoe/goweb/waf"
+)
+
+// challengeParam is added to the url when a visitor is sent through the cookie challenge
+// so visitors that do not keep cookies are denied instead of redirected forever.
+const challengeParam = "wafc"
+
+// Handler returns the http.Handler to serve, the router wrapped by the read-only mode
+// check, by the firewall, by the fault injection when it is
+// allowed and by CORS when origins are configured.  Every request is assigned a request
+// id first.
+func (s *Server) Handler() http.Handler {
+	var h http.Handler = s.ReadOnlyHandler(s.Router)
+	if s.Chaos != nil {
+		h = s.ChaosHandler(h)
+	}
+	// wrapped without rules too, a reloaded config can add them.
+	if s.Firewall != nil {
+		h = s.FirewallHandler(h)
+	}
+	// outside the firewall and faults so scripts can read their error responses.
+	if len(s.Config.CORS.Origins) > 0 {
+		h = s.CORS(h)
+	}
+	return s.Correlate(s.limitBody(h))
+}
+
+// Correlate stores the request id, and the job run id when a job made the request, in
+// the request context and echoes the request id back in the response headers.
+func (s *Server) Correlate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := correlate.FromRequest(r, s.runKey)
+		w.Header().Set(correlate.RequestIDHeader, correlate.RequestID(ctx))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// FirewallHandler evaluates the firewall rules before passing the request to the next
+// handler.  The decision is stored in the request context.  Requests pass through
+// untouched while no rules are configured.
+func (s *Server) FirewallHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(s.Firewall.Rules()) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		facts := s.Firewall.GetFacts(r)
+		decision := s.Firewall.Evaluate(facts)
+		r = r.WithContext(waf.WithDecision(r.Context(), decision))
+
+		if decision.Action != waf.Allow {
+			correlate.Log(r.Context(), s.Log).Info().Msgf("waf %s: %s %s %s %s", decision.Rule, decision.Action, s.Anonymizer.IP(net.GetIP(r)), r.Method, r.URL.Path)
+		}
+
+		switch decision.Action {
+		case waf.Deny:
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		case waf.Challenge:
+			if !s.challenge(w, r) {
+				return
+			}
+		case waf.Tarpit:
+			timer := time.NewTimer(decision.Delay)
+			select {
+			case <-r.Context().Done():
+			case <-timer.C:
+			}
+			timer.Stop()
+			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+			return
+		case waf.Reroute:
+			r.URL.Path = decision.Target
+			r.URL.RawPath = ""
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// challenge returns true if the visitor has a tracking cookie.  Otherwise a new cookie is
+// issued and the visitor is redirected back to the same url to prove it was kept.
+func (s *Server) challenge(w http.ResponseWriter, r *http.Request) bool {
+	if s.Tracker.ReadTrackingInfo(r) != nil {
+		return true
+	}
+
+	query := r.URL.Query()
+	if query.Get(challengeParam) != "" {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return false
+	}
+
+	s.Tracker.GetTrackingInfo(w, r)
+	query.Set(challengeParam, "1")
+	u := *r.URL
+	u.RawQuery = query.Encode()
+	http.Redirect(w, r, u.RequestURI(), http.StatusTemporaryRedirect)
+	return false
+}
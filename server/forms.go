@@ -0,0 +1,246 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/cwbriscoe/goutil/net"
+	"github.com/cwbriscoe/goweb/correlate"
+	"github.com/cwbriscoe/goweb/forms"
+	"github.com/goccy/go-json"
+)
+
+const (
+	formMaxBody     = 16 * 1024
+	formTokenCookie = "form_token"
+	formTokenHeader = "X-Form-Token"
+	formTokenField  = "_token"
+)
+
+// formResponse is the public part of a form, the webhook and notification settings
+// are not shown to visitors.
+type formResponse struct {
+	Name     string        `json:"name"`
+	Fields   []forms.Field `json:"fields"`
+	Honeypot string        `json:"honeypot"`
+	Token    string        `json:"token"`
+}
+
+// AddForm registers a form that is served at /forms/{name}/.  Forms can also be
+// defined in the forms section of the config.
+func (s *Server) AddForm(form forms.Form) {
+	if err := s.Forms.Register(form); err != nil {
+		panic(err)
+	}
+}
+
+// formLimit uses the forms limiter for submissions.
+func (s *Server) formLimit(f http.HandlerFunc) http.HandlerFunc {
+	return s.LimitWith(s.formLimiter)(f)
+}
+
+func (s *Server) formHandler() http.HandlerFunc {
+	return s.HandlePanic(s.Limit(s.Logger(s.form())))
+}
+
+// formCookiePath scopes the token cookie to its form, so forms open in other tabs do
+// not replace each other's token.
+func formCookiePath(name string) string {
+	return "/forms/" + url.PathEscape(name) + "/"
+}
+
+// form returns the definition of the form and a new token to submit it with.  The
+// token is also set as a cookie which the submission must send back.
+func (s *Server) form() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		form := s.Forms.Form(s.Param(r, "name"))
+		if form == nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		token, err := s.formTokens.Issue(form.Name, time.Now())
+		if err != nil {
+			correlate.Log(r.Context(), s.Log).Err(err).Msg("forms: error issuing token")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		http.SetCookie(w, &http.Cookie{
+			Name:     s.Config.Cookies.Prefix + formTokenCookie,
+			Value:    token,
+			Path:     formCookiePath(form.Name),
+			Domain:   s.Config.Cookies.Domain,
+			MaxAge:   int(s.formTokens.MaxAge.Seconds()),
+			Secure:   !s.Config.Cookies.Insecure,
+			HttpOnly: true,
+			SameSite: http.SameSiteStrictMode,
+		})
+		w.Header().Set("Cache-Control", "no-store")
+		writeJSON(w, http.StatusOK, &formResponse{
+			Name:     form.Name,
+			Fields:   form.Fields,
+			Honeypot: form.Honeypot,
+			Token:    token,
+		})
+	}
+}
+
+func (s *Server) submitFormHandler() http.HandlerFunc {
+	return s.HandlePanic(s.formLimit(s.Logger(s.submitForm())))
+}
+
+// submitForm validates and stores a submission sent as json or as a regular form post.
+// Spam is answered like a stored submission so bots can not tell it was dropped.
+func (s *Server) submitForm() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := correlate.Log(r.Context(), s.Log)
+
+		form := s.Forms.Form(s.Param(r, "name"))
+		if form == nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		values, err := readFormValues(w, r)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+
+		token := r.Header.Get(formTokenHeader)
+		if token == "" {
+			token = values[formTokenField]
+		}
+		cookie, err := r.Cookie(s.Config.Cookies.Prefix + formTokenCookie)
+		if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(token)) != 1 {
+			writeJSONError(w, http.StatusForbidden, "invalid form token")
+			return
+		}
+
+		ip := s.Anonymizer.IP(net.GetIP(r))
+		err = s.formTokens.Check(token, form.Name, time.Now())
+		if errors.Is(err, forms.ErrTooFast) {
+			log.Info().Msgf("forms: %s submitted too fast by %s", form.Name, ip)
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		if err != nil {
+			writeJSONError(w, http.StatusForbidden, "invalid form token")
+			return
+		}
+
+		data, err := form.Validate(values)
+		var invalid *forms.ValidationError
+		switch {
+		case errors.Is(err, forms.ErrSpam):
+			log.Info().Msgf("forms: %s honeypot filled by %s", form.Name, ip)
+			w.WriteHeader(http.StatusAccepted)
+			return
+		case errors.As(err, &invalid):
+			writeJSON(w, http.StatusUnprocessableEntity, invalid)
+			return
+		case err != nil:
+			writeJSONError(w, http.StatusBadRequest, "invalid form")
+			return
+		}
+
+		// tokens are single use, a replayed submission is refused.
+		if err = s.formTokens.Use(token, form.Name, time.Now()); err != nil {
+			writeJSONError(w, http.StatusForbidden, "invalid form token")
+			return
+		}
+
+		sub := &forms.Submission{Form: form.Name, Data: data, IP: ip}
+		if info := s.Tracker.ReadTrackingInfo(r); info != nil {
+			sub.TrackerID = info.ID
+		}
+		if err = s.Forms.Save(r.Context(), sub); err != nil {
+			log.Err(err).Msgf("forms: error saving %s submission", form.Name)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		s.notifyForm(correlate.Detach(r.Context()), form, sub)
+
+		// the token is used up
+		http.SetCookie(w, &http.Cookie{
+			Name:     s.Config.Cookies.Prefix + formTokenCookie,
+			Path:     formCookiePath(form.Name),
+			Domain:   s.Config.Cookies.Domain,
+			MaxAge:   -1,
+			Secure:   !s.Config.Cookies.Insecure,
+			HttpOnly: true,
+			SameSite: http.SameSiteStrictMode,
+		})
+		writeJSON(w, http.StatusCreated, map[string]int64{"id": sub.ID})
+	}
+}
+
+// readFormValues returns the submitted values of a json object or a form post.
+func readFormValues(w http.ResponseWriter, r *http.Request) (map[string]string, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, formMaxBody)
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/json" {
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		values := make(map[string]string)
+		if err = json.Unmarshal(data, &values); err != nil {
+			return nil, err
+		}
+		return values, nil
+	}
+
+	if err := r.ParseForm(); err != nil {
+		return nil, err
+	}
+	values := make(map[string]string, len(r.PostForm))
+	for name := range r.PostForm {
+		values[name] = r.PostForm.Get(name)
+	}
+	return values, nil
+}
+
+// notifyForm sends the submission to the forms webhook and the Notifier in the
+// background.
+func (s *Server) notifyForm(ctx context.Context, form *forms.Form, sub *forms.Submission) {
+	if form.Webhook == "" && (!form.Notify || s.Notifier == nil) {
+		return
+	}
+
+	go func() {
+		log := correlate.Log(ctx, s.Log)
+		if form.Webhook != "" {
+			if err := forms.PostWebhook(ctx, s.formClient, form.Webhook, sub); err != nil {
+				log.Err(err).Msgf("forms: error posting %s submission %d to webhook", form.Name, sub.ID)
+			}
+		}
+		if form.Notify && s.Notifier != nil {
+			if err := s.Notifier.Notify(ctx, form.Subject, form.Body(sub)); err != nil {
+				log.Err(err).Msgf("forms: error notifying %s submission %d", form.Name, sub.ID)
+			}
+		}
+	}()
+}
+
+// formsReport returns the newest submissions of the ?form= form, or of all forms, up
+// to ?limit= (default 100).
+func (s *Server) formsReport(r *http.Request) (any, error) {
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+	return s.Forms.Submissions(r.Context(), r.URL.Query().Get("form"), limit)
+}
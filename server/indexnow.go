@@ -0,0 +1,22 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package server
+
+import (
+	"net/http"
+)
+
+// indexNowKeyHandler hosts the IndexNow key file so search engines can verify
+// submissions made by the sitemap ping job.
+func (s *Server) indexNowKeyHandler() http.HandlerFunc {
+	return s.HandlePanic(s.Logger(func(w http.ResponseWriter, r *http.Request) {
+		key := s.Config.Sitemap.IndexNowKey
+		file := s.Param(r, "file")
+		if key == "" || file != key+".txt" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, _ = w.Write([]byte(key))
+	}))
+}
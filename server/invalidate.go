@@ -0,0 +1,282 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package server
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cwbriscoe/goweb/job"
+	"github.com/cwbriscoe/goweb/notification"
+	"github.com/cwbriscoe/goweb/setting"
+)
+
+// maxTrackedKeys is the max number of keys tracked per cache group.  Keys past the
+// limit are not invalidated with the group and just expire with their ttl, a warning is
+// logged when a group reaches the limit and when it is invalidated.
+const maxTrackedKeys = 100000
+
+// cacheKeys tracks the keys stored in each cache group so a whole group can be
+// invalidated, since the cache itself can only delete single keys.  It also remembers
+// when each entry was stored and expires, which the cache does not expose either.
+type cacheKeys struct {
+	sync.Mutex
+	groups map[string]map[string]keyState
+	full   map[string]bool // groups that reached maxTrackedKeys
+}
+
+// keyState is when the cached entry of a key was stored and expires, zero until the
+// entry was seen.
+type keyState struct {
+	stored  time.Time
+	expires time.Time
+}
+
+// add tracks the key, it returns true when the group just reached maxTrackedKeys.
+func (c *cacheKeys) add(group, key string) bool {
+	c.Lock()
+	defer c.Unlock()
+	full := c.full[group]
+	c.addLocked(group, key)
+	return !full && c.full[group]
+}
+
+func (c *cacheKeys) addLocked(group, key string) map[string]keyState {
+	if c.groups == nil {
+		c.groups = make(map[string]map[string]keyState)
+	}
+	keys, ok := c.groups[group]
+	if !ok {
+		keys = make(map[string]keyState)
+		c.groups[group] = keys
+	}
+	if _, ok = keys[key]; !ok {
+		if len(keys) < maxTrackedKeys {
+			keys[key] = keyState{}
+		} else {
+			if c.full == nil {
+				c.full = make(map[string]bool)
+			}
+			c.full[group] = true
+		}
+	}
+	return keys
+}
+
+// track adds the key to the tracked keys of the group and warns when the group is full.
+func (s *Server) track(group, key string) {
+	if s.cacheKeys.add(group, key) {
+		s.Log.Warn().Msgf("cache: group %s reached %d tracked keys, the keys past it are not invalidated with the group", group, maxTrackedKeys)
+	}
+}
+
+// seen records the expiration of the cached entry of the key.  An entry with a new
+// expiration was stored since the last time the key was seen.
+func (c *cacheKeys) seen(group, key string, expires time.Time) {
+	c.Lock()
+	defer c.Unlock()
+	keys := c.addLocked(group, key)
+	if state, ok := keys[key]; ok && !state.expires.Equal(expires) {
+		keys[key] = keyState{stored: time.Now(), expires: expires}
+	}
+}
+
+// state returns when the entry of the key was stored and expires.  tracked is false
+// for keys past maxTrackedKeys, whose entries are never known.
+func (c *cacheKeys) state(group, key string) (state keyState, tracked bool) {
+	c.Lock()
+	defer c.Unlock()
+	state, tracked = c.groups[group][key]
+	return state, tracked
+}
+
+// fresh returns true if the entry is known to be cached.
+func (k keyState) fresh() bool {
+	return time.Now().Before(k.expires)
+}
+
+// expire forgets the entry of the key after it was deleted from the cache.
+func (c *cacheKeys) expire(group, key string) {
+	c.Lock()
+	defer c.Unlock()
+	if keys, ok := c.groups[group]; ok {
+		if _, ok = keys[key]; ok {
+			keys[key] = keyState{}
+		}
+	}
+}
+
+// groupNames returns the groups with tracked keys.
+func (c *cacheKeys) groupNames() []string {
+	c.Lock()
+	defer c.Unlock()
+	groups := make([]string, 0, len(c.groups))
+	for group := range c.groups {
+		groups = append(groups, group)
+	}
+	return groups
+}
+
+// keys returns a copy of the tracked keys of the group.
+func (c *cacheKeys) keys(group string) map[string]keyState {
+	c.Lock()
+	defer c.Unlock()
+	keys := make(map[string]keyState, len(c.groups[group]))
+	for key, state := range c.groups[group] {
+		keys[key] = state
+	}
+	return keys
+}
+
+// take stops tracking the keys of the group and returns them, full is true if keys of
+// the group were not tracked.
+func (c *cacheKeys) take(group string) (keys map[string]keyState, full bool) {
+	c.Lock()
+	defer c.Unlock()
+	keys, full = c.groups[group], c.full[group]
+	delete(c.groups, group)
+	delete(c.full, group)
+	return keys, full
+}
+
+// InvalidateGroup deletes every cached entry of the group, including the responses
+// cached per user by UserCache, and returns the number of keys deleted.  With
+// cache.cluster set in the config, the other servers invalidate the group too.
+func (s *Server) InvalidateGroup(group string) int {
+	deleted := s.invalidateGroup(group)
+	s.broadcast(group, "")
+	return deleted
+}
+
+// InvalidateKey deletes the cached entry of the key in all of its encodings and returns
+// the number of entries deleted.  With cache.cluster set in the config, the other
+// servers invalidate the key too.
+func (s *Server) InvalidateKey(group, key string) int {
+	deleted := s.invalidateKey(group, key)
+	s.broadcast(group, key)
+	return deleted
+}
+
+func (s *Server) invalidateGroup(group string) int {
+	keys, full := s.cacheKeys.take(group)
+	for key := range keys {
+		s.Cache.Delete(group, key)
+	}
+	deleted := len(keys) + s.userCache.invalidateGroup(group)
+	s.Log.Info().Msgf("cache group %s invalidated, %d keys deleted", group, deleted)
+	if full {
+		s.Log.Warn().Msgf("cache group %s had more than %d keys, the others stay cached until they expire", group, maxTrackedKeys)
+	}
+	return deleted
+}
+
+func (s *Server) invalidateKey(group, key string) int {
+	deleted := 0
+	for _, k := range []string{key, key + "|br", key + "|gz"} {
+		if state, tracked := s.cacheKeys.state(group, k); tracked {
+			if !state.expires.IsZero() {
+				deleted++
+			}
+			s.cacheKeys.expire(group, k)
+		}
+		s.Cache.Delete(group, k)
+	}
+	s.Log.Info().Msgf("cache key %s %s invalidated", group, key)
+	return deleted
+}
+
+// invalidateAll deletes every cached entry of every group when invalidations may have
+// been missed, it is not broadcast.
+func (s *Server) invalidateAll(reason string) {
+	groups := s.cacheKeys.groupNames()
+	for _, group := range s.userCache.groupNames() {
+		if !slices.Contains(groups, group) {
+			groups = append(groups, group)
+		}
+	}
+	s.Log.Warn().Msgf("cache: %s, invalidating %d groups", reason, len(groups))
+	for _, group := range groups {
+		s.invalidateGroup(group)
+	}
+}
+
+// listenInvalidations kicks off a goroutine that invalidates cache groups or keys when
+// jobs send a notification on job.CacheChannel, ie: after a materialized view refresh
+// or when a pre-rendered page changed.  It also wakes up the notification streams of
+// users sent a notification.Channel signal and reloads settings changed on other
+// servers.  With cache.cluster set, it applies the invalidations broadcast by the other
+// servers.  The notifications sent while reconnecting are lost, so the whole cache is
+// invalidated and the settings are reloaded after a reconnect.
+func (s *Server) listenInvalidations() {
+	go func() {
+		for reconnect := false; ; reconnect = true {
+			err := s.waitInvalidations(s.ctx, reconnect)
+			if s.ctx.Err() != nil {
+				return
+			}
+			s.Log.Err(err).Msg("goroutine: error listening for cache invalidations")
+			time.Sleep(10 * time.Second)
+		}
+	}()
+}
+
+func (s *Server) waitInvalidations(ctx context.Context, reconnect bool) error {
+	conn, err := s.DB.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	if _, err = conn.Exec(ctx, "listen "+job.CacheChannel+";"); err != nil {
+		return err
+	}
+
+	if _, err = conn.Exec(ctx, "listen "+notification.Channel+";"); err != nil {
+		return err
+	}
+
+	if _, err = conn.Exec(ctx, "listen "+setting.Channel+";"); err != nil {
+		return err
+	}
+
+	if s.broadcaster.enabled() {
+		if _, err = conn.Exec(ctx, "listen "+InvalidateChannel+";"); err != nil {
+			return err
+		}
+	}
+	if reconnect {
+		s.invalidateAll("reconnected to the invalidation feed")
+		if err = s.Settings.Load(ctx); err != nil {
+			s.Log.Err(err).Msg("error reloading the settings after a reconnect")
+		}
+	}
+
+	for {
+		msg, err := conn.Conn().WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		switch msg.Channel {
+		case job.CacheChannel:
+			// every server gets the notification, so it is not broadcast again.
+			if group, key, ok := strings.Cut(msg.Payload, "|"); ok {
+				s.invalidateKey(group, key)
+			} else {
+				s.invalidateGroup(msg.Payload)
+			}
+		case InvalidateChannel:
+			s.applyBroadcast(msg.Payload)
+		case notification.Channel:
+			if err = s.notifyHub.publishPayload(msg.Payload); err != nil {
+				s.Log.Warn().Msg(err.Error())
+			}
+		case setting.Channel:
+			if err = s.Settings.Reload(ctx, msg.Payload); err != nil {
+				s.Log.Err(err).Msgf("error reloading setting %s", msg.Payload)
+			}
+		}
+	}
+}
@@ -0,0 +1,31 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package server
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestCacheKeysFull(t *testing.T) {
+	c := &cacheKeys{}
+	for i := 0; i < maxTrackedKeys; i++ {
+		if c.add("pages", strconv.Itoa(i)) {
+			t.Fatalf("key %d: the group is not full yet", i)
+		}
+	}
+	if !c.add("pages", "one more") {
+		t.Error("expected the first key past the limit to report the group full")
+	}
+	if c.add("pages", "another") {
+		t.Error("expected the full group to be reported once")
+	}
+
+	keys, full := c.take("pages")
+	if len(keys) != maxTrackedKeys || !full {
+		t.Errorf("expected %d keys of a full group, got %d keys, full %v", maxTrackedKeys, len(keys), full)
+	}
+	if c.add("pages", "fresh") {
+		t.Error("expected the group to be tracked again after it was taken")
+	}
+}
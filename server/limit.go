@@ -0,0 +1,37 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package server
+
+import (
+	"net/http"
+
+	"github.com/cwbriscoe/goweb/limiter"
+)
+
+// limitersEnabled returns false if features.disableLimiters is set in the config.
+func (s *Server) limitersEnabled() bool {
+	return s.Config == nil || !s.Config.Features.DisableLimiters
+}
+
+// LimitWith returns middleware rejecting the requests over the limits of l.  When
+// features.disableLimiters is set, it returns the handler unchanged so the limiters
+// cost nothing.  The flag is read when the middleware wraps the handler.
+func (s *Server) LimitWith(l *limiter.Limiter) Middleware {
+	if !s.limitersEnabled() || l == nil {
+		return func(f http.HandlerFunc) http.HandlerFunc { return f }
+	}
+	return func(f http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if err := l.LimitRequest(w, r); err != nil {
+				limiter.WriteRejection(w, r, err)
+				return
+			}
+			f(w, r)
+		}
+	}
+}
+
+// Limit limits the requests with the api limiter of the server, see LimitWith.
+func (s *Server) Limit(f http.HandlerFunc) http.HandlerFunc {
+	return s.LimitWith(s.Limiter)(f)
+}
@@ -0,0 +1,50 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cwbriscoe/goweb/config"
+	"github.com/cwbriscoe/goweb/limiter"
+)
+
+func TestLimitWith(t *testing.T) {
+	l, err := limiter.NewLimiter(&limiter.LimitSettings{
+		Name:     "test",
+		Log:      newStreamServer().Log,
+		UserRate: limiter.Rate{Interval: 200 * time.Millisecond, Burst: 1},
+		Registry: limiter.NewRegistry(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok := func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusOK) }
+
+	for _, enabled := range []bool{false, true} {
+		s := newStreamServer()
+		s.Config = &config.Config{}
+		s.Config.Features.DisableLimiters = !enabled
+		h := s.LimitWith(l)(ok)
+
+		// the limiter delays the second request of the burst.
+		start := time.Now()
+		for i := 0; i < 2; i++ {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = "192.0.2.1:1234"
+			h(w, r)
+			if w.Code != http.StatusOK {
+				t.Errorf("limiters enabled %v: got status %d", enabled, w.Code)
+			}
+		}
+
+		limited := time.Since(start) >= 150*time.Millisecond
+		if limited != enabled {
+			t.Errorf("limiters enabled %v: requests took %s", enabled, time.Since(start))
+		}
+	}
+}
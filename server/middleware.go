@@ -3,28 +3,54 @@
 package server
 
 import (
+	"context"
 	"errors"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/cwbriscoe/goutil/net"
-	"github.com/cwbriscoe/goweb/limiter"
+	"github.com/cwbriscoe/goweb/correlate"
 	"github.com/cwbriscoe/webcache"
 )
 
+// StatusClientClosed is recorded, like nginx does, for requests the client closed before
+// the response was written.  The logger records it without sending it and it is not
+// counted as a server error.
+const StatusClientClosed = 499
+
+// clientGone returns true if the client closed the request.
+func clientGone(r *http.Request) bool {
+	return errors.Is(r.Context().Err(), context.Canceled)
+}
+
 type loggingResponseWriter struct {
 	http.ResponseWriter
 	statusCode int
+	bytes      int64
 }
 
 func newLoggingResponseWriter(w http.ResponseWriter) *loggingResponseWriter {
-	return &loggingResponseWriter{w, http.StatusOK}
+	return &loggingResponseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+}
+
+func (lrw *loggingResponseWriter) Write(b []byte) (int, error) {
+	n, err := lrw.ResponseWriter.Write(b)
+	lrw.bytes += int64(n)
+	return n, err
 }
 
 func (lrw *loggingResponseWriter) WriteHeader(code int) {
 	lrw.statusCode = code
-	lrw.ResponseWriter.WriteHeader(code)
+	if code != StatusClientClosed {
+		lrw.ResponseWriter.WriteHeader(code)
+	}
+}
+
+// Unwrap lets http.ResponseController flush streamed responses through the logger.
+func (lrw *loggingResponseWriter) Unwrap() http.ResponseWriter {
+	return lrw.ResponseWriter
 }
 
 // HandlePanic will recover and log a panic.
@@ -32,7 +58,7 @@ func (s *Server) HandlePanic(f http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		defer func() {
 			if i := recover(); i != nil {
-				s.Log.Error().Msgf("panic(recovered) at %s: %v", r.URL.Path, i)
+				correlate.Log(r.Context(), s.Log).Error().Msgf("panic(recovered) at %s: %v", r.URL.Path, i)
 				w.WriteHeader(http.StatusInternalServerError)
 			}
 		}()
@@ -40,28 +66,80 @@ func (s *Server) HandlePanic(f http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
-// Logger writes request info to the configured log file.
+// Logger writes request info to the configured log file.  Requests that did not come
+// through Handler, ie: when the router is mounted on another mux, get their request id
+// here so the handler logs and the access log line can still be matched up.
 func (s *Server) Logger(f http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		if correlate.RequestID(r.Context()) == "" {
+			r = r.WithContext(correlate.FromRequest(r, s.runKey))
+			w.Header().Set(correlate.RequestIDHeader, correlate.RequestID(r.Context()))
+		}
+
 		start := time.Now()
 		lrw := newLoggingResponseWriter(w)
 		f(lrw, r)
 
+		elapsed := time.Since(start)
+		ip := net.GetIP(r)
+
+		aborted := lrw.statusCode == StatusClientClosed || clientGone(r)
+		if aborted {
+			lrw.statusCode = StatusClientClosed
+		}
+
+		host := s.Anonymizer.IP(ip)
 		name := r.Header.Get("Visitor-Name")
 		if name == "" {
-			ip := net.GetIP(r)
-			name = limiter.GetBotName(ip)
+			name = s.Limiters.BotName(ip)
 			if name == "" {
-				name = ip
+				name = host
 			}
 		}
 
-		elapsed := time.Since(start)
-		s.Log.Info().Msgf("%d %s %s %v %v", lrw.statusCode, name, r.Method, r.URL, elapsed)
+		// keep crawler stats for verified bots only
+		if s.Limiters.VisitorKind(ip) == "goodbot" {
+			s.bots.record(s.Limiters.BotName(ip), r.URL.Path, lrw.statusCode, elapsed)
+		}
+
+		s.accessLog.write(correlate.Log(r.Context(), s.Log), &accessEntry{
+			start:   start,
+			elapsed: elapsed,
+			status:  lrw.statusCode,
+			bytes:   lrw.bytes,
+			host:    host,
+			visitor: name,
+			method:  r.Method,
+			uri:     r.URL.String(),
+			proto:   r.Proto,
+			path:    r.URL.Path,
+			query:   r.URL.RawQuery,
+			ua:      r.UserAgent(),
+			referer: r.Referer(),
+			aborted: aborted,
+		})
+	}
+}
+
+// writeUncacheable writes a response the getter marked uncacheable, without the etag
+// and max age of a cached one.
+func (s *Server) writeUncacheable(w http.ResponseWriter, r *http.Request, bytes []byte) {
+	w.Header().Set("Cache-Control", "no-store")
+	if bytes == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Add("Content-Length", strconv.Itoa(len(bytes)))
+	if _, err := w.Write(bytes); err != nil && !clientGone(r) {
+		correlate.Log(r.Context(), s.Log).Err(err).Msg("error writing to http.ResponseWriter")
 	}
 }
 
 func addMaxAgeHeader(w http.ResponseWriter, expires time.Time) {
+	// the handler set its own lifetime, ie: a static file type with a max age.
+	if w.Header().Get("Cache-Control") != "" {
+		return
+	}
 	maxage := time.Until(expires)
 	// set a max maxage of 1 day if it greater.
 	if maxage > time.Hour*24 {
@@ -89,30 +167,81 @@ func addCacheMetaHeaders(w http.ResponseWriter, group, key string, info *webcach
 	w.Header().Add("Cache-Meta-Cost", strconv.FormatFloat(cost, 'f', 2, 64))
 }
 
-// Cacher stores and retrieves assets from the cache.
-func (s *Server) Cacher(w http.ResponseWriter, r *http.Request, group, key string) {
-	encoding := w.Header().Get("Content-Encoding")
+// encodedKey returns the cache key of the copy of key with the content encoding.
+func encodedKey(key, encoding string) string {
 	switch encoding {
 	case "br":
-		key += "|br"
+		return key + "|br"
 	case "gzip":
-		key += "|gz"
+		return key + "|gz"
 	}
+	return key
+}
 
+// plainKey returns the key encodedKey added the content encoding to.
+func plainKey(key string) string {
+	if base, ok := strings.CutSuffix(key, "|br"); ok {
+		return base
+	}
+	base, _ := strings.CutSuffix(key, "|gz")
+	return base
+}
+
+// Cacher stores and retrieves assets from the cache.
+func (s *Server) Cacher(w http.ResponseWriter, r *http.Request, group, key string) {
+	s.CacherWithOptions(w, r, group, key, nil)
+}
+
+// CacherWithOptions is Cacher with per route options.  Users with the bypass scope can
+// force a fresh entry with Cache-Control: no-cache or ?refresh=1.  The getter can mark
+// a response uncacheable with Uncacheable.  opts may be nil.
+func (s *Server) CacherWithOptions(w http.ResponseWriter, r *http.Request, group, key string, opts *CacheOptions) {
+	log := correlate.Log(r.Context(), s.Log)
+
+	key = encodedKey(key, w.Header().Get("Content-Encoding"))
+
+	s.track(group, key)
+	if s.forceRefresh(r, opts) {
+		// every encoding is refreshed, here and on the peers.
+		s.InvalidateKey(group, plainKey(key))
+		log.Info().Msgf("cache: refresh of %s %s forced", group, key)
+	} else if s.applyCacheHints(w, r, group, key) {
+		return
+	}
+
+	start := time.Now()
+	ctx := s.uncacheable.context(r.Context(), group, key)
 	match := r.Header.Get("If-None-Match")
-	bytes, info, err := s.Cache.Get(r.Context(), group, key, match)
+	bytes, info, err := s.getCached(ctx, group, key, match)
+	if err != nil && errors.Is(err, context.Canceled) && !clientGone(r) {
+		// the getter was shared with a request whose client went away, try again.
+		bytes, info, err = s.getCached(ctx, group, key, match)
+	}
+	if err != nil && clientGone(r) {
+		// nobody is waiting for the response, only record why it ended.
+		w.WriteHeader(StatusClientClosed)
+		return
+	}
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
-		s.Log.Err(err).Msgf("group: %s, key: %s", group, key)
+		log.Err(err).Msgf("group: %s, key: %s", group, key)
+		return
+	}
+
+	if s.uncacheable.marked(group, key, start) {
+		s.Cache.Delete(group, key)
+		s.cacheKeys.expire(group, key)
+		s.writeUncacheable(w, r, bytes)
 		return
 	}
 
 	// info should never be null since we should have added all cache groups in startup logic.
 	if info == nil {
 		w.WriteHeader(http.StatusInternalServerError)
-		s.Log.Err(errors.New("null info returned from Cache.Get()")).Msgf("group: %s, key: %s", group, key)
+		log.Err(errors.New("null info returned from Cache.Get()")).Msgf("group: %s, key: %s", group, key)
 		return
 	}
+	s.cacheKeys.seen(group, key, info.Expires)
 
 	// if no etag hit and no data is returned from the api, treat it as a 404.
 	if bytes == nil && match != info.Etag {
@@ -131,10 +260,19 @@ func (s *Server) Cacher(w http.ResponseWriter, r *http.Request, group, key strin
 		return
 	}
 
+	if clientGone(r) {
+		w.WriteHeader(StatusClientClosed)
+		return
+	}
+
 	w.Header().Add("Content-Length", strconv.Itoa(len(bytes)))
 
 	if _, err = w.Write(bytes); err != nil {
+		if clientGone(r) {
+			// the logger records the request as closed by the client.
+			return
+		}
 		w.WriteHeader(http.StatusInternalServerError)
-		s.Log.Err(err).Msg("error writing to http.ResponseWriter")
+		log.Err(err).Msg("error writing to http.ResponseWriter")
 	}
 }
@@ -0,0 +1,67 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package server
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"github.com/cwbriscoe/goweb/auth"
+	"github.com/cwbriscoe/goweb/job"
+	"github.com/cwbriscoe/goweb/migrate"
+)
+
+// migrations stores the migration sets of the app schemas.
+type migrations struct {
+	sync.RWMutex
+	sets []*migrate.Set
+}
+
+// SchemaReport is the migration state returned by the schema admin function.
+type SchemaReport struct {
+	Current bool              `json:"current"` // true when no schema has pending migrations
+	Schemas []*migrate.Status `json:"schemas"`
+}
+
+// AddMigrations registers the migrations of an app schema so its version is reported
+// along with the auth and job schemas.
+func (s *Server) AddMigrations(set *migrate.Set) {
+	s.migrations.Lock()
+	defer s.migrations.Unlock()
+	s.migrations.sets = append(s.migrations.sets, set)
+}
+
+// SchemaVersions returns the applied and pending migrations of the auth, job and app
+// schemas.
+func (s *Server) SchemaVersions(ctx context.Context) ([]*migrate.Status, error) {
+	s.migrations.RLock()
+	sets := append([]*migrate.Set{&auth.Migrations, &job.Migrations}, s.migrations.sets...)
+	s.migrations.RUnlock()
+
+	statuses := make([]*migrate.Status, 0, len(sets))
+	for _, set := range sets {
+		status, err := migrate.Check(ctx, s.DB, set)
+		if err != nil {
+			return nil, err
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// schemaReport is the admin function reporting the schema versions.
+func (s *Server) schemaReport(r *http.Request) (any, error) {
+	statuses, err := s.SchemaVersions(r.Context())
+	if err != nil {
+		return nil, err
+	}
+
+	report := &SchemaReport{Current: true, Schemas: statuses}
+	for _, status := range statuses {
+		if !status.Current() {
+			report.Current = false
+		}
+	}
+	return report, nil
+}
@@ -0,0 +1,276 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cwbriscoe/goweb/auth"
+	"github.com/cwbriscoe/goweb/correlate"
+	"github.com/cwbriscoe/goweb/notification"
+	"github.com/goccy/go-json"
+)
+
+const (
+	notificationsMaxBody = 16 * 1024
+	maxStreamsPerUser    = 5 // open notification streams per user, ie: browser tabs
+	streamPing           = 30 * time.Second
+)
+
+type notificationList struct {
+	Unread        int                          `json:"unread"`
+	Notifications []*notification.Notification `json:"notifications"`
+}
+
+type markRead struct {
+	IDs []int64 `json:"ids"` // all notifications are marked when empty
+}
+
+// notifyHub wakes up the open notification streams of a user when they get a new
+// notification.
+type notifyHub struct {
+	sync.Mutex
+	subs      map[int]map[chan struct{}]struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// closed returns a channel that is closed when the server shuts down.
+func (h *notifyHub) closed() <-chan struct{} {
+	h.Lock()
+	defer h.Unlock()
+
+	if h.done == nil {
+		h.done = make(chan struct{})
+	}
+	return h.done
+}
+
+// close ends the open streams so they do not hold up a graceful shutdown.
+func (h *notifyHub) close() {
+	h.closeOnce.Do(func() {
+		h.Lock()
+		defer h.Unlock()
+
+		if h.done == nil {
+			h.done = make(chan struct{})
+		}
+		close(h.done)
+	})
+}
+
+// subscribe returns a channel that is signalled when the user gets a notification, or
+// nil if the user already has too many streams open.
+func (h *notifyHub) subscribe(userID int) chan struct{} {
+	h.Lock()
+	defer h.Unlock()
+
+	if h.subs == nil {
+		h.subs = make(map[int]map[chan struct{}]struct{})
+	}
+	chans, ok := h.subs[userID]
+	if !ok {
+		chans = make(map[chan struct{}]struct{})
+		h.subs[userID] = chans
+	}
+	if len(chans) >= maxStreamsPerUser {
+		return nil
+	}
+
+	ch := make(chan struct{}, 1)
+	chans[ch] = struct{}{}
+	return ch
+}
+
+func (h *notifyHub) unsubscribe(userID int, ch chan struct{}) {
+	h.Lock()
+	defer h.Unlock()
+
+	delete(h.subs[userID], ch)
+	if len(h.subs[userID]) == 0 {
+		delete(h.subs, userID)
+	}
+}
+
+// publish signals the streams of the user without blocking, a stream that has not
+// handled the last signal yet will pick up the new notification with it.
+func (h *notifyHub) publish(userID int) {
+	h.Lock()
+	defer h.Unlock()
+
+	for ch := range h.subs[userID] {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// publishPayload signals the user in the payload of a notification on the channel.
+func (h *notifyHub) publishPayload(payload string) error {
+	id, err := strconv.Atoi(payload)
+	if err != nil {
+		return fmt.Errorf("invalid notification payload %q", payload)
+	}
+	h.publish(id)
+	return nil
+}
+
+func (s *Server) notificationsHandler() http.HandlerFunc {
+	return s.HandlePanic(s.Limit(s.Logger(s.notifications())))
+}
+
+// notifications returns the unread count and a page of notifications of the signed in
+// user, ?before= pages back from a notification id and ?unread=1 skips read ones.
+func (s *Server) notifications() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := auth.UserFromContext(r.Context())
+		if user == nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		params := r.URL.Query()
+		before, _ := strconv.ParseInt(params.Get("before"), 10, 64)
+		limit, err := strconv.Atoi(params.Get("limit"))
+		if err != nil || limit <= 0 || limit > 100 {
+			limit = 20
+		}
+
+		resp := &notificationList{}
+		resp.Unread, err = s.Notifications.Unread(r.Context(), user.ID)
+		if err == nil {
+			resp.Notifications, err = s.Notifications.List(r.Context(), user.ID, before, params.Get("unread") == "1", limit)
+		}
+		if err != nil {
+			correlate.Log(r.Context(), s.Log).Err(err).Msg("notifications: error listing notifications")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Cache-Control", "no-store")
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
+
+func (s *Server) markReadHandler() http.HandlerFunc {
+	return s.HandlePanic(s.Limit(s.Logger(s.markRead())))
+}
+
+// markRead marks notifications of the signed in user as read and returns the new
+// unread count.
+func (s *Server) markRead() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := correlate.Log(r.Context(), s.Log)
+
+		user := auth.UserFromContext(r.Context())
+		if user == nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		req := &markRead{}
+		data, err := io.ReadAll(io.LimitReader(r.Body, notificationsMaxBody))
+		if err != nil || (len(data) > 0 && json.Unmarshal(data, req) != nil) {
+			writeJSONError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+
+		if _, err = s.Notifications.MarkRead(r.Context(), user.ID, req.IDs); err != nil {
+			log.Err(err).Msg("notifications: error marking notifications read")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		unread, err := s.Notifications.Unread(r.Context(), user.ID)
+		if err != nil {
+			log.Err(err).Msg("notifications: error counting unread notifications")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		// other tabs of the user update their unread count as well.
+		s.notifyHub.publish(user.ID)
+		writeJSON(w, http.StatusOK, map[string]int{"unread": unread})
+	}
+}
+
+func (s *Server) notificationStreamHandler() http.HandlerFunc {
+	return s.HandlePanic(s.Limit(s.Logger(s.notificationStream())))
+}
+
+// notificationStream sends the unread count of the signed in user as server sent
+// events, once on connect and again whenever it may have changed.
+func (s *Server) notificationStream() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := correlate.Log(r.Context(), s.Log)
+
+		user := auth.UserFromContext(r.Context())
+		if user == nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		ch := s.notifyHub.subscribe(user.ID)
+		if ch == nil {
+			writeJSONError(w, http.StatusTooManyRequests, "too many notification streams")
+			return
+		}
+		defer s.notifyHub.unsubscribe(user.ID, ch)
+
+		rc := http.NewResponseController(w)
+		// the stream stays open longer than limits.writeTimeout.
+		_ = rc.SetWriteDeadline(time.Time{})
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("X-Accel-Buffering", "no")
+
+		send := func() error {
+			unread, err := s.Notifications.Unread(r.Context(), user.ID)
+			if err != nil {
+				return err
+			}
+			if _, err = fmt.Fprintf(w, "event: unread\ndata: {\"unread\":%d}\n\n", unread); err != nil {
+				return err
+			}
+			return rc.Flush()
+		}
+
+		if err := send(); err != nil {
+			log.Err(err).Msg("notifications: error starting stream")
+			return
+		}
+
+		ping := time.NewTicker(streamPing)
+		defer ping.Stop()
+		closed := s.notifyHub.closed()
+
+		for {
+			var err error
+			select {
+			case <-r.Context().Done():
+				return
+			case <-closed:
+				return
+			case <-ch:
+				err = send()
+			case <-ping.C:
+				// keeps proxies from closing the idle connection
+				if _, err = io.WriteString(w, ": ping\n\n"); err == nil {
+					err = rc.Flush()
+				}
+			}
+			if err != nil {
+				if r.Context().Err() == nil {
+					log.Err(err).Msg("notifications: error writing to stream")
+				}
+				return
+			}
+		}
+	}
+}
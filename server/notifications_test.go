@@ -0,0 +1,52 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package server
+
+import "testing"
+
+func TestNotifyHub(t *testing.T) {
+	h := &notifyHub{}
+
+	chans := make([]chan struct{}, 0, maxStreamsPerUser)
+	for i := 0; i < maxStreamsPerUser; i++ {
+		ch := h.subscribe(1)
+		if ch == nil {
+			t.Fatalf("stream %d: expected a channel", i)
+		}
+		chans = append(chans, ch)
+	}
+	if h.subscribe(1) != nil {
+		t.Error("expected nil past the stream limit")
+	}
+
+	// publishing twice must not block on a stream that has not read yet.
+	if err := h.publishPayload("1"); err != nil {
+		t.Fatal(err)
+	}
+	h.publish(1)
+	for i, ch := range chans {
+		select {
+		case <-ch:
+		default:
+			t.Errorf("stream %d: expected a signal", i)
+		}
+	}
+
+	if err := h.publishPayload("bob"); err == nil {
+		t.Error("expected an error for an invalid payload")
+	}
+
+	h.unsubscribe(1, chans[0])
+	if h.subscribe(1) == nil {
+		t.Error("expected a channel after a stream closed")
+	}
+
+	closed := h.closed()
+	h.close()
+	h.close()
+	select {
+	case <-closed:
+	default:
+		t.Error("expected the hub to be closed")
+	}
+}
@@ -0,0 +1,221 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package server
+
+import (
+	"context"
+	"net/http"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cwbriscoe/goutil/net"
+	"github.com/cwbriscoe/goweb/correlate"
+	"github.com/cwbriscoe/goweb/job"
+)
+
+// PageData loads the pages rendered by jobs into the page table, see job.Entry.SetPage,
+// when they are not found in the cache.
+type PageData struct {
+	group string
+	svr   *Server
+	mu    sync.RWMutex
+	types map[string]string    // path -> content type of the pages not typed by their extension
+	etags map[string]*pageEtag // cache key -> etag of the page and of its cached copy
+}
+
+// pageEtag maps the etag the job gave a page to the one the cache computed for its
+// cached copy, so the page etag is served and matched with If-None-Match.
+type pageEtag struct {
+	page  string // quoted etag of the page, with the encoding of the copy
+	cache string // etag of the cached copy, empty until it was served
+}
+
+// PageHandler serves the pages of the group rendered by jobs like static files: they
+// are compressed, cached for cacheDuration or the ttl of the page when shorter, and
+// dropped from the cache when a job changes them.  The content type of a page comes
+// from its extension, extension-less paths are html, unless the job set another one.
+// Leave the groups of pages with such types out of cache.snapshotGroups, the type is
+// only known once the page was loaded.
+func (s *Server) PageHandler(group string, cacheDuration time.Duration) http.HandlerFunc {
+	pages := &PageData{group: group, svr: s, types: make(map[string]string), etags: make(map[string]*pageEtag)}
+	var once sync.Once
+	return s.Logger(s.LoadShedder(s.ProfileLabel(group, func(w http.ResponseWriter, r *http.Request) {
+		once.Do(func() {
+			err := s.Cache.AddGroup(group, cacheDuration, pages)
+			if err != nil {
+				panic(err)
+			}
+		})
+
+		s.processPageRequest(w, r, pages)
+	})))
+}
+
+func (s *Server) processPageRequest(w http.ResponseWriter, r *http.Request, pages *PageData) {
+	file, ok := staticRequestPath(r)
+	if !ok {
+		correlate.Log(r.Context(), s.Log).Warn().Msgf("pages: rejected path %q", r.URL.EscapedPath())
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	t, ok := s.staticType(pageExt(file))
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", t.ContentType)
+	if t.Compress {
+		net.SetPreferredEncoding(w, r)
+	}
+
+	key := encodedKey(file, w.Header().Get("Content-Encoding"))
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		if etag, ok := pages.cacheEtag(key, match); ok {
+			r.Header.Set("If-None-Match", etag)
+		}
+	}
+
+	s.Cacher(&pageResponseWriter{ResponseWriter: w, pages: pages, file: file, key: key}, r, pages.group, file)
+}
+
+// pageExt returns the extension that types the page at file.
+func pageExt(file string) string {
+	if ext := path.Ext(file); ext != "" {
+		return ext
+	}
+	return ".html"
+}
+
+// pageResponseWriter sets the content type and etag the job gave the page, which are
+// only known once the cache loaded it.
+type pageResponseWriter struct {
+	http.ResponseWriter
+	pages *PageData
+	file  string
+	key   string // cache key of the copy served
+	typed bool
+}
+
+func (w *pageResponseWriter) setType() {
+	if w.typed {
+		return
+	}
+	w.typed = true
+	if contentType, ok := w.pages.contentType(w.file); ok {
+		w.Header().Set("Content-Type", contentType)
+	}
+	if etag, ok := w.pages.servedEtag(w.key, w.Header().Get("ETag")); ok {
+		w.Header().Set("ETag", etag)
+	}
+}
+
+func (w *pageResponseWriter) WriteHeader(code int) {
+	w.setType()
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *pageResponseWriter) Write(b []byte) (int, error) {
+	w.setType()
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *pageResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// contentType returns the content type of the page at file when it is not the one of
+// its extension.
+func (p *PageData) contentType(file string) (string, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	contentType, ok := p.types[file]
+	return contentType, ok
+}
+
+// setContentType records the content type of the page at file, typed is the content
+// type of its extension.
+func (p *PageData) setContentType(file, contentType, typed string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if contentType == typed {
+		delete(p.types, file)
+	} else {
+		p.types[file] = contentType
+	}
+}
+
+// setEtag records the etag of the page loaded for the cache key.
+func (p *PageData) setEtag(key, etag, encoding string) {
+	if encoding != "" {
+		etag += "-" + encoding
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.etags[key] = &pageEtag{page: strconv.Quote(etag)}
+}
+
+// servedEtag returns the page etag to serve for the cached copy with the cache etag.
+func (p *PageData) servedEtag(key, cache string) (string, bool) {
+	if cache == "" {
+		return "", false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	etag, ok := p.etags[key]
+	if !ok {
+		return "", false
+	}
+	etag.cache = cache
+	return etag.page, true
+}
+
+// cacheEtag returns the cache etag of the copy served with the page etag match.  A
+// changed page is loaded again and forgets the copy, so the old etag does not match.
+func (p *PageData) cacheEtag(key, match string) (string, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	etag, ok := p.etags[key]
+	if !ok || etag.cache == "" || etag.page != match {
+		return "", false
+	}
+	return etag.cache, true
+}
+
+// Get loads a page when not found in the cache
+func (p *PageData) Get(ctx context.Context, key string) ([]byte, error) {
+	keys, encoding := net.GetRequestParams(key)
+	file := keys[0]
+
+	t, ok := p.svr.staticType(pageExt(file))
+	if !ok {
+		return nil, nil
+	}
+
+	page, err := job.GetPage(ctx, p.svr.DB, p.svr.JobSchema, p.group, file)
+	if err != nil || page == nil {
+		return nil, err
+	}
+
+	p.setContentType(file, page.ContentType, t.ContentType)
+	p.setEtag(key, page.Etag, encoding)
+	if page.TTL > 0 {
+		CacheTTL(ctx, page.TTL)
+	}
+
+	src := page.Body
+	if !t.Compress {
+		return src, nil
+	}
+
+	src, err = p.svr.Transform(ctx, &TransformInfo{Group: p.group, Key: key, ContentType: page.ContentType}, src)
+	if err != nil {
+		return nil, err
+	}
+
+	return p.svr.Compressor.Compress(encoding, page.ContentType, src, true)
+}
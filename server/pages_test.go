@@ -0,0 +1,114 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package server
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCacheTTL(t *testing.T) {
+	var c cacheTTLs
+	start := time.Now()
+	expires := start.Add(time.Hour)
+
+	// getters not called by the cache handlers have no mark in their context.
+	CacheTTL(context.Background(), time.Minute)
+
+	ctx := c.context(context.Background(), "pages", "/a|br")
+	c.filled("pages", "/a|br", start, expires)
+	if _, stale := c.deadline("pages", "/a|br", expires); stale {
+		t.Error("expected no deadline without a ttl")
+	}
+
+	CacheTTL(ctx, time.Minute)
+	c.filled("pages", "/a|br", start, expires)
+	deadline, stale := c.deadline("pages", "/a|br", expires)
+	if stale || deadline.IsZero() || deadline.After(start.Add(time.Minute+time.Second)) {
+		t.Errorf("expected a deadline in a minute, got %v stale %v", deadline, stale)
+	}
+	if deadline, _ = c.deadline("pages", "/a|br", expires.Add(time.Second)); !deadline.IsZero() {
+		t.Error("expected an entry stored again to drop the deadline")
+	}
+
+	// a ttl longer than the max age of the group is ignored.
+	CacheTTL(ctx, 2*time.Hour)
+	c.filled("pages", "/a|br", start, expires)
+	if deadline, _ = c.deadline("pages", "/a|br", expires); !deadline.IsZero() {
+		t.Error("expected no deadline past the expiry")
+	}
+
+	CacheTTL(ctx, -time.Second)
+	c.filled("pages", "/a|br", start, expires)
+	if _, stale = c.deadline("pages", "/a|br", expires); !stale {
+		t.Error("expected the entry to be stale")
+	}
+}
+
+func TestPageContentType(t *testing.T) {
+	p := &PageData{types: make(map[string]string)}
+	p.setContentType("/feed", "application/rss+xml", "text/html; charset=utf-8")
+	p.setContentType("/about", "text/html; charset=utf-8", "text/html; charset=utf-8")
+	if _, ok := p.contentType("/about"); ok {
+		t.Error("expected no override for a page typed by its extension")
+	}
+
+	rec := httptest.NewRecorder()
+	rec.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w := &pageResponseWriter{ResponseWriter: rec, pages: p, file: "/feed"}
+	if _, err := w.Write([]byte("<rss/>")); err != nil {
+		t.Fatal(err)
+	}
+	if got := rec.Header().Get("Content-Type"); got != "application/rss+xml" {
+		t.Errorf("expected the page content type, got %q", got)
+	}
+
+	if ext := pageExt("/articles/golang"); ext != ".html" {
+		t.Errorf("expected extension-less pages to be html, got %q", ext)
+	}
+}
+
+func TestPageEtag(t *testing.T) {
+	p := &PageData{types: make(map[string]string), etags: make(map[string]*pageEtag)}
+	p.setEtag("/feed|br", "v1", "br")
+	if _, ok := p.cacheEtag("/feed|br", `"v1-br"`); ok {
+		t.Error("expected no match before the copy was served")
+	}
+
+	rec := httptest.NewRecorder()
+	rec.Header().Set("ETag", `"cache1"`)
+	w := &pageResponseWriter{ResponseWriter: rec, pages: p, file: "/feed", key: "/feed|br"}
+	w.WriteHeader(200)
+	if got := rec.Header().Get("ETag"); got != `"v1-br"` {
+		t.Errorf("expected the page etag, got %q", got)
+	}
+	if etag, ok := p.cacheEtag("/feed|br", `"v1-br"`); !ok || etag != `"cache1"` {
+		t.Errorf("expected the page etag to match the cached copy, got %q %t", etag, ok)
+	}
+
+	// the page changed and was loaded again.
+	p.setEtag("/feed|br", "v2", "br")
+	if _, ok := p.cacheEtag("/feed|br", `"v1-br"`); ok {
+		t.Error("expected the old page etag not to match")
+	}
+}
+
+func TestCacheTTLPrune(t *testing.T) {
+	var c cacheTTLs
+	start := time.Now()
+	ctx := c.context(context.Background(), "pages", "/a")
+	CacheTTL(ctx, time.Minute)
+	c.filled("pages", "/a", start, start.Add(time.Hour))
+	CacheTTL(c.context(context.Background(), "pages", "/b"), time.Minute)
+
+	c.prune(start.Add(30 * time.Second))
+	if len(c.marks) != 1 || len(c.deadlines) != 1 {
+		t.Fatalf("expected nothing pruned yet, got %d marks and %d deadlines", len(c.marks), len(c.deadlines))
+	}
+	c.prune(start.Add(2 * time.Minute))
+	if len(c.marks) != 0 || len(c.deadlines) != 0 {
+		t.Errorf("expected everything pruned, got %d marks and %d deadlines", len(c.marks), len(c.deadlines))
+	}
+}
@@ -0,0 +1,151 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package server
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+
+	"github.com/cwbriscoe/goweb/auth"
+	"github.com/cwbriscoe/goweb/correlate"
+)
+
+// routePermissions maps route keys ("METHOD /path") to the scope required to access them.
+// Scopes are resolved when the request is served so reloading them takes effect immediately.
+type routePermissions struct {
+	sync.RWMutex
+	defaults map[string]string // scopes hardcoded by the server and app
+	config   map[string]string // scopes from the config file
+	db       map[string]string // scopes loaded from the database
+	routes   []string          // every route registered through Server.HandlerFunc
+}
+
+// RoutePermission is the effective permission of a registered route.
+type RoutePermission struct {
+	Route  string `json:"route"`
+	Scope  string `json:"scope"`
+	Source string `json:"source"`
+}
+
+func routeKey(method, path string) string {
+	return method + " " + path
+}
+
+// scope returns the required scope for the route and where it came from.  The
+// database overrides the config which overrides the defaults.  An empty scope does not
+// override anything, a config line or a row can't make a protected route public.
+func (p *routePermissions) scope(key string) (string, string) {
+	p.RLock()
+	defer p.RUnlock()
+	if scope := p.db[key]; scope != "" {
+		return scope, "db"
+	}
+	if scope := p.config[key]; scope != "" {
+		return scope, "config"
+	}
+	if scope, ok := p.defaults[key]; ok {
+		return scope, "default"
+	}
+	return "", ""
+}
+
+// HandlerFunc registers a handler with the router.  If a scope is mapped to the route,
+// the handler is only called for users with that permission.  The middleware added
+// with Use wraps the permission check.
+func (s *Server) HandlerFunc(method, path string, f http.HandlerFunc) {
+	key := routeKey(method, path)
+
+	s.perms.Lock()
+	s.perms.routes = append(s.perms.routes, key)
+	s.perms.Unlock()
+
+	s.Router.HandlerFunc(method, path, s.middlewares.wrap(s.checkPermission(key, f)))
+}
+
+// checkPermission calls f when the user has the scope of the route.  The server routes
+// wrap their own middleware inside of the check, so it recovers its panics and logs the
+// requests it refuses itself.
+func (s *Server) checkPermission(key string, f http.HandlerFunc) http.HandlerFunc {
+	return s.HandlePanic(func(w http.ResponseWriter, r *http.Request) {
+		scope, source := s.perms.scope(key)
+		if scope == "" {
+			f(w, r)
+			return
+		}
+
+		allowed := false
+		s.auth.AuthHandler(scope, func(w http.ResponseWriter, r *http.Request) {
+			allowed = true
+			f(w, r)
+		})(w, r)
+		if !allowed {
+			correlate.Log(r.Context(), s.Log).Info().Msgf("permission: %s refused, %s scope %q required", key, source, scope)
+		}
+	})
+}
+
+// scoped calls f when the user has the scope.  It backs the route permission of the
+// endpoints that must never be opened up, since the permission can be overridden by the
+// config or the route_perm table.
+func (s *Server) scoped(scope string, f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if scope != "" && !s.hasScope(r, scope) {
+			correlate.Log(r.Context(), s.Log).Info().Msgf("permission: %s %s refused, handler scope %q required", r.Method, r.URL.Path, scope)
+			writeJSONError(w, http.StatusForbidden, "forbidden")
+			return
+		}
+		f(w, r)
+	}
+}
+
+// hasScope returns true if the user of the request has the scope.
+func (s *Server) hasScope(r *http.Request, scope string) bool {
+	if user := auth.UserFromContext(r.Context()); user != nil {
+		return slices.Contains(user.Permissions, scope)
+	}
+	return s.auth != nil && s.auth.HasScope(r, scope)
+}
+
+// RequireScope sets the default scope required to access a route.  It can be
+// overridden by the permissions section of the config or the route_perm table.
+func (s *Server) RequireScope(method, path, scope string) {
+	s.perms.Lock()
+	defer s.perms.Unlock()
+	if s.perms.defaults == nil {
+		s.perms.defaults = make(map[string]string)
+	}
+	s.perms.defaults[routeKey(method, path)] = scope
+}
+
+// LoadPermissions reloads the route permissions from the database.
+func (s *Server) LoadPermissions(ctx context.Context) error {
+	perms, err := s.auth.RoutePermissions(ctx)
+	if err != nil {
+		return err
+	}
+
+	s.perms.Lock()
+	s.perms.db = perms
+	s.perms.Unlock()
+
+	s.Log.Info().Msgf("loaded %d route permissions from the db", len(perms))
+	return nil
+}
+
+func (s *Server) listPermissions(*http.Request) (any, error) {
+	s.perms.RLock()
+	routes := append([]string(nil), s.perms.routes...)
+	s.perms.RUnlock()
+
+	sort.Strings(routes)
+	result := make([]RoutePermission, 0, len(routes))
+	for _, route := range routes {
+		scope, source := s.perms.scope(route)
+		result = append(result, RoutePermission{route, scope, source})
+	}
+
+	return result, nil
+}
@@ -0,0 +1,59 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRouteScope(t *testing.T) {
+	p := &routePermissions{
+		defaults: map[string]string{"GET /admin/": "admin", "GET /links/": "user"},
+		config:   map[string]string{"GET /admin/": "", "GET /links/": "editor"},
+		db:       map[string]string{"GET /links/": "", "GET /stats/": "ops"},
+	}
+
+	tests := []struct {
+		key, scope, source string
+	}{
+		{"GET /admin/", "admin", "default"},
+		{"GET /links/", "editor", "config"},
+		{"GET /stats/", "ops", "db"},
+		{"GET /public/", "", ""},
+	}
+	for _, tt := range tests {
+		if scope, source := p.scope(tt.key); scope != tt.scope || source != tt.source {
+			t.Errorf("%s: expected %q from %q, got %q from %q", tt.key, tt.scope, tt.source, scope, source)
+		}
+	}
+}
+
+func TestCheckPermissionPanic(t *testing.T) {
+	s := newStreamServer()
+	h := s.checkPermission("GET /public/", func(http.ResponseWriter, *http.Request) { panic("boom") })
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", "/public/", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("expected the panic to be recovered with a 500, got %d", w.Code)
+	}
+}
+
+func TestScoped(t *testing.T) {
+	s := newStreamServer()
+	ok := func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusNoContent) }
+
+	// the route permission was opened up, the handler still refuses anonymous users.
+	w := httptest.NewRecorder()
+	s.scoped("admin", ok)(w, httptest.NewRequest("POST", "/comments/1/moderate", nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected 403 without the scope, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	s.scoped("", ok)(w, httptest.NewRequest("GET", "/api/countries/", nil))
+	if w.Code != http.StatusNoContent {
+		t.Errorf("expected a public operation to pass, got %d", w.Code)
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"html"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/cwbriscoe/goweb/correlate"
+)
+
+// Fragment returns the per request text for a placeholder.  The text is html escaped
+// before it is written.
+type Fragment func(r *http.Request) string
+
+// placeholders in cached html look like <!--esi:username-->.  An unfilled placeholder
+// is just a comment so pages still render when a fragment is missing.
+var (
+	fragmentStart = []byte("<!--esi:")
+	fragmentEnd   = []byte("-->")
+)
+
+type fragments struct {
+	sync.RWMutex
+	funcs map[string]Fragment
+}
+
+// AddFragment registers the function that fills the named placeholder.  The username
+// fragment is registered by default.
+func (s *Server) AddFragment(name string, f Fragment) {
+	s.fragments.Lock()
+	defer s.fragments.Unlock()
+	if s.fragments.funcs == nil {
+		s.fragments.funcs = make(map[string]Fragment)
+	}
+	s.fragments.funcs[name] = f
+}
+
+func (s *Server) fragment(name string) Fragment {
+	s.fragments.RLock()
+	defer s.fragments.RUnlock()
+	return s.fragments.funcs[name]
+}
+
+// usernameFragment returns the name of the signed in user.
+func (s *Server) usernameFragment(r *http.Request) string {
+	if info := s.Tracker.ReadTrackingInfo(r); info != nil && info.Auth {
+		return info.Name
+	}
+	return ""
+}
+
+// fillFragments replaces the placeholders in src.  src is returned unchanged when it
+// has no placeholders.
+func (s *Server) fillFragments(r *http.Request, src []byte) []byte {
+	if !bytes.Contains(src, fragmentStart) {
+		return src
+	}
+
+	out := make([]byte, 0, len(src))
+	for {
+		start := bytes.Index(src, fragmentStart)
+		if start < 0 {
+			break
+		}
+		end := bytes.Index(src[start+len(fragmentStart):], fragmentEnd)
+		if end < 0 {
+			break
+		}
+		end += start + len(fragmentStart)
+
+		out = append(out, src[:start]...)
+		name := string(src[start+len(fragmentStart) : end])
+		if f := s.fragment(name); f != nil {
+			out = append(out, html.EscapeString(f(r))...)
+		} else {
+			// leave unknown placeholders alone.
+			out = append(out, src[start:end+len(fragmentEnd)]...)
+		}
+		src = src[end+len(fragmentEnd):]
+	}
+	return append(out, src...)
+}
+
+// PersonalCacher is like Cacher for pages with placeholders.  The page is stored in the
+// cache uncompressed and shared by all visitors, the placeholders are filled for each
+// request and the result is then compressed.  Since the response differs per visitor it
+// is marked private and its etag is a hash of the personalized body.
+func (s *Server) PersonalCacher(w http.ResponseWriter, r *http.Request, group, key string) {
+	log := correlate.Log(r.Context(), s.Log)
+
+	s.track(group, key)
+	if s.applyCacheHints(w, r, group, key) {
+		return
+	}
+
+	page, info, err := s.getCached(r.Context(), group, key, "")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Err(err).Msgf("group: %s, key: %s", group, key)
+		return
+	}
+	if info == nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Err(errors.New("null info returned from Cache.Get()")).Msgf("group: %s, key: %s", group, key)
+		return
+	}
+	s.cacheKeys.seen(group, key, info.Expires)
+	if page == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	body := s.fillFragments(r, page)
+
+	sum := sha256.Sum256(body)
+	etag := "\"" + hex.EncodeToString(sum[:8]) + "\""
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "private, no-cache")
+	w.Header().Add("Vary", "Cookie")
+	addCacheMetaHeaders(w, group, key, info)
+
+	if r.Header.Get("If-None-Match") == etag {
+		w.Header().Del("Content-Encoding")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	switch encoding := w.Header().Get("Content-Encoding"); encoding {
+	case "br", "gzip":
+		if encoding == "gzip" {
+			encoding = "gz"
+		}
+		body, err = s.Compressor.Compress(encoding, w.Header().Get("Content-Type"), body, false)
+		if err != nil {
+			w.Header().Del("Content-Encoding")
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Err(err).Msgf("error compressing personalized page group: %s, key: %s", group, key)
+			return
+		}
+	}
+
+	w.Header().Add("Content-Length", strconv.Itoa(len(body)))
+
+	if _, err = w.Write(body); err != nil {
+		log.Err(err).Msg("error writing to http.ResponseWriter")
+	}
+}
@@ -0,0 +1,28 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFillFragments(t *testing.T) {
+	s := &Server{}
+	s.AddFragment("username", func(*http.Request) string { return "<bob>" })
+	s.AddFragment("cart", func(*http.Request) string { return "3" })
+
+	r := httptest.NewRequest("GET", "/", nil)
+	tests := []struct{ in, want string }{
+		{"<p>no placeholders</p>", "<p>no placeholders</p>"},
+		{"hi <!--esi:username-->, cart: <!--esi:cart-->", "hi &lt;bob&gt;, cart: 3"},
+		{"<!--esi:unknown--> stays", "<!--esi:unknown--> stays"},
+		{"unterminated <!--esi:username", "unterminated <!--esi:username"},
+	}
+	for _, test := range tests {
+		if got := string(s.fillFragments(r, []byte(test.in))); got != test.want {
+			t.Errorf("%q: expected %q, got %q", test.in, test.want, got)
+		}
+	}
+}
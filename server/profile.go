@@ -0,0 +1,162 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime/pprof"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/cwbriscoe/goweb/correlate"
+)
+
+const maxProfileDuration = 2 * time.Minute
+
+// ProfileLabel tags all work done by the handler with a pprof "route" label so cpu
+// profiles captured through the admin api can be broken down by route.
+func (*Server) ProfileLabel(route string, f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pprof.Do(r.Context(), pprof.Labels("route", route), func(ctx context.Context) {
+			f(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// ProfileInfo describes a stored profile artifact.
+type ProfileInfo struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	Created time.Time `json:"created"`
+	URL     string    `json:"url"`
+}
+
+func (s *Server) profileDir() string {
+	return path.Join(s.Config.LogDir, "profiles")
+}
+
+// captureProfile starts a cpu profile (in the background) or writes a heap
+// snapshot and returns the name of the artifact.  It is an admin action, so only a
+// POST starts it.
+func (s *Server) captureProfile(r *http.Request) (any, error) {
+	log := correlate.Log(r.Context(), s.Log)
+
+	if err := os.MkdirAll(s.profileDir(), 0o750); err != nil {
+		return nil, err
+	}
+
+	kind := r.URL.Query().Get("type")
+	if kind == "" {
+		kind = "cpu"
+	}
+
+	switch kind {
+	case "heap":
+		f, name, err := s.createProfile(kind)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		if err = pprof.Lookup("heap").WriteTo(f, 0); err != nil {
+			return nil, err
+		}
+		log.Info().Msgf("profile: heap snapshot written to %s", name)
+		return map[string]string{"status": "done", "name": name}, nil
+	case "cpu":
+		seconds, err := strconv.Atoi(r.URL.Query().Get("seconds"))
+		if err != nil || seconds <= 0 {
+			seconds = 30
+		}
+		duration := time.Duration(seconds) * time.Second
+		if duration > maxProfileDuration {
+			duration = maxProfileDuration
+		}
+		if !s.cpuProfiling.CompareAndSwap(false, true) {
+			return nil, errors.New("a cpu profile is already being captured")
+		}
+		f, name, err := s.createProfile(kind)
+		if err != nil {
+			s.cpuProfiling.Store(false)
+			return nil, err
+		}
+		if err = pprof.StartCPUProfile(f); err != nil {
+			f.Close()
+			s.cpuProfiling.Store(false)
+			return nil, err
+		}
+		time.AfterFunc(duration, func() {
+			pprof.StopCPUProfile()
+			f.Close()
+			s.cpuProfiling.Store(false)
+			log.Info().Msgf("profile: cpu profile written to %s", name)
+		})
+		log.Info().Msgf("profile: cpu profile started for %s", duration.String())
+		return map[string]string{"status": "started", "name": name, "duration": duration.String()}, nil
+	}
+
+	return nil, errors.New("unknown profile type: " + kind)
+}
+
+// createProfile creates the file of a new profile artifact.  A random suffix keeps the
+// names of the profiles captured within the same second apart.
+func (s *Server) createProfile(kind string) (*os.File, string, error) {
+	f, err := os.CreateTemp(s.profileDir(), kind+"-"+time.Now().Format("20060102150405")+"-*.pprof")
+	if err != nil {
+		return nil, "", err
+	}
+	return f, filepath.Base(f.Name()), nil
+}
+
+// listProfiles returns the stored profile artifacts, newest first.
+func (s *Server) listProfiles(*http.Request) (any, error) {
+	entries, err := os.ReadDir(s.profileDir())
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return []ProfileInfo{}, nil
+		}
+		return nil, err
+	}
+
+	profiles := make([]ProfileInfo, 0, len(entries))
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || entry.IsDir() {
+			continue
+		}
+		profiles = append(profiles, ProfileInfo{
+			Name:    entry.Name(),
+			Size:    info.Size(),
+			Created: info.ModTime(),
+			URL:     "/debug/profiles/" + entry.Name(),
+		})
+	}
+
+	sort.Slice(profiles, func(i, j int) bool {
+		return profiles[i].Created.After(profiles[j].Created)
+	})
+
+	return profiles, nil
+}
+
+func (s *Server) profileDownloadHandler() http.HandlerFunc {
+	return s.HandlePanic(s.Logger(s.profileDownload()))
+}
+
+func (s *Server) profileDownload() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := filepath.Base(s.Param(r, "file"))
+		if path.Ext(name) != ".pprof" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Add("Content-Type", "application/octet-stream")
+		w.Header().Add("Content-Disposition", "attachment; filename=\""+name+"\"")
+		http.ServeFile(w, r, path.Join(s.profileDir(), name))
+	}
+}
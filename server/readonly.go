@@ -0,0 +1,87 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package server
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/cwbriscoe/goweb/auth"
+	"github.com/cwbriscoe/goweb/correlate"
+	"github.com/goccy/go-json"
+)
+
+// readOnlyPath serves the read-only state and is never blocked by it, so it can always
+// be turned off again.
+const readOnlyPath = "/readonly/"
+
+const readOnlyMaxBody = 1024
+
+const readOnlyMessage = "the site is in read-only mode for maintenance, please try again later"
+
+type readOnlyState struct {
+	ReadOnly bool `json:"readOnly"`
+}
+
+// ReadOnly reports whether the server is in read-only mode.  It is passed to auth so
+// refreshing a token does not write the session, and can be passed as the
+// job.ManagerOptions PauseCallback so no jobs are submitted while the database is being
+// maintained.
+func (s *Server) ReadOnly() bool {
+	return s.readOnly.Load()
+}
+
+// SetReadOnly turns read-only mode on or off.  While it is on, requests with a method
+// other than GET, HEAD or OPTIONS are answered with a 503 and cached reads keep serving.
+func (s *Server) SetReadOnly(on bool) {
+	s.readOnly.Store(on)
+}
+
+// ReadOnlyHandler rejects the requests that could write to the database while the
+// server is in read-only mode.
+func (s *Server) ReadOnlyHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.ReadOnly() || r.URL.Path == readOnlyPath {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+		default:
+			w.Header().Set("Retry-After", "60")
+			w.Header().Set("Cache-Control", "no-store")
+			writeJSONError(w, http.StatusServiceUnavailable, readOnlyMessage)
+		}
+	})
+}
+
+func (s *Server) readOnlyHandler() http.HandlerFunc {
+	return s.HandlePanic(s.Limit(s.Logger(s.readOnlyState())))
+}
+
+// readOnlyState returns the read-only state or changes it for a PUT.  It requires the
+// admin scope.  Changes only apply to the server handling the request.
+func (s *Server) readOnlyState() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			req := &readOnlyState{}
+			data, err := io.ReadAll(io.LimitReader(r.Body, readOnlyMaxBody))
+			if err != nil || json.Unmarshal(data, req) != nil {
+				writeJSONError(w, http.StatusBadRequest, "invalid request body")
+				return
+			}
+			s.SetReadOnly(req.ReadOnly)
+
+			actor := "UNKNOWN"
+			if user := auth.UserFromContext(r.Context()); user != nil {
+				actor = user.Name
+			}
+			correlate.Log(r.Context(), s.Log).Warn().Msgf("readonly: %s set read-only=%t", actor, req.ReadOnly)
+		}
+
+		w.Header().Set("Cache-Control", "no-store")
+		writeJSON(w, http.StatusOK, &readOnlyState{ReadOnly: s.ReadOnly()})
+	}
+}
@@ -0,0 +1,50 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReadOnlyHandler(t *testing.T) {
+	s := &Server{}
+	h := s.ReadOnlyHandler(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	serve := func(method, path string) int {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+		return w.Code
+	}
+
+	if code := serve("POST", "/links/"); code != http.StatusOK {
+		t.Errorf("writable: POST got %d, want 200", code)
+	}
+
+	s.SetReadOnly(true)
+	for _, tc := range []struct {
+		method, path string
+		code         int
+	}{
+		{"GET", "/links/", http.StatusOK},
+		{"HEAD", "/links/", http.StatusOK},
+		{"OPTIONS", "/links/", http.StatusOK},
+		{"POST", "/links/", http.StatusServiceUnavailable},
+		{"PUT", "/settings/key", http.StatusServiceUnavailable},
+		{"DELETE", "/links/abc", http.StatusServiceUnavailable},
+		{"POST", "/auth/signin/", http.StatusServiceUnavailable},
+		{"PUT", readOnlyPath, http.StatusOK},
+	} {
+		if code := serve(tc.method, tc.path); code != tc.code {
+			t.Errorf("read-only: %s %s got %d, want %d", tc.method, tc.path, code, tc.code)
+		}
+	}
+
+	s.SetReadOnly(false)
+	if code := serve("DELETE", "/links/abc"); code != http.StatusOK {
+		t.Errorf("writable again: DELETE got %d, want 200", code)
+	}
+}
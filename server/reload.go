@@ -0,0 +1,134 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/cwbriscoe/goweb/config"
+	"github.com/cwbriscoe/goweb/logsink"
+)
+
+// ErrRestartRequired is returned by ReloadConfig when settings that are only read at
+// startup changed, ie: the listen address or the db.
+var ErrRestartRequired = errors.New("config changes require a restart")
+
+// reloadable returns true if the setting at path can change while the server runs.
+// features.enableRegistration and features.enableRoleAdmin add routes and the router
+// is built once at startup.  features.disableLimiters is copied into the auth and
+// limiter settings at startup and waf.countryHeader into the firewall engine.
+func reloadable(path string) bool {
+	switch path {
+	case "features.readOnly", "https.approot", "https.appdirs", "https.staticroot", "https.staticdirs",
+		"waf.rules", "security.csp", "security.cspReportOnly":
+		return true
+	}
+	parts := strings.Split(path, ".")
+	return len(parts) == 3 && parts[0] == "logging" && parts[2] == "level"
+}
+
+// ReloadConfig rereads the config file and applies the settings that can change while
+// the server runs: features.readOnly, the levels of the loggers, the app and static
+// roots, the firewall rules and the content security policy.  Every change is logged.
+// If another setting changed, nothing is applied and the error wraps ErrRestartRequired
+// with the settings that need a restart.  Nothing is applied either when the new config
+// is not valid.  A started server reloads the config when the process receives SIGHUP.
+func (s *Server) ReloadConfig() error {
+	s.reloadmu.Lock()
+	defer s.reloadmu.Unlock()
+
+	// the environment chooses the file when it is not set in it.
+	cfg := &config.Config{Environment: s.Config.Environment}
+	if err := cfg.Read(s.configFile()); err != nil {
+		return err
+	}
+	cfg.LogConsole = s.Config.LogConsole
+
+	changes, err := config.Diff(s.Config, cfg)
+	if err != nil {
+		return err
+	}
+	if len(changes) == 0 {
+		s.Log.Info().Msg("config reloaded, no changes")
+		return nil
+	}
+
+	var restart []string
+	for _, c := range changes {
+		if !reloadable(c.Path) {
+			restart = append(restart, c.Path)
+		}
+	}
+	if len(restart) > 0 {
+		return fmt.Errorf("%w: %s", ErrRestartRequired, strings.Join(restart, ", "))
+	}
+	if err = cfg.Validate(); err != nil {
+		return err
+	}
+	// first, the rules are left unchanged when one of them does not compile.
+	if s.Firewall != nil {
+		if err = s.Firewall.SetRules(cfg.WAF.Rules); err != nil {
+			return err
+		}
+	}
+
+	for _, c := range changes {
+		s.Log.Info().Msgf("config reloaded: %s changed from %s to %s", c.Path, c.Old, c.New)
+	}
+	s.applyConfig(cfg)
+	return nil
+}
+
+// applyConfig applies the reloadable settings of cfg.
+func (s *Server) applyConfig(cfg *config.Config) {
+	s.SetReadOnly(cfg.Features.ReadOnly)
+	s.Config.Features.ReadOnly = cfg.Features.ReadOnly
+
+	for name, file := range s.logFiles {
+		var level string
+		if settings := cfg.Logging[name]; settings != nil {
+			level = settings.Level
+		}
+		if err := logsink.SetLevel(file, level); err != nil {
+			s.Log.Err(err).Msgf("error setting the level of the %s log", name)
+		}
+	}
+	s.Config.Logging = cfg.Logging
+
+	s.Config.HTTPS.AppRoot = cfg.HTTPS.AppRoot
+	s.Config.HTTPS.AppDirs = cfg.HTTPS.AppDirs
+	s.Config.HTTPS.StaticRoot = cfg.HTTPS.StaticRoot
+	s.Config.HTTPS.StaticDirs = cfg.HTTPS.StaticDirs
+	s.reroot(cfg)
+
+	s.Config.WAF.Rules = cfg.WAF.Rules
+
+	s.setCSP(cfg.Security.CSP, cfg.Security.CSPReportOnly)
+	s.Config.Security = cfg.Security
+}
+
+// reloadOnHangup reloads the config every time the process receives SIGHUP until ctx
+// is done.
+func (s *Server) reloadOnHangup(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(hup)
+		for {
+			select {
+			case <-hup:
+				if err := s.ReloadConfig(); err != nil {
+					s.Log.Err(err).Msg("config not reloaded")
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
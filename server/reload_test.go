@@ -0,0 +1,102 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package server
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cwbriscoe/goweb/config"
+	"github.com/cwbriscoe/goweb/waf"
+	"github.com/cwbriscoe/webcache"
+)
+
+func TestReloadConfig(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "test.json")
+	write := func(cfg string) {
+		// the settings every valid config needs.
+		base := `"rootdir":"` + dir + `","logdir":"` + dir + `","cache":{"capacity":1048576},` +
+			`"db":{"host":"localhost","port":"5432","name":"web","user":"web"},`
+		cfg = `{` + base + cfg[1:]
+		if err := os.WriteFile(file, []byte(cfg), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`{"listen":":8080","https":{"scheme":"https","domain":"example.com","port":"443","staticroot":"/static"}}`)
+
+	s := newStreamServer()
+	s.ConfigFile = file
+	s.Config = &config.Config{}
+	if err := s.Config.Read(file); err != nil {
+		t.Fatal(err)
+	}
+	s.Cache = webcache.NewWebCache(1<<20, 1)
+	s.staticHandler("sitemaps", time.Minute)
+	static := s.staticRoots.list[0]
+	var err error
+	if s.Firewall, err = waf.NewEngine(&waf.Settings{}); err != nil {
+		t.Fatal(err)
+	}
+
+	write(`{"listen":":8080","https":{"scheme":"https","domain":"example.com","port":"443","staticroot":"/static2"},"features":{"readOnly":true},` +
+		`"waf":{"rules":[{"name":"admin","path":"^/admin/","action":"deny"}]},"security":{"csp":"default-src 'self'"}}`)
+	if err = s.ReloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if !s.ReadOnly() || static.root != dir+"/static2" || s.Config.HTTPS.StaticRoot != "/static2" {
+		t.Errorf("config not applied: readOnly %v, root %s", s.ReadOnly(), static.root)
+	}
+	if rules := s.Firewall.Rules(); len(rules) != 1 || rules[0].Name != "admin" {
+		t.Errorf("waf rules not applied: %v", rules)
+	}
+	w := httptest.NewRecorder()
+	s.SecurityHeaders(func(http.ResponseWriter, *http.Request) {})(w, httptest.NewRequest("GET", "/", nil))
+	if csp := w.Header().Get("Content-Security-Policy"); csp != "default-src 'self'; report-uri /csp-report/; report-to csp-endpoint" {
+		t.Errorf("csp not applied: %q", csp)
+	}
+
+	write(`{"listen":":8080","https":{"scheme":"https","domain":"example.com","port":"443","staticroot":"/static2"},"features":{"readOnly":true},` +
+		`"waf":{"rules":[{"name":"admin","path":"(","action":"deny"}]},"security":{"csp":"default-src 'none'"}}`)
+	if err = s.ReloadConfig(); err == nil {
+		t.Error("expected a rule that does not compile to fail the reload")
+	}
+	if rules := s.Firewall.Rules(); len(rules) != 1 || rules[0].Path != "^/admin/" || s.Config.Security.CSP != "default-src 'self'" {
+		t.Error("a rejected config must not be applied")
+	}
+
+	write(`{"listen":":9090","https":{"scheme":"https","domain":"example.com","port":"443","staticroot":"/static3"}}`)
+	err = s.ReloadConfig()
+	if !errors.Is(err, ErrRestartRequired) || err.Error() != "config changes require a restart: listen" {
+		t.Errorf("expected a restart to be required, got %v", err)
+	}
+	if !s.ReadOnly() || static.root != dir+"/static2" {
+		t.Error("a rejected config must not be applied")
+	}
+}
+
+func TestReloadable(t *testing.T) {
+	tests := map[string]bool{
+		"features.readOnly":           true,
+		"logging.server.level":        true,
+		"https.staticroot":            true,
+		"waf.rules":                   true,
+		"security.csp":                true,
+		"features.enableRegistration": false,
+		"waf.countryHeader":           false,
+		"logging.server.sinks":        false,
+		"features.disableLimiters":    false,
+		"db.host":                     false,
+		"listen":                      false,
+	}
+	for path, want := range tests {
+		if got := reloadable(path); got != want {
+			t.Errorf("%s: expected %v, got %v", path, want, got)
+		}
+	}
+}
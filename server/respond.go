@@ -0,0 +1,45 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package server
+
+import (
+	"net/http"
+
+	"github.com/cwbriscoe/goweb/correlate"
+	"github.com/cwbriscoe/goweb/internal/respond"
+)
+
+// ErrorBody is the error envelope written by WriteError and the other error responses
+// of the server and auth endpoints: {"error": {"code", "message", "requestId"}}.
+type ErrorBody = respond.Error
+
+// WriteJSON writes v as the json body of the response with the status.  Bodies of 1KB
+// or more are compressed with the pooled encoders in the preferred encoding of the
+// client.  If v can't be marshaled, the error is logged and a 500 is written instead.
+func (s *Server) WriteJSON(w http.ResponseWriter, r *http.Request, status int, v any) {
+	var comp respond.Compressor
+	if s.Compressor != nil {
+		comp = s.Compressor
+	}
+	if err := respond.WriteJSON(w, r, status, v, comp); err != nil {
+		correlate.Log(r.Context(), s.Log).Err(err).Msgf("error marshaling the response of %s", r.URL.Path)
+	}
+}
+
+// WriteError writes the error envelope with the status, a machine readable code, ie:
+// invalid_note, and a message that can be shown to users.  The request id is added so
+// users can quote it.  An empty code defaults to the code of the status, ie:
+// too_many_requests.
+func (*Server) WriteError(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	respond.WriteError(w, r, status, code, message)
+}
+
+// writeJSON writes v without compression.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	_ = respond.WriteJSON(w, nil, status, v, nil)
+}
+
+// writeJSONError writes the error envelope with the code of the status.
+func writeJSONError(w http.ResponseWriter, status int, msg string) {
+	respond.WriteError(w, nil, status, "", msg)
+}
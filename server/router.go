@@ -0,0 +1,277 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package server
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Router is the interface of the http router used by the server.  Route paths use the
+// httprouter syntax: /book/:id for a named param and /app/*file for a catch-all param
+// whose value starts with a "/".
+type Router interface {
+	http.Handler
+	Handle(method, path string, handler http.Handler)
+	HandlerFunc(method, path string, handler http.HandlerFunc)
+	// Params returns the route params of a request served by the router.
+	Params(r *http.Request) Params
+	// Match returns the registered route matching the path, ie: /sitemaps/1.xml ->
+	// /sitemaps/:file, or an empty string if no route matches.
+	Match(method, path string) string
+}
+
+// Param is a single route param.
+type Param struct {
+	Key   string
+	Value string
+}
+
+// Params are the route params of a request in route order.
+type Params []Param
+
+// ByName returns the value of the first param with the given name or an empty string.
+func (ps Params) ByName(name string) string {
+	for _, p := range ps {
+		if p.Key == name {
+			return p.Value
+		}
+	}
+	return ""
+}
+
+// Param returns the value of the named route param of the request.
+func (s *Server) Param(r *http.Request, name string) string {
+	return s.Router.Params(r).ByName(name)
+}
+
+// httpRouter is the default Router implemented by julienschmidt/httprouter.  The
+// registered paths are kept for Match, httprouter does not tell which route matched.
+type httpRouter struct {
+	*httprouter.Router
+	mu     sync.RWMutex
+	routes map[string][]string // registered paths by method
+}
+
+// NewHTTPRouter returns the default Router based on julienschmidt/httprouter.
+func NewHTTPRouter() Router {
+	return &httpRouter{Router: httprouter.New(), routes: make(map[string][]string)}
+}
+
+func (h *httpRouter) Handle(method, path string, handler http.Handler) {
+	h.Router.Handler(method, path, handler)
+	h.mu.Lock()
+	h.routes[method] = append(h.routes[method], path)
+	h.mu.Unlock()
+}
+
+func (h *httpRouter) HandlerFunc(method, path string, handler http.HandlerFunc) {
+	h.Handle(method, path, handler)
+}
+
+func (h *httpRouter) Params(r *http.Request) Params {
+	hp := httprouter.ParamsFromContext(r.Context())
+	if len(hp) == 0 {
+		return nil
+	}
+	ps := make(Params, len(hp))
+	for i, p := range hp {
+		ps[i] = Param{Key: p.Key, Value: p.Value}
+	}
+	return ps
+}
+
+func (h *httpRouter) Match(method, path string) string {
+	handle, params, _ := h.Lookup(method, path)
+	if handle == nil {
+		return ""
+	}
+
+	// the matched route is the registered one giving back the path with the params.
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for _, route := range h.routes[method] {
+		if filled, ok := fillRoute(route, params); ok && filled == path {
+			return route
+		}
+	}
+	return ""
+}
+
+// fillRoute returns the route with its params replaced by the values of params in
+// order, false if the route has another number of params.
+func fillRoute(route string, params httprouter.Params) (string, bool) {
+	segs := strings.Split(route, "/")
+	i := 0
+	for j, seg := range segs {
+		if !strings.HasPrefix(seg, ":") && !strings.HasPrefix(seg, "*") {
+			continue
+		}
+		if i >= len(params) {
+			return "", false
+		}
+		if seg[0] == '*' {
+			// the catch-all is last and its value starts with a "/".
+			return strings.Join(segs[:j], "/") + params[i].Value, i == len(params)-1
+		}
+		segs[j] = params[i].Value
+		i++
+	}
+	return strings.Join(segs, "/"), i == len(params)
+}
+
+type muxParamsKey struct{}
+
+type muxRoute struct {
+	method  string
+	path    string
+	segs    []string
+	static  bool
+	handler http.Handler
+}
+
+// match returns the params of the path if it matches the route.
+func (rt *muxRoute) match(path string) (Params, bool) {
+	segs := strings.Split(path, "/")
+	var ps Params
+	for i, seg := range rt.segs {
+		switch {
+		case strings.HasPrefix(seg, "*"):
+			if i >= len(segs) {
+				return nil, false
+			}
+			return append(ps, Param{Key: seg[1:], Value: "/" + strings.Join(segs[i:], "/")}), true
+		case i >= len(segs):
+			return nil, false
+		case strings.HasPrefix(seg, ":"):
+			if segs[i] == "" {
+				return nil, false
+			}
+			ps = append(ps, Param{Key: seg[1:], Value: segs[i]})
+		case seg != segs[i]:
+			return nil, false
+		}
+	}
+	return ps, len(segs) == len(rt.segs)
+}
+
+// muxRouter adapts a http.ServeMux to the Router interface.
+type muxRouter struct {
+	sync.RWMutex
+	mux      *http.ServeMux
+	prefixes map[string][]*muxRoute
+}
+
+// NewMuxRouter returns a Router that registers its routes with mux so goweb handlers
+// can be added to an app that already uses the stdlib ServeMux.  Each route is added
+// to mux under the path up to its first param, ie: /admin/:func/ -> /admin/, and the
+// router matches the method and params itself.  The app must not register those
+// prefixes with mux itself.
+func NewMuxRouter(mux *http.ServeMux) Router {
+	if mux == nil {
+		mux = http.NewServeMux()
+	}
+	return &muxRouter{mux: mux, prefixes: make(map[string][]*muxRoute)}
+}
+
+func (m *muxRouter) Handle(method, path string, handler http.Handler) {
+	prefix := path
+	if i := strings.IndexAny(path, ":*"); i >= 0 {
+		prefix = path[:strings.LastIndex(path[:i], "/")+1]
+	}
+
+	rt := &muxRoute{
+		method:  method,
+		path:    path,
+		segs:    strings.Split(path, "/"),
+		static:  prefix == path,
+		handler: handler,
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	if _, ok := m.prefixes[prefix]; !ok {
+		m.mux.Handle(prefix, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			m.dispatch(prefix, w, r)
+		}))
+	}
+	m.prefixes[prefix] = append(m.prefixes[prefix], rt)
+}
+
+func (m *muxRouter) HandlerFunc(method, path string, handler http.HandlerFunc) {
+	m.Handle(method, path, handler)
+}
+
+// lookup finds the route for the path, static routes are preferred over routes with
+// params like httprouter does.  allowed reports if the path matched another method.
+func (m *muxRouter) lookup(routes []*muxRoute, method, path string) (rt *muxRoute, ps Params, allowed bool) {
+	for _, static := range []bool{true, false} {
+		for _, route := range routes {
+			if route.static != static {
+				continue
+			}
+			params, ok := route.match(path)
+			if !ok {
+				continue
+			}
+			if route.method != method {
+				allowed = true
+				continue
+			}
+			return route, params, false
+		}
+	}
+	return nil, nil, allowed
+}
+
+func (m *muxRouter) dispatch(prefix string, w http.ResponseWriter, r *http.Request) {
+	m.RLock()
+	routes := m.prefixes[prefix]
+	m.RUnlock()
+
+	rt, ps, allowed := m.lookup(routes, r.Method, r.URL.Path)
+	if rt == nil {
+		if allowed {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		http.NotFound(w, r)
+		return
+	}
+
+	if len(ps) > 0 {
+		r = r.WithContext(context.WithValue(r.Context(), muxParamsKey{}, ps))
+	}
+	rt.handler.ServeHTTP(w, r)
+}
+
+func (m *muxRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mux.ServeHTTP(w, r)
+}
+
+func (m *muxRouter) Params(r *http.Request) Params {
+	ps, _ := r.Context().Value(muxParamsKey{}).(Params)
+	return ps
+}
+
+func (m *muxRouter) Match(method, path string) string {
+	r, err := http.NewRequest(method, path, http.NoBody)
+	if err != nil {
+		return ""
+	}
+	// let the mux pick the prefix so the same route is found as when serving.
+	_, prefix := m.mux.Handler(r)
+
+	m.RLock()
+	routes := m.prefixes[prefix]
+	m.RUnlock()
+
+	if rt, _, _ := m.lookup(routes, method, path); rt != nil {
+		return rt.path
+	}
+	return ""
+}
@@ -0,0 +1,71 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMuxRouter(t *testing.T) {
+	r := NewMuxRouter(nil)
+
+	var got string
+	handler := func(name string) http.HandlerFunc {
+		return func(_ http.ResponseWriter, req *http.Request) {
+			got = name + " " + r.Params(req).ByName("id") + r.Params(req).ByName("file")
+		}
+	}
+	r.HandlerFunc("GET", "/book/:id", handler("book"))
+	r.HandlerFunc("GET", "/book/new", handler("new"))
+	r.HandlerFunc("GET", "/app/*file", handler("app"))
+
+	tests := []struct {
+		method, path, want string
+		code               int
+	}{
+		{"GET", "/book/42", "book 42", http.StatusOK},
+		{"GET", "/book/new", "new ", http.StatusOK},
+		{"GET", "/app/js/main.js", "app /js/main.js", http.StatusOK},
+		{"GET", "/book/42/extra", "", http.StatusNotFound},
+		{"POST", "/book/42", "", http.StatusMethodNotAllowed},
+	}
+	for _, test := range tests {
+		got = ""
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(test.method, test.path, nil))
+		if w.Code != test.code || got != test.want {
+			t.Errorf("%s %s: expected %d %q, got %d %q", test.method, test.path, test.code, test.want, w.Code, got)
+		}
+	}
+
+	if route := r.Match("GET", "/book/42"); route != "/book/:id" {
+		t.Errorf("expected /book/:id, got %q", route)
+	}
+}
+
+func TestHTTPRouterMatch(t *testing.T) {
+	r := NewHTTPRouter()
+	noop := func(http.ResponseWriter, *http.Request) {}
+	r.HandlerFunc("GET", "/user/:name/posts/:post", noop)
+	r.HandlerFunc("GET", "/sitemaps/:file", noop)
+	r.HandlerFunc("GET", "/app/*file", noop)
+	r.Handle("POST", "/book/:id", http.HandlerFunc(noop))
+
+	tests := []struct {
+		method, path, want string
+	}{
+		// the value of the first param also appears earlier in the path.
+		{"GET", "/user/posts/posts/posts", "/user/:name/posts/:post"},
+		{"GET", "/sitemaps/1.xml", "/sitemaps/:file"},
+		{"GET", "/app/js/app/main.js", "/app/*file"},
+		{"POST", "/book/42", "/book/:id"},
+		{"GET", "/book/42", ""},
+	}
+	for _, test := range tests {
+		if route := r.Match(test.method, test.path); route != test.want {
+			t.Errorf("%s %s: expected %q, got %q", test.method, test.path, test.want, route)
+		}
+	}
+}
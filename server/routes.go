@@ -7,13 +7,90 @@ import (
 )
 
 func (s *Server) initRoutes() {
+	// Default Permissions
+	s.RequireScope("GET", "/admin/:func/", "admin")
+	s.RequireScope("POST", "/admin/:func/", "admin")
+	s.RequireScope("GET", "/debug/profiles/:file", "admin")
+	s.RequireScope("GET", "/links/", "user")
+	s.RequireScope("POST", "/links/", "user")
+	s.RequireScope("DELETE", "/links/:code", "user")
+	s.RequireScope("POST", "/links/:code/moderate", "admin")
+	s.RequireScope("POST", "/links/:code/restore", "admin")
+
 	// Static Assets
-	s.Router.HandlerFunc("GET", "/app/*file", s.appRootHandler("app", 365*24*time.Hour))
-	s.Router.HandlerFunc("GET", "/favicon.svg", s.appRootHandler("favicon.svg", 365*24*time.Hour))
-	s.Router.HandlerFunc("GET", "/favicon.ico", s.appRootHandler("favicon.ico", 365*24*time.Hour))
-	s.Router.HandlerFunc("GET", "/admin/:func/", s.adminHandler())
+	s.HandlerFunc("GET", "/app/*file", s.appRootHandler("app", 365*24*time.Hour, s.Config.HTTPS.SPA))
+	s.HandlerFunc("GET", "/favicon.svg", s.appRootHandler("favicon.svg", 365*24*time.Hour, false))
+	s.HandlerFunc("GET", "/favicon.ico", s.appRootHandler("favicon.ico", 365*24*time.Hour, false))
+	s.HandlerFunc("GET", "/admin/:func/", s.adminHandler())
+	s.HandlerFunc("POST", "/admin/:func/", s.adminHandler())
+	s.HandlerFunc("GET", "/debug/profiles/:file", s.profileDownloadHandler())
+
+	// Async Cache Fills
+	s.HandlerFunc("GET", asyncPath+":id", s.asyncStatusHandler())
+
+	// Read-Only Mode
+	s.RequireScope("GET", readOnlyPath, "admin")
+	s.RequireScope("PUT", readOnlyPath, "admin")
+	s.HandlerFunc("GET", readOnlyPath, s.readOnlyHandler())
+	s.HandlerFunc("PUT", readOnlyPath, s.readOnlyHandler())
+
+	// Chaos
+	if s.Chaos != nil {
+		s.RequireScope("GET", chaosPath, "admin")
+		s.RequireScope("PUT", chaosPath, "admin")
+		s.HandlerFunc("GET", chaosPath, s.chaosHandler())
+		s.HandlerFunc("PUT", chaosPath, s.chaosHandler())
+	}
+
+	// Comments
+	if s.Comments != nil {
+		s.RequireScope("POST", "/comments/", "user")
+		s.RequireScope("POST", "/comments/:id/moderate", "admin")
+		s.HandlerFunc("GET", "/comments/", s.commentsHandler(10*time.Minute))
+		s.HandlerFunc("POST", "/comments/", s.postCommentHandler())
+		s.HandlerFunc("POST", "/comments/:id/moderate", s.moderateCommentHandler())
+	}
+
+	// Consent
+	s.HandlerFunc("GET", "/consent/", s.consentHandler())
+	s.HandlerFunc("POST", "/consent/", s.consentHandler())
+
+	// Forms
+	s.HandlerFunc("GET", "/forms/:name/", s.formHandler())
+	s.HandlerFunc("POST", "/forms/:name/", s.submitFormHandler())
+
+	// Notifications
+	s.RequireScope("GET", "/notifications/", "user")
+	s.RequireScope("POST", "/notifications/read/", "user")
+	s.RequireScope("GET", "/notifications/stream/", "user")
+	s.HandlerFunc("GET", "/notifications/", s.notificationsHandler())
+	s.HandlerFunc("POST", "/notifications/read/", s.markReadHandler())
+	s.HandlerFunc("GET", "/notifications/stream/", s.notificationStreamHandler())
+
+	// Reports
+	s.HandlerFunc("POST", cspReportPath, s.cspReportHandler())
+	s.HandlerFunc("POST", "/client-errors/", s.clientErrorHandler())
+	s.HandlerFunc("POST", "/rum/", s.rumHandler())
+
+	// Settings
+	s.RequireScope("GET", "/settings/", "admin")
+	s.RequireScope("PUT", "/settings/:key", "admin")
+	s.HandlerFunc("GET", "/settings/", s.settingsHandler())
+	s.HandlerFunc("PUT", "/settings/:key", s.updateSettingHandler())
+
+	// Search
+	s.HandlerFunc("GET", "/search/", s.searchHandler("search", time.Minute))
+
+	// Short Links
+	s.HandlerFunc("GET", "/s/:code", s.resolveLinkHandler())
+	s.HandlerFunc("GET", "/links/", s.linksHandler())
+	s.HandlerFunc("POST", "/links/", s.linksHandler())
+	s.HandlerFunc("DELETE", "/links/:code", s.deleteLinkHandler())
+	s.HandlerFunc("POST", "/links/:code/moderate", s.moderateLinkHandler())
+	s.HandlerFunc("POST", "/links/:code/restore", s.restoreLinkHandler())
 
 	// Sitemaps
-	s.Router.HandlerFunc("GET", "/sitemap.xml", s.staticHandler("sitemap_index", 6*time.Hour))
-	s.Router.HandlerFunc("GET", "/sitemaps/:file", s.staticHandler("sitemaps", 6*time.Hour))
+	s.HandlerFunc("GET", "/sitemap.xml", s.staticHandler("sitemap_index", 6*time.Hour))
+	s.HandlerFunc("GET", "/sitemaps/:file", s.staticHandler("sitemaps", 6*time.Hour))
+	s.HandlerFunc("GET", "/indexnow/:file", s.indexNowKeyHandler())
 }
@@ -0,0 +1,210 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package server
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cwbriscoe/goutil/db"
+	"github.com/cwbriscoe/goweb/query"
+	"github.com/goccy/go-json"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	rumMaxBody    = 8 * 1024 // max size of a beacon
+	rumMaxValue   = 120000   // timings above this (ms) are discarded as bogus
+	rumMaxPending = 10000    // max samples held in memory between flushes
+	rumRetention  = 30       // days of samples kept
+)
+
+// rumMetrics are the accepted beacon metrics, timings are in milliseconds.
+var rumMetrics = map[string]bool{
+	"ttfb": true, // time to first byte
+	"fcp":  true, // first contentful paint
+	"lcp":  true, // largest contentful paint
+	"dcl":  true, // dom content loaded
+	"load": true, // load event
+	"inp":  true, // interaction to next paint
+	"cls":  true, // cumulative layout shift (unitless)
+}
+
+var (
+	qInsertRUM = query.Query{
+		Name: "insertRUM",
+		SQL:  "insert into {schema}.rum (ts, route, metric, value) values ($1, $2, $3, $4);",
+	}
+	qPurgeRUM = query.Query{
+		Name: "purgeRUM",
+		SQL:  "delete from {schema}.rum where ts < now() - make_interval(days => $1);",
+	}
+	qRUMReport = query.Query{
+		Name: "rumReport",
+		SQL: `
+		select route, metric, count(*)::int8,
+			percentile_cont(0.5) within group (order by value),
+			percentile_cont(0.95) within group (order by value)
+		from {schema}.rum
+		where ts > now() - make_interval(hours => $1)
+		group by route, metric
+		order by route, metric;`,
+	}
+)
+
+type rumBeacon struct {
+	URL     string             `json:"url"`
+	Metrics map[string]float64 `json:"metrics"`
+}
+
+type rumSample struct {
+	ts     time.Time
+	route  string
+	metric string
+	value  float64
+}
+
+// rumSamples holds the beacon samples until they are flushed to the database.
+type rumSamples struct {
+	sync.Mutex
+	pending []rumSample
+}
+
+// RUMMetric is the p50 and p95 of a metric for a route.
+type RUMMetric struct {
+	Route   string  `json:"route"`
+	Metric  string  `json:"metric"`
+	Samples int64   `json:"samples"`
+	P50     float64 `json:"p50"`
+	P95     float64 `json:"p95"`
+}
+
+func (s *Server) rumHandler() http.HandlerFunc {
+	return s.HandlePanic(s.Limit(s.rum()))
+}
+
+// rum accepts navigator.sendBeacon payloads which are sent as text/plain.
+func (s *Server) rum() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		data, err := io.ReadAll(io.LimitReader(r.Body, rumMaxBody))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		beacon := &rumBeacon{}
+		if err = json.Unmarshal(data, beacon); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		route := s.routePattern(beacon.URL)
+		if route == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		now := time.Now()
+		s.rumSamples.Lock()
+		for metric, value := range beacon.Metrics {
+			if !rumMetrics[metric] || value < 0 || value > rumMaxValue {
+				continue
+			}
+			if len(s.rumSamples.pending) >= rumMaxPending {
+				break
+			}
+			s.rumSamples.pending = append(s.rumSamples.pending, rumSample{now, route, metric, value})
+		}
+		s.rumSamples.Unlock()
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// routePattern returns the registered route matching the url so samples are grouped by
+// route instead of by path, ie: /sitemaps/1.xml -> /sitemaps/:file.  Urls that do not
+// match a route return an empty string.
+func (s *Server) routePattern(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Path == "" {
+		return ""
+	}
+
+	return s.Router.Match(http.MethodGet, u.Path)
+}
+
+// flushRUM writes the pending samples to the database.
+func (s *Server) flushRUM() error {
+	s.rumSamples.Lock()
+	samples := s.rumSamples.pending
+	s.rumSamples.pending = nil
+	s.rumSamples.Unlock()
+
+	if len(samples) == 0 {
+		return nil
+	}
+
+	batch := db.NewBatch(context.TODO(), s.DB)
+	for _, sample := range samples {
+		batch.Queue(statsSchema.SQL(qInsertRUM), sample.ts, sample.route, sample.metric, sample.value)
+	}
+
+	_, err := batch.Exec()
+	return query.Wrap(qInsertRUM, err)
+}
+
+// startRUM kicks off a goroutine to flush the samples every minute and purge old
+// samples once a day.
+func (s *Server) startRUM() {
+	go func() {
+		purged := time.Now()
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if err := s.flushRUM(); err != nil {
+				s.Log.Err(err).Msg("goroutine: error flushing rum samples")
+			}
+			if time.Since(purged) > 24*time.Hour {
+				if _, err := statsSchema.Exec(context.TODO(), s.DB, qPurgeRUM, rumRetention); err != nil {
+					s.Log.Err(err).Msg("goroutine: error purging rum samples")
+				}
+				purged = time.Now()
+			}
+		}
+	}()
+}
+
+// rumReport returns the p50 and p95 of each metric per route for the last ?hours= hours
+// (default 24).
+func (s *Server) rumReport(r *http.Request) (any, error) {
+	hours, err := strconv.Atoi(r.URL.Query().Get("hours"))
+	if err != nil || hours <= 0 {
+		hours = 24
+	}
+
+	if err = s.flushRUM(); err != nil {
+		return nil, err
+	}
+
+	rows, err := statsSchema.Query(r.Context(), s.DB, qRUMReport, hours)
+	if err != nil {
+		return nil, err
+	}
+
+	metrics, err := pgx.CollectRows(rows, pgx.RowToStructByPos[RUMMetric])
+	if err != nil {
+		return nil, query.Wrap(qRUMReport, err)
+	}
+
+	return metrics, nil
+}
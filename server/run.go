@@ -0,0 +1,293 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/cwbriscoe/goweb/logsink"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// ErrNoCertificate is returned by RunTLS when neither certificate files nor autocert
+// are configured.
+var ErrNoCertificate = errors.New("tls requires certFile and keyFile or autoCert")
+
+// shutdownTimeout is how long Run and RunTLS wait for in-flight requests to finish.
+const shutdownTimeout = 30 * time.Second
+
+type lifecycle struct {
+	sync.Mutex
+	servers  []*http.Server
+	hooks    []func()
+	shutdown sync.Once
+	err      error
+}
+
+// OnShutdown registers a function that is called by Shutdown after the in-flight
+// requests are drained but before the db pool is closed.  Hooks are called in the
+// reverse order they were registered.
+func (s *Server) OnShutdown(f func()) {
+	s.life.Lock()
+	defer s.life.Unlock()
+	s.life.hooks = append(s.life.hooks, f)
+}
+
+// Start serves https when certificates are configured in the tls section of the config
+// and plain http otherwise.  It blocks until ctx is done, then shuts the server down, or
+// until the listener fails.
+func (s *Server) Start(ctx context.Context) error {
+	if s.Config.TLS.AutoCert || s.Config.TLS.CertFile != "" {
+		return s.startTLS(ctx)
+	}
+	return s.startHTTP(ctx)
+}
+
+// Run serves plain http on the listen address of the config until an interrupt or
+// terminate signal is received.
+func (s *Server) Run() error {
+	ctx, stop := signalContext()
+	defer stop()
+	return s.startHTTP(ctx)
+}
+
+// RunTLS serves https using the certificate files of the tls config or certificates
+// from let's encrypt when autoCert is set.  Plain http requests are redirected to https
+// and also answer the let's encrypt http challenges when autoCert is set.  It runs until
+// an interrupt or terminate signal is received.
+func (s *Server) RunTLS() error {
+	ctx, stop := signalContext()
+	defer stop()
+	return s.startTLS(ctx)
+}
+
+func signalContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+}
+
+func (s *Server) startHTTP(ctx context.Context) error {
+	srv := s.newHTTPServer(s.Config.Listen, s.Handler())
+	return s.serve(ctx, srv, srv.ListenAndServe)
+}
+
+func (s *Server) startTLS(ctx context.Context) error {
+	cfg := s.Config.TLS
+
+	listen := cfg.Listen
+	if listen == "" {
+		listen = ":443"
+	}
+	httpListen := cfg.HTTPListen
+	if httpListen == "" {
+		httpListen = ":80"
+	}
+
+	var redirect http.Handler = http.HandlerFunc(s.redirectHTTPS)
+	var tlsConfig *tls.Config
+
+	switch {
+	case cfg.AutoCert:
+		hosts := cfg.Hosts
+		if len(hosts) == 0 {
+			hosts = []string{s.Config.HTTPS.Domain}
+		}
+		cacheDir := cfg.CacheDir
+		if cacheDir == "" {
+			cacheDir = "./config/certs"
+		}
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(hosts...),
+			Cache:      autocert.DirCache(cacheDir),
+			Email:      cfg.Email,
+		}
+		tlsConfig = manager.TLSConfig()
+		redirect = manager.HTTPHandler(redirect)
+	case cfg.CertFile != "" && cfg.KeyFile != "":
+		tlsConfig = &tls.Config{}
+	default:
+		return ErrNoCertificate
+	}
+	tlsConfig.MinVersion = tls.VersionTLS12
+
+	srv := s.newHTTPServer(listen, s.Handler())
+	srv.TLSConfig = tlsConfig
+
+	if httpListen != "-" {
+		redirectSrv := s.newHTTPServer(httpListen, redirect)
+		s.addHTTPServer(redirectSrv)
+		go func() {
+			if err := redirectSrv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				s.Log.Err(err).Msg("error starting http redirect server")
+			}
+		}()
+	}
+
+	return s.serve(ctx, srv, func() error {
+		// the file names are ignored when autocert provides the certificates.
+		return srv.ListenAndServeTLS(cfg.CertFile, cfg.KeyFile)
+	})
+}
+
+// newHTTPServer returns a server with the timeouts and header limit of the limits section
+// of the config.
+func (s *Server) newHTTPServer(addr string, handler http.Handler) *http.Server {
+	limits := s.Config.Limits
+	seconds := func(n, def int) time.Duration {
+		if n <= 0 {
+			n = def
+		}
+		return time.Duration(n) * time.Second
+	}
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		MaxHeaderBytes:    limits.MaxHeaderBytes,
+		ReadHeaderTimeout: seconds(limits.ReadHeaderTimeout, 10),
+		ReadTimeout:       seconds(limits.ReadTimeout, 0),
+		WriteTimeout:      seconds(limits.WriteTimeout, 0),
+		IdleTimeout:       seconds(limits.IdleTimeout, 120),
+	}
+	// Shutdown does not wait on the clients of long lived notification streams.
+	srv.RegisterOnShutdown(s.notifyHub.close)
+	return srv
+}
+
+// redirectHTTPS permanently redirects a request to the same url over https.  The host
+// is only kept when it is one of the tls hosts, others are sent to https.domain so the
+// client cannot pick where it is redirected to.
+func (s *Server) redirectHTTPS(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if !s.tlsHost(host) {
+		host = s.Config.HTTPS.Domain
+	}
+	if port := s.Config.HTTPS.Port; port != "" && port != "443" {
+		host = net.JoinHostPort(host, port)
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+}
+
+// tlsHost reports whether host is https.domain or one of the autocert hosts.
+func (s *Server) tlsHost(host string) bool {
+	if strings.EqualFold(host, s.Config.HTTPS.Domain) {
+		return true
+	}
+	for _, h := range s.Config.TLS.Hosts {
+		if strings.EqualFold(host, h) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) addHTTPServer(srv *http.Server) {
+	s.life.Lock()
+	defer s.life.Unlock()
+	s.life.servers = append(s.life.servers, srv)
+}
+
+// serve runs listen until ctx is done and then shuts the server down.  The config is
+// reloaded on SIGHUP meanwhile.
+func (s *Server) serve(ctx context.Context, srv *http.Server, listen func() error) error {
+	s.addHTTPServer(srv)
+	s.reloadOnHangup(ctx)
+
+	errc := make(chan error, 1)
+	go func() {
+		s.Log.Info().Msgf("server starting on %s", srv.Addr)
+		errc <- listen()
+	}()
+
+	select {
+	case err := <-errc:
+		if errors.Is(err, http.ErrServerClosed) {
+			// Shutdown was called directly.
+			return nil
+		}
+		s.Log.Err(err).Msg("error starting server")
+		// stop the redirect server and the background work started with the server.
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		return errors.Join(err, s.Shutdown(shutdownCtx))
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	return s.Shutdown(shutdownCtx)
+}
+
+// Shutdown gracefully stops the server.  The http servers stop accepting connections
+// and wait for the in-flight requests to finish or ctx to be done, then the shutdown
+// hooks are called, the background goroutines of the server and of the auth and the
+// limiter daemon are stopped, the pending stats are written, the db pool is closed and
+// the log sinks are flushed.  Calling it more than once returns the result of the first
+// call.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.life.shutdown.Do(func() {
+		s.Log.Info().Msg("server shutting down")
+
+		s.life.Lock()
+		servers := s.life.servers
+		hooks := s.life.hooks
+		s.life.Unlock()
+
+		var errs []error
+		for _, srv := range servers {
+			if err := srv.Shutdown(ctx); err != nil {
+				errs = append(errs, err)
+			}
+		}
+
+		for i := len(hooks) - 1; i >= 0; i-- {
+			hooks[i]()
+		}
+
+		if s.cancel != nil {
+			s.cancel()
+		}
+		if s.Watchdog != nil {
+			s.Watchdog.Stop()
+		}
+		if s.Limiters != nil {
+			s.Limiters.Close()
+		}
+		if s.auth != nil {
+			s.auth.Close()
+		}
+
+		if s.DB != nil {
+			if err := s.flushBotStats(); err != nil {
+				errs = append(errs, err)
+			}
+			if err := s.flushRUM(); err != nil {
+				errs = append(errs, err)
+			}
+			s.DB.Close()
+		}
+		if err := s.accessLog.close(); err != nil {
+			errs = append(errs, err)
+		}
+		s.Log.Info().Msg("server ending")
+
+		if err := logsink.Flush(ctx); err != nil {
+			errs = append(errs, err)
+		}
+
+		s.life.err = errors.Join(errs...)
+	})
+	return s.life.err
+}
@@ -0,0 +1,71 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cwbriscoe/goweb/config"
+)
+
+func TestServeListenFailure(t *testing.T) {
+	s := newStreamServer()
+	s.Config = &config.Config{}
+
+	// the redirect server started next to the main server.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	redirect := s.newHTTPServer(ln.Addr().String(), http.NotFoundHandler())
+	s.addHTTPServer(redirect)
+	done := make(chan error, 1)
+	go func() { done <- redirect.Serve(ln) }()
+
+	// the main server can't listen on the address taken by the redirect server.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv := s.newHTTPServer(ln.Addr().String(), http.NotFoundHandler())
+	if err = s.serve(ctx, srv, srv.ListenAndServe); err == nil {
+		t.Fatal("expected the listen error")
+	}
+
+	select {
+	case err = <-done:
+		if !errors.Is(err, http.ErrServerClosed) {
+			t.Errorf("expected the redirect server to be shut down, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("redirect server still running")
+	}
+}
+
+func TestRedirectHTTPS(t *testing.T) {
+	s := newStreamServer()
+	s.Config = &config.Config{}
+	s.Config.HTTPS.Domain = "example.com"
+	s.Config.TLS.Hosts = []string{"example.com", "www.example.com"}
+
+	tests := []struct {
+		host, location string
+	}{
+		{"example.com", "https://example.com/a?b=1"},
+		{"www.example.com:80", "https://www.example.com/a?b=1"},
+		{"evil.com", "https://example.com/a?b=1"},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/a?b=1", nil)
+		r.Host = tt.host
+		s.redirectHTTPS(w, r)
+		if loc := w.Header().Get("Location"); w.Code != http.StatusMovedPermanently || loc != tt.location {
+			t.Errorf("%s: expected a 301 to %s, got %d to %s", tt.host, tt.location, w.Code, loc)
+		}
+	}
+}
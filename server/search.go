@@ -0,0 +1,88 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cwbriscoe/goutil/net"
+	"github.com/cwbriscoe/goweb/search"
+	"github.com/goccy/go-json"
+)
+
+// SearchData stores the resources used to load search results into the cache
+type SearchData struct {
+	idx  *search.Index
+	comp *Compressor
+}
+
+func (s *Server) searchHandler(group string, cacheDuration time.Duration) http.HandlerFunc {
+	return s.HandlePanic(s.searchLimit(s.Logger(s.LoadShedder(s.ProfileLabel(group, s.getSearchResults(group, cacheDuration))))))
+}
+
+// searchLimit uses the stricter search limiter since every uncached query hits the database.
+func (s *Server) searchLimit(f http.HandlerFunc) http.HandlerFunc {
+	return s.LimitWith(s.searchLimiter)(f)
+}
+
+func (s *Server) getSearchResults(group string, cacheDuration time.Duration) http.HandlerFunc {
+	var once sync.Once
+	return func(w http.ResponseWriter, r *http.Request) {
+		once.Do(func() {
+			data := &SearchData{
+				idx:  s.Search,
+				comp: s.Compressor,
+			}
+			err := s.Cache.AddGroup(group, cacheDuration, data)
+			if err != nil {
+				panic(err)
+			}
+		})
+
+		params := r.URL.Query()
+		q := strings.Join(strings.Fields(params.Get("q")), " ")
+		if q == "" {
+			s.WriteError(w, r, http.StatusBadRequest, "missing_query", "missing search query")
+			return
+		}
+		page, _ := strconv.Atoi(params.Get("page"))
+		size, _ := strconv.Atoi(params.Get("size"))
+
+		w.Header().Add("Content-Type", "application/json")
+		net.SetPreferredEncoding(w, r)
+		s.Cacher(w, r, group, url.QueryEscape(strings.ToLower(q))+"|"+strconv.Itoa(page)+"|"+strconv.Itoa(size))
+	}
+}
+
+// Get runs a search query when it is not found in the cache
+func (d *SearchData) Get(ctx context.Context, key string) ([]byte, error) {
+	keys, encoding := net.GetRequestParams(key)
+	if len(keys) != 3 {
+		return nil, nil
+	}
+
+	q, err := url.QueryUnescape(keys[0])
+	if err != nil {
+		return nil, nil
+	}
+	page, _ := strconv.Atoi(keys[1])
+	size, _ := strconv.Atoi(keys[2])
+
+	results, err := d.idx.Search(ctx, q, page, size)
+	if err != nil {
+		return nil, err
+	}
+
+	src, err := json.Marshal(results)
+	if err != nil {
+		return nil, err
+	}
+
+	return d.comp.Compress(encoding, "application/json", src, false)
+}
@@ -5,41 +5,130 @@ package server
 
 import (
 	"context"
+	"io"
+	"net/http"
 	"os"
+	"path"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/cwbriscoe/goutil/compress"
 	"github.com/cwbriscoe/goutil/logging"
 	"github.com/cwbriscoe/goweb/auth"
+	"github.com/cwbriscoe/goweb/chaos"
+	"github.com/cwbriscoe/goweb/clock"
+	"github.com/cwbriscoe/goweb/comments"
 	"github.com/cwbriscoe/goweb/config"
+	"github.com/cwbriscoe/goweb/forms"
+	"github.com/cwbriscoe/goweb/job"
 	"github.com/cwbriscoe/goweb/limiter"
+	"github.com/cwbriscoe/goweb/logsink"
+	"github.com/cwbriscoe/goweb/notification"
+	"github.com/cwbriscoe/goweb/privacy"
+	"github.com/cwbriscoe/goweb/search"
+	"github.com/cwbriscoe/goweb/setting"
+	"github.com/cwbriscoe/goweb/shortlink"
+	"github.com/cwbriscoe/goweb/tracker"
+	"github.com/cwbriscoe/goweb/waf"
+	"github.com/cwbriscoe/goweb/watchdog"
 	"github.com/cwbriscoe/webcache"
 	"github.com/jackc/pgx/v5/pgxpool"
-	"github.com/julienschmidt/httprouter"
 )
 
-// Server stores configuration for currently running server instance
+// Server stores configuration for currently running server instance.  Several servers
+// can run in one process, ie: the public site and an internal api, as long as each one
+// has its own config with its own listen address and log dir.
 type Server struct {
-	Config     *config.Config
-	Router     *httprouter.Router
-	DB         *pgxpool.Pool
-	Log        *logging.Logger
-	Cache      *webcache.WebCache
-	GzipPool   *compress.GzipPool
-	BrotliPool *compress.BrotliPool
-	Limiter    *limiter.Limiter
-	auth       *auth.Auth
+	Config       *config.Config
+	ConfigFile   string // loaded by Init, defaults to ./config/<environment>.json
+	SecretFile   string // auth secrets, defaults to DefaultSecretFile
+	JobSchema    string // schema of the job tables read by the admin functions, defaults to job.DefaultSchema
+	LinkSchema   string // schema of the shortlink tables, defaults to shortlink.DefaultSchema
+	NotifySchema string // schema of the notification tables, defaults to notification.DefaultSchema
+	Version      string // build of the app, cache snapshots saved by another build are not loaded
+	Router       Router // defaults to NewHTTPRouter when not set before Init
+	DB           *pgxpool.Pool
+	Log          *logging.Logger
+	Cache        *webcache.WebCache
+	GzipPool     *compress.GzipPool
+	BrotliPool   *compress.BrotliPool
+	Compressor   *Compressor
+	Limiter      *limiter.Limiter
+	Limiters     *limiter.Registry // shared by the limiters of the server, closed on shutdown
+	LimitPage    limiter.Page      // optional, the "slow down" page of the browsers rejected by the limiters, set before Init
+	Tracker      *tracker.Tracker  // reads and writes the tracking cookie of the server
+	Anonymizer   *privacy.Anonymizer
+	Watchdog     *watchdog.Watchdog
+	Firewall     *waf.Engine
+	Chaos        *chaos.Engine // nil unless fault injection is allowed in the config
+	Search       *search.Index
+	Shortlinks   *shortlink.Store
+	Forms        *forms.Registry
+	Comments     *comments.Store // nil unless comments are enabled in the config
+
+	// Notifications sends notifications to signed in users.
+	Notifications *notification.Store
+	// Settings are typed values admins can change at runtime.
+	Settings *setting.Store
+
+	// ErrorReporter optionally receives the errors reported by the frontend.
+	ErrorReporter ErrorReporter
+	// Notifier optionally receives the submissions of forms with notify set.
+	Notifier job.Notifier
+	// Mailer optionally sends password reset emails, reset is disabled without it.
+	Mailer auth.Mailer
+	// Clock tells the time of the tokens, limiters and tracking cookies, clock.Real when
+	// nil.  Set it before Init, ie: to run the server in simulated time.
+	Clock clock.Clock
+
+	auth          *auth.Auth
+	accessLog     accessLog
+	admin         *Admin
+	perms         routePermissions
+	bots          botStats
+	csp           cspReports
+	clientErrors  clientErrors
+	rumSamples    rumSamples
+	cacheKeys     cacheKeys
+	asyncFills    asyncFills
+	uncacheable   uncacheable
+	cacheTTLs     cacheTTLs
+	snapshot      cacheSnapshot
+	broadcaster   broadcaster
+	middlewares   middlewares
+	userCache     userCache
+	fragments     fragments
+	staticTypes   staticTypes
+	transforms    transforms
+	staticRoots   staticRoots
+	logFiles      map[string]string // log file of the loggers by name, for the log levels of a reloaded config
+	reloadmu      sync.Mutex
+	migrations    migrations
+	notifyHub     notifyHub
+	searchLimiter *limiter.Limiter
+	linkLimiter   *limiter.Limiter
+	formLimiter   *limiter.Limiter
+	formTokens    *forms.Tokens
+	formClient    *http.Client
+	readOnly      atomic.Bool
+	cspPolicy     atomic.Pointer[cspPolicy]
+	cpuProfiling  atomic.Bool // the runtime refuses a second cpu profile of another server
+	runKey        []byte      // verifies the job run ids of the requests, the runKey of the secrets file
+	life          lifecycle
+	ctx           context.Context // done when the server shuts down
+	cancel        context.CancelFunc
 }
 
 func (s *Server) readConfig() error {
 	var err error
 
 	// check for config files distribution folder
-	if err = s.Config.Load("./config/" + s.Config.Environment + ".json"); err == nil {
+	if err = s.Config.Load(s.configFile()); err == nil {
 		return nil
 	}
 
-	if !os.IsNotExist(err) {
+	if !os.IsNotExist(err) || s.ConfigFile != "" {
 		return err
 	}
 
@@ -51,25 +140,95 @@ func (s *Server) readConfig() error {
 	panic("no config file found.  created default file.")
 }
 
+// DefaultSecretFile is the path of the secrets file when Server.SecretFile is not set.
+const DefaultSecretFile = "./config/secrets.json"
+
+// configFile returns the path of the config file of the server.
+func (s *Server) configFile() string {
+	if s.ConfigFile != "" {
+		return s.ConfigFile
+	}
+	return "./config/" + s.Config.Environment + ".json"
+}
+
+func (s *Server) secretFile() string {
+	if s.SecretFile != "" {
+		return s.SecretFile
+	}
+	return DefaultSecretFile
+}
+
+// loadRunKey returns the runKey of the secrets file, nil when it has none.
+func (s *Server) loadRunKey() []byte {
+	key, err := job.SecretsFile(s.secretFile()).Secret(context.Background(), "runKey")
+	if err != nil {
+		s.Log.Debug().Msgf("no job run key, the job run ids of the requests are ignored: %s", err)
+		return nil
+	}
+	return []byte(key)
+}
+
+// passwordHasher returns the hasher for new passwords configured in the config.
+func (s *Server) passwordHasher() auth.Hasher {
+	hasher, err := PasswordHasher(s.Config)
+	if err != nil {
+		panic(err)
+	}
+	return hasher
+}
+
+// PasswordHasher returns the hasher for new passwords configured in cfg, so tools
+// working on the stored hashes agree with the server on which ones are outdated.
+func PasswordHasher(cfg *config.Config) (auth.Hasher, error) {
+	p := cfg.Passwords
+	return (&auth.HasherConfig{
+		Algorithm: p.Algorithm,
+		Cost:      p.Cost,
+		Time:      p.Time,
+		MemoryKB:  p.MemoryKB,
+		Threads:   p.Threads,
+	}).Hasher()
+}
+
 // Init loads the config and sets the server up to be started
 func (s *Server) Init() {
 	// read config file
 	if err := s.readConfig(); err != nil {
 		panic(err)
 	}
+	if err := s.Config.Validate(); err != nil {
+		panic("invalid config " + s.configFile() + ":\n" + err.Error())
+	}
 
 	// create server resources
 	s.initSvr()
 }
 
+// newTracker returns the tracker of the tracking and consent cookies of the server.
+func (s *Server) newTracker() *tracker.Tracker {
+	return tracker.New(tracker.CookieOptions{
+		Name:        s.Config.Cookies.Prefix + "id",
+		ConsentName: s.Config.Cookies.Prefix + "consent",
+		Domain:      s.Config.Cookies.Domain,
+		Path:        s.Config.Cookies.Path,
+		Insecure:    s.Config.Cookies.Insecure,
+		Clock:       s.Clock,
+	})
+}
+
 func (s *Server) initSvr() {
+	// background goroutines run until the server shuts down
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+
 	// init gzip and brotli pools
-	s.GzipPool = compress.NewGzipPool(6)
-	s.BrotliPool = compress.NewBrotliPool(6)
+	s.Compressor = NewCompressor(s.Config)
+	gzLevel, brLevel, _ := s.Compressor.levels("", 0, false)
+	s.GzipPool = s.Compressor.GzipPool(gzLevel)
+	s.BrotliPool = s.Compressor.BrotliPool(brLevel)
 
 	// init http logger
 	var err error
-	s.Log, err = logging.NewLogger(logging.Config{
+	s.Log, err = s.newLogger("server", logging.Config{
 		BaseDir:    s.Config.LogDir,
 		FileName:   "server.log",
 		MaxAge:     time.Hour * 24 * 30,
@@ -82,6 +241,16 @@ func (s *Server) initSvr() {
 		panic(err)
 	}
 
+	// start in read-only mode when the database is being maintained
+	s.SetReadOnly(s.Config.Features.ReadOnly)
+	s.setCSP(s.Config.Security.CSP, s.Config.Security.CSPReportOnly)
+
+	// init the request lines written by Logger
+	s.accessLog, err = s.newAccessLog()
+	if err != nil {
+		panic(err)
+	}
+
 	// init api login
 	connstr := "postgresql://" +
 		s.Config.DB.Host + ":" +
@@ -94,11 +263,36 @@ func (s *Server) initSvr() {
 		panic(err)
 	}
 
+	// init ip anonymizer for the logs
+	s.Anonymizer, err = privacy.NewAnonymizer(s.Config.Privacy.AnonymizeIPs)
+	if err != nil {
+		panic(err)
+	}
+
+	// init watchdog to shed load before the process runs out of resources
+	if s.Config.Watchdog.Enabled {
+		s.Watchdog = watchdog.NewWatchdog(&watchdog.Settings{
+			Interval:      time.Duration(s.Config.Watchdog.Interval) * time.Second,
+			MaxHeap:       uint64(s.Config.Watchdog.MaxHeapMB) * 1024 * 1024,
+			MaxGoroutines: s.Config.Watchdog.MaxGoroutines,
+			MaxPoolUsage:  s.Config.Watchdog.MaxPoolUsage,
+			DB:            s.DB,
+			Log:           s.Log,
+		})
+		s.Watchdog.Start()
+	}
+
 	// init cache
 	s.Cache = webcache.NewWebCache(s.Config.Cache.Capacity, s.Config.Cache.Buckets)
+	if s.Config.Cache.Cluster {
+		s.startBroadcasts()
+	}
+	if file := s.Config.Cache.Snapshot; file != "" {
+		s.initCacheSnapshot(file)
+	}
 
 	// init logger for limiters
-	limiterLogger, err := logging.NewLogger(logging.Config{
+	limiterLogger, err := s.newLogger("limiter", logging.Config{
 		BaseDir:    s.Config.LogDir,
 		FileName:   "limiter.log",
 		MaxAge:     time.Hour * 24 * 30,
@@ -111,11 +305,20 @@ func (s *Server) initSvr() {
 		panic(err)
 	}
 
+	// init the registry shared by all limiters of the server
+	s.Limiters = limiter.NewRegistry()
+
+	// init the tracking cookie with the same attributes as the auth cookies
+	s.Tracker = s.newTracker()
+
 	// init api limiter
 	s.Limiter, err = limiter.NewLimiter(
 		&limiter.LimitSettings{
-			Name: "api",
-			Log:  limiterLogger,
+			Name:       "api",
+			Log:        limiterLogger,
+			Anonymizer: s.Anonymizer,
+			Registry:   s.Limiters,
+			Tracker:    s.Tracker,
 			UserRate: limiter.Rate{
 				Interval:   time.Second / 2,
 				Burst:      3,
@@ -125,23 +328,201 @@ func (s *Server) initSvr() {
 				Interval: 50 * time.Millisecond,
 				Burst:    4,
 			},
+			Page:   s.LimitPage,
+			Clock:  s.Clock,
+			Tarpit: s.tarpit("api"),
+		})
+	if err != nil {
+		panic(err)
+	}
+
+	// init search limiter, stricter than the api limiter since most queries hit the db
+	s.searchLimiter, err = limiter.NewLimiter(
+		&limiter.LimitSettings{
+			Name:       "search",
+			Log:        limiterLogger,
+			Anonymizer: s.Anonymizer,
+			Registry:   s.Limiters,
+			Tracker:    s.Tracker,
+			UserRate: limiter.Rate{
+				Interval:   2 * time.Second,
+				Burst:      3,
+				MaxDelayed: 1,
+			},
+			GoodBotRate: limiter.Rate{
+				Interval: time.Second,
+				Burst:    2,
+			},
+			Page:   s.LimitPage,
+			Clock:  s.Clock,
+			Tarpit: s.tarpit("search"),
+		})
+	if err != nil {
+		panic(err)
+	}
+
+	// init shortlink limiter, links are resolved by anyone they were shared with
+	s.linkLimiter, err = limiter.NewLimiter(
+		&limiter.LimitSettings{
+			Name:       "shortlink",
+			Log:        limiterLogger,
+			Anonymizer: s.Anonymizer,
+			Registry:   s.Limiters,
+			Tracker:    s.Tracker,
+			UserRate: limiter.Rate{
+				Interval:   time.Second,
+				Burst:      5,
+				MaxDelayed: 2,
+			},
+			GoodBotRate: limiter.Rate{
+				Interval: time.Second,
+				Burst:    2,
+			},
+			Page:   s.LimitPage,
+			Clock:  s.Clock,
+			Tarpit: s.tarpit("shortlink"),
+		})
+	if err != nil {
+		panic(err)
+	}
+
+	// init shortlink store
+	s.Shortlinks = shortlink.NewStore(&shortlink.Settings{DB: s.DB, Schema: s.LinkSchema})
+
+	// init forms limiter, people rarely submit more than a couple of forms a minute
+	s.formLimiter, err = limiter.NewLimiter(
+		&limiter.LimitSettings{
+			Name:       "forms",
+			Log:        limiterLogger,
+			Anonymizer: s.Anonymizer,
+			Registry:   s.Limiters,
+			Tracker:    s.Tracker,
+			UserRate: limiter.Rate{
+				Interval: 20 * time.Second,
+				Burst:    3,
+			},
+			GoodBotRate: limiter.Rate{
+				Interval: time.Minute,
+				Burst:    1,
+			},
+			Page:   s.LimitPage,
+			Clock:  s.Clock,
+			Tarpit: s.tarpit("forms"),
+		})
+	if err != nil {
+		panic(err)
+	}
+
+	// init forms
+	s.Forms = forms.NewRegistry(&forms.Settings{DB: s.DB})
+	for _, form := range s.Config.Forms.Forms {
+		s.AddForm(form)
+	}
+	s.formTokens, err = forms.NewTokens(s.Config.Forms.Secret)
+	if err != nil {
+		panic(err)
+	}
+	s.formClient = &http.Client{Timeout: 10 * time.Second}
+
+	// init notifications, expired ones are deleted by the purgeNotifications job
+	s.Notifications = notification.NewStore(&notification.Settings{DB: s.DB, Schema: s.NotifySchema})
+
+	// init settings, they are reloaded when changed on any server
+	s.Settings = setting.NewStore(&setting.Settings{DB: s.DB})
+	if err = s.Settings.Load(context.Background()); err != nil {
+		s.Log.Err(err).Msg("error loading settings from the db")
+	}
+
+	// init comments
+	if s.Config.Comments.Enabled {
+		s.Comments = comments.NewStore(&comments.Settings{
+			DB:          s.DB,
+			MaxLen:      s.Config.Comments.MaxLen,
+			MaxDepth:    s.Config.Comments.MaxDepth,
+			Premoderate: s.Config.Comments.Premoderate,
+			Blocklist:   s.Config.Comments.Blocklist,
+			MaxPerHour:  s.Config.Comments.MaxPerHour,
 		})
+	}
+
+	// init search index, providers are registered by the app
+	s.Search = search.NewIndex(&search.Settings{
+		DB:  s.DB,
+		Log: s.Log,
+	})
+	s.Search.Start(s.ctx, 5*time.Minute)
+
+	// init firewall rules
+	s.Firewall, err = waf.NewEngine(&waf.Settings{
+		CountryHeader: s.Config.WAF.CountryHeader,
+		Limiters:      s.Limiters,
+		Rules:         s.Config.WAF.Rules,
+		SignedIn: func(r *http.Request) bool {
+			return s.auth != nil && s.auth.SignedIn(r)
+		},
+	})
 	if err != nil {
 		panic(err)
 	}
 
+	// init fault injection, only allowed in staging
+	if s.Config.Chaos.Allow {
+		s.Chaos, err = chaos.NewEngine(&chaos.Settings{
+			Enabled: s.Config.Chaos.Enabled,
+			Rules:   s.Config.Chaos.Rules,
+		})
+		if err != nil {
+			panic(err)
+		}
+	}
+
 	// init router
-	s.Router = httprouter.New()
+	if s.Router == nil {
+		s.Router = NewHTTPRouter()
+	}
 
-	var secretPath string
-	if s.Config.Environment == "dev" {
-		secretPath = "/home/chris/env/webroot/config/secrets.json"
-	} else {
-		secretPath = "./config/secrets.json"
+	// init admin functions
+	s.admin = &Admin{}
+	s.admin.SetResources(s.DB, s.Cache)
+	s.AddAdminFunc("bots", s.botReport)
+	s.AddAdminAction("bots", s.flushBotReport)
+	s.AddAdminFunc("cache", s.admin.GetCache)
+	s.AddAdminFunc("clienterrors", s.clientErrors.list)
+	if s.Comments != nil {
+		s.AddAdminFunc("comments", s.commentQueue)
 	}
+	s.AddAdminFunc("compression", func(*http.Request) (any, error) {
+		return s.Compressor.Stats(), nil
+	})
+	s.AddAdminFunc("csp", s.csp.list)
+	s.AddAdminAction("csp", s.csp.clear)
+	s.AddAdminFunc("etags", func(r *http.Request) (any, error) {
+		return job.TopEtags(r.Context(), s.DB, s.JobSchema, 100)
+	})
+	s.AddAdminFunc("firewall", func(*http.Request) (any, error) {
+		return s.Firewall.Rules(), nil
+	})
+	s.AddAdminFunc("forms", s.formsReport)
+	s.AddAdminFunc("jobhistory", s.jobHistory)
+	s.AddAdminFunc("logsinks", func(*http.Request) (any, error) {
+		return logsink.GetStats(), nil
+	})
+	s.AddAdminFunc("permissions", s.listPermissions)
+	s.AddAdminAction("profile", s.captureProfile)
+	s.AddAdminFunc("profiles", s.listProfiles)
+	s.AddAdminFunc("rum", s.rumReport)
+	s.AddAdminFunc("schedule", s.jobSchedule)
+	s.AddAdminFunc("schema", s.schemaReport)
+	s.AddAdminFunc("shortlinks", s.shortlinkReport)
+	s.AddAdminFunc("watchdog", func(*http.Request) (any, error) {
+		if s.Watchdog == nil {
+			return nil, nil
+		}
+		return s.Watchdog.Status(), nil
+	})
 
 	// init logger for access
-	accessLogger, err := logging.NewLogger(logging.Config{
+	accessLogger, err := s.newLogger("access", logging.Config{
 		BaseDir:    s.Config.LogDir,
 		FileName:   "access.log",
 		MaxAge:     time.Hour * 24 * 30,
@@ -154,20 +535,84 @@ func (s *Server) initSvr() {
 		panic(err)
 	}
 
+	// only the requests of the job runs signed with the run key carry their run id.
+	s.runKey = s.loadRunKey()
+
 	// init the auth handlers
+	if !s.limitersEnabled() {
+		s.Log.Warn().Msg("features.disableLimiters is set, the server and auth routes are not rate limited")
+	}
 	s.auth = auth.NewAuth(&auth.Config{
 		Issuer:             s.Config.HTTPS.Domain,
-		SecretPath:         secretPath,
+		SecretPath:         s.secretFile(),
 		Router:             s.Router,
 		AccessExpire:       5 * time.Minute,
 		RefreshExpire:      30 * 24 * time.Hour,
+		SlidingExpire:      true,
+		MaxLifetime:        90 * 24 * time.Hour,
 		UserRate:           10 * time.Second,
 		GlobalRate:         50 * time.Millisecond,
+		Tarpit:             s.tarpit("auth"),
+		LimitPage:          s.LimitPage,
+		DisableLimiter:     !s.limitersEnabled(),
 		LimiterLogger:      limiterLogger,
+		Limiters:           s.Limiters,
+		Tracker:            s.Tracker,
+		Anonymizer:         s.Anonymizer,
+		TrackerData:        s.Shortlinks,
 		DB:                 s.DB,
 		Log:                accessLogger,
 		EnableRegistration: s.Config.Features.EnableRegistration,
+		AdminRoutes:        s.Config.Features.EnableRoleAdmin,
+		CookiePrefix:       s.Config.Cookies.Prefix,
+		CookieDomain:       s.Config.Cookies.Domain,
+		CookiePath:         s.Config.Cookies.Path,
+		InsecureCookies:    s.Config.Cookies.Insecure,
+		OpaqueTokens:       s.Config.Cookies.Opaque,
+		Mailer:             s.Mailer,
+		ResetURL:           s.Config.URLPrefix + "/reset/",
+		Hasher:             s.passwordHasher(),
+		Clock:              s.Clock,
+		ReadOnly:           s.ReadOnly,
 	})
 
+	// load route permissions
+	s.perms.config = s.Config.Permissions
+	if err = s.LoadPermissions(context.Background()); err != nil {
+		s.Log.Err(err).Msg("error loading route permissions from the db")
+	}
+
+	s.AddFragment("username", s.usernameFragment)
+
+	s.startBotStats()
+	s.startRUM()
+	s.startCacheTTLs()
+	s.listenInvalidations()
 	s.initRoutes()
 }
+
+// tarpit returns the configured bad bot handling for the named limiter.
+func (s *Server) tarpit(name string) limiter.Tarpit {
+	cfg := s.Config.Tarpits[name]
+	return limiter.Tarpit{
+		Mode:         limiter.TarpitMode(cfg.Mode),
+		Interval:     time.Duration(cfg.Interval) * time.Millisecond,
+		Drips:        cfg.Drips,
+		MaxOpen:      cfg.MaxOpen,
+		FlagFakeBots: cfg.FlagFakeBots,
+	}
+}
+
+// newLogger creates a logger with the overrides and sinks configured for the named logger.
+func (s *Server) newLogger(name string, cfg logging.Config) (*logging.Logger, error) {
+	if s.logFiles == nil {
+		s.logFiles = make(map[string]string)
+	}
+	s.logFiles[name] = path.Join(cfg.BaseDir, cfg.FileName)
+	return logsink.NewLogger(cfg, s.Config.Logging[name])
+}
+
+// newWriter creates a rolling file writer with the overrides configured for the named log.
+func (s *Server) newWriter(name string, cfg logging.Config) (io.WriteCloser, error) {
+	return logsink.NewWriter(cfg, s.Config.Logging[name])
+}
@@ -0,0 +1,83 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package server
+
+import (
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/cwbriscoe/goweb/auth"
+	"github.com/cwbriscoe/goweb/correlate"
+	"github.com/cwbriscoe/goweb/internal/respond"
+	"github.com/cwbriscoe/goweb/query"
+	"github.com/cwbriscoe/goweb/setting"
+	"github.com/goccy/go-json"
+)
+
+const settingsMaxBody = 16 * 1024
+
+type updateSetting struct {
+	Value   string `json:"value"`
+	Version int    `json:"version"` // version the change is based on
+}
+
+func (s *Server) settingsHandler() http.HandlerFunc {
+	return s.HandlePanic(s.Logger(s.listSettings()))
+}
+
+// listSettings returns every setting, it requires the admin scope.
+func (s *Server) listSettings() http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		writeJSON(w, http.StatusOK, s.Settings.All())
+	}
+}
+
+func (s *Server) updateSettingHandler() http.HandlerFunc {
+	return s.HandlePanic(s.Logger(s.updateSetting()))
+}
+
+// updateSetting changes the value of a setting on every server, it requires the admin
+// scope.
+func (s *Server) updateSetting() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := correlate.Log(r.Context(), s.Log)
+
+		req := &updateSetting{}
+		data, err := io.ReadAll(io.LimitReader(r.Body, settingsMaxBody))
+		if err != nil || json.Unmarshal(data, req) != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+
+		actor := "UNKNOWN"
+		if user := auth.UserFromContext(r.Context()); user != nil {
+			actor = user.Name
+		}
+
+		key := s.Param(r, "key")
+		updated, err := s.Settings.Set(r.Context(), key, req.Value, req.Version, actor)
+		switch {
+		case errors.Is(err, setting.ErrNotFound):
+			http.NotFound(w, r)
+			return
+		case errors.Is(err, setting.ErrInvalidValue):
+			respond.WriteErrorBody(w, r, http.StatusUnprocessableEntity, &respond.Error{Code: "invalid_field", Message: err.Error(), Field: "value"})
+			return
+		case errors.Is(err, query.ErrNoVersion):
+			writeJSONError(w, http.StatusBadRequest, "the version of the setting is required")
+			return
+		case errors.Is(err, query.ErrConflict):
+			writeJSONError(w, http.StatusConflict, "setting was changed by someone else, reload and try again")
+			return
+		case err != nil:
+			log.Err(err).Msg("settings: error updating setting")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		log.Info().Msgf("settings: %s set %s to %q", actor, key, req.Value)
+		writeJSON(w, http.StatusOK, updated)
+	}
+}
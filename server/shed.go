@@ -0,0 +1,23 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package server
+
+import (
+	"net/http"
+)
+
+// LoadShedder returns 503 to anonymous visitors while the watchdog reports the server
+// is overloaded.  Signed in users, those with a valid access or refresh token, are still
+// served.
+func (s *Server) LoadShedder(f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.Watchdog.Overloaded() {
+			if s.auth == nil || !s.auth.SignedIn(r) {
+				w.Header().Set("Retry-After", "30")
+				http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+				return
+			}
+		}
+		f(w, r)
+	}
+}
@@ -0,0 +1,239 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package server
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/cwbriscoe/goweb/auth"
+	"github.com/cwbriscoe/goweb/correlate"
+	"github.com/cwbriscoe/goweb/shortlink"
+	"github.com/cwbriscoe/goweb/tracker"
+	"github.com/goccy/go-json"
+)
+
+const (
+	shortlinkMaxBody = 4 * 1024
+	shortlinkMaxTTL  = 5 * 365 * 24 * time.Hour
+)
+
+type createLink struct {
+	URL string `json:"url"`
+	TTL int64  `json:"ttl"` // seconds until the link expires, zero never expires
+}
+
+type moderateLink struct {
+	Disabled bool   `json:"disabled"`
+	Reason   string `json:"reason"`
+}
+
+// linkLimit uses the shortlink limiter for link resolution.
+func (s *Server) linkLimit(f http.HandlerFunc) http.HandlerFunc {
+	return s.LimitWith(s.linkLimiter)(f)
+}
+
+func (s *Server) resolveLinkHandler() http.HandlerFunc {
+	return s.HandlePanic(s.linkLimit(s.Logger(s.Consent(s.resolveLink()))))
+}
+
+// resolveLink redirects to the url of the code.  Redirects are not cached by the
+// browser so every click is counted.
+func (s *Server) resolveLink() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		code := s.Param(r, "code")
+
+		target, err := s.Shortlinks.Resolve(r.Context(), code)
+		switch {
+		case errors.Is(err, shortlink.ErrNotFound):
+			http.NotFound(w, r)
+			return
+		case errors.Is(err, shortlink.ErrExpired), errors.Is(err, shortlink.ErrDisabled):
+			http.Error(w, http.StatusText(http.StatusGone), http.StatusGone)
+			return
+		case err != nil:
+			correlate.Log(r.Context(), s.Log).Err(err).Msgf("shortlink: error resolving %s", code)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		click := &shortlink.Click{Code: code, Time: time.Now()}
+		// only tie the click to the visitor when they allowed analytics.
+		if tracker.ConsentFromContext(r.Context()).Analytics {
+			if info := s.Tracker.GetTrackingInfo(w, r); info != nil {
+				click.TrackerID = info.ID
+			}
+		}
+		// keep the referring host only, the full referer can contain personal data.
+		if ref, err := url.Parse(r.Referer()); err == nil {
+			click.Referer = ref.Host
+		}
+
+		ctx := correlate.Detach(r.Context())
+		go func() {
+			if err := s.Shortlinks.RecordClick(ctx, click); err != nil {
+				correlate.Log(ctx, s.Log).Err(err).Msgf("shortlink: error recording click for %s", code)
+			}
+		}()
+
+		w.Header().Set("Cache-Control", "no-store")
+		http.Redirect(w, r, target, http.StatusFound)
+	}
+}
+
+func (s *Server) linksHandler() http.HandlerFunc {
+	return s.HandlePanic(s.Limit(s.Logger(s.links())))
+}
+
+// links creates a link for the signed in user on POST and lists their links on GET.
+func (s *Server) links() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := correlate.Log(r.Context(), s.Log)
+
+		user := auth.UserFromContext(r.Context())
+		if user == nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		if r.Method == http.MethodGet {
+			links, err := s.Shortlinks.Links(r.Context(), user.ID)
+			if err != nil {
+				log.Err(err).Msg("shortlink: error listing links")
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			writeJSON(w, http.StatusOK, links)
+			return
+		}
+
+		req := &createLink{}
+		data, err := io.ReadAll(io.LimitReader(r.Body, shortlinkMaxBody))
+		if err != nil || json.Unmarshal(data, req) != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+
+		ttl := time.Duration(req.TTL) * time.Second
+		if ttl < 0 || ttl > shortlinkMaxTTL {
+			writeJSONError(w, http.StatusBadRequest, "invalid ttl")
+			return
+		}
+
+		link, err := s.Shortlinks.Create(r.Context(), user.ID, req.URL, ttl)
+		if errors.Is(err, shortlink.ErrInvalidURL) {
+			writeJSONError(w, http.StatusBadRequest, "invalid url")
+			return
+		}
+		if err != nil {
+			log.Err(err).Msg("shortlink: error creating link")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		log.Info().Msgf("shortlink: %d|%s created %s", user.ID, user.Name, link.Code)
+		writeJSON(w, http.StatusCreated, link)
+	}
+}
+
+func (s *Server) deleteLinkHandler() http.HandlerFunc {
+	return s.HandlePanic(s.Limit(s.Logger(s.deleteLink())))
+}
+
+// deleteLink deletes a link owned by the signed in user.
+func (s *Server) deleteLink() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := auth.UserFromContext(r.Context())
+		if user == nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		err := s.Shortlinks.Delete(r.Context(), user.ID, s.Param(r, "code"))
+		if errors.Is(err, shortlink.ErrNotFound) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			correlate.Log(r.Context(), s.Log).Err(err).Msg("shortlink: error deleting link")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s *Server) moderateLinkHandler() http.HandlerFunc {
+	return s.HandlePanic(s.Limit(s.Logger(s.scoped("admin", s.moderateLink()))))
+}
+
+// moderateLink disables or enables any link, it requires the admin scope.
+func (s *Server) moderateLink() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := correlate.Log(r.Context(), s.Log)
+
+		req := &moderateLink{}
+		data, err := io.ReadAll(io.LimitReader(r.Body, shortlinkMaxBody))
+		if err != nil || json.Unmarshal(data, req) != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+
+		code := s.Param(r, "code")
+		err = s.Shortlinks.Moderate(r.Context(), code, req.Disabled, truncateUTF8(req.Reason, 200))
+		if errors.Is(err, shortlink.ErrNotFound) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			log.Err(err).Msg("shortlink: error moderating link")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		actor := "UNKNOWN"
+		if user := auth.UserFromContext(r.Context()); user != nil {
+			actor = user.Name
+		}
+		log.Info().Msgf("shortlink: %s set %s disabled=%v", actor, code, req.Disabled)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// shortlinkReport returns the newest links for moderation.
+func (s *Server) shortlinkReport(r *http.Request) (any, error) {
+	return s.Shortlinks.Recent(r.Context(), 100)
+}
+
+func (s *Server) restoreLinkHandler() http.HandlerFunc {
+	return s.HandlePanic(s.Limit(s.Logger(s.scoped("admin", s.restoreLink()))))
+}
+
+// restoreLink undeletes a link deleted by its owner, it requires the admin scope.
+func (s *Server) restoreLink() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := correlate.Log(r.Context(), s.Log)
+
+		code := s.Param(r, "code")
+		err := s.Shortlinks.Restore(r.Context(), code)
+		if errors.Is(err, shortlink.ErrNotFound) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			log.Err(err).Msg("shortlink: error restoring link")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		actor := "UNKNOWN"
+		if user := auth.UserFromContext(r.Context()); user != nil {
+			actor = user.Name
+		}
+		log.Info().Msgf("shortlink: %s restored %s", actor, code)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
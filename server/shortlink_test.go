@@ -0,0 +1,29 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/cwbriscoe/goweb/config"
+)
+
+func TestModerateLinkScope(t *testing.T) {
+	s := newStreamServer()
+	s.Config = &config.Config{}
+
+	handlers := map[string]http.HandlerFunc{
+		"/links/abc/moderate": s.moderateLinkHandler(),
+		"/links/abc/restore":  s.restoreLinkHandler(),
+	}
+	for path, h := range handlers {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest("POST", path, strings.NewReader(`{"disabled":true}`)))
+		if w.Code != http.StatusForbidden {
+			t.Errorf("%s: expected 403 without the admin scope, got %d", path, w.Code)
+		}
+	}
+}
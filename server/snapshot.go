@@ -0,0 +1,324 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package server
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/cwbriscoe/webcache"
+	"github.com/goccy/go-json"
+)
+
+// snapshotFormat is the version of the snapshot file layout.
+const snapshotFormat = 1
+
+// snapshotTimeout bounds the getters called while saving a snapshot on shutdown.
+const snapshotTimeout = 10 * time.Second
+
+// ErrSnapshotVersion is returned when loading a cache snapshot saved by another build
+// of the app or in another file format.
+var ErrSnapshotVersion = errors.New("cache snapshot was saved by another version")
+
+// snapshotFile is the content of a cache snapshot.
+type snapshotFile struct {
+	Format  int             `json:"format"`
+	Version string          `json:"version"`
+	Created time.Time       `json:"created"`
+	Entries []snapshotEntry `json:"entries"`
+}
+
+// snapshotEntry is a cached entry saved in a snapshot.
+type snapshotEntry struct {
+	Group   string    `json:"group"`
+	Key     string    `json:"key"`
+	Etag    string    `json:"etag"`
+	Expires time.Time `json:"expires"`
+	Value   []byte    `json:"value"`
+}
+
+// restoredEntry is an entry set from a snapshot.  The cache gives it the max age of
+// its group again, so the expiration it had when it was saved is kept here.
+type restoredEntry struct {
+	deadline time.Time // expiration when the snapshot was saved
+	expires  time.Time // expiration given by the cache when it was restored
+}
+
+// cacheSnapshot holds the entries loaded from a snapshot.  Groups are added to the
+// cache by their handlers on the first request, so the entries of a group wait until
+// then to be restored.
+type cacheSnapshot struct {
+	sync.Mutex
+	pending  map[string][]snapshotEntry          // group -> entries waiting for the group
+	restored map[string]map[string]restoredEntry // group -> key -> restored entry
+}
+
+// SaveCacheSnapshot writes the tracked entries of the groups that are still fresh to
+// file and returns the number of entries saved.  All tracked groups are saved when
+// groups is empty.  The getters of the entries that were evicted are called again, the
+// whole save is bounded by snapshotTimeout and the entries not filled in time are
+// skipped.  Entries cached per user by UserCache are never saved.
+func (s *Server) SaveCacheSnapshot(file string, groups []string) (int, error) {
+	if len(groups) == 0 {
+		groups = s.cacheKeys.groupNames()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), snapshotTimeout)
+	defer cancel()
+
+	snap := &snapshotFile{Format: snapshotFormat, Version: s.Version, Created: time.Now()}
+	for _, group := range groups {
+		for key, state := range s.cacheKeys.keys(group) {
+			if !state.fresh() {
+				continue
+			}
+			value, info, err := s.Cache.Get(ctx, group, key, "")
+			if err != nil || info == nil || value == nil || !time.Now().Before(info.Expires) {
+				continue
+			}
+			expires := info.Expires
+			if state.expires.Before(expires) {
+				expires = state.expires
+			}
+			snap.Entries = append(snap.Entries, snapshotEntry{
+				Group:   group,
+				Key:     key,
+				Etag:    info.Etag,
+				Expires: expires,
+				Value:   value,
+			})
+		}
+	}
+
+	if err := writeSnapshot(file, snap); err != nil {
+		return 0, err
+	}
+	return len(snap.Entries), nil
+}
+
+// LoadCacheSnapshot reads a snapshot saved by SaveCacheSnapshot and returns the number
+// of entries that will be restored.  Snapshots saved by another Version are rejected
+// with ErrSnapshotVersion.  Entries that expired since or whose etag does not match
+// their value are dropped, so clients keep getting 304s for the etags they hold.  The
+// entries of a group are put in the cache on its first request and keep the expiration
+// they had when they were saved.
+func (s *Server) LoadCacheSnapshot(file string) (int, error) {
+	snap, err := readSnapshot(file)
+	if err != nil {
+		return 0, err
+	}
+	if snap.Format != snapshotFormat || snap.Version != s.Version {
+		return 0, fmt.Errorf("%w: format %d, version %q", ErrSnapshotVersion, snap.Format, snap.Version)
+	}
+
+	now := time.Now()
+	pending := make(map[string][]snapshotEntry)
+	count := 0
+	for _, e := range snap.Entries {
+		if !now.Before(e.Expires) || e.Etag != snapshotEtag(e.Value) {
+			continue
+		}
+		pending[e.Group] = append(pending[e.Group], e)
+		count++
+	}
+
+	s.snapshot.Lock()
+	s.snapshot.pending = pending
+	s.snapshot.Unlock()
+	return count, nil
+}
+
+// snapshotEtag returns the etag the cache computes for the value.
+func snapshotEtag(value []byte) string {
+	return strconv.FormatUint(xxhash.Sum64(value), 16)
+}
+
+func writeSnapshot(file string, snap *snapshotFile) error {
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+
+	// write to a temp file first so a crash never leaves a truncated snapshot behind.
+	tmp, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	zw := gzip.NewWriter(tmp)
+	if _, err = zw.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = zw.Close(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+func readSnapshot(file string) (*snapshotFile, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	snap := &snapshotFile{}
+	if err = json.NewDecoder(zr).Decode(snap); err != nil {
+		return nil, err
+	}
+	return snap, nil
+}
+
+// restore puts the pending entries of the group in the cache.
+func (c *cacheSnapshot) restore(cache *webcache.WebCache, keys *cacheKeys, group string) {
+	c.Lock()
+	defer c.Unlock()
+
+	entries, ok := c.pending[group]
+	if !ok {
+		return
+	}
+	delete(c.pending, group)
+
+	if c.restored == nil {
+		c.restored = make(map[string]map[string]restoredEntry)
+	}
+	restored := make(map[string]restoredEntry, len(entries))
+	for _, e := range entries {
+		if !time.Now().Before(e.Expires) {
+			continue
+		}
+		info := cache.Set(group, e.Key, e.Value)
+		if info.Etag != e.Etag {
+			cache.Delete(group, e.Key)
+			continue
+		}
+		restored[e.Key] = restoredEntry{deadline: e.Expires, expires: info.Expires}
+		keys.add(group, e.Key)
+	}
+	if len(restored) > 0 {
+		c.restored[group] = restored
+	}
+}
+
+// deadline returns the expiration the entry had when it was saved in the snapshot, or
+// the zero time if it was not restored from one.  stale is true if that expiration has
+// passed, the entry then has to be read again.
+func (c *cacheSnapshot) deadline(group, key string, expires time.Time) (deadline time.Time, stale bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	entry, ok := c.restored[group][key]
+	if !ok {
+		return time.Time{}, false
+	}
+	if !entry.expires.Equal(expires) {
+		// the entry was stored again since it was restored.
+		c.forget(group, key)
+		return time.Time{}, false
+	}
+	if !time.Now().Before(entry.deadline) {
+		c.forget(group, key)
+		return time.Time{}, true
+	}
+	return entry.deadline, false
+}
+
+func (c *cacheSnapshot) forget(group, key string) {
+	delete(c.restored[group], key)
+	if len(c.restored[group]) == 0 {
+		delete(c.restored, group)
+	}
+}
+
+// getCached reads the entry of the key from the cache, after restoring the entries of
+// the group loaded from a snapshot.  Restored entries keep the expiration they had when
+// the snapshot was saved and entries whose getter called CacheTTL expire after it.
+func (s *Server) getCached(ctx context.Context, group, key, etag string) ([]byte, *webcache.CacheInfo, error) {
+	s.snapshot.restore(s.Cache, &s.cacheKeys, group)
+
+	ctx = s.cacheTTLs.context(ctx, group, key)
+	bytes, info, err := s.fetchCached(ctx, group, key, etag)
+	if err != nil || info == nil {
+		return bytes, info, err
+	}
+
+	deadline, stale := s.entryDeadline(group, key, info.Expires)
+	if stale {
+		s.Cache.Delete(group, key)
+		bytes, info, err = s.fetchCached(ctx, group, key, etag)
+		if err != nil || info == nil {
+			return bytes, info, err
+		}
+		deadline, _ = s.entryDeadline(group, key, info.Expires)
+	}
+	if !deadline.IsZero() && deadline.Before(info.Expires) {
+		shortened := *info
+		shortened.Expires = deadline
+		info = &shortened
+	}
+	return bytes, info, nil
+}
+
+// fetchCached reads the entry of the key and records the lifetime asked by its getter.
+func (s *Server) fetchCached(ctx context.Context, group, key, etag string) ([]byte, *webcache.CacheInfo, error) {
+	start := time.Now()
+	bytes, info, err := s.Cache.Get(ctx, group, key, etag)
+	if err == nil && info != nil {
+		s.cacheTTLs.filled(group, key, start, info.Expires)
+	}
+	return bytes, info, err
+}
+
+// entryDeadline returns the earliest deadline of a restored or shortened entry, zero if
+// it has none.  stale is true once one of them passed.
+func (s *Server) entryDeadline(group, key string, expires time.Time) (deadline time.Time, stale bool) {
+	deadline, stale = s.snapshot.deadline(group, key, expires)
+	ttl, ttlStale := s.cacheTTLs.deadline(group, key, expires)
+	if !ttl.IsZero() && (deadline.IsZero() || ttl.Before(deadline)) {
+		deadline = ttl
+	}
+	return deadline, stale || ttlStale
+}
+
+// initCacheSnapshot loads the snapshot saved by the last run and saves a new one on
+// shutdown.  A missing or outdated snapshot just leaves the cache cold.
+func (s *Server) initCacheSnapshot(file string) {
+	count, err := s.LoadCacheSnapshot(file)
+	switch {
+	case err == nil:
+		s.Log.Info().Msgf("cache snapshot: %d entries loaded from %s", count, file)
+	case errors.Is(err, os.ErrNotExist):
+	default:
+		s.Log.Warn().Err(err).Msgf("cache snapshot: not loaded from %s", file)
+	}
+
+	s.OnShutdown(func() {
+		count, err := s.SaveCacheSnapshot(file, s.Config.Cache.SnapshotGroups)
+		if err != nil {
+			s.Log.Err(err).Msgf("cache snapshot: error saving to %s", file)
+			return
+		}
+		s.Log.Info().Msgf("cache snapshot: %d entries saved to %s", count, file)
+	})
+}
@@ -0,0 +1,100 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cwbriscoe/webcache"
+)
+
+type snapshotGetter struct {
+	calls int
+}
+
+func (g *snapshotGetter) Get(ctx context.Context, key string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	g.calls++
+	return []byte(strings.Repeat(key, 3)), nil
+}
+
+func snapshotServer(t *testing.T, version string) (*Server, *snapshotGetter) {
+	s := &Server{Version: version, Cache: webcache.NewWebCache(1<<20, 1)}
+	getter := &snapshotGetter{}
+	if err := s.Cache.AddGroup("pages", time.Hour, getter); err != nil {
+		t.Fatal(err)
+	}
+	return s, getter
+}
+
+func TestCacheSnapshot(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "cache.snapshot")
+	ctx := context.Background()
+
+	s, getter := snapshotServer(t, "v1")
+	etags := make(map[string]string)
+	for _, key := range []string{"a", "b", "c"} {
+		s.cacheKeys.add("pages", key)
+		_, info, err := s.getCached(ctx, "pages", key, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.cacheKeys.seen("pages", key, info.Expires)
+		etags[key] = info.Etag
+	}
+	// tracked but evicted keys are filled again with a live context.
+	s.cacheKeys.add("pages", "gone")
+	s.cacheKeys.seen("pages", "gone", time.Now().Add(time.Hour))
+	etags["gone"] = snapshotEtag([]byte("gonegonegone"))
+
+	count, err := s.SaveCacheSnapshot(file, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 4 || getter.calls != 4 {
+		t.Fatalf("expected 4 entries saved with 4 getter calls, got %d and %d", count, getter.calls)
+	}
+
+	// a new build does not load the snapshot.
+	other, _ := snapshotServer(t, "v2")
+	if _, err = other.LoadCacheSnapshot(file); !errors.Is(err, ErrSnapshotVersion) {
+		t.Fatalf("expected ErrSnapshotVersion, got %v", err)
+	}
+
+	restarted, getter := snapshotServer(t, "v1")
+	if count, err = restarted.LoadCacheSnapshot(file); err != nil || count != 4 {
+		t.Fatalf("expected 4 entries loaded, got %d (%v)", count, err)
+	}
+	for key, etag := range etags {
+		value, info, err := restarted.getCached(ctx, "pages", key, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(value) != strings.Repeat(key, 3) || info.Etag != etag {
+			t.Errorf("key %s: got %q with etag %s, want etag %s", key, value, info.Etag, etag)
+		}
+	}
+	if getter.calls != 0 {
+		t.Errorf("restored entries should not call the getter, got %d calls", getter.calls)
+	}
+
+	// restored entries expire when they would have without the restart.
+	restarted.snapshot.Lock()
+	entry := restarted.snapshot.restored["pages"]["a"]
+	entry.deadline = time.Now().Add(-time.Second)
+	restarted.snapshot.restored["pages"]["a"] = entry
+	restarted.snapshot.Unlock()
+	if _, _, err = restarted.getCached(ctx, "pages", "a", ""); err != nil {
+		t.Fatal(err)
+	}
+	if getter.calls != 1 {
+		t.Errorf("expected the expired entry to be read again, got %d calls", getter.calls)
+	}
+}
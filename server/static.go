@@ -8,59 +8,139 @@ import (
 	"net/http"
 	"os"
 	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/cwbriscoe/goutil/compress"
 	"github.com/cwbriscoe/goutil/net"
+	"github.com/cwbriscoe/goweb/config"
+	"github.com/cwbriscoe/goweb/correlate"
 )
 
 // StaticData stores the root path for static and root handlers
 type StaticData struct {
-	root string
-	gz   *compress.GzipPool
-	br   *compress.BrotliPool
+	mu    sync.RWMutex // guards root and dirs, changed when the config is reloaded
+	root  string
+	dirs  []string // subdirectories of root that are served, all of them when empty
+	app   bool     // serves the app root, else the static root
+	spa   bool     // serve index.html for the extension-less paths that are not files
+	group string
+	svr   *Server
 }
 
-func (s *Server) appRootHandler(group string, cacheDuration time.Duration) http.HandlerFunc {
-	return s.Logger(s.getStaticData(group, s.Config.RootDir+s.Config.HTTPS.AppRoot, cacheDuration))
+// staticRoots are the handlers of the app and static roots of the config.
+type staticRoots struct {
+	sync.Mutex
+	list []*StaticData
+}
+
+// appRootHandler serves the files of the app root.  In spa mode, the extension-less
+// paths that are not files get the index.html of their first directory, ie:
+// /app/index.html for /app/settings/profile, so the client side router of a single page
+// app handles them on refresh.  Missing assets are still a 404.
+func (s *Server) appRootHandler(group string, cacheDuration time.Duration, spaMode bool) http.HandlerFunc {
+	return s.Logger(s.LoadShedder(s.ProfileLabel(group, s.rootHandler(group, true, cacheDuration, spaMode))))
 }
 
 func (s *Server) staticHandler(group string, cacheDuration time.Duration) http.HandlerFunc {
-	return s.Logger(s.getStaticData(group, s.Config.RootDir+s.Config.HTTPS.StaticRoot, cacheDuration))
+	return s.Logger(s.LoadShedder(s.ProfileLabel(group, s.rootHandler(group, false, cacheDuration, false))))
+}
+
+// rootHandler serves the app or static root of the config, the root follows the config
+// when it is reloaded.
+func (s *Server) rootHandler(group string, app bool, cacheDuration time.Duration, spaMode bool) http.HandlerFunc {
+	root, dirs := rootPaths(s.Config, app)
+	static := &StaticData{root: root, dirs: dirs, app: app, spa: spaMode, group: group, svr: s}
+
+	s.staticRoots.Lock()
+	s.staticRoots.list = append(s.staticRoots.list, static)
+	s.staticRoots.Unlock()
+
+	return s.serveStatic(static, cacheDuration)
+}
+
+// rootPaths returns the app or static root of cfg and its served subdirectories.
+func rootPaths(cfg *config.Config, app bool) (string, []string) {
+	if app {
+		return cfg.RootDir + cfg.HTTPS.AppRoot, cfg.HTTPS.AppDirs
+	}
+	return cfg.RootDir + cfg.HTTPS.StaticRoot, cfg.HTTPS.StaticDirs
+}
+
+// reroot points the app and static handlers to the roots of cfg.  The cached files of
+// the handlers whose root changed are invalidated.
+func (s *Server) reroot(cfg *config.Config) {
+	s.staticRoots.Lock()
+	list := slices.Clone(s.staticRoots.list)
+	s.staticRoots.Unlock()
+
+	for _, static := range list {
+		root, dirs := rootPaths(cfg, static.app)
+		if static.setRoot(root, dirs) {
+			s.invalidateGroup(static.group)
+		}
+	}
 }
 
-func (s *Server) getStaticData(group, root string, cacheDuration time.Duration) http.HandlerFunc {
+// setRoot changes the root and subdirectories served, it returns true if they changed.
+func (s *StaticData) setRoot(root string, dirs []string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.root == root && slices.Equal(s.dirs, dirs) {
+		return false
+	}
+	s.root, s.dirs = root, dirs
+	return true
+}
+
+func (s *Server) getStaticData(group, root string, dirs []string, cacheDuration time.Duration, spaMode bool) http.HandlerFunc {
+	return s.serveStatic(&StaticData{root: root, dirs: dirs, spa: spaMode, group: group, svr: s}, cacheDuration)
+}
+
+func (s *Server) serveStatic(static *StaticData, cacheDuration time.Duration) http.HandlerFunc {
+	group := static.group
 	var once sync.Once
 	return func(w http.ResponseWriter, r *http.Request) {
 		once.Do(func() {
-			static := &StaticData{}
-			static.root = root
-			static.gz = s.GzipPool
-			static.br = s.BrotliPool
 			err := s.Cache.AddGroup(group, cacheDuration, static)
 			if err != nil {
 				panic(err)
 			}
 		})
 
-		s.processStaticRequest(w, r, group)
+		s.processStaticRequest(w, r, static)
 	}
 }
 
 //revive:disable:cyclomatic
 //revive:disable:cognitive-complexity
-func (s *Server) processStaticRequest(w http.ResponseWriter, r *http.Request, group string) {
-	file := r.URL.Path
+func (s *Server) processStaticRequest(w http.ResponseWriter, r *http.Request, static *StaticData) {
+	log := correlate.Log(r.Context(), s.Log)
+
+	file, ok := staticRequestPath(r)
+	if !ok {
+		log.Warn().Msgf("static: rejected path %q", r.URL.EscapedPath())
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	fallback := false
+	if static.spa && path.Ext(file) == "" {
+		index := static.spaFile(file)
+		fallback = index != file
+		file = index
+	}
 
 	ext := path.Ext(file)
 	if ext == "" {
 		ext = ".html"
 	}
 
-	if ext != ".jpg" && ext != ".png" && ext != ".svg" && ext != ".html" && ext != ".css" &&
-		ext != ".js" && ext != ".json" && ext != ".xml" && ext != ".ico" {
+	t, ok := s.staticType(ext)
+	if !ok {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
@@ -79,52 +159,115 @@ func (s *Server) processStaticRequest(w http.ResponseWriter, r *http.Request, gr
 		}
 	}
 	if !br || !gzip {
-		s.Log.Debug().Msgf("request accept-encoding: %s: %v", file, encodings)
+		log.Debug().Msgf("request accept-encoding: %s: %v", file, encodings)
 	}
 	// end-debug
 
-	switch ext {
-	case ".jpg":
-		w.Header().Add("Content-Type", "image/jpeg")
-	case ".png":
-		w.Header().Add("Content-Type", "image/png")
-	case ".svg":
-		w.Header().Add("Content-Type", "image/svg+xml")
-	case ".ico":
-		w.Header().Add("Content-Type", "image/x-icon")
-	case ".html":
-		w.Header().Add("Content-Type", "text/html")
-	case ".css":
-		w.Header().Add("Content-Type", "text/css")
-	case ".js":
-		w.Header().Add("Content-Type", "application/javascript")
-	case ".json":
-		w.Header().Add("Content-Type", "application/json")
-	case ".xml":
-		w.Header().Add("Content-Type", "application/xml")
-	default:
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+	w.Header().Add("Content-Type", t.ContentType)
+	if t.MaxAge > 0 {
+		w.Header().Set("Cache-Control", "max-age="+strconv.Itoa(int(t.MaxAge/time.Second)))
+	} else if fallback {
+		// the index of a single page app links the assets of the current deploy.
+		w.Header().Set("Cache-Control", "no-cache")
 	}
 
-	if ext != ".jpg" && ext != ".png" {
+	if t.Compress {
 		net.SetPreferredEncoding(w, r)
 	}
 
-	s.Cacher(w, r, group, file)
+	s.Cacher(w, r, static.group, file)
 }
 
 //revive:enable:cyclomatic
 //revive:enable:cognitive-complexity
 
+// staticRequestPath returns the cleaned path of the file requested.  Paths with ../
+// segments, backslashes or encoded slashes are rejected, they are only sent to escape
+// the root.
+func staticRequestPath(r *http.Request) (string, bool) {
+	escaped := strings.ToLower(r.URL.EscapedPath())
+	if strings.Contains(escaped, "%2f") || strings.Contains(escaped, "%5c") {
+		return "", false
+	}
+	return cleanStaticPath(r.URL.Path)
+}
+
+// cleanStaticPath returns the rooted and cleaned name of a static file.
+func cleanStaticPath(name string) (string, bool) {
+	if strings.ContainsAny(name, "\\\x00") {
+		return "", false
+	}
+	for _, seg := range strings.Split(name, "/") {
+		if seg == ".." {
+			return "", false
+		}
+	}
+	return path.Clean("/" + name), true
+}
+
+// file returns the path of the named file under root.  It returns false when the name
+// is not a clean path, when the file would be outside of root or when it is in a
+// subdirectory that is not in the allow-list.  Files directly in root are always served.
+func (s *StaticData) file(name string) (string, bool) {
+	if name == "" || name == "/" {
+		name = "/index.html"
+	}
+	name, ok := cleanStaticPath(name)
+	if !ok || !s.allowed(name) {
+		return "", false
+	}
+
+	s.mu.RLock()
+	root := filepath.Clean(s.root)
+	s.mu.RUnlock()
+	file := filepath.Join(root, filepath.FromSlash(name))
+	if !strings.HasPrefix(file, root+string(filepath.Separator)) {
+		return "", false
+	}
+	return file, true
+}
+
+// allowed returns true if the subdirectory of the cleaned name is in the allow-list.
+func (s *StaticData) allowed(name string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.dirs) == 0 {
+		return true
+	}
+	dir := strings.TrimPrefix(path.Dir(name), "/")
+	if dir == "" {
+		return true
+	}
+	for _, allowed := range s.dirs {
+		allowed = strings.Trim(allowed, "/")
+		if dir == allowed || strings.HasPrefix(dir, allowed+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// spaFile returns name when it is a file, else the index.html of its first directory.
+func (s *StaticData) spaFile(name string) string {
+	if file, ok := s.file(name); ok {
+		if info, err := os.Stat(file); err == nil && !info.IsDir() {
+			return name
+		}
+	}
+
+	dir, _, _ := strings.Cut(strings.TrimPrefix(name, "/"), "/")
+	if dir == "" {
+		return "/index.html"
+	}
+	return "/" + dir + "/index.html"
+}
+
 // Get loads static data when not found in the cache
-func (s *StaticData) Get(_ context.Context, key string) ([]byte, error) {
+func (s *StaticData) Get(ctx context.Context, key string) ([]byte, error) {
 	keys, encoding := net.GetRequestParams(key)
-	file := s.root
-	if keys[0] == "" {
-		file += "/index.html"
-	} else {
-		file += keys[0]
+	file, ok := s.file(keys[0])
+	if !ok {
+		return nil, nil
 	}
 
 	src, err := os.ReadFile(file)
@@ -136,24 +279,23 @@ func (s *StaticData) Get(_ context.Context, key string) ([]byte, error) {
 	}
 
 	ext := path.Ext(keys[0])
+	if ext == "" {
+		ext = ".html"
+	}
 
-	if ext == ".jpg" || ext == ".png" {
+	t, ok := s.svr.staticType(ext)
+	if !ok {
+		return nil, nil
+	}
+	if !t.Compress {
 		return src, nil
 	}
 
-	var dest []byte
-
-	if encoding == "br" {
-		dest, err = s.br.Compress(src)
-		if err != nil {
-			return nil, err
-		}
-	} else {
-		dest, err = s.gz.Compress(src)
-		if err != nil {
-			return nil, err
-		}
+	contentType := t.ContentType
+	src, err = s.svr.Transform(ctx, &TransformInfo{Group: s.group, Key: key, ContentType: contentType}, src)
+	if err != nil {
+		return nil, err
 	}
 
-	return dest, nil
+	return s.svr.Compressor.Compress(encoding, contentType, src, true)
 }
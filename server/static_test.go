@@ -0,0 +1,146 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cwbriscoe/goweb/config"
+	"github.com/cwbriscoe/webcache"
+)
+
+func TestStaticRequestPath(t *testing.T) {
+	tests := []struct {
+		target string
+		want   string
+		ok     bool
+	}{
+		{"/app/main.js", "/app/main.js", true},
+		{"/app//img/./logo.png", "/app/img/logo.png", true},
+		{"/app/../../etc/passwd", "", false},
+		{"/app/%2e%2e/%2e%2e/etc/passwd", "", false},
+		{"/app/..%2f..%2fetc/passwd", "", false},
+		{"/app/..%5c..%5cetc%5cpasswd", "", false},
+		{"/app/..\\..\\etc\\passwd", "", false},
+		{"/app/main.js%00.png", "", false},
+		{"/app/%2Fetc/passwd", "", false},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, test.target, nil)
+		got, ok := staticRequestPath(r)
+		if ok != test.ok || got != test.want {
+			t.Errorf("%s: expected %q %v, got %q %v", test.target, test.want, test.ok, got, ok)
+		}
+	}
+}
+
+func TestStaticDataFile(t *testing.T) {
+	root := t.TempDir()
+	static := &StaticData{root: root, dirs: []string{"app", "/img/"}}
+
+	tests := []struct {
+		name string
+		want string
+		ok   bool
+	}{
+		{"", "index.html", true},
+		{"/favicon.svg", "favicon.svg", true},
+		{"/app/main.js", "app/main.js", true},
+		{"/img/icons/x.svg", "img/icons/x.svg", true},
+		{"/private/keys.json", "", false},
+		{"/application/x.js", "", false},
+		{"/app/../private/keys.json", "", false},
+		{"../" + filepath.Base(root) + "2/x.html", "", false},
+	}
+	for _, test := range tests {
+		got, ok := static.file(test.name)
+		if ok != test.ok {
+			t.Errorf("%s: expected %v, got %v", test.name, test.ok, ok)
+			continue
+		}
+		if ok && got != filepath.Join(root, test.want) {
+			t.Errorf("%s: expected %s, got %s", test.name, filepath.Join(root, test.want), got)
+		}
+	}
+}
+
+func TestStaticDataGetOutsideRoot(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "public")
+	if err := os.Mkdir(root, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "secrets.json"), []byte(`{"key":"x"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	static := &StaticData{root: root}
+	src, err := static.Get(context.Background(), "/../secrets.json")
+	if err != nil || src != nil {
+		t.Errorf("expected the file outside of root to be missing, got %q %v", src, err)
+	}
+}
+
+func TestStaticDataSPAFile(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"app/docs", "app/guide"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(root, "app", "docs", "readme"), []byte("readme"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	static := &StaticData{root: root, spa: true}
+
+	tests := map[string]string{
+		"/app/settings/profile": "/app/index.html",
+		"/app/":                 "/app/index.html",
+		"/app/guide":            "/app/index.html",
+		"/app/docs/readme":      "/app/docs/readme",
+		"/":                     "/index.html",
+	}
+	for name, want := range tests {
+		if got := static.spaFile(name); got != want {
+			t.Errorf("%s: expected %s, got %s", name, want, got)
+		}
+	}
+}
+
+func TestProcessStaticRequestSPA(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "app"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "app", "index.html"), []byte("<html>app</html>"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := newStreamServer()
+	s.Config = &config.Config{}
+	s.Cache = webcache.NewWebCache(1<<20, 1)
+	h := s.getStaticData("spa", root, nil, time.Minute, true)
+
+	tests := []struct {
+		target string
+		code   int
+	}{
+		{"/app/settings/profile", http.StatusOK},
+		{"/app/index.html", http.StatusOK},
+		{"/app/missing.js", http.StatusNotFound},
+		{"/app/img/missing.png", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest(http.MethodGet, test.target, nil))
+		if w.Code != test.code {
+			t.Errorf("%s: expected %d, got %d", test.target, test.code, w.Code)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package server
+
+import (
+	"mime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StaticType is how the static handlers serve the files with an extension.
+type StaticType struct {
+	ContentType string        // defaults to the type of the extension known by the mime package
+	Compress    bool          // compress and transform the files, for text formats
+	MaxAge      time.Duration // how long browsers cache the files, defaults to the lifetime of the cache entry
+}
+
+// defaultStaticTypes are the extensions served without any config.  The types are
+// listed since the mime package only knows some of them on some systems.
+var defaultStaticTypes = map[string]StaticType{
+	".html":        {ContentType: "text/html", Compress: true},
+	".css":         {ContentType: "text/css", Compress: true},
+	".js":          {ContentType: "application/javascript", Compress: true},
+	".mjs":         {ContentType: "application/javascript", Compress: true},
+	".json":        {ContentType: "application/json", Compress: true},
+	".map":         {ContentType: "application/json", Compress: true},
+	".webmanifest": {ContentType: "application/manifest+json", Compress: true},
+	".xml":         {ContentType: "application/xml", Compress: true},
+	".txt":         {ContentType: "text/plain; charset=utf-8", Compress: true},
+	".svg":         {ContentType: "image/svg+xml", Compress: true},
+	".ico":         {ContentType: "image/x-icon", Compress: true},
+	".wasm":        {ContentType: "application/wasm", Compress: true},
+	".jpg":         {ContentType: "image/jpeg"},
+	".jpeg":        {ContentType: "image/jpeg"},
+	".png":         {ContentType: "image/png"},
+	".gif":         {ContentType: "image/gif"},
+	".webp":        {ContentType: "image/webp"},
+	".avif":        {ContentType: "image/avif"},
+	".woff":        {ContentType: "font/woff"},
+	".woff2":       {ContentType: "font/woff2"},
+	".mp4":         {ContentType: "video/mp4"},
+	".webm":        {ContentType: "video/webm"},
+}
+
+// staticTypes are the types added with AddStaticType.
+type staticTypes struct {
+	sync.RWMutex
+	types map[string]StaticType
+}
+
+// AddStaticType serves the files with the extension, ie: ".woff2", from the static
+// handlers or changes how they are served.  An empty content type is looked up with
+// mime.TypeByExtension.  It takes precedence over the staticTypes of the config.
+func (s *Server) AddStaticType(ext string, t StaticType) {
+	s.staticTypes.Lock()
+	defer s.staticTypes.Unlock()
+	if s.staticTypes.types == nil {
+		s.staticTypes.types = make(map[string]StaticType)
+	}
+	s.staticTypes.types[strings.ToLower(ext)] = t
+}
+
+// staticType returns how the files with the extension are served, false when they are
+// not served.  Types added with AddStaticType come first, then the config, then the
+// defaults.
+func (s *Server) staticType(ext string) (StaticType, bool) {
+	ext = strings.ToLower(ext)
+
+	s.staticTypes.RLock()
+	t, ok := s.staticTypes.types[ext]
+	s.staticTypes.RUnlock()
+
+	if !ok && s.Config != nil {
+		if cfg, found := s.Config.StaticTypes[ext]; found {
+			t, ok = StaticType{ContentType: cfg.ContentType, Compress: cfg.Compress, MaxAge: time.Duration(cfg.MaxAge) * time.Second}, true
+		}
+	}
+	if !ok {
+		t, ok = defaultStaticTypes[ext]
+	}
+	if !ok {
+		return StaticType{}, false
+	}
+
+	if t.ContentType == "" {
+		t.ContentType = mime.TypeByExtension(ext)
+	}
+	return t, t.ContentType != ""
+}
@@ -0,0 +1,46 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package server
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/cwbriscoe/goweb/config"
+)
+
+func TestStaticType(t *testing.T) {
+	cfg := &config.Config{}
+	err := json.Unmarshal([]byte(`{"staticTypes": {
+		".pdf": {"maxAge": 3600},
+		".csv": {"contentType": "text/csv", "compress": true},
+		".png": {"contentType": "image/png", "maxAge": 86400}
+	}}`), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{Config: cfg}
+	s.AddStaticType(".CSV", StaticType{ContentType: "text/csv; charset=utf-8", Compress: true})
+
+	tests := []struct {
+		ext  string
+		want StaticType
+		ok   bool
+	}{
+		{".html", StaticType{ContentType: "text/html", Compress: true}, true},
+		{".woff2", StaticType{ContentType: "font/woff2"}, true},
+		{".WEBP", StaticType{ContentType: "image/webp"}, true},
+		{".pdf", StaticType{ContentType: "application/pdf", MaxAge: time.Hour}, true},
+		{".png", StaticType{ContentType: "image/png", MaxAge: 24 * time.Hour}, true},
+		{".csv", StaticType{ContentType: "text/csv; charset=utf-8", Compress: true}, true},
+		{".go", StaticType{}, false},
+		{".env", StaticType{}, false},
+	}
+	for _, test := range tests {
+		got, ok := s.staticType(test.ext)
+		if ok != test.ok || got != test.want {
+			t.Errorf("%s: expected %+v %v, got %+v %v", test.ext, test.want, test.ok, got, ok)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package server
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cwbriscoe/goweb/correlate"
+)
+
+// StreamOptions are the options of Stream.
+type StreamOptions struct {
+	ContentType string // Content-Type of the response, ie: text/csv or text/event-stream
+	Filename    string // download the response as an attachment with this file name
+	NoCompress  bool   // never compress, ie: the payload is already compressed
+}
+
+// StreamWriter writes the body of a streamed response.
+type StreamWriter struct {
+	w  io.Writer
+	rc *http.ResponseController
+	n  int64
+}
+
+// Write implements io.Writer.
+func (sw *StreamWriter) Write(b []byte) (int, error) {
+	n, err := sw.w.Write(b)
+	sw.n += int64(n)
+	return n, err
+}
+
+// Flush sends what was written so far to the client, through the compressor when the
+// response is compressed.
+func (sw *StreamWriter) Flush() error {
+	return sw.rc.Flush()
+}
+
+// Event writes a server-sent event and flushes it.  The event name is omitted when empty
+// and every line of data is sent as its own data field.
+func (sw *StreamWriter) Event(name, data string) error {
+	var b strings.Builder
+	if name != "" {
+		b.WriteString("event: " + name + "\n")
+	}
+	for _, line := range strings.Split(data, "\n") {
+		b.WriteString("data: " + line + "\n")
+	}
+	b.WriteString("\n")
+	if _, err := io.WriteString(sw, b.String()); err != nil {
+		return err
+	}
+	return sw.Flush()
+}
+
+// Stream writes a large or dynamic response, ie: a CSV export or server-sent events,
+// straight to the client as write produces it instead of buffering it in the cache.  It
+// is compressed on the fly with the pooled encoders when the client accepts it, unless
+// opts.NoCompress is set.  Streamed responses are never stored by the cache or by the
+// browser.  If write fails before writing anything, a 500 is returned, after that the
+// status was already sent and the error is only logged.  opts may be nil.
+func (s *Server) Stream(w http.ResponseWriter, r *http.Request, opts *StreamOptions, write func(sw *StreamWriter) error) {
+	log := correlate.Log(r.Context(), s.Log)
+
+	if opts == nil {
+		opts = &StreamOptions{}
+	}
+
+	h := w.Header()
+	if opts.ContentType != "" {
+		h.Set("Content-Type", opts.ContentType)
+	}
+	if opts.Filename != "" {
+		h.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": opts.Filename}))
+	}
+	h.Set("Cache-Control", "no-store")
+	// keeps proxies like nginx from buffering the whole response.
+	h.Set("X-Accel-Buffering", "no")
+	// streams may last longer than limits.writeTimeout.
+	_ = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	encoding := ""
+	if !opts.NoCompress && h.Get("Content-Encoding") == "" {
+		encoding = acceptedEncoding(r)
+	}
+
+	out := w
+	if encoding != "" {
+		cw := &compressResponseWriter{ResponseWriter: w, comp: s.Compressor, encoding: encoding}
+		defer func() {
+			if err := cw.close(); err != nil && !clientGone(r) {
+				log.Err(err).Msgf("stream: error closing %s stream for %s", encoding, r.URL.Path)
+			}
+		}()
+		out = cw
+	}
+
+	sw := &StreamWriter{w: out, rc: http.NewResponseController(out)}
+	err := write(sw)
+	if err == nil || clientGone(r) {
+		return
+	}
+	if sw.n == 0 {
+		h.Del("Content-Disposition")
+		writeJSONError(w, http.StatusInternalServerError, "error streaming the response")
+	}
+	log.Err(err).Msgf("stream: error writing %s after %d bytes", r.URL.Path, sw.n)
+}
@@ -0,0 +1,84 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package server
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cwbriscoe/goutil/logging"
+	"github.com/cwbriscoe/goweb/config"
+	"github.com/rs/zerolog"
+)
+
+func newStreamServer() *Server {
+	log := zerolog.Nop()
+	return &Server{Compressor: NewCompressor(&config.Config{}), Log: &logging.Logger{Logger: &log}}
+}
+
+func TestStream(t *testing.T) {
+	s := newStreamServer()
+	r := httptest.NewRequest("GET", "/export", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+
+	s.Stream(w, r, &StreamOptions{ContentType: "text/csv", Filename: "users.csv"}, func(sw *StreamWriter) error {
+		_, err := io.WriteString(sw, "id,name\n1,chris\n")
+		return err
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	h := w.Header()
+	if h.Get("Content-Encoding") != "gzip" || h.Get("Cache-Control") != "no-store" {
+		t.Errorf("unexpected headers %v", h)
+	}
+	if h.Get("Content-Disposition") != `attachment; filename=users.csv` {
+		t.Errorf("unexpected Content-Disposition %q", h.Get("Content-Disposition"))
+	}
+	zr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(zr)
+	if err != nil || string(body) != "id,name\n1,chris\n" {
+		t.Errorf("unexpected body %q %v", body, err)
+	}
+}
+
+func TestStreamEvents(t *testing.T) {
+	s := newStreamServer()
+	w := httptest.NewRecorder()
+	s.Stream(w, httptest.NewRequest("GET", "/events", nil), &StreamOptions{ContentType: "text/event-stream"}, func(sw *StreamWriter) error {
+		return sw.Event("progress", "50\n60")
+	})
+
+	if w.Header().Get("Content-Encoding") != "" {
+		t.Error("expected an uncompressed stream without Accept-Encoding")
+	}
+	if want := "event: progress\ndata: 50\ndata: 60\n\n"; w.Body.String() != want {
+		t.Errorf("expected %q, got %q", want, w.Body.String())
+	}
+	if !w.Flushed {
+		t.Error("expected the event to be flushed")
+	}
+}
+
+func TestStreamError(t *testing.T) {
+	s := newStreamServer()
+	r := httptest.NewRequest("GET", "/export", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	s.Stream(w, r, nil, func(*StreamWriter) error {
+		return errors.New("query failed")
+	})
+
+	if w.Code != http.StatusInternalServerError || w.Header().Get("Content-Encoding") != "" {
+		t.Errorf("expected an uncompressed 500, got %d %v", w.Code, w.Header())
+	}
+}
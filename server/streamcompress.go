@@ -0,0 +1,228 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package server
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/cwbriscoe/goweb/correlate"
+	"github.com/klauspost/compress/zstd"
+)
+
+// streamEncoder is the common interface of the pooled gzip, brotli and zstd writers.
+type streamEncoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(io.Writer)
+}
+
+type zstdEncoder struct {
+	*zstd.Encoder
+}
+
+func (z zstdEncoder) Reset(w io.Writer) {
+	z.Encoder.Reset(w)
+}
+
+// streamPools holds pools of streaming encoders so large responses can be compressed
+// as they are written instead of being buffered in memory first.
+type streamPools struct {
+	once sync.Once
+	gz   sync.Pool
+	br   sync.Pool
+	zstd sync.Pool
+}
+
+func (c *Compressor) initStreamPools() {
+	c.streams.once.Do(func() {
+		gzLevel, brLevel, _ := c.levels("", 0, false)
+		c.streams.gz.New = func() any {
+			w, err := gzip.NewWriterLevel(io.Discard, gzLevel)
+			if err != nil {
+				w = gzip.NewWriter(io.Discard)
+			}
+			return w
+		}
+		c.streams.br.New = func() any {
+			return brotli.NewWriterLevel(io.Discard, brLevel)
+		}
+		zstdLevel := c.zstdLevel()
+		c.streams.zstd.New = func() any {
+			w, err := zstd.NewWriter(io.Discard,
+				zstd.WithEncoderConcurrency(1),
+				zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(zstdLevel)))
+			if err != nil {
+				panic(err)
+			}
+			return zstdEncoder{w}
+		}
+	})
+}
+
+func (c *Compressor) getEncoder(encoding string, w io.Writer) streamEncoder {
+	c.initStreamPools()
+
+	var enc streamEncoder
+	switch encoding {
+	case "br":
+		enc = c.streams.br.Get().(*brotli.Writer)
+	case "zstd":
+		enc = c.streams.zstd.Get().(zstdEncoder)
+	default:
+		enc = c.streams.gz.Get().(*gzip.Writer)
+	}
+	enc.Reset(w)
+	return enc
+}
+
+func (c *Compressor) putEncoder(encoding string, enc streamEncoder) {
+	// reset to io.Discard so the pool doesn't hold on to the response writer.
+	enc.Reset(io.Discard)
+	switch encoding {
+	case "br":
+		c.streams.br.Put(enc)
+	case "zstd":
+		c.streams.zstd.Put(enc)
+	default:
+		c.streams.gz.Put(enc)
+	}
+}
+
+// acceptedEncoding picks the best encoding the client accepts, preferring br, then
+// zstd, then gzip.  An empty string means the response should not be compressed.
+func acceptedEncoding(r *http.Request) string {
+	accepted := make(map[string]bool)
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q = f
+			}
+		}
+		accepted[strings.ToLower(name)] = q > 0
+	}
+
+	for _, encoding := range []string{"br", "zstd", "gzip"} {
+		if accepted[encoding] {
+			return encoding
+		}
+	}
+	return ""
+}
+
+type compressResponseWriter struct {
+	http.ResponseWriter
+	comp        *Compressor
+	encoding    string
+	enc         streamEncoder
+	code        int // status held back until the body starts
+	wroteHeader bool
+}
+
+// WriteHeader holds the status back until the first write or flush, so an empty body
+// is sent without an encoding.
+func (cw *compressResponseWriter) WriteHeader(code int) {
+	if code < http.StatusOK {
+		// informational responses, e.g. early hints, go out right away.
+		cw.ResponseWriter.WriteHeader(code)
+		return
+	}
+	if cw.wroteHeader || cw.code != 0 {
+		return
+	}
+	cw.code = code
+}
+
+// start writes the held back status.  The body is compressed unless it is empty, the
+// status has no body or the handler already encoded it.
+func (cw *compressResponseWriter) start(body bool) {
+	if cw.wroteHeader {
+		return
+	}
+	cw.wroteHeader = true
+
+	code := cw.code
+	if code == 0 {
+		code = http.StatusOK
+	}
+
+	h := cw.Header()
+	if body && h.Get("Content-Encoding") == "" && code != http.StatusNoContent && code != http.StatusNotModified {
+		h.Set("Content-Encoding", cw.encoding)
+		h.Del("Content-Length")
+		cw.enc = cw.comp.getEncoder(cw.encoding, cw.ResponseWriter)
+	}
+	h.Add("Vary", "Accept-Encoding")
+
+	cw.ResponseWriter.WriteHeader(code)
+}
+
+func (cw *compressResponseWriter) Write(b []byte) (int, error) {
+	if !cw.wroteHeader {
+		if len(b) == 0 {
+			return 0, nil
+		}
+		cw.start(true)
+	}
+	if cw.enc == nil {
+		return cw.ResponseWriter.Write(b)
+	}
+	return cw.enc.Write(b)
+}
+
+// Flush flushes the encoder and then the underlying writer so streamed
+// responses (server sent events, progress output) reach the client.
+func (cw *compressResponseWriter) Flush() {
+	cw.start(true)
+	if cw.enc != nil {
+		_ = cw.enc.Flush()
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (cw *compressResponseWriter) close() error {
+	// nothing was written, send the status without an encoding.
+	cw.start(false)
+	if cw.enc == nil {
+		return nil
+	}
+	err := cw.enc.Close()
+	cw.comp.putEncoder(cw.encoding, cw.enc)
+	cw.enc = nil
+	return err
+}
+
+// StreamCompress compresses the response of handlers that bypass the cache as it is
+// written, honoring the clients Accept-Encoding header.  Cached responses are already
+// compressed by their getters and should not use this middleware.  HEAD requests and
+// empty bodies are not encoded.
+func (s *Server) StreamCompress(f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		encoding := acceptedEncoding(r)
+		if encoding == "" || r.Method == http.MethodHead {
+			if encoding != "" {
+				w.Header().Add("Vary", "Accept-Encoding")
+			}
+			f(w, r)
+			return
+		}
+
+		cw := &compressResponseWriter{ResponseWriter: w, comp: s.Compressor, encoding: encoding}
+		defer func() {
+			if err := cw.close(); err != nil {
+				correlate.Log(r.Context(), s.Log).Err(err).Msgf("error closing %s stream for %s", encoding, r.URL.Path)
+			}
+		}()
+
+		f(cw, r)
+	}
+}
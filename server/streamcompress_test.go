@@ -0,0 +1,61 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestStreamCompress(t *testing.T) {
+	s := newStreamServer()
+	s.Compressor.config.Compression.Default.Gzip = 9
+	s.Compressor.config.Compression.Default.Zstd = 1
+	if level := s.Compressor.zstdLevel(); level != 1 {
+		t.Errorf("expected the zstd level of the config, got %d", level)
+	}
+
+	h := s.StreamCompress(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/empty" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		_, _ = w.Write([]byte("hello"))
+	})
+
+	tests := []struct {
+		method, path, encoding string
+	}{
+		{"GET", "/", "zstd"},
+		{"HEAD", "/", ""},
+		{"GET", "/empty", ""},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(tt.method, tt.path, nil)
+		r.Header.Set("Accept-Encoding", "zstd")
+		h(w, r)
+		if got := w.Header().Get("Content-Encoding"); got != tt.encoding {
+			t.Errorf("%s %s: expected encoding %q, got %q", tt.method, tt.path, tt.encoding, got)
+		}
+		if w.Header().Get("Vary") != "Accept-Encoding" {
+			t.Errorf("%s %s: expected Vary: Accept-Encoding", tt.method, tt.path)
+		}
+		if tt.encoding == "" {
+			continue
+		}
+		d, err := zstd.NewReader(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(d)
+		d.Close()
+		if err != nil || string(body) != "hello" {
+			t.Errorf("expected the body to decode, got %q %v", body, err)
+		}
+	}
+}
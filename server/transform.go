@@ -0,0 +1,182 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/cwbriscoe/goutil/net"
+)
+
+// TransformInfo describes the content being transformed.
+type TransformInfo struct {
+	Group       string
+	Key         string
+	ContentType string
+}
+
+// Transformer rewrites the uncompressed output of a getter before it is compressed and
+// stored in the cache.  Since the result is cached it must not depend on the request.
+type Transformer func(ctx context.Context, src []byte, info *TransformInfo) ([]byte, error)
+
+// AllGroups registers a transformer for every cache group.
+const AllGroups = "*"
+
+type transform struct {
+	name  string
+	order int
+	seq   int
+	f     Transformer
+}
+
+type transforms struct {
+	sync.RWMutex
+	seq    int
+	groups map[string][]transform
+}
+
+// AddTransformer registers a transformer for a cache group, or for all groups with
+// AllGroups.  Transformers run from the lowest to the highest order, transformers with
+// the same order run in the order they were added.  The transformers of AllGroups and
+// of the group are merged into one chain by the same rule.
+func (s *Server) AddTransformer(group string, order int, name string, f Transformer) {
+	s.transforms.Lock()
+	defer s.transforms.Unlock()
+	if s.transforms.groups == nil {
+		s.transforms.groups = make(map[string][]transform)
+	}
+	s.transforms.seq++
+	s.transforms.groups[group] = append(s.transforms.groups[group], transform{
+		name:  name,
+		order: order,
+		seq:   s.transforms.seq,
+		f:     f,
+	})
+}
+
+func (s *Server) transformChain(group string) []transform {
+	s.transforms.RLock()
+	defer s.transforms.RUnlock()
+
+	chain := append([]transform(nil), s.transforms.groups[AllGroups]...)
+	if group != AllGroups {
+		chain = append(chain, s.transforms.groups[group]...)
+	}
+	sort.Slice(chain, func(i, j int) bool {
+		if chain[i].order != chain[j].order {
+			return chain[i].order < chain[j].order
+		}
+		return chain[i].seq < chain[j].seq
+	})
+	return chain
+}
+
+// Transform runs the transformers registered for the group over src.  Getters that
+// compress their own output should call it before compressing.
+func (s *Server) Transform(ctx context.Context, info *TransformInfo, src []byte) ([]byte, error) {
+	var err error
+	for _, t := range s.transformChain(info.Group) {
+		if src, err = t.f(ctx, src, info); err != nil {
+			return nil, fmt.Errorf("transform %s: %w", t.name, err)
+		}
+	}
+	return src, nil
+}
+
+// Getter is the interface of the webcache getters.
+type Getter interface {
+	Get(ctx context.Context, key string) ([]byte, error)
+}
+
+type transformGetter struct {
+	svr         *Server
+	group       string
+	contentType string
+	getter      Getter
+}
+
+// TransformGetter wraps a getter that returns uncompressed content so the transformers
+// of the group run on its output, which is then compressed for the encoding in the key.
+func (s *Server) TransformGetter(group, contentType string, g Getter) Getter {
+	return &transformGetter{svr: s, group: group, contentType: contentType, getter: g}
+}
+
+// Get calls the wrapped getter, transforms and then compresses the result.
+func (t *transformGetter) Get(ctx context.Context, key string) ([]byte, error) {
+	src, err := t.getter.Get(ctx, key)
+	if err != nil || src == nil {
+		return src, err
+	}
+
+	src, err = t.svr.Transform(ctx, &TransformInfo{Group: t.group, Key: key, ContentType: t.contentType}, src)
+	if err != nil {
+		return nil, err
+	}
+
+	_, encoding := net.GetRequestParams(key)
+	if encoding == "" {
+		return src, nil
+	}
+	return t.svr.Compressor.Compress(encoding, t.contentType, src, false)
+}
+
+var (
+	reBetweenTags = regexp.MustCompile(`>\s*\n\s*<`)
+	rePreserved   = regexp.MustCompile(`(?is)<(pre|textarea|script|style)\b.*?</(pre|textarea|script|style)>`)
+	reRootLink    = regexp.MustCompile(`\b(href|src)="/[^/]`)
+)
+
+// MinifyHTML removes the whitespace between tags that contains a line break.  The
+// content of pre, textarea, script and style elements is left untouched.
+func MinifyHTML(_ context.Context, src []byte, info *TransformInfo) ([]byte, error) {
+	if !strings.HasPrefix(info.ContentType, "text/html") {
+		return src, nil
+	}
+
+	preserved := rePreserved.FindAllIndex(src, -1)
+	inPreserved := func(start, end int) bool {
+		for _, p := range preserved {
+			if start < p[1] && end > p[0] {
+				return true
+			}
+		}
+		return false
+	}
+
+	out := make([]byte, 0, len(src))
+	last := 0
+	for _, loc := range reBetweenTags.FindAllIndex(src, -1) {
+		// the whitespace is between the > and the < of the match.
+		if inPreserved(loc[0]+1, loc[1]-1) {
+			continue
+		}
+		out = append(out, src[last:loc[0]+1]...)
+		last = loc[1] - 1
+	}
+	return append(out, src[last:]...), nil
+}
+
+// RewriteLinks returns a transformer that prefixes the root relative href and src
+// attributes of html with prefix, e.g. the URLPrefix of the server config.  Protocol
+// relative urls (//host/path) are left alone.
+func RewriteLinks(prefix string) Transformer {
+	prefix = strings.TrimSuffix(prefix, "/")
+	return func(_ context.Context, src []byte, info *TransformInfo) ([]byte, error) {
+		if !strings.HasPrefix(info.ContentType, "text/html") || prefix == "" {
+			return src, nil
+		}
+		return reRootLink.ReplaceAllFunc(src, func(m []byte) []byte {
+			// m is (href|src)="/ followed by one char that is not a slash.
+			eq := bytes.IndexByte(m, '=')
+			out := append([]byte(nil), m[:eq+2]...)
+			out = append(out, prefix...)
+			return append(out, m[eq+2:]...)
+		}), nil
+	}
+}
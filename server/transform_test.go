@@ -0,0 +1,48 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package server
+
+import (
+	"context"
+	"testing"
+)
+
+func TestTransformOrder(t *testing.T) {
+	s := &Server{}
+	appender := func(tag string) Transformer {
+		return func(_ context.Context, src []byte, _ *TransformInfo) ([]byte, error) {
+			return append(src, tag...), nil
+		}
+	}
+	s.AddTransformer("page", 20, "c", appender("c"))
+	s.AddTransformer(AllGroups, 10, "a", appender("a"))
+	s.AddTransformer("page", 10, "b", appender("b"))
+	s.AddTransformer("other", 0, "x", appender("x"))
+
+	out, err := s.Transform(context.Background(), &TransformInfo{Group: "page"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "abc" {
+		t.Errorf("expected abc, got %s", out)
+	}
+}
+
+func TestMinifyHTML(t *testing.T) {
+	src := "<div>\n  <p>hi</p>\n</div>\n<pre>\n  <b>keep</b>\n</pre>"
+	out, _ := MinifyHTML(context.Background(), []byte(src), &TransformInfo{ContentType: "text/html"})
+	want := "<div><p>hi</p></div><pre>\n  <b>keep</b>\n</pre>"
+	if string(out) != want {
+		t.Errorf("expected %q, got %q", want, out)
+	}
+}
+
+func TestRewriteLinks(t *testing.T) {
+	f := RewriteLinks("https://example.com/")
+	src := `<a href="/">home</a><img src="/a.png"><script src="//cdn.com/x.js"></script><a href="http://x.com/">x</a>`
+	out, _ := f(context.Background(), []byte(src), &TransformInfo{ContentType: "text/html"})
+	want := `<a href="https://example.com/">home</a><img src="https://example.com/a.png"><script src="//cdn.com/x.js"></script><a href="http://x.com/">x</a>`
+	if string(out) != want {
+		t.Errorf("expected %q, got %q", want, out)
+	}
+}
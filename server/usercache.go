@@ -0,0 +1,280 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cwbriscoe/goweb/auth"
+)
+
+const (
+	defaultUserCacheTTL = 30 * time.Second
+	maxUserCacheEntries = 50000 // entries of all users and groups, new ones are dropped past it
+	maxUserCacheBody    = 256 * 1024
+)
+
+// userCacheEntry is a cached json response of a user.
+type userCacheEntry struct {
+	header  http.Header
+	body    []byte
+	etag    string
+	expires time.Time
+}
+
+// userCache stores the json responses of signed in users by group, user and key.  It is
+// separate from the shared cache since the entries are private, short lived and are
+// invalidated per user.
+type userCache struct {
+	sync.Mutex
+	groups    map[string]map[int]map[string]*userCacheEntry
+	gens      map[string]map[int]uint64 // bumped on invalidation, so stale responses aren't stored
+	groupGens map[string]uint64
+	entries   int
+}
+
+// gen returns the generation of the entries of the user in the group.
+func (c *userCache) gen(group string, userID int) uint64 {
+	c.Lock()
+	defer c.Unlock()
+	return c.genLocked(group, userID)
+}
+
+func (c *userCache) genLocked(group string, userID int) uint64 {
+	return c.groupGens[group] + c.gens[group][userID]
+}
+
+func (c *userCache) get(group string, userID int, key string) *userCacheEntry {
+	c.Lock()
+	defer c.Unlock()
+	entry := c.groups[group][userID][key]
+	if entry == nil || time.Now().After(entry.expires) {
+		return nil
+	}
+	return entry
+}
+
+// set stores the entry unless the entries of the user were invalidated since gen.
+func (c *userCache) set(group string, userID int, key string, gen uint64, entry *userCacheEntry) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.genLocked(group, userID) != gen {
+		return false
+	}
+	if c.entries >= maxUserCacheEntries {
+		c.purgeLocked()
+		if c.entries >= maxUserCacheEntries {
+			return false
+		}
+	}
+
+	if c.groups == nil {
+		c.groups = make(map[string]map[int]map[string]*userCacheEntry)
+	}
+	users, ok := c.groups[group]
+	if !ok {
+		users = make(map[int]map[string]*userCacheEntry)
+		c.groups[group] = users
+	}
+	keys, ok := users[userID]
+	if !ok {
+		keys = make(map[string]*userCacheEntry)
+		users[userID] = keys
+	}
+	if _, ok = keys[key]; !ok {
+		c.entries++
+	}
+	keys[key] = entry
+	return true
+}
+
+// invalidate deletes the entries of the user in the group.
+func (c *userCache) invalidate(group string, userID int) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.gens == nil {
+		c.gens = make(map[string]map[int]uint64)
+	}
+	gens, ok := c.gens[group]
+	if !ok {
+		gens = make(map[int]uint64)
+		c.gens[group] = gens
+	}
+	gens[userID]++
+
+	c.entries -= len(c.groups[group][userID])
+	delete(c.groups[group], userID)
+}
+
+// invalidateGroup deletes the entries of all users in the group and returns how many
+// were deleted.
+func (c *userCache) invalidateGroup(group string) int {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.groupGens == nil {
+		c.groupGens = make(map[string]uint64)
+	}
+	c.groupGens[group]++
+
+	deleted := 0
+	for _, keys := range c.groups[group] {
+		deleted += len(keys)
+	}
+	c.entries -= deleted
+	delete(c.groups, group)
+	return deleted
+}
+
+// groupNames returns the groups with cached entries.
+func (c *userCache) groupNames() []string {
+	c.Lock()
+	defer c.Unlock()
+	groups := make([]string, 0, len(c.groups))
+	for group := range c.groups {
+		groups = append(groups, group)
+	}
+	return groups
+}
+
+func (c *userCache) purgeLocked() {
+	now := time.Now()
+	for _, users := range c.groups {
+		for userID, keys := range users {
+			for key, entry := range keys {
+				if now.After(entry.expires) {
+					delete(keys, key)
+					c.entries--
+				}
+			}
+			if len(keys) == 0 {
+				delete(users, userID)
+			}
+		}
+	}
+}
+
+// bufferedResponse records a response so it can be cached before it is written.
+type bufferedResponse struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header { return b.header }
+
+func (b *bufferedResponse) WriteHeader(code int) {
+	if b.code == 0 {
+		b.code = code
+	}
+}
+
+func (b *bufferedResponse) Write(data []byte) (int, error) {
+	if b.code == 0 {
+		b.code = http.StatusOK
+	}
+	return b.body.Write(data)
+}
+
+// UserCache caches the json responses of the handler for each signed in user, keyed by
+// the route and the parts of the request in opts, for ttl or 30 seconds when zero.  It
+// is meant for dashboard style endpoints users keep refreshing.  Only 200 responses are
+// cached and requests without a user are passed through.  Wrap the handlers that change
+// the data with InvalidateUserCache, or call InvalidateUser, so users see their own
+// writes.
+func (s *Server) UserCache(group string, ttl time.Duration, opts *KeyOptions, f http.HandlerFunc) http.HandlerFunc {
+	if ttl <= 0 {
+		ttl = defaultUserCacheTTL
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := auth.UserFromContext(r.Context())
+		if user == nil || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+			f(w, r)
+			return
+		}
+
+		key := r.URL.Path + "|" + s.CacheKey(r, opts)
+		entry := s.userCache.get(group, user.ID, key)
+		if entry == nil {
+			gen := s.userCache.gen(group, user.ID)
+			resp := &bufferedResponse{header: make(http.Header)}
+			f(resp, r)
+
+			if resp.code != http.StatusOK || resp.body.Len() > maxUserCacheBody {
+				writeBuffered(w, resp)
+				return
+			}
+
+			// the cookies set for this request must not be replayed on the next ones.
+			header := resp.header.Clone()
+			header.Del("Set-Cookie")
+			sum := sha256.Sum256(resp.body.Bytes())
+			entry = &userCacheEntry{
+				header:  header,
+				body:    resp.body.Bytes(),
+				etag:    "\"" + hex.EncodeToString(sum[:8]) + "\"",
+				expires: time.Now().Add(ttl),
+			}
+			s.userCache.set(group, user.ID, key, gen, entry)
+			if cookies := resp.header.Values("Set-Cookie"); len(cookies) > 0 {
+				w.Header()["Set-Cookie"] = cookies
+			}
+		}
+
+		for name, values := range entry.header {
+			w.Header()[name] = append([]string(nil), values...)
+		}
+		w.Header().Set("ETag", entry.etag)
+		w.Header().Set("Cache-Control", "private, no-cache")
+		w.Header().Add("Vary", "Cookie")
+
+		if r.Header.Get("If-None-Match") == entry.etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(entry.body)
+	}
+}
+
+func writeBuffered(w http.ResponseWriter, resp *bufferedResponse) {
+	for name, values := range resp.header {
+		w.Header()[name] = values
+	}
+	if resp.code != 0 {
+		w.WriteHeader(resp.code)
+	}
+	_, _ = w.Write(resp.body.Bytes())
+}
+
+// InvalidateUserCache deletes the cached responses of the user in the groups after the
+// handler returns a 2xx status.
+func (s *Server) InvalidateUserCache(groups []string, f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		lrw := newLoggingResponseWriter(w)
+		f(lrw, r)
+
+		if lrw.statusCode < 200 || lrw.statusCode > 299 {
+			return
+		}
+		if user := auth.UserFromContext(r.Context()); user != nil {
+			for _, group := range groups {
+				s.InvalidateUser(group, user.ID)
+			}
+		}
+	}
+}
+
+// InvalidateUser deletes the cached responses of the user in the group on this server
+// and its peers, ie: after an admin or a job changed their data.
+func (s *Server) InvalidateUser(group string, userID int) {
+	s.userCache.invalidate(group, userID)
+	s.broadcastUser(group, userID)
+}
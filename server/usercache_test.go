@@ -0,0 +1,51 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUserCache(t *testing.T) {
+	var c userCache
+	entry := func(ttl time.Duration) *userCacheEntry {
+		return &userCacheEntry{body: []byte("{}"), expires: time.Now().Add(ttl)}
+	}
+
+	gen := c.gen("dash", 1)
+	if !c.set("dash", 1, "/a", gen, entry(time.Minute)) || c.get("dash", 1, "/a") == nil {
+		t.Fatal("expected the entry to be cached")
+	}
+	if c.get("dash", 2, "/a") != nil {
+		t.Error("expected no entry for another user")
+	}
+
+	c.set("dash", 1, "/old", gen, entry(-time.Second))
+	if c.get("dash", 1, "/old") != nil {
+		t.Error("expected the expired entry to be skipped")
+	}
+
+	// a response read before the invalidation is not stored after it.
+	gen = c.gen("dash", 1)
+	c.invalidate("dash", 1)
+	if c.get("dash", 1, "/a") != nil {
+		t.Error("expected the entries of the user to be invalidated")
+	}
+	if c.set("dash", 1, "/a", gen, entry(time.Minute)) {
+		t.Error("expected a stale response not to be stored")
+	}
+
+	gen2 := c.gen("dash", 2)
+	c.set("dash", 2, "/a", gen2, entry(time.Minute))
+	gen = c.gen("dash", 3)
+	if deleted := c.invalidateGroup("dash"); deleted != 1 {
+		t.Errorf("expected 1 entry deleted, got %d", deleted)
+	}
+	if c.set("dash", 3, "/a", gen, entry(time.Minute)) {
+		t.Error("expected a stale response not to be stored after the group was invalidated")
+	}
+	if c.entries != 0 {
+		t.Errorf("expected no entries left, got %d", c.entries)
+	}
+}
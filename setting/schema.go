@@ -0,0 +1,58 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package setting
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// CreateSchema will create the setting schema and associated tables needed
+// for this package to run
+func CreateSchema(ctx context.Context, conn *pgx.Conn) error {
+	var sql string
+	var err error
+
+	sql = "drop schema if exists setting cascade;"
+	_, err = conn.Exec(ctx, sql)
+	if err != nil {
+		return err
+	}
+
+	sql = "create schema setting authorization current_role;"
+	_, err = conn.Exec(ctx, sql)
+	if err != nil {
+		return err
+	}
+
+	sql = `
+	CREATE TABLE setting.setting (
+		"key" varchar NOT NULL,
+		"type" varchar NOT NULL,
+		value varchar NOT NULL,
+		description varchar NOT NULL,
+		"version" int4 NOT NULL DEFAULT 1,
+		update_ts timestamptz NOT NULL,
+		update_by varchar NOT NULL,
+		CONSTRAINT setting_pk PRIMARY KEY ("key")
+	);`
+	_, err = conn.Exec(ctx, sql)
+	if err != nil {
+		return err
+	}
+
+	sql = "grant select, insert, update on table setting.setting to api;"
+	_, err = conn.Exec(ctx, sql)
+	if err != nil {
+		return err
+	}
+
+	sql = "grant select on table setting.setting to job;"
+	_, err = conn.Exec(ctx, sql)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
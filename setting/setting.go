@@ -0,0 +1,377 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+// Package setting stores typed settings in postgres so they can be changed at runtime
+// without a config redeploy.  Values are cached in memory and reloaded on every server
+// when one of them changes.
+package setting
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cwbriscoe/goweb/query"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// DefaultSchema is the schema with the settings table.
+const DefaultSchema query.Schema = "setting"
+
+// Channel is the postgres channel the key of a changed setting is sent on, so every
+// server reloads it.
+const Channel = "setting"
+
+// Type is the type of the value of a setting.
+type Type string
+
+// The setting types.
+const (
+	String   Type = "string"
+	Int      Type = "int"
+	Float    Type = "float"
+	Bool     Type = "bool"
+	Duration Type = "duration" // parsed by time.ParseDuration, ie: "90s"
+)
+
+var (
+	// ErrNotFound is returned for a setting that is not defined.
+	ErrNotFound = errors.New("setting not found")
+	// ErrInvalidValue is returned for a value that does not match the type of the setting.
+	ErrInvalidValue = errors.New("invalid setting value")
+)
+
+// Setting is a single typed value.  Values are stored as text and checked against the
+// type whenever they are written.
+type Setting struct {
+	Key         string    `json:"key"`
+	Type        Type      `json:"type"`
+	Value       string    `json:"value"`
+	Description string    `json:"description"`
+	Version     int       `json:"version"` // send back with changes to detect concurrent edits
+	Updated     time.Time `json:"updated"`
+	UpdatedBy   string    `json:"updatedBy"`
+}
+
+// Check returns an error if value is not valid for the type.
+func (t Type) Check(value string) error {
+	var err error
+	switch t {
+	case String:
+	case Int:
+		_, err = strconv.ParseInt(value, 10, 64)
+	case Float:
+		_, err = strconv.ParseFloat(value, 64)
+	case Bool:
+		_, err = strconv.ParseBool(value)
+	case Duration:
+		_, err = time.ParseDuration(value)
+	default:
+		return fmt.Errorf("%w: unknown setting type %q", ErrInvalidValue, t)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %q is not a valid %s", ErrInvalidValue, value, t)
+	}
+	return nil
+}
+
+var (
+	qDefineSetting = query.Query{
+		Name: "defineSetting",
+		SQL: `
+insert into {schema}.setting (key, type, value, description, version, update_ts, update_by)
+values ($1, $2, $3, $4, 1, now(), 'default')
+on conflict (key) do update set type = excluded.type, description = excluded.description;`,
+	}
+	qAllSettings = query.Query{
+		Name: "allSettings",
+		SQL:  "select key, type, value, description, version, update_ts, update_by from {schema}.setting order by key;",
+	}
+	qGetSetting = query.Query{
+		Name: "getSetting",
+		SQL:  "select key, type, value, description, version, update_ts, update_by from {schema}.setting where key = $1;",
+	}
+	qUpdateSetting = query.Query{
+		Name: "updateSetting",
+		SQL: `
+update {schema}.setting
+   set value = $2, version = version + 1, update_ts = now(), update_by = $4
+ where key = $1
+   and version = $3
+returning version, update_ts;`,
+	}
+	qNotifySetting = query.Query{
+		Name: "notifySetting",
+		SQL:  "select pg_notify('" + Channel + "', $1);",
+	}
+)
+
+// Settings contains the settings for a Store.
+type Settings struct {
+	DB     *pgxpool.Pool
+	Schema string // defaults to "setting"
+}
+
+// Store caches the settings and writes changes.
+type Store struct {
+	db       *pgxpool.Pool
+	schema   query.Schema
+	mu       sync.RWMutex
+	values   map[string]*Setting
+	watchers []func(*Setting)
+}
+
+// NewStore returns a Store using the settings.  Call Load before reading values.
+func NewStore(settings *Settings) *Store {
+	store := &Store{
+		db:     settings.DB,
+		schema: DefaultSchema,
+		values: make(map[string]*Setting),
+	}
+	if settings.Schema != "" {
+		store.schema = query.Schema(settings.Schema)
+	}
+	return store
+}
+
+// Define adds the setting with its default value if it does not exist yet.  The type
+// and description of an existing setting are updated and its value is kept.
+func (s *Store) Define(ctx context.Context, key string, typ Type, value, description string) error {
+	if err := typ.Check(value); err != nil {
+		return err
+	}
+	if _, err := s.schema.Exec(ctx, s.db, qDefineSetting, key, typ, value, description); err != nil {
+		return err
+	}
+	return s.Reload(ctx, key)
+}
+
+// Load reads every setting into the cache and tells the watchers about the values that
+// changed since the last load, ie: while the change notifications were missed.
+func (s *Store) Load(ctx context.Context) error {
+	rows, err := s.schema.Query(ctx, s.db, qAllSettings)
+	if err != nil {
+		return err
+	}
+	list, err := pgx.CollectRows(rows, scanSetting)
+	if err != nil {
+		return query.Wrap(qAllSettings, err)
+	}
+
+	s.replace(list)
+	return nil
+}
+
+// replace swaps the cache for the settings and tells the watchers about the values
+// that changed.
+func (s *Store) replace(list []*Setting) {
+	values := make(map[string]*Setting, len(list))
+	for _, setting := range list {
+		values[setting.Key] = setting
+	}
+
+	s.mu.Lock()
+	old := s.values
+	s.values = values
+	watchers := s.watchers
+	s.mu.Unlock()
+
+	for _, setting := range list {
+		if prev, ok := old[setting.Key]; !ok || prev.Value != setting.Value {
+			notify(watchers, setting)
+		}
+	}
+}
+
+// Reload reads the setting into the cache and tells the watchers about the change.
+func (s *Store) Reload(ctx context.Context, key string) error {
+	rows, err := s.schema.Query(ctx, s.db, qGetSetting, key)
+	if err != nil {
+		return err
+	}
+	setting, err := pgx.CollectOneRow(rows, scanSetting)
+	if errors.Is(err, pgx.ErrNoRows) {
+		s.mu.Lock()
+		delete(s.values, key)
+		s.mu.Unlock()
+		return nil
+	}
+	if err != nil {
+		return query.Wrap(qGetSetting, err)
+	}
+
+	s.cache(setting)
+	return nil
+}
+
+// cache stores the setting and tells the watchers if its value changed.
+func (s *Store) cache(setting *Setting) {
+	s.mu.Lock()
+	old, ok := s.values[setting.Key]
+	s.values[setting.Key] = setting
+	watchers := s.watchers
+	s.mu.Unlock()
+
+	if !ok || old.Value != setting.Value {
+		notify(watchers, setting)
+	}
+}
+
+// notify calls the watchers with a copy of the setting.
+func notify(watchers []func(*Setting), setting *Setting) {
+	for _, f := range watchers {
+		c := *setting
+		f(&c)
+	}
+}
+
+// Watch calls f after the value of a setting changed on any server.
+func (s *Store) Watch(f func(*Setting)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.watchers = append(s.watchers, f)
+}
+
+// Set changes the value of the setting and tells every server to reload it.  It returns
+// query.ErrConflict if the setting changed since that version was read.
+func (s *Store) Set(ctx context.Context, key, value string, version int, actor string) (*Setting, error) {
+	setting := s.Get(key)
+	if setting == nil {
+		return nil, ErrNotFound
+	}
+	if err := setting.Type.Check(value); err != nil {
+		return nil, err
+	}
+	if version < 1 {
+		return nil, query.ErrNoVersion
+	}
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	err = s.schema.QueryRow(ctx, tx, qUpdateSetting, key, value, version, actor).Scan(&setting.Version, &setting.Updated)
+	if errors.Is(err, pgx.ErrNoRows) {
+		err = s.schema.VersionMismatch(ctx, tx, "setting", "key = $1", key)
+		if errors.Is(err, pgx.ErrNoRows) {
+			err = ErrNotFound
+		}
+		return nil, err
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = s.schema.Exec(ctx, tx, qNotifySetting, key); err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+
+	setting.Value = value
+	setting.UpdatedBy = actor
+	c := *setting
+	s.cache(&c)
+	return setting, nil
+}
+
+// All returns a copy of every cached setting, ordered by key.
+func (s *Store) All() []*Setting {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	list := make([]*Setting, 0, len(s.values))
+	for _, setting := range s.values {
+		c := *setting
+		list = append(list, &c)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Key < list[j].Key })
+	return list
+}
+
+// Get returns a copy of the cached setting or nil if it is not defined.
+func (s *Store) Get(key string) *Setting {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	setting, ok := s.values[key]
+	if !ok {
+		return nil
+	}
+	c := *setting
+	return &c
+}
+
+// value returns the cached value of the setting if it has the type.
+func (s *Store) value(key string, typ Type) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	setting, ok := s.values[key]
+	if !ok || setting.Type != typ {
+		return "", false
+	}
+	return setting.Value, true
+}
+
+// String returns the value of the string setting or def if it is not defined.
+func (s *Store) String(key, def string) string {
+	if v, ok := s.value(key, String); ok {
+		return v
+	}
+	return def
+}
+
+// Int returns the value of the int setting or def if it is not defined.
+func (s *Store) Int(key string, def int) int {
+	if v, ok := s.value(key, Int); ok {
+		if i, err := strconv.Atoi(v); err == nil {
+			return i
+		}
+	}
+	return def
+}
+
+// Float returns the value of the float setting or def if it is not defined.
+func (s *Store) Float(key string, def float64) float64 {
+	if v, ok := s.value(key, Float); ok {
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			return f
+		}
+	}
+	return def
+}
+
+// Bool returns the value of the bool setting or def if it is not defined.
+func (s *Store) Bool(key string, def bool) bool {
+	if v, ok := s.value(key, Bool); ok {
+		if b, err := strconv.ParseBool(v); err == nil {
+			return b
+		}
+	}
+	return def
+}
+
+// Duration returns the value of the duration setting or def if it is not defined.
+func (s *Store) Duration(key string, def time.Duration) time.Duration {
+	if v, ok := s.value(key, Duration); ok {
+		if d, err := time.ParseDuration(v); err == nil {
+			return d
+		}
+	}
+	return def
+}
+
+func scanSetting(row pgx.CollectableRow) (*Setting, error) {
+	s := &Setting{}
+	err := row.Scan(&s.Key, &s.Type, &s.Value, &s.Description, &s.Version, &s.Updated, &s.UpdatedBy)
+	return s, err
+}
@@ -0,0 +1,99 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package setting
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		typ   Type
+		value string
+		valid bool
+	}{
+		{String, "", true},
+		{Int, "42", true},
+		{Int, "4.2", false},
+		{Float, "4.2", true},
+		{Float, "four", false},
+		{Bool, "true", true},
+		{Bool, "yes", false},
+		{Duration, "90s", true},
+		{Duration, "90", false},
+		{Type("json"), "{}", false},
+	}
+	for _, test := range tests {
+		if err := test.typ.Check(test.value); (err == nil) != test.valid {
+			t.Errorf("%s %q: expected valid=%v, got %v", test.typ, test.value, test.valid, err)
+		}
+	}
+}
+
+func TestAccessors(t *testing.T) {
+	s := NewStore(&Settings{})
+	s.values["name"] = &Setting{Key: "name", Type: String, Value: "goweb"}
+	s.values["max"] = &Setting{Key: "max", Type: Int, Value: "10"}
+	s.values["ratio"] = &Setting{Key: "ratio", Type: Float, Value: "0.5"}
+	s.values["on"] = &Setting{Key: "on", Type: Bool, Value: "true"}
+	s.values["ttl"] = &Setting{Key: "ttl", Type: Duration, Value: "5m"}
+
+	if v := s.String("name", ""); v != "goweb" {
+		t.Errorf("expected goweb, got %s", v)
+	}
+	if v := s.Int("max", 1); v != 10 {
+		t.Errorf("expected 10, got %d", v)
+	}
+	if v := s.Float("ratio", 1); v != 0.5 {
+		t.Errorf("expected 0.5, got %f", v)
+	}
+	if v := s.Bool("on", false); !v {
+		t.Error("expected true")
+	}
+	if v := s.Duration("ttl", time.Second); v != 5*time.Minute {
+		t.Errorf("expected 5m, got %s", v)
+	}
+
+	// missing settings and settings of another type return the default
+	if v := s.Int("missing", 3); v != 3 {
+		t.Errorf("expected 3, got %d", v)
+	}
+	if v := s.Int("name", 3); v != 3 {
+		t.Errorf("expected 3, got %d", v)
+	}
+
+	list := s.All()
+	if len(list) != 5 || list[0].Key != "max" || list[4].Key != "ttl" {
+		t.Errorf("unexpected list order")
+	}
+	list[0].Value = "changed"
+	if s.Int("max", 1) != 10 {
+		t.Error("All should return copies")
+	}
+}
+
+func TestReplace(t *testing.T) {
+	s := NewStore(&Settings{})
+	s.values["name"] = &Setting{Key: "name", Type: String, Value: "goweb"}
+	s.values["max"] = &Setting{Key: "max", Type: Int, Value: "10"}
+	s.values["gone"] = &Setting{Key: "gone", Type: Bool, Value: "true"}
+
+	var changed []string
+	s.Watch(func(setting *Setting) {
+		changed = append(changed, setting.Key+"="+setting.Value)
+	})
+
+	// only the settings changed while the notifications were missed are reported.
+	s.replace([]*Setting{
+		{Key: "max", Type: Int, Value: "20"},
+		{Key: "name", Type: String, Value: "goweb"},
+		{Key: "ttl", Type: Duration, Value: "5m"},
+	})
+	if len(changed) != 2 || changed[0] != "max=20" || changed[1] != "ttl=5m" {
+		t.Errorf("expected max and ttl to be reported, got %v", changed)
+	}
+	if s.Get("gone") != nil || s.Int("max", 1) != 20 {
+		t.Error("expected the cache to be replaced")
+	}
+}
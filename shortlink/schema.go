@@ -0,0 +1,84 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package shortlink
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// CreateSchema will create the shortlink schema and associated tables needed
+// for this package to run
+func CreateSchema(ctx context.Context, conn *pgx.Conn) error {
+	var sql string
+	var err error
+
+	sql = "drop schema if exists shortlink cascade;"
+	_, err = conn.Exec(ctx, sql)
+	if err != nil {
+		return err
+	}
+
+	sql = "create schema shortlink authorization current_role;"
+	_, err = conn.Exec(ctx, sql)
+	if err != nil {
+		return err
+	}
+
+	sql = `
+	CREATE TABLE shortlink.link (
+		code varchar NOT NULL,
+		url varchar NOT NULL,
+		owner_id int4 NOT NULL,
+		create_ts timestamptz NOT NULL,
+		expire_ts timestamptz NULL,
+		clicks int8 NOT NULL DEFAULT 0,
+		disabled bool NOT NULL DEFAULT false,
+		reason varchar NULL,
+		deleted_at timestamptz NULL,
+		CONSTRAINT link_pk PRIMARY KEY (code)
+	);`
+	_, err = conn.Exec(ctx, sql)
+	if err != nil {
+		return err
+	}
+
+	sql = "CREATE INDEX link_owner_idx ON shortlink.link (owner_id, create_ts);"
+	_, err = conn.Exec(ctx, sql)
+	if err != nil {
+		return err
+	}
+
+	sql = `
+	CREATE TABLE shortlink.click (
+		code varchar NOT NULL REFERENCES shortlink.link (code) ON DELETE CASCADE,
+		tracker_id varchar NOT NULL,
+		referer varchar NOT NULL,
+		click_ts timestamptz NOT NULL
+	);`
+	_, err = conn.Exec(ctx, sql)
+	if err != nil {
+		return err
+	}
+
+	sql = "CREATE INDEX click_code_idx ON shortlink.click (code, click_ts);"
+	_, err = conn.Exec(ctx, sql)
+	if err != nil {
+		return err
+	}
+
+	sql = "grant select, insert, update, delete on table shortlink.link, shortlink.click to api;"
+	_, err = conn.Exec(ctx, sql)
+	if err != nil {
+		return err
+	}
+
+	sql = "grant select, delete on table shortlink.link, shortlink.click to job;"
+	_, err = conn.Exec(ctx, sql)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,335 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+// Package shortlink maps short codes minted by users to urls and counts the clicks
+package shortlink
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"math/big"
+	"net/url"
+	"time"
+
+	"github.com/cwbriscoe/goutil/db"
+	"github.com/cwbriscoe/goweb/query"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// DefaultSchema is the schema with the shortlink tables.
+const DefaultSchema query.Schema = "shortlink"
+
+const (
+	codeLen      = 7
+	codeAlphabet = "0123456789abcdefghijkmnopqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ"
+	maxURLLen    = 2048
+	createTries  = 5
+)
+
+var (
+	// ErrNotFound is returned when a code does not exist.
+	ErrNotFound = errors.New("shortlink not found")
+	// ErrExpired is returned when resolving a link past its expiration.
+	ErrExpired = errors.New("shortlink expired")
+	// ErrDisabled is returned when resolving a link disabled by a moderator.
+	ErrDisabled = errors.New("shortlink disabled")
+	// ErrInvalidURL is returned when the target is not an absolute http(s) url.
+	ErrInvalidURL = errors.New("shortlink url must be an absolute http or https url")
+)
+
+// Link is a short code and the url it redirects to.
+type Link struct {
+	Code     string     `json:"code"`
+	URL      string     `json:"url"`
+	Owner    int        `json:"owner"`
+	Created  time.Time  `json:"created"`
+	Expires  *time.Time `json:"expires,omitempty"`
+	Clicks   int64      `json:"clicks"`
+	Disabled bool       `json:"disabled"`
+	Reason   string     `json:"reason,omitempty"`  // why a moderator disabled the link
+	Deleted  *time.Time `json:"deleted,omitempty"` // only listed for moderators, until it is purged
+}
+
+// Click is a single resolution of a link.
+type Click struct {
+	Code      string    `json:"code"`
+	TrackerID string    `json:"trackerId"`
+	Referer   string    `json:"referer"`
+	Time      time.Time `json:"time"`
+}
+
+// Settings contains the settings for a Store.
+type Settings struct {
+	DB     *pgxpool.Pool
+	Schema string // defaults to "shortlink"
+}
+
+// Store creates, resolves and moderates short links.
+type Store struct {
+	db     *pgxpool.Pool
+	schema query.Schema
+}
+
+var (
+	qInsertLink = query.Query{
+		Name: "insertLink",
+		SQL: `
+insert into {schema}.link (code, url, owner_id, create_ts, expire_ts)
+values ($1, $2, $3, now(), $4)
+returning create_ts;`,
+	}
+	qResolveLink = query.Query{
+		Name: "resolveLink",
+		SQL:  "select url, expire_ts, disabled from {schema}.link where code = $1 and {live};",
+	}
+	qInsertClick = query.Query{
+		Name: "insertClick",
+		SQL:  "insert into {schema}.click (code, tracker_id, referer, click_ts) values ($1, $2, $3, $4);",
+	}
+	qIncrementClicks = query.Query{
+		Name: "incrementClicks",
+		SQL:  "update {schema}.link set clicks = clicks + 1 where code = $1;",
+	}
+	qOwnerLinks = query.Query{
+		Name: "ownerLinks",
+		SQL: `
+select code, url, owner_id, create_ts, expire_ts, clicks, disabled, coalesce(reason, ''), deleted_at
+  from {schema}.link
+ where owner_id = $1
+   and {live}
+ order by create_ts desc;`,
+	}
+	qRecentLinks = query.Query{
+		Name: "recentLinks",
+		SQL: `
+select code, url, owner_id, create_ts, expire_ts, clicks, disabled, coalesce(reason, ''), deleted_at
+  from {schema}.link
+ order by create_ts desc
+ limit $1;`,
+	}
+	qModerateLink = query.Query{
+		Name: "moderateLink",
+		SQL:  "update {schema}.link set disabled = $2, reason = nullif($3, '') where code = $1;",
+	}
+	qTrackerClicks = query.Query{
+		Name: "trackerClicks",
+		SQL:  "select code, tracker_id, referer, click_ts from {schema}.click where tracker_id = any($1) order by click_ts;",
+	}
+	qDeleteTrackerClicks = query.Query{
+		Name: "deleteTrackerClicks",
+		SQL:  "delete from {schema}.click where tracker_id = any($1);",
+	}
+	qPurgeLinks = query.Query{
+		Name: "purgeLinks",
+		SQL:  "delete from {schema}.link where expire_ts < $1;",
+	}
+)
+
+// NewStore returns a Store for the settings.
+func NewStore(settings *Settings) *Store {
+	st := &Store{
+		db:     settings.DB,
+		schema: DefaultSchema,
+	}
+	if settings.Schema != "" {
+		st.schema = query.Schema(settings.Schema)
+	}
+	return st
+}
+
+// ValidURL reports if the url can be the target of a link.
+func ValidURL(raw string) bool {
+	if raw == "" || len(raw) > maxURLLen {
+		return false
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return false
+	}
+	return (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// newCode returns a random code.
+func newCode() (string, error) {
+	code := make([]byte, codeLen)
+	max := big.NewInt(int64(len(codeAlphabet)))
+	for i := range code {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		code[i] = codeAlphabet[n.Int64()]
+	}
+	return string(code), nil
+}
+
+// Create mints a new code for the url owned by the user.  A ttl of zero never expires.
+func (st *Store) Create(ctx context.Context, owner int, target string, ttl time.Duration) (*Link, error) {
+	if !ValidURL(target) {
+		return nil, ErrInvalidURL
+	}
+
+	link := &Link{URL: target, Owner: owner}
+	if ttl > 0 {
+		expires := time.Now().Add(ttl)
+		link.Expires = &expires
+	}
+
+	// retry on the unlikely chance the random code is already taken.
+	for i := 0; i < createTries; i++ {
+		code, err := newCode()
+		if err != nil {
+			return nil, err
+		}
+		err = st.schema.QueryRow(ctx, st.db, qInsertLink, code, target, owner, link.Expires).Scan(&link.Created)
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		link.Code = code
+		return link, nil
+	}
+	return nil, errors.New("shortlink: could not find an unused code")
+}
+
+// Resolve returns the url of the code.
+func (st *Store) Resolve(ctx context.Context, code string) (string, error) {
+	var target string
+	var expires *time.Time
+	var disabled bool
+	err := st.schema.QueryRow(ctx, st.db, qResolveLink, code).Scan(&target, &expires, &disabled)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", ErrNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	if disabled {
+		return "", ErrDisabled
+	}
+	if expires != nil && time.Now().After(*expires) {
+		return "", ErrExpired
+	}
+	return target, nil
+}
+
+// RecordClick stores a click and increments the click count of the link.
+func (st *Store) RecordClick(ctx context.Context, click *Click) error {
+	batch := db.NewBatch(ctx, st.db)
+	batch.Queue(st.schema.SQL(qInsertClick), click.Code, click.TrackerID, click.Referer, click.Time)
+	batch.Queue(st.schema.SQL(qIncrementClicks), click.Code)
+	_, err := batch.Exec()
+	return query.Wrap(qInsertClick, err)
+}
+
+// ExportTrackers returns the clicks of the tracking ids, it makes the Store an
+// auth.TrackerData so the clicks are part of the privacy requests of a user.
+func (st *Store) ExportTrackers(ctx context.Context, ids []string) (any, error) {
+	rows, err := st.schema.Query(ctx, st.db, qTrackerClicks, ids)
+	if err != nil {
+		return nil, err
+	}
+	clicks, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (*Click, error) {
+		click := &Click{}
+		err := row.Scan(&click.Code, &click.TrackerID, &click.Referer, &click.Time)
+		return click, err
+	})
+	if err != nil {
+		return nil, query.Wrap(qTrackerClicks, err)
+	}
+	return map[string]any{"clicks": clicks}, nil
+}
+
+// DeleteTrackers deletes the clicks of the tracking ids.  The click counts of the links
+// are kept, they are not tied to anyone.
+func (st *Store) DeleteTrackers(ctx context.Context, ids []string) (int64, error) {
+	tag, err := st.schema.Exec(ctx, st.db, qDeleteTrackerClicks, ids)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+func (st *Store) collect(rows pgx.Rows) ([]*Link, error) {
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (*Link, error) {
+		link := &Link{}
+		err := row.Scan(&link.Code, &link.URL, &link.Owner, &link.Created, &link.Expires, &link.Clicks, &link.Disabled, &link.Reason, &link.Deleted)
+		return link, err
+	})
+}
+
+// Links returns the links owned by the user, newest first.
+func (st *Store) Links(ctx context.Context, owner int) ([]*Link, error) {
+	rows, err := st.schema.Query(ctx, st.db, qOwnerLinks, owner)
+	if err != nil {
+		return nil, err
+	}
+	return st.collect(rows)
+}
+
+// Recent returns the newest links of all users for moderation, including deleted ones.
+func (st *Store) Recent(ctx context.Context, limit int) ([]*Link, error) {
+	rows, err := st.schema.Query(ctx, st.db, qRecentLinks, limit)
+	if err != nil {
+		return nil, err
+	}
+	return st.collect(rows)
+}
+
+// Delete soft deletes a link owned by the user.  The code stops resolving right away but
+// a moderator can restore it until it is purged.
+func (st *Store) Delete(ctx context.Context, owner int, code string) error {
+	cnt, err := st.schema.SoftDelete(ctx, st.db, "link", "code = $1 and owner_id = $2", code, owner)
+	if err != nil {
+		return err
+	}
+	if cnt == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Restore undeletes a link.
+func (st *Store) Restore(ctx context.Context, code string) error {
+	cnt, err := st.schema.Restore(ctx, st.db, "link", "code = $1", code)
+	if err != nil {
+		return err
+	}
+	if cnt == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Moderate disables or enables a link.  The reason is shown to the owner.
+func (st *Store) Moderate(ctx context.Context, code string, disabled bool, reason string) error {
+	tag, err := st.schema.Exec(ctx, st.db, qModerateLink, code, disabled, reason)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Purge deletes the links, and their clicks, that expired longer ago than the given
+// duration.
+func (st *Store) Purge(ctx context.Context, olderThan time.Duration) (int64, error) {
+	tag, err := st.schema.Exec(ctx, st.db, qPurgeLinks, time.Now().Add(-olderThan))
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+// PurgeDeleted removes the links, and their clicks, deleted longer ago than the given
+// duration.
+func (st *Store) PurgeDeleted(ctx context.Context, olderThan time.Duration) (int64, error) {
+	return st.schema.PurgeDeleted(ctx, st.db, "link", time.Now().Add(-olderThan))
+}
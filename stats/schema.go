@@ -0,0 +1,78 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+// Package stats creates the schema of the traffic stats the server persists, the bot
+// hits and the real user metrics.
+package stats
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// CreateSchema will create the stats schema and associated tables needed
+// for this package to run
+func CreateSchema(ctx context.Context, conn *pgx.Conn) error {
+	var sql string
+	var err error
+
+	sql = "drop schema if exists stats cascade;"
+	_, err = conn.Exec(ctx, sql)
+	if err != nil {
+		return err
+	}
+
+	sql = "create schema stats authorization current_role;"
+	_, err = conn.Exec(ctx, sql)
+	if err != nil {
+		return err
+	}
+
+	sql = `
+	CREATE TABLE stats.bot_hit (
+		"day" date NOT NULL,
+		bot varchar NOT NULL,
+		"path" varchar NOT NULL,
+		hits int8 NOT NULL,
+		total_ms float8 NOT NULL,
+		errors int8 NOT NULL,
+		last_ts timestamptz NOT NULL,
+		CONSTRAINT bot_hit_pk PRIMARY KEY (day, bot, path)
+	);`
+	_, err = conn.Exec(ctx, sql)
+	if err != nil {
+		return err
+	}
+
+	sql = "grant select, insert, update on table stats.bot_hit to api;"
+	_, err = conn.Exec(ctx, sql)
+	if err != nil {
+		return err
+	}
+
+	sql = `
+	CREATE TABLE stats.rum (
+		ts timestamptz NOT NULL,
+		route varchar NOT NULL,
+		metric varchar NOT NULL,
+		value float8 NOT NULL
+	);`
+	_, err = conn.Exec(ctx, sql)
+	if err != nil {
+		return err
+	}
+
+	sql = "CREATE INDEX rum_ts_idx ON stats.rum USING btree (ts);"
+	_, err = conn.Exec(ctx, sql)
+	if err != nil {
+		return err
+	}
+
+	sql = "grant select, insert, delete on table stats.rum to api;"
+	_, err = conn.Exec(ctx, sql)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
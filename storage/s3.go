@@ -0,0 +1,125 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+// Package storage copies files to remote object storage
+package storage
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3 uploads files to S3 compatible storage with a signature v4 signed PUT.
+type S3 struct {
+	Endpoint  string `json:"endpoint" doc:"ie: https://s3.us-east-1.amazonaws.com"`
+	Region    string `json:"region" doc:"region the requests are signed for, ie: us-east-1"`
+	Bucket    string `json:"bucket" doc:"name of the bucket"`
+	Prefix    string `json:"prefix" doc:"key prefix, ie: backups/"`
+	AccessKey string `json:"accessKey" doc:"access key id"`
+	SecretKey string `json:"secretKey" doc:"secret access key, ie: ${S3_SECRET_KEY}"`
+}
+
+// Upload puts the file in the bucket using path style addressing.
+func (s *S3) Upload(ctx context.Context, name string, file *os.File, size int64, _ string) error {
+	// s3 signs the sha256 of the payload, so hash it first and then rewind.
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	payloadHash := hex.EncodeToString(h.Sum(nil))
+
+	endpoint, err := url.Parse(strings.TrimSuffix(s.Endpoint, "/"))
+	if err != nil {
+		return err
+	}
+	endpoint.Path += "/" + s.Bucket + "/" + s.Prefix + name
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, endpoint.String(), file)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	s.sign(req, payloadHash, time.Now().UTC())
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1000))
+		return fmt.Errorf("s3 upload of %s failed with status %d: %s", name, resp.StatusCode, string(body))
+	}
+	return nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// sign adds the aws signature version 4 authorization header to the request.  The host
+// and every header already set on the request are signed.
+func (s *S3) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.Query().Encode(),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := day + "/" + s.Region + "/s3/aws4_request"
+	sum := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+
+	signature := hex.EncodeToString(hmacSHA256(signingKey(s.SecretKey, day, s.Region, "s3"), toSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.AccessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+// signingKey derives the signature version 4 key of the day, region and service.
+func signingKey(secret, day, region, service string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secret), day)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	return hmacSHA256(key, "aws4_request")
+}
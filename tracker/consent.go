@@ -0,0 +1,124 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package tracker
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Consent stores which optional features a visitor has agreed to.  It is read from the
+// consent cookie which holds a comma separated list of the granted features.
+type Consent struct {
+	Analytics       bool `json:"analytics"`
+	Personalization bool `json:"personalization"`
+}
+
+const (
+	consentAnalytics       = "analytics"
+	consentPersonalization = "personalization"
+)
+
+type consentKey struct{}
+
+// GetConsent calls GetConsent of the default Tracker.
+func GetConsent(r *http.Request) *Consent {
+	return defaultTracker.GetConsent(r)
+}
+
+// GetConsent returns the consent state of the visitor.  Visitors without a consent
+// cookie have not agreed to anything.
+func (t *Tracker) GetConsent(r *http.Request) *Consent {
+	consent := &Consent{}
+	c, err := r.Cookie(t.opts.ConsentName)
+	if err != nil {
+		return consent
+	}
+
+	for _, s := range strings.Split(c.Value, ",") {
+		switch strings.TrimSpace(s) {
+		case consentAnalytics:
+			consent.Analytics = true
+		case consentPersonalization:
+			consent.Personalization = true
+		}
+	}
+
+	return consent
+}
+
+// SetConsent calls SetConsent of the default Tracker.
+func SetConsent(w http.ResponseWriter, consent *Consent) {
+	defaultTracker.SetConsent(w, consent)
+}
+
+// SetConsent writes the consent cookie with the attributes of the tracking cookie.  It
+// is readable by scripts so the page can tell if the banner was answered.
+func (t *Tracker) SetConsent(w http.ResponseWriter, consent *Consent) {
+	var granted []string
+	if consent.Analytics {
+		granted = append(granted, consentAnalytics)
+	}
+	if consent.Personalization {
+		granted = append(granted, consentPersonalization)
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     t.opts.ConsentName,
+		Value:    strings.Join(granted, ","),
+		Domain:   t.opts.Domain,
+		Path:     t.opts.Path,
+		Expires:  t.opts.Clock.Now().Add(24 * 365 * time.Hour),
+		Secure:   !t.opts.Insecure,
+		HttpOnly: false,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// Key returns a short string that uniquely identifies the consent state so it can
+// be used to vary cache keys.
+func (c *Consent) Key() string {
+	bits := 0
+	if c.Analytics {
+		bits |= 1
+	}
+	if c.Personalization {
+		bits |= 2
+	}
+	return "c" + strconv.Itoa(bits)
+}
+
+// ParseConsentKey is the reverse of Consent.Key and can be used by cache getters
+// to decide what to render for a cache key.
+func ParseConsentKey(key string) *Consent {
+	consent := &Consent{}
+	if !strings.HasPrefix(key, "c") {
+		return consent
+	}
+
+	bits, err := strconv.Atoi(key[1:])
+	if err != nil {
+		return consent
+	}
+
+	consent.Analytics = bits&1 != 0
+	consent.Personalization = bits&2 != 0
+	return consent
+}
+
+// WithConsent returns a copy of ctx that carries the consent state.
+func WithConsent(ctx context.Context, consent *Consent) context.Context {
+	return context.WithValue(ctx, consentKey{}, consent)
+}
+
+// ConsentFromContext returns the consent state stored in ctx.  If none was
+// stored, an empty consent (nothing granted) is returned.
+func ConsentFromContext(ctx context.Context) *Consent {
+	if consent, ok := ctx.Value(consentKey{}).(*Consent); ok {
+		return consent
+	}
+	return &Consent{}
+}
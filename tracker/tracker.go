@@ -5,23 +5,80 @@ package tracker
 
 import (
 	"encoding/base64"
-	"math/rand"
 	"net/http"
-	"strconv"
 	"time"
 
 	"github.com/cespare/xxhash/v2"
+	"github.com/cwbriscoe/goweb/clock"
+	"github.com/cwbriscoe/goweb/cookies"
+	"github.com/cwbriscoe/goweb/internal/randid"
 	"github.com/goccy/go-json"
 )
 
-// These functions are *NOT* cryptographically secure so should not be used for
-// authorization.  Use the JWT access/refresh/session tokens for that.
-// The tracking cookie (named "id") can be used for the rate limiter or by the client
+// The ids are random but the cookie is only checksummed, not signed, so it must *NOT* be
+// used for authorization.  Use the JWT access/refresh/session tokens for that.
+// The tracking cookie (named "id" by default) can be used for the rate limiter or by the client
 // for display only info.
 
+// CookieOptions are the attributes of the tracking and consent cookies.
+type CookieOptions struct {
+	Name        string      // defaults to "id"
+	ConsentName string      // name of the consent cookie, defaults to "consent"
+	Domain      string      // defaults to the host that set the cookie
+	Path        string      // defaults to "/"
+	Insecure    bool        // omit the Secure attribute, only for local http development
+	Clock       clock.Clock // tells the time the cookie expires from, clock.Real when nil
+}
+
+// Tracker reads and writes the tracking and consent cookies with its own cookie
+// attributes, so servers running in the same process can use different cookies.
+type Tracker struct {
+	opts CookieOptions
+}
+
+// New returns a Tracker writing the cookie with the options.
+func New(opts CookieOptions) *Tracker {
+	if opts.Name == "" {
+		opts.Name = "id"
+	}
+	if opts.ConsentName == "" {
+		opts.ConsentName = "consent"
+	}
+	if opts.Path == "" {
+		opts.Path = "/"
+	}
+	if opts.Clock == nil {
+		opts.Clock = clock.Real
+	}
+	return &Tracker{opts: opts}
+}
+
+var defaultTracker = New(CookieOptions{})
+
+// Default returns the Tracker used by the package level functions.
+func Default() *Tracker {
+	return defaultTracker
+}
+
+// SetCookieOptions changes the attributes of the cookie of the default Tracker.  It
+// must be called before the server starts handling requests.
+func SetCookieOptions(opts CookieOptions) {
+	defaultTracker = New(opts)
+}
+
+// CookieName returns the name of the tracking cookie of the default Tracker.
+func CookieName() string {
+	return defaultTracker.CookieName()
+}
+
+// CookieName returns the name of the tracking cookie.
+func (t *Tracker) CookieName() string {
+	return t.opts.Name
+}
+
 // Info is used to uniquely identify repeat visitors for clients that use cookies.
 type Info struct {
-	ID    int64    `json:"id"`
+	ID    string   `json:"id"`
 	Name  string   `json:"name"`
 	Auth  bool     `json:"auth"`
 	Scope []string `json:"scope,omitempty"`
@@ -32,38 +89,97 @@ type payload struct {
 	Sig  uint64 `json:"sig"`
 }
 
+// GetTrackingInfo calls GetTrackingInfo of the default Tracker.
+func GetTrackingInfo(w http.ResponseWriter, r *http.Request) *Info {
+	return defaultTracker.GetTrackingInfo(w, r)
+}
+
 // GetTrackingInfo will return a valid tracking cookie whether it creates its own or
 // returns a previously stored tracking cookie
-func GetTrackingInfo(w http.ResponseWriter, r *http.Request) *Info {
-	info, err := getTrackingCookie(r)
+func (t *Tracker) GetTrackingInfo(w http.ResponseWriter, r *http.Request) *Info {
+	info, err := t.getTrackingCookie(r)
 	if err == nil {
 		if info != nil {
 			return info
 		}
 	}
 
-	if err = createAnonTracker(w); err != nil {
+	if err = t.createAnonTracker(w); err != nil {
 		return nil
 	}
 
 	return nil
 }
 
-// CreateAuthTracker returns a tracking cookie using the users authenticated account name.
+// CreateAuthTracker calls CreateAuthTracker of the default Tracker.
 func CreateAuthTracker(w http.ResponseWriter, name string, permissions []string) error {
+	return defaultTracker.CreateAuthTracker(w, name, permissions)
+}
+
+// CreateAuthTracker returns a tracking cookie using the users authenticated account name.
+func (t *Tracker) CreateAuthTracker(w http.ResponseWriter, name string, permissions []string) error {
+	id, err := NewID()
+	if err != nil {
+		return err
+	}
+	return t.CreateAuthTrackerWithID(w, id, name, permissions)
+}
+
+// nameLen is the number of random bytes in the display name of an anonymous visitor.
+const nameLen = 6
+
+// IDSize is the number of random bytes in a tracking id.  The 128 bits make collisions
+// between visitors negligible, the id is 32 hex characters.
+const IDSize = 16
+
+// NewID returns a random tracking id, it can't be guessed from the ids of other visitors.
+// The cookies written before the ids were widened have a numeric id and are replaced.
+func NewID() (string, error) {
+	return randid.Hex(IDSize)
+}
+
+// newName returns the random display name of an anonymous visitor.
+func newName() (string, error) {
+	return randid.Hex(nameLen)
+}
+
+// CreateAuthTrackerWithID calls CreateAuthTrackerWithID of the default Tracker.
+func CreateAuthTrackerWithID(w http.ResponseWriter, id string, name string, permissions []string) error {
+	return defaultTracker.CreateAuthTrackerWithID(w, id, name, permissions)
+}
+
+// CreateAuthTrackerWithID returns a tracking cookie using the users authenticated account
+// name while keeping an existing tracking id, so a visitor keeps the same id after signing in.
+func (t *Tracker) CreateAuthTrackerWithID(w http.ResponseWriter, id string, name string, permissions []string) error {
 	payload := &payload{
 		Info: &Info{
-			ID:    rand.Int63(),
+			ID:    id,
 			Name:  name,
 			Auth:  true,
 			Scope: permissions,
 		},
 	}
-	return createNewTracker(w, payload)
+	return t.createNewTracker(w, payload)
+}
+
+// ReadTrackingInfo calls ReadTrackingInfo of the default Tracker.
+func ReadTrackingInfo(r *http.Request) *Info {
+	return defaultTracker.ReadTrackingInfo(r)
+}
+
+// ReadTrackingInfo returns the validated tracking info from the request or nil if the
+// request does not have a valid tracking cookie.  Unlike GetTrackingInfo, it never
+// writes a new cookie.
+func (t *Tracker) ReadTrackingInfo(r *http.Request) *Info {
+	info, err := t.getTrackingCookie(r)
+	if err != nil {
+		return nil
+	}
+	return info
 }
 
-func getTrackingCookie(r *http.Request) (*Info, error) {
-	c, err := r.Cookie("id")
+func (t *Tracker) getTrackingCookie(r *http.Request) (*Info, error) {
+	c, err := r.Cookie(t.opts.Name)
 	if err != nil {
 		return nil, nil
 	}
@@ -98,44 +214,65 @@ func validateTrackingCookie(payload *payload) bool {
 	return true
 }
 
-func createAnonTracker(w http.ResponseWriter) error {
+func (t *Tracker) createAnonTracker(w http.ResponseWriter) error {
+	id, err := NewID()
+	if err != nil {
+		return err
+	}
+	name, err := newName()
+	if err != nil {
+		return err
+	}
 	payload := &payload{
 		Info: &Info{
-			ID:   rand.Int63(),
-			Name: strconv.FormatInt(rand.Int63(), 16)[8:],
+			ID:   id,
+			Name: name,
 			Auth: false,
 		},
 	}
-	return createNewTracker(w, payload)
+	return t.createNewTracker(w, payload)
 }
 
-func createNewTracker(w http.ResponseWriter, payload *payload) error {
-	bytes, err := json.Marshal(payload.Info)
+// createNewTracker signs and writes the payload.  The scope is only there for client
+// scripts, so it is dropped when it would make the cookie too large for browsers.
+func (t *Tracker) createNewTracker(w http.ResponseWriter, payload *payload) error {
+	c, err := t.trackingCookie(payload)
 	if err != nil {
 		return err
 	}
+	if !cookies.Fits(c) && len(payload.Info.Scope) > 0 {
+		payload.Info.Scope = nil
+		if c, err = t.trackingCookie(payload); err != nil {
+			return err
+		}
+	}
+
+	http.SetCookie(w, c)
+	return nil
+}
+
+// trackingCookie returns the cookie holding the signed payload.
+func (t *Tracker) trackingCookie(payload *payload) (*http.Cookie, error) {
+	bytes, err := json.Marshal(payload.Info)
+	if err != nil {
+		return nil, err
+	}
 
 	payload.Sig = xxhash.Sum64(bytes)
 
 	bytes, err = json.Marshal(payload)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return writeTrackingCookie(w, bytes)
-}
-
-func writeTrackingCookie(w http.ResponseWriter, bytes []byte) error {
-	val := base64.URLEncoding.EncodeToString(bytes)
-	http.SetCookie(w, &http.Cookie{
-		Name:     "id",
-		Value:    val,
-		Path:     "/",
-		Expires:  time.Now().Add(24 * 365 * time.Hour),
-		Secure:   true,
+	return &http.Cookie{
+		Name:     t.opts.Name,
+		Value:    base64.URLEncoding.EncodeToString(bytes),
+		Path:     t.opts.Path,
+		Domain:   t.opts.Domain,
+		Expires:  t.opts.Clock.Now().Add(24 * 365 * time.Hour),
+		Secure:   !t.opts.Insecure,
 		HttpOnly: false,
 		SameSite: http.SameSiteLaxMode,
-	})
-
-	return nil
+	}, nil
 }
@@ -0,0 +1,106 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package tracker
+
+import (
+	"encoding/hex"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNewID(t *testing.T) {
+	const count = 10000
+	seen := make(map[string]bool, count)
+	bits := make([]byte, IDSize)
+	for i := 0; i < count; i++ {
+		id, err := NewID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seen[id] {
+			t.Fatalf("id %s returned twice", id)
+		}
+		seen[id] = true
+
+		b, err := hex.DecodeString(id)
+		if err != nil || len(b) != IDSize {
+			t.Fatalf("expected %d hex encoded bytes, got %q", IDSize, id)
+		}
+		for j := range b {
+			bits[j] |= b[j]
+		}
+	}
+
+	// every bit should be set by some id, a math/rand or truncated source would leave
+	// some of them unused.
+	for j, b := range bits {
+		if b != 0xff {
+			t.Errorf("expected all 128 bits to be used, byte %d is %08b", j, b)
+		}
+	}
+}
+
+func TestNewName(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		name, err := newName()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(name) != nameLen*2 {
+			t.Fatalf("expected %d characters, got %q", nameLen*2, name)
+		}
+		if seen[name] {
+			t.Fatalf("name %q returned twice", name)
+		}
+		seen[name] = true
+	}
+}
+
+func TestAnonTracker(t *testing.T) {
+	tr := New(CookieOptions{})
+	ids := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		w := httptest.NewRecorder()
+		if info := tr.GetTrackingInfo(w, httptest.NewRequest("GET", "/", nil)); info != nil {
+			t.Fatal("expected no info without a cookie")
+		}
+
+		r := httptest.NewRequest("GET", "/", nil)
+		for _, c := range w.Result().Cookies() {
+			r.AddCookie(c)
+		}
+		info := tr.ReadTrackingInfo(r)
+		if info == nil || info.Auth || info.ID == "" {
+			t.Fatalf("expected a valid anonymous tracker, got %+v", info)
+		}
+		if ids[info.ID] {
+			t.Fatalf("id %s returned twice", info.ID)
+		}
+		ids[info.ID] = true
+	}
+}
+
+func TestConsentCookie(t *testing.T) {
+	local := New(CookieOptions{ConsentName: "app_consent", Path: "/app/", Insecure: true})
+	w := httptest.NewRecorder()
+	local.SetConsent(w, &Consent{Analytics: true})
+
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("expected 1 cookie, got %d", len(cookies))
+	}
+	c := cookies[0]
+	if c.Name != "app_consent" || c.Path != "/app/" || c.Secure || c.Value != "analytics" {
+		t.Errorf("expected the cookie options to be used, got %+v", c)
+	}
+
+	r := httptest.NewRequest("GET", "/app/", nil)
+	r.AddCookie(c)
+	if !local.GetConsent(r).Analytics {
+		t.Error("expected analytics consent")
+	}
+	if New(CookieOptions{}).GetConsent(r).Analytics {
+		t.Error("expected another tracker not to read the cookie")
+	}
+}
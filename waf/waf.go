@@ -0,0 +1,250 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+// Package waf evaluates operator defined rules against incoming requests before they
+// reach the handlers.  It is a lightweight firewall built on the limiter and auth data.
+package waf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/cwbriscoe/goutil/net"
+	"github.com/cwbriscoe/goweb/limiter"
+)
+
+// Action is what to do with a request that matches a rule.
+type Action string
+
+// The actions a rule can take.
+const (
+	Allow     Action = "allow"     // skip the remaining rules and serve the request
+	Deny      Action = "deny"      // return 403
+	Challenge Action = "challenge" // require the visitor to accept the tracking cookie
+	Tarpit    Action = "tarpit"    // hold the request for a while and then return 429
+	Reroute   Action = "reroute"   // serve the request from another path
+)
+
+// Rule is a set of conditions and the action to take when all of them match.
+// Empty conditions always match.
+type Rule struct {
+	Name      string   `json:"name" doc:"name of the rule in the logs"`
+	Path      string   `json:"path" doc:"regex matched against the url path"`
+	Method    string   `json:"method" doc:"comma separated list of methods"`
+	UserAgent string   `json:"userAgent" doc:"case insensitive regex matched against the user agent"`
+	Country   []string `json:"country" doc:"country codes from the configured country header"`
+	Visitor   string   `json:"visitor" doc:"kind of visitor" enum:"user,goodbot,badbot"`
+	Auth      string   `json:"auth" doc:"signed in or not" enum:"anon,auth"`
+	Action    Action   `json:"action" doc:"what to do with the matching requests" enum:"allow,deny,challenge,tarpit,reroute"`
+	Target    string   `json:"target" doc:"path used by the reroute action"`
+	Delay     int      `json:"delay" doc:"milliseconds the tarpit action holds the request"`
+
+	path      *regexp.Regexp
+	userAgent *regexp.Regexp
+	methods   []string
+}
+
+// Facts are the attributes of a request the rules are evaluated against.
+type Facts struct {
+	Path      string `json:"path"`
+	Method    string `json:"method"`
+	UserAgent string `json:"userAgent"`
+	Country   string `json:"country"`
+	Visitor   string `json:"visitor"`
+	Auth      string `json:"auth"`
+}
+
+// Decision is the result of evaluating the rules for a request.
+type Decision struct {
+	Rule   string        `json:"rule,omitempty"`
+	Action Action        `json:"action"`
+	Target string        `json:"target,omitempty"`
+	Delay  time.Duration `json:"delay,omitempty"`
+}
+
+// Settings contains the rules and options for an Engine.
+type Settings struct {
+	CountryHeader string                     // request header with the visitors country code, ie: CF-IPCountry
+	Limiters      *limiter.Registry          // knows the verified and flagged bots, the default registry when nil
+	SignedIn      func(r *http.Request) bool // verifies the auth tokens, everyone is anonymous when nil
+	Rules         []Rule
+}
+
+// Engine evaluates the rules in order, the first matching rule decides the action.
+type Engine struct {
+	countryHeader string
+	limiters      *limiter.Registry
+	signedIn      func(r *http.Request) bool
+	rules         atomic.Pointer[[]Rule]
+}
+
+type ctxKey struct{}
+
+// ErrInvalidAction is returned when a rule has an unknown action.
+var ErrInvalidAction = errors.New("invalid waf action")
+
+// NewEngine compiles the rules and returns a new Engine.
+func NewEngine(settings *Settings) (*Engine, error) {
+	e := &Engine{
+		countryHeader: settings.CountryHeader,
+		limiters:      settings.Limiters,
+		signedIn:      settings.SignedIn,
+	}
+	if e.limiters == nil {
+		e.limiters = limiter.DefaultRegistry()
+	}
+
+	if err := e.SetRules(settings.Rules); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// SetRules compiles the rules and replaces the rules of the engine, they are left
+// unchanged when one of them is not valid.  It is safe to call while requests are
+// evaluated.
+func (e *Engine) SetRules(rules []Rule) error {
+	compiled := make([]Rule, len(rules))
+	for i, rule := range rules {
+		var err error
+		if rule.Path != "" {
+			if rule.path, err = regexp.Compile(rule.Path); err != nil {
+				return fmt.Errorf("waf rule %q: %w", rule.Name, err)
+			}
+		}
+		if rule.UserAgent != "" {
+			if rule.userAgent, err = regexp.Compile("(?i)" + rule.UserAgent); err != nil {
+				return fmt.Errorf("waf rule %q: %w", rule.Name, err)
+			}
+		}
+		rule.methods = nil
+		for _, method := range strings.Split(rule.Method, ",") {
+			if method = strings.TrimSpace(method); method != "" {
+				rule.methods = append(rule.methods, strings.ToUpper(method))
+			}
+		}
+		switch rule.Action {
+		case Allow, Deny, Challenge, Tarpit:
+		case Reroute:
+			if rule.Target == "" {
+				return fmt.Errorf("waf rule %q: reroute requires a target", rule.Name)
+			}
+		default:
+			return fmt.Errorf("waf rule %q: %w: %s", rule.Name, ErrInvalidAction, rule.Action)
+		}
+		compiled[i] = rule
+	}
+
+	e.rules.Store(&compiled)
+	return nil
+}
+
+// Rules returns the configured rules.
+func (e *Engine) Rules() []Rule {
+	if e == nil {
+		return nil
+	}
+	if rules := e.rules.Load(); rules != nil {
+		return *rules
+	}
+	return nil
+}
+
+// GetFacts collects the attributes of the request used to evaluate the rules.
+func (e *Engine) GetFacts(r *http.Request) *Facts {
+	facts := &Facts{
+		Path:      r.URL.Path,
+		Method:    r.Method,
+		UserAgent: r.Header.Get("User-Agent"),
+		Visitor:   e.limiters.VisitorKind(net.GetIP(r)),
+		Auth:      "anon",
+	}
+
+	if e.countryHeader != "" {
+		facts.Country = strings.ToUpper(r.Header.Get(e.countryHeader))
+	}
+
+	// the tracking cookie can be forged, only the signed tokens are trusted.
+	if e.signedIn != nil && e.signedIn(r) {
+		facts.Auth = "auth"
+	}
+
+	return facts
+}
+
+// Evaluate returns the decision of the first rule matching the facts or Allow if
+// none of them match.
+func (e *Engine) Evaluate(facts *Facts) *Decision {
+	if e != nil {
+		rules := e.Rules()
+		for i := range rules {
+			rule := &rules[i]
+			if rule.match(facts) {
+				return &Decision{
+					Rule:   rule.Name,
+					Action: rule.Action,
+					Target: rule.Target,
+					Delay:  time.Duration(rule.Delay) * time.Millisecond,
+				}
+			}
+		}
+	}
+	return &Decision{Action: Allow}
+}
+
+func (rule *Rule) match(facts *Facts) bool {
+	if rule.path != nil && !rule.path.MatchString(facts.Path) {
+		return false
+	}
+	if len(rule.methods) > 0 && !contains(rule.methods, facts.Method) {
+		return false
+	}
+	if rule.userAgent != nil && !rule.userAgent.MatchString(facts.UserAgent) {
+		return false
+	}
+	if len(rule.Country) > 0 && !containsFold(rule.Country, facts.Country) {
+		return false
+	}
+	if rule.Visitor != "" && !strings.EqualFold(rule.Visitor, facts.Visitor) {
+		return false
+	}
+	if rule.Auth != "" && !strings.EqualFold(rule.Auth, facts.Auth) {
+		return false
+	}
+	return true
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// WithDecision returns a copy of the context with the decision stored in it.
+func WithDecision(ctx context.Context, d *Decision) context.Context {
+	return context.WithValue(ctx, ctxKey{}, d)
+}
+
+// DecisionFromContext returns the decision made for the request or nil if the
+// request was not evaluated.
+func DecisionFromContext(ctx context.Context) *Decision {
+	d, _ := ctx.Value(ctxKey{}).(*Decision)
+	return d
+}
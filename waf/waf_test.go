@@ -0,0 +1,76 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+package waf
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestEvaluate(t *testing.T) {
+	e, err := NewEngine(&Settings{
+		Rules: []Rule{
+			{Name: "admin", Path: "^/admin/", Auth: "anon", Action: Deny},
+			{Name: "scrapers", UserAgent: "curl|wget", Method: "get, head", Action: Tarpit, Delay: 500},
+			{Name: "geo", Country: []string{"xx"}, Action: Reroute, Target: "/blocked"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		facts  Facts
+		action Action
+		rule   string
+	}{
+		{Facts{Path: "/admin/cache/", Auth: "anon"}, Deny, "admin"},
+		{Facts{Path: "/admin/cache/", Auth: "auth"}, Allow, ""},
+		{Facts{Path: "/", Method: "GET", UserAgent: "Wget/1.21"}, Tarpit, "scrapers"},
+		{Facts{Path: "/", Method: "POST", UserAgent: "curl/8.0"}, Allow, ""},
+		{Facts{Path: "/", Country: "XX"}, Reroute, "geo"},
+	}
+
+	for _, test := range tests {
+		d := e.Evaluate(&test.facts)
+		if d.Action != test.action || d.Rule != test.rule {
+			t.Errorf("%+v: got %s(%s), want %s(%s)", test.facts, d.Action, d.Rule, test.action, test.rule)
+		}
+	}
+}
+
+func TestInvalidRule(t *testing.T) {
+	if _, err := NewEngine(&Settings{Rules: []Rule{{Name: "bad", Action: "drop"}}}); err == nil {
+		t.Error("expected error for invalid action")
+	}
+	if _, err := NewEngine(&Settings{Rules: []Rule{{Name: "bad", Action: Reroute}}}); err == nil {
+		t.Error("expected error for reroute without target")
+	}
+}
+
+func TestGetFactsAuth(t *testing.T) {
+	// a forged tracking cookie claiming a signed in user is ignored.
+	r := httptest.NewRequest("GET", "/admin/", nil)
+	r.AddCookie(&http.Cookie{Name: "id", Value: "forged"})
+
+	e, err := NewEngine(&Settings{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if facts := e.GetFacts(r); facts.Auth != "anon" {
+		t.Errorf("expected an anonymous visitor without SignedIn, got %q", facts.Auth)
+	}
+
+	e, err = NewEngine(&Settings{SignedIn: func(r *http.Request) bool { return r.Header.Get("Authorization") != "" }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if facts := e.GetFacts(r); facts.Auth != "anon" {
+		t.Errorf("expected an anonymous visitor without tokens, got %q", facts.Auth)
+	}
+	r.Header.Set("Authorization", "Bearer token")
+	if facts := e.GetFacts(r); facts.Auth != "auth" {
+		t.Errorf("expected a signed in visitor, got %q", facts.Auth)
+	}
+}
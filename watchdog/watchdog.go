@@ -0,0 +1,140 @@
+// Copyright 2023 Christopher Briscoe.  All rights reserved.
+
+// Package watchdog monitors process resources and reports when the process is overloaded
+package watchdog
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cwbriscoe/goutil/logging"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Settings contains the thresholds the watchdog checks.  A zero threshold is not checked.
+type Settings struct {
+	Interval      time.Duration   // how often to sample resources
+	MaxHeap       uint64          // max heap bytes in use
+	MaxGoroutines int             // max number of goroutines
+	MaxPoolUsage  float64         // max fraction (0-1) of db pool connections acquired
+	DB            *pgxpool.Pool   // optional db pool to monitor
+	Log           *logging.Logger // logger for state changes
+}
+
+// Status is a snapshot of the last sample taken by the watchdog.
+type Status struct {
+	Overloaded bool      `json:"overloaded"`
+	Reason     string    `json:"reason,omitempty"`
+	Heap       uint64    `json:"heap"`
+	Goroutines int       `json:"goroutines"`
+	PoolUsage  float64   `json:"poolUsage"`
+	Since      time.Time `json:"since,omitempty"`
+	Sampled    time.Time `json:"sampled"`
+}
+
+// Watchdog periodically samples heap usage, goroutine count and db pool saturation.
+type Watchdog struct {
+	sync.RWMutex
+	settings   *Settings
+	overloaded atomic.Bool
+	status     Status
+	stop       chan struct{}
+	stopOnce   sync.Once
+}
+
+// NewWatchdog creates a new watchdog.  Call Start to begin monitoring.
+func NewWatchdog(settings *Settings) *Watchdog {
+	if settings.Interval <= 0 {
+		settings.Interval = 5 * time.Second
+	}
+	return &Watchdog{
+		settings: settings,
+		stop:     make(chan struct{}),
+	}
+}
+
+// Start begins monitoring in a background goroutine.
+func (w *Watchdog) Start() {
+	go func() {
+		ticker := time.NewTicker(w.settings.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-w.stop:
+				return
+			case <-ticker.C:
+				w.sample()
+			}
+		}
+	}()
+	w.settings.Log.Info().Msg("watchdog started")
+}
+
+// Stop ends monitoring.
+func (w *Watchdog) Stop() {
+	w.stopOnce.Do(func() { close(w.stop) })
+}
+
+// Overloaded returns true if any threshold was crossed on the last sample.  It is safe
+// to call on a nil *Watchdog which is never overloaded.
+func (w *Watchdog) Overloaded() bool {
+	return w != nil && w.overloaded.Load()
+}
+
+// Status returns the last sample taken.
+func (w *Watchdog) Status() Status {
+	w.RLock()
+	defer w.RUnlock()
+	return w.status
+}
+
+func (w *Watchdog) sample() {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	status := Status{
+		Heap:       mem.HeapAlloc,
+		Goroutines: runtime.NumGoroutine(),
+		Sampled:    time.Now(),
+	}
+
+	if w.settings.DB != nil {
+		stat := w.settings.DB.Stat()
+		if stat.MaxConns() > 0 {
+			status.PoolUsage = float64(stat.AcquiredConns()) / float64(stat.MaxConns())
+		}
+	}
+
+	switch {
+	case w.settings.MaxHeap > 0 && status.Heap > w.settings.MaxHeap:
+		status.Reason = fmt.Sprintf("heap %d > %d", status.Heap, w.settings.MaxHeap)
+	case w.settings.MaxGoroutines > 0 && status.Goroutines > w.settings.MaxGoroutines:
+		status.Reason = fmt.Sprintf("goroutines %d > %d", status.Goroutines, w.settings.MaxGoroutines)
+	case w.settings.MaxPoolUsage > 0 && status.PoolUsage > w.settings.MaxPoolUsage:
+		status.Reason = fmt.Sprintf("db pool usage %.2f > %.2f", status.PoolUsage, w.settings.MaxPoolUsage)
+	}
+	status.Overloaded = status.Reason != ""
+
+	w.Lock()
+	prev := w.status
+	if status.Overloaded {
+		status.Since = prev.Since
+		if !prev.Overloaded {
+			status.Since = status.Sampled
+		}
+	}
+	w.status = status
+	w.Unlock()
+
+	w.overloaded.Store(status.Overloaded)
+
+	// only log transitions so an extended overload doesn't flood the log.
+	if status.Overloaded && !prev.Overloaded {
+		w.settings.Log.Warn().Msgf("watchdog: overloaded, shedding load: %s", status.Reason)
+	} else if !status.Overloaded && prev.Overloaded {
+		w.settings.Log.Info().Msgf("watchdog: recovered after %s", status.Sampled.Sub(prev.Since).String())
+	}
+}